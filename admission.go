@@ -0,0 +1,148 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the admission of the senders of a session, e.g. of a multicast
+ * group that accepts only the designated encoder.
+ */
+
+import (
+	"net"
+	"sort"
+	"time"
+)
+
+// maxIgnoredSenders limits the senders the session counts separately, the SSRCs of ignored
+// packets are not trusted.
+const maxIgnoredSenders = 256
+
+// SenderAdmission decides if the session accepts the packets of a sender, see
+// SetSenderAdmission. The session calls the function for every RTP packet and every compound
+// RTCP packet with a sender report, it must be fast and must not call methods of the session.
+//
+//   ssrc - the SSRC of the packet's sender
+//   ip   - the source IP address of the packet
+//
+type SenderAdmission func(ssrc uint32, ip net.IP) bool
+
+// IgnoredSender holds the counters of a sender that the admission ignored.
+type IgnoredSender struct {
+	Ssrc        uint32
+	Ip          net.IP // the source address of the last ignored packet
+	DataPackets uint64 // ignored RTP packets
+	Reports     uint64 // ignored compound RTCP packets with a sender report
+	Last        int64  // time in nanoseconds of the last ignored packet
+}
+
+// SetSenderAdmission sets the policy that decides which senders may send to the session, nil
+// accepts all senders.
+//
+// Many-to-many sessions, for example a multicast distribution group, receive the packets of
+// every host that sends to the group. With an admission the session ignores the RTP packets
+// and the sender reports of the senders that the admission does not accept: the packets don't
+// create input streams, don't update statistics and don't reach the application. Unlike a
+// SourceVerifier the admission also applies to existing input streams, a stricter policy ignores
+// an admitted sender from its next packet on and its stream times out. Receivers that send only
+// receiver reports stay members of the session.
+//
+// The session counts the ignored packets per sender, see IgnoredSenders, and sends a
+// SenderIgnoredData event for the first ignored RTP packet of a sender.
+//
+//   admit - the admission function, see also AdmitSenders
+//
+func (rs *Session) SetSenderAdmission(admit SenderAdmission) {
+	rs.admissionMutex.Lock()
+	rs.admission = admit
+	rs.admissionMutex.Unlock()
+}
+
+// AdmitSenders returns an admission that accepts the senders with one of the SSRCs and one of
+// the IP addresses. An empty list accepts any SSRC or any address.
+//
+//   ssrcs - the accepted SSRCs, e.g. the designated encoder's SSRC
+//   ips   - the accepted source addresses
+//
+func AdmitSenders(ssrcs []uint32, ips []net.IP) SenderAdmission {
+	ssrcSet := make(map[uint32]bool, len(ssrcs))
+	for _, ssrc := range ssrcs {
+		ssrcSet[ssrc] = true
+	}
+	ipSet := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		ipSet[string(ip.To16())] = true
+	}
+	return func(ssrc uint32, ip net.IP) bool {
+		if len(ssrcSet) > 0 && !ssrcSet[ssrc] {
+			return false
+		}
+		return len(ipSet) == 0 || ipSet[string(ip.To16())]
+	}
+}
+
+// IgnoredSenders returns the counters of the ignored senders ordered by SSRC and the number of
+// ignored packets of senders beyond the first 256.
+func (rs *Session) IgnoredSenders() (senders []IgnoredSender, overflow uint64) {
+	rs.admissionMutex.Lock()
+	defer rs.admissionMutex.Unlock()
+	for _, ign := range rs.ignored {
+		senders = append(senders, *ign)
+	}
+	sort.Slice(senders, func(i, j int) bool { return senders[i].Ssrc < senders[j].Ssrc })
+	return senders, rs.ignoredOverflow
+}
+
+// admitSender returns false and counts the packet if the admission ignores the sender.
+func (rs *Session) admitSender(ssrc uint32, ip net.IP, data bool) bool {
+	rs.admissionMutex.Lock()
+	admit := rs.admission
+	if admit == nil || admit(ssrc, ip) {
+		rs.admissionMutex.Unlock()
+		return true
+	}
+	ign := rs.ignored[ssrc]
+	first := ign == nil
+	if first {
+		if len(rs.ignored) >= maxIgnoredSenders {
+			rs.ignoredOverflow++
+			rs.admissionMutex.Unlock()
+			return false
+		}
+		if rs.ignored == nil {
+			rs.ignored = make(map[uint32]*IgnoredSender)
+		}
+		ign = &IgnoredSender{Ssrc: ssrc}
+		rs.ignored[ssrc] = ign
+	}
+	if !ign.Ip.Equal(ip) {
+		// a new slice, the copies returned by IgnoredSenders keep the old one
+		ign.Ip = append(net.IP(nil), ip...)
+	}
+	ign.Last = time.Now().UnixNano()
+	if data {
+		ign.DataPackets++
+	} else {
+		ign.Reports++
+	}
+	rs.admissionMutex.Unlock()
+	if first && data {
+		rs.sendDataCtrlEvent(SenderIgnoredData, ssrc, 0)
+	}
+	return false
+}
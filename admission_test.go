@@ -0,0 +1,95 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSenderAdmission(t *testing.T) {
+	parseFlags()
+
+	rs, _ := drainedSession(t)
+	events := rs.CreateCtrlEventChan()
+	encoder, other := net.IPv4(10, 0, 0, 5), net.IPv4(10, 0, 0, 6)
+	rs.SetSenderAdmission(AdmitSenders([]uint32{0xaa}, []net.IP{encoder}))
+
+	for seq := uint16(0); seq < 3; seq++ {
+		originData(rs, 0xaa, seq, &Address{encoder, 6000, 6001})
+		originData(rs, 0xbb, seq, &Address{encoder, 6010, 6011})
+	}
+	originData(rs, 0xaa, 3, &Address{other, 6000, 6001}) // the designated SSRC from another host
+	sr := impairPacket(true, false, 0xbb)
+	sr.fromAddr = Address{encoder, 0, 6011}
+	rs.OnRecvCtrl(sr)
+	rr := impairPacket(false, false, 0xcc) // a receiver stays a member
+	rr.fromAddr = Address{other, 0, 6021}
+	rs.OnRecvCtrl(rr)
+
+	members := map[uint32]bool{}
+	for _, info := range rs.InputStreams() {
+		members[info.Ssrc] = true
+	}
+	if len(members) != 2 || !members[0xaa] || !members[0xcc] {
+		t.Errorf("member check failed: %v\n", members)
+	}
+	if str, _, _ := rs.lookupSsrcMapIn(0xaa); str.Statistics().PacketCount != 3 {
+		t.Errorf("admitted stream check failed: %d packets\n", str.Statistics().PacketCount)
+	}
+	senders, overflow := rs.IgnoredSenders()
+	if len(senders) != 2 || overflow != 0 {
+		t.Errorf("IgnoredSenders check failed: %+v, %d\n", senders, overflow)
+		return
+	}
+	if senders[0].Ssrc != 0xaa || senders[0].DataPackets != 1 || !senders[0].Ip.Equal(other) {
+		t.Errorf("ignored 0xaa check failed: %+v\n", senders[0])
+	}
+	if senders[1].Ssrc != 0xbb || senders[1].DataPackets != 3 || senders[1].Reports != 1 || senders[1].Last == 0 {
+		t.Errorf("ignored 0xbb check failed: %+v\n", senders[1])
+	}
+	originData(rs, 0xaa, 4, &Address{net.IPv4(10, 0, 0, 7), 6000, 6001})
+	if !senders[0].Ip.Equal(other) {
+		t.Errorf("IgnoredSenders copy changed by a later packet: %v\n", senders[0].Ip)
+	}
+	ignoredEvents := 0
+	for len(events) > 0 {
+		for _, ev := range <-events {
+			if ev.EventType == SenderIgnoredData {
+				ignoredEvents++
+			}
+		}
+	}
+	if ignoredEvents != 2 {
+		t.Errorf("SenderIgnoredData events check failed: %d\n", ignoredEvents)
+	}
+
+	// without admission every sender is accepted
+	rs.SetSenderAdmission(nil)
+	originData(rs, 0xbb, 3, &Address{encoder, 6010, 6011})
+	if _, _, ok := rs.lookupSsrcMapIn(0xbb); !ok {
+		t.Errorf("sender not accepted without admission\n")
+	}
+	if admit := AdmitSenders(nil, nil); !admit(0x1234, other) {
+		t.Errorf("empty AdmitSenders rejected a sender\n")
+	}
+	if admit := AdmitSenders(nil, []net.IP{encoder}); admit(0xaa, other) || !admit(0x1234, encoder.To16()) {
+		t.Errorf("address AdmitSenders check failed\n")
+	}
+}
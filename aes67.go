@@ -0,0 +1,183 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+package rtp
+
+/*
+ * This source file contains the interoperability profile of professional audio over IP,
+ * AES67 and SMPTE ST 2110-30.
+ */
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// The packet times of AES67 and ST 2110-30. Level A receivers support 1 ms, level B and C
+// receivers also 125 µs.
+const (
+	Aes67Ptime    = time.Millisecond
+	Aes67PtimeLow = 125 * time.Microsecond
+)
+
+// aes67MaxPayload is the payload limit of AES67, the packets fit into a 1500 byte MTU.
+const aes67MaxPayload = 1440
+
+// Aes67Profile describes a linear PCM stream of AES67 or ST 2110-30. Zero values select the
+// defaults.
+type Aes67Profile struct {
+	PayloadType byte          // the dynamic payload type of the stream
+	Encoding    string        // "L16" or "L24" (default)
+	ClockRate   int           // sample rate, 48000 (default), 44100 or 96000
+	Channels    int           // 1 - 64, default 2, the packets must not exceed 1440 bytes
+	Ptime       time.Duration // packet time, Aes67Ptime (default) or Aes67PtimeLow, at most 4 ms
+}
+
+// PayloadFormat returns the payload format of the profile. The frame of the format is one
+// packet time of samples, the session sends and accepts only packets of exactly one frame.
+func (p Aes67Profile) PayloadFormat() (*PayloadFormat, error) {
+	if p.PayloadType < 96 || p.PayloadType > 127 {
+		return nil, Error("Aes67Profile: not a dynamic payload type.")
+	}
+	if p.Encoding == "" {
+		p.Encoding = "L24"
+	}
+	if p.ClockRate == 0 {
+		p.ClockRate = 48000
+	}
+	if p.Channels == 0 {
+		p.Channels = 2
+	}
+	if p.Ptime == 0 {
+		p.Ptime = Aes67Ptime
+	}
+	var sampleSize int
+	switch p.Encoding {
+	case "L16":
+		sampleSize = 2
+	case "L24":
+		sampleSize = 3
+	default:
+		return nil, Error("Aes67Profile: encoding " + p.Encoding + " is not L16 or L24.")
+	}
+	switch p.ClockRate {
+	case 44100, 48000, 96000:
+	default:
+		return nil, Error("Aes67Profile: unsupported sample rate " + strconv.Itoa(p.ClockRate) + ".")
+	}
+	if p.Channels < 1 || p.Channels > 64 {
+		return nil, Error("Aes67Profile: unsupported channel count.")
+	}
+	samples := int64(p.ClockRate) * int64(p.Ptime)
+	if p.Ptime <= 0 || p.Ptime > 4*time.Millisecond || samples%int64(time.Second) != 0 {
+		return nil, Error("Aes67Profile: the packet time is not a whole number of samples up to 4 ms.")
+	}
+	size := int(samples/int64(time.Second)) * p.Channels * sampleSize
+	if size > aes67MaxPayload {
+		return nil, Error("Aes67Profile: " + strconv.Itoa(size) + " bytes per packet exceed the MTU.")
+	}
+	return &PayloadFormat{TypeNumber: int(p.PayloadType), MediaType: Audio, ClockRate: p.ClockRate, Channels: p.Channels,
+		Name: p.Encoding, FrameDuration: p.Ptime, FrameSize: size}, nil
+}
+
+// strictPtime is the payload type with a strict packet time and its payload size.
+type strictPtime struct {
+	pt    byte
+	ptime time.Duration
+	size  int
+}
+
+// SetAes67Profile configures the session for AES67 and ST 2110-30 interoperability.
+//
+// The method registers the payload format of the profile in PayloadFormatMap, selects the
+// RTP/AVP profile and sets the reference clock of the direct media clock with offset 0, see
+// SetReferenceClock, thus the RTP timestamps count the samples since the PTP epoch. The
+// packet time is strict: WriteFrames sends one frame of exactly one packet time per packet,
+// and the session drops received packets of the payload type with another payload size and
+// records a FieldPtime diagnostic, see ParseDiagnostics. SdpMedia adds the ptime attribute.
+// Combine the profile with a source-specific multicast transport, see
+// NewTransportUDPSourceMulticast. Set the profile before the session starts.
+//
+//   p     - the stream's profile
+//   clock - the PTP disciplined reference clock
+//   ref   - the signaling of the reference clock, usually the PTP grandmaster and domain
+//
+func (rs *Session) SetAes67Profile(p Aes67Profile, clock ReferenceClock, ref TsRefClock) error {
+	if rs.rtcpServiceActive {
+		return Error("Set the AES67 profile before the session starts.")
+	}
+	if clock == nil {
+		return Error("The AES67 profile needs a reference clock.")
+	}
+	pf, err := p.PayloadFormat()
+	if err != nil {
+		return err
+	}
+	if err = rs.SetRtpProfile(RtpProfileAvp); err != nil {
+		return err
+	}
+	PayloadFormatMap[pf.TypeNumber] = pf
+	rs.SetReferenceClock(ref, clock, 0)
+	rs.strictPtime = &strictPtime{pt: p.PayloadType, ptime: pf.FrameDuration, size: pf.FrameSize}
+	return nil
+}
+
+// *** Local functions and methods.
+
+// checkStrictPtime returns false if the packet has the payload type with a strict packet time
+// and its payload is not one packet time. The session drops the packet.
+func (rs *Session) checkStrictPtime(rp *DataPacket) bool {
+	sp := rs.strictPtime
+	if sp == nil || rp.PayloadType() != sp.pt {
+		return true
+	}
+	if n := len(rp.Payload()); n != sp.size {
+		rs.diagnostics.record(rp.Ssrc(), FieldPtime, fmt.Sprintf("%d payload bytes, expected %d", n, sp.size), false)
+		return false
+	}
+	return true
+}
+
+// strictFrames returns the packet time of the payload type and checks the frames if the packet
+// time is strict, ok is false if it is not strict.
+func (rs *Session) strictFrames(pt byte, frames [][]byte) (ptime time.Duration, ok bool, err error) {
+	sp := rs.strictPtime
+	if sp == nil || pt != sp.pt {
+		return 0, false, nil
+	}
+	for _, frame := range frames {
+		if len(frame) != sp.size {
+			return 0, true, Error("Frame of " + strconv.Itoa(len(frame)) + " bytes, the strict packet time needs " + strconv.Itoa(sp.size) + ".")
+		}
+	}
+	return sp.ptime, true, nil
+}
+
+// sdpPtime returns the ptime attribute of a strict packet time among the payload types.
+func (rs *Session) sdpPtime(pts []byte) string {
+	sp := rs.strictPtime
+	if sp == nil {
+		return ""
+	}
+	for _, pt := range pts {
+		if pt == sp.pt {
+			return "a=ptime:" + strconv.FormatFloat(float64(sp.ptime)/float64(time.Millisecond), 'f', -1, 64) + "\r\n"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+package rtp
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAes67PayloadFormat(t *testing.T) {
+	parseFlags()
+
+	pf, err := Aes67Profile{PayloadType: 101}.PayloadFormat()
+	if err != nil || pf.Name != "L24" || pf.ClockRate != 48000 || pf.Channels != 2 || pf.FrameDuration != time.Millisecond || pf.FrameSize != 288 {
+		t.Errorf("default AES67 format check failed: %+v, %v\n", pf, err)
+	}
+	pf, err = Aes67Profile{PayloadType: 101, Encoding: "L16", Channels: 8, Ptime: Aes67PtimeLow}.PayloadFormat()
+	if err != nil || pf.FrameSize != 6*8*2 || pf.FrameSamples() != 6 {
+		t.Errorf("125 µs AES67 format check failed: %+v, %v\n", pf, err)
+	}
+	invalid := []Aes67Profile{
+		{PayloadType: 10},
+		{PayloadType: 101, Encoding: "L8"},
+		{PayloadType: 101, ClockRate: 32000},
+		{PayloadType: 101, Channels: 65},
+		{PayloadType: 101, ClockRate: 96000, Channels: 64},
+		{PayloadType: 101, Ptime: 333 * time.Microsecond},
+		{PayloadType: 101, Ptime: 8 * time.Millisecond},
+	}
+	for _, p := range invalid {
+		if _, err = p.PayloadFormat(); err == nil {
+			t.Errorf("invalid AES67 profile accepted: %+v\n", p)
+		}
+	}
+}
+
+func TestAes67Session(t *testing.T) {
+	parseFlags()
+	defer delete(PayloadFormatMap, 101)
+
+	ct := new(closeTransport)
+	rs := NewSession(ct, ct)
+	clock := &fixedClock{now: time.Unix(3000, 0)}
+	ref := TsRefClock{Source: "ptp", Value: "IEEE1588-2008:39-A7-94-FF-FE-07-CB-D0:0"}
+	if err := rs.SetAes67Profile(Aes67Profile{PayloadType: 101}, nil, ref); err == nil {
+		t.Errorf("SetAes67Profile accepted a nil clock\n")
+	}
+	if err := rs.SetAes67Profile(Aes67Profile{PayloadType: 101}, clock, ref); err != nil {
+		t.Errorf("SetAes67Profile failed: %s\n", err)
+		return
+	}
+	if rs.RtpProfile() != RtpProfileAvp {
+		t.Errorf("AES67 RTP profile check failed: %d\n", rs.RtpProfile())
+	}
+	media, _ := rs.SdpMedia(5004, []byte{101})
+	expected := "m=audio 5004 RTP/AVP 101\r\na=rtpmap:101 L24/48000/2\r\na=ptime:1\r\n" +
+		"a=ts-refclk:ptp=IEEE1588-2008:39-A7-94-FF-FE-07-CB-D0:0\r\na=mediaclk:direct=0\r\n"
+	if media != expected {
+		t.Errorf("AES67 SDP media check failed:\n%s\n", media)
+	}
+
+	local := net.IPv4(127, 0, 0, 1)
+	rs.AddRemote(&Address{local, 5006, 5007})
+	idx, _ := rs.NewSsrcStreamOut(&Address{local, 5004, 5005}, 0x01020304, 1)
+	str := rs.SsrcStreamOutForIndex(idx)
+	str.SetPayloadType(101)
+	str.SetPtime(4*time.Millisecond, 4*time.Millisecond)
+	rs.rtcpServiceActive = true
+	drainCtrl(t, rs)
+
+	stamp, _ := rs.MediaClockStamp(48000)
+	next, err := rs.WriteFrames(idx, stamp, [][]byte{make([]byte, 288), make([]byte, 288)})
+	if err != nil || next != stamp+96 || len(ct.captureWriter.data) != 2 {
+		t.Errorf("strict WriteFrames check failed: %d packets, %d, %v\n", len(ct.captureWriter.data), next-stamp, err)
+	}
+	if _, err = rs.WriteFrames(idx, next, [][]byte{make([]byte, 576)}); err == nil {
+		t.Errorf("strict WriteFrames accepted a frame of two packet times\n")
+	}
+
+	for _, size := range []int{288, 144} {
+		rp := newDataPacket()
+		rp.SetSsrc(0x0a0b0c0d)
+		rp.SetPayloadType(101)
+		rp.SetPayload(make([]byte, size))
+		rs.OnRecvData(rp)
+	}
+	diags, count := rs.ParseDiagnostics(0x0a0b0c0d)
+	if count != 1 || diags[0].Field != FieldPtime || diags[0].Repaired {
+		t.Errorf("strict ptime receive check failed: %d, %v\n", count, diags)
+	}
+}
+
+func TestSourceMulticastTransport(t *testing.T) {
+	parseFlags()
+
+	group := &net.IPAddr{IP: net.IPv4(232, 1, 2, 3)}
+	if _, err := NewTransportUDPSourceMulticast(group, &net.IPAddr{IP: net.ParseIP("2001:db8::1")}, 5004, nil); err == nil {
+		t.Errorf("IPv6 source accepted\n")
+	}
+	if _, err := NewTransportUDPSourceMulticast(&net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}, &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}, 5004, nil); err == nil {
+		t.Errorf("unicast group accepted\n")
+	}
+	tp, err := NewTransportUDPSourceMulticast(group, &net.IPAddr{IP: net.IPv4(192, 0, 2, 7)}, 5004, nil)
+	if err != nil || !tp.multicastSource.Equal(net.IPv4(192, 0, 2, 7)) {
+		t.Errorf("NewTransportUDPSourceMulticast failed: %v\n", err)
+	}
+	if _, _, err = NewTransportFromUri("mcast://232.1.2.3:5004?source=bogus"); err == nil || !strings.Contains(err.Error(), "source") {
+		t.Errorf("invalid SSM source URI accepted: %v\n", err)
+	}
+	if recv, _, err := NewTransportFromUri("mcast://232.1.2.3:5004?source=192.0.2.7"); err != nil || recv.(*TransportUDP).multicastSource == nil {
+		t.Errorf("SSM URI check failed: %v\n", err)
+	}
+}
@@ -0,0 +1,373 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the RTP profiles of a session and their feedback timing: the early
+ * feedback rules of RTP/AVPF (RFC 4585 chapter 3.5), RTP/AVP has no feedback messages.
+ */
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// RTP profiles, see SetRtpProfile.
+const (
+	RtpProfileAvp   = iota // RTP/AVP, RFC 3551: no feedback messages, the default
+	RtpProfileAvpf         // RTP/AVPF, RFC 4585: feedback messages
+	RtpProfileSavp         // RTP/SAVP, RFC 3711: no feedback messages, SRTP required
+	RtpProfileSavpf        // RTP/SAVPF, RFC 5124: feedback messages, SRTP required
+)
+
+// rtpProfileNames are the SDP transport protocols of the profiles.
+var rtpProfileNames = [...]string{"RTP/AVP", "RTP/AVPF", "RTP/SAVP", "RTP/SAVPF"}
+
+// AVPF feedback modes, see SetFeedbackMode.
+const (
+	FeedbackImmediate = iota // feedback messages go out at once while the bandwidth allows, RFC 4585 chapter 3.5.1, the default
+	FeedbackEarly            // at most one early packet between two regular reports, RFC 4585 chapter 3.5.3
+)
+
+// FeedbackStats counts the feedback messages (NACK, PLI) of a session by the way they went out.
+type FeedbackStats struct {
+	Immediate uint32 // RTCP packets sent at once in immediate feedback mode
+	Early     uint32 // early RTCP packets
+	Regular   uint32 // feedback messages that went out with a regular report
+	Dropped   uint32 // feedback messages dropped because the queue was full or the profile has no feedback
+}
+
+// feedbackState holds the early feedback state of RFC 4585 chapter 3.5.3, guarded by fbMutex.
+type feedbackState struct {
+	profile, mode int
+	reducedSize   bool     // early and immediate feedback goes out without RR and SDES, RFC 5506
+	credit        float64  // bandwidth left for immediate feedback until the next regular report
+	earlyUsed     bool     // an early packet went out since the last regular report, allow_early is false
+	earlyPending  bool     // an early packet waits for its dither time
+	delayNext     bool     // the next regular report goes out at tprev + 2 * interval
+	tprev, tnext  int64    // the regular schedule of the RTCP service
+	queue         [][]byte // feedback messages for the next early or regular packet
+	stats         FeedbackStats
+}
+
+// maxQueuedFeedback limits the feedback messages that wait for an early or regular packet.
+const maxQueuedFeedback = 16
+
+// SetRtpProfile selects the RTP profile of the session as negotiated in SDP. Set the profile
+// before the session starts.
+//
+// The feedback profiles RTP/AVPF and RTP/SAVPF send feedback messages (NACK, PLI) following
+// the feedback mode, see SetFeedbackMode. RTP/AVP and RTP/SAVP have no feedback messages: the
+// session drops the NACK messages of its NackGenerators, counted in FeedbackStats.Dropped, and
+// SendPli returns an error. The regular reports of these profiles don't carry feedback either,
+// a RTP/AVP peer does not expect the RTPFB and PSFB packets of RFC 4585. The
+// secure profiles RTP/SAVP and RTP/SAVPF require SRTP: StartSession returns an error unless
+// both transports of the session are a TransportSRTP with keys. SdpMedia writes the profile
+// into the media description.
+//
+//   profile - one of the RtpProfile constants
+//
+func (rs *Session) SetRtpProfile(profile int) error {
+	if profile < RtpProfileAvp || profile > RtpProfileSavpf {
+		return Error("Unknown RTP profile.")
+	}
+	if rs.rtcpServiceActive {
+		return Error("Set the RTP profile before the session starts.")
+	}
+	rs.fbMutex.Lock()
+	rs.fb.profile = profile
+	rs.fbMutex.Unlock()
+	return nil
+}
+
+// RtpProfile returns the RTP profile of the session.
+func (rs *Session) RtpProfile() int {
+	rs.fbMutex.Lock()
+	defer rs.fbMutex.Unlock()
+	return rs.fb.profile
+}
+
+// RtpProfileName returns the SDP transport protocol of a profile, e.g. "RTP/SAVPF".
+func RtpProfileName(profile int) string {
+	if profile < RtpProfileAvp || profile > RtpProfileSavpf {
+		return ""
+	}
+	return rtpProfileNames[profile]
+}
+
+// ParseRtpProfile returns the profile of a SDP transport protocol, e.g. "RTP/AVP".
+func ParseRtpProfile(name string) (int, error) {
+	for profile, n := range rtpProfileNames {
+		if strings.EqualFold(name, n) {
+			return profile, nil
+		}
+	}
+	return 0, Error("Unknown RTP profile: " + name)
+}
+
+// SetFeedbackMode sets the feedback mode of the feedback profiles.
+//
+// In immediate feedback mode the session sends each feedback message at once; use it if the
+// RTCP bandwidth allows a report per event, for example in a small session. The immediate
+// packets share the member's part of the RTCP bandwidth with the regular reports, RFC 4585
+// chapter 3.5.2: if the bandwidth left until the next regular report is used up, further
+// messages follow the early RTCP rules until the next regular report. In early RTCP mode
+// the session sends at most one early packet between two regular reports: it sends the first
+// feedback message after a random dither time of up to half the report interval, no dither
+// for two members, and delays the next regular report by one interval. Further feedback
+// messages go out with the early packet or with the next regular report, as do messages that
+// arrive shortly before a regular report.
+//
+//   mode - FeedbackImmediate or FeedbackEarly
+//
+func (rs *Session) SetFeedbackMode(mode int) error {
+	if mode < FeedbackImmediate || mode > FeedbackEarly {
+		return Error("Unknown feedback mode.")
+	}
+	rs.fbMutex.Lock()
+	rs.fb.mode = mode
+	rs.fbMutex.Unlock()
+	return nil
+}
+
+// SetRtcpReducedSize sends the early and immediate feedback packets as reduced size RTCP
+// (RFC 5506), the bare feedback messages without the RR and SDES of a compound packet. Enable it
+// only if the peer negotiated it, SdpMedia writes the rtcp-rsize attribute. By default the
+// feedback packets are compound packets of an RR or SR, the SDES of the first output stream and
+// the feedback messages, RFC 4585 chapter 3.1.
+func (rs *Session) SetRtcpReducedSize(on bool) {
+	rs.fbMutex.Lock()
+	rs.fb.reducedSize = on
+	rs.fbMutex.Unlock()
+}
+
+// RtcpReducedSize returns true if the session sends reduced size feedback packets.
+func (rs *Session) RtcpReducedSize() bool {
+	rs.fbMutex.Lock()
+	defer rs.fbMutex.Unlock()
+	return rs.fb.reducedSize
+}
+
+// FeedbackStats returns the counts of the feedback messages the session sent.
+func (rs *Session) FeedbackStats() FeedbackStats {
+	rs.fbMutex.Lock()
+	defer rs.fbMutex.Unlock()
+	return rs.fb.stats
+}
+
+// SendPli sends a Picture Loss Indication (RFC 4585 chapter 6.3.1) for the media SSRC, the
+// feedback timing follows the session's profile. The first output stream is the packet sender.
+func (rs *Session) SendPli(media uint32) error {
+	if !hasFeedback(rs.RtpProfile()) {
+		return errNoFeedback
+	}
+	rs.streamsMapMutex.Lock()
+	strOut, exists := rs.streamsOut[0]
+	rs.streamsMapMutex.Unlock()
+	if !exists {
+		return Error("No output stream to send feedback.")
+	}
+	rp, offset := strOut.newCtrlPacket(RtcpPsfb)
+	rp.SetCount(0, PsfbPli)
+	binary.BigEndian.PutUint32(rp.buffer[offset+rtcpSsrcLength:], media)
+	rp.inUse = offset + rtcpSsrcLength + rtcpSsrcLength
+	rp.SetLength(0, uint16(rp.inUse/4-1))
+	rs.sendFeedback(rp)
+	return nil
+}
+
+// *** Local functions and methods.
+
+const errNoFeedback = Error("The RTP profile has no feedback messages.")
+
+func hasFeedback(profile int) bool {
+	return profile == RtpProfileAvpf || profile == RtpProfileSavpf
+}
+
+func isSecure(profile int) bool {
+	return profile == RtpProfileSavpf || profile == RtpProfileSavp
+}
+
+// checkProfile returns an error if the transports don't match the secure profiles.
+func (rs *Session) checkProfile() error {
+	if !isSecure(rs.RtpProfile()) {
+		return nil
+	}
+	tpw, okw := rs.transportWrite.(*TransportSRTP)
+	tpr, okr := rs.transportRecv.(*TransportSRTP)
+	if !okw || !okr || (tpr.recv == nil && len(tpr.recvStreams) == 0) ||
+		(rs.role != RolePassive && tpw.send == nil && len(tpw.sendStreams) == 0) {
+		return Error("The RTP profile " + RtpProfileName(rs.RtpProfile()) + " requires SRTP transports with keys.")
+	}
+	return nil
+}
+
+// sendFeedback sends a feedback message following the profile and the feedback mode. The
+// method frees the packet.
+func (rs *Session) sendFeedback(rp *CtrlPacket) {
+	rs.streamsMapMutex.Lock()
+	members := len(rs.streamsIn) + len(rs.streamsOut)
+	rs.streamsMapMutex.Unlock()
+	msg := append([]byte{}, rp.buffer[0:rp.inUse]...)
+	rp.FreePacket()
+
+	rs.fbMutex.Lock()
+	fb := &rs.fb
+	if !hasFeedback(fb.profile) {
+		fb.stats.Dropped++
+		rs.fbMutex.Unlock()
+		return
+	}
+	if fb.mode == FeedbackImmediate {
+		reducedSize := fb.reducedSize
+		rs.fbMutex.Unlock()
+		rc := rs.feedbackPacket([][]byte{msg}, reducedSize)
+		rs.fbMutex.Lock()
+		if size := float64(rc.inUse + 20 + 8); size <= fb.credit { // IP and UDP header as in the RTCP service
+			fb.credit -= size
+			fb.stats.Immediate++
+			rs.fbMutex.Unlock()
+			rs.WriteCtrl(rc)
+			rc.FreePacket()
+			return
+		}
+		rc.FreePacket() // the bandwidth is used up, follow the early RTCP rules
+	}
+	now := time.Now().UnixNano()
+	if len(fb.queue) == maxQueuedFeedback {
+		fb.queue = fb.queue[1:]
+		fb.stats.Dropped++
+	}
+	fb.queue = append(fb.queue, msg)
+
+	var ditherMax int64
+	if members > 2 {
+		ditherMax = (fb.tnext - fb.tprev) / 2
+	}
+	if fb.earlyUsed || fb.tnext-now <= ditherMax {
+		rs.fbMutex.Unlock() // goes with the pending early packet or the next regular report
+		return
+	}
+	fb.earlyUsed, fb.earlyPending, fb.delayNext = true, true, true
+	rs.fbMutex.Unlock()
+
+	if ditherMax == 0 {
+		rs.sendEarlyFeedback()
+		return
+	}
+	var rnd [4]byte
+	rand.Read(rnd[:])
+	dither := time.Duration(int64(binary.BigEndian.Uint32(rnd[:])) * ditherMax >> 32)
+	time.AfterFunc(dither, rs.sendEarlyFeedback)
+}
+
+// sendEarlyFeedback sends the queued feedback messages in an early RTCP packet.
+func (rs *Session) sendEarlyFeedback() {
+	rs.fbMutex.Lock()
+	queue := rs.fb.queue
+	reducedSize := rs.fb.reducedSize
+	rs.fb.queue = nil
+	rs.fb.earlyPending = false
+	if len(queue) > 0 {
+		rs.fb.stats.Early++
+	} else {
+		rs.fb.earlyUsed = false
+	}
+	rs.fbMutex.Unlock()
+	if len(queue) == 0 {
+		return // a regular report took the messages
+	}
+	rc := rs.feedbackPacket(queue, reducedSize)
+	rs.WriteCtrl(rc)
+	rc.FreePacket()
+}
+
+// feedbackPacket creates the RTCP packet of early or immediate feedback messages: a compound of
+// an RR or SR without report blocks, the SDES of the first output stream and the messages, or
+// the bare messages if the session sends reduced size RTCP. Messages that exceed the compound
+// size are dropped.
+func (rs *Session) feedbackPacket(msgs [][]byte, reducedSize bool) (rc *CtrlPacket) {
+	rs.streamsMapMutex.Lock()
+	strOut, exists := rs.streamsOut[0]
+	rs.streamsMapMutex.Unlock()
+	if reducedSize || !exists {
+		rc, _ = newCtrlPacket()
+		rc.inUse = 0
+	} else {
+		rc = rs.buildRtcpPkt(strOut, 0)
+	}
+	for _, msg := range msgs {
+		if rc.inUse+len(msg) <= rs.RtcpMaxSize() {
+			rc.inUse += copy(rc.buffer[rc.inUse:], msg)
+		}
+	}
+	return
+}
+
+// addQueuedFeedback appends the queued feedback messages to a regular report. The RTCP service
+// calls it before it sends the report, messages that exceed the compound size stay queued.
+func (rs *Session) addQueuedFeedback(rc *CtrlPacket) {
+	rs.fbMutex.Lock()
+	defer rs.fbMutex.Unlock()
+	rest := rs.fb.queue[:0]
+	for _, msg := range rs.fb.queue {
+		if rc.inUse+len(msg) > rs.RtcpMaxSize() {
+			rest = append(rest, msg)
+			continue
+		}
+		rc.inUse += copy(rc.buffer[rc.inUse:], msg)
+		rs.fb.stats.Regular++
+	}
+	rs.fb.queue = rest
+}
+
+// scheduleFeedback keeps the schedule of the regular reports after the RTCP service sent a
+// report at tprev, the next early packet is allowed again. The bandwidth for immediate feedback
+// until tnext is the member's share of the RTCP bandwidth less the regular report.
+func (rs *Session) scheduleFeedback(tprev, tnext int64) {
+	rs.streamsMapMutex.Lock()
+	members := len(rs.streamsIn) + len(rs.streamsOut)
+	rs.streamsMapMutex.Unlock()
+	if members == 0 {
+		members = 1
+	}
+	credit := rs.RtcpSessionBandwidth/float64(members)*float64(tnext-tprev)/1e9 - rs.avrgPacketLength
+
+	rs.fbMutex.Lock()
+	rs.fb.tprev, rs.fb.tnext = tprev, tnext
+	rs.fb.credit = credit
+	rs.fb.earlyUsed = rs.fb.earlyPending
+	rs.fb.delayNext = false
+	rs.fbMutex.Unlock()
+}
+
+// feedbackNext returns the time of the next regular report. After an early packet the next
+// report goes out one interval later, tn = tp + 2 * T_rr.
+func (rs *Session) feedbackNext(tnext int64) int64 {
+	rs.fbMutex.Lock()
+	defer rs.fbMutex.Unlock()
+	if rs.fb.delayNext {
+		rs.fb.delayNext = false
+		rs.fb.tnext = rs.fb.tprev + 2*(rs.fb.tnext-rs.fb.tprev)
+		return rs.fb.tnext
+	}
+	return tnext
+}
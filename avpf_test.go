@@ -0,0 +1,210 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func isPli(data []byte, media uint32) bool {
+	rc, _ := NewCtrlPacketFromBuffer(data)
+	return rc.Type(0) == RtcpPsfb && rc.Count(0) == PsfbPli && rc.InUse() == 12 && rc.Ssrc(4) == media
+}
+
+// feedbackSession returns a session with the RTP/AVPF profile and the RTCP bandwidth and
+// report schedule of a 64 kbit/s stream, see closeSession.
+func feedbackSession(reducedSize bool) (*Session, *closeTransport) {
+	rs, ct := closeSession(false)
+	rs.rtcpServiceActive = false
+	rs.SetRtpProfile(RtpProfileAvpf)
+	rs.rtcpServiceActive = true
+	rs.SetRtcpReducedSize(reducedSize)
+	rs.RtcpSessionBandwidth = 64000. / 20.
+	now := time.Now().UnixNano()
+	rs.scheduleFeedback(now, now+int64(5*time.Second))
+	return rs, ct
+}
+
+func TestFeedbackImmediate(t *testing.T) {
+	parseFlags()
+
+	rs, ct := feedbackSession(true)
+	rs.SendPli(0x0a0b0c0d)
+	rs.SendPli(0x0a0b0c0d)
+	if len(ct.captureWriter.ctrl) != 2 || !isPli(ct.captureWriter.ctrl[1], 0x0a0b0c0d) {
+		t.Errorf("Immediate feedback check failed, sent: %d\n", len(ct.captureWriter.ctrl))
+	}
+	if stats := rs.FeedbackStats(); stats.Immediate != 2 {
+		t.Errorf("Immediate feedback stats check failed: %+v\n", stats)
+	}
+	if err := rs.SetRtpProfile(RtpProfileAvp); err == nil {
+		t.Errorf("SetRtpProfile must fail after the session started\n")
+	}
+
+	// Without reduced size the feedback message follows an RR and the SDES
+	rs, ct = feedbackSession(false)
+	rs.SendPli(0x0a0b0c0d)
+	if len(ct.captureWriter.ctrl) != 1 {
+		t.Errorf("Compound feedback check failed, sent: %d\n", len(ct.captureWriter.ctrl))
+		return
+	}
+	pkt := ct.captureWriter.ctrl[0]
+	rc, _ := NewCtrlPacketFromBuffer(pkt)
+	offset := int(rc.Length(0)+1) * 4
+	sdes := offset
+	offset += int(rc.Length(offset)+1) * 4
+	if rc.Type(0) != RtcpRR || rc.Type(sdes) != RtcpSdes || offset+12 != len(pkt) || !isPli(pkt[offset:], 0x0a0b0c0d) {
+		t.Errorf("Compound feedback packet check failed\n")
+	}
+
+	// The bandwidth left until the next regular report limits the immediate packets, there
+	// is room for 25 bytes: the PLI goes out as early packet, the next waits for the report
+	rs, ct = feedbackSession(true)
+	rs.RtcpSessionBandwidth = 10
+	now := time.Now().UnixNano()
+	rs.scheduleFeedback(now, now+int64(5*time.Second))
+	rs.SendPli(0x0a0b0c0d)
+	rs.SendPli(0x0a0b0c0e)
+	if stats := rs.FeedbackStats(); len(ct.captureWriter.ctrl) != 1 || stats.Immediate != 0 || stats.Early != 1 {
+		t.Errorf("Immediate feedback bandwidth check failed: %+v\n", stats)
+	}
+}
+
+func TestFeedbackAvp(t *testing.T) {
+	parseFlags()
+
+	rs, ct := closeSession(false)
+	rs.rtcpServiceActive = false
+	if err := rs.SetRtpProfile(RtpProfileAvp); err != nil {
+		t.Errorf("SetRtpProfile failed: %s\n", err.Error())
+	}
+	rs.rtcpServiceActive = true
+	if err := rs.SendPli(0x0a0b0c0d); err == nil {
+		t.Errorf("AVP must not send a PLI\n")
+	}
+	rs.sendNack(0x0a0b0c0d, NackFci([]uint16{3}))
+	rs.SetFeedbackMode(FeedbackEarly)
+	rs.sendNack(0x0a0b0c0d, NackFci([]uint16{4}))
+	if len(ct.captureWriter.ctrl) != 0 {
+		t.Errorf("AVP must not send feedback messages, sent: %d\n", len(ct.captureWriter.ctrl))
+	}
+	rc, _ := rs.SsrcStreamOut().newCtrlPacket(RtcpRR)
+	rc.inUse = rtcpHeaderLength + rtcpSsrcLength
+	rs.addQueuedFeedback(rc)
+	if stats := rs.FeedbackStats(); rc.InUse() != 8 || stats.Dropped != 2 || stats.Regular != 0 {
+		t.Errorf("AVP feedback must not wait for the regular report: %+v\n", stats)
+	}
+}
+
+func TestRtpProfile(t *testing.T) {
+	parseFlags()
+
+	for _, name := range []string{"RTP/AVPF", "RTP/AVP", "RTP/SAVPF", "RTP/SAVP"} {
+		profile, err := ParseRtpProfile(name)
+		if err != nil || RtpProfileName(profile) != name {
+			t.Errorf("RTP profile name check failed: %s\n", name)
+		}
+	}
+	if _, err := ParseRtpProfile("UDP/TLS/RTP/SAVPF"); err == nil {
+		t.Errorf("ParseRtpProfile accepted an unknown profile\n")
+	}
+
+	plain := NewSession(new(captureWriter), new(teeConsumer))
+	if plain.RtpProfile() != RtpProfileAvp {
+		t.Errorf("The default RTP profile must be RTP/AVP: %d\n", plain.RtpProfile())
+	}
+	plain.SetRtpProfile(RtpProfileSavpf)
+	if err := plain.StartSession(); err == nil {
+		t.Errorf("RTP/SAVPF must require SRTP transports\n")
+	}
+	key := srtpMasterKeySalt()
+	recvOnly, _ := NewTransportSRTP(new(teeConsumer), new(captureWriter), nil, key)
+	rs := NewSession(recvOnly, recvOnly)
+	rs.SetRtpProfile(RtpProfileSavp)
+	if err := rs.checkProfile(); err == nil {
+		t.Errorf("RTP/SAVP must require a send key\n")
+	}
+	srtp, _ := NewTransportSRTP(new(teeConsumer), new(captureWriter), key, key)
+	rs = NewSession(srtp, srtp)
+	rs.SetRtpProfile(RtpProfileSavp)
+	if err := rs.checkProfile(); err != nil {
+		t.Errorf("RTP/SAVP check failed: %s\n", err.Error())
+	}
+}
+
+func TestFeedbackEarly(t *testing.T) {
+	parseFlags()
+
+	// Point to point: two members, the early packet has no dither
+	rs, ct := feedbackSession(true)
+	rs.SetFeedbackMode(FeedbackEarly)
+	now := time.Now().UnixNano()
+	rs.scheduleFeedback(now, now+int64(5*time.Second))
+	rs.SendPli(0x0a0b0c0d)
+	rs.SendPli(0x0a0b0c0e)
+	if len(ct.captureWriter.ctrl) != 1 || !isPli(ct.captureWriter.ctrl[0], 0x0a0b0c0d) {
+		t.Errorf("Early packet check failed, sent: %d\n", len(ct.captureWriter.ctrl))
+	}
+	if next := rs.feedbackNext(now + int64(5*time.Second)); next != now+int64(10*time.Second) {
+		t.Errorf("The regular report after an early packet must move by an interval: %d\n", next-now)
+	}
+	rc, _ := newCtrlPacket()
+	rc.inUse = 0
+	rs.addQueuedFeedback(rc)
+	if rc.inUse != 12 || !isPli(rc.buffer[0:12], 0x0a0b0c0e) {
+		t.Errorf("Second feedback message must wait for the regular report\n")
+	}
+	rs.scheduleFeedback(now+int64(10*time.Second), now+int64(15*time.Second))
+	rs.SendPli(0x0a0b0c0f)
+	if stats := rs.FeedbackStats(); len(ct.captureWriter.ctrl) != 2 || stats.Early != 2 || stats.Regular != 1 {
+		t.Errorf("Early packet after a regular report check failed: %+v\n", stats)
+	}
+
+	// Three members: a regular report within the dither time takes the feedback
+	rs, ct = feedbackSession(true)
+	drainCtrl(t, rs)
+	rs.SetFeedbackMode(FeedbackEarly)
+	quirkData(rs, 0x0a0b0c0d, 1, &Address{IpAddr: net.IPv4(127, 0, 0, 1), DataPort: 6002, CtrlPort: 6003})
+	now = time.Now().UnixNano()
+	rs.scheduleFeedback(now-int64(time.Second), now+int64(10*time.Millisecond))
+	rs.SendPli(0x0a0b0c0d)
+	if stats := rs.FeedbackStats(); len(ct.captureWriter.ctrl) != 0 || stats.Early != 0 {
+		t.Errorf("Feedback shortly before a regular report must wait for it: %+v\n", stats)
+	}
+	rc, _ = newCtrlPacket()
+	rc.inUse = 0
+	rs.addQueuedFeedback(rc)
+	if rc.inUse != 12 {
+		t.Errorf("Regular report does not carry the feedback, length: %d\n", rc.inUse)
+	}
+
+	// Three members and a far regular report: the early packet goes out after the dither time
+	now = time.Now().UnixNano()
+	rs.scheduleFeedback(now, now+int64(40*time.Millisecond))
+	rs.SendPli(0x0a0b0c0d)
+	rs.SendPli(0x0a0b0c0e)
+	for i := 0; i < 50 && rs.FeedbackStats().Early == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := rs.FeedbackStats(); stats.Early != 1 {
+		t.Errorf("Dithered early packet check failed: %+v\n", stats)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// BitrateStats contains the bitrates of a stream in bits per second over the standard rolling
+// windows, and the highest 1 second bitrate since the stream started. The bitrates count the
+// RTP packets including the RTP headers.
+type BitrateStats struct {
+	Rate1s, Rate5s, Rate30s float64
+	Peak                    float64
+}
+
+const (
+	bitrateBucket  = 100 * time.Millisecond
+	bitrateHistory = 30 * time.Second // the longest window
+	bitrateBuckets = int(bitrateHistory / bitrateBucket)
+)
+
+// bitrateMeter counts the bytes of a stream in buckets of 100 ms. The meter uses 32 bit atomic
+// operations only, thus the send and receive paths don't take an additional lock and the meter
+// needs no 64 bit alignment. A concurrent rollover of a bucket may lose the bytes of a packet,
+// the rates are estimates anyway.
+type bitrateMeter struct {
+	buckets [bitrateBuckets]struct {
+		slot  uint32 // the 100 ms interval the bucket counts, wraps around
+		bytes uint32
+	}
+	peak uint32 // bytes of the best 1 second window
+}
+
+// add counts the bytes of a packet at time now, in nanoseconds.
+func (bm *bitrateMeter) add(bytes int, now int64) {
+	slot := uint32(now / int64(bitrateBucket))
+	b := &bm.buckets[slot%uint32(bitrateBuckets)]
+	if old := atomic.LoadUint32(&b.slot); old != slot {
+		if atomic.CompareAndSwapUint32(&b.slot, old, slot) {
+			atomic.StoreUint32(&b.bytes, 0)
+			bm.updatePeak(slot - 1) // the last second before the new bucket is complete
+		}
+	}
+	atomic.AddUint32(&b.bytes, uint32(bytes))
+}
+
+// sum returns the bytes of the buckets in (last-n, last].
+func (bm *bitrateMeter) sum(last uint32, n int) (bytes uint64) {
+	for i := 0; i < n; i++ {
+		slot := last - uint32(i)
+		b := &bm.buckets[slot%uint32(bitrateBuckets)]
+		if atomic.LoadUint32(&b.slot) == slot {
+			bytes += uint64(atomic.LoadUint32(&b.bytes))
+		}
+	}
+	return
+}
+
+func (bm *bitrateMeter) updatePeak(last uint32) {
+	bytes := uint32(bm.sum(last, int(time.Second/bitrateBucket)))
+	for {
+		peak := atomic.LoadUint32(&bm.peak)
+		if bytes <= peak || atomic.CompareAndSwapUint32(&bm.peak, peak, bytes) {
+			return
+		}
+	}
+}
+
+// rate returns the bitrate over the window that ends at now, in nanoseconds. The window is
+// at most 30 seconds.
+func (bm *bitrateMeter) rate(window time.Duration, now int64) float64 {
+	if window > bitrateHistory {
+		window = bitrateHistory
+	}
+	n := int(window / bitrateBucket)
+	if n < 1 {
+		n = 1
+	}
+	return float64(bm.sum(uint32(now/int64(bitrateBucket)), n)*8) / (time.Duration(n) * bitrateBucket).Seconds()
+}
+
+func (bm *bitrateMeter) stats(now int64) BitrateStats {
+	bs := BitrateStats{
+		Rate1s:  bm.rate(time.Second, now),
+		Rate5s:  bm.rate(5*time.Second, now),
+		Rate30s: bm.rate(30*time.Second, now),
+		Peak:    float64(atomic.LoadUint32(&bm.peak)) * 8,
+	}
+	if bs.Rate1s > bs.Peak {
+		bs.Peak = bs.Rate1s
+	}
+	return bs
+}
+
+// Bitrate returns the bitrate of the stream in bits per second over a rolling window that ends
+// now: the sent packets of an output stream, the received packets of an input stream. The
+// window has a 100 ms granularity and is at most 30 seconds.
+//
+//   window - the duration of the window, e.g. 1 s for a congestion controller
+//
+func (str *SsrcStream) Bitrate(window time.Duration) float64 {
+	return str.bitrate.rate(window, time.Now().UnixNano())
+}
+
+// BitrateStats returns the bitrates of the stream over the standard windows and its peak bitrate.
+func (str *SsrcStream) BitrateStats() BitrateStats {
+	return str.bitrate.stats(time.Now().UnixNano())
+}
@@ -0,0 +1,66 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBitrate(t *testing.T) {
+	parseFlags()
+
+	// 1000 bytes every 100 ms for 10 seconds: 80 kbit/s, then a 1 second burst of 4 times the rate
+	bm := new(bitrateMeter)
+	start := time.Now().UnixNano()
+	now := start
+	for i := 0; i < 100; i++ {
+		bm.add(1000, now)
+		now += int64(bitrateBucket)
+	}
+	for i := 0; i < 10; i++ {
+		bm.add(4000, now)
+		now += int64(bitrateBucket)
+	}
+	bm.add(1000, now) // completes the burst second
+	if rate := bm.rate(time.Second, now-int64(bitrateBucket)); rate != 320000 {
+		t.Errorf("1 s rate check failed. Expected: 320000, got: %f\n", rate)
+	}
+	if rate := bm.rate(5*time.Second, now-int64(bitrateBucket)); rate != (40*1000+10*4000)*8/5 {
+		t.Errorf("5 s rate check failed. Expected: %d, got: %f\n", (40*1000+10*4000)*8/5, rate)
+	}
+	bs := bm.stats(now + int64(2*time.Second))
+	if bs.Rate1s != 0 || bs.Peak != 320000 {
+		t.Errorf("Peak check failed: %+v\n", bs)
+	}
+	if bs.Rate30s != float64(100*1000+10*4000+1000)*8/30 {
+		t.Errorf("30 s rate check failed: %f\n", bs.Rate30s)
+	}
+
+	rs, _ := closeSession(false)
+	rp := rs.NewDataPacket(0)
+	rp.SetPayload(make([]byte, 160))
+	rs.WriteData(rp)
+	rp.FreePacket()
+	for _, info := range rs.OutputStreams() {
+		if info.Index == 0 && info.Bitrate.Rate1s != (160+rtpHeaderLength)*8 {
+			t.Errorf("Send bitrate check failed: %+v\n", info.Bitrate)
+		}
+	}
+}
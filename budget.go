@@ -0,0 +1,238 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the bandwidth budget that splits a contracted send rate across the
+ * output streams of a session.
+ */
+
+import (
+	"time"
+)
+
+// defaultBudgetWeights favours audio over video over FEC over retransmissions.
+var defaultBudgetWeights = [trafficClasses]float64{8, 4, 2, 1}
+
+const (
+	defaultBudgetBurst = 50 * time.Millisecond
+	errBudget          = Error("The bandwidth budget is exhausted.")
+)
+
+// BudgetStats holds the counters of one traffic class of the bandwidth budget.
+type BudgetStats struct {
+	Class          int
+	Weight         float64
+	SentOctets     uint64 // octets sent to all remotes
+	SentPackets    uint64
+	DroppedPackets uint64 // packets the budget refused, a Scheduler's retry counts again
+}
+
+// bandwidthBudget is a token bucket per traffic class. The refill splits the session's rate by
+// the weights of the classes, the share of a class with a full bucket spills over to the other
+// classes, thus an idle class does not waste the budget.
+type bandwidthBudget struct {
+	rate    float64 // octets per second
+	burst   float64 // octets of all buckets together
+	weights [trafficClasses]float64
+	tokens  [trafficClasses]float64
+	stats   [trafficClasses]BudgetStats
+	last    int64
+}
+
+// SetBandwidthBudget limits the total RTP output of the session to the rate. The budget splits
+// the rate across the traffic classes by their weights, see SetBudgetWeights: audio, video,
+// FEC and retransmissions by default 8:4:2:1. A class that does not use its share leaves it to
+// the other classes. The session output never exceeds the rate plus the burst and one packet.
+//
+// The class of an output stream follows the media type of its payload type, see
+// SetStreamClass to change it. WriteData and WriteRaw return an error if the budget
+// refuses a packet. The packets of a Scheduler wait in its queue until the budget refilled,
+// see ScheduleData; a NackResponder drops the retransmission. The cost of a packet is its size
+// times the number of remotes.
+//
+//   rate  - the contracted rate in bits per second, 0 removes the budget
+//   burst - the time of the rate that the buckets may accumulate, 0 selects 50 ms
+//
+func (rs *Session) SetBandwidthBudget(rate int, burst time.Duration) error {
+	if rate < 0 || burst < 0 {
+		return Error("SetBandwidthBudget: negative rate or burst.")
+	}
+	rs.budgetMutex.Lock()
+	defer rs.budgetMutex.Unlock()
+	if rate == 0 {
+		rs.budget = nil
+		return nil
+	}
+	if burst == 0 {
+		burst = defaultBudgetBurst
+	}
+	bb := rs.budget
+	if bb == nil {
+		bb = &bandwidthBudget{weights: defaultBudgetWeights}
+		for i := range bb.stats {
+			bb.stats[i].Class = i
+		}
+		rs.budget = bb
+	}
+	bb.rate = float64(rate) / 8
+	bb.burst = bb.rate * burst.Seconds()
+	for i := range bb.tokens {
+		bb.tokens[i] = bb.capacity(i)
+	}
+	bb.last = time.Now().UnixNano()
+	return nil
+}
+
+// SetBudgetWeights changes the weights of the traffic classes at runtime, a higher weight gets
+// a larger share of the rate. The weights must be positive.
+func (rs *Session) SetBudgetWeights(audio, video, fec, rtx float64) error {
+	weights := [trafficClasses]float64{audio, video, fec, rtx}
+	for _, w := range weights {
+		if w <= 0 {
+			return Error("SetBudgetWeights: weights must be positive.")
+		}
+	}
+	rs.budgetMutex.Lock()
+	defer rs.budgetMutex.Unlock()
+	if rs.budget == nil {
+		return Error("SetBudgetWeights: the session has no bandwidth budget.")
+	}
+	bb := rs.budget
+	bb.refill(time.Now().UnixNano())
+	bb.weights = weights
+	for i := range bb.tokens {
+		if c := bb.capacity(i); bb.tokens[i] > c {
+			bb.tokens[i] = c
+		}
+	}
+	return nil
+}
+
+// BudgetStats returns the counters of the traffic classes, nil without a bandwidth budget.
+func (rs *Session) BudgetStats() []BudgetStats {
+	rs.budgetMutex.Lock()
+	defer rs.budgetMutex.Unlock()
+	if rs.budget == nil {
+		return nil
+	}
+	stats := rs.budget.stats
+	for i := range stats {
+		stats[i].Weight = rs.budget.weights[i]
+	}
+	return stats[:]
+}
+
+// budgetAdmit returns false if the budget refuses the packet of the class. A class may send
+// a packet if its bucket holds the packet's cost or is full, the bucket then goes into debt.
+func (rs *Session) budgetAdmit(class int, rp *DataPacket) bool {
+	rs.budgetMutex.Lock()
+	defer rs.budgetMutex.Unlock()
+	bb := rs.budget
+	if bb == nil {
+		return true
+	}
+	bb.refill(time.Now().UnixNano())
+	cost := float64(rp.inUse * len(rs.remoteList()))
+	need := cost
+	if c := bb.capacity(class); need > c {
+		need = c
+	}
+	st := &bb.stats[class]
+	if bb.tokens[class] < need {
+		st.DroppedPackets++
+		return false
+	}
+	bb.tokens[class] -= cost
+	st.SentPackets++
+	st.SentOctets += uint64(cost)
+	return true
+}
+
+// budgetRetry returns the time until the budget may admit a refused packet of the class. It
+// assumes the class receives the full rate, the other classes may not use their shares.
+func (rs *Session) budgetRetry(class int, rp *DataPacket) time.Duration {
+	rs.budgetMutex.Lock()
+	defer rs.budgetMutex.Unlock()
+	bb := rs.budget
+	if bb == nil || bb.rate <= 0 {
+		return 0
+	}
+	bb.refill(time.Now().UnixNano())
+	need := float64(rp.inUse * len(rs.remoteList()))
+	if c := bb.capacity(class); need > c {
+		need = c
+	}
+	wait := time.Duration((need - bb.tokens[class]) / bb.rate * 1e9)
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	return wait
+}
+
+// sendPaused returns true if the output stream is paused, its packets don't use the budget.
+func (str *SsrcStream) sendPaused() bool {
+	str.streamMutex.Lock()
+	defer str.streamMutex.Unlock()
+	return str.paused
+}
+
+// capacity returns the size of the class's bucket, its share of the burst.
+func (bb *bandwidthBudget) capacity(class int) float64 {
+	sum := 0.0
+	for _, w := range bb.weights {
+		sum += w
+	}
+	return bb.burst * bb.weights[class] / sum
+}
+
+// refill adds the tokens of the time since the last refill. The classes with room in their
+// buckets share the tokens by weight, the tokens above a full bucket go to the other classes.
+func (bb *bandwidthBudget) refill(now int64) {
+	dt := float64(now-bb.last) / 1e9
+	if dt <= 0 {
+		return
+	}
+	bb.last = now
+	add := bb.rate * dt
+	for round := 0; round < trafficClasses && add > 0; round++ {
+		sum := 0.0
+		for i := range bb.tokens {
+			if bb.tokens[i] < bb.capacity(i) {
+				sum += bb.weights[i]
+			}
+		}
+		if sum == 0 {
+			return // all buckets are full
+		}
+		left := 0.0
+		for i := range bb.tokens {
+			c := bb.capacity(i)
+			if bb.tokens[i] >= c {
+				continue
+			}
+			bb.tokens[i] += add * bb.weights[i] / sum
+			if bb.tokens[i] > c {
+				left += bb.tokens[i] - c
+				bb.tokens[i] = c
+			}
+		}
+		add = left
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBandwidthBudget(t *testing.T) {
+	parseFlags()
+
+	rs, ct := drainedSession(t)
+	audio, fec := rs.SsrcStreamOutForIndex(0), rs.SsrcStreamOutForIndex(1)
+	if err := rs.SetBudgetWeights(1, 1, 1, 1); err == nil {
+		t.Errorf("SetBudgetWeights accepted a session without budget\n")
+	}
+	// 1000 octets per second, buckets of 1000 octets split 8:4:2:1
+	if err := rs.SetBandwidthBudget(8000, time.Second); err != nil {
+		t.Errorf("SetBandwidthBudget failed: %s\n", err)
+		return
+	}
+	if err := rs.SetStreamClass(1, trafficClasses); err == nil {
+		t.Errorf("SetStreamClass accepted an unknown class\n")
+	}
+	rs.SetStreamClass(1, ClassFec)
+	payload := make([]byte, 88) // 100 octet packets
+
+	sent := 0
+	for seq := uint16(0); seq < 10; seq++ {
+		if _, err := rs.WriteRaw(classPacket(audio.Ssrc(), seq, 0, payload)); err == nil {
+			sent++
+		} else if err != errBudget {
+			t.Errorf("WriteRaw failed: %s\n", err)
+		}
+	}
+	if sent != 5 || len(ct.captureWriter.data) != 5 {
+		t.Errorf("audio bucket check failed: %d sent\n", sent)
+	}
+	_, err1 := rs.WriteRaw(rawPacket(fec.Ssrc(), 0, payload))
+	_, err2 := rs.WriteRaw(rawPacket(fec.Ssrc(), 1, payload))
+	if err1 != nil || err2 != errBudget {
+		t.Errorf("FEC bucket check failed: %v, %v\n", err1, err2)
+	}
+	// a packet larger than the bucket goes out if the bucket is full
+	rp := newDataPacket()
+	rp.SetPayload(payload)
+	if !rs.budgetAdmit(ClassRtx, rp) || rs.budgetAdmit(ClassRtx, rp) {
+		t.Errorf("RTX bucket check failed\n")
+	}
+	rp.FreePacket()
+
+	stats := rs.BudgetStats()
+	if len(stats) != trafficClasses || stats[ClassAudio].SentPackets != 5 || stats[ClassAudio].DroppedPackets != 5 ||
+		stats[ClassFec].SentOctets != 100 || stats[ClassRtx].Weight != 1 || stats[ClassAudio].Weight != 8 {
+		t.Errorf("BudgetStats check failed: %+v\n", stats)
+	}
+
+	// the total output stays below the rate plus the burst and one packet
+	start, octets := time.Now(), 0
+	for seq := uint16(10); time.Since(start) < 200*time.Millisecond; seq++ {
+		if _, err := rs.WriteRaw(classPacket(audio.Ssrc(), seq, 0, payload)); err == nil {
+			octets += 100
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if limit := 1000*time.Since(start).Seconds() + 1000 + 100; float64(octets) > limit || octets == 0 {
+		t.Errorf("rate check failed: %d octets, limit %.0f\n", octets, limit)
+	}
+
+	if err := rs.SetBudgetWeights(1, 0, 1, 1); err == nil {
+		t.Errorf("SetBudgetWeights accepted a zero weight\n")
+	}
+	if err := rs.SetBudgetWeights(1, 1, 1, 1); err != nil || rs.BudgetStats()[ClassAudio].Weight != 1 {
+		t.Errorf("SetBudgetWeights failed: %v\n", err)
+	}
+	rs.SetBandwidthBudget(0, 0)
+	for seq := uint16(0); seq < 20; seq++ {
+		if _, err := rs.WriteRaw(classPacket(audio.Ssrc(), 1000+seq, 0, payload)); err != nil {
+			t.Errorf("WriteRaw without budget failed: %s\n", err)
+			break
+		}
+	}
+	if rs.BudgetStats() != nil {
+		t.Errorf("removed budget has stats\n")
+	}
+}
+
+func TestBandwidthBudgetScheduler(t *testing.T) {
+	parseFlags()
+
+	rs, ct := drainedSession(t)
+	audio := rs.SsrcStreamOutForIndex(0)
+	// 1000 octets per second, the audio bucket holds 533 octets
+	rs.SetBandwidthBudget(8000, time.Second)
+	sc := NewScheduler()
+
+	now := time.Now()
+	for seq := uint16(0); seq < 10; seq++ {
+		rp, _ := NewDataPacketFromBuffer(classPacket(audio.Ssrc(), seq, 0, make([]byte, 88)))
+		sc.ScheduleData(rs, rp, now)
+	}
+	// the budget admits 5 packets of 100 octets, the others wait for the refill
+	time.Sleep(50 * time.Millisecond)
+	if n := sc.Pending(); n != 5 {
+		t.Errorf("held packets check failed. Expected: 5, got: %d\n", n)
+	}
+	for start := time.Now(); sc.Pending() > 0 && time.Since(start) < 2*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+	elapsed := time.Since(now)
+	sc.Stop()
+	if len(ct.captureWriter.data) != 10 {
+		t.Errorf("paced packets check failed. Expected: 10, got: %d\n", len(ct.captureWriter.data))
+	}
+	// the 500 octets above the bucket need half a second of the rate
+	if elapsed < 300*time.Millisecond {
+		t.Errorf("pacing check failed, all packets sent after %s\n", elapsed)
+	}
+}
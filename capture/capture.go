@@ -0,0 +1,59 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+// Package capture reads and writes packet capture files that contain RTP and RTCP traffic.
+//
+// The package supports libpcap files (the classic pcap format, not pcapng) and rtpdump files
+// as written by the rtptools. Both readers return the UDP payload of the captured packets
+// together with the capture time and the UDP addresses, the payload is usually a RTP or RTCP
+// packet that applications hand over to the rtp package.
+package capture
+
+import (
+	"net"
+	"time"
+)
+
+// Packet is a captured UDP datagram.
+type Packet struct {
+	Time     time.Time    // capture time of the packet
+	Src, Dst *net.UDPAddr // UDP source and destination, Src may be nil if the file format does not record it
+	Data     []byte       // the UDP payload
+}
+
+// Reader is implemented by all capture file readers.
+//
+// ReadPacket returns the next UDP packet of the capture, io.EOF at the end of the capture.
+type Reader interface {
+	ReadPacket() (*Packet, error)
+}
+
+// Returned in case of an error.
+type Error string
+
+func (s Error) Error() string {
+	return string(s)
+}
+
+// IsRtcp checks if a packet looks like a RTCP packet.
+//
+// The function uses the packet type range defined in RFC 5761, chapter 4 to distinguish RTP and
+// RTCP packets that share a port.
+func IsRtcp(data []byte) bool {
+	return len(data) >= 2 && data[1] >= 192 && data[1] <= 223
+}
@@ -0,0 +1,141 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var rtpPkt = []byte{0x80, 0x00, 0x47, 0x11, 0xf0, 0xe0, 0xd0, 0xc0, 0x01, 0x02, 0x03, 0x04, 0x11, 0x12, 0x13, 0x14}
+var rtcpPkt = []byte{0x80, 201, 0x00, 0x01, 0x01, 0x02, 0x03, 0x04}
+
+func TestRtpdump(t *testing.T) {
+	var buf bytes.Buffer
+	start := time.Unix(1400000000, 250000000)
+	src := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5220}
+
+	wr, err := NewRtpdumpWriter(&buf, src, start)
+	if err != nil {
+		t.Errorf("NewRtpdumpWriter failed: %s\n", err)
+		return
+	}
+	wr.WritePacket(start.Add(20*time.Millisecond), rtpPkt)
+	wr.WritePacket(start.Add(45*time.Millisecond), rtcpPkt)
+
+	rd, err := NewRtpdumpReader(&buf)
+	if err != nil {
+		t.Errorf("NewRtpdumpReader failed: %s\n", err)
+		return
+	}
+	if !rd.Start.Equal(start) {
+		t.Errorf("Start time check failed. Expected: %s, got: %s\n", start, rd.Start)
+	}
+	if rd.Source == nil || rd.Source.Port != 5220 || !rd.Source.IP.Equal(src.IP) {
+		t.Errorf("Source address check failed. Expected: %s, got: %s\n", src, rd.Source)
+	}
+	for i, exp := range [][]byte{rtpPkt, rtcpPkt} {
+		pkt, err := rd.ReadPacket()
+		if err != nil {
+			t.Errorf("ReadPacket %d failed: %s\n", i, err)
+			return
+		}
+		if !bytes.Equal(pkt.Data, exp) {
+			t.Errorf("Packet %d data check failed. Expected: %x, got: %x\n", i, exp, pkt.Data)
+		}
+	}
+	if _, err = rd.ReadPacket(); err != io.EOF {
+		t.Errorf("Expected EOF after last packet, got: %v\n", err)
+	}
+}
+
+// pcapFile builds a little endian, microsecond pcap file with one Ethernet/IPv4/UDP frame
+// and one ARP frame that the reader must skip.
+func pcapFile(payload []byte) []byte {
+	var buf bytes.Buffer
+	hdr := make([]byte, pcapHeaderLen)
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagicMicro)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:], LinkTypeEthernet)
+	buf.Write(hdr)
+
+	record := func(frame []byte, sec, usec uint32) {
+		rec := make([]byte, pcapRecordLen)
+		binary.LittleEndian.PutUint32(rec[0:], sec)
+		binary.LittleEndian.PutUint32(rec[4:], usec)
+		binary.LittleEndian.PutUint32(rec[8:], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(rec[12:], uint32(len(frame)))
+		buf.Write(rec)
+		buf.Write(frame)
+	}
+	arp := make([]byte, 42)
+	binary.BigEndian.PutUint16(arp[12:], 0x0806)
+	record(arp, 1400000000, 0)
+
+	frame := make([]byte, 14+20+8+len(payload))
+	binary.BigEndian.PutUint16(frame[12:], etherTypeIPv4)
+	ip := frame[14:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+8+len(payload)))
+	ip[8] = 64
+	ip[9] = protocolUDP
+	copy(ip[12:], []byte{10, 0, 0, 1})
+	copy(ip[16:], []byte{10, 0, 0, 2})
+	udp := ip[20:]
+	binary.BigEndian.PutUint16(udp[0:], 5220)
+	binary.BigEndian.PutUint16(udp[2:], 5222)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	copy(udp[8:], payload)
+	record(frame, 1400000000, 20000)
+	return buf.Bytes()
+}
+
+func TestPcap(t *testing.T) {
+	rd, err := NewPcapReader(bytes.NewReader(pcapFile(rtpPkt)))
+	if err != nil {
+		t.Errorf("NewPcapReader failed: %s\n", err)
+		return
+	}
+	pkt, err := rd.ReadPacket()
+	if err != nil {
+		t.Errorf("ReadPacket failed: %s\n", err)
+		return
+	}
+	if !bytes.Equal(pkt.Data, rtpPkt) {
+		t.Errorf("Packet data check failed. Expected: %x, got: %x\n", rtpPkt, pkt.Data)
+	}
+	if pkt.Src.Port != 5220 || pkt.Dst.Port != 5222 || !pkt.Dst.IP.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("Address check failed. Got: %s -> %s\n", pkt.Src, pkt.Dst)
+	}
+	if exp := time.Unix(1400000000, 20000000); !pkt.Time.Equal(exp) {
+		t.Errorf("Time check failed. Expected: %s, got: %s\n", exp, pkt.Time)
+	}
+	if _, err = rd.ReadPacket(); err != io.EOF {
+		t.Errorf("Expected EOF after last packet, got: %v\n", err)
+	}
+	if IsRtcp(rtpPkt) || !IsRtcp(rtcpPkt) {
+		t.Errorf("IsRtcp check failed\n")
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+// The link layer types (LINKTYPE_*) the pcap reader understands, see http://www.tcpdump.org/linktypes.html
+const (
+	LinkTypeNull     = 0   // BSD loopback encapsulation
+	LinkTypeEthernet = 1   // IEEE 802.3 Ethernet
+	LinkTypeRaw      = 101 // raw IPv4 or IPv6
+	LinkTypeLinuxSLL = 113 // Linux "cooked" capture
+	LinkTypeIPv4     = 228 // raw IPv4
+	LinkTypeIPv6     = 229 // raw IPv6
+)
+
+const (
+	pcapMagicMicro = 0xa1b2c3d4
+	pcapMagicNano  = 0xa1b23c4d
+	pcapHeaderLen  = 24
+	pcapRecordLen  = 16
+	maxSnapLen     = 262144
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeVlan = 0x8100
+	etherTypeQinQ = 0x88a8
+	protocolUDP   = 17
+)
+
+// PcapReader reads UDP datagrams from a libpcap file.
+type PcapReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nanos    bool
+	LinkType int // link layer type of the capture as stored in the file header
+	buf      []byte
+}
+
+// NewPcapReader reads the pcap file header and returns a reader for the packets.
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	var hdr [pcapHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	pr := &PcapReader{r: r}
+
+	switch {
+	case binary.LittleEndian.Uint32(hdr[0:]) == pcapMagicMicro:
+		pr.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[0:]) == pcapMagicMicro:
+		pr.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(hdr[0:]) == pcapMagicNano:
+		pr.order, pr.nanos = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(hdr[0:]) == pcapMagicNano:
+		pr.order, pr.nanos = binary.BigEndian, true
+	default:
+		return nil, Error("Not a pcap file (pcapng is not supported).")
+	}
+	pr.LinkType = int(pr.order.Uint32(hdr[20:]) & 0x0fffffff)
+	snapLen := pr.order.Uint32(hdr[16:])
+	if snapLen == 0 || snapLen > maxSnapLen {
+		snapLen = maxSnapLen
+	}
+	pr.buf = make([]byte, snapLen)
+	return pr, nil
+}
+
+// ReadPacket implements the capture.Reader ReadPacket method.
+//
+// The method skips all packets that are not UDP datagrams, IP fragments, and packets that
+// were truncated during capture.
+func (pr *PcapReader) ReadPacket() (*Packet, error) {
+	var rec [pcapRecordLen]byte
+	for {
+		if _, err := io.ReadFull(pr.r, rec[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return nil, err
+		}
+		sec := int64(pr.order.Uint32(rec[0:]))
+		frac := int64(pr.order.Uint32(rec[4:]))
+		inclLen := int(pr.order.Uint32(rec[8:]))
+		origLen := int(pr.order.Uint32(rec[12:]))
+
+		if inclLen > len(pr.buf) {
+			pr.buf = make([]byte, inclLen)
+		}
+		frame := pr.buf[:inclLen]
+		if _, err := io.ReadFull(pr.r, frame); err != nil {
+			return nil, io.EOF
+		}
+		if inclLen < origLen {
+			continue
+		}
+		src, dst, payload, ok := DecodeFrame(pr.LinkType, frame)
+		if !ok {
+			continue
+		}
+		if !pr.nanos {
+			frac *= 1000
+		}
+		pkt := &Packet{Time: time.Unix(sec, frac), Src: src, Dst: dst}
+		pkt.Data = make([]byte, len(payload))
+		copy(pkt.Data, payload)
+		return pkt, nil
+	}
+}
+
+// DecodeFrame extracts the UDP addresses and the UDP payload from a link layer frame.
+//
+// The function returns false if the frame does not contain a complete, unfragmented
+// UDP datagram. The returned payload is a slice of frame, not a copy.
+func DecodeFrame(linkType int, frame []byte) (src, dst *net.UDPAddr, payload []byte, ok bool) {
+	switch linkType {
+	case LinkTypeEthernet:
+		if len(frame) < 14 {
+			return
+		}
+		etherType := binary.BigEndian.Uint16(frame[12:])
+		frame = frame[14:]
+		for (etherType == etherTypeVlan || etherType == etherTypeQinQ) && len(frame) >= 4 {
+			etherType = binary.BigEndian.Uint16(frame[2:])
+			frame = frame[4:]
+		}
+		if etherType != etherTypeIPv4 && etherType != etherTypeIPv6 {
+			return
+		}
+	case LinkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return
+		}
+		frame = frame[16:]
+	case LinkTypeNull:
+		if len(frame) < 4 {
+			return
+		}
+		frame = frame[4:]
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6:
+	default:
+		return
+	}
+	return DecodeIP(frame)
+}
+
+// DecodeIP extracts the UDP addresses and the UDP payload from an IPv4 or IPv6 packet.
+//
+// See DecodeFrame.
+func DecodeIP(pkt []byte) (src, dst *net.UDPAddr, payload []byte, ok bool) {
+	if len(pkt) < 1 {
+		return
+	}
+	var srcIP, dstIP net.IP
+	var udp []byte
+
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return
+		}
+		hdrLen := int(pkt[0]&0x0f) * 4
+		totalLen := int(binary.BigEndian.Uint16(pkt[2:]))
+		if hdrLen < 20 || totalLen < hdrLen || totalLen > len(pkt) {
+			return
+		}
+		// More fragments flag or a fragment offset: not a complete datagram
+		if binary.BigEndian.Uint16(pkt[6:])&0x3fff != 0 || pkt[9] != protocolUDP {
+			return
+		}
+		srcIP, dstIP = net.IP(pkt[12:16]), net.IP(pkt[16:20])
+		udp = pkt[hdrLen:totalLen]
+
+	case 6:
+		if len(pkt) < 40 {
+			return
+		}
+		payloadLen := int(binary.BigEndian.Uint16(pkt[4:]))
+		if 40+payloadLen > len(pkt) {
+			return
+		}
+		next := pkt[6]
+		srcIP, dstIP = net.IP(pkt[8:24]), net.IP(pkt[24:40])
+		udp = pkt[40 : 40+payloadLen]
+		// skip hop-by-hop, routing, and destination options extension headers
+		for next == 0 || next == 43 || next == 60 {
+			if len(udp) < 8 {
+				return
+			}
+			extLen := (int(udp[1]) + 1) * 8
+			if extLen > len(udp) {
+				return
+			}
+			next = udp[0]
+			udp = udp[extLen:]
+		}
+		if next != protocolUDP {
+			return
+		}
+	default:
+		return
+	}
+	if len(udp) < 8 {
+		return
+	}
+	udpLen := int(binary.BigEndian.Uint16(udp[4:]))
+	if udpLen < 8 || udpLen > len(udp) {
+		return
+	}
+	src = &net.UDPAddr{IP: copyIP(srcIP), Port: int(binary.BigEndian.Uint16(udp[0:]))}
+	dst = &net.UDPAddr{IP: copyIP(dstIP), Port: int(binary.BigEndian.Uint16(udp[2:]))}
+	return src, dst, udp[8:udpLen], true
+}
+
+func copyIP(ip net.IP) net.IP {
+	c := make(net.IP, len(ip))
+	copy(c, ip)
+	return c
+}
@@ -0,0 +1,153 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// The rtpdump format as written by rtpdump of the rtptools:
+//
+//   "#!rtpplay1.0 address/port\n"
+//   file header:   start time (seconds, microseconds), source address, source port, padding
+//   packet header: length (packet header plus data), packet length (zero for RTCP), offset in ms
+//
+// All binary values are in network order.
+const (
+	rtpdumpMagic     = "#!rtpplay1.0"
+	rtpdumpHeaderLen = 16
+	rtpdumpPacketLen = 8
+)
+
+// RtpdumpReader reads packets from a rtpdump file.
+type RtpdumpReader struct {
+	r      *bufio.Reader
+	Start  time.Time    // recording start time as stored in the file header
+	Source *net.UDPAddr // address from the first line of the file
+}
+
+// NewRtpdumpReader reads the rtpdump file header and returns a reader for the packets.
+func NewRtpdumpReader(r io.Reader) (*RtpdumpReader, error) {
+	rr := &RtpdumpReader{r: bufio.NewReader(r)}
+
+	line, err := rr.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, rtpdumpMagic) {
+		return nil, Error("Not a rtpdump file.")
+	}
+	// The address part is informational only, ignore it if it is not parseable
+	if fields := strings.Fields(line); len(fields) == 2 {
+		if idx := strings.LastIndex(fields[1], "/"); idx > 0 {
+			rr.Source, _ = net.ResolveUDPAddr("udp", fields[1][:idx]+":"+fields[1][idx+1:])
+		}
+	}
+	var hdr [rtpdumpHeaderLen]byte
+	if _, err = io.ReadFull(rr.r, hdr[:]); err != nil {
+		return nil, err
+	}
+	rr.Start = time.Unix(int64(binary.BigEndian.Uint32(hdr[0:])), int64(binary.BigEndian.Uint32(hdr[4:]))*1000)
+	return rr, nil
+}
+
+// ReadPacket implements the capture.Reader ReadPacket method.
+//
+// The packet time is the recording start time plus the packet offset. The rtpdump format
+// does not store the destination address, thus Dst is always nil, Src is the address of the
+// file header.
+func (rr *RtpdumpReader) ReadPacket() (*Packet, error) {
+	var hdr [rtpdumpPacketLen]byte
+	if _, err := io.ReadFull(rr.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(hdr[0:]))
+	offset := time.Duration(binary.BigEndian.Uint32(hdr[4:])) * time.Millisecond
+	if length < rtpdumpPacketLen {
+		return nil, Error("Corrupted rtpdump packet header.")
+	}
+	pkt := &Packet{Time: rr.Start.Add(offset), Src: rr.Source}
+	pkt.Data = make([]byte, length-rtpdumpPacketLen)
+	if _, err := io.ReadFull(rr.r, pkt.Data); err != nil {
+		return nil, io.EOF
+	}
+	return pkt, nil
+}
+
+// RtpdumpWriter writes packets to a rtpdump file.
+type RtpdumpWriter struct {
+	w     io.Writer
+	start time.Time
+}
+
+// NewRtpdumpWriter writes the rtpdump file header and returns a writer for the packets.
+//
+//   w      - the output, usually a file
+//   source - the address to store in the file header, may be nil
+//   start  - the recording start time, the packet offsets are relative to this time
+//
+func NewRtpdumpWriter(w io.Writer, source *net.UDPAddr, start time.Time) (*RtpdumpWriter, error) {
+	ip := net.IPv4zero.To4()
+	port := 0
+	if source != nil {
+		if ip4 := source.IP.To4(); ip4 != nil {
+			ip = ip4
+		}
+		port = source.Port
+	}
+	if _, err := fmt.Fprintf(w, "%s %s/%d\n", rtpdumpMagic, ip, port); err != nil {
+		return nil, err
+	}
+	var hdr [rtpdumpHeaderLen]byte
+	binary.BigEndian.PutUint32(hdr[0:], uint32(start.Unix()))
+	binary.BigEndian.PutUint32(hdr[4:], uint32(start.Nanosecond()/1000))
+	copy(hdr[8:12], ip)
+	binary.BigEndian.PutUint16(hdr[12:], uint16(port))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return &RtpdumpWriter{w: w, start: start}, nil
+}
+
+// WritePacket appends a RTP or RTCP packet received at time tm.
+func (rw *RtpdumpWriter) WritePacket(tm time.Time, data []byte) error {
+	if len(data)+rtpdumpPacketLen > 0xffff {
+		return Error("Packet too long for rtpdump format.")
+	}
+	var hdr [rtpdumpPacketLen]byte
+	binary.BigEndian.PutUint16(hdr[0:], uint16(len(data)+rtpdumpPacketLen))
+	if !IsRtcp(data) {
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(data)))
+	}
+	binary.BigEndian.PutUint32(hdr[4:], uint32(tm.Sub(rw.start)/time.Millisecond))
+	if _, err := rw.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := rw.w.Write(data)
+	return err
+}
@@ -0,0 +1,146 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"time"
+)
+
+// srClockWindow is the number of sender reports of the clock mapping estimation.
+const srClockWindow = 16
+
+// srClockJump is the largest deviation of a SR from the mapping before the estimation restarts,
+// e.g. after the sender stepped its wallclock or restarted its RTP clock.
+const srClockJump = 100 * time.Millisecond
+
+// ClockMapping maps the RTP timestamps of an input stream to UTC. The session derives it from
+// the sender reports of the stream and refines it with each SR: a least squares fit of the RTP
+// timestamps over the NTP times of the latest reports estimates the actual rate of the sender's
+// media clock, thus the mapping also holds between two reports of a skewed clock.
+//
+// Recorders use the mapping to timestamp stored media in the sender's wallclock, then the
+// recordings of several senders with synchronized wallclocks align in post-production.
+//
+type ClockMapping struct {
+	RtpTimestamp uint32    // the RTP timestamp of the latest sender report
+	Utc          time.Time // its wallclock time on the fitted line
+	ClockRate    int       // the nominal clock rate of the payload, 0 if unknown
+	Rate         float64   // the estimated actual clock rate, RTP units per second
+	Skew         float64   // the relative deviation of Rate from ClockRate, e.g. 25e-6 for 25 ppm
+	Reports      int       // the number of reports of the estimation
+}
+
+// Time returns the wallclock time of a RTP timestamp. The timestamp must be within half the RTP
+// timestamp range of the mapping's reference, i.e. some hours for usual clock rates.
+func (cm *ClockMapping) Time(stamp uint32) time.Time {
+	return cm.Utc.Add(time.Duration(float64(int32(stamp-cm.RtpTimestamp)) / cm.Rate * 1e9))
+}
+
+// Stamp returns the RTP timestamp of a wallclock time.
+func (cm *ClockMapping) Stamp(tm time.Time) uint32 {
+	return cm.RtpTimestamp + uint32(int64(tm.Sub(cm.Utc).Seconds()*cm.Rate))
+}
+
+// ClockMapping returns the RTP to UTC mapping of the input stream, false if the stream received
+// no SR yet, or only one SR and the clock rate of its payload is unknown.
+func (si *SsrcStream) ClockMapping() (ClockMapping, bool) {
+	si.streamMutex.Lock()
+	defer si.streamMutex.Unlock()
+	return si.srClock.mapping(si.statistics.clockRate)
+}
+
+// ClockMapping returns the RTP to UTC mapping of the input stream with the SSRC, see
+// SsrcStream.ClockMapping.
+func (rs *Session) ClockMapping(ssrc uint32) (ClockMapping, bool) {
+	rs.streamsMapMutex.Lock()
+	str, _, ok := rs.lookupSsrcMapIn(ssrc)
+	rs.streamsMapMutex.Unlock()
+	if !ok {
+		return ClockMapping{}, false
+	}
+	return str.ClockMapping()
+}
+
+// *** Local functions and methods.
+
+type srPoint struct {
+	ntp int64 // NTP time of the report in ns
+	rtp int64 // unwrapped RTP timestamp of the report
+}
+
+// srClock keeps the latest sender reports of an input stream, guarded by the streamMutex.
+type srClock struct {
+	points []srPoint // oldest first
+}
+
+// add records the NTP time and RTP timestamp of a SR.
+func (sc *srClock) add(ntp int64, stamp uint32, clockRate int) {
+	if n := len(sc.points); n > 0 {
+		last := sc.points[n-1]
+		rtp := last.rtp + int64(int32(stamp-uint32(last.rtp)))
+		restart := ntp <= last.ntp || rtp < last.rtp
+		if cm, ok := sc.mapping(clockRate); ok && !restart {
+			dev := time.Duration(ntp - cm.Time(stamp).UnixNano())
+			restart = dev > srClockJump || dev < -srClockJump
+		}
+		if !restart {
+			if n == srClockWindow {
+				sc.points = append(sc.points[:0], sc.points[1:]...)
+			}
+			sc.points = append(sc.points, srPoint{ntp, rtp})
+			return
+		}
+	}
+	sc.points = append(sc.points[:0], srPoint{ntp, int64(stamp)})
+}
+
+// mapping fits a line through the reports, with one report it uses the nominal clock rate.
+func (sc *srClock) mapping(clockRate int) (cm ClockMapping, ok bool) {
+	n := len(sc.points)
+	if n == 0 || (n == 1 && clockRate <= 0) {
+		return cm, false
+	}
+	last := sc.points[n-1]
+	cm = ClockMapping{RtpTimestamp: uint32(last.rtp), Utc: time.Unix(0, last.ntp), ClockRate: clockRate,
+		Rate: float64(clockRate), Reports: n}
+	if n == 1 {
+		return cm, true
+	}
+	// least squares fit of rtp = a + b*t, t in seconds relative to the latest report
+	var st, sr, stt, str float64
+	for _, p := range sc.points {
+		t, r := float64(p.ntp-last.ntp)/1e9, float64(p.rtp-last.rtp)
+		st, sr, stt, str = st+t, sr+r, stt+t*t, str+t*r
+	}
+	den := float64(n)*stt - st*st
+	if den <= 0 {
+		return cm, clockRate > 0
+	}
+	b := (float64(n)*str - st*sr) / den
+	a := (sr - b*st) / float64(n)
+	if b <= 0 {
+		return cm, clockRate > 0
+	}
+	cm.Rate = b
+	cm.Utc = cm.Utc.Add(time.Duration(-a / b * 1e9)) // the fitted time of the latest timestamp
+	if clockRate > 0 {
+		cm.Skew = b/float64(clockRate) - 1
+	}
+	return cm, true
+}
@@ -0,0 +1,97 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSrClock(t *testing.T) {
+	parseFlags()
+
+	// The sender's media clock runs 50 ppm fast, its SR wallclock times jitter by up to 1 ms.
+	start := time.Unix(1400000000, 0).UnixNano()
+	rate := 8000 * (1 + 50e-6)
+	var sc srClock
+	for i := 0; i < 20; i++ {
+		jitter := int64((i%3 - 1)) * int64(time.Millisecond)
+		ntp := start + int64(i)*int64(5*time.Second)
+		sc.add(ntp+jitter, 0xfffff000+uint32(float64(i)*5*rate), 8000)
+	}
+	cm, ok := sc.mapping(8000)
+	if !ok || cm.Reports != srClockWindow || math.Abs(cm.Skew-50e-6) > 5e-6 {
+		t.Errorf("Skew check failed: %+v\n", cm)
+	}
+	// 10 seconds after the latest report, the nominal rate would be off by 0.5 ms
+	stamp := cm.RtpTimestamp + uint32(10*rate)
+	want := time.Unix(0, start+int64(21*5*time.Second))
+	if d := cm.Time(stamp).Sub(want); d > time.Millisecond || d < -time.Millisecond {
+		t.Errorf("Time check failed: %v off\n", d)
+	}
+	if back := cm.Stamp(cm.Time(stamp)); back-stamp+1 > 2 {
+		t.Errorf("Stamp check failed. Expected: %d, got: %d\n", stamp, back)
+	}
+
+	// A wallclock step restarts the estimation.
+	sc.add(start+int64(time.Hour), 0xfffff000+uint32(100*rate), 8000)
+	if cm, _ = sc.mapping(8000); cm.Reports != 1 || cm.Rate != 8000 {
+		t.Errorf("Restart check failed: %+v\n", cm)
+	}
+	var empty srClock
+	if _, ok := empty.mapping(8000); ok {
+		t.Errorf("Mapping without reports must fail\n")
+	}
+	empty.add(start, 0, 0)
+	if _, ok := empty.mapping(0); ok {
+		t.Errorf("Mapping of one report without clock rate must fail\n")
+	}
+}
+
+func TestSessionClockMapping(t *testing.T) {
+	parseFlags()
+
+	rs, _ := drainedSession(t)
+	from := &Address{net.IPv4(10, 0, 0, 9), 6000, 6001}
+	srCheckData(rs, 0x0a0b0c0d, 0, 2, 160, from) // PT 0, 8000 Hz
+	sec, frac := toNtpStamp(time.Unix(1400000000, 0).UnixNano())
+	rc, offset := newCtrlPacket()
+	rc.SetType(0, RtcpSR)
+	rc.addHeaderSsrc(offset, 0x0a0b0c0d)
+	info, _ := rc.newSenderInfo()
+	info.setNtpTimeStamp(sec, frac)
+	info.setRtpTimeStamp(16000)
+	rc.SetLength(0, uint16(rc.inUse/4-1))
+	rc.fromAddr = *from
+	rs.OnRecvCtrl(rc)
+
+	cm, ok := rs.ClockMapping(0x0a0b0c0d)
+	if !ok || cm.ClockRate != 8000 || cm.Reports != 1 {
+		t.Errorf("Session mapping check failed: %+v\n", cm)
+		return
+	}
+	if d := cm.Time(24000).Sub(time.Unix(1400000001, 0)); d > time.Microsecond || d < -time.Microsecond {
+		t.Errorf("Mapped time check failed: %v off\n", d)
+	}
+	if _, ok := rs.ClockMapping(0x01020304); ok {
+		t.Errorf("Output streams have no clock mapping\n")
+	}
+}
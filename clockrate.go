@@ -0,0 +1,117 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"time"
+)
+
+/*
+ * This source file contains the clock rate inference for payload types that are not in
+ * PayloadFormatMap.
+ */
+
+const (
+	clockInferWindow  = time.Second // minimum time span of the packets that infer the clock rate
+	clockInferPackets = 10          // minimum number of packets that infer the clock rate
+	clockInferSnap    = 0.05        // relative deviation from a common clock rate that snaps to it
+)
+
+// commonClockRates are the clock rates of the usual audio and video payload formats.
+var commonClockRates = []int{8000, 11025, 12000, 16000, 22050, 24000, 32000, 44100, 48000, 90000}
+
+// clockInference infers the clock rate of an unknown payload type from the timestamp deltas and
+// arrival times of the received packets.
+type clockInference struct {
+	pt         byte
+	packets    int
+	firstStamp uint32
+	firstTime  int64
+	rate       int // 0 while the inference needs more packets
+}
+
+// SetClockRateInference switches the inference of the clock rate of unknown payload types.
+//
+// The session computes the jitter of an input stream in timestamp units of the payload
+// format's clock rate. A payload type that is not in PayloadFormatMap has no clock rate, the
+// input stream does not compute its jitter. With the inference the input stream computes the
+// clock rate from the timestamp increase over at least one second of packets and snaps it to
+// a common clock rate within 5 %, the jitter is roughly correct even if the application did
+// not register the payload type. StreamStatistics reports the rate and ClockRateInferred.
+// Without the inference the session drops the packets of unknown payload types, see
+// DataPacket.IsValid. Switch the inference before the session receives packets.
+//
+//   on - true to infer the clock rate of unknown payload types
+//
+func (rs *Session) SetClockRateInference(on bool) {
+	rs.inferClockRate = on
+}
+
+// *** Local functions and methods.
+
+// validData checks a received RTP packet like DataPacket.IsValid. With the clock rate inference
+// a packet of a payload type that is not in PayloadFormatMap is valid, the inference is for
+// these packets.
+func (rs *Session) validData(rp *DataPacket) bool {
+	if rs.inferClockRate {
+		return rp.buffer[0]&versionMask == version2Bit
+	}
+	return rp.IsValid()
+}
+
+// clockRate returns the clock rate of the payload type of the packet, the inferred clock rate
+// if it is not in PayloadFormatMap and 0 if the clock rate is unknown. The caller holds
+// recvMutex.
+func (si *SsrcStream) clockRate(rp *DataPacket) (rate int, inferred bool) {
+	if pf := PayloadFormatMap[int(rp.PayloadType())]; pf != nil && pf.ClockRate > 0 {
+		return pf.ClockRate, false
+	}
+	rate = si.payloadClockRate(rp.PayloadType())
+	return rate, rate > 0
+}
+
+// inferClockRate adds a valid packet of an unknown payload type to the inference. A new payload
+// type restarts the inference and the jitter computation.
+func (si *SsrcStream) inferClockRate(rp *DataPacket, recvTime int64) {
+	ci := &si.statistics.clock
+	if ci.packets > 0 && ci.pt != rp.PayloadType() {
+		*ci = clockInference{}
+		si.statistics.lastPacketTransitTime = 0
+	}
+	if ci.rate > 0 {
+		return
+	}
+	if ci.packets == 0 || int32(rp.Timestamp()-ci.firstStamp) < 0 {
+		*ci = clockInference{pt: rp.PayloadType(), packets: 1, firstStamp: rp.Timestamp(), firstTime: recvTime}
+		return
+	}
+	ci.packets++
+	elapsed := time.Duration(recvTime - ci.firstTime)
+	if ci.packets < clockInferPackets || elapsed < clockInferWindow {
+		return
+	}
+	raw := float64(rp.Timestamp()-ci.firstStamp) / elapsed.Seconds()
+	ci.rate = int(raw/100+0.5) * 100
+	for _, rate := range commonClockRates {
+		if diff := raw/float64(rate) - 1; diff < clockInferSnap && diff > -clockInferSnap {
+			ci.rate = rate
+			break
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// clockRateStream feeds 60 packets in 20 ms intervals with an arrival jitter of 2 ms into a new
+// input stream and returns its statistics.
+func clockRateStream(rs *Session, pt byte, samples uint32) StreamStatistics {
+	str := newSsrcStreamIn(&Address{}, 0x0badcafe)
+	start := time.Now().UnixNano()
+	for i := 0; i < 60; i++ {
+		rp := newDataPacket()
+		rp.SetSsrc(0x0badcafe)
+		rp.SetPayloadType(pt)
+		rp.SetSequence(uint16(1000 + i))
+		rp.SetTimestamp(5000 + uint32(i)*samples)
+		recvTime := start + int64(i)*int64(20*time.Millisecond)
+		if i&1 == 1 {
+			recvTime += int64(2 * time.Millisecond)
+		}
+		str.recordReceptionData(rp, rs, recvTime)
+		rp.FreePacket()
+	}
+	return str.Statistics()
+}
+
+func TestClockRateInference(t *testing.T) {
+	parseFlags()
+
+	rs, _ := drainedSession(t)
+
+	stats := clockRateStream(rs, 122, 960)
+	if stats.ClockRate != 0 || stats.ClockRateInferred || stats.Jitter != 0 || stats.PacketCount == 0 {
+		t.Errorf("Unknown payload type check failed. Rate: %d, jitter: %d\n", stats.ClockRate, stats.Jitter)
+	}
+
+	rs.SetClockRateInference(true)
+	stats = clockRateStream(rs, 122, 960)
+	if stats.ClockRate != 48000 || !stats.ClockRateInferred {
+		t.Errorf("Inferred clock rate check failed. Expected: 48000, got: %d\n", stats.ClockRate)
+	}
+	// 2 ms at 48 kHz are 96 timestamp units, the jitter computation starts after the inference
+	// and approaches twice that
+	if stats.Jitter < 20 || stats.Jitter > 200 {
+		t.Errorf("Inferred jitter check failed: %d\n", stats.Jitter)
+	}
+	if stats = clockRateStream(rs, 123, 1500); stats.ClockRate != 75000 || !stats.ClockRateInferred {
+		t.Errorf("Uncommon clock rate check failed. Expected: 75000, got: %d\n", stats.ClockRate)
+	}
+
+	// Registered payload types keep their clock rate
+	stats = clockRateStream(rs, 0, 160)
+	if stats.ClockRate != 8000 || stats.ClockRateInferred || stats.Jitter == 0 {
+		t.Errorf("Known clock rate check failed. Rate: %d, inferred: %v\n", stats.ClockRate, stats.ClockRateInferred)
+	}
+}
+
+func TestClockRateInferenceReceive(t *testing.T) {
+	parseFlags()
+
+	rs, _ := drainedSession(t)
+
+	from := &Address{IpAddr: net.IPv4(10, 0, 0, 1), DataPort: 5004, CtrlPort: 5005}
+	receive := func(ssrc uint32, seq uint16) {
+		rp := newDataPacket()
+		rp.SetSsrc(ssrc)
+		rp.SetPayloadType(122)
+		rp.SetSequence(seq)
+		rp.SetTimestamp(uint32(seq) * 4800)
+		rp.fromAddr = *from
+		rs.OnRecvData(rp)
+	}
+	receive(0x0badcafe, 0)
+	if _, _, ok := rs.lookupSsrcMapIn(0x0badcafe); ok {
+		t.Errorf("Unknown payload type accepted without inference\n")
+	}
+
+	// 12 packets of 100 ms at 48 kHz cover the inference window
+	rs.SetClockRateInference(true)
+	for seq := uint16(0); seq < 12; seq++ {
+		receive(0x0badbeef, seq)
+		time.Sleep(100 * time.Millisecond)
+	}
+	str, _, ok := rs.lookupSsrcMapIn(0x0badbeef)
+	if !ok {
+		t.Errorf("Unknown payload type dropped with inference\n")
+		return
+	}
+	if stats := str.Statistics(); stats.PacketCount != 12 || stats.ClockRate != 48000 || !stats.ClockRateInferred {
+		t.Errorf("Received clock rate check failed. Packets: %d, rate: %d\n", stats.PacketCount, stats.ClockRate)
+	}
+}
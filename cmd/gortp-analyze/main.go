@@ -0,0 +1,451 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+// gortp-analyze reads a pcap or rtpdump capture and reports on the RTP streams it contains.
+//
+// The tool reconstructs the RTP streams per SSRC and reports packet and octet counts, loss,
+// interarrival jitter, sequence and time gaps, the bitrate over time, and checks the RTCP
+// sender and receiver reports against the observed packets. It uses the packet parsers and
+// the receive statistics of the rtp package, thus the results match what a Session computes
+// for the same packets at runtime.
+//
+// Usage:
+//
+//   gortp-analyze -clockrate 96=90000,111=48000 call.pcap
+//
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/room732/gortp"
+	"github.com/room732/gortp/capture"
+)
+
+var (
+	formatFlag    = flag.String("format", "", "file format: rtpdump or pcap (default: derived from file name)")
+	clockRateFlag = flag.String("clockrate", "", "comma separated list of pt=clockrate for payload types that are not well known")
+	defaultRate   = flag.Int("default-clockrate", 90000, "clock rate of unknown payload types not listed in -clockrate")
+	intervalFlag  = flag.Duration("interval", time.Second, "bitrate report interval, 0 disables the bitrate report")
+	gapFlag       = flag.Duration("gap", 200*time.Millisecond, "report arrival gaps longer than this")
+)
+
+// streamKey identifies a stream by its SSRC and its sender's address
+type streamKey struct {
+	ssrc uint32
+	src  string
+}
+
+// srCheck records a received sender report and the packets observed up to its arrival.
+type srCheck struct {
+	time     time.Time
+	info     rtp.SenderInfoData
+	packets  uint32
+	octets   uint32
+	lastSeen uint32 // RTP timestamp of the last packet seen before the SR
+}
+
+// rrCheck records a received report block about a stream and the locally computed values.
+type rrCheck struct {
+	time     time.Time
+	reporter uint32
+	block    rtp.ReportBlock
+	stats    rtp.StreamStatistics
+}
+
+type stream struct {
+	key         streamKey
+	str         *rtp.SsrcStream
+	payloadType map[byte]int
+	first, last time.Time
+	packets     uint32
+	octets      uint32
+	rejected    int
+	duplicates  int
+	reordered   int
+	extSeq      int64 // extended highest sequence number, -1 before the first packet
+	seen        map[int64]bool
+	seqGaps     []string
+	timeGaps    []string
+	buckets     []uint64
+	lastStamp   uint32
+	srs         []srCheck
+	rrs         []rrCheck
+}
+
+var streams = make(map[streamKey]*stream)
+var bySsrc = make(map[uint32]*stream)
+var unknownPts = make(map[byte]bool)
+
+func newStream(key streamKey, src *net.UDPAddr) *stream {
+	addr := &rtp.Address{IpAddr: src.IP, DataPort: src.Port}
+	st := &stream{key: key, str: rtp.NewSsrcStreamIn(addr, key.ssrc), payloadType: make(map[byte]int), extSeq: -1,
+		seen: make(map[int64]bool)}
+	streams[key] = st
+	bySsrc[key.ssrc] = st
+	return st
+}
+
+// extend computes the extended sequence number closest to the current highest sequence number.
+func (st *stream) extend(seq uint16) int64 {
+	if st.extSeq < 0 {
+		return int64(seq)
+	}
+	ext := st.extSeq&^0xffff | int64(seq)
+	if ext < st.extSeq-0x8000 {
+		ext += 0x10000
+	} else if ext > st.extSeq+0x8000 && ext >= 0x10000 {
+		ext -= 0x10000
+	}
+	return ext
+}
+
+func (st *stream) addData(pkt *capture.Packet, rp *rtp.DataPacket) {
+	pt := rp.PayloadType()
+	if rtp.PayloadFormatMap[int(pt)] == nil {
+		rtp.PayloadFormatMap[int(pt)] = &rtp.PayloadFormat{TypeNumber: int(pt), MediaType: rtp.Video, ClockRate: *defaultRate,
+			Channels: 1, Name: "unknown"}
+		unknownPts[pt] = true
+	}
+	if st.packets == 0 {
+		st.first = pkt.Time
+	} else if d := pkt.Time.Sub(st.last); d > *gapFlag {
+		st.timeGaps = append(st.timeGaps, fmt.Sprintf("%s: no packet for %s", offset(st.last), d))
+	}
+	st.packets++
+	st.octets += uint32(len(rp.Payload()))
+	st.payloadType[pt]++
+	st.lastStamp = rp.Timestamp()
+
+	ext := st.extend(rp.Sequence())
+	switch {
+	case st.seen[ext]:
+		st.duplicates++
+	case st.extSeq >= 0 && ext < st.extSeq:
+		st.reordered++
+	case st.extSeq >= 0 && ext > st.extSeq+1:
+		st.seqGaps = append(st.seqGaps, fmt.Sprintf("%s: missing %d packets, seq %d-%d", offset(pkt.Time),
+			ext-st.extSeq-1, uint16(st.extSeq+1), uint16(ext-1)))
+	}
+	st.seen[ext] = true
+	if ext > st.extSeq {
+		st.extSeq = ext
+	}
+	if !st.str.RecordData(rp, pkt.Time.UnixNano()) {
+		st.rejected++
+	}
+	if pkt.Time.After(st.last) {
+		st.last = pkt.Time
+	}
+	if *intervalFlag > 0 {
+		b := int(pkt.Time.Sub(captureStart) / *intervalFlag)
+		for len(st.buckets) <= b {
+			st.buckets = append(st.buckets, 0)
+		}
+		st.buckets[b] += uint64(rp.InUse())
+	}
+}
+
+func addCtrl(pkt *capture.Packet, rc *rtp.CtrlPacket) {
+	for offset := 0; offset+8 <= rc.InUse(); {
+		pktLen := int(rc.Length(offset)+1) * 4
+		if offset+pktLen > rc.InUse() {
+			return
+		}
+		switch rc.Type(offset) {
+		case rtp.RtcpSR:
+			if st := bySsrc[rc.Ssrc(offset)]; st != nil {
+				if info, ok := rc.SenderInfo(offset); ok {
+					st.srs = append(st.srs, srCheck{pkt.Time, info, st.packets, st.octets, st.lastStamp})
+					st.str.RecordSenderInfo(info, pkt.Time.UnixNano())
+				}
+			}
+			fallthrough
+		case rtp.RtcpRR:
+			for _, block := range rc.ReportBlocks(offset) {
+				if st := bySsrc[block.Ssrc]; st != nil {
+					st.rrs = append(st.rrs, rrCheck{pkt.Time, rc.Ssrc(offset), block, st.str.Statistics()})
+				}
+			}
+		}
+		offset += pktLen
+	}
+}
+
+var captureStart time.Time
+
+func offset(tm time.Time) string {
+	return fmt.Sprintf("%9.3fs", tm.Sub(captureStart).Seconds())
+}
+
+func clockRate(st *stream) int {
+	pt, cnt := byte(0), -1
+	for p, c := range st.payloadType {
+		if c > cnt {
+			pt, cnt = p, c
+		}
+	}
+	return rtp.PayloadFormatMap[int(pt)].ClockRate
+}
+
+func report(st *stream) {
+	stats := st.str.Statistics()
+	rate := clockRate(st)
+	dur := st.last.Sub(st.first)
+
+	fmt.Printf("\nStream SSRC 0x%08x from %s\n", st.key.ssrc, st.key.src)
+	var pts []string
+	for pt, cnt := range st.payloadType {
+		pts = append(pts, fmt.Sprintf("%d (%d packets)", pt, cnt))
+	}
+	sort.Strings(pts)
+	fmt.Printf("  payload types:  %s\n", strings.Join(pts, ", "))
+	fmt.Printf("  time:           %s - %s, duration %s\n", offset(st.first), offset(st.last), dur)
+	fmt.Printf("  packets:        %d, payload octets: %d", st.packets, st.octets)
+	if dur > 0 {
+		fmt.Printf(", average payload bitrate: %.1f kbit/s", float64(st.octets)*8/dur.Seconds()/1000)
+	}
+	fmt.Println()
+	expected := int64(stats.PacketCount) + int64(stats.PacketsLost)
+	lossPct := 0.0
+	if expected > 0 {
+		lossPct = float64(stats.PacketsLost) * 100 / float64(expected)
+	}
+	fmt.Printf("  loss:           %d of %d expected (%.2f%%), duplicates: %d, reordered: %d, rejected: %d\n",
+		stats.PacketsLost, expected, lossPct, st.duplicates, st.reordered, st.rejected)
+	fmt.Printf("  jitter:         %d timestamp units (%.2f ms at %d Hz)\n", stats.Jitter,
+		float64(stats.Jitter)*1000/float64(rate), rate)
+
+	if len(st.seqGaps) > 0 {
+		fmt.Printf("  sequence gaps:  %d\n", len(st.seqGaps))
+		for _, g := range st.seqGaps {
+			fmt.Printf("    %s\n", g)
+		}
+	}
+	if len(st.timeGaps) > 0 {
+		fmt.Printf("  arrival gaps:   %d longer than %s\n", len(st.timeGaps), *gapFlag)
+		for _, g := range st.timeGaps {
+			fmt.Printf("    %s\n", g)
+		}
+	}
+	if *intervalFlag > 0 && len(st.buckets) > 0 {
+		fmt.Printf("  bitrate (RTP packets, per %s):\n", *intervalFlag)
+		for i, b := range st.buckets {
+			if time.Duration(i+1)**intervalFlag < st.first.Sub(captureStart) {
+				continue
+			}
+			fmt.Printf("    %9.3fs  %8.1f kbit/s\n", (time.Duration(i) * *intervalFlag).Seconds(),
+				float64(b)*8/intervalFlag.Seconds()/1000)
+		}
+	}
+	reportRtcp(st, rate)
+}
+
+// reportRtcp checks the sender reports of the stream and the report blocks about the stream.
+func reportRtcp(st *stream, rate int) {
+	if len(st.srs) == 0 && len(st.rrs) == 0 {
+		fmt.Printf("  RTCP:           no sender or receiver reports\n")
+		return
+	}
+	fmt.Printf("  RTCP:           %d sender reports, %d report blocks\n", len(st.srs), len(st.rrs))
+	for i, sr := range st.srs {
+		var notes []string
+		if sr.info.SenderPacketCnt < sr.packets {
+			notes = append(notes, fmt.Sprintf("packet count below %d observed", sr.packets))
+		}
+		if sr.info.SenderOctectCnt < sr.octets {
+			notes = append(notes, fmt.Sprintf("octet count below %d observed", sr.octets))
+		}
+		if i > 0 {
+			prev := st.srs[i-1]
+			ntpDelta := time.Duration(sr.info.NtpTime - prev.info.NtpTime)
+			stampDelta := int32(sr.info.RtpTimestamp - prev.info.RtpTimestamp)
+			if ntpDelta > 0 {
+				implied := float64(stampDelta) / ntpDelta.Seconds()
+				if implied < float64(rate)*0.95 || implied > float64(rate)*1.05 {
+					notes = append(notes, fmt.Sprintf("RTP/NTP timestamps imply %.0f Hz", implied))
+				}
+			} else {
+				notes = append(notes, "NTP timestamp not increasing")
+			}
+		}
+		if sr.packets > 0 {
+			if d := int32(sr.info.RtpTimestamp - sr.lastSeen); d < -int32(rate) || d > int32(rate) {
+				notes = append(notes, fmt.Sprintf("RTP timestamp %d units off the media", d))
+			}
+		}
+		status := "ok"
+		if len(notes) > 0 {
+			status = strings.Join(notes, ", ")
+		}
+		fmt.Printf("    %s SR packets: %d octets: %d rtp: %d - %s\n", offset(sr.time), sr.info.SenderPacketCnt,
+			sr.info.SenderOctectCnt, sr.info.RtpTimestamp, status)
+	}
+	for _, rr := range st.rrs {
+		var notes []string
+		if rr.block.HighestSeqNo&0xffff != rr.stats.HighestSeqNo&0xffff {
+			notes = append(notes, fmt.Sprintf("highest seq %d, observed %d", rr.block.HighestSeqNo&0xffff,
+				rr.stats.HighestSeqNo&0xffff))
+		}
+		lost := int32(rr.block.PacketsLost<<8) >> 8 // 24 bit signed value
+		if lost != rr.stats.PacketsLost {
+			notes = append(notes, fmt.Sprintf("observed loss %d", rr.stats.PacketsLost))
+		}
+		status := "consistent with capture"
+		if len(notes) > 0 {
+			status = strings.Join(notes, ", ") + " (includes loss before the capture point)"
+		}
+		fmt.Printf("    %s RR from 0x%08x lost: %d fraction: %d/256 jitter: %d - %s\n", offset(rr.time), rr.reporter,
+			lost, rr.block.FracLost, rr.block.Jitter, status)
+	}
+}
+
+func parseClockRates(list string) error {
+	if list == "" {
+		return nil
+	}
+	for _, m := range strings.Split(list, ",") {
+		pair := strings.SplitN(m, "=", 2)
+		if len(pair) != 2 {
+			return fmt.Errorf("malformed clock rate '%s'", m)
+		}
+		pt, err1 := strconv.Atoi(strings.TrimSpace(pair[0]))
+		rate, err2 := strconv.Atoi(strings.TrimSpace(pair[1]))
+		if err1 != nil || err2 != nil || pt < 0 || pt > 127 || rate <= 0 {
+			return fmt.Errorf("malformed clock rate '%s'", m)
+		}
+		rtp.PayloadFormatMap[pt] = &rtp.PayloadFormat{TypeNumber: pt, MediaType: rtp.Audio, ClockRate: rate, Channels: 1,
+			Name: "CLI"}
+	}
+	return nil
+}
+
+func openCapture(name string) (capture.Reader, io.Closer, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	format := *formatFlag
+	if format == "" {
+		format = "pcap"
+		if ext := strings.ToLower(filepath.Ext(name)); ext == ".rtpdump" || ext == ".rtp" {
+			format = "rtpdump"
+		}
+	}
+	var rd capture.Reader
+	switch format {
+	case "pcap":
+		rd, err = capture.NewPcapReader(f)
+	case "rtpdump":
+		rd, err = capture.NewRtpdumpReader(f)
+	default:
+		err = fmt.Errorf("unknown file format '%s'", format)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return rd, f, nil
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: gortp-analyze [flags] capture-file")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	if err := parseClockRates(*clockRateFlag); err != nil {
+		fmt.Fprintln(os.Stderr, "gortp-analyze:", err)
+		os.Exit(2)
+	}
+	rd, f, err := openCapture(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gortp-analyze:", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	var total, rtpCnt, rtcpCnt, other int
+	var order []*stream
+	for {
+		pkt, err := rd.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "gortp-analyze:", err)
+			break
+		}
+		if total == 0 {
+			captureStart = pkt.Time
+		}
+		total++
+		if len(pkt.Data) < 2 || pkt.Data[0]&0xc0 != 0x80 {
+			other++
+			continue
+		}
+		src := pkt.Src
+		if src == nil {
+			src = &net.UDPAddr{}
+		}
+		if capture.IsRtcp(pkt.Data) {
+			rc, err := rtp.NewCtrlPacketFromBuffer(pkt.Data)
+			if err != nil {
+				other++
+				continue
+			}
+			rtcpCnt++
+			addCtrl(pkt, rc)
+			rc.FreePacket()
+			continue
+		}
+		rp, err := rtp.NewDataPacketFromBuffer(pkt.Data)
+		if err != nil {
+			other++
+			continue
+		}
+		rtpCnt++
+		key := streamKey{rp.Ssrc(), src.String()}
+		st := streams[key]
+		if st == nil {
+			st = newStream(key, src)
+			order = append(order, st)
+		}
+		st.addData(pkt, rp)
+		rp.FreePacket()
+	}
+
+	fmt.Printf("%s: %d UDP packets, %d RTP, %d RTCP, %d other, %d RTP streams\n", flag.Arg(0), total, rtpCnt, rtcpCnt,
+		other, len(order))
+	for pt := range unknownPts {
+		fmt.Printf("note: payload type %d not known, assumed clock rate %d Hz (use -clockrate)\n", pt, *defaultRate)
+	}
+	for _, st := range order {
+		report(st)
+	}
+}
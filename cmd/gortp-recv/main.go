@@ -0,0 +1,181 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+// gortp-recv receives RTP streams, prints live statistics and optionally records them.
+//
+// The tool listens on a local port pair and reports each new input stream and its receive
+// statistics (packets, octets, loss, jitter) at a regular interval. With -print it dumps
+// each received packet, with -record it writes all received RTP packets into a rtpdump file
+// that gortp-send can play back.
+//
+// Usage:
+//
+//   gortp-recv -local 127.0.0.1:5222 -record call.rtpdump
+//
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"github.com/room732/gortp"
+	"github.com/room732/gortp/capture"
+)
+
+var (
+	localFlag  = flag.String("local", "0.0.0.0:5222", "local address and RTP port (RTCP uses port+1)")
+	remoteFlag = flag.String("remote", "", "optional remote address and RTP port to send receiver reports to")
+	recordFlag = flag.String("record", "", "record received RTP packets into this rtpdump file")
+	printFlag  = flag.Bool("print", false, "print a line for each received packet")
+	statsFlag  = flag.Duration("stats", time.Second, "statistics interval, 0 disables statistics")
+	timeFlag   = flag.Duration("time", 0, "stop after this time, default is to run until interrupted")
+)
+
+func resolve(hostPort string) (*rtp.Address, error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return nil, err
+	}
+	return &rtp.Address{IpAddr: ip.IP, DataPort: port, CtrlPort: port + 1}, nil
+}
+
+func printStats(rs *rtp.Session, streams []uint32) {
+	for _, idx := range streams {
+		str := rs.SsrcStreamInForIndex(idx)
+		if str == nil {
+			continue
+		}
+		st := str.Statistics()
+		fmt.Printf("  SSRC 0x%08x from %s:%d  packets: %d  octets: %d  lost: %d  jitter: %d  cname: %s\n",
+			str.Ssrc(), str.IpAddr, str.DataPort, st.PacketCount, st.OctetCount, st.PacketsLost, st.Jitter,
+			str.SdesItems[rtp.SdesCname])
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	local, err := resolve(*localFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gortp-recv: local address:", err)
+		os.Exit(2)
+	}
+	tp, _ := rtp.NewTransportUDP(&net.IPAddr{IP: local.IpAddr}, local.DataPort)
+	rs := rtp.NewSession(tp, tp)
+	if *remoteFlag != "" {
+		remote, err := resolve(*remoteFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "gortp-recv: remote address:", err)
+			os.Exit(2)
+		}
+		rs.AddRemote(remote)
+	}
+	// The RTCP service requires an output stream to send receiver reports
+	strIdx, _ := rs.NewSsrcStreamOut(local, 0, 0)
+	rs.SsrcStreamOutForIndex(strIdx).SetPayloadType(0)
+
+	var recorder *capture.RtpdumpWriter
+	if *recordFlag != "" {
+		f, err := os.Create(*recordFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "gortp-recv:", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		recorder, err = capture.NewRtpdumpWriter(f, &net.UDPAddr{IP: local.IpAddr, Port: local.DataPort}, time.Now())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "gortp-recv:", err)
+			os.Exit(1)
+		}
+	}
+
+	dataReceiver := rs.CreateDataReceiveChan()
+	ctrlReceiver := rs.CreateCtrlEventChan()
+
+	if err = rs.StartSession(); err != nil {
+		fmt.Fprintln(os.Stderr, "gortp-recv:", err)
+		os.Exit(1)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	var stop <-chan time.Time
+	if *timeFlag > 0 {
+		stop = time.After(*timeFlag)
+	}
+	var statsTick <-chan time.Time
+	if *statsFlag > 0 {
+		ticker := time.NewTicker(*statsFlag)
+		defer ticker.Stop()
+		statsTick = ticker.C
+	}
+	var streams []uint32
+
+	for running := true; running; {
+		select {
+		case rp := <-dataReceiver:
+			if *printFlag {
+				fmt.Printf("RTP SSRC 0x%08x  pt: %3d  seq: %5d  ts: %10d  marker: %-5t  payload: %d bytes\n",
+					rp.Ssrc(), rp.PayloadType(), rp.Sequence(), rp.Timestamp(), rp.Marker(), len(rp.Payload()))
+			}
+			if recorder != nil {
+				if err := recorder.WritePacket(time.Now(), rp.Buffer()[:rp.InUse()]); err != nil {
+					fmt.Fprintln(os.Stderr, "gortp-recv: record:", err)
+				}
+			}
+			rp.FreePacket()
+
+		case events := <-ctrlReceiver:
+			for _, ev := range events {
+				switch ev.EventType {
+				case rtp.NewStreamData, rtp.NewStreamCtrl:
+					fmt.Printf("New input stream SSRC 0x%08x\n", ev.Ssrc)
+					streams = append(streams, ev.Index)
+				case rtp.RtcpBye:
+					fmt.Printf("BYE from SSRC 0x%08x: %s\n", ev.Ssrc, ev.Reason)
+				}
+			}
+
+		case <-statsTick:
+			fmt.Printf("%s: %d input streams\n", time.Now().Format("15:04:05"), len(streams))
+			printStats(rs, streams)
+
+		case <-stop:
+			running = false
+		case <-interrupt:
+			running = false
+		}
+	}
+	fmt.Println("Final statistics:")
+	printStats(rs, streams)
+	rs.CloseSession()
+}
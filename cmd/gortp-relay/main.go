@@ -0,0 +1,151 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+// gortp-relay relays RTP and RTCP packets from a local port pair to one or more destinations.
+//
+// The relay is a reference application of the rtp.Forwarder. It optionally re-writes SSRCs
+// and protects the relayed packets with SRTP, or removes SRTP from received packets. The SRTP
+// keys are base64 encoded master key and salt as used in SDES (RFC 4568) inline parameters.
+//
+// Usage:
+//
+//   gortp-relay -local 0.0.0.0:5230 -dest 10.0.0.2:5222,10.0.0.3:5222
+//   gortp-relay -local 0.0.0.0:5230 -dest 10.0.0.2:5222 -ssrc-map 0x1234=0x5678 -srtp-out <key>
+//
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/room732/gortp"
+)
+
+var (
+	localFlag   = flag.String("local", "0.0.0.0:5230", "local address and RTP port (RTCP uses port+1)")
+	destFlag    = flag.String("dest", "", "comma separated list of destination addresses and RTP ports")
+	ssrcMapFlag = flag.String("ssrc-map", "", "comma separated list of old=new SSRC re-writes")
+	srtpOutFlag = flag.String("srtp-out", "", "base64 master key and salt to protect relayed packets with SRTP")
+	srtpInFlag  = flag.String("srtp-in", "", "base64 master key and salt to check and decrypt received SRTP packets")
+)
+
+func resolve(hostPort string) (*rtp.Address, error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return nil, err
+	}
+	return &rtp.Address{IpAddr: ip.IP, DataPort: port, CtrlPort: port + 1}, nil
+}
+
+func decodeKey(key string) ([]byte, error) {
+	if key == "" {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(key)
+}
+
+func fatal(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "gortp-relay: "+format+"\n", a...)
+	os.Exit(2)
+}
+
+func main() {
+	flag.Parse()
+	if *destFlag == "" {
+		fatal("at least one destination (-dest) is required")
+	}
+	local, err := resolve(*localFlag)
+	if err != nil {
+		fatal("local address: %s", err)
+	}
+	outKey, err := decodeKey(*srtpOutFlag)
+	if err != nil {
+		fatal("srtp-out key: %s", err)
+	}
+	inKey, err := decodeKey(*srtpInFlag)
+	if err != nil {
+		fatal("srtp-in key: %s", err)
+	}
+
+	tp, _ := rtp.NewTransportUDP(&net.IPAddr{IP: local.IpAddr}, local.DataPort)
+	var tpr rtp.TransportRecv = tp
+	var tpw rtp.TransportWrite = tp
+	if outKey != nil || inKey != nil {
+		srtp, err := rtp.NewTransportSRTP(tp, tp, outKey, inKey)
+		if err != nil {
+			fatal("%s", err)
+		}
+		tpr, tpw = srtp, srtp
+	}
+	fw := rtp.NewForwarder(tpr, tpw)
+
+	for _, d := range strings.Split(*destFlag, ",") {
+		dest, err := resolve(strings.TrimSpace(d))
+		if err != nil {
+			fatal("destination address: %s", err)
+		}
+		fw.AddDestination(dest)
+		fmt.Printf("gortp-relay: relaying %s:%d to %s:%d\n", local.IpAddr, local.DataPort, dest.IpAddr, dest.DataPort)
+	}
+	if *ssrcMapFlag != "" {
+		for _, m := range strings.Split(*ssrcMapFlag, ",") {
+			pair := strings.SplitN(m, "=", 2)
+			if len(pair) != 2 {
+				fatal("malformed SSRC re-write '%s'", m)
+			}
+			from, err1 := strconv.ParseUint(strings.TrimSpace(pair[0]), 0, 32)
+			to, err2 := strconv.ParseUint(strings.TrimSpace(pair[1]), 0, 32)
+			if err1 != nil || err2 != nil {
+				fatal("malformed SSRC re-write '%s'", m)
+			}
+			fw.SetSsrcRewrite(uint32(from), uint32(to))
+		}
+	}
+
+	// The receiver loops signal on this channel when they stopped
+	end := make(rtp.TransportEnd, 2)
+	fw.SetEndChannel(end)
+
+	if err = fw.ListenOnTransports(); err != nil {
+		fmt.Fprintln(os.Stderr, "gortp-relay:", err)
+		os.Exit(1)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+
+	fw.CloseRecv()
+	for allClosed := 0; allClosed != (rtp.DataTransportRecvStopped | rtp.CtrlTransportRecvStopped); {
+		allClosed |= <-end
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+// gortp-send streams a file as RTP to a remote destination.
+//
+// The file is either a raw payload file that the tool splits into frames of a fixed size, a
+// rtpdump file, or a pcap file. For rtpdump and pcap files the tool re-sends the payload,
+// payload type, marker and timestamp progression of the captured RTP packets using its own
+// SSRC and sequence numbers, and paces the packets according to the capture times.
+//
+// Usage:
+//
+//   gortp-send -remote 127.0.0.1:5222 -file music.ulaw -pt 0 -ptime 20
+//   gortp-send -remote 127.0.0.1:5222 -file call.pcap -ssrc-filter 0x12345678
+//
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/room732/gortp"
+	"github.com/room732/gortp/capture"
+)
+
+var (
+	localFlag      = flag.String("local", "0.0.0.0:5220", "local address and RTP port (RTCP uses port+1)")
+	remoteFlag     = flag.String("remote", "", "remote address and RTP port (RTCP uses port+1)")
+	fileFlag       = flag.String("file", "", "file to send")
+	formatFlag     = flag.String("format", "", "file format: raw, rtpdump, or pcap (default: derived from file name)")
+	ptFlag         = flag.Int("pt", 0, "payload type of the output stream")
+	clockRateFlag  = flag.Int("clockrate", 0, "clock rate if the payload type is not a well known type")
+	ptimeFlag      = flag.Int("ptime", 20, "raw files: packet time in milliseconds")
+	frameSizeFlag  = flag.Int("framesize", 160, "raw files: payload bytes per packet")
+	ssrcFlag       = flag.Uint("ssrc", 0, "SSRC of the output stream, random if zero")
+	ssrcFilterFlag = flag.String("ssrc-filter", "", "rtpdump/pcap: send only packets of this SSRC, default is the first SSRC found")
+	loopFlag       = flag.Bool("loop", false, "restart at the end of the file")
+	noRtcpFlag     = flag.Bool("nortcp", false, "simple RTP, do not start the RTCP service")
+)
+
+// frame is one packet to send: payload plus its attributes relative to the start of the file
+type frame struct {
+	offset    time.Duration // send time relative to start of the stream
+	stamp     uint32        // RTP timestamp relative to the first packet
+	payload   []byte
+	pt        byte
+	marker    bool
+	hasHeader bool // pt/marker valid, taken from a captured RTP packet
+}
+
+func resolve(hostPort string) (*rtp.Address, error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return nil, err
+	}
+	return &rtp.Address{IpAddr: ip.IP, DataPort: port, CtrlPort: port + 1}, nil
+}
+
+// readRaw splits a raw payload file into frames of equal size.
+func readRaw(r io.Reader, clockRate int) (frames []*frame, err error) {
+	samples := uint32(clockRate * *ptimeFlag / 1000)
+	ptime := time.Duration(*ptimeFlag) * time.Millisecond
+
+	for i := 0; ; i++ {
+		buf := make([]byte, *frameSizeFlag)
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			frames = append(frames, &frame{offset: time.Duration(i) * ptime, stamp: uint32(i) * samples, payload: buf[:n]})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return frames, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readCapture reads the RTP packets of one SSRC from a rtpdump or pcap capture.
+func readCapture(rd capture.Reader) (frames []*frame, err error) {
+	var ssrc uint32
+	haveSsrc := false
+	if *ssrcFilterFlag != "" {
+		v, err := strconv.ParseUint(*ssrcFilterFlag, 0, 32)
+		if err != nil {
+			return nil, err
+		}
+		ssrc, haveSsrc = uint32(v), true
+	}
+	var start time.Time
+	var firstStamp uint32
+
+	for {
+		pkt, err := rd.ReadPacket()
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if capture.IsRtcp(pkt.Data) {
+			continue
+		}
+		rp, err := rtp.NewDataPacketFromBuffer(pkt.Data)
+		if err != nil {
+			continue
+		}
+		if !haveSsrc {
+			ssrc, haveSsrc = rp.Ssrc(), true
+		}
+		if rp.Ssrc() == ssrc {
+			if len(frames) == 0 {
+				start, firstStamp = pkt.Time, rp.Timestamp()
+			}
+			payload := make([]byte, len(rp.Payload()))
+			copy(payload, rp.Payload())
+			frames = append(frames, &frame{pkt.Time.Sub(start), rp.Timestamp() - firstStamp, payload,
+				rp.PayloadType(), rp.Marker(), true})
+		}
+		rp.FreePacket()
+	}
+}
+
+func readFile(name, format string, clockRate int) ([]*frame, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".pcap", ".cap":
+			format = "pcap"
+		case ".rtpdump", ".rtp":
+			format = "rtpdump"
+		default:
+			format = "raw"
+		}
+	}
+	switch format {
+	case "raw":
+		return readRaw(f, clockRate)
+	case "rtpdump":
+		rd, err := capture.NewRtpdumpReader(f)
+		if err != nil {
+			return nil, err
+		}
+		return readCapture(rd)
+	case "pcap":
+		rd, err := capture.NewPcapReader(f)
+		if err != nil {
+			return nil, err
+		}
+		return readCapture(rd)
+	}
+	return nil, fmt.Errorf("unknown file format '%s'", format)
+}
+
+func main() {
+	flag.Parse()
+	if *fileFlag == "" || *remoteFlag == "" {
+		fmt.Fprintln(os.Stderr, "gortp-send: -file and -remote are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+	pt := *ptFlag
+	if *clockRateFlag != 0 {
+		rtp.PayloadFormatMap[pt] = &rtp.PayloadFormat{TypeNumber: pt, MediaType: rtp.Audio, ClockRate: *clockRateFlag, Channels: 1, Name: "CLI"}
+	}
+	format := rtp.PayloadFormatMap[pt]
+	if format == nil {
+		fmt.Fprintf(os.Stderr, "gortp-send: unknown payload type %d, use -clockrate\n", pt)
+		os.Exit(2)
+	}
+	local, err := resolve(*localFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gortp-send: local address:", err)
+		os.Exit(2)
+	}
+	remote, err := resolve(*remoteFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gortp-send: remote address:", err)
+		os.Exit(2)
+	}
+	frames, err := readFile(*fileFlag, *formatFlag, format.ClockRate)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gortp-send:", err)
+		os.Exit(1)
+	}
+	if len(frames) == 0 {
+		fmt.Fprintln(os.Stderr, "gortp-send: no packets to send")
+		os.Exit(1)
+	}
+
+	tp, _ := rtp.NewTransportUDP(&net.IPAddr{IP: local.IpAddr}, local.DataPort)
+	rs := rtp.NewSession(tp, tp)
+	rs.AddRemote(remote)
+	strIdx, _ := rs.NewSsrcStreamOut(local, uint32(*ssrcFlag), 0)
+	rs.SsrcStreamOutForIndex(strIdx).SetPayloadType(byte(pt))
+
+	if *noRtcpFlag {
+		err = rs.ListenOnTransports()
+	} else {
+		err = rs.StartSession()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gortp-send:", err)
+		os.Exit(1)
+	}
+
+	// Pace against the start time of each pass, not against the previous packet, thus sleep
+	// inaccuracies do not accumulate.
+	var sent, octets int
+	var stampBase uint32
+	for pass := 0; pass == 0 || *loopFlag; pass++ {
+		start := time.Now()
+		last := frames[len(frames)-1]
+		for _, fr := range frames {
+			rtp.WaitUntil(start.Add(fr.offset), nil)
+			rp := rs.NewDataPacketForStream(strIdx, stampBase+fr.stamp)
+			if fr.hasHeader {
+				rp.SetPayloadType(fr.pt)
+				rp.SetMarker(fr.marker)
+			}
+			rp.SetPayload(fr.payload)
+			if _, err = rs.WriteData(rp); err != nil {
+				fmt.Fprintln(os.Stderr, "gortp-send: write:", err)
+			}
+			rp.FreePacket()
+			sent++
+			octets += len(fr.payload)
+		}
+		// next pass continues the timestamps after the last frame of this pass
+		stampBase += last.stamp + uint32(format.ClockRate**ptimeFlag/1000)
+		fmt.Printf("gortp-send: pass %d done, %d packets, %d payload octets sent\n", pass+1, sent, octets)
+	}
+	if *noRtcpFlag {
+		rs.CloseRecv()
+	} else {
+		rs.CloseSession()
+	}
+}
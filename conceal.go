@@ -0,0 +1,193 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"sync"
+)
+
+// Gap describes a missing packet of an input stream at the time of its playout.
+type Gap struct {
+	Ssrc        uint32
+	Sequence    uint16 // sequence number of the missing packet
+	Timestamp   uint32 // timestamp interpolated between the packets around the gap
+	PayloadType byte   // payload type of the packet before the gap
+	Position    int    // position of the missing packet in the gap, 0 is the first
+	Length      int    // number of missing packets in the gap
+}
+
+// ConcealmentProvider synthesizes the payload of a missing packet, e.g. the packet loss
+// concealment (PLC) of a codec. It returns false if it can't conceal the packet, the Concealer
+// then emits a gap marker instead.
+//
+//   gap      - the missing packet
+//   previous - the payload of the last packet before the gap, do not keep it
+//
+type ConcealmentProvider interface {
+	Conceal(gap Gap, previous []byte) (payload []byte, ok bool)
+}
+
+// Concealer is the insertion point of packet loss concealment on the receive side.
+//
+// A jitter buffer passes the packets of its input streams in playout order to Playout. If a
+// packet follows a gap the concealer asks the ConcealmentProvider of the payload type to
+// synthesize the missing packets and returns them ahead of the packet. Without a provider, or if
+// the provider fails, the concealer returns a gap marker: a packet with the sequence number and
+// timestamp of the missing packet but without payload. Concealed packets and gap markers report
+// Concealed true, thus a PLC capable decoder sees a notified gap and not a silent discontinuity.
+//
+// Gaps longer than MaxGap are not concealed, one gap marker with the first missing sequence
+// number stands for the whole gap. Packets that arrive after the concealer concealed or skipped
+// them are late, Playout drops them.
+//
+// A session runs a concealer on its in-order delivery path if the application sets it with
+// SetConcealer. The session forwards the packets on arrival, thus a retransmission arrives late
+// if a later packet arrived before it. Applications that use retransmissions call Playout from
+// their jitter buffer instead.
+//
+type Concealer struct {
+	MaxGap int // longest concealed gap in packets, default 10
+
+	mutex     sync.Mutex
+	providers map[byte]ConcealmentProvider
+	sources   map[uint32]*concealSource
+	concealed uint32
+	markers   uint32
+	late      uint32
+}
+
+type concealSource struct {
+	seq     uint16
+	stamp   uint32
+	pt      byte
+	payload []byte // copy of the last played payload
+}
+
+// ConcealStats are the counters of a Concealer.
+type ConcealStats struct {
+	Concealed uint32 // packets the providers synthesized
+	Markers   uint32 // gap markers for packets without concealment
+	Late      uint32 // dropped packets that arrived after their playout
+}
+
+// NewConcealer creates a concealer without providers.
+func NewConcealer() *Concealer {
+	return &Concealer{MaxGap: 10, providers: make(map[byte]ConcealmentProvider),
+		sources: make(map[uint32]*concealSource)}
+}
+
+// Register sets the concealment provider of a payload type, nil removes it.
+func (cc *Concealer) Register(pt byte, cp ConcealmentProvider) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	if cp == nil {
+		delete(cc.providers, pt)
+		return
+	}
+	cc.providers[pt] = cp
+}
+
+// Stats returns the counters of the concealer.
+func (cc *Concealer) Stats() ConcealStats {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return ConcealStats{Concealed: cc.concealed, Markers: cc.markers, Late: cc.late}
+}
+
+// Remove forgets the state of an input stream, e.g. after its BYE.
+func (cc *Concealer) Remove(ssrc uint32) {
+	cc.mutex.Lock()
+	delete(cc.sources, ssrc)
+	cc.mutex.Unlock()
+}
+
+// Playout returns the packets to play for the next packet of an input stream: the concealed
+// packets or gap markers of a gap before it, followed by the packet. It returns nil and frees
+// the packet if the packet is late or a duplicate.
+func (cc *Concealer) Playout(rp *DataPacket) []*DataPacket {
+	ssrc := rp.Ssrc()
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	src, ok := cc.sources[ssrc]
+	if !ok {
+		src = new(concealSource)
+		cc.sources[ssrc] = src
+	} else {
+		delta := int16(rp.Sequence() - src.seq)
+		if delta <= 0 {
+			cc.late++
+			rp.FreePacket()
+			return nil
+		}
+		if delta > 1 {
+			out := cc.conceal(ssrc, src, rp, int(delta-1))
+			src.update(rp)
+			return append(out, rp)
+		}
+	}
+	src.update(rp)
+	return []*DataPacket{rp}
+}
+
+// *** Local functions and methods.
+
+func (src *concealSource) update(rp *DataPacket) {
+	src.seq, src.stamp, src.pt = rp.Sequence(), rp.Timestamp(), rp.PayloadType()
+	src.payload = append(src.payload[:0], rp.Payload()...)
+}
+
+// conceal builds the packets of a gap of length missing packets before rp.
+func (cc *Concealer) conceal(ssrc uint32, src *concealSource, rp *DataPacket, length int) []*DataPacket {
+	if length > cc.MaxGap {
+		cc.markers++
+		return []*DataPacket{concealedPacket(ssrc, src.seq+1, src.stamp, src.pt, nil)}
+	}
+	cp := cc.providers[src.pt]
+	span := rp.Timestamp() - src.stamp
+	out := make([]*DataPacket, 0, length+1)
+	for i := 0; i < length; i++ {
+		gap := Gap{Ssrc: ssrc, Sequence: src.seq + uint16(i+1), PayloadType: src.pt, Position: i, Length: length,
+			Timestamp: src.stamp + uint32(uint64(span)*uint64(i+1)/uint64(length+1))}
+		var payload []byte
+		ok := false
+		if cp != nil {
+			payload, ok = cp.Conceal(gap, src.payload)
+		}
+		if ok {
+			cc.concealed++
+		} else {
+			payload = nil
+			cc.markers++
+		}
+		out = append(out, concealedPacket(ssrc, gap.Sequence, gap.Timestamp, gap.PayloadType, payload))
+	}
+	return out
+}
+
+func concealedPacket(ssrc uint32, seq uint16, stamp uint32, pt byte, payload []byte) *DataPacket {
+	rp := newDataPacket()
+	rp.SetSsrc(ssrc)
+	rp.SetSequence(seq)
+	rp.SetTimestamp(stamp)
+	rp.SetPayloadType(pt)
+	rp.SetPayload(payload)
+	rp.concealed = true
+	return rp
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"testing"
+)
+
+// repeatPlc conceals a packet with a copy of the previous payload.
+type repeatPlc struct {
+	gaps []Gap
+}
+
+func (p *repeatPlc) Conceal(gap Gap, previous []byte) ([]byte, bool) {
+	p.gaps = append(p.gaps, gap)
+	return append([]byte{}, previous...), true
+}
+
+func concealPacket(seq uint16, pt byte) *DataPacket {
+	rp := newDataPacket()
+	rp.SetSsrc(0x01020304)
+	rp.SetSequence(seq)
+	rp.SetTimestamp(uint32(seq) * 160)
+	rp.SetPayloadType(pt)
+	rp.SetPayload([]byte{byte(seq), 1, 2, 3})
+	return rp
+}
+
+func TestConcealer(t *testing.T) {
+	parseFlags()
+
+	plc := new(repeatPlc)
+	cc := NewConcealer()
+	cc.Register(0, plc)
+
+	cc.Playout(concealPacket(1, 0))
+	cc.Playout(concealPacket(2, 0))
+	out := cc.Playout(concealPacket(5, 0))
+	if len(out) != 3 || out[2].Sequence() != 5 || out[2].Concealed() {
+		t.Errorf("Concealment check failed, got %d packets\n", len(out))
+		return
+	}
+	for i, rp := range out[:2] {
+		seq := uint16(3 + i)
+		if !rp.Concealed() || rp.Sequence() != seq || rp.Timestamp() != uint32(seq)*160 || rp.Payload()[0] != 2 {
+			t.Errorf("Concealed packet %d check failed: %d, %d\n", i, rp.Sequence(), rp.Timestamp())
+		}
+	}
+	if len(plc.gaps) != 2 || plc.gaps[1].Position != 1 || plc.gaps[1].Length != 2 {
+		t.Errorf("Provider gap check failed: %+v\n", plc.gaps)
+	}
+	if cc.Playout(concealPacket(4, 0)) != nil {
+		t.Errorf("Concealer must drop late packets\n")
+	}
+
+	// No provider for PT 8: gap markers, and one marker for a gap longer than MaxGap
+	cc.Playout(concealPacket(6, 8))
+	out = cc.Playout(concealPacket(8, 8))
+	if len(out) != 2 || !out[0].Concealed() || len(out[0].Payload()) != 0 || out[0].Sequence() != 7 {
+		t.Errorf("Gap marker check failed\n")
+	}
+	out = cc.Playout(concealPacket(30, 8))
+	if len(out) != 2 || !out[0].Concealed() || out[0].Sequence() != 9 {
+		t.Errorf("Long gap marker check failed, got %d packets\n", len(out))
+	}
+	if st := cc.Stats(); st.Concealed != 2 || st.Markers != 2 || st.Late != 1 {
+		t.Errorf("Concealer stats check failed: %+v\n", st)
+	}
+	out[0].FreePacket()
+	if out[0].Concealed() {
+		t.Errorf("FreePacket must clear the concealed flag\n")
+	}
+}
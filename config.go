@@ -0,0 +1,260 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the declarative session configuration and the BuildSession constructor.
+ */
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config describes a complete session: transport, addresses, payload formats, streams, SRTP
+// and RTCP parameters.
+//
+// Config and its parts use only basic types, thus applications can read them with
+// encoding/json (see ReadConfig) or any YAML package that honors the yaml field tags.
+// Addresses are "host:port" strings, the port is the RTP data port and the RTCP control
+// port is the next port. Transport is a scheme of RegisterTransport, the transport listens on
+// the local address, or a complete transport URI, "mcast://239.1.2.3:5004?iface=eth0" for
+// example. Example (JSON):
+//
+//     {
+//       "transport": "udp",
+//       "profile": "RTP/SAVPF",
+//       "local": "0.0.0.0:5220",
+//       "remotes": ["10.0.0.2:5222"],
+//       "payloads": [{"type": 98, "media": "audio", "clockRate": 48000, "channels": 2, "name": "opus"}],
+//       "streams": [{"payloadType": 98, "cname": "sender@example.com"}],
+//       "extensions": [{"id": 1, "uri": "urn:ietf:params:rtp-hdrext:ssrc-audio-level"}],
+//       "srtp": {"sendKey": "<base64 key and salt>", "recvKey": "<base64 key and salt>"},
+//       "rtcp": {"bandwidth": 4000}
+//     }
+//
+type Config struct {
+	Transport  string            `json:"transport,omitempty" yaml:"transport,omitempty"` // scheme or URI, see RegisterTransport, "udp" (default)
+	Profile    string            `json:"profile,omitempty" yaml:"profile,omitempty"`     // "RTP/AVPF" (default), "RTP/AVP", "RTP/SAVPF" or "RTP/SAVP"
+	Local      string            `json:"local" yaml:"local"`
+	Remotes    []string          `json:"remotes,omitempty" yaml:"remotes,omitempty"`
+	Payloads   []PayloadConfig   `json:"payloads,omitempty" yaml:"payloads,omitempty"`
+	Streams    []StreamConfig    `json:"streams,omitempty" yaml:"streams,omitempty"`
+	Extensions []ExtensionConfig `json:"extensions,omitempty" yaml:"extensions,omitempty"`
+	Srtp       *SrtpConfig       `json:"srtp,omitempty" yaml:"srtp,omitempty"`
+	Rtcp       RtcpConfig        `json:"rtcp,omitempty" yaml:"rtcp,omitempty"`
+}
+
+// PayloadConfig describes a payload format that BuildSession adds to PayloadFormatMap.
+//
+// Usually these are dynamic payload formats (96 - 127). Media is "audio", "video" or
+// "audio/video".
+//
+type PayloadConfig struct {
+	Type      int    `json:"type" yaml:"type"`
+	Media     string `json:"media" yaml:"media"`
+	ClockRate int    `json:"clockRate" yaml:"clockRate"`
+	Channels  int    `json:"channels,omitempty" yaml:"channels,omitempty"`
+	Name      string `json:"name" yaml:"name"`
+	FrameMs   int    `json:"frameMs,omitempty" yaml:"frameMs,omitempty"`     // frame duration in milliseconds, 0 if not fixed
+	FrameSize int    `json:"frameSize,omitempty" yaml:"frameSize,omitempty"` // bytes of a frame
+}
+
+// StreamConfig describes an output stream. A zero Ssrc or Sequence selects a random value.
+type StreamConfig struct {
+	Ssrc        uint32 `json:"ssrc,omitempty" yaml:"ssrc,omitempty"`
+	Sequence    uint16 `json:"sequence,omitempty" yaml:"sequence,omitempty"`
+	PayloadType byte   `json:"payloadType" yaml:"payloadType"`
+	Cname       string `json:"cname,omitempty" yaml:"cname,omitempty"`
+	Name        string `json:"name,omitempty" yaml:"name,omitempty"`
+	Email       string `json:"email,omitempty" yaml:"email,omitempty"`
+	Tool        string `json:"tool,omitempty" yaml:"tool,omitempty"`
+	Ptime       int    `json:"ptime,omitempty" yaml:"ptime,omitempty"`       // SDP a=ptime in milliseconds
+	MaxPtime    int    `json:"maxPtime,omitempty" yaml:"maxPtime,omitempty"` // SDP a=maxptime in milliseconds
+}
+
+// ExtensionConfig maps a header extension URI to its negotiated ID (SDP a=extmap), see
+// ExtensionMap.
+type ExtensionConfig struct {
+	Id  byte   `json:"id" yaml:"id"`
+	Uri string `json:"uri" yaml:"uri"`
+}
+
+// SrtpConfig holds the base64 encoded SRTP master keys and salts, see NewTransportSRTP.
+// An empty key disables SRTP in this direction.
+type SrtpConfig struct {
+	SendKey string `json:"sendKey,omitempty" yaml:"sendKey,omitempty"`
+	RecvKey string `json:"recvKey,omitempty" yaml:"recvKey,omitempty"`
+}
+
+// RtcpConfig holds the RTCP and stream limit parameters of a session. Zero values keep the
+// session's defaults.
+type RtcpConfig struct {
+	Bandwidth     float64 `json:"bandwidth,omitempty" yaml:"bandwidth,omitempty"` // RTCP bandwidth in bits/sec
+	MaxOutStreams int     `json:"maxOutStreams,omitempty" yaml:"maxOutStreams,omitempty"`
+	MaxInStreams  int     `json:"maxInStreams,omitempty" yaml:"maxInStreams,omitempty"`
+}
+
+// ReadConfig reads a JSON encoded session configuration.
+func ReadConfig(r io.Reader) (*Config, error) {
+	cfg := new(Config)
+	if err := json.NewDecoder(r).Decode(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// BuildSession creates a session as described by the configuration.
+//
+// The function creates the transport with NewTransportFromUri and stacks an SRTP transport on top of it if the
+// configuration contains SRTP keys, registers the payload formats, adds the remotes and
+// creates the output streams, stream index 0 is the first stream of the configuration.
+// The application then creates its data and control channels and starts the session.
+//
+func BuildSession(cfg *Config) (*Session, error) {
+	local, err := resolveConfigAddr(cfg.Local)
+	if err != nil {
+		return nil, err
+	}
+	uri := cfg.Transport
+	if uri == "" {
+		uri = "udp"
+	}
+	if !strings.Contains(uri, "://") {
+		uri += "://" + cfg.Local
+	}
+	tpr, tpw, err := NewTransportFromUri(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Srtp != nil && (cfg.Srtp.SendKey != "" || cfg.Srtp.RecvKey != "") {
+		sendKey, err := decodeConfigKey(cfg.Srtp.SendKey)
+		if err != nil {
+			return nil, err
+		}
+		recvKey, err := decodeConfigKey(cfg.Srtp.RecvKey)
+		if err != nil {
+			return nil, err
+		}
+		srtp, err := NewTransportSRTP(tpr, tpw, sendKey, recvKey)
+		if err != nil {
+			return nil, err
+		}
+		tpr, tpw = srtp, srtp
+	}
+
+	for _, pc := range cfg.Payloads {
+		media := 0
+		for _, m := range strings.Split(pc.Media, "/") {
+			switch strings.ToLower(m) {
+			case "audio":
+				media |= Audio
+			case "video":
+				media |= Video
+			default:
+				return nil, Error("Unknown media type in payload configuration: " + pc.Media)
+			}
+		}
+		if pc.Type < 0 || pc.Type > 127 || pc.ClockRate <= 0 {
+			return nil, Error("Invalid payload configuration: " + pc.Name)
+		}
+		PayloadFormatMap[pc.Type] = &PayloadFormat{TypeNumber: pc.Type, MediaType: media, ClockRate: pc.ClockRate,
+			Channels: pc.Channels, Name: pc.Name, FrameDuration: time.Duration(pc.FrameMs) * time.Millisecond, FrameSize: pc.FrameSize}
+	}
+
+	rs := NewSession(tpw, tpr)
+	if cfg.Profile != "" {
+		profile, err := ParseRtpProfile(cfg.Profile)
+		if err != nil {
+			return nil, err
+		}
+		rs.SetRtpProfile(profile)
+	}
+	if cfg.Rtcp.Bandwidth > 0 {
+		rs.RtcpSessionBandwidth = cfg.Rtcp.Bandwidth
+	}
+	if cfg.Rtcp.MaxOutStreams > 0 {
+		rs.MaxNumberOutStreams = cfg.Rtcp.MaxOutStreams
+	}
+	if cfg.Rtcp.MaxInStreams > 0 {
+		rs.MaxNumberInStreams = cfg.Rtcp.MaxInStreams
+	}
+	for _, ec := range cfg.Extensions {
+		if err := rs.ExtensionMap().Register(ec.Id, ec.Uri); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, remote := range cfg.Remotes {
+		addr, err := resolveConfigAddr(remote)
+		if err != nil {
+			return nil, err
+		}
+		rs.AddRemote(addr)
+	}
+
+	for _, sc := range cfg.Streams {
+		idx, err := rs.NewSsrcStreamOut(local, sc.Ssrc, sc.Sequence)
+		if err != "" {
+			return nil, err
+		}
+		str := rs.SsrcStreamOutForIndex(idx)
+		if !str.SetPayloadType(sc.PayloadType) {
+			return nil, Error("Unknown payload type in stream configuration: " + strconv.Itoa(int(sc.PayloadType)))
+		}
+		if err := str.SetPtime(time.Duration(sc.Ptime)*time.Millisecond, time.Duration(sc.MaxPtime)*time.Millisecond); err != nil {
+			return nil, err
+		}
+		for itemType, text := range map[int]string{SdesCname: sc.Cname, SdesName: sc.Name, SdesEmail: sc.Email, SdesTool: sc.Tool} {
+			if text != "" {
+				str.SetSdesItem(itemType, text)
+			}
+		}
+	}
+	return rs, nil
+}
+
+func resolveConfigAddr(hostPort string) (*Address, error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return nil, err
+	}
+	return &Address{IpAddr: ip.IP, DataPort: port, CtrlPort: port + 1}, nil
+}
+
+func decodeConfigKey(key string) ([]byte, error) {
+	if key == "" {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(key)
+}
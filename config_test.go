@@ -0,0 +1,85 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestBuildSession(t *testing.T) {
+	parseFlags()
+
+	key := base64.StdEncoding.EncodeToString(srtpMasterKeySalt())
+	cfg, err := ReadConfig(strings.NewReader(`{
+		"local": "127.0.0.1:54020",
+		"profile": "RTP/SAVP",
+		"remotes": ["127.0.0.1:54022"],
+		"payloads": [{"type": 111, "media": "audio", "clockRate": 48000, "channels": 2, "name": "opus"}],
+		"streams": [{"ssrc": 305419896, "sequence": 100, "payloadType": 111, "cname": "config"}],
+		"extensions": [{"id": 3, "uri": "urn:ietf:params:rtp-hdrext:sdes:mid"}],
+		"srtp": {"sendKey": "` + key + `"},
+		"rtcp": {"bandwidth": 2000, "maxInStreams": 10}
+	}`))
+	if err != nil {
+		t.Errorf("ReadConfig failed: %s\n", err)
+		return
+	}
+	rs, err := BuildSession(cfg)
+	if err != nil {
+		t.Errorf("BuildSession failed: %s\n", err)
+		return
+	}
+	defer delete(PayloadFormatMap, 111)
+
+	str := rs.SsrcStreamOutForIndex(0)
+	if str == nil || str.Ssrc() != 0x12345678 || str.PayloadType() != 111 || str.SdesItems[SdesCname] != "config" {
+		t.Errorf("Configured stream check failed\n")
+	}
+	if pf := PayloadFormatMap[111]; pf == nil || pf.ClockRate != 48000 || pf.MediaType != Audio {
+		t.Errorf("Configured payload format check failed\n")
+	}
+	if remote := rs.remotes[0]; remote == nil || remote.DataPort != 54022 || remote.CtrlPort != 54023 {
+		t.Errorf("Configured remote check failed\n")
+	}
+	if id, ok := rs.ExtensionMap().Id(ExtSdesMid); !ok || id != 3 {
+		t.Errorf("Configured header extension check failed\n")
+	}
+	if _, ok := rs.transportWrite.(*TransportSRTP); !ok {
+		t.Errorf("Configured SRTP transport check failed\n")
+	}
+	if rs.RtcpSessionBandwidth != 2000 || rs.MaxNumberInStreams != 10 || rs.MaxNumberOutStreams != maxNumberOutStreams {
+		t.Errorf("Configured RTCP parameter check failed\n")
+	}
+	if rs.RtpProfile() != RtpProfileSavp {
+		t.Errorf("Configured RTP profile check failed: %d\n", rs.RtpProfile())
+	}
+
+	cfg.Profile = "RTP/XYZ"
+	if _, err = BuildSession(cfg); err == nil {
+		t.Errorf("Unknown RTP profile check failed\n")
+	}
+	cfg.Profile = ""
+
+	cfg.Transport = "pigeon"
+	if _, err = BuildSession(cfg); err == nil {
+		t.Errorf("Unknown transport check failed\n")
+	}
+}
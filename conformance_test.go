@@ -0,0 +1,327 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// The conformance vectors are packets as sent by common RTP implementations (libwebrtc, FFmpeg,
+// GStreamer, Asterisk) together with the parse results the stack must produce for them. Each
+// vector is a JSON file in testdata/conformance. To add a vector just drop a new file into
+// this directory, the test picks up all files.
+//
+const conformanceDir = "testdata/conformance"
+
+type conformanceVector struct {
+	Source      string          `json:"source"`
+	Description string          `json:"description"`
+	Kind        string          `json:"kind"` // either "rtp" or "rtcp"
+	Packet      string          `json:"packet"`
+	Expect      json.RawMessage `json:"expect"`
+}
+
+type goldenRtp struct {
+	Valid           bool     `json:"valid"`
+	Padding         bool     `json:"padding"`
+	Extension       bool     `json:"extension"`
+	Marker          bool     `json:"marker"`
+	PayloadType     byte     `json:"payload_type"`
+	Sequence        uint16   `json:"sequence"`
+	Timestamp       uint32   `json:"timestamp"`
+	Ssrc            uint32   `json:"ssrc"`
+	Csrc            []uint32 `json:"csrc"`
+	ExtensionLength int      `json:"extension_length"`
+	Payload         string   `json:"payload"`
+}
+
+type goldenRtcpPacket struct {
+	Type   int    `json:"type"`
+	Count  int    `json:"count"`
+	Length uint16 `json:"length"`
+	Ssrc   uint32 `json:"ssrc"`
+}
+
+type goldenSenderInfo struct {
+	NtpSeconds   uint32 `json:"ntp_seconds"`
+	NtpFraction  uint32 `json:"ntp_fraction"`
+	RtpTimestamp uint32 `json:"rtp_timestamp"`
+	PacketCount  uint32 `json:"packet_count"`
+	OctetCount   uint32 `json:"octet_count"`
+}
+
+type goldenReportBlock struct {
+	Ssrc         uint32 `json:"ssrc"`
+	FractionLost byte   `json:"fraction_lost"`
+	PacketsLost  uint32 `json:"packets_lost"`
+	HighestSeq   uint32 `json:"highest_seq"`
+	Jitter       uint32 `json:"jitter"`
+	Lsr          uint32 `json:"lsr"`
+	Dlsr         uint32 `json:"dlsr"`
+}
+
+type goldenSdes struct {
+	Ssrc  uint32            `json:"ssrc"`
+	Items map[string]string `json:"items"`
+}
+
+type goldenRtcp struct {
+	Packets      []goldenRtcpPacket  `json:"packets"`
+	SenderInfo   *goldenSenderInfo   `json:"sender_info"`
+	ReportBlocks []goldenReportBlock `json:"report_blocks"`
+	Sdes         []goldenSdes        `json:"sdes"`
+	Bye          *struct {
+		Ssrc   uint32 `json:"ssrc"`
+		Reason string `json:"reason"`
+	} `json:"bye"`
+	Feedback *struct {
+		MediaSsrc uint32 `json:"media_ssrc"`
+		Fci       string `json:"fci"`
+	} `json:"feedback"`
+}
+
+func loadConformanceVectors(t *testing.T) (names []string, vectors []*conformanceVector) {
+	files, err := filepath.Glob(filepath.Join(conformanceDir, "*.json"))
+	if err != nil || len(files) == 0 {
+		t.Errorf("No conformance vectors found in %s\n", conformanceDir)
+		return
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Errorf("Cannot read conformance vector %s: %s\n", file, err)
+			continue
+		}
+		vec := new(conformanceVector)
+		if err = json.Unmarshal(data, vec); err != nil {
+			t.Errorf("Cannot parse conformance vector %s: %s\n", file, err)
+			continue
+		}
+		names = append(names, filepath.Base(file))
+		vectors = append(vectors, vec)
+	}
+	return
+}
+
+func conformanceRtp(t *testing.T, name string, buf []byte, expect *goldenRtp) {
+	rp := new(DataPacket)
+	rp.buffer = buf
+	rp.inUse = len(buf)
+
+	if rp.IsValid() != expect.Valid {
+		t.Errorf("%s: valid check failed. Expected: %v, got: %v\n", name, expect.Valid, rp.IsValid())
+	}
+	if rp.Padding() != expect.Padding {
+		t.Errorf("%s: padding check failed. Expected: %v, got: %v\n", name, expect.Padding, rp.Padding())
+	}
+	if rp.ExtensionBit() != expect.Extension {
+		t.Errorf("%s: extension bit check failed. Expected: %v, got: %v\n", name, expect.Extension, rp.ExtensionBit())
+	}
+	if rp.Marker() != expect.Marker {
+		t.Errorf("%s: marker check failed. Expected: %v, got: %v\n", name, expect.Marker, rp.Marker())
+	}
+	if rp.PayloadType() != expect.PayloadType {
+		t.Errorf("%s: payload type check failed. Expected: %d, got: %d\n", name, expect.PayloadType, rp.PayloadType())
+	}
+	if rp.Sequence() != expect.Sequence {
+		t.Errorf("%s: sequence check failed. Expected: %d, got: %d\n", name, expect.Sequence, rp.Sequence())
+	}
+	if rp.Timestamp() != expect.Timestamp {
+		t.Errorf("%s: timestamp check failed. Expected: 0x%x, got: 0x%x\n", name, expect.Timestamp, rp.Timestamp())
+	}
+	if rp.Ssrc() != expect.Ssrc {
+		t.Errorf("%s: SSRC check failed. Expected: 0x%x, got: 0x%x\n", name, expect.Ssrc, rp.Ssrc())
+	}
+	csrc := rp.CsrcList()
+	if len(csrc) != len(expect.Csrc) {
+		t.Errorf("%s: CSRC count check failed. Expected: %d, got: %d\n", name, len(expect.Csrc), len(csrc))
+	} else {
+		for i, v := range expect.Csrc {
+			if csrc[i] != v {
+				t.Errorf("%s: CSRC check failed at %d. Expected: 0x%x, got: 0x%x\n", name, i, v, csrc[i])
+			}
+		}
+	}
+	if rp.ExtensionLength() != expect.ExtensionLength {
+		t.Errorf("%s: extension length check failed. Expected: %d, got: %d\n", name, expect.ExtensionLength, rp.ExtensionLength())
+	}
+	if pay := hex.EncodeToString(rp.Payload()); pay != expect.Payload {
+		t.Errorf("%s: payload check failed. Expected: %s, got: %s\n", name, expect.Payload, pay)
+	}
+}
+
+func conformanceRtcp(t *testing.T, name string, buf []byte, expect *goldenRtcp) {
+	rp := new(CtrlPacket)
+	rp.buffer = buf
+	rp.inUse = len(buf)
+
+	var blocks []goldenReportBlock
+	var sdes []goldenSdes
+
+	offset := 0
+	for i := 0; offset < rp.inUse; i++ {
+		pktLen := int((rp.Length(offset) + 1) * 4)
+		if offset+pktLen > len(buf) {
+			t.Errorf("%s: packet %d exceeds compound length\n", name, i)
+			return
+		}
+		if i >= len(expect.Packets) {
+			t.Errorf("%s: more RTCP packets than expected: %d\n", name, len(expect.Packets))
+			return
+		}
+		exp := expect.Packets[i]
+		if rp.Type(offset) != exp.Type || rp.Count(offset) != exp.Count || rp.Length(offset) != exp.Length ||
+			rp.Ssrc(offset) != exp.Ssrc {
+			t.Errorf("%s: header check of packet %d failed. Expected: %d/%d/%d/0x%x, got: %d/%d/%d/0x%x\n", name, i,
+				exp.Type, exp.Count, exp.Length, exp.Ssrc, rp.Type(offset), rp.Count(offset), rp.Length(offset), rp.Ssrc(offset))
+		}
+
+		switch rp.Type(offset) {
+		case RtcpSR, RtcpRR:
+			rrOffset := offset + rtcpHeaderLength + rtcpSsrcLength
+			if rp.Type(offset) == RtcpSR {
+				info := rp.toSenderInfo(rrOffset)
+				sec, frac := info.ntpTimeStamp()
+				got := goldenSenderInfo{sec, frac, info.rtpTimeStamp(), info.packetCount(), info.octetCount()}
+				if expect.SenderInfo == nil || *expect.SenderInfo != got {
+					t.Errorf("%s: sender info check failed. Expected: %+v, got: %+v\n", name, expect.SenderInfo, got)
+				}
+				rrOffset += senderInfoLen
+			}
+			for j := 0; j < rp.Count(offset); j++ {
+				rr := rp.toRecvReport(rrOffset)
+				blocks = append(blocks, goldenReportBlock{rr.ssrc(), rr.packetsLostFrac(), rr.packetsLost(),
+					rr.highestSeq(), rr.jitter(), rr.lsr(), rr.dlsr()})
+				rrOffset += reportBlockLen
+			}
+
+		case RtcpSdes:
+			chunkOffset := offset + rtcpHeaderLength
+			remaining := pktLen - rtcpHeaderLength
+			for j := 0; j < rp.Count(offset); j++ {
+				chunk := rp.toSdesChunk(chunkOffset, remaining)
+				chunkLen, ok := chunk.chunkLen()
+				if !ok {
+					t.Errorf("%s: SDES chunk %d length check failed\n", name, j)
+					break
+				}
+				str := newSsrcStreamIn(&Address{}, chunk.ssrc())
+				str.parseSdesChunk(chunk)
+				items := make(map[string]string, len(str.SdesItems))
+				for itemType, txt := range str.SdesItems {
+					items[strconv.Itoa(itemType)] = txt
+				}
+				sdes = append(sdes, goldenSdes{chunk.ssrc(), items})
+				chunkOffset += chunkLen
+				remaining -= chunkLen
+			}
+
+		case RtcpBye:
+			bye := rp.toByeData(offset+rtcpHeaderLength, pktLen-rtcpHeaderLength)
+			if expect.Bye == nil {
+				t.Errorf("%s: unexpected BYE packet\n", name)
+				break
+			}
+			if bye.ssrc(0) != expect.Bye.Ssrc || bye.getReason(rp.Count(offset)) != expect.Bye.Reason {
+				t.Errorf("%s: BYE check failed. Expected: 0x%x '%s', got: 0x%x '%s'\n", name, expect.Bye.Ssrc,
+					expect.Bye.Reason, bye.ssrc(0), bye.getReason(rp.Count(offset)))
+			}
+
+		case RtcpRtpfb, RtcpPsfb:
+			fbOffset := offset + rtcpHeaderLength + rtcpSsrcLength
+			if expect.Feedback == nil {
+				t.Errorf("%s: unexpected feedback packet\n", name)
+				break
+			}
+			mediaSsrc := rp.Ssrc(fbOffset - ssrcOffsetRtcp)
+			fci := hex.EncodeToString(buf[fbOffset+rtcpSsrcLength : offset+pktLen])
+			if mediaSsrc != expect.Feedback.MediaSsrc || fci != expect.Feedback.Fci {
+				t.Errorf("%s: feedback check failed. Expected: 0x%x '%s', got: 0x%x '%s'\n", name,
+					expect.Feedback.MediaSsrc, expect.Feedback.Fci, mediaSsrc, fci)
+			}
+		}
+		offset += pktLen
+	}
+
+	if len(blocks) != len(expect.ReportBlocks) {
+		t.Errorf("%s: report block count check failed. Expected: %d, got: %d\n", name, len(expect.ReportBlocks), len(blocks))
+	} else {
+		for i, blk := range blocks {
+			if blk != expect.ReportBlocks[i] {
+				t.Errorf("%s: report block %d check failed. Expected: %+v, got: %+v\n", name, i, expect.ReportBlocks[i], blk)
+			}
+		}
+	}
+	if len(sdes) != len(expect.Sdes) {
+		t.Errorf("%s: SDES chunk count check failed. Expected: %d, got: %d\n", name, len(expect.Sdes), len(sdes))
+		return
+	}
+	for i, chunk := range sdes {
+		exp := expect.Sdes[i]
+		if chunk.Ssrc != exp.Ssrc || len(chunk.Items) != len(exp.Items) {
+			t.Errorf("%s: SDES chunk %d check failed. Expected: %+v, got: %+v\n", name, i, exp, chunk)
+			continue
+		}
+		for itemType, txt := range exp.Items {
+			if chunk.Items[itemType] != txt {
+				t.Errorf("%s: SDES item %s check failed. Expected: '%s', got: '%s'\n", name, itemType, txt, chunk.Items[itemType])
+			}
+		}
+	}
+}
+
+func TestConformanceVectors(t *testing.T) {
+	parseFlags()
+	names, vectors := loadConformanceVectors(t)
+
+	for i, vec := range vectors {
+		name := names[i]
+		buf, err := hex.DecodeString(vec.Packet)
+		if err != nil {
+			t.Errorf("%s: cannot decode packet: %s\n", name, err)
+			continue
+		}
+		switch vec.Kind {
+		case "rtp":
+			expect := new(goldenRtp)
+			if err = json.Unmarshal(vec.Expect, expect); err != nil {
+				t.Errorf("%s: cannot parse expected result: %s\n", name, err)
+				continue
+			}
+			conformanceRtp(t, name, buf, expect)
+		case "rtcp":
+			expect := new(goldenRtcp)
+			if err = json.Unmarshal(vec.Expect, expect); err != nil {
+				t.Errorf("%s: cannot parse expected result: %s\n", name, err)
+				continue
+			}
+			conformanceRtcp(t, name, buf, expect)
+		default:
+			t.Errorf("%s: unknown vector kind '%s'\n", name, vec.Kind)
+		}
+		if *verbose {
+			t.Logf("%s: %s - %s\n", name, vec.Source, vec.Description)
+		}
+	}
+}
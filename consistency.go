@@ -0,0 +1,166 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the consistency check of the sender reports: it compares the
+ * counts of the senders with the counts the input streams observed.
+ */
+
+import (
+	"sync"
+	"time"
+)
+
+// The kinds of a SrDiscrepancy.
+const (
+	SrExcessPackets     = iota // the stream received more packets than the sender sent
+	SrExcessOctets             // the stream received more payload octets than the sender sent
+	SrSequenceSkew             // the sequence numbers advanced by more than the sender's packet count
+	SrCounterRegression        // the sender's packet or octet count went backwards
+	srDiscrepancyKinds
+)
+
+// SrDiscrepancy describes a sender report whose counts don't match the packets the input stream
+// received since the previous sender report. Excess packets or octets hint at injected packets,
+// a sequence skew or a regression at a middlebox that mangles the packets or the reports.
+type SrDiscrepancy struct {
+	Ssrc           uint32
+	Index          uint32 // index of the input stream
+	Kind           int
+	Sent, Observed uint32 // the sender's count and the locally observed count since the previous report
+	Time           time.Time
+}
+
+// SrConsistencyStats holds the results of the consistency check of a sender.
+type SrConsistencyStats struct {
+	Reports       uint32                     // checked sender reports, the first report of a sender is the base only
+	Discrepancies [srDiscrepancyKinds]uint32 // per kind, see SrExcessPackets
+	Last          SrDiscrepancy              // valid if one of the Discrepancies counts is not zero
+}
+
+// SrChecker cross-checks the packet and octet counts of received sender reports against the
+// counts of the input streams.
+//
+// The checker compares the differences to the previous sender report of the same sender, thus
+// it works for receivers that joined a running session. Packets that are in flight while the
+// sender sends its report make the counts differ a little, PacketSlack allows for them. Lost
+// packets never cause a discrepancy. The session sends a SrInconsistentCtrl event for each
+// discrepancy, the CtrlEvent's Discrepancy field describes it.
+//
+type SrChecker struct {
+	PacketSlack uint32 // packets observed before the sender counted them, default 10
+
+	mutex   sync.Mutex
+	senders map[uint32]*srCheckState
+}
+
+type srCheckState struct {
+	srPackets, srOctets         uint32 // counts of the previous sender report
+	packets, octets, highestSeq uint32 // counts of the input stream at the previous sender report
+	stats                       SrConsistencyStats
+}
+
+// NewSrChecker creates a sender report consistency checker, see Session.SetSrChecker.
+func NewSrChecker() *SrChecker {
+	return &SrChecker{PacketSlack: 10, senders: make(map[uint32]*srCheckState)}
+}
+
+// SetSrChecker sets the consistency check of received sender reports, nil removes it. Set the
+// checker before the session starts.
+func (rs *Session) SetSrChecker(sc *SrChecker) {
+	rs.srChecker = sc
+}
+
+// Stats returns the check results of a sender, false if the checker saw no report of the
+// sender.
+func (sc *SrChecker) Stats(ssrc uint32) (stats SrConsistencyStats, ok bool) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if st := sc.senders[ssrc]; st != nil {
+		return st.stats, true
+	}
+	return
+}
+
+// Remove drops the state of a sender, for example after it left the session.
+func (sc *SrChecker) Remove(ssrc uint32) {
+	sc.mutex.Lock()
+	delete(sc.senders, ssrc)
+	sc.mutex.Unlock()
+}
+
+// *** Local functions and methods.
+
+// check compares the sender report of the input stream with its counts and returns the
+// discrepancies. The stream read the sender report before.
+func (sc *SrChecker) check(str *SsrcStream, strIdx uint32, now time.Time) (found []SrDiscrepancy) {
+	str.recvMutex.Lock()
+	packets, octets := str.statistics.packetCount, str.statistics.octetCount
+	highestSeq := str.statistics.seqNumAccum + uint32(str.statistics.maxSeqNum)
+	str.recvMutex.Unlock()
+	ssrc := str.Ssrc()
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	st := sc.senders[ssrc]
+	if st == nil {
+		st = new(srCheckState)
+		sc.senders[ssrc] = st
+	} else if packets >= st.packets { // the stream did not reset its statistics
+		add := func(kind int, sent, observed uint32) {
+			d := SrDiscrepancy{Ssrc: ssrc, Index: strIdx, Kind: kind, Sent: sent, Observed: observed, Time: now}
+			st.stats.Discrepancies[kind]++
+			st.stats.Last = d
+			found = append(found, d)
+		}
+		st.stats.Reports++
+		sentPackets, sentOctets := str.SenderPacketCnt-st.srPackets, str.SenderOctectCnt-st.srOctets
+		recvPackets, recvOctets := packets-st.packets, octets-st.octets
+		seqPackets := highestSeq - st.highestSeq
+		switch {
+		case int32(sentPackets) < 0:
+			add(SrCounterRegression, str.SenderPacketCnt, st.srPackets)
+		case int32(sentOctets) < 0:
+			add(SrCounterRegression, str.SenderOctectCnt, st.srOctets)
+		default:
+			if recvPackets > sentPackets+sc.PacketSlack {
+				add(SrExcessPackets, sentPackets, recvPackets)
+			}
+			if seqPackets > sentPackets+sc.PacketSlack {
+				add(SrSequenceSkew, sentPackets, seqPackets)
+			}
+			octetSlack := sc.PacketSlack * maxPayloadEstimate
+			if sentPackets > 0 {
+				octetSlack = sc.PacketSlack * (sentOctets/sentPackets + 1)
+			}
+			if recvOctets > sentOctets+octetSlack {
+				add(SrExcessOctets, sentOctets, recvOctets)
+			}
+		}
+	}
+	st.srPackets, st.srOctets = str.SenderPacketCnt, str.SenderOctectCnt
+	st.packets, st.octets, st.highestSeq = packets, octets, highestSeq
+	return
+}
+
+// maxPayloadEstimate is the payload size of a packet if a sender report doesn't allow to
+// compute the average payload size.
+const maxPayloadEstimate = 1200
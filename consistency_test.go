@@ -0,0 +1,106 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+)
+
+func srCheckData(rs *Session, ssrc uint32, first, count uint16, size int, from *Address) {
+	for seq := first; seq < first+count; seq++ {
+		rp := rs.NewDataPacket(uint32(seq) * 160)
+		rp.SetSsrc(ssrc)
+		rp.SetSequence(seq)
+		rp.SetPayload(make([]byte, size))
+		rp.fromAddr = *from
+		rs.OnRecvData(rp)
+	}
+}
+
+func srCheckReport(rs *Session, ssrc, packets, octets uint32, from *Address) {
+	rc, offset := newCtrlPacket()
+	rc.SetType(0, RtcpSR)
+	rc.addHeaderSsrc(offset, ssrc)
+	info, _ := rc.newSenderInfo()
+	info.setPacketCount(packets)
+	info.setOctetCount(octets)
+	rc.SetLength(0, uint16(rc.inUse/4-1))
+	rc.fromAddr = *from
+	rs.OnRecvCtrl(rc)
+}
+
+func TestSrChecker(t *testing.T) {
+	parseFlags()
+
+	rs, _ := drainedSession(t)
+	sc := NewSrChecker()
+	sc.PacketSlack = 2
+	rs.SetSrChecker(sc)
+	events := rs.CreateCtrlEventChan()
+	from := &Address{IpAddr: net.IPv4(127, 0, 0, 1), DataPort: 6002, CtrlPort: 6003}
+	const ssrc = 0x0a0b0c0d
+
+	srCheckData(rs, ssrc, 1, 20, 100, from)
+	srCheckReport(rs, ssrc, 20, 2000, from) // the base
+	srCheckData(rs, ssrc, 21, 20, 100, from)
+	srCheckReport(rs, ssrc, 40, 4000, from)
+	if stats, ok := sc.Stats(ssrc); !ok || stats.Reports != 1 || stats.Discrepancies != [srDiscrepancyKinds]uint32{} {
+		t.Errorf("Consistent report check failed: %+v\n", stats)
+	}
+
+	// 10 injected packets
+	srCheckData(rs, ssrc, 41, 30, 100, from)
+	srCheckReport(rs, ssrc, 60, 6000, from)
+	// the sender's counts go backwards
+	srCheckReport(rs, ssrc, 50, 5000, from)
+	// a middlebox enlarged the payloads
+	srCheckData(rs, ssrc, 71, 10, 200, from)
+	srCheckReport(rs, ssrc, 60, 6000, from)
+
+	stats, _ := sc.Stats(ssrc)
+	expected := [srDiscrepancyKinds]uint32{SrExcessPackets: 1, SrExcessOctets: 2, SrSequenceSkew: 1, SrCounterRegression: 1}
+	if stats.Reports != 4 || stats.Discrepancies != expected {
+		t.Errorf("Discrepancy check failed: %+v\n", stats)
+	}
+	if d := stats.Last; d.Kind != SrExcessOctets || d.Sent != 1000 || d.Observed != 2000 {
+		t.Errorf("Last discrepancy check failed: %+v\n", d)
+	}
+
+	var kinds []int
+	for len(events) > 0 {
+		for _, ev := range <-events {
+			if ev.EventType == SrInconsistentCtrl {
+				if ev.Discrepancy == nil || ev.Discrepancy.Ssrc != ssrc || ev.Ssrc != ssrc {
+					t.Errorf("SrInconsistentCtrl event check failed: %+v\n", ev)
+					continue
+				}
+				kinds = append(kinds, ev.Discrepancy.Kind)
+			}
+		}
+	}
+	if len(kinds) != 5 || kinds[0] != SrExcessPackets || kinds[3] != SrCounterRegression {
+		t.Errorf("SrInconsistentCtrl events check failed: %v\n", kinds)
+	}
+
+	sc.Remove(ssrc)
+	if _, ok := sc.Stats(ssrc); ok {
+		t.Errorf("Remove check failed\n")
+	}
+}
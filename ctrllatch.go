@@ -0,0 +1,77 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the detection of known sources whose RTCP arrives from a new
+ * address, for example after a NAT rebinding or a move of the endpoint.
+ */
+
+// CtrlAddressChange holds the control addresses of a RemoteAddressChangedCtrl event.
+type CtrlAddressChange struct {
+	Ssrc      uint32
+	Index     uint32  // the index of the input stream
+	Old       Address // the previous control address, DataPort is not set
+	New       Address // the address the RTCP packet came from, DataPort is not set
+	Relatched bool    // the session sends its RTCP to the new address, see SetCtrlRelatch
+}
+
+// SetCtrlRelatch selects if the session follows the control address of a known source. If the
+// RTCP packets of an input stream arrive from a new address the session sends a
+// RemoteAddressChangedCtrl event. With relatching on the session also replaces the remote with
+// the old control address by the new one, like a latched source for RTP, see SourceLatch. The
+// remote keeps its data port.
+//
+//   on - true follows the new control address, false (the default) reports it only
+//
+func (rs *Session) SetCtrlRelatch(on bool) {
+	rs.remotesMutex.Lock()
+	rs.ctrlRelatch = on
+	rs.remotesMutex.Unlock()
+}
+
+// *** Local functions and methods.
+
+// ctrlAddressChanged handles the new control address of a known source: it relatches the
+// control destination if this is on and sends a RemoteAddressChangedCtrl event.
+func (rs *Session) ctrlAddressChanged(str *SsrcStream, strIdx uint32, old, from *Address) {
+	change := &CtrlAddressChange{Ssrc: str.ssrc, Index: strIdx,
+		Old: Address{IpAddr: old.IpAddr, CtrlPort: old.CtrlPort},
+		New: Address{IpAddr: from.IpAddr, CtrlPort: from.CtrlPort}}
+
+	rs.remotesMutex.Lock()
+	if rs.ctrlRelatch {
+		for idx, remote := range rs.remotes {
+			if remote.CtrlPort == old.CtrlPort && remote.IpAddr.Equal(old.IpAddr) {
+				// a new Address, the writers may still use the old one
+				rs.remotes[idx] = &Address{IpAddr: from.IpAddr, DataPort: remote.DataPort, CtrlPort: from.CtrlPort}
+				change.Relatched = true
+			}
+		}
+	}
+	rs.remotesMutex.Unlock()
+
+	ctrlEv := newCrtlEvent(RemoteAddressChangedCtrl, str.ssrc, strIdx)
+	ctrlEv.AddrChange = change
+	ctrlEv.Context = str.Context()
+	select {
+	case rs.ctrlEventChan <- []*CtrlEvent{ctrlEv}:
+	default:
+	}
+}
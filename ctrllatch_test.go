@@ -0,0 +1,85 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCtrlRelatch(t *testing.T) {
+	parseFlags()
+
+	rs, _ := closeSession(false)
+	events := rs.CreateCtrlEventChan()
+	peer, moved := net.IPv4(127, 0, 0, 1), net.IPv4(10, 0, 0, 7)
+
+	rr := impairPacket(false, false, 0xaa)
+	rr.fromAddr = Address{peer, 0, 6003}
+	rs.OnRecvCtrl(rr)
+	changedEvents := func() (changes []*CtrlAddressChange) {
+		for len(events) > 0 {
+			for _, ev := range <-events {
+				if ev.EventType == RemoteAddressChangedCtrl {
+					changes = append(changes, ev.AddrChange)
+				}
+			}
+		}
+		return
+	}
+	if changes := changedEvents(); len(changes) != 0 {
+		t.Errorf("first RTCP packet reported as address change\n")
+	}
+
+	// without relatching the session reports the new address only
+	rr = impairPacket(false, false, 0xaa)
+	rr.fromAddr = Address{peer, 0, 7003}
+	rs.OnRecvCtrl(rr)
+	changes := changedEvents()
+	if len(changes) != 1 || changes[0].Ssrc != 0xaa || changes[0].Old.CtrlPort != 6003 ||
+		changes[0].New.CtrlPort != 7003 || changes[0].Relatched {
+		t.Errorf("address change check failed: %+v\n", changes)
+	}
+	if remotes := rs.remoteList(); len(remotes) != 1 || remotes[0].CtrlPort != 6003 {
+		t.Errorf("remote changed without relatching: %+v\n", remotes)
+	}
+	// packets from the new address are no change
+	rr = impairPacket(false, false, 0xaa)
+	rr.fromAddr = Address{peer, 0, 7003}
+	rs.OnRecvCtrl(rr)
+	if changes := changedEvents(); len(changes) != 0 {
+		t.Errorf("unchanged address reported: %+v\n", changes)
+	}
+
+	// the NAT rebinds the peer, it moves its remote from 6003 to 7003
+	rs.SetCtrlRelatch(true)
+	rs.RemoveRemote(0)
+	rs.AddRemote(&Address{peer, 7002, 7003})
+	rr = impairPacket(false, false, 0xaa)
+	rr.fromAddr = Address{moved, 0, 9003}
+	rs.OnRecvCtrl(rr)
+	changes = changedEvents()
+	if len(changes) != 1 || !changes[0].Relatched || !changes[0].New.IpAddr.Equal(moved) {
+		t.Errorf("relatch event check failed: %+v\n", changes)
+	}
+	remotes := rs.remoteList()
+	if len(remotes) != 1 || !remotes[0].IpAddr.Equal(moved) || remotes[0].CtrlPort != 9003 || remotes[0].DataPort != 7002 {
+		t.Errorf("relatched remote check failed: %+v\n", remotes)
+	}
+}
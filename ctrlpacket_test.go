@@ -131,8 +131,103 @@ func sdesCheck(t *testing.T) (result bool) {
 	return
 }
 
+// sdesItemTypes returns the item types of the SDES chunk at offset 4 of the control packet.
+func sdesItemTypes(rc *CtrlPacket, chunkLen int) (items []int) {
+	chunk := rc.toSdesChunk(4, chunkLen)
+	for itemOffset := 4; itemOffset < chunkLen && chunk.getItemType(itemOffset) != SdesEnd; {
+		items = append(items, chunk.getItemType(itemOffset))
+		itemOffset += chunk.getItemLen(itemOffset) + 2
+	}
+	return
+}
+
+func sdesScheduleCheck(t *testing.T) {
+	so := newSsrcStreamOut(&Address{}, 0x01020304, 1)
+	so.SetSdesItem(SdesCname, "cname")
+	so.SetSdesItem(SdesName, "name")
+	so.SetSdesItem(SdesTool, "tool")
+
+	if so.SetSdesSchedule([]int{SdesCname}) {
+		t.Errorf("SDES schedule must not accept CNAME\n")
+	}
+	so.SetSdesSchedule([]int{SdesName, SdesEmail, SdesTool})
+	// EMAIL is not set and is skipped
+	expected := [][]int{{SdesCname, SdesName}, {SdesCname, SdesTool}, {SdesCname, SdesName}}
+	for i, exp := range expected {
+		rc, _ := newCtrlPacket()
+		next := so.makeSdesChunk(rc, &sdesPrivacy{})
+		items := sdesItemTypes(rc, next-4)
+		if fmt.Sprint(items) != fmt.Sprint(exp) || (next-4)%4 != 0 {
+			t.Errorf("SDES schedule check %d failed. Expected: %v, got: %v\n", i, exp, items)
+		}
+		rc.FreePacket()
+	}
+	so.SetSdesSchedule(nil)
+	rc, _ := newCtrlPacket()
+	next := so.makeSdesChunk(rc, &sdesPrivacy{})
+	if items := sdesItemTypes(rc, next-4); len(items) != 3 || next-4 != so.sdesChunkLen {
+		t.Errorf("SDES default schedule check failed. Got: %v\n", items)
+	}
+	rc.FreePacket()
+}
+
+// sdesItemTexts returns the item texts of the SDES chunk at offset 4 of the control packet.
+func sdesItemTexts(rc *CtrlPacket, chunkLen int) map[int]string {
+	texts := make(map[int]string)
+	chunk := rc.toSdesChunk(4, chunkLen)
+	for itemOffset := 4; itemOffset < chunkLen && chunk.getItemType(itemOffset) != SdesEnd; {
+		length := chunk.getItemLen(itemOffset)
+		texts[chunk.getItemType(itemOffset)] = chunk.getItemText(itemOffset, length)
+		itemOffset += length + 2
+	}
+	return texts
+}
+
+func sdesPrivacyCheck(t *testing.T) {
+	so := newSsrcStreamOut(&Address{}, 0x01020304, 1)
+	so.SetSdesItem(SdesCname, "cname")
+	so.SetSdesItem(SdesName, "Jane Doe")
+	so.SetSdesItem(SdesEmail, "jane@example.com")
+	so.SetSdesItem(SdesPhone, "+1 555 0100")
+	so.SetSdesItem(SdesTool, "tool")
+
+	chunk := func(privacy *sdesPrivacy) map[int]string {
+		rc, _ := newCtrlPacket()
+		defer rc.FreePacket()
+		return sdesItemTexts(rc, so.makeSdesChunk(rc, privacy)-4)
+	}
+	if texts := chunk(&sdesPrivacy{level: SdesPrivacyFull}); len(texts) != 5 || texts[SdesName] != "Jane Doe" {
+		t.Errorf("Full SDES privacy check failed. Got: %v\n", texts)
+	}
+	if texts := chunk(&sdesPrivacy{level: SdesPrivacyCnameOnly}); len(texts) != 1 || texts[SdesCname] != "cname" {
+		t.Errorf("CNAME only SDES privacy check failed. Got: %v\n", texts)
+	}
+	anon := &sdesPrivacy{level: SdesPrivacyAnonymized, key: []byte("key")}
+	texts := chunk(anon)
+	if len(texts) != 4 || texts[SdesCname] != "cname" || texts[SdesTool] != "tool" || len(texts[SdesName]) != sdesHashLength ||
+		texts[SdesName] == "Jane Doe" || texts[SdesEmail] == texts[SdesName] {
+		t.Errorf("Anonymized SDES privacy check failed. Got: %v\n", texts)
+	}
+	if again := chunk(anon); again[SdesName] != texts[SdesName] {
+		t.Errorf("Anonymized SDES hashes must be stable. Got: %s, %s\n", texts[SdesName], again[SdesName])
+	}
+	if other := chunk(&sdesPrivacy{level: SdesPrivacyAnonymized, key: []byte("other")}); other[SdesName] == texts[SdesName] {
+		t.Errorf("Anonymized SDES hashes must depend on the key\n")
+	}
+
+	rs := NewSession(new(captureWriter), new(teeConsumer))
+	if rs.SetSdesPrivacy(SdesPrivacyAnonymized+1, nil) == nil {
+		t.Errorf("SetSdesPrivacy must fail for an unknown level\n")
+	}
+	if rs.SetSdesPrivacy(SdesPrivacyAnonymized, nil) != nil || len(rs.sdesPrivacy.key) == 0 {
+		t.Errorf("SetSdesPrivacy must select a random key\n")
+	}
+}
+
 func rtcpPacketBasic(t *testing.T) {
 	sdesCheck(t)
+	sdesScheduleCheck(t)
+	sdesPrivacyCheck(t)
 }
 
 func TestRtcpPacket(t *testing.T) {
@@ -316,6 +316,99 @@ func rtpPacket(t *testing.T) {
 	}
 }
 
+func extElements(t *testing.T) {
+	em := NewExtensionMap()
+	if em.Register(1, ExtAudioLevel) != nil || em.Register(20, ExtSdesMid) != nil {
+		t.Errorf("Extension map register failed\n")
+		return
+	}
+	if em.Register(1, ExtAbsSendTime) == nil || em.Register(0, ExtAbsSendTime) == nil {
+		t.Errorf("Extension map duplicate ID check failed\n")
+	}
+	rp, _ := NewDataPacketFromBuffer(append(make([]byte, rtpHeaderLength), payload...))
+	rp.buffer[0] = 0x80
+
+	// one-byte format as long as the IDs and lengths allow it
+	if err := em.SetExtension(rp, ExtAudioLevel, []byte{0x85}); err != nil {
+		t.Errorf("Set audio level extension failed: %s\n", err)
+		return
+	}
+	ext := rp.Extension()
+	if len(ext) != 8 || ext[0] != 0xbe || ext[1] != 0xde || ext[4] != 0x10 || ext[5] != 0x85 {
+		t.Errorf("One-byte extension check failed. Got: %x\n", ext)
+	}
+	// ID 20 requires the two-byte format, the other elements must survive
+	if err := em.SetExtension(rp, ExtSdesMid, []byte("audio")); err != nil {
+		t.Errorf("Set mid extension failed: %s\n", err)
+		return
+	}
+	ext = rp.Extension()
+	if ext[0] != 0x10 || ext[1] != 0x00 || len(ext)%4 != 0 {
+		t.Errorf("Two-byte extension check failed. Got: %x\n", ext)
+	}
+	if level := em.Extension(rp, ExtAudioLevel); len(level) != 1 || level[0] != 0x85 {
+		t.Errorf("Audio level extension check failed. Got: %x\n", level)
+	}
+	if exts := em.Extensions(rp); len(exts) != 2 || string(exts[ExtSdesMid]) != "audio" {
+		t.Errorf("Extensions check failed. Got: %v\n", exts)
+	}
+	if p := rp.Payload(); len(p) != len(payload) || p[0] != payload[0] {
+		t.Errorf("Payload check after extensions failed\n")
+	}
+	// removing all elements removes the header extension
+	em.SetExtension(rp, ExtSdesMid, nil)
+	em.SetExtension(rp, ExtAudioLevel, nil)
+	if rp.ExtensionBit() || rp.InUse() != rtpHeaderLength+len(payload) {
+		t.Errorf("Extension removal check failed. In use: %d\n", rp.InUse())
+	}
+	if em.Extension(rp, ExtAbsSendTime) != nil || em.SetExtension(rp, ExtAbsSendTime, []byte{1}) == nil {
+		t.Errorf("Unregistered extension check failed\n")
+	}
+
+	// the transport writes abs-send-time when it sends the packet
+	cw := new(captureWriter)
+	tp, _ := NewTransportSRTP(nil, cw, nil, nil)
+	tp.SetAbsSendTime(3)
+	before := AbsSendTime(time.Now())
+	tp.WriteDataTo(rp, &Address{})
+	sent, _ := NewDataPacketFromBuffer(cw.data[0])
+	if stamp, ok := ParseAbsSendTime(sent.ExtensionElement(3)); !ok || (stamp-before)&0xffffff > 1<<12 {
+		t.Errorf("abs-send-time check failed. Expected about: %x, got: %x\n", before, stamp)
+	}
+
+	capture := AbsCaptureTime{CaptureTime: time.Unix(1400000000, 250000000), ClockOffset: -1500 * time.Millisecond, HasOffset: true}
+	em.Register(4, ExtAbsCaptureTime)
+	em.SetExtension(rp, ExtAbsCaptureTime, capture.Bytes())
+	act, ok := em.AbsCaptureTime(rp)
+	if !ok || !act.HasOffset || act.ClockOffset != capture.ClockOffset || act.CaptureTime.Sub(capture.CaptureTime).Abs() > time.Microsecond {
+		t.Errorf("abs-capture-time check failed. Got: %+v\n", act)
+	}
+}
+
+func frameMarking(t *testing.T) {
+	em := NewExtensionMap()
+	em.Register(5, ExtFrameMarking)
+	rp, _ := NewDataPacketFromBuffer(append(make([]byte, rtpHeaderLength), payload...))
+	rp.buffer[0] = 0x80
+
+	key := FrameMarking{Start: true, Independent: true}
+	em.SetFrameMarking(rp, &key)
+	if data := rp.ExtensionElement(5); len(data) != 1 || data[0] != 0xa0 {
+		t.Errorf("Non-scalable frame marking check failed. Got: %x\n", data)
+	}
+	if fm, ok := em.FrameMarking(rp); !ok || fm != key {
+		t.Errorf("Non-scalable frame marking parse failed. Got: %+v\n", fm)
+	}
+	layer := FrameMarking{End: true, Discardable: true, Scalable: true, TemporalId: 2, LayerId: 1, HasTl0PicIdx: true, Tl0PicIdx: 77}
+	em.SetFrameMarking(rp, &layer)
+	if data := rp.ExtensionElement(5); len(data) != 3 || data[0] != 0x52 || data[1] != 1 || data[2] != 77 {
+		t.Errorf("Scalable frame marking check failed. Got: %x\n", data)
+	}
+	if fm, ok := em.FrameMarking(rp); !ok || fm != layer {
+		t.Errorf("Scalable frame marking parse failed. Got: %+v\n", fm)
+	}
+}
+
 func intervalCheck(t *testing.T) {
 	//                     members, senders, RTCP bandwidth, packet length, weSent, initial
 	tm, _ := rtcpInterval(1, 0, 3500.0, 80.0, false, true)
@@ -345,6 +438,8 @@ func parseFlags() {
 func TestRtpPacket(t *testing.T) {
 	parseFlags()
 	rtpPacket(t)
+	extElements(t)
+	frameMarking(t)
 	ntpCheck(t)
 	//    intervalCheck(t)
 }
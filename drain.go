@@ -0,0 +1,107 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * This source file contains the drain mode of the session manager: a media server that
+ * restarts stops taking calls, lets the running calls end and closes the remaining ones at a
+ * deadline.
+ */
+
+// DrainProgress reports the progress of SessionManager.Drain.
+type DrainProgress struct {
+	Remaining int  // sessions that still run
+	Ended     int  // sessions the application removed since the drain started
+	Forced    int  // sessions the drain closed at the deadline, in parallel
+	Done      bool // the last report, no sessions remain
+}
+
+const errDraining = Error("SessionManager: draining, no new sessions.")
+
+// Drain stops accepting new sessions and waits until the application removed the existing
+// sessions or the timeout passed. Then it removes the remaining sessions, see RemoveSession,
+// thus the started sessions send a BYE for their output streams.
+//
+// NewSession returns an error after Drain started. The method blocks until all sessions ended
+// and returns the last progress report, a rolling restart stops the process then.
+//
+//   timeout  - the time the existing sessions may run
+//   progress - called after each ended session and with the last report, may be nil
+//
+func (sm *SessionManager) Drain(timeout time.Duration, progress func(DrainProgress)) DrainProgress {
+	atomic.StoreUint32(&sm.draining, 1)
+	var p DrainProgress
+	report := func() {
+		if progress != nil {
+			progress(p)
+		}
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-sm.drainWake: // a removal before the drain
+	default:
+	}
+	start := atomic.LoadUint32(&sm.removed)
+	for p.Remaining = sm.Sessions(); p.Remaining > 0; p.Remaining = sm.Sessions() {
+		select {
+		case <-sm.drainWake:
+			p.Ended = int(atomic.LoadUint32(&sm.removed) - start)
+			if p.Remaining = sm.Sessions(); p.Remaining > 0 {
+				report()
+			}
+		case <-timer.C:
+			p.Forced += sm.removeAll()
+		}
+	}
+	p.Ended = int(atomic.LoadUint32(&sm.removed)-start) - p.Forced
+	p.Done = true
+	report()
+	return p
+}
+
+// removeAll removes the sessions in parallel, each waits for its BYE packets, and returns the
+// number of sessions it removed. The application may remove some of them at the same time.
+func (sm *SessionManager) removeAll() int {
+	var wg sync.WaitGroup
+	var forced int32
+	for _, callId := range sm.callIds() {
+		wg.Add(1)
+		go func(callId string) {
+			defer wg.Done()
+			if sm.removeSession(callId) {
+				atomic.AddInt32(&forced, 1)
+			}
+		}(callId)
+	}
+	wg.Wait()
+	return int(forced)
+}
+
+// Draining returns true after Drain started.
+func (sm *SessionManager) Draining() bool {
+	return atomic.LoadUint32(&sm.draining) == 1
+}
@@ -0,0 +1,94 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	parseFlags()
+
+	local, _ := net.ResolveIPAddr("ip", "127.0.0.1")
+	sm, _ := NewSessionManager(local, 55600, 55610)
+	defer sm.Close()
+	for _, callId := range []string{"call-a", "call-b", "call-c"} {
+		sm.NewSession(callId)
+	}
+	// the first call ends on its own within the timeout, the others are closed at the deadline
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		sm.RemoveSession("call-a")
+	}()
+	var reports []DrainProgress
+	done := make(chan DrainProgress)
+	go func() {
+		done <- sm.Drain(200*time.Millisecond, func(p DrainProgress) { reports = append(reports, p) })
+	}()
+	time.Sleep(5 * time.Millisecond)
+	if _, err := sm.NewSession("call-d"); err == nil || !sm.Draining() {
+		t.Errorf("Draining new session check failed\n")
+	}
+	var last DrainProgress
+	select {
+	case last = <-done:
+	case <-time.After(2 * time.Second):
+		t.Errorf("Drain did not return\n")
+		return
+	}
+	if !last.Done || last.Remaining != 0 || last.Ended != 1 || last.Forced != 2 || sm.Sessions() != 0 {
+		t.Errorf("Last progress check failed. Got: %+v\n", last)
+	}
+	if len(reports) != 2 || reports[0].Remaining != 2 || reports[0].Ended != 1 || reports[1] != last {
+		t.Errorf("Progress reports check failed. Got: %+v\n", reports)
+	}
+	// a session the application removed already doesn't count as forced
+	if forced := sm.removeAll(); forced != 0 {
+		t.Errorf("Forced count check failed. Got: %d\n", forced)
+	}
+}
+
+func TestDrainParallel(t *testing.T) {
+	parseFlags()
+
+	local, _ := net.ResolveIPAddr("ip", "127.0.0.1")
+	sm, _ := NewSessionManager(local, 55620, 55630)
+	defer sm.Close()
+	// the BYE packets of the sessions block, each close waits for DefaultByeTimeout
+	var blocked []*closeTransport
+	for _, callId := range []string{"call-a", "call-b", "call-c"} {
+		sm.NewSession(callId)
+		rs, ct := closeSession(true)
+		shard := sm.shard(callId)
+		shard.mutex.Lock()
+		shard.sessions[callId].rs = rs
+		shard.mutex.Unlock()
+		blocked = append(blocked, ct)
+	}
+	start := time.Now()
+	last := sm.Drain(10*time.Millisecond, nil)
+	if d := time.Since(start); d > 2*DefaultByeTimeout || last.Forced != 3 {
+		t.Errorf("Parallel forced close check failed. Got: %+v in %s\n", last, d)
+	}
+	for _, ct := range blocked {
+		close(ct.block)
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the DTMF sender: RFC 4733 telephone events if the payload registry
+ * has a telephone-event format for the stream, in-band tones from a generator otherwise.
+ */
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Modes of the DtmfSender.
+const (
+	DtmfNone      = iota // the stream can't send DTMF: no telephone-event format and no tone generator
+	DtmfOutOfBand        // RFC 4733 telephone events
+	DtmfInBand           // tones in the stream's audio format
+)
+
+const (
+	defaultDtmfInterval = 50 * time.Millisecond // RFC 4733 chapter 2.5.1.2
+	defaultDtmfVolume   = 10                    // -10 dBm0
+	dtmfEndPackets      = 3                     // retransmissions of the end packet, RFC 4733 chapter 2.5.1.4
+)
+
+// ToneGenerator creates the in-band tone of a DTMF digit as codec frames of the payload format,
+// the DtmfSender sends them with WriteFrames.
+//
+//   digit    - one of 0-9, *, #, A-D
+//   duration - the duration of the tone
+//   pf       - the payload format of the output stream
+//
+type ToneGenerator func(digit byte, duration time.Duration, pf *PayloadFormat) ([][]byte, error)
+
+// DtmfSender sends DTMF digits on an output stream.
+//
+// The sender selects the mode from PayloadFormatMap: if the map holds a "telephone-event"
+// format with the clock rate of the stream's payload format the sender sends RFC 4733 events
+// with this payload type on the stream's SSRC. Otherwise it synthesizes in-band tones with
+// the tone generator, if the application set one. PSTN gateways thus send DTMF the way the
+// remote side negotiated it.
+type DtmfSender struct {
+	Interval time.Duration // time between the event packets of a digit, 50 ms if zero
+	Volume   int           // the power level of the events in -dBm0, 10 if zero
+
+	rs          *Session
+	streamIndex uint32
+	generator   ToneGenerator
+}
+
+// NewDtmfSender creates a DTMF sender for an output stream.
+//
+//   rs          - the session of the stream
+//   streamIndex - the index of the output stream as returned by NewSsrcStreamOut
+//
+func NewDtmfSender(rs *Session, streamIndex uint32) (*DtmfSender, error) {
+	if rs.SsrcStreamOutForIndex(streamIndex) == nil {
+		return nil, Error("No output stream at this index.")
+	}
+	return &DtmfSender{rs: rs, streamIndex: streamIndex}, nil
+}
+
+// SetToneGenerator sets the generator of the in-band tones, nil disables the in-band fallback.
+func (ds *DtmfSender) SetToneGenerator(gen ToneGenerator) {
+	ds.generator = gen
+}
+
+// Mode returns the mode the sender uses with the stream's current payload type.
+func (ds *DtmfSender) Mode() int {
+	if _, ok := ds.eventPayloadType(); ok {
+		return DtmfOutOfBand
+	}
+	if ds.generator != nil && ds.audioFormat() != nil {
+		return DtmfInBand
+	}
+	return DtmfNone
+}
+
+// SendDigit sends one DTMF digit and returns the timestamp that follows the digit.
+//
+// RFC 4733 events start at the timestamp and the method sends an update every Interval, thus
+// it blocks for the duration of the digit. The last packet has the end bit and goes out three
+// times. In-band tones go out with WriteFrames without further delay.
+//
+//   digit    - one of 0-9, *, #, A-D
+//   duration - the duration of the digit
+//   stamp    - the RTP timestamp of the digit's start
+//
+func (ds *DtmfSender) SendDigit(digit byte, duration time.Duration, stamp uint32) (next uint32, err error) {
+	event, ok := dtmfEvent(digit)
+	if !ok {
+		return stamp, Error("Invalid DTMF digit: " + string(digit))
+	}
+	if duration <= 0 {
+		return stamp, Error("Invalid DTMF duration.")
+	}
+	switch ds.Mode() {
+	case DtmfOutOfBand:
+		return ds.sendEvent(event, duration, stamp)
+	case DtmfInBand:
+		frames, err := ds.generator(digit, duration, ds.audioFormat())
+		if err != nil {
+			return stamp, err
+		}
+		return ds.rs.WriteFrames(ds.streamIndex, stamp, frames)
+	}
+	return stamp, Error("Stream has no telephone-event format and no tone generator.")
+}
+
+// *** Local functions and methods.
+
+// audioFormat returns the payload format of the output stream, nil if it is not an audio format.
+func (ds *DtmfSender) audioFormat() *PayloadFormat {
+	str := ds.rs.SsrcStreamOutForIndex(ds.streamIndex)
+	if str == nil {
+		return nil
+	}
+	pf := PayloadFormatMap[int(str.PayloadType())]
+	if pf == nil || pf.MediaType&Audio == 0 {
+		return nil
+	}
+	return pf
+}
+
+// eventPayloadType returns the lowest telephone-event payload type with the clock rate of the
+// stream's audio format.
+func (ds *DtmfSender) eventPayloadType() (byte, bool) {
+	audio := ds.audioFormat()
+	if audio == nil {
+		return 0, false
+	}
+	var pts []int
+	for pt, pf := range PayloadFormatMap {
+		if strings.EqualFold(pf.Name, "telephone-event") && pf.ClockRate == audio.ClockRate {
+			pts = append(pts, pt)
+		}
+	}
+	if len(pts) == 0 {
+		return 0, false
+	}
+	sort.Ints(pts)
+	return byte(pts[0]), true
+}
+
+// sendEvent sends the RFC 4733 packets of an event.
+func (ds *DtmfSender) sendEvent(event byte, duration time.Duration, stamp uint32) (uint32, error) {
+	pt, _ := ds.eventPayloadType()
+	rate := int64(ds.audioFormat().ClockRate)
+	total := int64(duration) * rate / int64(time.Second)
+	if total > 0xffff {
+		return stamp, Error("DTMF duration exceeds the event duration field.")
+	}
+	interval, volume := ds.Interval, ds.Volume
+	if interval <= 0 {
+		interval = defaultDtmfInterval
+	}
+	if volume <= 0 {
+		volume = defaultDtmfVolume
+	}
+	step := int64(interval) * rate / int64(time.Second)
+
+	var payload [4]byte
+	payload[0] = event
+	for elapsed, first := step, true; ; elapsed, first = elapsed+step, false {
+		end := elapsed >= total
+		if end {
+			elapsed = total
+		}
+		payload[1] = byte(volume & 0x3f)
+		if end {
+			payload[1] |= 0x80
+		}
+		payload[2], payload[3] = byte(elapsed>>8), byte(elapsed)
+		sends := 1
+		if end {
+			sends = dtmfEndPackets
+		}
+		for i := 0; i < sends; i++ {
+			rp := ds.rs.NewDataPacketForStream(ds.streamIndex, stamp)
+			rp.SetPayloadType(pt)
+			rp.SetMarker(first && i == 0)
+			rp.SetPayload(payload[:])
+			_, err := ds.rs.WriteData(rp)
+			rp.FreePacket()
+			if err != nil {
+				return stamp, err
+			}
+		}
+		if end {
+			break
+		}
+		time.Sleep(interval)
+	}
+	return stamp + uint32(total), nil
+}
+
+// dtmfEvent returns the RFC 4733 event code of a DTMF digit.
+func dtmfEvent(digit byte) (byte, bool) {
+	switch {
+	case digit >= '0' && digit <= '9':
+		return digit - '0', true
+	case digit == '*':
+		return 10, true
+	case digit == '#':
+		return 11, true
+	case digit >= 'A' && digit <= 'D':
+		return digit - 'A' + 12, true
+	case digit >= 'a' && digit <= 'd':
+		return digit - 'a' + 12, true
+	}
+	return 0, false
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDtmfSender(t *testing.T) {
+	parseFlags()
+
+	rs, ct := closeSession(false)
+	ds, err := NewDtmfSender(rs, 0)
+	if err != nil {
+		t.Errorf("NewDtmfSender failed: %s\n", err)
+		return
+	}
+	if _, err = NewDtmfSender(rs, 7); err == nil {
+		t.Errorf("Output stream check failed\n")
+	}
+	ds.Interval = 5 * time.Millisecond
+
+	// A telephone-event format with another clock rate does not match the PCMU stream
+	PayloadFormatMap[102] = &PayloadFormat{TypeNumber: 102, MediaType: Audio, ClockRate: 48000, Channels: 1, Name: "telephone-event"}
+	defer delete(PayloadFormatMap, 102)
+	if ds.Mode() != DtmfNone {
+		t.Errorf("Mode check failed without a matching format: %d\n", ds.Mode())
+	}
+	if _, err = ds.SendDigit('5', 20*time.Millisecond, 0); err == nil {
+		t.Errorf("SendDigit without a mode check failed\n")
+	}
+
+	PayloadFormatMap[101] = &PayloadFormat{TypeNumber: 101, MediaType: Audio, ClockRate: 8000, Channels: 1, Name: "telephone-event"}
+	defer delete(PayloadFormatMap, 101)
+	if ds.Mode() != DtmfOutOfBand {
+		t.Errorf("Out-of-band mode check failed: %d\n", ds.Mode())
+	}
+	if _, err = ds.SendDigit('x', 20*time.Millisecond, 0); err == nil {
+		t.Errorf("Digit check failed\n")
+	}
+	next, err := ds.SendDigit('#', 20*time.Millisecond, 1000)
+	if err != nil || next != 1160 {
+		t.Errorf("SendDigit failed. Next: %d, error: %v\n", next, err)
+		return
+	}
+	// 20 ms at 8 kHz are 160 timestamp units, updates every 40 units, the end packet three times
+	if len(ct.captureWriter.data) != 6 {
+		t.Errorf("Event packet count check failed: %d\n", len(ct.captureWriter.data))
+		return
+	}
+	first, _ := NewDataPacketFromBuffer(ct.captureWriter.data[0])
+	for i, buf := range ct.captureWriter.data {
+		rp, _ := NewDataPacketFromBuffer(buf)
+		payload := rp.Payload()
+		duration := int(payload[2])<<8 | int(payload[3])
+		expected, end := 40*(i+1), i >= 3
+		if end {
+			expected = 160
+		}
+		if rp.PayloadType() != 101 || rp.Timestamp() != first.Timestamp() || rp.Marker() != (i == 0) || payload[0] != 11 ||
+			duration != expected || (payload[1]&0x80 != 0) != end || payload[1]&0x3f != defaultDtmfVolume {
+			t.Errorf("Event packet %d check failed: %x\n", i, payload)
+		}
+	}
+
+	// Without the telephone-event format the generator synthesizes the tone
+	delete(PayloadFormatMap, 101)
+	var generated byte
+	ds.SetToneGenerator(func(digit byte, duration time.Duration, pf *PayloadFormat) ([][]byte, error) {
+		generated = digit
+		frames := make([][]byte, int(duration/pf.FrameDuration))
+		for i := range frames {
+			frames[i] = make([]byte, pf.FrameSize)
+		}
+		return frames, nil
+	})
+	if ds.Mode() != DtmfInBand {
+		t.Errorf("In-band mode check failed: %d\n", ds.Mode())
+	}
+	ct.captureWriter.data = nil
+	if next, err = ds.SendDigit('7', 20*time.Millisecond, 0); err != nil || next != 160 || generated != '7' {
+		t.Errorf("In-band SendDigit failed. Next: %d, error: %v\n", next, err)
+	}
+	if len(ct.captureWriter.data) != 2 {
+		t.Errorf("In-band packet count check failed: %d\n", len(ct.captureWriter.data))
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// DualStackRemote is a receive transport layer that selects the address family of a remote
+// peer that has IPv4 and IPv6 addresses (Happy Eyeballs).
+//
+// The layer sits between the receiving transport and the Session. It adds all addresses of
+// the peer to the session's remotes, thus the first RTP and RTCP packets probe both families.
+// The family of the first packet that arrives from the peer wins: the layer removes the other
+// addresses from the remotes and drops the packets that arrive from them, this avoids that the
+// Session sees the peer's SSRCs from two addresses. If the selected family does not deliver
+// packets for Timeout but another family does, the layer fails over to it. If no family
+// delivers packets for Timeout the layer probes all families again.
+//
+// The receiving transport needs a dual-stack socket, for example a TransportUDP listening on
+// the IPv6 unspecified address.
+//
+type DualStackRemote struct {
+	Timeout time.Duration // inactivity of the selected family that triggers the failover, 0 selects 2 s
+
+	callUpper     TransportRecv
+	transportRecv TransportRecv
+	rs            *Session
+
+	mutex    sync.Mutex
+	remotes  []*Address
+	lastRecv []int64 // time of the last packet received from the address
+	selected int     // index of the selected address, -1 while probing
+	stop     chan bool
+
+	updateMutex sync.Mutex // serializes the changes of the session's remotes, guards indexes and added
+	indexes     []uint32   // the remote index in the session, valid if added is true
+	added       []bool
+}
+
+const dualStackTimeout = 2 * time.Second
+
+// ResolveDualStack resolves the host name of a remote peer to its IPv6 and IPv4 addresses.
+// The IPv6 addresses come first.
+//
+//   host - the host name or IP address of the peer
+//   port - the peer's RTP data port, the RTCP control port is the next port
+//
+func ResolveDualStack(host string, port int) ([]*Address, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	var v6, v4 []*Address
+	for _, ip := range ips {
+		addr := &Address{ip, port, port + 1}
+		if ip.To4() == nil {
+			v6 = append(v6, addr)
+		} else {
+			v4 = append(v4, addr)
+		}
+	}
+	return append(v6, v4...), nil
+}
+
+// NewDualStackRemote creates the layer and registers it as the upper layer of the transport.
+// Use the layer as the receive transport of the Session and call SetSession before the
+// session starts.
+//
+//   tpr     - the lower layer transport that receives the packets
+//   remotes - the peer's addresses, for example from ResolveDualStack
+//
+func NewDualStackRemote(tpr TransportRecv, remotes []*Address) (*DualStackRemote, error) {
+	if len(remotes) == 0 {
+		return nil, Error("DualStackRemote: no remote address.")
+	}
+	ds := &DualStackRemote{Timeout: dualStackTimeout, transportRecv: tpr, remotes: remotes, selected: -1}
+	ds.indexes = make([]uint32, len(remotes))
+	ds.added = make([]bool, len(remotes))
+	ds.lastRecv = make([]int64, len(remotes))
+	ds.callUpper = ds
+	tpr.SetCallUpper(ds)
+	return ds, nil
+}
+
+// SetSession adds the peer's addresses to the session's remotes. Don't add them with
+// AddRemote as well.
+func (ds *DualStackRemote) SetSession(rs *Session) {
+	ds.mutex.Lock()
+	ds.rs = rs
+	ds.selected = -1
+	ds.mutex.Unlock()
+	ds.update()
+}
+
+// Selected returns the selected address of the peer, nil while the layer probes the families.
+func (ds *DualStackRemote) Selected() *Address {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	if ds.selected < 0 {
+		return nil
+	}
+	return ds.remotes[ds.selected]
+}
+
+// *** The following methods implement the rtp.TransportRecv interface.
+
+// ListenOnTransports implements the rtp.TransportRecv ListenOnTransports method. It also starts
+// the check for a silent peer.
+func (ds *DualStackRemote) ListenOnTransports() error {
+	ds.mutex.Lock()
+	if ds.stop == nil {
+		ds.stop = make(chan bool)
+		go ds.watch(ds.stop, ds.timeout())
+	}
+	ds.mutex.Unlock()
+	return ds.transportRecv.ListenOnTransports()
+}
+
+// OnRecvData implements the rtp.TransportRecv OnRecvData method.
+func (ds *DualStackRemote) OnRecvData(rp *DataPacket) bool {
+	if !ds.accept(&rp.fromAddr) {
+		rp.FreePacket()
+		return false
+	}
+	return ds.callUpper.OnRecvData(rp)
+}
+
+// OnRecvCtrl implements the rtp.TransportRecv OnRecvCtrl method.
+func (ds *DualStackRemote) OnRecvCtrl(rp *CtrlPacket) bool {
+	if !ds.accept(&rp.fromAddr) {
+		rp.FreePacket()
+		return false
+	}
+	return ds.callUpper.OnRecvCtrl(rp)
+}
+
+// SetCallUpper implements the rtp.TransportRecv SetCallUpper method.
+func (ds *DualStackRemote) SetCallUpper(upper TransportRecv) {
+	ds.callUpper = upper
+}
+
+// CloseRecv implements the rtp.TransportRecv CloseRecv method.
+func (ds *DualStackRemote) CloseRecv() {
+	ds.mutex.Lock()
+	if ds.stop != nil {
+		close(ds.stop)
+		ds.stop = nil
+	}
+	ds.mutex.Unlock()
+	ds.transportRecv.CloseRecv()
+}
+
+// SetEndChannel implements the rtp.TransportRecv SetEndChannel method.
+func (ds *DualStackRemote) SetEndChannel(ch TransportEnd) {
+	ds.transportRecv.SetEndChannel(ch)
+}
+
+// *** Local functions and methods.
+
+// accept records the packet's arrival and returns false if the packet arrived from an address
+// of the peer that is not selected.
+func (ds *DualStackRemote) accept(from *Address) bool {
+	ds.mutex.Lock()
+	idx := -1
+	for i, remote := range ds.remotes {
+		if remote.IpAddr.Equal(from.IpAddr) {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		ds.mutex.Unlock()
+		return true // not from the peer, let the upper layers decide
+	}
+	now := time.Now().UnixNano()
+	ds.lastRecv[idx] = now
+	accepted, changed := false, false
+	switch {
+	case ds.selected == idx:
+		accepted = true
+	case ds.selected < 0:
+		ds.selected = idx
+		accepted, changed = true, true
+	case now-ds.lastRecv[ds.selected] > int64(ds.timeout()):
+		ds.selected = idx // the selected family stopped working
+		accepted, changed = true, true
+	}
+	ds.mutex.Unlock()
+	if changed {
+		ds.update()
+	}
+	return accepted
+}
+
+// timeout returns the failover timeout. The caller holds the mutex or the layer is not active.
+func (ds *DualStackRemote) timeout() time.Duration {
+	if ds.Timeout <= 0 {
+		return dualStackTimeout
+	}
+	return ds.Timeout
+}
+
+// update adds the selected address to the session's remotes and removes the others, while
+// probing it adds all addresses. The method doesn't hold the mutex while it changes the
+// remotes, it always applies the latest selection.
+func (ds *DualStackRemote) update() {
+	ds.updateMutex.Lock()
+	defer ds.updateMutex.Unlock()
+
+	ds.mutex.Lock()
+	rs, selected := ds.rs, ds.selected
+	ds.mutex.Unlock()
+	if rs == nil {
+		return
+	}
+	for i := range ds.remotes {
+		if i != selected && selected >= 0 && ds.added[i] {
+			rs.RemoveRemote(ds.indexes[i])
+			ds.added[i] = false
+		}
+	}
+	for i, remote := range ds.remotes {
+		if (i == selected || selected < 0) && !ds.added[i] {
+			ds.indexes[i], _ = rs.AddRemote(remote)
+			ds.added[i] = true
+		}
+	}
+}
+
+func (ds *DualStackRemote) watch(stop chan bool, timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			ds.mutex.Lock()
+			probe := ds.selected >= 0 && now.UnixNano()-ds.lastRecv[ds.selected] > int64(timeout)
+			if probe {
+				ds.selected = -1
+			}
+			ds.mutex.Unlock()
+			if probe {
+				ds.update()
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func dualStackPacket(ip net.IP) *DataPacket {
+	rp, _ := NewDataPacketFromBuffer(append(make([]byte, rtpHeaderLength), payload...))
+	rp.fromAddr = Address{ip, 5222, 0}
+	return rp
+}
+
+func TestDualStackRemote(t *testing.T) {
+	parseFlags()
+
+	v6, v4 := net.ParseIP("2001:db8::2"), net.IPv4(192, 0, 2, 2)
+	remotes := []*Address{{v6, 5222, 5223}, {v4, 5222, 5223}}
+	ds, _ := NewDualStackRemote(new(teeConsumer), remotes)
+	ds.Timeout = 40 * time.Millisecond
+	rs := NewSession(new(captureWriter), ds)
+	upper := new(teeConsumer)
+	ds.SetCallUpper(upper)
+	ds.SetSession(rs)
+	if len(rs.remotes) != 2 || ds.Selected() != nil {
+		t.Errorf("Probe check failed. Remotes: %d\n", len(rs.remotes))
+		return
+	}
+
+	// IPv4 answers first and wins, IPv6 packets are dropped while IPv4 works
+	ds.OnRecvData(dualStackPacket(v4))
+	ds.OnRecvData(dualStackPacket(v6))
+	if sel := ds.Selected(); sel == nil || !sel.IpAddr.Equal(v4) || len(rs.remotes) != 1 || len(upper.data) != 1 {
+		t.Errorf("Selection check failed. Selected: %v, remotes: %d, forwarded: %d\n", sel, len(rs.remotes), len(upper.data))
+	}
+	// IPv4 stops working, IPv6 still delivers: fail over
+	time.Sleep(50 * time.Millisecond)
+	ds.OnRecvData(dualStackPacket(v6))
+	if sel := ds.Selected(); sel == nil || !sel.IpAddr.Equal(v6) || len(upper.data) != 2 {
+		t.Errorf("Failover check failed. Selected: %v, forwarded: %d\n", sel, len(upper.data))
+	}
+	for _, remote := range rs.remotes {
+		if !remote.IpAddr.Equal(v6) {
+			t.Errorf("Failover remotes check failed. Got: %v\n", remote.IpAddr)
+		}
+	}
+	// both families silent: probe again
+	ds.ListenOnTransports()
+	defer ds.CloseRecv()
+	time.Sleep(100 * time.Millisecond)
+	if ds.Selected() != nil || len(rs.remotes) != 2 {
+		t.Errorf("Re-probe check failed. Remotes: %d\n", len(rs.remotes))
+	}
+
+	// a zero timeout selects the default
+	ds, _ = NewDualStackRemote(new(teeConsumer), remotes)
+	ds.Timeout = 0
+	if ds.timeout() != dualStackTimeout {
+		t.Errorf("Default timeout check failed. Got: %s\n", ds.timeout())
+	}
+	ds.ListenOnTransports()
+	ds.CloseRecv()
+}
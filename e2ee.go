@@ -0,0 +1,142 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the interception point of end-to-end encryption: a payload cryptor
+ * encrypts the payload of the sent packets and decrypts the payload of the received packets,
+ * for example with SFrame.
+ */
+
+// FrameContext describes the RTP packet whose payload a PayloadCryptor transforms. All packets
+// of a media frame have the same timestamp, a cryptor that works on frames, for example SFrame,
+// uses Timestamp, FrameStart and Marker to find the frame boundaries.
+type FrameContext struct {
+	Ssrc        uint32
+	Csrc        []uint32 // the CSRC list of the packet, nil if the packet has none
+	PayloadType byte
+	Sequence    uint16
+	Timestamp   uint32
+	Marker      bool
+	FrameStart  bool // the timestamp differs from the one of the previous packet of the stream
+	Send        bool // true for sent packets, false for received packets
+	StreamIndex uint32
+}
+
+// PayloadCryptor transforms the payload of RTP packets for end-to-end encryption.
+//
+// The session calls EncryptPayload in WriteData after the application or a packetizer, for
+// example WriteFrames, built the packet and before the session records the packet for
+// retransmissions and sends it. It calls DecryptPayload for received packets after the stream
+// statistics, the loss detection and the retransmission recovery, and before the packet goes
+// to the concealer or the application, thus the depacketizers, for example SplitFrames, see
+// the plain payload. The header, including the header extension, stays in the clear, thus hop
+// by hop SRTP, the Forwarder and the Translator work unchanged.
+//
+// The methods return the new payload; they may return the payload slice itself if they
+// transformed it in place. The session calls the methods of one stream one at a time, the
+// calls of different streams run in parallel.
+type PayloadCryptor interface {
+	EncryptPayload(fc *FrameContext, payload []byte) ([]byte, error)
+	DecryptPayload(fc *FrameContext, payload []byte) ([]byte, error)
+}
+
+// SetPayloadCryptor sets the end-to-end encryption of the payloads, nil removes it. Set the
+// cryptor before the session starts.
+//
+// If WriteData cannot encrypt a packet it returns the error and doesn't send the packet. The
+// session drops received packets that the cryptor cannot decrypt and sends a
+// DecryptFailedData event.
+//
+func (rs *Session) SetPayloadCryptor(pc PayloadCryptor) {
+	rs.cryptor = pc
+}
+
+// *** Local functions and methods.
+
+const errCryptPayload = Error("PayloadCryptor: transformed payload does not fit into the packet.")
+
+// frameContext returns the context of the packet and keeps its timestamp. The caller holds the
+// streamMutex of an output stream or the recvMutex of an input stream, str is nil in simple RTP
+// mode and then each packet starts a frame.
+func frameContext(str *SsrcStream, strIdx uint32, rp *DataPacket, send bool) *FrameContext {
+	fc := &FrameContext{
+		Ssrc:        rp.Ssrc(),
+		PayloadType: rp.PayloadType(),
+		Sequence:    rp.Sequence(),
+		Timestamp:   rp.Timestamp(),
+		Marker:      rp.Marker(),
+		FrameStart:  true,
+		Send:        send,
+		StreamIndex: strIdx,
+	}
+	if rp.CsrcCount() > 0 {
+		fc.Csrc = rp.CsrcList()
+	}
+	if str != nil {
+		fc.FrameStart = !str.frameStampValid || str.frameStamp != fc.Timestamp
+		str.frameStamp, str.frameStampValid = fc.Timestamp, true
+	}
+	return fc
+}
+
+// encryptPayload replaces the payload of a packet the application sends.
+func (rs *Session) encryptPayload(str *SsrcStream, strIdx uint32, rp *DataPacket) error {
+	str.streamMutex.Lock()
+	fc := frameContext(str, strIdx, rp, true)
+	str.streamMutex.Unlock()
+
+	payload, err := rs.cryptor.EncryptPayload(fc, rp.Payload())
+	if err != nil {
+		return err
+	}
+	return rp.replacePayload(payload)
+}
+
+// decryptPayload replaces the payload of a received packet. If the cryptor fails the method
+// frees the packet and returns false.
+func (rs *Session) decryptPayload(str *SsrcStream, strIdx uint32, rp *DataPacket) bool {
+	ssrc := rp.Ssrc()
+	payload, err := rs.cryptor.DecryptPayload(frameContext(str, strIdx, rp, false), rp.Payload())
+	if err == nil {
+		err = rp.replacePayload(payload)
+	}
+	if err != nil {
+		rp.FreePacket()
+		rs.sendStreamCtrlEvent(DecryptFailedData, str, ssrc, strIdx)
+		return false
+	}
+	return true
+}
+
+// replacePayload sets the transformed payload. A packet the application built keeps its
+// padding setting, see SetPadding; a received packet loses its padding, the padding belongs to
+// the transformed payload.
+func (rp *DataPacket) replacePayload(payload []byte) error {
+	if rp.Padding() && rp.padTo == 0 {
+		rp.inUse -= int(rp.buffer[rp.inUse-1])
+		rp.buffer[0] &^= paddingBit
+	}
+	payOffset := int(rp.CsrcCount()*4+rtpHeaderLength) + rp.ExtensionLength()
+	if payOffset+len(payload)+rp.padTo > len(rp.buffer) {
+		return errCryptPayload
+	}
+	rp.SetPayload(payload) // copy moves the bytes of a payload that points into the buffer
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// xorCryptor is a toy end-to-end encryption: it XORs the payload with the low byte of the SSRC
+// and appends the timestamp as tag.
+type xorCryptor struct {
+	frames []FrameContext
+}
+
+func (xc *xorCryptor) EncryptPayload(fc *FrameContext, payload []byte) ([]byte, error) {
+	xc.frames = append(xc.frames, *fc)
+	out := make([]byte, len(payload), len(payload)+4)
+	for i, b := range payload {
+		out[i] = b ^ byte(fc.Ssrc)
+	}
+	return binary.BigEndian.AppendUint32(out, fc.Timestamp), nil
+}
+
+func (xc *xorCryptor) DecryptPayload(fc *FrameContext, payload []byte) ([]byte, error) {
+	xc.frames = append(xc.frames, *fc)
+	if len(payload) < 4 || binary.BigEndian.Uint32(payload[len(payload)-4:]) != fc.Timestamp {
+		return nil, Error("bad tag")
+	}
+	payload = payload[:len(payload)-4]
+	for i := range payload {
+		payload[i] ^= byte(fc.Ssrc) // in place
+	}
+	return payload, nil
+}
+
+func TestPayloadCryptor(t *testing.T) {
+	parseFlags()
+
+	sender, ct := closeSession(false)
+	drainCtrl(t, sender)
+	send := new(xorCryptor)
+	sender.SetPayloadCryptor(send)
+
+	plain := [][]byte{{1, 2, 3}, {4, 5, 6, 7}, {8, 9}}
+	for i, payload := range plain {
+		rp := sender.NewDataPacket(uint32(i/2) * 160) // two packets of the first frame
+		rp.SetPayload(payload)
+		if _, err := sender.WriteData(rp); err != nil {
+			t.Errorf("WriteData failed: %s\n", err.Error())
+		}
+		rp.FreePacket()
+	}
+	if len(ct.captureWriter.data) != 3 || len(send.frames) != 3 {
+		t.Errorf("Sent %d packets, expected 3.\n", len(ct.captureWriter.data))
+		return
+	}
+	for i, fc := range send.frames {
+		if !fc.Send || fc.Ssrc != 0x01020304 || fc.FrameStart != (i != 1) {
+			t.Errorf("Send frame context %d check failed: %+v\n", i, fc)
+		}
+	}
+	sent, _ := NewDataPacketFromBuffer(ct.captureWriter.data[0])
+	if len(sent.Payload()) != 7 || bytes.Equal(sent.Payload()[0:3], plain[0]) {
+		t.Errorf("Sent payload is not encrypted: % x\n", sent.Payload())
+	}
+	if out := sender.SsrcStreamOut(); out.SenderOctectCnt != 3*4+9 {
+		t.Errorf("Sender octet count %d does not count the encrypted payload.\n", out.SenderOctectCnt)
+	}
+
+	receiver, _ := closeSession(false)
+	drainCtrl(t, receiver)
+	recv := new(xorCryptor)
+	receiver.SetPayloadCryptor(recv)
+	dataChan := receiver.CreateDataReceiveChan()
+	events := receiver.CreateCtrlEventChan()
+
+	from := Address{IpAddr: net.IPv4(127, 0, 0, 1), DataPort: 6002, CtrlPort: 6003}
+	tampered := append([]byte{}, ct.captureWriter.data[2]...)
+	tampered[len(tampered)-1] ^= 0xff
+	binary.BigEndian.PutUint16(tampered[2:], binary.BigEndian.Uint16(tampered[2:])+1) // not a duplicate
+	for _, data := range append(ct.captureWriter.data, tampered) {
+		rp, _ := NewDataPacketFromBuffer(data)
+		rp.fromAddr = from
+		receiver.OnRecvData(rp)
+	}
+	if len(dataChan) != 3 {
+		t.Errorf("Received %d packets, expected 3.\n", len(dataChan))
+		return
+	}
+	for i := range plain {
+		rp := <-dataChan
+		if !bytes.Equal(rp.Payload(), plain[i]) {
+			t.Errorf("Decrypted payload %d: % x, expected % x\n", i, rp.Payload(), plain[i])
+		}
+		rp.FreePacket()
+	}
+	if fc := recv.frames[1]; fc.Send || fc.FrameStart || fc.Sequence != recv.frames[0].Sequence+1 {
+		t.Errorf("Receive frame context check failed: %+v\n", fc)
+	}
+	var failed int
+	for len(events) > 0 {
+		for _, ev := range <-events {
+			if ev.EventType == DecryptFailedData {
+				failed++
+			}
+		}
+	}
+	if failed != 1 {
+		t.Errorf("DecryptFailedData event count %d, expected 1.\n", failed)
+	}
+}
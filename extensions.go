@@ -0,0 +1,437 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the RTP header extension elements of RFC 8285 and the registry
+ * that maps extension URIs to the IDs negotiated in SDP (a=extmap).
+ */
+
+import (
+	"encoding/binary"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Some well known header extension URIs.
+const (
+	ExtAudioLevel         = "urn:ietf:params:rtp-hdrext:ssrc-audio-level"
+	ExtTransmissionOffset = "urn:ietf:params:rtp-hdrext:toffset"
+	ExtAbsSendTime        = "http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time"
+	ExtAbsCaptureTime     = "http://www.webrtc.org/experiments/rtp-hdrext/abs-capture-time"
+	ExtFrameMarking       = "urn:ietf:params:rtp-hdrext:framemarking"
+	ExtSdesMid            = "urn:ietf:params:rtp-hdrext:sdes:mid"
+)
+
+const (
+	extOneByteProfile = 0xbede
+	extTwoByteProfile = 0x1000 // the lower 4 bits are application bits
+	extOneByteMaxId   = 14
+	extOneByteMaxLen  = 16
+)
+
+type extElement struct {
+	id   byte
+	data []byte
+}
+
+// ExtensionMap maps header extension URIs to numeric IDs.
+//
+// The IDs of header extensions are negotiated per peer in SDP (a=extmap), thus application code
+// refers to extensions by URI and looks up the IDs in the map. Each session has its own map,
+// see Session.ExtensionMap.
+//
+type ExtensionMap struct {
+	mutex sync.RWMutex
+	ids   map[string]byte
+	uris  map[byte]string
+}
+
+// NewExtensionMap creates an empty extension map.
+func NewExtensionMap() *ExtensionMap {
+	return &ExtensionMap{ids: make(map[string]byte), uris: make(map[byte]string)}
+}
+
+// Register maps an extension URI to an ID.
+//
+// IDs 1 - 14 use the one-byte header format if the data is not longer than 16 bytes, IDs
+// 15 - 255 always use the two-byte format. Registering an URI again replaces its ID. The method
+// returns an error if the ID is not valid or already used by another URI.
+//
+//   id  - the negotiated ID
+//   uri - the extension's URI
+//
+func (em *ExtensionMap) Register(id byte, uri string) error {
+	if id == 0 {
+		return Error("Invalid header extension ID 0.")
+	}
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+	if other, ok := em.uris[id]; ok && other != uri {
+		return Error("Header extension ID " + strconv.Itoa(int(id)) + " already used by " + other)
+	}
+	if old, ok := em.ids[uri]; ok {
+		delete(em.uris, old)
+	}
+	em.ids[uri] = id
+	em.uris[id] = uri
+	return nil
+}
+
+// Unregister removes an extension URI from the map.
+func (em *ExtensionMap) Unregister(uri string) {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+	if id, ok := em.ids[uri]; ok {
+		delete(em.uris, id)
+		delete(em.ids, uri)
+	}
+}
+
+// Id returns the ID of an extension URI, false if the URI is not registered.
+func (em *ExtensionMap) Id(uri string) (byte, bool) {
+	em.mutex.RLock()
+	defer em.mutex.RUnlock()
+	id, ok := em.ids[uri]
+	return id, ok
+}
+
+// Uri returns the extension URI of an ID, false if the ID is not registered.
+func (em *ExtensionMap) Uri(id byte) (string, bool) {
+	em.mutex.RLock()
+	defer em.mutex.RUnlock()
+	uri, ok := em.uris[id]
+	return uri, ok
+}
+
+// SetExtension sets the data of the extension with the URI in a RTP packet. Nil data removes
+// the extension from the packet.
+func (em *ExtensionMap) SetExtension(rp *DataPacket, uri string, data []byte) error {
+	id, ok := em.Id(uri)
+	if !ok {
+		return Error("Header extension not registered: " + uri)
+	}
+	return rp.SetExtensionElement(id, data)
+}
+
+// Extension returns the data of the extension with the URI in a RTP packet, nil if the
+// extension is not registered or the packet does not contain it.
+func (em *ExtensionMap) Extension(rp *DataPacket, uri string) []byte {
+	id, ok := em.Id(uri)
+	if !ok {
+		return nil
+	}
+	return rp.ExtensionElement(id)
+}
+
+// Extensions returns the data of all extensions of a RTP packet with a registered ID, indexed
+// by the URIs.
+func (em *ExtensionMap) Extensions(rp *DataPacket) map[string][]byte {
+	elements, _, ok := extensionElements(rp.Extension())
+	if !ok {
+		return nil
+	}
+	em.mutex.RLock()
+	defer em.mutex.RUnlock()
+	exts := make(map[string][]byte, len(elements))
+	for _, e := range elements {
+		if uri, ok := em.uris[e.id]; ok {
+			exts[uri] = e.data
+		}
+	}
+	return exts
+}
+
+// ExtensionElement returns the data of the RFC 8285 header extension element with the ID, nil if
+// the packet does not contain the element. The slice points into the packet buffer.
+func (rp *DataPacket) ExtensionElement(id byte) []byte {
+	elements, _, ok := extensionElements(rp.Extension())
+	if !ok {
+		return nil
+	}
+	for _, e := range elements {
+		if e.id == id {
+			return e.data
+		}
+	}
+	return nil
+}
+
+// SetExtensionElement sets the data of the RFC 8285 header extension element with the ID and
+// keeps the other elements. Nil data removes the element.
+//
+// The method uses the one-byte header format if all elements allow it, otherwise the two-byte
+// format. It returns an error if the packet has a header extension of another profile.
+//
+//   id   - the element's ID, 1 - 255
+//   data - the element's data, at most 255 bytes
+//
+func (rp *DataPacket) SetExtensionElement(id byte, data []byte) error {
+	if id == 0 || len(data) > 255 {
+		return Error("Invalid header extension element.")
+	}
+	elements, _, ok := extensionElements(rp.Extension())
+	if !ok {
+		return Error("RTP packet has a header extension of another profile.")
+	}
+	var newElements []extElement
+	for _, e := range elements {
+		if e.id != id {
+			newElements = append(newElements, extElement{e.id, append([]byte{}, e.data...)})
+		}
+	}
+	if data != nil {
+		newElements = append(newElements, extElement{id, data})
+	}
+	ext := buildExtension(newElements)
+	oldLen := rp.inUse - rp.ExtensionLength()
+	rp.SetExtension(ext)
+	if rp.inUse-rp.ExtensionLength() != oldLen || rp.ExtensionLength() != len(ext) {
+		return Error("RTP packet buffer too small for the header extension.")
+	}
+	return nil
+}
+
+// extensionElements parses a RFC 8285 header extension. The function returns ok false if the
+// extension has another profile or is malformed. An empty extension has no elements.
+func extensionElements(ext []byte) (elements []extElement, twoByte, ok bool) {
+	if len(ext) == 0 {
+		return nil, false, true
+	}
+	if len(ext) < 4 {
+		return nil, false, false
+	}
+	profile := binary.BigEndian.Uint16(ext)
+	switch {
+	case profile == extOneByteProfile:
+	case profile&0xfff0 == extTwoByteProfile:
+		twoByte = true
+	default:
+		return nil, false, false
+	}
+	data := ext[4:]
+	for i := 0; i < len(data); {
+		if data[i] == 0 { // padding
+			i++
+			continue
+		}
+		var id byte
+		var length int
+		if twoByte {
+			if i+2 > len(data) {
+				return nil, twoByte, false
+			}
+			id, length = data[i], int(data[i+1])
+			i += 2
+		} else {
+			id, length = data[i]>>4, int(data[i]&0x0f)+1
+			if id == 15 { // reserved, stop parsing
+				break
+			}
+			i++
+		}
+		if i+length > len(data) {
+			return nil, twoByte, false
+		}
+		elements = append(elements, extElement{id, data[i : i+length]})
+		i += length
+	}
+	return elements, twoByte, true
+}
+
+// buildExtension builds a RFC 8285 header extension with the elements, including the extension
+// header and the padding.
+func buildExtension(elements []extElement) []byte {
+	if len(elements) == 0 {
+		return []byte{}
+	}
+	twoByte := false
+	for _, e := range elements {
+		if e.id > extOneByteMaxId || len(e.data) == 0 || len(e.data) > extOneByteMaxLen {
+			twoByte = true
+		}
+	}
+	ext := make([]byte, 4, 64)
+	binary.BigEndian.PutUint16(ext, extOneByteProfile)
+	if twoByte {
+		binary.BigEndian.PutUint16(ext, extTwoByteProfile)
+	}
+	for _, e := range elements {
+		if twoByte {
+			ext = append(ext, e.id, byte(len(e.data)))
+		} else {
+			ext = append(ext, e.id<<4|byte(len(e.data)-1))
+		}
+		ext = append(ext, e.data...)
+	}
+	for len(ext)%4 != 0 {
+		ext = append(ext, 0)
+	}
+	binary.BigEndian.PutUint16(ext[2:], uint16(len(ext)/4-1))
+	return ext
+}
+
+// AbsSendTime returns the 24 bit abs-send-time value of a time: the seconds modulo 64 and the
+// fraction of the NTP timestamp in 6.18 fixed point format.
+func AbsSendTime(tm time.Time) uint32 {
+	seconds, fraction := toNtpStamp(tm.UnixNano())
+	return (seconds&0x3f)<<18 | fraction>>14
+}
+
+// ParseAbsSendTime returns the 24 bit value of an abs-send-time extension element, false if the
+// data has not the length of 3 bytes.
+func ParseAbsSendTime(data []byte) (uint32, bool) {
+	if len(data) != 3 {
+		return 0, false
+	}
+	return uint32(data[0])<<16 | uint32(data[1])<<8 | uint32(data[2]), true
+}
+
+// stampAbsSendTime writes the current abs-send-time into the packet's extension element with
+// the ID. If the packet already contains the element with the correct length the function
+// overwrites it in place, otherwise it adds the element.
+func stampAbsSendTime(rp *DataPacket, id byte) {
+	stamp := AbsSendTime(time.Now())
+	data := []byte{byte(stamp >> 16), byte(stamp >> 8), byte(stamp)}
+	if old := rp.ExtensionElement(id); len(old) == 3 {
+		copy(old, data)
+		return
+	}
+	rp.SetExtensionElement(id, data)
+}
+
+// AbsCaptureTime holds the data of an abs-capture-time extension element.
+type AbsCaptureTime struct {
+	CaptureTime time.Time     // the capture time of the first sample, in the capturing system's clock
+	ClockOffset time.Duration // estimated offset of the capturing system's clock to the sender's clock
+	HasOffset   bool          // true if the element contains ClockOffset
+}
+
+// ParseAbsCaptureTime parses the data of an abs-capture-time extension element. The function
+// returns false if the data has neither the length of 8 nor 16 bytes.
+func ParseAbsCaptureTime(data []byte) (act AbsCaptureTime, ok bool) {
+	if len(data) != 8 && len(data) != 16 {
+		return act, false
+	}
+	act.CaptureTime = time.Unix(0, fromNtp(binary.BigEndian.Uint32(data), binary.BigEndian.Uint32(data[4:])))
+	if len(data) == 16 {
+		// signed Q32.32 fixed point seconds
+		offset := int64(binary.BigEndian.Uint64(data[8:]))
+		act.ClockOffset = time.Duration(offset>>32)*time.Second + time.Duration((offset&0xffffffff)*1e9>>32)
+		act.HasOffset = true
+	}
+	return act, true
+}
+
+// Bytes returns the data of the abs-capture-time extension element, 8 bytes or 16 bytes if
+// HasOffset is true.
+func (act *AbsCaptureTime) Bytes() []byte {
+	data := make([]byte, 8, 16)
+	seconds, fraction := toNtpStamp(act.CaptureTime.UnixNano())
+	binary.BigEndian.PutUint32(data, seconds)
+	binary.BigEndian.PutUint32(data[4:], fraction)
+	if act.HasOffset {
+		secs := int64(act.ClockOffset / time.Second)
+		frac := int64(act.ClockOffset%time.Second) << 32 / 1e9
+		data = data[:16]
+		binary.BigEndian.PutUint64(data[8:], uint64(secs<<32+frac))
+	}
+	return data
+}
+
+// AbsCaptureTime returns the abs-capture-time extension of a RTP packet, false if the extension
+// is not registered or the packet does not contain a valid element.
+func (em *ExtensionMap) AbsCaptureTime(rp *DataPacket) (AbsCaptureTime, bool) {
+	return ParseAbsCaptureTime(em.Extension(rp, ExtAbsCaptureTime))
+}
+
+// FrameMarking holds the data of a frame-marking extension element (draft-ietf-avtext-framemarking).
+//
+// The element describes the frame a packet belongs to, thus middleboxes can forward or drop
+// packets of encrypted payloads they cannot parse. The non-scalable form contains only the
+// flags, the scalable form adds the layer IDs.
+//
+type FrameMarking struct {
+	Start         bool // first packet of a frame
+	End           bool // last packet of a frame
+	Independent   bool // the frame can be decoded independent of earlier frames, for example a keyframe
+	Discardable   bool // no other frame depends on this frame
+	Scalable      bool // the element contains BaseLayerSync, TemporalId and LayerId
+	BaseLayerSync bool // the frame depends only on the base temporal layer
+	TemporalId    byte // temporal layer ID, 0 - 7
+	LayerId       byte // spatial and quality layer ID, codec specific
+	HasTl0PicIdx  bool // the element contains Tl0PicIdx
+	Tl0PicIdx     byte // running index of the base temporal layer frames
+}
+
+// ParseFrameMarking parses the 1 to 3 bytes of a frame-marking extension element.
+func ParseFrameMarking(data []byte) (fm FrameMarking, ok bool) {
+	if len(data) < 1 || len(data) > 3 {
+		return fm, false
+	}
+	fm.Start = data[0]&0x80 != 0
+	fm.End = data[0]&0x40 != 0
+	fm.Independent = data[0]&0x20 != 0
+	fm.Discardable = data[0]&0x10 != 0
+	if len(data) == 1 {
+		return fm, true
+	}
+	fm.Scalable = true
+	fm.BaseLayerSync = data[0]&0x08 != 0
+	fm.TemporalId = data[0] & 0x07
+	fm.LayerId = data[1]
+	if len(data) == 3 {
+		fm.HasTl0PicIdx = true
+		fm.Tl0PicIdx = data[2]
+	}
+	return fm, true
+}
+
+// Bytes returns the data of the frame-marking extension element.
+func (fm *FrameMarking) Bytes() []byte {
+	var flags byte
+	for i, set := range []bool{fm.Start, fm.End, fm.Independent, fm.Discardable} {
+		if set {
+			flags |= 0x80 >> uint(i)
+		}
+	}
+	if !fm.Scalable {
+		return []byte{flags}
+	}
+	if fm.BaseLayerSync {
+		flags |= 0x08
+	}
+	data := []byte{flags | fm.TemporalId&0x07, fm.LayerId}
+	if fm.HasTl0PicIdx {
+		data = append(data, fm.Tl0PicIdx)
+	}
+	return data
+}
+
+// FrameMarking returns the frame-marking extension of a RTP packet, false if the extension is
+// not registered or the packet does not contain a valid element.
+func (em *ExtensionMap) FrameMarking(rp *DataPacket) (FrameMarking, bool) {
+	return ParseFrameMarking(em.Extension(rp, ExtFrameMarking))
+}
+
+// SetFrameMarking sets the frame-marking extension of a RTP packet.
+func (em *ExtensionMap) SetFrameMarking(rp *DataPacket, fm *FrameMarking) error {
+	return em.SetExtension(rp, ExtFrameMarking, fm.Bytes())
+}
@@ -0,0 +1,167 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"sync"
+)
+
+// Feedback message types (FMT) of PSFB packets, RFC 4585 chapter 6.3 and RFC 5104 chapter 4.3.
+const (
+	PsfbPli  = 1  // Picture Loss Indication
+	PsfbSli  = 2  // Slice Loss Indication
+	PsfbRpsi = 3  // Reference Picture Selection Indication
+	PsfbFir  = 4  // Full Intra Request [RFC5104]
+	PsfbAfb  = 15 // Application layer feedback, e.g. REMB
+)
+
+// FmtAny registers a feedback handler for all feedback message types of a packet type.
+const FmtAny = -1
+
+// FeedbackMessage is a received RTCP feedback message, RFC 4585 chapter 6.1.
+type FeedbackMessage struct {
+	Type   int    // the packet type, RtcpRtpfb or RtcpPsfb
+	Format int    // the feedback message type (FMT), e.g. RtpfbNack or PsfbPli
+	Sender uint32 // SSRC of the packet sender
+	Media  uint32 // SSRC of the media source
+	Fci    []byte // the feedback control information, valid during the handler call only
+}
+
+// Copy returns the message as a parsed Feedback packet that owns a copy of the FCI, e.g. to
+// keep a message after the handler call.
+func (msg *FeedbackMessage) Copy() *Feedback {
+	fci := make([]byte, len(msg.Fci))
+	copy(fci, msg.Fci)
+	fb := &Feedback{*msg}
+	fb.Fci = fci
+	return fb
+}
+
+// FeedbackHandler handles a received feedback message. The session calls the handlers while it
+// processes the RTCP packet, thus a handler must not block.
+type FeedbackHandler func(msg *FeedbackMessage)
+
+// FeedbackRouter dispatches the received RTCP feedback messages of a session to the handlers
+// registered for their packet type and FMT. Handlers registered with FmtAny receive all messages
+// of a packet type after the handlers of the FMT. The session's NACK responders register as a
+// handler of Generic NACKs. The session also signals every feedback message with a control event
+// as before.
+//
+type FeedbackRouter struct {
+	mutex    sync.RWMutex
+	handlers map[feedbackKey][]feedbackEntry
+	nextId   int
+	unrouted uint32
+}
+
+type feedbackKey struct {
+	pt, format int
+}
+
+type feedbackEntry struct {
+	id      int
+	handler FeedbackHandler
+}
+
+func newFeedbackRouter() *FeedbackRouter {
+	return &FeedbackRouter{handlers: make(map[feedbackKey][]feedbackEntry)}
+}
+
+// FeedbackRouter returns the session's feedback router.
+func (rs *Session) FeedbackRouter() *FeedbackRouter {
+	return rs.feedback
+}
+
+// Register registers a handler for the feedback messages of a packet type and FMT and returns
+// the registration id for Unregister.
+//
+//   pt      - the packet type, RtcpRtpfb or RtcpPsfb
+//   format  - the feedback message type or FmtAny
+//   handler - the handler
+//
+func (fr *FeedbackRouter) Register(pt, format int, handler FeedbackHandler) (id int, err error) {
+	if pt != RtcpRtpfb && pt != RtcpPsfb {
+		return 0, Error("FeedbackRouter: packet type is not a feedback type.")
+	}
+	if format != FmtAny && (format < 0 || format > 31) {
+		return 0, Error("FeedbackRouter: FMT out of range.")
+	}
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+	fr.nextId++
+	key := feedbackKey{pt, format}
+	fr.handlers[key] = append(fr.handlers[key], feedbackEntry{fr.nextId, handler})
+	return fr.nextId, nil
+}
+
+// Unregister removes the handler with the registration id.
+func (fr *FeedbackRouter) Unregister(id int) {
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+	for key, entries := range fr.handlers {
+		for i, e := range entries {
+			if e.id == id {
+				fr.handlers[key] = append(entries[:i:i], entries[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Unrouted returns the number of feedback messages without a handler.
+func (fr *FeedbackRouter) Unrouted() uint32 {
+	fr.mutex.RLock()
+	defer fr.mutex.RUnlock()
+	return fr.unrouted
+}
+
+// *** Local functions and methods.
+
+// route calls the handlers of a feedback message. It calls the handlers outside the mutex, thus
+// a handler may register and unregister handlers.
+func (fr *FeedbackRouter) route(msg *FeedbackMessage) {
+	fr.mutex.RLock()
+	var handlers []FeedbackHandler
+	for _, key := range []feedbackKey{{msg.Type, msg.Format}, {msg.Type, FmtAny}} {
+		for _, e := range fr.handlers[key] {
+			handlers = append(handlers, e.handler)
+		}
+	}
+	fr.mutex.RUnlock()
+
+	if len(handlers) == 0 {
+		fr.mutex.Lock()
+		fr.unrouted++
+		fr.mutex.Unlock()
+		return
+	}
+	for _, handler := range handlers {
+		handler(msg)
+	}
+}
+
+// routeFeedback builds the message of the RTPFB or PSFB packet at the offset and routes it.
+func (rs *Session) routeFeedback(rp *CtrlPacket, offset, pktLen int) {
+	fbOffset := offset + rtcpHeaderLength + rtcpSsrcLength + rtcpSsrcLength
+	if fbOffset > offset+pktLen {
+		return
+	}
+	rs.feedback.route(&FeedbackMessage{Type: rp.Type(offset), Format: rp.Count(offset),
+		Sender: rp.Ssrc(offset), Media: rp.Ssrc(offset + rtcpSsrcLength), Fci: rp.buffer[fbOffset : offset+pktLen]})
+}
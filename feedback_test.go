@@ -0,0 +1,56 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"testing"
+)
+
+func TestFeedbackRouter(t *testing.T) {
+	parseFlags()
+
+	rs, _ := closeSession(false)
+	fr := rs.FeedbackRouter()
+	if _, err := fr.Register(RtcpSR, PsfbPli, func(msg *FeedbackMessage) {}); err == nil {
+		t.Errorf("Register must reject non feedback packet types\n")
+	}
+	var plis, all []FeedbackMessage
+	fr.Register(RtcpPsfb, PsfbPli, func(msg *FeedbackMessage) { plis = append(plis, *msg) })
+	allId, _ := fr.Register(RtcpPsfb, FmtAny, func(msg *FeedbackMessage) { all = append(all, *msg) })
+
+	pli := nackPacket(0x0a0b0c0d, 0x01020304, nil)
+	pli.buffer[0] = 0x80 | PsfbPli
+	pli.buffer[1] = RtcpPsfb
+	rs.OnRecvCtrl(pli)
+	if len(plis) != 1 || plis[0].Sender != 0x0a0b0c0d || plis[0].Media != 0x01020304 || len(plis[0].Fci) != 0 {
+		t.Errorf("PLI routing check failed: %+v\n", plis)
+	}
+	if len(all) != 1 || all[0].Format != PsfbPli {
+		t.Errorf("FmtAny routing check failed: %+v\n", all)
+	}
+
+	fir := nackPacket(0x0a0b0c0d, 0, []byte{1, 2, 3, 4, 5, 0, 0, 0})
+	fir.buffer[0] = 0x80 | PsfbFir
+	fir.buffer[1] = RtcpPsfb
+	fr.Unregister(allId)
+	rs.OnRecvCtrl(fir)
+	if len(plis) != 1 || len(all) != 1 || fr.Unrouted() != 1 {
+		t.Errorf("Unregister check failed, unrouted: %d\n", fr.Unrouted())
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * This source file contains the payload format plugins: packages outside of gortp register the
+ * packetization of their codecs by the encoding name, WriteFrames and SplitFrames use them. The
+ * frame based formats of PayloadFormatMap use the same interface.
+ */
+
+// PayloadFormatter packetizes the frames of a codec and depacketizes the payloads.
+//
+// A PayloadFormat with a fixed frame duration has a built-in formatter that aggregates frames
+// as the packetization time allows it, see SetPtime, and splits payloads by the frame size.
+// Other codecs register a formatter with RegisterPayloadFormatter. The PayloadFormat struct
+// keeps the SDP parameters; it is not an interface because its fields are part of the API.
+type PayloadFormatter interface {
+	ClockRate() int
+	FrameDuration() time.Duration // 0 if the frames have no fixed duration
+
+	// Packetize puts the frames into the payloads of packets of at most maxSize bytes.
+	// WriteFrames sends one packet for each returned payload.
+	Packetize(frames [][]byte, ptime, maxPtime time.Duration, maxSize int) ([]FormattedPayload, error)
+
+	// Depacketize returns the frames of the payload of a received packet.
+	Depacketize(payload []byte) ([][]byte, error)
+}
+
+// FormattedPayload is the payload of one packet a PayloadFormatter created.
+type FormattedPayload struct {
+	Payload []byte
+	Samples uint32 // timestamp units from this packet to the next one, 0 for the packets of one frame
+	Marker  bool
+}
+
+// PayloadFormatterFunc creates the formatter of a payload format. The session creates the
+// formatter for each call of WriteFrames and SplitFrames, a factory that needs no state may
+// return the same formatter.
+type PayloadFormatterFunc func(pf *PayloadFormat) PayloadFormatter
+
+var (
+	formattersMutex sync.RWMutex
+	formatters      = make(map[string]PayloadFormatterFunc)
+)
+
+// RegisterPayloadFormatter registers the formatter of an encoding name, for example "opus" or
+// "H264". The name matches the Name of the PayloadFormat without regard to case, as in SDP. A
+// registered formatter replaces the built-in one of the name, nil removes the registration.
+//
+func RegisterPayloadFormatter(name string, fn PayloadFormatterFunc) {
+	formattersMutex.Lock()
+	defer formattersMutex.Unlock()
+	if fn == nil {
+		delete(formatters, strings.ToLower(name))
+		return
+	}
+	formatters[strings.ToLower(name)] = fn
+}
+
+// Formatter returns the formatter of the payload format: the registered formatter of its name
+// or the built-in formatter of a fixed frame duration, nil if the format has neither.
+func (pf *PayloadFormat) Formatter() PayloadFormatter {
+	formattersMutex.RLock()
+	fn := formatters[strings.ToLower(pf.Name)]
+	formattersMutex.RUnlock()
+	if fn != nil {
+		return fn(pf)
+	}
+	if pf.FrameDuration <= 0 {
+		return nil
+	}
+	return &frameFormatter{pf: *pf}
+}
+
+// *** Local functions and methods.
+
+// frameFormatter is the formatter of the formats with a fixed frame duration.
+type frameFormatter struct {
+	pf PayloadFormat
+}
+
+func (ff *frameFormatter) ClockRate() int {
+	return ff.pf.ClockRate
+}
+
+func (ff *frameFormatter) FrameDuration() time.Duration {
+	return ff.pf.FrameDuration
+}
+
+// Packetize aggregates as many frames as fit into the packetization time, the size limit does
+// not apply to the aggregation.
+func (ff *frameFormatter) Packetize(frames [][]byte, ptime, maxPtime time.Duration, maxSize int) ([]FormattedPayload, error) {
+	perPacket := framesPerPacket(ff.pf.FrameDuration, ptime, maxPtime)
+	samples := ff.pf.FrameSamples()
+
+	var payloads []FormattedPayload
+	for len(frames) > 0 {
+		n := perPacket
+		if n > len(frames) {
+			n = len(frames)
+		}
+		var payload []byte
+		for _, frame := range frames[:n] {
+			payload = append(payload, frame...)
+		}
+		payloads = append(payloads, FormattedPayload{Payload: payload, Samples: uint32(n) * samples})
+		frames = frames[n:]
+	}
+	return payloads, nil
+}
+
+// Depacketize splits the payload by the frame size. A trailing short frame, for example a
+// G.729 Annex B comfort noise frame, is the last frame.
+func (ff *frameFormatter) Depacketize(payload []byte) (frames [][]byte, err error) {
+	if ff.pf.FrameSize <= 0 {
+		return nil, Error("Payload format has no fixed frame size.")
+	}
+	for len(payload) > 0 {
+		n := ff.pf.FrameSize
+		if n > len(payload) {
+			n = len(payload)
+		}
+		frames = append(frames, payload[:n])
+		payload = payload[n:]
+	}
+	return frames, nil
+}
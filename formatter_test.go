@@ -0,0 +1,127 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// lengthFormatter is a plugin formatter as an external package would register it: every frame
+// goes into its own packet with a one byte length prefix, the last packet has the marker bit.
+type lengthFormatter struct {
+	clockRate int
+}
+
+func (lf *lengthFormatter) ClockRate() int               { return lf.clockRate }
+func (lf *lengthFormatter) FrameDuration() time.Duration { return 0 }
+
+func (lf *lengthFormatter) Packetize(frames [][]byte, ptime, maxPtime time.Duration, maxSize int) ([]FormattedPayload, error) {
+	var payloads []FormattedPayload
+	for i, frame := range frames {
+		if len(frame)+1 > maxSize || len(frame) > 255 {
+			return nil, Error("Frame too long.")
+		}
+		payload := append([]byte{byte(len(frame))}, frame...)
+		payloads = append(payloads, FormattedPayload{Payload: payload, Marker: i == len(frames)-1})
+	}
+	if len(payloads) > 0 {
+		payloads[len(payloads)-1].Samples = 3000
+	}
+	return payloads, nil
+}
+
+func (lf *lengthFormatter) Depacketize(payload []byte) ([][]byte, error) {
+	if len(payload) == 0 || int(payload[0]) != len(payload)-1 {
+		return nil, Error("Bad length prefix.")
+	}
+	return [][]byte{payload[1:]}, nil
+}
+
+func TestPayloadFormatter(t *testing.T) {
+	parseFlags()
+
+	PayloadFormatMap[120] = &PayloadFormat{TypeNumber: 120, MediaType: Video, ClockRate: 90000, Name: "X-LENGTH"}
+	defer delete(PayloadFormatMap, 120)
+	if PayloadFormatMap[120].Formatter() != nil {
+		t.Errorf("Formatter check failed, unregistered format without frames has a formatter\n")
+	}
+	RegisterPayloadFormatter("x-length", func(pf *PayloadFormat) PayloadFormatter {
+		return &lengthFormatter{clockRate: pf.ClockRate}
+	})
+	defer RegisterPayloadFormatter("x-length", nil)
+
+	rs, ct := closeSession(false)
+	str := rs.SsrcStreamOutForIndex(0)
+	str.SetPayloadType(120)
+	next, err := rs.WriteFrames(0, 1000, [][]byte{[]byte("one"), []byte("three")})
+	if err != nil {
+		t.Errorf("WriteFrames with plugin failed: %s\n", err)
+		return
+	}
+	if next != 4000 || len(ct.captureWriter.data) != 2 {
+		t.Errorf("Plugin packetize check failed. Next stamp: %d, packets: %d\n", next, len(ct.captureWriter.data))
+		return
+	}
+	first, _ := NewDataPacketFromBuffer(ct.captureWriter.data[0])
+	rp, _ := NewDataPacketFromBuffer(ct.captureWriter.data[1])
+	if first.Marker() || !rp.Marker() || rp.Timestamp() != first.Timestamp() {
+		t.Errorf("Plugin marker or timestamp check failed\n")
+	}
+	frames, stamps, ok := SplitFrames(rp)
+	if !ok || len(frames) != 1 || !bytes.Equal(frames[0], []byte("three")) || stamps[0] != rp.Timestamp() {
+		t.Errorf("Plugin depacketize check failed\n")
+	}
+	if _, err = rs.WriteFrames(0, 0, [][]byte{make([]byte, 2000)}); err == nil {
+		t.Errorf("Plugin error check failed\n")
+	}
+
+	// The built-in formats use the same interface
+	formatter := PayloadFormatMap[0].Formatter()
+	if formatter == nil || formatter.ClockRate() != 8000 || formatter.FrameDuration() != 10*time.Millisecond {
+		t.Errorf("Built-in formatter check failed\n")
+		return
+	}
+	payloads, _ := formatter.Packetize(make([][]byte, 3), 20*time.Millisecond, 0, maxFramesPayload)
+	if len(payloads) != 2 || payloads[0].Samples != 160 || payloads[1].Samples != 80 {
+		t.Errorf("Built-in packetize check failed\n")
+	}
+	// G.723.1 frames have a fixed duration but two sizes, 24 bytes at 6.3 and 20 at 5.3 kbit/s
+	g723 := PayloadFormatMap[4].Formatter()
+	payloads, _ = g723.Packetize([][]byte{make([]byte, 24), make([]byte, 20)}, 60*time.Millisecond, 0, maxFramesPayload)
+	if len(payloads) != 1 || len(payloads[0].Payload) != 44 || payloads[0].Samples != 480 {
+		t.Errorf("G.723.1 packetize check failed\n")
+	}
+	if _, err = g723.Depacketize(payloads[0].Payload); err == nil {
+		t.Errorf("G.723.1 has no fixed frame size to split by\n")
+	}
+
+	// A registration replaces the built-in formatter of the name
+	RegisterPayloadFormatter("PCMU", func(pf *PayloadFormat) PayloadFormatter {
+		return &lengthFormatter{clockRate: pf.ClockRate}
+	})
+	if _, ok := PayloadFormatMap[0].Formatter().(*lengthFormatter); !ok {
+		t.Errorf("Formatter replace check failed\n")
+	}
+	RegisterPayloadFormatter("PCMU", nil)
+	if _, ok := PayloadFormatMap[0].Formatter().(*frameFormatter); !ok {
+		t.Errorf("Formatter remove check failed\n")
+	}
+}
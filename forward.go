@@ -0,0 +1,210 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// Forwarder implements the TransportRecv interface and relays received RTP and RTCP
+// packets to a set of destinations.
+//
+// A Forwarder sits on top of a receiving transport and uses a TransportWrite module to
+// send the relayed packets, usually the same transport module that receives the packets.
+// The Forwarder does not parse or check the packets, it may however re-write the SSRC of
+// the RTP packets and the SSRCs of the packet senders in RTCP compounds. It never touches the
+// CSRC list, the header extension, the payload or the padding of RTP packets, thus it relays
+// end-to-end encrypted payloads, for example SFrame, byte by byte.
+//
+// If an application registers an upper layer (SetCallUpper) the Forwarder hands the
+// packets to the upper layer after relaying them, otherwise it frees the packets.
+//
+type Forwarder struct {
+	callUpper      TransportRecv
+	transportRecv  TransportRecv
+	transportWrite TransportWrite
+
+	destMutex    sync.Mutex // synchronize activities on the destination and SSRC maps
+	destinations remoteMap
+	destIndex    uint32
+	ssrcMap      map[uint32]uint32
+}
+
+// NewForwarder creates a new forwarder.
+//
+//   tpr - the transport that receives the packets to relay, the function registers the
+//         forwarder as its upper layer
+//   tpw - the transport that sends the relayed packets
+//
+func NewForwarder(tpr TransportRecv, tpw TransportWrite) *Forwarder {
+	fw := new(Forwarder)
+	fw.transportRecv = tpr
+	fw.transportWrite = tpw
+	fw.destinations = make(remoteMap, 2)
+	fw.ssrcMap = make(map[uint32]uint32)
+	tpr.SetCallUpper(fw)
+	return fw
+}
+
+// AddDestination adds the address of an additional destination.
+//
+//   dest - the address of the destination. The transport sends RTP packets to the data
+//          port and RTCP packets to the control port.
+//
+func (fw *Forwarder) AddDestination(dest *Address) (index uint32) {
+	fw.destMutex.Lock()
+	defer fw.destMutex.Unlock()
+
+	fw.destinations[fw.destIndex] = dest
+	index = fw.destIndex
+	fw.destIndex++
+	return
+}
+
+// RemoveDestination removes the address at the specified index.
+//
+func (fw *Forwarder) RemoveDestination(index uint32) {
+	fw.destMutex.Lock()
+	delete(fw.destinations, index)
+	fw.destMutex.Unlock()
+}
+
+// SetSsrcRewrite sets the SSRC the Forwarder uses for relayed packets of SSRC ssrc.
+//
+// The Forwarder re-writes the SSRC of RTP packets and the SSRC of the sender in RTCP packets.
+// Setting newSsrc to the same value as ssrc removes the re-write.
+//
+func (fw *Forwarder) SetSsrcRewrite(ssrc, newSsrc uint32) {
+	fw.destMutex.Lock()
+	if ssrc == newSsrc {
+		delete(fw.ssrcMap, ssrc)
+	} else {
+		fw.ssrcMap[ssrc] = newSsrc
+	}
+	fw.destMutex.Unlock()
+}
+
+// *** The following methods implement the rtp.TransportRecv interface.
+
+// SetCallUpper implements the rtp.TransportRecv SetCallUpper method.
+func (fw *Forwarder) SetCallUpper(upper TransportRecv) {
+	fw.callUpper = upper
+}
+
+// ListenOnTransports implements the rtp.TransportRecv ListenOnTransports method.
+//
+// The Forwarder just forwards this to the receiving transport.
+func (fw *Forwarder) ListenOnTransports() error {
+	return fw.transportRecv.ListenOnTransports()
+}
+
+// OnRecvData implements the rtp.TransportRecv OnRecvData method.
+func (fw *Forwarder) OnRecvData(rp *DataPacket) bool {
+	if rp.inUse < rtpHeaderLength {
+		rp.FreePacket()
+		return false
+	}
+	fw.destMutex.Lock()
+	if newSsrc, ok := fw.ssrcMap[rp.Ssrc()]; ok {
+		rp.SetSsrc(newSsrc)
+	}
+	for _, dest := range fw.destinations {
+		fw.transportWrite.WriteDataTo(rp, dest)
+	}
+	fw.destMutex.Unlock()
+
+	if fw.callUpper != nil {
+		return fw.callUpper.OnRecvData(rp)
+	}
+	rp.FreePacket()
+	return true
+}
+
+// OnRecvCtrl implements the rtp.TransportRecv OnRecvCtrl method.
+func (fw *Forwarder) OnRecvCtrl(rp *CtrlPacket) bool {
+	fw.destMutex.Lock()
+	if len(fw.ssrcMap) > 0 {
+		fw.rewriteCtrl(rp)
+	}
+	for _, dest := range fw.destinations {
+		fw.transportWrite.WriteCtrlTo(rp, dest)
+	}
+	fw.destMutex.Unlock()
+
+	if fw.callUpper != nil {
+		return fw.callUpper.OnRecvCtrl(rp)
+	}
+	rp.FreePacket()
+	return true
+}
+
+// CloseRecv implements the rtp.TransportRecv CloseRecv method.
+//
+// The Forwarder just forwards this to the receiving transport.
+func (fw *Forwarder) CloseRecv() {
+	fw.transportRecv.CloseRecv()
+}
+
+// SetEndChannel implements the rtp.TransportRecv SetEndChannel method.
+//
+// The receiving transport signals directly to the channel.
+func (fw *Forwarder) SetEndChannel(ch TransportEnd) {
+	fw.transportRecv.SetEndChannel(ch)
+}
+
+// *** Local functions and methods.
+
+// rewriteCtrl walks through the RTCP compound and re-writes the SSRCs of the packet
+// senders, the SDES chunks, and the BYE SSRC lists. The caller holds destMutex.
+func (fw *Forwarder) rewriteCtrl(rp *CtrlPacket) {
+	for offset := 0; offset+rtcpHeaderLength+rtcpSsrcLength <= rp.inUse; {
+		pktLen := int(rp.Length(offset)+1) * 4
+		if offset+pktLen > rp.inUse {
+			return
+		}
+		switch rp.Type(offset) {
+		case RtcpSdes:
+			// each chunk starts with its SSRC, find the chunks via their length
+			chunkOffset := offset + rtcpHeaderLength
+			for i := 0; i < rp.Count(offset); i++ {
+				chunk := rp.toSdesChunk(chunkOffset, offset+pktLen-chunkOffset)
+				chunkLen, ok := chunk.chunkLen()
+				if !ok {
+					break
+				}
+				fw.rewriteSsrcAt(rp, chunkOffset)
+				chunkOffset += chunkLen
+			}
+		case RtcpBye:
+			for i := 0; i < rp.Count(offset) && rtcpHeaderLength+(i+1)*4 <= pktLen; i++ {
+				fw.rewriteSsrcAt(rp, offset+rtcpHeaderLength+i*4)
+			}
+		default:
+			fw.rewriteSsrcAt(rp, offset+rtcpHeaderLength)
+		}
+		offset += pktLen
+	}
+}
+
+func (fw *Forwarder) rewriteSsrcAt(rp *CtrlPacket, offset int) {
+	if newSsrc, ok := fw.ssrcMap[binary.BigEndian.Uint32(rp.buffer[offset:])]; ok {
+		binary.BigEndian.PutUint32(rp.buffer[offset:], newSsrc)
+	}
+}
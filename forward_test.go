@@ -0,0 +1,170 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// e2eOffset is the offset of the payload of the packets that e2ePacket builds.
+const e2eOffset = rtpHeaderLength + 2*4 + 8
+
+// e2ePacket builds a RTP packet with two CSRCs, a header extension, a payload that looks
+// like an end-to-end encrypted frame, and padding. Relays must not change any byte after the
+// SSRC.
+func e2ePacket(ssrc uint32, seq uint16) []byte {
+	raw := []byte{
+		version2Bit | paddingBit | extensionBit | 2, 96, 0, 0,
+		0, 0, 0, 0, // timestamp
+		0, 0, 0, 0, // SSRC
+		0x0a, 0x0b, 0x0c, 0x0d, 0x11, 0x12, 0x13, 0x14, // CSRC list
+		0xbe, 0xde, 0, 1, 0x30, 0xaa, 0, 0, // one-byte extension, element ID 3
+	}
+	binary.BigEndian.PutUint16(raw[2:], seq)
+	binary.BigEndian.PutUint32(raw[4:], 160*uint32(seq))
+	binary.BigEndian.PutUint32(raw[8:], ssrc)
+	for i := 0; i < 37; i++ {
+		raw = append(raw, byte(i*97+int(seq)))
+	}
+	return append(raw, 0xff, 0, 3) // padding, the first octet must not matter
+}
+
+func e2eDataPacket(ssrc uint32, seq uint16) *DataPacket {
+	rp := newDataPacket()
+	rp.inUse = copy(rp.buffer, e2ePacket(ssrc, seq))
+	rp.fromAddr = Address{IpAddr: net.IPv4(10, 0, 0, 1), DataPort: 5220}
+	return rp
+}
+
+// checkPassThrough compares a relayed packet to the original of e2ePacket. The relay may only
+// change the fixed header, header is the expected fixed header.
+func checkPassThrough(t *testing.T, label string, got, orig []byte, header []byte) {
+	if len(got) != len(orig) {
+		t.Errorf("%s: relayed packet has %d octets, expected %d.\n", label, len(got), len(orig))
+		return
+	}
+	if !bytes.Equal(got[0:rtpHeaderLength], header) {
+		t.Errorf("%s: relayed header % x, expected % x.\n", label, got[0:rtpHeaderLength], header)
+	}
+	if !bytes.Equal(got[rtpHeaderLength:], orig[rtpHeaderLength:]) {
+		t.Errorf("%s: CSRC list, extension, payload or padding changed.\n", label)
+	}
+}
+
+func TestForwarderPassThrough(t *testing.T) {
+	parseFlags()
+
+	recv, upper := new(teeConsumer), new(teeConsumer)
+	cw := new(captureWriter)
+	fw := NewForwarder(recv, cw)
+	fw.SetCallUpper(upper)
+	fw.AddDestination(&Address{IpAddr: net.IPv4(10, 0, 0, 2), DataPort: 5222, CtrlPort: 5223})
+	fw.AddDestination(&Address{IpAddr: net.IPv4(10, 0, 0, 3), DataPort: 5222, CtrlPort: 5223})
+	fw.SetSsrcRewrite(0x01020304, 0x05060708)
+
+	orig := e2ePacket(0x01020304, 7)
+	fw.OnRecvData(e2eDataPacket(0x01020304, 7))
+
+	header := e2ePacket(0x05060708, 7)[0:rtpHeaderLength]
+	if len(cw.data) != 2 || len(upper.data) != 1 {
+		t.Errorf("Forwarder relayed %d packets, expected 2.\n", len(cw.data))
+		return
+	}
+	for _, data := range cw.data {
+		checkPassThrough(t, "Forwarder", data, orig, header)
+	}
+	up := upper.data[0]
+	checkPassThrough(t, "Forwarder upper layer", up.buffer[0:up.inUse], orig, header)
+
+	// The abs-send-time element of a SRTP transport without keys goes into a copy, the CSRC
+	// list and the payload follow the new extension unchanged.
+	cw = new(captureWriter)
+	tp, _ := NewTransportSRTP(nil, cw, nil, nil)
+	tp.SetAbsSendTime(5)
+	fw = NewForwarder(new(teeConsumer), tp)
+	fw.SetCallUpper(upper)
+	fw.AddDestination(&Address{IpAddr: net.IPv4(10, 0, 0, 2), DataPort: 5222, CtrlPort: 5223})
+	fw.AddDestination(&Address{IpAddr: net.IPv4(10, 0, 0, 3), DataPort: 5222, CtrlPort: 5223})
+	fw.OnRecvData(e2eDataPacket(0x01020304, 8))
+
+	orig = e2ePacket(0x01020304, 8)
+	up = upper.data[1]
+	checkPassThrough(t, "SRTP relay upper layer", up.buffer[0:up.inUse], orig, orig[0:rtpHeaderLength])
+	for _, data := range cw.data {
+		rp, _ := NewDataPacketFromBuffer(data)
+		if len(rp.ExtensionElement(5)) != 3 || !bytes.Equal(rp.ExtensionElement(3), []byte{0xaa}) {
+			t.Errorf("SRTP relay: abs-send-time element missing or extension damaged.\n")
+		}
+		csrc := rp.CsrcList()
+		if len(csrc) != 2 || csrc[0] != 0x0a0b0c0d || csrc[1] != 0x11121314 {
+			t.Errorf("SRTP relay: CSRC list changed to %x.\n", csrc)
+		}
+		payOffset := rtpHeaderLength + 2*4 + rp.ExtensionLength()
+		if !bytes.Equal(data[payOffset:], orig[e2eOffset:]) {
+			t.Errorf("SRTP relay: payload or padding changed.\n")
+		}
+	}
+}
+
+func TestSetExtensionKeepsCsrcList(t *testing.T) {
+	parseFlags()
+
+	rp := newDataPacket()
+	rp.SetCsrcList([]uint32{0x0a0b0c0d, 0x11121314})
+	rp.SetPayload([]byte{1, 2, 3, 4, 5})
+	rp.SetExtension([]byte{0xbe, 0xde, 0, 1, 0x30, 0xaa, 0, 0})
+
+	csrc := rp.CsrcList()
+	if len(csrc) != 2 || csrc[0] != 0x0a0b0c0d || csrc[1] != 0x11121314 {
+		t.Errorf("SetExtension changed the CSRC list to %x.\n", csrc)
+	}
+	if !bytes.Equal(rp.Payload(), []byte{1, 2, 3, 4, 5}) {
+		t.Errorf("SetExtension changed the payload to % x.\n", rp.Payload())
+	}
+}
+
+func TestForwarderMalformedSdes(t *testing.T) {
+	parseFlags()
+
+	cw := new(captureWriter)
+	fw := NewForwarder(new(teeConsumer), cw)
+	fw.SetCallUpper(new(teeConsumer))
+	fw.AddDestination(&Address{IpAddr: net.IPv4(10, 0, 0, 2), DataPort: 5222, CtrlPort: 5223})
+	fw.SetSsrcRewrite(1, 0x05060708)
+
+	malformed := [][]byte{
+		{0x81, RtcpSdes, 0, 2, 0, 0, 0, 1, 1, 2, 'a', 'b'},                       // no SdesEnd, the items end at the packet end
+		{0x81, RtcpSdes, 0, 2, 0, 0, 0, 1, 1, 5, 'a', 'b'},                       // the item exceeds the packet
+		{0x81, RtcpSdes, 0, 2, 0, 0, 0, 1, 1, 1, 'a', 2},                         // the item type at the packet end
+		{0x82, RtcpSdes, 0, 3, 0, 0, 0, 1, 1, 1, 'a', 0, 0, 0, 0, 1},             // the second chunk is truncated
+		{0x81, RtcpSdes, 0, 3, 0, 0, 0, 1, 1, 1, 'a', 0, 0, 0, 0, 0, 1, 0, 1, 2}, // a trailing item without padding
+	}
+	for i, buf := range malformed {
+		rp, _ := NewCtrlPacketFromBuffer(buf)
+		rp.fromAddr = Address{IpAddr: net.IPv4(10, 0, 0, 1), CtrlPort: 5221}
+		fw.OnRecvCtrl(rp)
+		if len(cw.ctrl) != i+1 {
+			t.Errorf("malformed SDES %d was not relayed\n", i)
+			return
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"time"
+)
+
+// SequenceGap describes packets an input stream misses when the packet after them arrives.
+// Reordered packets and retransmissions may still fill the gap.
+type SequenceGap struct {
+	Ssrc         uint32
+	Index        uint32    // index of the input stream
+	FirstMissing uint16    // sequence number of the first missing packet
+	Count        int       // number of missing packets
+	Time         time.Time // arrival time of the packet after the gap
+	StampBefore  uint32    // timestamp of the packet before the gap
+	StampAfter   uint32    // timestamp of the packet after the gap
+}
+
+// GapHandler receives the sequence gaps of the session's input streams. The session calls it
+// while it processes the packet after the gap, thus the handler must not block.
+type GapHandler func(gap SequenceGap)
+
+// SetGapHandler sets the handler of sequence gaps, nil removes it. Independent of the handler
+// the session signals each gap with a SequenceGapData control event, its Gap field holds the
+// details. Set the handler before the session starts.
+//
+//   handler - the gap handler
+//
+func (rs *Session) SetGapHandler(handler GapHandler) {
+	rs.gapHandler = handler
+}
+
+// *** Local functions and methods.
+
+// checkGap reports a gap before a recorded packet. The caller holds the stream's recvMutex and
+// passes the highest sequence number before it recorded the packet.
+func (rs *Session) checkGap(str *SsrcStream, strIdx uint32, prevMax uint16, reset bool, rp *DataPacket, now int64) {
+	seq := rp.Sequence()
+	if reset || !str.gapStampValid {
+		str.gapStamp, str.gapStampValid = rp.Timestamp(), true
+		return
+	}
+	step := seq - prevMax
+	if step == 0 || step >= maxDropout {
+		return // a reordered packet or a retransmission
+	}
+	if step > 1 {
+		gap := &SequenceGap{Ssrc: str.ssrc, Index: strIdx, FirstMissing: prevMax + 1, Count: int(step - 1),
+			Time: time.Unix(0, now), StampBefore: str.gapStamp, StampAfter: rp.Timestamp()}
+		if rs.gapHandler != nil {
+			rs.gapHandler(*gap)
+		}
+		ctrlEv := newCrtlEvent(SequenceGapData, str.ssrc, strIdx)
+		ctrlEv.Gap = gap
+		ctrlEv.Context = str.Context()
+		select {
+		case rs.ctrlEventChan <- []*CtrlEvent{ctrlEv}:
+		default:
+		}
+	}
+	str.gapStamp = rp.Timestamp()
+}
@@ -0,0 +1,64 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSequenceGap(t *testing.T) {
+	parseFlags()
+
+	rs, _ := drainedSession(t)
+	events := rs.CreateCtrlEventChan()
+	var gaps []SequenceGap
+	rs.SetGapHandler(func(gap SequenceGap) { gaps = append(gaps, gap) })
+
+	// The session's timestamps have a random offset, the packets advance them by 160 per sequence number
+	from := &Address{IpAddr: net.IPv4(127, 0, 0, 1), DataPort: 6002, CtrlPort: 6003}
+	for _, seq := range []uint16{1, 2, 3, 6, 4, 7, 10} {
+		quirkData(rs, 0x0a0b0c0d, seq, from)
+	}
+	if len(gaps) != 2 {
+		t.Errorf("Gap count check failed: %+v\n", gaps)
+		return
+	}
+	if g := gaps[0]; g.Ssrc != 0x0a0b0c0d || g.FirstMissing != 4 || g.Count != 2 || g.StampAfter-g.StampBefore != 480 {
+		t.Errorf("First gap check failed: %+v\n", g)
+	}
+	if g := gaps[1]; g.FirstMissing != 8 || g.Count != 2 || g.StampBefore-gaps[0].StampAfter != 160 {
+		t.Errorf("Second gap check failed: %+v\n", g)
+	}
+
+	var gapEvents int
+	for len(events) > 0 {
+		for _, ev := range <-events {
+			if ev.EventType == SequenceGapData {
+				gapEvents++
+				if ev.Gap == nil || ev.Gap.Count != 2 {
+					t.Errorf("Gap event check failed: %+v\n", ev)
+				}
+			}
+		}
+	}
+	if gapEvents != 2 {
+		t.Errorf("Gap event count check failed: %d\n", gapEvents)
+	}
+}
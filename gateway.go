@@ -0,0 +1,244 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Gateway relays a multicast RTP session to a dynamic set of unicast subscribers, for example
+// for last-mile networks that block multicast.
+//
+// The Gateway is a Translator: side A joins the multicast group, side B sends to the unicast
+// subscribers. The Gateway relays the RTP and RTCP packets of the group to all subscribers and
+// the RTCP packets of the subscribers to the group, thus the multicast senders see the receiver
+// reports of the subscribers. Packets from unicast addresses that are not subscribed are dropped.
+//
+// The Gateway keeps the latest receiver reports of each subscriber. A subscriber that sends a
+// BYE is removed. If SubscriberTimeout is not zero then the Gateway also removes subscribers
+// that did not send RTCP packets for this time.
+//
+type Gateway struct {
+	*Translator
+	SubscriberTimeout time.Duration
+
+	group       *Address
+	subMutex    sync.Mutex
+	subscribers map[string]*gatewaySubscriber
+	stop        chan bool
+}
+
+// SubscriberInfo holds the state of a subscriber as returned by Gateway.Subscribers.
+type SubscriberInfo struct {
+	Address
+	Subscribed, LastRtcp time.Time
+	Reports              []ReportBlock // the report blocks of the last RR or SR from the subscriber
+}
+
+type gatewaySubscriber struct {
+	SubscriberInfo
+	index uint32 // destination index of side B
+}
+
+// gatewayUpper is the upper layer of the Gateway's unicast side, it processes the RTCP
+// packets of the subscribers.
+type gatewayUpper struct {
+	gw *Gateway
+}
+
+// NewGateway creates a new multicast to unicast gateway.
+//
+//   group, groupPort - the multicast group and its RTP data port
+//   ifi              - the network interface to join the group on, nil selects the default
+//   local, localPort - the local address and RTP data port of the unicast side
+//
+func NewGateway(group *net.IPAddr, groupPort int, ifi *net.Interface, local *net.IPAddr, localPort int) (*Gateway, error) {
+	mc, err := NewTransportUDPMulticast(group, groupPort, ifi)
+	if err != nil {
+		return nil, err
+	}
+	uc, _ := NewTransportUDP(local, localPort)
+
+	gw := &Gateway{Translator: NewTranslator(mc, mc, uc, uc)}
+	gw.group = &Address{group.IP, groupPort, groupPort + 1}
+	gw.subscribers = make(map[string]*gatewaySubscriber)
+	gw.SideA.AddDestination(gw.group)
+	gw.SideB.AcceptFrom = gw.isSubscriber
+	gw.SideB.SetCallUpper(&gatewayUpper{gw})
+	return gw, nil
+}
+
+// Subscribe adds a unicast subscriber. The Gateway sends RTP packets to the data port and
+// RTCP packets to the control port of the address. Subscribing an address again has no effect.
+//
+func (gw *Gateway) Subscribe(addr *Address) {
+	key := gatewayKey(addr.IpAddr, addr.DataPort)
+	gw.subMutex.Lock()
+	defer gw.subMutex.Unlock()
+
+	if _, ok := gw.subscribers[key]; ok {
+		return
+	}
+	now := time.Now()
+	sub := &gatewaySubscriber{SubscriberInfo: SubscriberInfo{Address: *addr, Subscribed: now, LastRtcp: now}}
+	sub.index = gw.SideB.AddDestination(&sub.Address)
+	gw.subscribers[key] = sub
+}
+
+// Unsubscribe removes a unicast subscriber.
+func (gw *Gateway) Unsubscribe(addr *Address) {
+	gw.subMutex.Lock()
+	gw.removeSubscriber(gatewayKey(addr.IpAddr, addr.DataPort))
+	gw.subMutex.Unlock()
+}
+
+// Subscribers returns the state of all subscribers.
+func (gw *Gateway) Subscribers() (subs []SubscriberInfo) {
+	gw.subMutex.Lock()
+	defer gw.subMutex.Unlock()
+
+	for _, sub := range gw.subscribers {
+		info := sub.SubscriberInfo
+		info.Reports = append([]ReportBlock(nil), sub.Reports...)
+		subs = append(subs, info)
+	}
+	return
+}
+
+// ListenOnTransports starts the transports of both sides and, if SubscriberTimeout is not
+// zero, the expiry of silent subscribers.
+func (gw *Gateway) ListenOnTransports() error {
+	if err := gw.Translator.ListenOnTransports(); err != nil {
+		return err
+	}
+	if gw.SubscriberTimeout > 0 {
+		gw.stop = make(chan bool)
+		go gw.expireSubscribers(gw.SubscriberTimeout, gw.stop)
+	}
+	return nil
+}
+
+// CloseRecv closes the transports of both sides and stops the expiry of subscribers.
+func (gw *Gateway) CloseRecv() {
+	if gw.stop != nil {
+		close(gw.stop)
+		gw.stop = nil
+	}
+	gw.Translator.CloseRecv()
+}
+
+// *** The following methods implement the rtp.TransportRecv interface for the unicast side.
+
+func (gu *gatewayUpper) SetCallUpper(upper TransportRecv) {}
+func (gu *gatewayUpper) ListenOnTransports() error        { return nil }
+func (gu *gatewayUpper) CloseRecv()                       {}
+func (gu *gatewayUpper) SetEndChannel(ch TransportEnd)    {}
+
+func (gu *gatewayUpper) OnRecvData(rp *DataPacket) bool {
+	rp.FreePacket()
+	return true
+}
+
+// OnRecvCtrl records the report blocks of the subscriber and removes the subscriber if the
+// compound contains a BYE.
+func (gu *gatewayUpper) OnRecvCtrl(rp *CtrlPacket) bool {
+	gw := gu.gw
+	gw.subMutex.Lock()
+	defer gw.subMutex.Unlock()
+	defer rp.FreePacket()
+
+	key, sub := gw.lookupSubscriber(rp.fromAddr)
+	if sub == nil {
+		return false
+	}
+	sub.LastRtcp = time.Now()
+	for offset := 0; offset+rtcpHeaderLength+rtcpSsrcLength <= rp.inUse; {
+		pktLen := int(rp.Length(offset)+1) * 4
+		if offset+pktLen > rp.inUse {
+			break
+		}
+		switch rp.Type(offset) {
+		case RtcpSR, RtcpRR:
+			sub.Reports = rp.ReportBlocks(offset)
+		case RtcpBye:
+			gw.removeSubscriber(key)
+			return true
+		}
+		offset += pktLen
+	}
+	return true
+}
+
+// *** Local functions and methods.
+
+func gatewayKey(ip net.IP, port int) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// lookupSubscriber finds the subscriber for the sender's address of a received packet. The
+// caller holds subMutex.
+func (gw *Gateway) lookupSubscriber(from Address) (key string, sub *gatewaySubscriber) {
+	if from.DataPort != 0 {
+		key = gatewayKey(from.IpAddr, from.DataPort)
+		return key, gw.subscribers[key]
+	}
+	for key, sub = range gw.subscribers {
+		if sub.IpAddr.Equal(from.IpAddr) && sub.CtrlPort == from.CtrlPort {
+			return
+		}
+	}
+	return "", nil
+}
+
+func (gw *Gateway) isSubscriber(from Address) bool {
+	gw.subMutex.Lock()
+	defer gw.subMutex.Unlock()
+	_, sub := gw.lookupSubscriber(from)
+	return sub != nil
+}
+
+// removeSubscriber removes the subscriber and its destination. The caller holds subMutex.
+func (gw *Gateway) removeSubscriber(key string) {
+	if sub, ok := gw.subscribers[key]; ok {
+		gw.SideB.RemoveDestination(sub.index)
+		delete(gw.subscribers, key)
+	}
+}
+
+func (gw *Gateway) expireSubscribers(timeout time.Duration, stop chan bool) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			gw.subMutex.Lock()
+			for key, sub := range gw.subscribers {
+				if now.Sub(sub.LastRtcp) > timeout {
+					gw.removeSubscriber(key)
+				}
+			}
+			gw.subMutex.Unlock()
+		}
+	}
+}
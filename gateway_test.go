@@ -0,0 +1,101 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+)
+
+func gatewayRR(from *Address, ssrc, reportSsrc uint32, bye bool) *CtrlPacket {
+	rc, offset := newCtrlPacket()
+	rc.SetType(0, RtcpRR)
+	rc.SetCount(0, 1)
+	rc.addHeaderSsrc(offset, ssrc)
+	rr, _ := rc.newRecvReport()
+	rr.setSsrc(reportSsrc)
+	rc.SetLength(0, uint16(rc.inUse/4-1))
+	if bye {
+		offset = rc.inUse
+		rc.inUse += 8
+		rc.buffer[offset] = version2Bit
+		rc.SetType(offset, RtcpBye)
+		rc.SetCount(offset, 1)
+		rc.SetSsrc(offset, ssrc)
+		rc.SetLength(offset, 1)
+	}
+	rc.fromAddr = Address{from.IpAddr, 0, from.CtrlPort}
+	return rc
+}
+
+func TestGateway(t *testing.T) {
+	parseFlags()
+
+	group, _ := net.ResolveIPAddr("ip", "239.1.2.3")
+	local, _ := net.ResolveIPAddr("ip", "127.0.0.1")
+	gw, err := NewGateway(group, 5004, nil, local, 6000)
+	if err != nil {
+		t.Errorf("NewGateway failed: %s\n", err)
+		return
+	}
+	toGroup, toSubs := new(captureWriter), new(captureWriter)
+	gw.SideA.transportWrite = toGroup
+	gw.SideB.transportWrite = toSubs
+
+	sub1 := &Address{net.IPv4(10, 0, 0, 1), 7000, 7001}
+	sub2 := &Address{net.IPv4(10, 0, 0, 2), 7000, 7001}
+	gw.Subscribe(sub1)
+	gw.Subscribe(sub2)
+	gw.Subscribe(sub1)
+
+	rp := newDataPacket()
+	rp.SetSsrc(0x01020304)
+	gw.SideA.OnRecvData(rp)
+	if len(toSubs.data) != 2 {
+		t.Errorf("Gateway fan-out check failed. Expected: 2 packets, got: %d\n", len(toSubs.data))
+	}
+
+	// RTCP of a subscriber goes to the group, RTCP of other addresses is dropped
+	gw.SideB.OnRecvCtrl(gatewayRR(sub1, 0x0a0a0a0a, 0x01020304, false))
+	gw.SideB.OnRecvCtrl(gatewayRR(&Address{net.IPv4(10, 0, 0, 9), 0, 7001}, 0x0b0b0b0b, 0x01020304, false))
+	if len(toGroup.ctrl) != 1 {
+		t.Errorf("Gateway RTCP relay check failed. Expected: 1 packet, got: %d\n", len(toGroup.ctrl))
+	}
+	for _, sub := range gw.Subscribers() {
+		if sub.IpAddr.Equal(sub1.IpAddr) && (len(sub.Reports) != 1 || sub.Reports[0].Ssrc != 0x01020304) {
+			t.Errorf("Gateway subscriber report check failed. Got: %+v\n", sub.Reports)
+		}
+	}
+
+	// BYE removes the subscriber
+	gw.SideB.OnRecvCtrl(gatewayRR(sub2, 0x0c0c0c0c, 0x01020304, true))
+	gw.Unsubscribe(sub1)
+	if subs := gw.Subscribers(); len(subs) != 0 {
+		t.Errorf("Gateway unsubscribe check failed. Remaining: %d\n", len(subs))
+	}
+	rp = newDataPacket()
+	gw.SideA.OnRecvData(rp)
+	if len(toSubs.data) != 2 {
+		t.Errorf("Gateway relays to removed subscribers\n")
+	}
+
+	if _, err = NewGateway(local, 5004, nil, local, 6000); err == nil {
+		t.Errorf("Gateway must reject a unicast group address\n")
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+// Limits of the sequence number distance the header repair accepts as reordering or loss.
+const (
+	repairMaxMisorder = 100  // older packets up to this distance are reordered packets
+	repairMaxDropout  = 3000 // newer packets up to this distance follow a loss
+)
+
+// HeaderRepairStats counts the repairs of the packets of a sender, see SetHeaderRepair.
+type HeaderRepairStats struct {
+	SequenceRepairs  uint32 // packets with a repeated or jumping sequence number that got a new one
+	TimestampRepairs uint32 // packets with a timestamp before the previous one that got a new one
+	Duplicates       uint32 // dropped packets with the sequence number and timestamp of the previous packet
+}
+
+// SetHeaderRepair enables the repair of the RTP headers of all packets this side relays. Buggy
+// upstream encoders repeat sequence numbers, restart them without a new SSRC or let the
+// timestamps run backwards, and receivers then drop the packets or stall their playout.
+//
+// With the repair on, the side renumbers a sender's packets after a repeated sequence number
+// or a jump beyond the usual reordering and loss distances and moves timestamps that run
+// backwards to the previous timestamp plus the last timestamp increment. It keeps the
+// distances of later packets, thus losses and reordering stay visible to the receivers, and
+// drops exact duplicates. The side shifts the RTP timestamps of the sender's SR like the
+// packets and subtracts the dropped duplicates from its counts. Receiver reports and NACKs of
+// the receivers refer to the repaired sequence numbers. The side sends the repaired header,
+// the upper layer gets the packet unchanged.
+//
+//   on - true enables the repair, false disables it and clears the counters
+//
+func (ts *TranslatorSide) SetHeaderRepair(on bool) {
+	ts.sideMutex.Lock()
+	if on && ts.repairs == nil {
+		ts.repairs = make(map[uint32]*headerRepair)
+	} else if !on {
+		ts.repairs = nil
+	}
+	ts.sideMutex.Unlock()
+}
+
+// HeaderRepairStats returns the repair counters of the sender, false if the side does not
+// repair the headers or received no packet of the sender.
+func (ts *TranslatorSide) HeaderRepairStats(ssrc uint32) (HeaderRepairStats, bool) {
+	ts.sideMutex.Lock()
+	defer ts.sideMutex.Unlock()
+	hr, ok := ts.repairs[ssrc]
+	if !ok {
+		return HeaderRepairStats{}, false
+	}
+	return hr.stats, true
+}
+
+// *** Local functions and methods.
+
+// headerRepair maps the sequence numbers and timestamps of a sender to the repaired ones.
+type headerRepair struct {
+	lastIn, lastOut     uint16 // sequence numbers of the latest packet
+	lastInTs, lastOutTs uint32 // timestamps of the latest packet
+	seqOffset           uint16 // the repaired minus the received sequence number
+	tsOffset            uint32 // the repaired minus the received timestamp
+	tsStep              uint32 // the last timestamp increment
+	stats               HeaderRepairStats
+}
+
+func newHeaderRepair(seq uint16, stamp uint32) *headerRepair {
+	return &headerRepair{lastIn: seq, lastOut: seq, lastInTs: stamp, lastOutTs: stamp}
+}
+
+// repair returns the repaired sequence number and timestamp of the next packet, false if the
+// packet is a duplicate.
+func (hr *headerRepair) repair(seq uint16, stamp uint32) (uint16, uint32, bool) {
+	switch d := int16(seq - hr.lastIn); {
+	case d == 0 && stamp == hr.lastInTs:
+		hr.stats.Duplicates++
+		return 0, 0, false
+	case d < 0 && d > -repairMaxMisorder:
+		return seq + hr.seqOffset, stamp + hr.tsOffset, true // reordered, keeps the state
+	case d <= 0 || d > repairMaxDropout:
+		hr.seqOffset = hr.lastOut + 1 - seq
+		hr.stats.SequenceRepairs++
+	}
+	outSeq, outTs := seq+hr.seqOffset, stamp+hr.tsOffset
+	if int32(outTs-hr.lastOutTs) < 0 {
+		outTs = hr.lastOutTs + hr.tsStep
+		hr.tsOffset = outTs - stamp
+		hr.stats.TimestampRepairs++
+	} else if outTs != hr.lastOutTs {
+		hr.tsStep = outTs - hr.lastOutTs
+	}
+	hr.lastIn, hr.lastOut, hr.lastInTs, hr.lastOutTs = seq, outSeq, stamp, outTs
+	return outSeq, outTs, true
+}
+
+// repairHeader repairs the header of a packet before the side relays it. It returns false if
+// the side must drop the packet. The caller holds sideMutex and restores the header with the
+// returned sequence number and timestamp after relaying.
+func (ts *TranslatorSide) repairHeader(rp *DataPacket) (seq uint16, stamp uint32, ok bool) {
+	ssrc := rp.Ssrc()
+	seq, stamp = rp.Sequence(), rp.Timestamp()
+	hr := ts.repairs[ssrc]
+	if hr == nil {
+		ts.repairs[ssrc] = newHeaderRepair(seq, stamp)
+		return seq, stamp, true
+	}
+	outSeq, outTs, ok := hr.repair(seq, stamp)
+	if !ok {
+		drops := ts.drops(ssrc)
+		drops.packets++
+		drops.octets += uint32(len(rp.Payload()))
+		return seq, stamp, false
+	}
+	rp.SetSequence(outSeq)
+	rp.SetTimestamp(outTs)
+	return seq, stamp, true
+}
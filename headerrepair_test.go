@@ -0,0 +1,105 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHeaderRepair(t *testing.T) {
+	parseFlags()
+
+	// the sequence numbers and timestamps of the received packets and of the repaired ones
+	in := []struct {
+		seq   uint16
+		stamp uint32
+	}{
+		{10, 1000}, {11, 1160}, {11, 1320}, // repeated sequence number
+		{13, 1640}, {12, 1480}, // loss of 12, then reordered
+		{14, 1640}, {14, 1640}, // duplicate
+		{5000, 1800}, // encoder restart
+		{5001, 200},  // timestamps run backwards
+		{5002, 360},
+	}
+	expect := []struct {
+		seq   uint16
+		stamp uint32
+		ok    bool
+	}{
+		{10, 1000, true}, {11, 1160, true}, {12, 1320, true},
+		{14, 1640, true}, {13, 1480, true},
+		{15, 1640, true}, {0, 0, false},
+		{16, 1800, true},
+		{17, 1960, true},
+		{18, 2120, true},
+	}
+	hr := newHeaderRepair(in[0].seq, in[0].stamp)
+	for i := 1; i < len(in); i++ {
+		seq, stamp, ok := hr.repair(in[i].seq, in[i].stamp)
+		if ok != expect[i].ok || (ok && (seq != expect[i].seq || stamp != expect[i].stamp)) {
+			t.Errorf("Repair %d check failed. Expected: %d/%d, got: %d/%d, %v\n", i, expect[i].seq, expect[i].stamp, seq, stamp, ok)
+		}
+	}
+	if hr.stats.SequenceRepairs != 2 || hr.stats.TimestampRepairs != 1 || hr.stats.Duplicates != 1 {
+		t.Errorf("Stats check failed: %+v\n", hr.stats)
+	}
+}
+
+func TestTranslatorHeaderRepair(t *testing.T) {
+	parseFlags()
+
+	recvA, recvB := new(teeConsumer), new(teeConsumer)
+	writeA, writeB := new(captureWriter), new(captureWriter)
+	tr := NewTranslator(recvA, writeA, recvB, writeB)
+	tr.SideB.AddDestination(&Address{net.IPv4(10, 0, 0, 2), 5222, 5223})
+	tr.SideB.SetHeaderRepair(true)
+	upper := new(teeConsumer)
+	tr.SideA.SetCallUpper(upper)
+
+	for i, seq := range []uint16{1, 2, 2, 3} {
+		rp := newDataPacket()
+		rp.SetSsrc(0x01020304)
+		rp.SetSequence(seq)
+		rp.SetTimestamp(uint32(i) * 160)
+		rp.SetPayload(make([]byte, 10))
+		tr.SideA.OnRecvData(rp)
+	}
+	if len(writeB.data) != 4 {
+		t.Errorf("Relay check failed, got: %d packets\n", len(writeB.data))
+		return
+	}
+	for i, buf := range writeB.data {
+		rp, _ := NewDataPacketFromBuffer(buf)
+		if rp.Sequence() != uint16(i+1) {
+			t.Errorf("Repaired sequence check failed. Expected: %d, got: %d\n", i+1, rp.Sequence())
+		}
+		rp.FreePacket()
+	}
+	if upper.data[2].Sequence() != 2 || upper.data[3].Sequence() != 3 {
+		t.Errorf("Upper layer must get the received header\n")
+	}
+	if stats, ok := tr.SideB.HeaderRepairStats(0x01020304); !ok || stats.SequenceRepairs != 1 {
+		t.Errorf("HeaderRepairStats check failed: %+v\n", stats)
+	}
+	tr.SideB.SetHeaderRepair(false)
+	if _, ok := tr.SideB.HeaderRepairStats(0x01020304); ok {
+		t.Errorf("Disabled repair must have no stats\n")
+	}
+}
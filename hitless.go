@@ -0,0 +1,338 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the hitless merge of redundant multicast legs, SMPTE ST 2022-7.
+ */
+
+import (
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	hitlessWindow     = 1024 // the sequence numbers a stream tracks, a power of 2
+	hitlessDropout    = 3000 // a larger backward jump is a restarted sender
+	hitlessCtrlHashes = 64   // the compound RTCP packets the merge remembers
+	maxHitlessStreams = 256
+	maxHitlessLegs    = 32
+)
+
+// HitlessLegStats holds the counters of one leg of a HitlessMerge.
+type HitlessLegStats struct {
+	Received   uint64 // RTP packets the leg received
+	Delivered  uint64 // RTP packets the leg delivered before the other legs
+	Duplicates uint64 // RTP packets another leg delivered before
+	Late       uint64 // RTP packets older than the merge window, dropped
+	Missing    uint64 // RTP packets other legs delivered and the leg did not receive in the window
+	LastPacket int64  // time in nanoseconds of the leg's last RTP or RTCP packet, 0 if none
+}
+
+// HitlessMerge is a receive transport layer that merges the packets of several redundant
+// receive transports, the legs, into one stream without duplicates, like the seamless
+// protection switching of SMPTE ST 2022-7.
+//
+// The sender sends the same packets over independent networks, the receiver joins the
+// multicast group on one interface per network, see NewMulticastLegs. The merge forwards the
+// first arriving packet of each SSRC and sequence number to the upper layer and drops the
+// copies of the other legs, a packet lost on one leg arrives from another one without a gap.
+// Packets older than the merge window of 1024 sequence numbers are dropped. The merge also
+// drops the copies of compound RTCP packets.
+//
+// The legs receive the sender's packets from different source addresses. The merge replaces
+// the source address of a packet with the address of the first packet of its SSRC, thus the
+// Session sees one address per stream.
+//
+// The per leg counters show the health of the networks, a leg with Missing packets lost
+// packets that another leg delivered, see Stats.
+//
+type HitlessMerge struct {
+	callUpper TransportRecv
+	legs      []*hitlessLeg
+
+	mutex      sync.Mutex // serializes the legs, the upper layer receives one packet at a time
+	stats      []HitlessLegStats
+	streams    map[uint32]*hitlessStream
+	ctrlHashes [hitlessCtrlHashes]uint64
+	ctrlNext   int
+	endUpper   TransportEnd
+}
+
+// hitlessLeg is the upper layer of one leg, it tags the packets with the leg's index.
+type hitlessLeg struct {
+	merge         *HitlessMerge
+	idx           int
+	transportRecv TransportRecv
+	end           TransportEnd
+}
+
+// hitlessStream holds the sequence numbers that the legs delivered for one SSRC.
+type hitlessStream struct {
+	from     Address // the source address the upper layers see
+	highest  int64   // the extended highest sequence number
+	lastRecv int64
+	seqs     [hitlessWindow]int64  // the extended sequence number of the slot's packet, 0 if empty
+	legs     [hitlessWindow]uint32 // the legs that delivered the slot's packet
+}
+
+// NewHitlessMerge creates a merge of the receive transports. Use it as the receive transport
+// of the Session.
+//
+//   legs - the receive transports of the redundant networks, at most 32, the function
+//          registers the merge as their upper layer
+//
+func NewHitlessMerge(legs ...TransportRecv) (*HitlessMerge, error) {
+	if len(legs) == 0 || len(legs) > maxHitlessLegs {
+		return nil, Error("HitlessMerge: needs 1 to 32 legs.")
+	}
+	hm := &HitlessMerge{stats: make([]HitlessLegStats, len(legs)), streams: make(map[uint32]*hitlessStream)}
+	hm.callUpper = hm
+	for i, tpr := range legs {
+		leg := &hitlessLeg{merge: hm, idx: i, transportRecv: tpr, end: make(TransportEnd, 2)}
+		hm.legs = append(hm.legs, leg)
+		tpr.SetCallUpper(leg)
+		tpr.SetEndChannel(leg.end)
+	}
+	return hm, nil
+}
+
+// NewMulticastLegs creates one multicast transport per interface that joins the group on the
+// interface. On Linux the transports of an IPv4 group receive only the packets of their own
+// interface, other platforms deliver the packets of all joined interfaces to each transport and the per leg
+// counters of a HitlessMerge lose their meaning.
+//
+//   group - the multicast group's IP address
+//   port  - the RTP data port, the RTCP control port is the next port
+//   ifis  - the network interfaces of the redundant networks
+//
+func NewMulticastLegs(group *net.IPAddr, port int, ifis []*net.Interface) ([]*TransportUDP, error) {
+	legs := make([]*TransportUDP, 0, len(ifis))
+	for _, ifi := range ifis {
+		tp, err := NewTransportUDPMulticast(group, port, ifi)
+		if err != nil {
+			return nil, err
+		}
+		tp.multicastOwnIfi = true
+		legs = append(legs, tp)
+	}
+	return legs, nil
+}
+
+// Stats returns the counters of the legs in the order of NewHitlessMerge.
+func (hm *HitlessMerge) Stats() []HitlessLegStats {
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+	return append([]HitlessLegStats(nil), hm.stats...)
+}
+
+// *** The following methods implement the rtp.TransportRecv interface.
+
+// ListenOnTransports implements the rtp.TransportRecv ListenOnTransports method. It starts all
+// legs, a leg that fails stops the legs started before.
+func (hm *HitlessMerge) ListenOnTransports() error {
+	for i, leg := range hm.legs {
+		if err := leg.transportRecv.ListenOnTransports(); err != nil {
+			for _, started := range hm.legs[0:i] {
+				started.transportRecv.CloseRecv()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// OnRecvData implements the rtp.TransportRecv OnRecvData method.
+func (hm *HitlessMerge) OnRecvData(rp *DataPacket) bool {
+	rp.FreePacket()
+	return false
+}
+
+// OnRecvCtrl implements the rtp.TransportRecv OnRecvCtrl method.
+func (hm *HitlessMerge) OnRecvCtrl(rp *CtrlPacket) bool {
+	rp.FreePacket()
+	return false
+}
+
+// SetCallUpper implements the rtp.TransportRecv SetCallUpper method.
+func (hm *HitlessMerge) SetCallUpper(upper TransportRecv) {
+	hm.callUpper = upper
+}
+
+// CloseRecv implements the rtp.TransportRecv CloseRecv method. It closes all legs and signals
+// the end channel after all legs stopped.
+func (hm *HitlessMerge) CloseRecv() {
+	for _, leg := range hm.legs {
+		leg.transportRecv.CloseRecv()
+	}
+	hm.mutex.Lock()
+	endUpper := hm.endUpper
+	hm.mutex.Unlock()
+	if endUpper == nil {
+		return
+	}
+	for _, leg := range hm.legs {
+		for allClosed := 0; allClosed != (DataTransportRecvStopped | CtrlTransportRecvStopped); {
+			allClosed |= <-leg.end
+		}
+	}
+	endUpper <- (DataTransportRecvStopped | CtrlTransportRecvStopped)
+}
+
+// SetEndChannel implements the rtp.TransportRecv SetEndChannel method.
+func (hm *HitlessMerge) SetEndChannel(ch TransportEnd) {
+	hm.mutex.Lock()
+	hm.endUpper = ch
+	hm.mutex.Unlock()
+}
+
+// *** The legs' upper layer, only OnRecvData and OnRecvCtrl carry packets.
+
+func (leg *hitlessLeg) ListenOnTransports() error        { return nil }
+func (leg *hitlessLeg) SetCallUpper(upper TransportRecv) {}
+func (leg *hitlessLeg) CloseRecv()                       {}
+func (leg *hitlessLeg) SetEndChannel(ch TransportEnd)    {}
+
+func (leg *hitlessLeg) OnRecvData(rp *DataPacket) bool {
+	return leg.merge.recvData(leg.idx, rp)
+}
+
+func (leg *hitlessLeg) OnRecvCtrl(rp *CtrlPacket) bool {
+	return leg.merge.recvCtrl(leg.idx, rp)
+}
+
+// *** Local functions and methods.
+
+// recvData forwards the first copy of a RTP packet to the upper layer.
+func (hm *HitlessMerge) recvData(idx int, rp *DataPacket) bool {
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+
+	now := time.Now().UnixNano()
+	stats := &hm.stats[idx]
+	stats.Received++
+	stats.LastPacket = now
+	if rp.InUse() < rtpHeaderLength {
+		rp.FreePacket()
+		return false
+	}
+	str := hm.stream(rp.Ssrc(), &rp.fromAddr, now)
+	if str.from.DataPort == 0 {
+		str.from.DataPort = rp.fromAddr.DataPort
+	}
+	seq := rp.Sequence()
+	ext := str.highest + int64(int16(seq-uint16(str.highest)))
+	switch {
+	case str.highest == 0:
+		ext = 1<<32 + int64(seq)
+		str.highest = ext
+	case ext <= str.highest-hitlessWindow:
+		if str.highest-ext <= hitlessDropout {
+			stats.Late++
+			rp.FreePacket()
+			return false
+		}
+		*str = hitlessStream{from: str.from, lastRecv: now} // the sender restarted
+		ext = 1<<32 + int64(seq)
+		str.highest = ext
+	case ext > str.highest:
+		for e := str.highest + 1; e <= ext && e <= str.highest+hitlessWindow; e++ {
+			hm.evict(str, int(e&(hitlessWindow-1)))
+		}
+		str.highest = ext
+	}
+	slot := int(ext & (hitlessWindow - 1))
+	if str.seqs[slot] == ext {
+		str.legs[slot] |= 1 << uint(idx)
+		stats.Duplicates++
+		rp.FreePacket()
+		return false
+	}
+	str.seqs[slot] = ext
+	str.legs[slot] = 1 << uint(idx)
+	stats.Delivered++
+	rp.fromAddr.IpAddr = str.from.IpAddr
+	rp.fromAddr.DataPort = str.from.DataPort
+	return hm.callUpper.OnRecvData(rp)
+}
+
+// recvCtrl forwards the first copy of a compound RTCP packet to the upper layer.
+func (hm *HitlessMerge) recvCtrl(idx int, rp *CtrlPacket) bool {
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+
+	now := time.Now().UnixNano()
+	hm.stats[idx].LastPacket = now
+	h := fnv.New64a()
+	h.Write(rp.buffer[0:rp.inUse])
+	sum := h.Sum64()
+	for _, seen := range hm.ctrlHashes {
+		if seen == sum {
+			rp.FreePacket()
+			return false
+		}
+	}
+	hm.ctrlHashes[hm.ctrlNext] = sum
+	hm.ctrlNext = (hm.ctrlNext + 1) % hitlessCtrlHashes
+	if rp.inUse >= rtcpHeaderLength+rtcpSsrcLength {
+		str := hm.stream(rp.Ssrc(0), &rp.fromAddr, now)
+		if str.from.CtrlPort == 0 {
+			str.from.CtrlPort = rp.fromAddr.CtrlPort
+		}
+		rp.fromAddr.IpAddr = str.from.IpAddr
+		rp.fromAddr.CtrlPort = str.from.CtrlPort
+	}
+	return hm.callUpper.OnRecvCtrl(rp)
+}
+
+// stream returns the state of the SSRC, a new stream replaces the least recently active one
+// if the merge tracks too many streams.
+func (hm *HitlessMerge) stream(ssrc uint32, from *Address, now int64) *hitlessStream {
+	str := hm.streams[ssrc]
+	if str == nil {
+		if len(hm.streams) >= maxHitlessStreams {
+			var oldest uint32
+			for s, other := range hm.streams {
+				if str == nil || other.lastRecv < str.lastRecv {
+					oldest, str = s, other
+				}
+			}
+			delete(hm.streams, oldest)
+		}
+		str = &hitlessStream{from: Address{IpAddr: from.IpAddr}}
+		hm.streams[ssrc] = str
+	}
+	str.lastRecv = now
+	return str
+}
+
+// evict empties the slot and counts the packet as missing for the legs that did not deliver it.
+func (hm *HitlessMerge) evict(str *hitlessStream, slot int) {
+	if str.seqs[slot] == 0 {
+		return
+	}
+	for i := range hm.stats {
+		if str.legs[slot]&(1<<uint(i)) == 0 {
+			hm.stats[i].Missing++
+		}
+	}
+	str.seqs[slot] = 0
+}
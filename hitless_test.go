@@ -0,0 +1,106 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+)
+
+func hitlessPacket(ssrc uint32, seq uint16, ip net.IP) *DataPacket {
+	rp := newDataPacket()
+	rp.SetSsrc(ssrc)
+	rp.SetSequence(seq)
+	rp.SetPayload([]byte{1, 2, 3})
+	rp.fromAddr = Address{ip, 5004, 0}
+	return rp
+}
+
+func TestHitlessMerge(t *testing.T) {
+	parseFlags()
+
+	if _, err := NewHitlessMerge(); err == nil {
+		t.Errorf("NewHitlessMerge accepted no legs\n")
+	}
+	first, second := net.IPv4(10, 0, 1, 1), net.IPv4(10, 0, 2, 1)
+	hm, _ := NewHitlessMerge(new(teeConsumer), new(teeConsumer))
+	upper := new(teeConsumer)
+	hm.SetCallUpper(upper)
+	a, b := hm.legs[0], hm.legs[1]
+
+	// leg a loses sequence number 5, leg b delivers it
+	for seq := uint16(1); seq <= 10; seq++ {
+		if seq != 5 {
+			a.OnRecvData(hitlessPacket(0x11, seq, first))
+		}
+		b.OnRecvData(hitlessPacket(0x11, seq, second))
+	}
+	if len(upper.data) != 10 {
+		t.Errorf("merge check failed: %d packets\n", len(upper.data))
+		return
+	}
+	for i, rp := range upper.data {
+		if rp.Sequence() != uint16(i+1) || !rp.fromAddr.IpAddr.Equal(first) {
+			t.Errorf("packet %d check failed: seq %d from %s\n", i, rp.Sequence(), rp.fromAddr.IpAddr)
+		}
+	}
+	stats := hm.Stats()
+	if stats[0].Delivered != 9 || stats[0].Duplicates != 0 || stats[1].Delivered != 1 || stats[1].Duplicates != 9 ||
+		stats[1].Received != 10 || stats[0].LastPacket == 0 {
+		t.Errorf("leg stats check failed: %+v\n", stats)
+	}
+
+	// moving the window counts the missing packet of leg a, old packets are late
+	a.OnRecvData(hitlessPacket(0x11, 2000, first))
+	b.OnRecvData(hitlessPacket(0x11, 500, second))
+	stats = hm.Stats()
+	if stats[0].Missing != 1 || stats[1].Missing != 0 || stats[1].Late != 1 || len(upper.data) != 11 {
+		t.Errorf("window check failed: %+v, %d packets\n", stats, len(upper.data))
+	}
+	// a large backward jump is a restarted sender
+	b.OnRecvData(hitlessPacket(0x11, 60000, second))
+	a.OnRecvData(hitlessPacket(0x11, 60000, first))
+	if len(upper.data) != 12 || !upper.data[11].fromAddr.IpAddr.Equal(first) {
+		t.Errorf("restart check failed: %d packets\n", len(upper.data))
+	}
+
+	// the copies of compound RTCP packets
+	rp := impairPacket(true, false, 0x11)
+	rp.fromAddr = Address{second, 0, 5005}
+	b.OnRecvCtrl(rp)
+	rp = impairPacket(true, false, 0x11)
+	rp.fromAddr = Address{first, 0, 5005}
+	a.OnRecvCtrl(rp)
+	if len(upper.ctrl) != 1 || !upper.ctrl[0].fromAddr.IpAddr.Equal(first) || upper.ctrl[0].fromAddr.CtrlPort != 5005 {
+		t.Errorf("RTCP merge check failed: %d packets\n", len(upper.ctrl))
+	}
+}
+
+func TestMulticastLegs(t *testing.T) {
+	parseFlags()
+
+	group := &net.IPAddr{IP: net.IPv4(239, 1, 2, 3)}
+	legs, err := NewMulticastLegs(group, 5004, []*net.Interface{nil, nil})
+	if err != nil || len(legs) != 2 || !legs[0].multicast || !legs[1].multicastOwnIfi {
+		t.Errorf("NewMulticastLegs check failed: %v\n", err)
+	}
+	if _, err := NewMulticastLegs(&net.IPAddr{IP: net.IPv4(10, 1, 2, 3)}, 5004, []*net.Interface{nil}); err == nil {
+		t.Errorf("NewMulticastLegs accepted a unicast address\n")
+	}
+}
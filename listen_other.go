@@ -0,0 +1,58 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+//go:build !windows
+// +build !windows
+
+package rtp
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// listenUDP binds a unicast UDP socket. Sockets on these platforms don't share ports unless
+// they set SO_REUSEADDR, thus a plain bind is exclusive.
+func listenUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	return net.ListenUDP(addr.Network(), addr)
+}
+
+// listenMulticastUDP binds a socket to the port of the multicast group and joins the group.
+func listenMulticastUDP(addr *net.UDPAddr, ifi *net.Interface) (*net.UDPConn, error) {
+	return net.ListenMulticastUDP(addr.Network(), ifi, addr)
+}
+
+// listenSourceMulticastUDP binds a socket to the group address and port and joins the
+// source-specific group.
+func listenSourceMulticastUDP(addr *net.UDPAddr, source net.IP, ifi *net.Interface) (*net.UDPConn, error) {
+	conn, err := net.ListenUDP(addr.Network(), addr)
+	if err != nil {
+		return nil, err
+	}
+	if err = ipv4.NewPacketConn(conn).JoinSourceSpecificGroup(ifi, &net.UDPAddr{IP: addr.IP}, &net.UDPAddr{IP: source}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// readErrorKind classifies the error of a socket read, every read error ends the receiver on
+// these platforms.
+func readErrorKind(err error) int {
+	return readFatal
+}
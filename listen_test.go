@@ -0,0 +1,55 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+package rtp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListenUDPExclusive(t *testing.T) {
+	parseFlags()
+	conn, err := listenUDP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 54060})
+	if err != nil {
+		t.Errorf("listenUDP failed: %s\n", err)
+		return
+	}
+	defer conn.Close()
+	if second, err := listenUDP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 54060}); err == nil {
+		second.Close()
+		t.Errorf("second listenUDP on the same port succeeded\n")
+	}
+}
+
+func TestReadErrorKind(t *testing.T) {
+	parseFlags()
+	conn, err := listenUDP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 54062})
+	if err != nil {
+		t.Errorf("listenUDP failed: %s\n", err)
+		return
+	}
+	conn.Close()
+	_, _, err = conn.ReadFromUDP(make([]byte, 16))
+	if err == nil {
+		t.Errorf("read on a closed socket succeeded\n")
+		return
+	}
+	if kind := readErrorKind(err); kind != readFatal {
+		t.Errorf("closed socket read error kind: %d, expected fatal\n", kind)
+	}
+}
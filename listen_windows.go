@@ -0,0 +1,145 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+//go:build windows
+// +build windows
+
+package rtp
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	soExclusiveAddrUse = ^int32(syscall.SO_REUSEADDR) // SO_EXCLUSIVEADDRUSE, not in package syscall
+	wsaEMsgSize        = syscall.Errno(10040)         // WSAEMSGSIZE, the datagram exceeded the buffer
+)
+
+// listenUDP binds a unicast UDP socket with SO_EXCLUSIVEADDRUSE. Without it another process
+// that sets SO_REUSEADDR may bind the same port and receive the media. The function also
+// switches off SIO_UDP_CONNRESET: otherwise an ICMP port unreachable for a sent packet fails
+// the next read with WSAECONNRESET.
+func listenUDP(addr *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			on := int32(1)
+			err = syscall.Setsockopt(syscall.Handle(fd), syscall.SOL_SOCKET, soExclusiveAddrUse, (*byte)(unsafe.Pointer(&on)), 4)
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}}
+	pc, err := lc.ListenPacket(context.Background(), addr.Network(), addr.String())
+	if err != nil {
+		return nil, err
+	}
+	conn := pc.(*net.UDPConn)
+	disableConnReset(conn)
+	return conn, nil
+}
+
+// listenMulticastUDP binds a socket to the wildcard address and the port of the group and
+// joins the group with the ipv4 package. Windows does not bind to group addresses, the socket
+// shares the port with other receivers of the group.
+func listenMulticastUDP(addr *net.UDPAddr, ifi *net.Interface) (*net.UDPConn, error) {
+	conn, err := listenSharedUDP(addr.Port)
+	if err != nil {
+		return nil, err
+	}
+	if err = ipv4.NewPacketConn(conn).JoinGroup(ifi, &net.UDPAddr{IP: addr.IP}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// listenSourceMulticastUDP binds a socket like listenMulticastUDP and joins the source-specific
+// group.
+func listenSourceMulticastUDP(addr *net.UDPAddr, source net.IP, ifi *net.Interface) (*net.UDPConn, error) {
+	conn, err := listenSharedUDP(addr.Port)
+	if err != nil {
+		return nil, err
+	}
+	if err = ipv4.NewPacketConn(conn).JoinSourceSpecificGroup(ifi, &net.UDPAddr{IP: addr.IP}, &net.UDPAddr{IP: source}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// listenSharedUDP binds a socket with SO_REUSEADDR to the wildcard address and the port.
+func listenSharedUDP(port int) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", (&net.UDPAddr{IP: net.IPv4zero, Port: port}).String())
+	if err != nil {
+		return nil, err
+	}
+	conn := pc.(*net.UDPConn)
+	disableConnReset(conn)
+	return conn, nil
+}
+
+// disableConnReset switches off the report of ICMP port unreachable messages as read errors.
+func disableConnReset(conn *net.UDPConn) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	rc.Control(func(fd uintptr) {
+		off := uint32(0)
+		var ret uint32
+		syscall.WSAIoctl(syscall.Handle(fd), syscall.SIO_UDP_CONNRESET, (*byte)(unsafe.Pointer(&off)), 4, nil, 0, &ret, nil, 0)
+	})
+}
+
+// readErrorKind classifies the error of a socket read. Windows reports truncated datagrams and,
+// if SIO_UDP_CONNRESET could not be switched off, ICMP port unreachable messages as errors,
+// the receiver continues after them.
+func readErrorKind(err error) int {
+	var errno syscall.Errno
+	if oe, ok := err.(*net.OpError); ok {
+		if se, ok := oe.Err.(*os.SyscallError); ok {
+			errno, _ = se.Err.(syscall.Errno)
+		} else {
+			errno, _ = oe.Err.(syscall.Errno)
+		}
+	}
+	switch errno {
+	case wsaEMsgSize:
+		return readTruncated
+	case syscall.WSAECONNRESET:
+		return readTransient
+	}
+	return readFatal
+}
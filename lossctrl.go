@@ -0,0 +1,186 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"sync"
+	"time"
+)
+
+// LossController adapts the target bitrate of an output stream to the packet loss the remotes
+// report, a loss based AIMD controller.
+//
+// This is a lighter alternative to a delay based controller, e.g. GCC, for deployments that just
+// need to back off under loss, for example audio only calls. The controller takes the fraction
+// lost of the latest receiver report of each receiver of the stream and, if the application has
+// transport-wide feedback, the loss it computes from it (OnTransportFeedback). The highest loss
+// of the sources that reported within StaleAfter counts, the worst receiver decides:
+//
+//   - below LowLoss the target increases by Increase, at most once per IncreaseInterval
+//   - above HighLoss the target decreases by half the loss, at most once per DecreaseInterval
+//   - in between the target holds
+//
+// The controller calls the target function on every change of the target bitrate. Set the
+// parameters before the first report arrives.
+//
+type LossController struct {
+	MinBitrate, MaxBitrate float64       // limits of the target bitrate in bits per second
+	Increase               float64       // additive increase in bits per second, default 8000
+	LowLoss, HighLoss      float64       // loss thresholds, default 0.02 and 0.1
+	IncreaseInterval       time.Duration // minimum time between increases, default 1 s
+	DecreaseInterval       time.Duration // minimum time between decreases, default 300 ms
+	StaleAfter             time.Duration // a loss report older than this no longer counts, default 10 s
+
+	onTarget func(bitrate float64)
+
+	mutex        sync.Mutex
+	target       float64
+	rrLoss       map[uint32]reportedLoss // by SSRC of the receiver
+	tccLoss      float64
+	tccTime      time.Time
+	lastIncrease time.Time
+	lastDecrease time.Time
+}
+
+// reportedLoss is the fraction lost of a receiver's latest report.
+type reportedLoss struct {
+	loss float64
+	time time.Time
+}
+
+const (
+	lossIncrease         = 8000
+	lossLow              = 0.02
+	lossHigh             = 0.1
+	lossIncreaseInterval = time.Second
+	lossDecreaseInterval = 300 * time.Millisecond
+	lossStaleAfter       = 10 * time.Second
+)
+
+// NewLossController creates a loss based rate controller for an output stream and enables it.
+// It returns an error if the bitrates are not consistent.
+//
+//   rs          - the session of the stream
+//   streamIndex - the index of the output stream as returned by NewSsrcStreamOut
+//   start       - the initial target bitrate in bits per second
+//   min, max    - the limits of the target bitrate
+//   onTarget    - the function to call with the new target bitrate
+//
+func NewLossController(rs *Session, streamIndex uint32, start, min, max float64, onTarget func(bitrate float64)) (*LossController, error) {
+	if err := rs.sendData(); err != nil {
+		return nil, err
+	}
+	str := rs.SsrcStreamOutForIndex(streamIndex)
+	if str == nil {
+		return nil, Error("No output stream at this index.")
+	}
+	if min <= 0 || max < min || start < min || start > max {
+		return nil, Error("LossController: invalid bitrates.")
+	}
+	lc := &LossController{
+		MinBitrate:       min,
+		MaxBitrate:       max,
+		Increase:         lossIncrease,
+		LowLoss:          lossLow,
+		HighLoss:         lossHigh,
+		IncreaseInterval: lossIncreaseInterval,
+		DecreaseInterval: lossDecreaseInterval,
+		StaleAfter:       lossStaleAfter,
+		onTarget:         onTarget,
+		target:           start,
+	}
+	str.streamMutex.Lock()
+	str.lossControl = lc
+	str.streamMutex.Unlock()
+	return lc, nil
+}
+
+// Target returns the current target bitrate in bits per second.
+func (lc *LossController) Target() float64 {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	return lc.target
+}
+
+// OnTransportFeedback reports the loss the application computed from transport-wide congestion
+// control feedback.
+//
+//   received - the number of packets the feedback reports as received
+//   lost     - the number of packets the feedback reports as lost
+//
+func (lc *LossController) OnTransportFeedback(received, lost int) {
+	if received+lost <= 0 {
+		return
+	}
+	now := time.Now()
+	lc.mutex.Lock()
+	lc.tccLoss, lc.tccTime = float64(lost)/float64(received+lost), now
+	lc.mutex.Unlock()
+	lc.update(now)
+}
+
+// onRecvReport takes the fraction lost of a receiver's report block, an 8 bit fixed point number.
+func (lc *LossController) onRecvReport(reporter uint32, fracLost byte) {
+	now := time.Now()
+	lc.mutex.Lock()
+	if lc.rrLoss == nil {
+		lc.rrLoss = make(map[uint32]reportedLoss)
+	}
+	lc.rrLoss[reporter] = reportedLoss{float64(fracLost) / 256, now}
+	lc.mutex.Unlock()
+	lc.update(now)
+}
+
+// update computes the new target and calls the target function outside the mutex.
+func (lc *LossController) update(now time.Time) {
+	lc.mutex.Lock()
+	loss := 0.0
+	for reporter, rr := range lc.rrLoss {
+		if now.Sub(rr.time) > lc.StaleAfter {
+			delete(lc.rrLoss, reporter) // left the session or stopped reporting
+		} else if rr.loss > loss {
+			loss = rr.loss
+		}
+	}
+	if now.Sub(lc.tccTime) <= lc.StaleAfter && lc.tccLoss > loss {
+		loss = lc.tccLoss
+	}
+	target := lc.target
+	switch {
+	case loss < lc.LowLoss && now.Sub(lc.lastIncrease) >= lc.IncreaseInterval:
+		target += lc.Increase
+		lc.lastIncrease = now
+	case loss > lc.HighLoss && now.Sub(lc.lastDecrease) >= lc.DecreaseInterval:
+		target *= 1 - loss/2
+		lc.lastDecrease = now
+	}
+	if target > lc.MaxBitrate {
+		target = lc.MaxBitrate
+	}
+	if target < lc.MinBitrate {
+		target = lc.MinBitrate
+	}
+	changed := target != lc.target
+	lc.target = target
+	lc.mutex.Unlock()
+
+	if changed && lc.onTarget != nil {
+		lc.onTarget(target)
+	}
+}
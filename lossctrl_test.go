@@ -0,0 +1,99 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLossController(t *testing.T) {
+	parseFlags()
+
+	rs, _ := closeSession(false)
+	if _, err := NewLossController(rs, 0, 8000, 16000, 64000, nil); err == nil {
+		t.Errorf("Start bitrate check failed\n")
+	}
+	var targets []float64
+	lc, err := NewLossController(rs, 0, 32000, 16000, 64000, func(bitrate float64) { targets = append(targets, bitrate) })
+	if err != nil {
+		t.Errorf("NewLossController failed: %s\n", err)
+		return
+	}
+	lc.IncreaseInterval, lc.DecreaseInterval = 0, 0
+	str := rs.SsrcStreamOutForIndex(0)
+	reportFrom := func(reporter uint32, fracLost byte) {
+		rr := make(recvReport, reportBlockLen)
+		rr.setPacketsLostFrac(fracLost)
+		str.readRecvReport(rr, reporter)
+	}
+	report := func(fracLost byte) { reportFrom(0xa1, fracLost) }
+
+	report(0) // no loss: additive increase
+	if lc.Target() != 40000 {
+		t.Errorf("Increase check failed. Expected: 40000, got: %f\n", lc.Target())
+	}
+	report(64) // 25 % loss: decrease by 12.5 %
+	if lc.Target() != 35000 {
+		t.Errorf("Decrease check failed. Expected: 35000, got: %f\n", lc.Target())
+	}
+	report(13) // about 5 %: hold
+	if lc.Target() != 35000 || len(targets) != 2 {
+		t.Errorf("Hold check failed. Target: %f, callbacks: %d\n", lc.Target(), len(targets))
+	}
+
+	// The transport feedback loss counts if it is higher than the RR loss
+	lc.OnTransportFeedback(50, 50)
+	if lc.Target() != 26250 {
+		t.Errorf("Transport feedback check failed. Expected: 26250, got: %f\n", lc.Target())
+	}
+	// Stale reports no longer count
+	lc.update(time.Now().Add(lc.StaleAfter + time.Second))
+	if lc.Target() != 34250 {
+		t.Errorf("Stale report check failed. Expected: 34250, got: %f\n", lc.Target())
+	}
+
+	// The limits and the increase interval
+	lc.IncreaseInterval, lc.lastIncrease = time.Hour, time.Time{}
+	lc.tccTime = time.Time{} // the transport feedback went stale
+	for i := 0; i < 10; i++ {
+		report(255)
+	}
+	if lc.Target() != 16000 {
+		t.Errorf("Minimum check failed. Got: %f\n", lc.Target())
+	}
+	report(0)
+	report(0)
+	if lc.Target() != 24000 {
+		t.Errorf("Increase interval check failed. Expected: 24000, got: %f\n", lc.Target())
+	}
+
+	// The worst receiver counts, a good one does not hide a lossy one
+	reportFrom(0xb2, 64)
+	if lc.Target() != 21000 {
+		t.Errorf("Second receiver check failed. Expected: 21000, got: %f\n", lc.Target())
+	}
+	report(0)
+	if lc.Target() != 18375 {
+		t.Errorf("Worst receiver check failed. Expected: 18375, got: %f\n", lc.Target())
+	}
+	if len(lc.rrLoss) != 2 {
+		t.Errorf("Receiver count check failed: %d\n", len(lc.rrLoss))
+	}
+}
@@ -0,0 +1,365 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"hash/fnv"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+ * This source file contains the session manager of media servers: it owns the sessions of
+ * many calls, allocates their UDP port pairs from a pool, shares a scheduler and a worker
+ * pool between them and finds the session of a port, a SSRC or a call ID.
+ */
+
+const managerShards = 32
+
+// SessionManager owns the sessions of many calls.
+//
+// The manager creates each session with a UDP transport on a port pair of its port range and
+// sets the call ID as the correlation ID of the session's input streams, see StreamContext.
+// It keeps the sessions in shards with their own locks, thus thousands of calls that start,
+// end and look up sessions in parallel don't contend on one lock. The sessions share the
+// manager's Scheduler and its worker pool, an application uses them instead of timers and
+// goroutines per session.
+//
+// The lookup by call ID and by port takes a shard lock or the port lock only, the lookup by
+// SSRC scans the sessions. To avoid the bind calls during call setup bursts set an UdpPortPool,
+// see SetPortPool.
+//
+type SessionManager struct {
+	Workers int // number of goroutines of the worker pool, set it before the first Go call
+
+	local   *net.IPAddr
+	minPort int
+	maxPort int
+
+	shards [managerShards]managerShard
+
+	portsMutex sync.Mutex
+	ports      map[int]string // allocated RTP data port to call ID
+	nextPort   int
+	pool       *UdpPortPool // nil if the manager binds the ports itself
+
+	poolOnce  sync.Once
+	jobs      chan func()
+	scheduler *Scheduler
+
+	draining  uint32        // accessed atomically, 1 after Drain started
+	removed   uint32        // accessed atomically, number of removed sessions
+	drainWake chan struct{} // signals a removed session to Drain
+}
+
+type managerShard struct {
+	mutex    sync.Mutex
+	sessions map[string]*managedSession
+}
+
+type managedSession struct {
+	rs   *Session
+	tp   *TransportUDP
+	port int
+}
+
+// ManagerStats holds the aggregate statistics of the sessions of a SessionManager.
+type ManagerStats struct {
+	Sessions        int
+	InputStreams    int
+	OutputStreams   int
+	PacketsReceived uint64
+	OctetsReceived  uint64
+	PacketsLost     int64
+	PacketsSent     uint64
+	OctetsSent      uint64
+	ReceiveRate     float64 // bits per second of all input streams, 5 second window
+	SendRate        float64 // bits per second of all output streams, 5 second window
+}
+
+// NewSessionManager creates a session manager.
+//
+//   local            - the local address of the sessions' transports
+//   minPort, maxPort - the range of the RTP data ports, the RTCP control ports are the following odd ports
+//
+func NewSessionManager(local *net.IPAddr, minPort, maxPort int) (*SessionManager, error) {
+	if minPort <= 0 || maxPort > 0xfffe || maxPort < minPort {
+		return nil, Error("Invalid port range.")
+	}
+	sm := &SessionManager{Workers: runtime.NumCPU(), local: local, minPort: minPort + minPort&1, maxPort: maxPort,
+		ports: make(map[int]string), scheduler: NewScheduler(), drainWake: make(chan struct{}, 1)}
+	sm.nextPort = sm.minPort
+	for i := range sm.shards {
+		sm.shards[i].sessions = make(map[string]*managedSession)
+	}
+	return sm, nil
+}
+
+// SetPortPool sets the pool that leases the transports of new sessions instead of the port
+// range of the manager. Set the pool before the first NewSession call. The manager returns the
+// transports of removed sessions to the pool but doesn't close the pool.
+//
+func (sm *SessionManager) SetPortPool(pool *UdpPortPool) {
+	sm.pool = pool
+}
+
+// NewSession creates the session of a call on a free port pair of the manager.
+//
+// The application adds the streams and remotes and starts the session as usual. To end the
+// call use RemoveSession, not the close methods of the session.
+//
+//   callId - the unique ID of the call, the key of the lookup methods
+//
+func (sm *SessionManager) NewSession(callId string) (*Session, error) {
+	shard := sm.shard(callId)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if sm.Draining() {
+		return nil, errDraining
+	}
+	if _, ok := shard.sessions[callId]; ok {
+		return nil, Error("SessionManager: call ID exists.")
+	}
+	tp, port, err := sm.allocate(callId)
+	if err != nil {
+		return nil, err
+	}
+	rs := NewSession(tp, tp)
+	rs.SetInputContext(func(ssrc uint32, from *Address) StreamContext {
+		return StreamContext{CorrelationId: callId}
+	})
+	shard.sessions[callId] = &managedSession{rs: rs, tp: tp, port: port}
+	return rs, nil
+}
+
+// RemoveSession closes the session of the call, see CloseSession, and returns its port pair
+// to the pool. The method does nothing if the manager has no session for the call ID.
+func (sm *SessionManager) RemoveSession(callId string) {
+	sm.removeSession(callId)
+}
+
+// Session returns the session of the call, nil if the manager has none.
+func (sm *SessionManager) Session(callId string) *Session {
+	shard := sm.shard(callId)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if ms, ok := shard.sessions[callId]; ok {
+		return ms.rs
+	}
+	return nil
+}
+
+// SessionForPort returns the call ID and the session that uses the local RTP data port or the
+// RTCP control port, nil if the manager has none.
+func (sm *SessionManager) SessionForPort(port int) (string, *Session) {
+	sm.portsMutex.Lock()
+	callId, ok := sm.ports[port&^1]
+	sm.portsMutex.Unlock()
+
+	if !ok {
+		return "", nil
+	}
+	return callId, sm.Session(callId)
+}
+
+// SessionForSsrc returns the call ID and the session that has an output or input stream with
+// the SSRC, nil if the manager has none. Different calls may use the same SSRC, the method
+// returns one of them.
+func (sm *SessionManager) SessionForSsrc(ssrc uint32) (string, *Session) {
+	for i := range sm.shards {
+		shard := &sm.shards[i]
+		shard.mutex.Lock()
+		for callId, ms := range shard.sessions {
+			if ms.rs.lookupStream(ssrc) != nil {
+				shard.mutex.Unlock()
+				return callId, ms.rs
+			}
+		}
+		shard.mutex.Unlock()
+	}
+	return "", nil
+}
+
+// Sessions returns the number of sessions of the manager.
+func (sm *SessionManager) Sessions() (n int) {
+	for i := range sm.shards {
+		sm.shards[i].mutex.Lock()
+		n += len(sm.shards[i].sessions)
+		sm.shards[i].mutex.Unlock()
+	}
+	return
+}
+
+// Stats returns the aggregate statistics of the streams of all sessions.
+func (sm *SessionManager) Stats() (stats ManagerStats) {
+	var sessions []*Session
+	for i := range sm.shards {
+		shard := &sm.shards[i]
+		shard.mutex.Lock()
+		for _, ms := range shard.sessions {
+			sessions = append(sessions, ms.rs)
+		}
+		shard.mutex.Unlock()
+	}
+	stats.Sessions = len(sessions)
+	for _, rs := range sessions {
+		for _, info := range rs.InputStreams() {
+			stats.InputStreams++
+			stats.PacketsReceived += uint64(info.Statistics.PacketCount)
+			stats.OctetsReceived += uint64(info.Statistics.OctetCount)
+			stats.PacketsLost += int64(info.Statistics.PacketsLost)
+			stats.ReceiveRate += info.Bitrate.Rate5s
+		}
+		rs.streamsMapMutex.Lock()
+		for _, str := range rs.streamsOut {
+			stats.OutputStreams++
+			str.streamMutex.Lock()
+			stats.PacketsSent += uint64(str.SenderPacketCnt)
+			stats.OctetsSent += uint64(str.SenderOctectCnt)
+			stats.SendRate += str.BitrateStats().Rate5s
+			str.streamMutex.Unlock()
+		}
+		rs.streamsMapMutex.Unlock()
+	}
+	return
+}
+
+// Scheduler returns the scheduler that the sessions of the manager share.
+func (sm *SessionManager) Scheduler() *Scheduler {
+	return sm.scheduler
+}
+
+// Go runs fn on a goroutine of the worker pool. The method blocks if all workers are busy and
+// their queue is full. The manager starts the workers with the first call.
+func (sm *SessionManager) Go(fn func()) {
+	sm.poolOnce.Do(func() {
+		workers := sm.Workers
+		if workers < 1 {
+			workers = 1
+		}
+		sm.jobs = make(chan func(), workers*16)
+		for i := 0; i < workers; i++ {
+			go func() {
+				for job := range sm.jobs {
+					job()
+				}
+			}()
+		}
+	})
+	sm.jobs <- fn
+}
+
+// Close removes all sessions, stops the scheduler and stops the workers after they ran the
+// queued functions. Don't use the manager after Close.
+func (sm *SessionManager) Close() {
+	for _, callId := range sm.callIds() {
+		sm.RemoveSession(callId)
+	}
+	sm.scheduler.Stop()
+	sm.poolOnce.Do(func() {})
+	if sm.jobs != nil {
+		close(sm.jobs)
+	}
+}
+
+// *** Local functions and methods.
+
+// removeSession removes and closes the session of the call, it returns false if the manager
+// has no session for the call ID.
+func (sm *SessionManager) removeSession(callId string) bool {
+	shard := sm.shard(callId)
+	shard.mutex.Lock()
+	ms, ok := shard.sessions[callId]
+	delete(shard.sessions, callId)
+	shard.mutex.Unlock()
+
+	if !ok {
+		return false
+	}
+	ms.rs.CloseSession()
+	if sm.pool != nil {
+		sm.pool.Release(ms.tp)
+	} else {
+		ms.tp.CloseRecv() // the transport of a session that never started has bound sockets too
+	}
+	sm.portsMutex.Lock()
+	delete(sm.ports, ms.port)
+	sm.portsMutex.Unlock()
+
+	atomic.AddUint32(&sm.removed, 1)
+	select {
+	case sm.drainWake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (sm *SessionManager) shard(callId string) *managerShard {
+	h := fnv.New32a()
+	h.Write([]byte(callId))
+	return &sm.shards[h.Sum32()%managerShards]
+}
+
+// callIds returns the call IDs of all sessions.
+func (sm *SessionManager) callIds() (callIds []string) {
+	for i := range sm.shards {
+		shard := &sm.shards[i]
+		shard.mutex.Lock()
+		for callId := range shard.sessions {
+			callIds = append(callIds, callId)
+		}
+		shard.mutex.Unlock()
+	}
+	return
+}
+
+// allocate leases a transport from the port pool or binds one to the next free port pair.
+func (sm *SessionManager) allocate(callId string) (*TransportUDP, int, error) {
+	sm.portsMutex.Lock()
+	defer sm.portsMutex.Unlock()
+
+	if sm.pool != nil {
+		tp, err := sm.pool.Lease()
+		if err != nil {
+			return nil, 0, err
+		}
+		port, _ := tp.LocalPorts()
+		sm.ports[port] = callId
+		return tp, port, nil
+	}
+	pairs := (sm.maxPort-sm.minPort)/2 + 1
+	for i := 0; i < pairs; i++ {
+		port := sm.nextPort
+		if sm.nextPort += 2; sm.nextPort > sm.maxPort {
+			sm.nextPort = sm.minPort
+		}
+		if _, used := sm.ports[port]; used {
+			continue
+		}
+		if tp, err := NewTransportUDPAutoPorts(sm.local, port, port); err == nil {
+			sm.ports[port] = callId
+			return tp, port, nil
+		}
+	}
+	return nil, 0, Error("SessionManager: no free port pair.")
+}
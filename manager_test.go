@@ -0,0 +1,106 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestSessionManager(t *testing.T) {
+	parseFlags()
+
+	local, _ := net.ResolveIPAddr("ip", "127.0.0.1")
+	if _, err := NewSessionManager(local, 55310, 55300); err == nil {
+		t.Errorf("Invalid port range check failed\n")
+	}
+	sm, _ := NewSessionManager(local, 55300, 55304) // three port pairs
+	defer sm.Close()
+	calls := []string{"call-a", "call-b", "call-c"}
+	for _, callId := range calls {
+		if _, err := sm.NewSession(callId); err != nil {
+			t.Errorf("NewSession %s failed: %s\n", callId, err)
+			return
+		}
+	}
+	if _, err := sm.NewSession("call-a"); err == nil {
+		t.Errorf("Duplicate call ID check failed\n")
+	}
+	if _, err := sm.NewSession("call-d"); err == nil {
+		t.Errorf("Port pool exhaustion check failed\n")
+	}
+	if callId, rs := sm.SessionForPort(55303); callId != "call-b" || rs != sm.Session("call-b") {
+		t.Errorf("Port lookup check failed. Got: %s\n", callId)
+	}
+
+	// call-a sends, call-b's input stream has the call ID as correlation ID
+	rsA, rsB := sm.Session("call-a"), sm.Session("call-b")
+	rsA.AddRemote(&Address{IpAddr: local.IP, DataPort: 55302, CtrlPort: 55303})
+	strIdx, _ := rsA.NewSsrcStreamOut(&Address{IpAddr: local.IP, DataPort: 55300, CtrlPort: 55301}, 0x0a0a0a0a, 1)
+	rsA.SsrcStreamOutForIndex(strIdx).SetPayloadType(0)
+	rp := rsA.NewDataPacket(160)
+	rp.SetPayload(make([]byte, 160))
+	rsA.WriteData(rp)
+	rp.fromAddr = Address{IpAddr: local.IP, DataPort: 55300, CtrlPort: 55301}
+	rsB.rtcpServiceActive = true // to simulate an active RTCP service
+	rsB.OnRecvData(rp)
+	rsB.rtcpServiceActive = false
+
+	if in := rsB.InputStreams(); len(in) != 1 || in[0].Context.CorrelationId != "call-b" {
+		t.Errorf("Input stream correlation ID check failed\n")
+	}
+	if callId, _ := sm.SessionForSsrc(0x0a0a0a0a); callId != "call-a" && callId != "call-b" {
+		t.Errorf("SSRC lookup check failed. Got: %s\n", callId)
+	}
+	stats := sm.Stats()
+	if stats.Sessions != 3 || stats.OutputStreams != 1 || stats.InputStreams != 1 || stats.PacketsSent != 1 ||
+		stats.PacketsReceived != 1 || stats.OctetsReceived != 160 {
+		t.Errorf("Aggregate statistics check failed. Got: %+v\n", stats)
+	}
+
+	// removed sessions return their ports to the pool
+	sm.RemoveSession("call-b")
+	if sm.Session("call-b") != nil || sm.Sessions() != 2 {
+		t.Errorf("RemoveSession check failed\n")
+	}
+	if _, err := sm.NewSession("call-d"); err != nil {
+		t.Errorf("Port reuse check failed: %s\n", err)
+	}
+	if callId, _ := sm.SessionForPort(55302); callId != "call-d" {
+		t.Errorf("Reused port lookup check failed. Got: %s\n", callId)
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	ran := 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		sm.Go(func() {
+			mutex.Lock()
+			ran++
+			mutex.Unlock()
+			wg.Done()
+		})
+	}
+	wg.Wait()
+	if ran != 100 {
+		t.Errorf("Worker pool check failed. Ran: %d\n", ran)
+	}
+}
@@ -0,0 +1,551 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+/*
+ * This source file implements the pre-shared key mode of MIKEY (RFC 3830) to derive SRTP master
+ * keys and salts. The initiator sends an I_MESSAGE with a random TEK generation key (TGK) that is
+ * encrypted and authenticated with keys derived from the pre-shared key, the responder checks
+ * it and optionally returns a verification message (R_MESSAGE).
+ */
+
+// MIKEY message data types according to RFC 3830, chapter 6.1.
+const (
+	MikeyPskInit   = 0 // Initiator's pre-shared key message
+	MikeyPskVerify = 1 // Verification message of a pre-shared key message
+)
+
+// MIKEY payload types, RFC 3830 chapter 6.1
+const (
+	mikeyLastPayload  = 0
+	mikeyKemacPayload = 1
+	mikeyTPayload     = 5
+	mikeyIdPayload    = 6
+	mikeyVPayload     = 9
+	mikeySpPayload    = 10
+	mikeyRandPayload  = 11
+)
+
+// MIKEY constants and algorithms
+const (
+	mikeyVersion      = 1
+	mikeySrtpIdMap    = 0  // CS ID map type SRTP-ID
+	mikeyNtpUtc       = 0  // timestamp type NTP-UTC
+	mikeyAesCm128     = 1  // KEMAC encryption algorithm AES-CM-128
+	mikeyHmacSha1     = 1  // KEMAC MAC algorithm HMAC-SHA-1-160
+	mikeyMacLength    = 20 // length of the HMAC-SHA-1-160 MAC
+	mikeyTgkType      = 0  // key data type TGK
+	mikeyRandLength   = 16
+	mikeyTgkLength    = 16
+	mikeySrtpProtocol = 0 // security policy protocol type SRTP
+)
+
+// Key derivation constants, RFC 3830 chapter 4.1.3 and 4.1.4
+const (
+	mikeyLabelTek     = 0x2AD01C64
+	mikeyLabelEncr    = 0x15798CEF
+	mikeyLabelAuth    = 0x1B5C7973
+	mikeyLabelSalt    = 0x39A2C14B
+	mikeyEnvelopeCsId = 0xff
+)
+
+// MikeyMaxSkew is the default for the allowed difference between the timestamp of a MIKEY
+// message and the local clock.
+const MikeyMaxSkew = 5 * time.Minute
+
+// mikeySrtpPolicy holds the security policy parameters of AES_CM_128_HMAC_SHA1_80, the crypto
+// suite that TransportSRTP implements, RFC 3830 chapter 6.10.1.
+var mikeySrtpPolicy = []byte{
+	0, 1, 1, // encryption algorithm: AES-CM
+	1, 1, SrtpMasterKeyLength, // session encryption key length
+	2, 1, 1, // authentication algorithm: HMAC-SHA-1
+	3, 1, srtpAuthKeyLength, // session authentication key length
+	4, 1, SrtpMasterSaltLength, // session salt key length
+	5, 1, 0, // SRTP pseudo random function: AES-CM
+	6, 1, 0, // key derivation rate: 0
+	7, 1, 1, // SRTP encryption on
+	8, 1, 1, // SRTCP encryption on
+	10, 1, 1, // SRTP authentication on
+	11, 1, srtpAuthTagLength, // authentication tag length
+}
+
+// MikeyCryptoSession describes one crypto session (one SRTP stream) of a MIKEY message.
+type MikeyCryptoSession struct {
+	PolicyNo byte // the number of the security policy, this implementation uses 0
+	Ssrc     uint32
+	Roc      uint32 // the current rollover counter of the stream
+}
+
+// MikeyKeys holds the key material that a MIKEY exchange established.
+type MikeyKeys struct {
+	CsbId          uint32 // the crypto session bundle ID
+	CryptoSessions []MikeyCryptoSession
+	Tgk            []byte // TEK generation key
+	Rand           []byte
+	Timestamp      uint64 // NTP-UTC timestamp of the initiator's message
+}
+
+// MikeyPsk creates and processes MIKEY messages in pre-shared key mode.
+type MikeyPsk struct {
+	MaxSkew time.Duration // allowed difference between a message's timestamp and the local clock
+	psk     []byte
+	mutex   sync.Mutex
+	replay  map[mikeyReplayKey]int64 // the accepted I_MESSAGEs within the skew, RFC 3830 chapter 5.4
+}
+
+// mikeyReplayKey identifies an I_MESSAGE in the replay cache.
+type mikeyReplayKey struct {
+	csbId     uint32
+	timestamp uint64
+	rand      string
+}
+
+// mikeyMessage is the parsed form of a MIKEY message.
+type mikeyMessage struct {
+	dataType       byte
+	verify         bool
+	csbId          uint32
+	cryptoSessions []MikeyCryptoSession
+	timestamp      uint64
+	rand           []byte
+	ids            [][]byte
+	policy         map[byte][]byte // parameters of the SRTP security policy 0
+	encrData       []byte
+	mac            []byte
+	macOffset      int // offset of the MAC (KEMAC or V payload) in the message
+}
+
+// NewMikeyPsk creates a MIKEY handler for a pre-shared key.
+//
+//   psk - the pre-shared key, at least 16 bytes
+//
+func NewMikeyPsk(psk []byte) (*MikeyPsk, error) {
+	if len(psk) < 16 {
+		return nil, Error("MIKEY: pre-shared key too short.")
+	}
+	return &MikeyPsk{MaxSkew: MikeyMaxSkew, psk: append([]byte{}, psk...)}, nil
+}
+
+// Initiate creates an I_MESSAGE with a new random TGK for the crypto sessions.
+//
+// The method returns the message and the key material. Use MikeyKeys.SrtpKey to get the SRTP
+// master keys.
+//
+//   sessions - the crypto sessions, usually one per SRTP stream (SSRC)
+//   verify   - request a verification message from the responder
+//
+func (mp *MikeyPsk) Initiate(sessions []MikeyCryptoSession, verify bool) (msg []byte, keys *MikeyKeys, err error) {
+	if len(sessions) == 0 || len(sessions) > 255 {
+		return nil, nil, Error("MIKEY: invalid number of crypto sessions.")
+	}
+	keys = &MikeyKeys{CryptoSessions: append([]MikeyCryptoSession{}, sessions...)}
+	keys.Rand = make([]byte, mikeyRandLength)
+	keys.Tgk = make([]byte, mikeyTgkLength)
+	var csb [4]byte
+	for _, b := range [][]byte{keys.Rand, keys.Tgk, csb[:]} {
+		if _, err = rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+	}
+	keys.CsbId = binary.BigEndian.Uint32(csb[:])
+	sec, frac := toNtpStamp(time.Now().UnixNano())
+	keys.Timestamp = uint64(sec)<<32 | uint64(frac)
+
+	msg = mikeyHeader(MikeyPskInit, verify, keys.CsbId, keys.CryptoSessions, mikeyTPayload)
+	msg = mikeyTimestamp(msg, keys.Timestamp, mikeyRandPayload)
+	msg = append(msg, mikeySpPayload, byte(len(keys.Rand)))
+	msg = append(msg, keys.Rand...)
+
+	// security policy 0 for all crypto sessions
+	msg = append(msg, mikeyKemacPayload, 0, mikeySrtpProtocol, 0, byte(len(mikeySrtpPolicy)))
+	msg = append(msg, mikeySrtpPolicy...)
+
+	// key data sub-payload with the TGK, encrypted with AES-CM
+	keyData := []byte{mikeyLastPayload, mikeyTgkType << 4, 0, byte(len(keys.Tgk))}
+	keyData = append(keyData, keys.Tgk...)
+	encrKey, authKey, saltKey := mp.envelopeKeys(keys.CsbId, keys.Rand)
+	mikeyAesCm(encrKey, saltKey, keys.CsbId, keys.Timestamp, keyData)
+
+	msg = append(msg, mikeyLastPayload, mikeyAesCm128, byte(len(keyData)>>8), byte(len(keyData)))
+	msg = append(msg, keyData...)
+	msg = append(msg, mikeyHmacSha1)
+	msg = append(msg, mikeyMac(authKey, msg)...)
+	return msg, keys, nil
+}
+
+// Respond processes an I_MESSAGE and returns the key material of the initiator.
+//
+// The method checks the version, the timestamp and the MAC of the message and decrypts the TGK.
+// It keeps the CSB ID, timestamp and RAND of the accepted messages while their timestamp is
+// within the allowed clock skew and rejects a message it accepted already, RFC 3830 chapter
+// 5.4. If the initiator requested a verification the method also returns the R_MESSAGE to send back,
+// otherwise resp is nil.
+//
+//   msg - the I_MESSAGE
+//
+func (mp *MikeyPsk) Respond(msg []byte) (keys *MikeyKeys, resp []byte, err error) {
+	m, err := parseMikey(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m.dataType != MikeyPskInit || m.encrData == nil || m.rand == nil {
+		return nil, nil, Error("MIKEY: not a pre-shared key I_MESSAGE.")
+	}
+	if err = mp.checkTimestamp(m.timestamp); err != nil {
+		return nil, nil, err
+	}
+	encrKey, authKey, saltKey := mp.envelopeKeys(m.csbId, m.rand)
+	if subtle.ConstantTimeCompare(mikeyMac(authKey, msg[:m.macOffset]), m.mac) != 1 {
+		return nil, nil, Error("MIKEY: MAC check failed.")
+	}
+	if m.policy != nil && !mikeyPolicySupported(m.policy) {
+		return nil, nil, Error("MIKEY: unsupported SRTP security policy.")
+	}
+	if !mp.fresh(mikeyReplayKey{m.csbId, m.timestamp, string(m.rand)}) {
+		return nil, nil, Error("MIKEY: replayed message.")
+	}
+	keyData := append([]byte{}, m.encrData...)
+	mikeyAesCm(encrKey, saltKey, m.csbId, m.timestamp, keyData)
+	if len(keyData) < 4 || keyData[1]>>4 != mikeyTgkType {
+		return nil, nil, Error("MIKEY: no TGK in key data.")
+	}
+	tgkLen := int(binary.BigEndian.Uint16(keyData[2:]))
+	if tgkLen == 0 || len(keyData) < 4+tgkLen {
+		return nil, nil, Error("MIKEY: invalid key data length.")
+	}
+	keys = &MikeyKeys{CsbId: m.csbId, CryptoSessions: m.cryptoSessions, Tgk: keyData[4 : 4+tgkLen],
+		Rand: m.rand, Timestamp: m.timestamp}
+	if !m.verify {
+		return keys, nil, nil
+	}
+	resp = mikeyHeader(MikeyPskVerify, false, m.csbId, m.cryptoSessions, mikeyTPayload)
+	sec, frac := toNtpStamp(time.Now().UnixNano())
+	resp = mikeyTimestamp(resp, uint64(sec)<<32|uint64(frac), mikeyVPayload)
+	resp = append(resp, mikeyLastPayload, mikeyHmacSha1)
+	resp = append(resp, mikeyMac(authKey, mikeyVerifyData(resp, m.ids, m.timestamp))...)
+	return keys, resp, nil
+}
+
+// CheckVerification checks the R_MESSAGE of the responder to an I_MESSAGE that requested a
+// verification.
+//
+//   keys - the key material that Initiate returned
+//   resp - the R_MESSAGE
+//
+func (mp *MikeyPsk) CheckVerification(keys *MikeyKeys, resp []byte) error {
+	m, err := parseMikey(resp)
+	if err != nil {
+		return err
+	}
+	if m.dataType != MikeyPskVerify || m.mac == nil || m.csbId != keys.CsbId {
+		return Error("MIKEY: not a verification message for this exchange.")
+	}
+	if err = mp.checkTimestamp(m.timestamp); err != nil {
+		return err
+	}
+	_, authKey, _ := mp.envelopeKeys(keys.CsbId, keys.Rand)
+	if subtle.ConstantTimeCompare(mikeyMac(authKey, mikeyVerifyData(resp[:m.macOffset], nil, keys.Timestamp)), m.mac) != 1 {
+		return Error("MIKEY: verification MAC check failed.")
+	}
+	return nil
+}
+
+// SrtpKey returns the SRTP master key followed by the master salt of a crypto session, the
+// format that NewTransportSRTP expects.
+//
+//   cs - the index of the crypto session in CryptoSessions
+//
+func (keys *MikeyKeys) SrtpKey(cs int) []byte {
+	label := mikeyLabel(mikeyLabelTek, byte(cs+1), keys.CsbId, keys.Rand)
+	key := mikeyPrf(keys.Tgk, label, SrtpMasterKeyLength)
+	binary.BigEndian.PutUint32(label, mikeyLabelSalt)
+	return append(key, mikeyPrf(keys.Tgk, label, SrtpMasterSaltLength)...)
+}
+
+// *** Local functions and methods.
+
+func (mp *MikeyPsk) checkTimestamp(stamp uint64) error {
+	tm := fromNtp(uint32(stamp>>32), uint32(stamp))
+	skew := time.Duration(time.Now().UnixNano() - tm)
+	if skew > mp.MaxSkew || skew < -mp.MaxSkew {
+		return Error("MIKEY: timestamp outside of the allowed clock skew.")
+	}
+	return nil
+}
+
+// fresh adds an authenticated I_MESSAGE to the replay cache, it returns false if the cache has
+// the message already. The entries expire when their timestamp leaves the allowed clock skew.
+func (mp *MikeyPsk) fresh(key mikeyReplayKey) bool {
+	now := time.Now().UnixNano()
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	for k, expires := range mp.replay {
+		if expires < now {
+			delete(mp.replay, k)
+		}
+	}
+	if _, ok := mp.replay[key]; ok {
+		return false
+	}
+	if mp.replay == nil {
+		mp.replay = make(map[mikeyReplayKey]int64)
+	}
+	mp.replay[key] = fromNtp(uint32(key.timestamp>>32), uint32(key.timestamp)) + int64(mp.MaxSkew)
+	return true
+}
+
+// envelopeKeys derives the encryption, authentication and salting keys from the pre-shared key,
+// RFC 3830 chapter 4.1.4.
+func (mp *MikeyPsk) envelopeKeys(csbId uint32, rnd []byte) (encrKey, authKey, saltKey []byte) {
+	label := mikeyLabel(mikeyLabelEncr, mikeyEnvelopeCsId, csbId, rnd)
+	encrKey = mikeyPrf(mp.psk, label, 16)
+	binary.BigEndian.PutUint32(label, mikeyLabelAuth)
+	authKey = mikeyPrf(mp.psk, label, mikeyMacLength)
+	binary.BigEndian.PutUint32(label, mikeyLabelSalt)
+	saltKey = mikeyPrf(mp.psk, label, 14)
+	return
+}
+
+func mikeyLabel(constant uint32, csId byte, csbId uint32, rnd []byte) []byte {
+	label := make([]byte, 9, 9+len(rnd))
+	binary.BigEndian.PutUint32(label, constant)
+	label[4] = csId
+	binary.BigEndian.PutUint32(label[5:], csbId)
+	return append(label, rnd...)
+}
+
+// mikeyPrf implements the MIKEY PRF of RFC 3830 chapter 4.1.2. The function splits the input key
+// into 256 bit parts and XORs the P functions of all parts.
+func mikeyPrf(inkey, label []byte, length int) []byte {
+	out := make([]byte, length)
+	for len(inkey) > 0 {
+		part := inkey
+		if len(part) > 32 {
+			part = part[:32]
+		}
+		inkey = inkey[len(part):]
+		p := mikeyP(part, label, length)
+		for i := range out {
+			out[i] ^= p[i]
+		}
+	}
+	return out
+}
+
+// mikeyP computes HMAC(s, A_1 || label) || HMAC(s, A_2 || label) || ... with A_0 = label and
+// A_i = HMAC(s, A_(i-1)).
+func mikeyP(s, label []byte, length int) []byte {
+	mac := hmac.New(sha1.New, s)
+	var out []byte
+	a := label
+	for len(out) < length {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(label)
+		out = mac.Sum(out)
+	}
+	return out[:length]
+}
+
+// mikeyAesCm en- or decrypts data in place with AES-CM, the IV is
+// (S XOR (0x0000 || CSB ID || T)) || 0x0000, RFC 3830 chapter 4.2.3.
+func mikeyAesCm(key, salt []byte, csbId uint32, stamp uint64, data []byte) {
+	block, _ := aes.NewCipher(key)
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, salt)
+	var x [14]byte
+	binary.BigEndian.PutUint32(x[2:], csbId)
+	binary.BigEndian.PutUint64(x[6:], stamp)
+	for i := range x {
+		iv[i] ^= x[i]
+	}
+	cipher.NewCTR(block, iv).XORKeyStream(data, data)
+}
+
+func mikeyMac(authKey, data []byte) []byte {
+	mac := hmac.New(sha1.New, authKey)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// mikeyVerifyData returns the data the MAC of a verification message covers: the R_MESSAGE
+// without the MAC, the identities, and the timestamp of the I_MESSAGE.
+func mikeyVerifyData(resp []byte, ids [][]byte, stamp uint64) []byte {
+	data := append([]byte{}, resp...)
+	for _, id := range ids {
+		data = append(data, id...)
+	}
+	var t [8]byte
+	binary.BigEndian.PutUint64(t[:], stamp)
+	return append(data, t[:]...)
+}
+
+func mikeyHeader(dataType byte, verify bool, csbId uint32, sessions []MikeyCryptoSession, next byte) []byte {
+	hdr := []byte{mikeyVersion, dataType, next, 0, 0, 0, 0, 0, byte(len(sessions)), mikeySrtpIdMap}
+	if verify {
+		hdr[3] = 0x80
+	}
+	binary.BigEndian.PutUint32(hdr[4:], csbId)
+	for _, cs := range sessions {
+		var info [9]byte
+		info[0] = cs.PolicyNo
+		binary.BigEndian.PutUint32(info[1:], cs.Ssrc)
+		binary.BigEndian.PutUint32(info[5:], cs.Roc)
+		hdr = append(hdr, info[:]...)
+	}
+	return hdr
+}
+
+func mikeyTimestamp(msg []byte, stamp uint64, next byte) []byte {
+	var t [8]byte
+	binary.BigEndian.PutUint64(t[:], stamp)
+	msg = append(msg, next, mikeyNtpUtc)
+	return append(msg, t[:]...)
+}
+
+func mikeyPolicySupported(policy map[byte][]byte) bool {
+	for i := 0; i < len(mikeySrtpPolicy); i += 3 {
+		if v, ok := policy[mikeySrtpPolicy[i]]; ok && (len(v) != 1 || v[0] != mikeySrtpPolicy[i+2]) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseMikey parses a MIKEY message. It supports the payloads of the pre-shared key mode.
+func parseMikey(msg []byte) (*mikeyMessage, error) {
+	errShort := Error("MIKEY: message too short.")
+	if len(msg) < 10 {
+		return nil, errShort
+	}
+	if msg[0] != mikeyVersion {
+		return nil, Error("MIKEY: unsupported version.")
+	}
+	m := &mikeyMessage{dataType: msg[1], verify: msg[3]&0x80 != 0, csbId: binary.BigEndian.Uint32(msg[4:])}
+	if msg[3]&0x7f != 0 {
+		return nil, Error("MIKEY: unsupported PRF.")
+	}
+	if msg[9] != mikeySrtpIdMap {
+		return nil, Error("MIKEY: unsupported CS ID map type.")
+	}
+	next := msg[2]
+	offset := 10
+	for i := 0; i < int(msg[8]); i++ {
+		if len(msg) < offset+9 {
+			return nil, errShort
+		}
+		m.cryptoSessions = append(m.cryptoSessions, MikeyCryptoSession{PolicyNo: msg[offset],
+			Ssrc: binary.BigEndian.Uint32(msg[offset+1:]), Roc: binary.BigEndian.Uint32(msg[offset+5:])})
+		offset += 9
+	}
+	for next != mikeyLastPayload {
+		if len(msg) < offset+2 {
+			return nil, errShort
+		}
+		payload := next
+		next = msg[offset]
+		var length int
+		switch payload {
+		case mikeyTPayload:
+			if msg[offset+1] != mikeyNtpUtc && msg[offset+1] != 1 {
+				return nil, Error("MIKEY: unsupported timestamp type.")
+			}
+			length = 10
+			if len(msg) >= offset+length {
+				m.timestamp = binary.BigEndian.Uint64(msg[offset+2:])
+			}
+		case mikeyRandPayload:
+			length = 2 + int(msg[offset+1])
+			if len(msg) >= offset+length {
+				m.rand = msg[offset+2 : offset+length]
+			}
+		case mikeyIdPayload:
+			if len(msg) < offset+4 {
+				return nil, errShort
+			}
+			length = 4 + int(binary.BigEndian.Uint16(msg[offset+2:]))
+			if len(msg) >= offset+length {
+				m.ids = append(m.ids, msg[offset+4:offset+length])
+			}
+		case mikeySpPayload:
+			if len(msg) < offset+5 {
+				return nil, errShort
+			}
+			length = 5 + int(binary.BigEndian.Uint16(msg[offset+3:]))
+			if len(msg) >= offset+length && msg[offset+1] == 0 && msg[offset+2] == mikeySrtpProtocol {
+				m.policy = make(map[byte][]byte)
+				for p := offset + 5; p+2 <= offset+length; {
+					end := p + 2 + int(msg[p+1])
+					if end > offset+length {
+						return nil, Error("MIKEY: invalid security policy.")
+					}
+					m.policy[msg[p]] = msg[p+2 : end]
+					p = end
+				}
+			}
+		case mikeyKemacPayload:
+			if len(msg) < offset+4 {
+				return nil, errShort
+			}
+			if msg[offset+1] != mikeyAesCm128 {
+				return nil, Error("MIKEY: unsupported KEMAC encryption algorithm.")
+			}
+			encrLen := int(binary.BigEndian.Uint16(msg[offset+2:]))
+			length = 4 + encrLen + 1 + mikeyMacLength
+			if len(msg) >= offset+length {
+				m.encrData = msg[offset+4 : offset+4+encrLen]
+				if msg[offset+4+encrLen] != mikeyHmacSha1 {
+					return nil, Error("MIKEY: unsupported KEMAC MAC algorithm.")
+				}
+				m.macOffset = offset + 5 + encrLen
+			}
+		case mikeyVPayload:
+			if msg[offset+1] != mikeyHmacSha1 {
+				return nil, Error("MIKEY: unsupported verification MAC algorithm.")
+			}
+			length = 2 + mikeyMacLength
+			m.macOffset = offset + 2
+		default:
+			return nil, Error("MIKEY: unsupported payload type.")
+		}
+		if len(msg) < offset+length {
+			return nil, errShort
+		}
+		offset += length
+	}
+	if m.macOffset > 0 {
+		m.mac = msg[m.macOffset : m.macOffset+mikeyMacLength]
+	}
+	return m, nil
+}
@@ -0,0 +1,174 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestMikey(t *testing.T) {
+	parseFlags()
+
+	psk := []byte("0123456789abcdef0123456789abcdef0123")
+	initiator, _ := NewMikeyPsk(psk)
+	responder, _ := NewMikeyPsk(psk)
+
+	sessions := []MikeyCryptoSession{{Ssrc: 0x01020304}, {Ssrc: 0x05060708, Roc: 3}}
+	msg, keys, err := initiator.Initiate(sessions, true)
+	if err != nil {
+		t.Errorf("MIKEY initiate failed: %s\n", err)
+		return
+	}
+	recvKeys, resp, err := responder.Respond(msg)
+	if err != nil {
+		t.Errorf("MIKEY respond failed: %s\n", err)
+		return
+	}
+	if !bytes.Equal(recvKeys.Tgk, keys.Tgk) || len(recvKeys.CryptoSessions) != 2 || recvKeys.CryptoSessions[1].Roc != 3 {
+		t.Errorf("MIKEY key material check failed\n")
+	}
+	for cs := range sessions {
+		key := keys.SrtpKey(cs)
+		if len(key) != SrtpMasterKeyLength+SrtpMasterSaltLength || !bytes.Equal(key, recvKeys.SrtpKey(cs)) {
+			t.Errorf("MIKEY SRTP key check failed for crypto session %d\n", cs)
+		}
+	}
+	if bytes.Equal(keys.SrtpKey(0), keys.SrtpKey(1)) {
+		t.Errorf("MIKEY crypto sessions must have different keys\n")
+	}
+	if _, err = NewTransportSRTP(nil, nil, keys.SrtpKey(0), recvKeys.SrtpKey(0)); err != nil {
+		t.Errorf("MIKEY keys not usable for SRTP: %s\n", err)
+	}
+	if err = initiator.CheckVerification(keys, resp); err != nil {
+		t.Errorf("MIKEY verification failed: %s\n", err)
+	}
+	resp[len(resp)-1] ^= 1
+	if initiator.CheckVerification(keys, resp) == nil {
+		t.Errorf("MIKEY modified verification check failed\n")
+	}
+
+	// modified message or wrong key must fail
+	msg[len(msg)-25] ^= 1
+	if _, _, err = responder.Respond(msg); err == nil {
+		t.Errorf("MIKEY modified message check failed\n")
+	}
+	msg[len(msg)-25] ^= 1
+	other, _ := NewMikeyPsk([]byte("fedcba9876543210fedcba9876543210"))
+	if _, _, err = other.Respond(msg); err == nil {
+		t.Errorf("MIKEY wrong key check failed\n")
+	}
+	// no verification requested
+	msg, _, _ = initiator.Initiate(sessions[:1], false)
+	if _, resp, err = responder.Respond(msg); err != nil || resp != nil {
+		t.Errorf("MIKEY no verification check failed: %v\n", err)
+	}
+	// the responder accepts a message once, another responder has its own cache
+	if _, _, err = responder.Respond(msg); err == nil {
+		t.Errorf("MIKEY replay check failed\n")
+	}
+	second, _ := NewMikeyPsk(psk)
+	if _, _, err = second.Respond(msg); err != nil {
+		t.Errorf("MIKEY replay cache of a second responder check failed: %s\n", err)
+	}
+	// an expired entry leaves the cache
+	responder.replay[mikeyReplayKey{csbId: 1}] = time.Now().UnixNano() - 1
+	responder.Respond(msg)
+	if _, ok := responder.replay[mikeyReplayKey{csbId: 1}]; ok || len(responder.replay) != 2 {
+		t.Errorf("MIKEY replay cache expiry check failed: %d entries\n", len(responder.replay))
+	}
+}
+
+func TestMikeyKnownAnswer(t *testing.T) {
+	parseFlags()
+
+	// TEK and its salt of the first crypto session, RFC 3830 chapter 4.1.3
+	rnd := make([]byte, 16)
+	keys := &MikeyKeys{CsbId: 0x01020304, Tgk: make([]byte, 16), Rand: rnd}
+	for i := range keys.Tgk {
+		keys.Tgk[i], rnd[i] = byte(i), byte(0x10+i)
+	}
+	if key := hex.EncodeToString(keys.SrtpKey(0)); key != "a488dab36184e8d41ae26cb6daf5405e"+"bfd77adf6b9118d13fffbcd4b407" {
+		t.Errorf("MIKEY TEK known answer check failed: %s\n", key)
+	}
+	// the envelope keys of a 36 byte pre-shared key: the PRF combines two key parts
+	mp, _ := NewMikeyPsk([]byte("0123456789abcdef0123456789abcdef0123"))
+	encrKey, authKey, saltKey := mp.envelopeKeys(0x01020304, rnd)
+	if hex.EncodeToString(encrKey) != "a0add99a8b72cf1908678ed1486d8c4d" ||
+		hex.EncodeToString(authKey) != "ea0e0a8ee8ab026845b1bb6bfb2e58d03399be30" ||
+		hex.EncodeToString(saltKey) != "e4a22a00e6d0b14bc9e840100d48" {
+		t.Errorf("MIKEY envelope key known answer check failed: %x, %x, %x\n", encrKey, authKey, saltKey)
+	}
+}
+
+func TestMikeyMalformed(t *testing.T) {
+	parseFlags()
+
+	psk := []byte("0123456789abcdef0123456789abcdef0123")
+	initiator, _ := NewMikeyPsk(psk)
+	responder, _ := NewMikeyPsk(psk)
+	msg, _, _ := initiator.Initiate([]MikeyCryptoSession{{Ssrc: 0x01020304}}, true)
+
+	// every truncated message fails, none panics
+	for n := 0; n < len(msg); n++ {
+		if _, _, err := responder.Respond(msg[:n]); err == nil {
+			t.Errorf("MIKEY truncated message of %d bytes accepted\n", n)
+		}
+	}
+	modify := func(offset int, value byte) []byte {
+		m := append([]byte{}, msg...)
+		m[offset] = value
+		return m
+	}
+	// the header, one crypto session, the T payload at 19 and the RAND payload at 29
+	for _, c := range []struct {
+		name string
+		msg  []byte
+	}{
+		{"version", modify(0, 2)},
+		{"PRF", modify(3, 0x81)},
+		{"CS ID map type", modify(9, 1)},
+		{"crypto session count", modify(8, 200)},
+		{"first payload type", modify(2, 42)},
+		{"timestamp type", modify(20, 7)},
+		{"RAND length", modify(30, 0xff)},
+	} {
+		if _, err := parseMikey(c.msg); err == nil {
+			t.Errorf("MIKEY malformed %s accepted\n", c.name)
+		}
+	}
+	if _, _, err := responder.Respond(modify(1, MikeyPskVerify)); err == nil {
+		t.Errorf("MIKEY verification message accepted as I_MESSAGE\n")
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		m := append([]byte{}, msg[:rnd.Intn(len(msg))]...)
+		for j := rnd.Intn(4); j >= 0 && len(m) > 10; j-- {
+			m[10+rnd.Intn(len(m)-10)] = byte(rnd.Intn(256))
+		}
+		parseMikey(m)
+		initiator.CheckVerification(&MikeyKeys{}, m)
+	}
+	if _, _, err := responder.Respond(msg); err != nil {
+		t.Errorf("MIKEY message check failed after the malformed messages: %s\n", err)
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// FrameDecoder decodes the payload of a received RTP packet into a frame of PCM samples. The
+// bridge calls the decoder once per packet, thus a decoder may keep a state per SSRC.
+type FrameDecoder interface {
+	Decode(ssrc uint32, payload []byte) (pcm []int16, err error)
+}
+
+// FrameEncoder encodes a mixed frame for a participant. The bridge encodes a separate mix for
+// each participant, thus an encoder may keep a state per participant.
+type FrameEncoder interface {
+	Encode(participant uint32, pcm []int16) (payload []byte, err error)
+}
+
+// MixFunc mixes the frames of the contributing sources, the map key is the SSRC of the source.
+// The map never contains the frame of the participant that receives the mix.
+type MixFunc func(frames map[uint32][]int16) []int16
+
+// MixerBridge is the scaffolding of an audio conference bridge, a RTP mixer as specified in
+// RFC 3550, chapter 7.1.
+//
+// The application pushes the received packets of the participants into the bridge. The bridge
+// decodes them and queues the frames per participant. On every tick of its clock it takes one
+// frame of each participant and sends each participant the mix of all other participants
+// (mix-minus), on the participant's output stream. The CSRC list of the packet names the
+// contributing sources. The bridge sets the timestamps of the output streams from its clock and
+// the marker bit on the first packet after a silence, i.e. a tick without contributors.
+//
+type MixerBridge struct {
+	decoder FrameDecoder
+	encoder FrameEncoder
+	mix     MixFunc
+	tick    time.Duration
+	samples uint32
+
+	mutex        sync.Mutex
+	participants map[uint32]*mixParticipant
+	stop         chan bool
+	drops        uint32
+}
+
+type mixParticipant struct {
+	rs          *Session
+	streamIndex uint32
+	frames      [][]int16 // decoded frames waiting for the next ticks
+	stamp       uint32    // timestamp of the next packet of the output stream
+	silent      bool      // no packet sent at the last tick
+}
+
+// mixQueueLength is the number of frames the bridge queues per participant, further frames
+// replace the oldest frame.
+const mixQueueLength = 5
+
+// NewMixerBridge creates a bridge. It returns an error if the tick or the samples are zero.
+//
+//   decoder - decodes the received payloads
+//   encoder - encodes the mixes
+//   mix     - mixes the frames of one tick
+//   tick    - the frame duration, e.g. 20 ms
+//   samples - the timestamp units of a frame in the output streams, e.g. 160 for 20 ms PCMU
+//
+func NewMixerBridge(decoder FrameDecoder, encoder FrameEncoder, mix MixFunc, tick time.Duration, samples uint32) (*MixerBridge, error) {
+	if tick <= 0 || samples == 0 {
+		return nil, Error("MixerBridge: tick and samples must be positive.")
+	}
+	return &MixerBridge{decoder: decoder, encoder: encoder, mix: mix, tick: tick, samples: samples,
+		participants: make(map[uint32]*mixParticipant)}, nil
+}
+
+// AddParticipant adds a participant. The bridge mixes the frames of the participant's SSRC and
+// sends the mix of the other participants on the output stream.
+//
+//   ssrc        - the SSRC the participant sends
+//   rs          - the session that sends the mix to the participant
+//   streamIndex - the index of the output stream as returned by NewSsrcStreamOut
+//
+func (mb *MixerBridge) AddParticipant(ssrc uint32, rs *Session, streamIndex uint32) {
+	mb.mutex.Lock()
+	mb.participants[ssrc] = &mixParticipant{rs: rs, streamIndex: streamIndex, silent: true}
+	mb.mutex.Unlock()
+}
+
+// RemoveParticipant removes the participant with the SSRC.
+func (mb *MixerBridge) RemoveParticipant(ssrc uint32) {
+	mb.mutex.Lock()
+	delete(mb.participants, ssrc)
+	mb.mutex.Unlock()
+}
+
+// Push decodes a received packet and queues the frame of its participant. It frees the packet.
+// Packets of unknown SSRCs and packets the decoder rejects count as drops.
+func (mb *MixerBridge) Push(rp *DataPacket) {
+	defer rp.FreePacket()
+	ssrc := rp.Ssrc()
+	mb.mutex.Lock()
+	_, known := mb.participants[ssrc]
+	mb.mutex.Unlock()
+	if !known {
+		mb.drop()
+		return
+	}
+	pcm, err := mb.decoder.Decode(ssrc, rp.Payload())
+	if err != nil {
+		mb.drop()
+		return
+	}
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	if p, ok := mb.participants[ssrc]; ok {
+		if len(p.frames) >= mixQueueLength {
+			p.frames = p.frames[1:]
+			mb.drops++
+		}
+		p.frames = append(p.frames, pcm)
+	}
+}
+
+// Drops returns the number of dropped packets and frames.
+func (mb *MixerBridge) Drops() uint32 {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	return mb.drops
+}
+
+// Start starts the clock of the bridge.
+func (mb *MixerBridge) Start() {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	if mb.stop != nil {
+		return
+	}
+	mb.stop = make(chan bool)
+	go mb.run(mb.stop)
+}
+
+// Stop stops the clock of the bridge.
+func (mb *MixerBridge) Stop() {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+	if mb.stop != nil {
+		close(mb.stop)
+		mb.stop = nil
+	}
+}
+
+// *** Local functions and methods.
+
+func (mb *MixerBridge) run(stop chan bool) {
+	ticker := time.NewTicker(mb.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			mb.mixTick()
+		}
+	}
+}
+
+func (mb *MixerBridge) drop() {
+	mb.mutex.Lock()
+	mb.drops++
+	mb.mutex.Unlock()
+}
+
+// mixOutput is the mix of one participant for one tick.
+type mixOutput struct {
+	p      *mixParticipant
+	ssrc   uint32
+	frames map[uint32][]int16
+	csrcs  []uint32
+	stamp  uint32
+	marker bool
+}
+
+// mixTick takes one frame of each participant and sends the mixes. The mixing, the encoding and
+// the sending happen outside the mutex.
+func (mb *MixerBridge) mixTick() {
+	mb.mutex.Lock()
+	frames := make(map[uint32][]int16)
+	for ssrc, p := range mb.participants {
+		if len(p.frames) > 0 {
+			frames[ssrc] = p.frames[0]
+			p.frames = p.frames[1:]
+		}
+	}
+	var outputs []mixOutput
+	for ssrc, p := range mb.participants {
+		out := mixOutput{p: p, ssrc: ssrc, frames: make(map[uint32][]int16), stamp: p.stamp}
+		for src, frame := range frames {
+			if src != ssrc {
+				out.frames[src] = frame
+				out.csrcs = append(out.csrcs, src)
+			}
+		}
+		p.stamp += mb.samples
+		if len(out.frames) == 0 {
+			p.silent = true
+			continue
+		}
+		out.marker, p.silent = p.silent, false
+		outputs = append(outputs, out)
+	}
+	mb.mutex.Unlock()
+
+	for i := range outputs {
+		mb.send(&outputs[i])
+	}
+}
+
+// send encodes and sends the mix of a participant. A RTP packet holds up to 15 CSRCs.
+func (mb *MixerBridge) send(out *mixOutput) {
+	payload, err := mb.encoder.Encode(out.ssrc, mb.mix(out.frames))
+	if err != nil {
+		mb.drop()
+		return
+	}
+	sort.Slice(out.csrcs, func(i, j int) bool { return out.csrcs[i] < out.csrcs[j] })
+	if len(out.csrcs) > 15 {
+		out.csrcs = out.csrcs[:15]
+	}
+	rp := out.p.rs.NewDataPacketForStream(out.p.streamIndex, out.stamp)
+	rp.SetCsrcList(out.csrcs)
+	rp.SetMarker(out.marker)
+	rp.SetPayload(payload)
+	out.p.rs.WriteData(rp)
+	rp.FreePacket()
+}
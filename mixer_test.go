@@ -0,0 +1,142 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// byteCodec maps each payload byte to a sample and back.
+type byteCodec struct{}
+
+func (byteCodec) Decode(ssrc uint32, payload []byte) ([]int16, error) {
+	if len(payload) == 0 {
+		return nil, Error("empty payload")
+	}
+	pcm := make([]int16, len(payload))
+	for i, b := range payload {
+		pcm[i] = int16(b)
+	}
+	return pcm, nil
+}
+
+func (byteCodec) Encode(participant uint32, pcm []int16) ([]byte, error) {
+	payload := make([]byte, len(pcm))
+	for i, s := range pcm {
+		payload[i] = byte(s)
+	}
+	return payload, nil
+}
+
+func sumMix(frames map[uint32][]int16) []int16 {
+	mix := make([]int16, 4)
+	for _, frame := range frames {
+		for i := range mix {
+			mix[i] += frame[i]
+		}
+	}
+	return mix
+}
+
+func mixerPacket(ssrc uint32, sample byte) *DataPacket {
+	rp := newDataPacket()
+	rp.SetSsrc(ssrc)
+	rp.SetPayload([]byte{sample, sample, sample, sample})
+	return rp
+}
+
+func TestMixerBridge(t *testing.T) {
+	parseFlags()
+
+	if _, err := NewMixerBridge(byteCodec{}, byteCodec{}, sumMix, 0, 160); err == nil {
+		t.Errorf("MixerBridge must reject a zero tick\n")
+	}
+	cw := new(captureWriter)
+	rs := NewSession(cw, new(teeConsumer))
+	drainCtrl(t, rs)
+	rs.AddRemote(&Address{IpAddr: net.IPv4(127, 0, 0, 1), DataPort: 6002, CtrlPort: 6003})
+	mb, _ := NewMixerBridge(byteCodec{}, byteCodec{}, sumMix, 20*time.Millisecond, 160)
+
+	// Participant n sends SSRC 10+n, the bridge sends the mix to it on SSRC 20+n
+	outSsrc := make(map[uint32]uint32)
+	for n := uint32(1); n <= 3; n++ {
+		idx, _ := rs.NewSsrcStreamOut(&Address{IpAddr: net.IPv4(127, 0, 0, 1), DataPort: 6000, CtrlPort: 6001}, 20+n, 1)
+		rs.SsrcStreamOutForIndex(idx).SetPayloadType(0)
+		mb.AddParticipant(10+n, rs, idx)
+		outSsrc[20+n] = 10 + n
+	}
+	mb.Push(mixerPacket(99, 1))
+	mb.Push(mixerPacket(11, 1))
+	mb.Push(mixerPacket(12, 2))
+	mb.Push(mixerPacket(13, 4))
+	if mb.Drops() != 1 {
+		t.Errorf("Unknown SSRC drop check failed: %d\n", mb.Drops())
+	}
+	mb.mixTick()
+	if len(cw.data) != 3 {
+		t.Errorf("Mix-minus must send one packet per participant, got: %d\n", len(cw.data))
+		return
+	}
+	expected := map[uint32]byte{11: 6, 12: 5, 13: 3}
+	stamps := make(map[uint32]uint32)
+	for _, buf := range cw.data {
+		rp, _ := NewDataPacketFromBuffer(buf)
+		own := outSsrc[rp.Ssrc()]
+		if rp.Payload()[0] != expected[own] {
+			t.Errorf("Mix-minus of %d check failed, got: %d\n", own, rp.Payload()[0])
+		}
+		csrcs := rp.CsrcList()
+		if len(csrcs) != 2 {
+			t.Errorf("CSRC count check failed: %d\n", len(csrcs))
+		}
+		for _, csrc := range csrcs {
+			if csrc == own {
+				t.Errorf("The CSRC list must not contain the own SSRC %d\n", own)
+			}
+		}
+		if !rp.Marker() {
+			t.Errorf("The first packet must have the marker bit\n")
+		}
+		stamps[rp.Ssrc()] = rp.Timestamp()
+	}
+
+	// Only participant 1 talks: it gets nothing, the others get its frame on the next timestamps
+	cw.data = nil
+	mb.mixTick() // silence
+	mb.Push(mixerPacket(11, 7))
+	mb.mixTick()
+	if len(cw.data) != 2 {
+		t.Errorf("Single talker check failed, got: %d packets\n", len(cw.data))
+		return
+	}
+	for _, buf := range cw.data {
+		rp, _ := NewDataPacketFromBuffer(buf)
+		if outSsrc[rp.Ssrc()] == 11 || rp.Payload()[0] != 7 {
+			t.Errorf("Single talker mix check failed for %d\n", rp.Ssrc())
+		}
+		if rp.Timestamp()-stamps[rp.Ssrc()] != 320 {
+			t.Errorf("Timestamp check failed, delta: %d\n", rp.Timestamp()-stamps[rp.Ssrc()])
+		}
+		if !rp.Marker() {
+			t.Errorf("The first packet after the silence must have the marker bit\n")
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the membership refresh of the multicast groups of TransportUDP.
+ */
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// MulticastRejoin describes a re-join of the multicast group, see SetMulticastRefresh.
+type MulticastRejoin struct {
+	Silent  bool          // the transport re-joined because the group went silent
+	Silence time.Duration // the time since the last RTP packet or the last join
+	Err     error         // the error of the re-join, nil if it succeeded
+}
+
+// SetMulticastRefresh re-joins the transport's multicast group, either periodically or when
+// the group goes silent. Some switches lose their IGMP or MLD snooping state, for example
+// after a firmware restart or a lost membership query, and stop forwarding the group; the
+// transport then goes quiet forever. A re-join leaves the group and joins it again on both
+// sockets, the kernel sends new unsolicited membership reports.
+//
+// Leaving the group may prune the group on the first hop for a moment, prefer the silence
+// detection or a long interval. Call SetMulticastRefresh after ListenOnTransports, CloseRecv
+// stops the refresh. Zero for both durations stops the refresh.
+//
+//   interval - the time between two periodic re-joins, 0 disables them
+//   silence  - the time without RTP packets after which the transport re-joins, 0 disables
+//              the silence detection. After a re-join the transport waits the full time again.
+//   handler  - called after each re-join on the refresh goroutine, may be nil
+//
+func (tp *TransportUDP) SetMulticastRefresh(interval, silence time.Duration, handler func(ev MulticastRejoin)) error {
+	if !tp.multicast {
+		return Error("SetMulticastRefresh: not a multicast transport.")
+	}
+	if tp.dataConn == nil {
+		return Error("SetMulticastRefresh: the transport does not listen.")
+	}
+	if interval < 0 || silence < 0 {
+		return Error("SetMulticastRefresh: negative duration.")
+	}
+	tp.refreshMutex.Lock()
+	defer tp.refreshMutex.Unlock()
+	if tp.refreshStop != nil {
+		close(tp.refreshStop)
+		tp.refreshStop = nil
+	}
+	if interval == 0 && silence == 0 {
+		return nil
+	}
+	tp.refreshStop = make(chan bool)
+	go tp.refreshMulticast(interval, silence, handler, tp.refreshStop)
+	return nil
+}
+
+// MulticastRejoins returns the number of re-joins of the multicast group.
+func (tp *TransportUDP) MulticastRejoins() uint32 {
+	return atomic.LoadUint32(&tp.rejoins)
+}
+
+// stopMulticastRefresh stops the refresh goroutine, if it runs.
+func (tp *TransportUDP) stopMulticastRefresh() {
+	tp.refreshMutex.Lock()
+	if tp.refreshStop != nil {
+		close(tp.refreshStop)
+		tp.refreshStop = nil
+	}
+	tp.refreshMutex.Unlock()
+}
+
+// refreshMulticast checks at a quarter of the silence time or at the interval whether the
+// group needs a re-join.
+func (tp *TransportUDP) refreshMulticast(interval, silence time.Duration, handler func(ev MulticastRejoin), stop chan bool) {
+	tick := interval
+	if silence > 0 && (tick == 0 || silence/4 < tick) {
+		tick = silence / 4
+	}
+	if tick <= 0 {
+		tick = silence
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	lastJoin := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			last := lastJoin
+			if recv := atomic.LoadInt64(&tp.lastDataRecv); recv > last.UnixNano() {
+				last = time.Unix(0, recv)
+			}
+			silent := silence > 0 && now.Sub(last) >= silence
+			if !silent && (interval == 0 || now.Sub(lastJoin) < interval) {
+				continue
+			}
+			err := tp.rejoinGroup(tp.dataConn)
+			if cerr := tp.rejoinGroup(tp.ctrlConn); err == nil {
+				err = cerr
+			}
+			lastJoin = now
+			atomic.AddUint32(&tp.rejoins, 1)
+			if handler != nil {
+				handler(MulticastRejoin{Silent: silent, Silence: now.Sub(last), Err: err})
+			}
+		}
+	}
+}
+
+// rejoinGroup leaves the socket's group and joins it again. The leave may fail if the kernel
+// lost the membership, the join decides.
+func (tp *TransportUDP) rejoinGroup(conn *net.UDPConn) error {
+	group := &net.UDPAddr{IP: tp.localAddrRtp.IP}
+	if group.IP.To4() == nil {
+		// source-specific groups are IPv4 only, the kernel sends MLD reports for the join
+		p := ipv6.NewPacketConn(conn)
+		p.LeaveGroup(tp.multicastIfi, group)
+		return p.JoinGroup(tp.multicastIfi, group)
+	}
+	p := ipv4.NewPacketConn(conn)
+	if tp.multicastSource != nil {
+		source := &net.UDPAddr{IP: tp.multicastSource}
+		p.LeaveSourceSpecificGroup(tp.multicastIfi, group, source)
+		return p.JoinSourceSpecificGroup(tp.multicastIfi, group, source)
+	}
+	p.LeaveGroup(tp.multicastIfi, group)
+	return p.JoinGroup(tp.multicastIfi, group)
+}
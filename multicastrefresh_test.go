@@ -0,0 +1,103 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv6"
+)
+
+func TestMulticastRefresh(t *testing.T) {
+	parseFlags()
+
+	unicast, _ := NewTransportUDP(&net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}, 54090)
+	if err := unicast.SetMulticastRefresh(time.Second, 0, nil); err == nil {
+		t.Errorf("SetMulticastRefresh accepted a unicast transport\n")
+	}
+	tp, _ := NewTransportUDPMulticast(&net.IPAddr{IP: net.IPv4(239, 1, 2, 3)}, 54090, nil)
+	if err := tp.SetMulticastRefresh(time.Second, 0, nil); err == nil {
+		t.Errorf("SetMulticastRefresh accepted a transport that does not listen\n")
+	}
+	// the refresh only needs the sockets, the join result goes to the handler
+	tp.dataConn, _ = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	tp.ctrlConn, _ = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer tp.CloseRecv()
+	if err := tp.SetMulticastRefresh(-time.Second, 0, nil); err == nil {
+		t.Errorf("SetMulticastRefresh accepted a negative interval\n")
+	}
+
+	events := make(chan MulticastRejoin, 8)
+	tp.SetMulticastRefresh(0, 40*time.Millisecond, func(ev MulticastRejoin) { events <- ev })
+	select {
+	case ev := <-events:
+		if !ev.Silent || ev.Silence < 40*time.Millisecond {
+			t.Errorf("silence re-join check failed: %+v\n", ev)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("silent group not re-joined\n")
+	}
+
+	tp.SetMulticastRefresh(30*time.Millisecond, 0, func(ev MulticastRejoin) { events <- ev })
+	for len(events) > 0 {
+		<-events
+	}
+	select {
+	case ev := <-events:
+		if ev.Silent {
+			t.Errorf("periodic re-join check failed: %+v\n", ev)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no periodic re-join\n")
+	}
+	if tp.MulticastRejoins() < 2 {
+		t.Errorf("MulticastRejoins check failed: %d\n", tp.MulticastRejoins())
+	}
+	tp.SetMulticastRefresh(0, 0, nil)
+	time.Sleep(10 * time.Millisecond) // a tick in progress completes
+	count := tp.MulticastRejoins()
+	time.Sleep(80 * time.Millisecond)
+	if tp.MulticastRejoins() != count {
+		t.Errorf("stopped refresh re-joined\n")
+	}
+}
+
+func TestMulticastRejoinIpv6(t *testing.T) {
+	parseFlags()
+
+	group := &net.UDPAddr{IP: net.ParseIP("ff15::1:2")}
+	tp, err := NewTransportUDPMulticast(&net.IPAddr{IP: group.IP}, 54092, nil)
+	if err != nil {
+		t.Errorf("IPv6 multicast transport not created: %v\n", err)
+		return
+	}
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified})
+	if err != nil {
+		t.Skipf("no IPv6 socket: %v", err)
+	}
+	defer conn.Close()
+	if err = ipv6.NewPacketConn(conn).JoinGroup(nil, group); err != nil {
+		t.Skipf("no IPv6 multicast route: %v", err)
+	}
+	if err = tp.rejoinGroup(conn); err != nil {
+		t.Errorf("IPv6 re-join failed: %v\n", err)
+	}
+}
@@ -0,0 +1,429 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Feedback message types (FMT) of RTPFB packets.
+const (
+	RtpfbNack = 1 // Generic NACK [RFC4585]
+)
+
+// ParseNack returns the sequence numbers a Generic NACK requests, RFC 4585 chapter 6.2.1.
+//
+// Each FCI entry holds a packet ID (PID) and a bitmask of following lost packets (BLP), thus
+// one entry requests up to 17 packets.
+//
+//   fci - the feedback control information of the NACK, a multiple of 4 bytes
+//
+func ParseNack(fci []byte) (seqs []uint16) {
+	for ; len(fci) >= 4; fci = fci[4:] {
+		pid := binary.BigEndian.Uint16(fci)
+		blp := binary.BigEndian.Uint16(fci[2:])
+		seqs = append(seqs, pid)
+		for i := uint16(0); i < 16; i++ {
+			if blp&(1<<i) != 0 {
+				seqs = append(seqs, pid+i+1)
+			}
+		}
+	}
+	return
+}
+
+// NackFci builds the FCI entries of a Generic NACK for the lost sequence numbers. One entry
+// covers a packet and the 16 packets that follow it.
+//
+//   seqs - the sequence numbers of the lost packets in ascending order, modulo 2^16
+//
+func NackFci(seqs []uint16) []byte {
+	var fci []byte
+	for i := 0; i < len(seqs); {
+		pid := seqs[i]
+		var blp uint16
+		for i++; i < len(seqs) && seqs[i]-pid >= 1 && seqs[i]-pid <= 16; i++ {
+			blp |= 1 << (seqs[i] - pid - 1)
+		}
+		fci = append(fci, byte(pid>>8), byte(pid), byte(blp>>8), byte(blp))
+	}
+	return fci
+}
+
+// NackResponder answers the Generic NACKs the receivers of an output stream send.
+//
+// The responder keeps copies of the last packets the stream sent. If a NACK arrives it
+// retransmits the requested packets that are still in the history, either as copies of the
+// original packets or as RTX packets, see SetRtx. The retransmissions of one NACK go through the
+// pacer one Spacing apart, this avoids bursts that cause new losses.
+//
+type NackResponder struct {
+	Spacing time.Duration // time between the retransmissions of one NACK, default 1 ms
+
+	rs    *Session
+	ssrc  uint32
+	str   *SsrcStream
+	pacer *Scheduler
+
+	mutex         sync.Mutex
+	history       []nackEntry
+	rtxSsrc       uint32
+	rtxPt         byte
+	rtxSeq        uint16
+	useRtx        bool
+	retransmitted uint32
+	missed        uint32
+}
+
+type nackEntry struct {
+	seq   uint16
+	valid bool
+	data  []byte
+}
+
+const nackSpacing = time.Millisecond
+
+// NewNackResponder creates a NACK responder for an output stream and enables it.
+//
+//   rs          - the session of the stream
+//   streamIndex - the index of the output stream as returned by NewSsrcStreamOut
+//   history     - the number of sent packets the responder keeps
+//   pacer       - the scheduler that sends the retransmissions, nil sends them immediately
+//
+func NewNackResponder(rs *Session, streamIndex uint32, history int, pacer *Scheduler) (*NackResponder, error) {
+	if err := rs.sendData(); err != nil {
+		return nil, err
+	}
+	str := rs.SsrcStreamOutForIndex(streamIndex)
+	if str == nil {
+		return nil, Error("No output stream at this index.")
+	}
+	if history <= 0 {
+		return nil, Error("NackResponder: history must be positive.")
+	}
+	nr := &NackResponder{Spacing: nackSpacing, rs: rs, ssrc: str.ssrc, str: str, pacer: pacer, history: make([]nackEntry, history)}
+	str.streamMutex.Lock()
+	str.nack = nr
+	str.streamMutex.Unlock()
+	return nr, nil
+}
+
+// SetRtx sends the retransmissions as RTX packets, RFC 4588, instead of copies of the original
+// packets.
+//
+//   ssrc - the SSRC of the RTX stream
+//   pt   - the RTX payload type
+//
+func (nr *NackResponder) SetRtx(ssrc uint32, pt byte) {
+	nr.mutex.Lock()
+	nr.rtxSsrc, nr.rtxPt, nr.useRtx = ssrc, pt, true
+	nr.mutex.Unlock()
+}
+
+// Retransmitted returns the number of retransmitted packets.
+func (nr *NackResponder) Retransmitted() uint32 {
+	nr.mutex.Lock()
+	defer nr.mutex.Unlock()
+	return nr.retransmitted
+}
+
+// Missed returns the number of requested packets that were no longer in the history.
+func (nr *NackResponder) Missed() uint32 {
+	nr.mutex.Lock()
+	defer nr.mutex.Unlock()
+	return nr.missed
+}
+
+// *** Local functions and methods.
+
+// record keeps a copy of the sent packet.
+func (nr *NackResponder) record(rp *DataPacket) {
+	seq := rp.Sequence()
+	nr.mutex.Lock()
+	e := &nr.history[int(seq)%len(nr.history)]
+	e.seq, e.valid = seq, true
+	e.data = append(e.data[:0], rp.buffer[0:rp.inUse]...)
+	nr.mutex.Unlock()
+}
+
+// handle retransmits the packets the NACK requests. Each packet is sent at most once per NACK.
+func (nr *NackResponder) handle(fci []byte) {
+	var packets []*DataPacket
+	seen := make(map[uint16]bool)
+	nr.mutex.Lock()
+	for _, seq := range ParseNack(fci) {
+		if seen[seq] {
+			continue
+		}
+		seen[seq] = true
+		e := &nr.history[int(seq)%len(nr.history)]
+		if !e.valid || e.seq != seq {
+			nr.missed++
+			continue
+		}
+		packets = append(packets, nr.retransmission(e.data))
+		nr.retransmitted++
+	}
+	nr.mutex.Unlock()
+
+	now := time.Now()
+	for i, rp := range packets {
+		if nr.pacer == nil {
+			nr.send(rp)
+			continue
+		}
+		rp := rp
+		nr.pacer.ScheduleClass(now.Add(time.Duration(i)*nr.Spacing), ClassRtx, func() { nr.send(rp) })
+	}
+}
+
+// send sends and frees a retransmission and counts it in the repair statistics of the stream.
+func (nr *NackResponder) send(rp *DataPacket) {
+	if !nr.rs.budgetAdmit(ClassRtx, rp) {
+		rp.FreePacket()
+		return
+	}
+	nr.rs.markClass(ClassRtx, rp)
+	if _, err := nr.rs.writeDataToRemotes(rp); err == nil {
+		nr.str.addRepair(rp, time.Now().UnixNano())
+	}
+	rp.FreePacket()
+}
+
+// retransmission creates the packet that retransmits the original packet. The caller holds the
+// mutex.
+func (nr *NackResponder) retransmission(data []byte) *DataPacket {
+	rp := newDataPacket()
+	rp.inUse = copy(rp.buffer, data)
+	if !nr.useRtx {
+		return rp
+	}
+	payOffset := int(rp.CsrcCount()*4+rtpHeaderLength) + rp.ExtensionLength()
+	osn := rp.Sequence()
+	copy(rp.buffer[payOffset+2:], data[payOffset:])
+	binary.BigEndian.PutUint16(rp.buffer[payOffset:], osn)
+	rp.inUse += 2
+	rp.SetSsrc(nr.rtxSsrc)
+	rp.SetPayloadType(nr.rtxPt)
+	rp.SetSequence(nr.rtxSeq)
+	nr.rtxSeq++
+	return rp
+}
+
+// NackGenerator sends Generic NACKs for the missing packets of an input stream.
+//
+// The generator tracks the sequence numbers the stream receives. It waits ReorderDelay before it
+// requests a missing packet, thus reordered packets don't cause NACKs, and repeats the request
+// with a backoff: the first retry follows after RetryInterval, every further retry doubles the
+// interval. The generator gives up on a packet if it arrives, after MaxRetries requests, if it
+// is more than MaxAge packets behind the highest received packet and thus too old for the jitter
+// buffer, or if Deadline passed since the generator detected the loss and the packet missed its
+// playout time.
+//
+// The generator sends the NACKs with the SSRC of the session's first output stream as packet
+// sender, following the session's feedback timing, see SetFeedbackMode and SetRtcpReducedSize.
+// The profiles without feedback messages drop the NACKs. Set the timers before Start.
+//
+type NackGenerator struct {
+	ReorderDelay  time.Duration // wait before the first NACK of a missing packet, default 10 ms
+	RetryInterval time.Duration // wait before the first retry, doubles with every retry, default 40 ms
+	MaxRetries    int           // number of NACKs per missing packet, default 5
+	MaxAge        uint16        // packets behind the highest received packet a NACK still makes sense, default 500
+	Deadline      time.Duration // playout deadline after the detection of a loss, default 500 ms
+
+	rs   *Session
+	ssrc uint32
+
+	mutex   sync.Mutex
+	started bool
+	highest uint16
+	missing map[uint16]*nackMiss
+	stats   NackStats
+	stop    chan bool
+}
+
+// NackStats contains the counters of a NackGenerator.
+type NackStats struct {
+	Nacks     uint32 // sent NACK packets
+	Requests  uint32 // requested packets, retries included
+	Recovered uint32 // requested packets that arrived
+	Expired   uint32 // missing packets the generator gave up on
+}
+
+type nackMiss struct {
+	detected time.Time
+	next     time.Time
+	retries  int
+}
+
+const (
+	nackReorderDelay  = 10 * time.Millisecond
+	nackRetryInterval = 40 * time.Millisecond
+	nackMaxRetries    = 5
+	nackMaxAge        = 500
+	nackDeadline      = 500 * time.Millisecond
+)
+
+// NewNackGenerator creates a NACK generator for an input stream.
+//
+//   rs   - the session that receives the stream
+//   ssrc - the SSRC of the input stream
+//
+func NewNackGenerator(rs *Session, ssrc uint32) *NackGenerator {
+	return &NackGenerator{
+		ReorderDelay:  nackReorderDelay,
+		RetryInterval: nackRetryInterval,
+		MaxRetries:    nackMaxRetries,
+		MaxAge:        nackMaxAge,
+		Deadline:      nackDeadline,
+		rs:            rs,
+		ssrc:          ssrc,
+		missing:       make(map[uint16]*nackMiss),
+	}
+}
+
+// Start starts to track the input stream and to send NACKs.
+func (ng *NackGenerator) Start() {
+	ng.mutex.Lock()
+	if ng.stop != nil {
+		ng.mutex.Unlock()
+		return
+	}
+	ng.stop = make(chan bool)
+	go ng.run(ng.tick(), ng.stop)
+	ng.mutex.Unlock()
+
+	ng.rs.streamsMapMutex.Lock()
+	if ng.rs.nackGenerators == nil {
+		ng.rs.nackGenerators = make(map[uint32]*NackGenerator)
+	}
+	ng.rs.nackGenerators[ng.ssrc] = ng
+	ng.rs.streamsMapMutex.Unlock()
+}
+
+// Stop stops the generator and forgets the missing packets.
+func (ng *NackGenerator) Stop() {
+	ng.rs.streamsMapMutex.Lock()
+	if ng.rs.nackGenerators[ng.ssrc] == ng {
+		delete(ng.rs.nackGenerators, ng.ssrc)
+	}
+	ng.rs.streamsMapMutex.Unlock()
+
+	ng.mutex.Lock()
+	defer ng.mutex.Unlock()
+	if ng.stop != nil {
+		close(ng.stop)
+		ng.stop = nil
+	}
+	ng.started = false
+	ng.missing = make(map[uint16]*nackMiss)
+}
+
+// Stats returns the counters of the generator.
+func (ng *NackGenerator) Stats() NackStats {
+	ng.mutex.Lock()
+	defer ng.mutex.Unlock()
+	return ng.stats
+}
+
+// tick returns the check interval, half of the shorter timer.
+func (ng *NackGenerator) tick() time.Duration {
+	tick := ng.ReorderDelay
+	if ng.RetryInterval < tick {
+		tick = ng.RetryInterval
+	}
+	if tick /= 2; tick < time.Millisecond {
+		tick = time.Millisecond
+	}
+	return tick
+}
+
+func (ng *NackGenerator) run(tick time.Duration, stop chan bool) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			ng.check(now)
+		}
+	}
+}
+
+// received records the arrival of a packet. A jump of the sequence number marks the skipped
+// packets as missing, at most MaxAge of them.
+func (ng *NackGenerator) received(seq uint16, now time.Time) {
+	ng.mutex.Lock()
+	defer ng.mutex.Unlock()
+	if !ng.started {
+		ng.started, ng.highest = true, seq
+		return
+	}
+	diff := int16(seq - ng.highest)
+	if diff <= 0 {
+		if _, ok := ng.missing[seq]; ok {
+			delete(ng.missing, seq)
+			ng.stats.Recovered++
+		}
+		return
+	}
+	first := ng.highest + 1
+	if uint16(diff) > ng.MaxAge {
+		first = seq - ng.MaxAge
+	}
+	for s := first; s != seq; s++ {
+		ng.missing[s] = &nackMiss{detected: now, next: now.Add(ng.ReorderDelay)}
+	}
+	ng.highest = seq
+}
+
+// check sends a NACK for the missing packets that are due and drops the expired ones.
+func (ng *NackGenerator) check(now time.Time) {
+	var due []uint16
+	ng.mutex.Lock()
+	for seq, m := range ng.missing {
+		if now.Before(m.next) {
+			continue
+		}
+		if m.retries >= ng.MaxRetries || ng.highest-seq > ng.MaxAge || now.Sub(m.detected) > ng.Deadline {
+			delete(ng.missing, seq)
+			ng.stats.Expired++
+			continue
+		}
+		m.next = now.Add(ng.RetryInterval << uint(m.retries))
+		m.retries++
+		due = append(due, seq)
+	}
+	if len(due) == 0 {
+		ng.mutex.Unlock()
+		return
+	}
+	// Oldest first, relative to the highest sequence number to handle the wrap around
+	highest := ng.highest
+	sort.Slice(due, func(i, j int) bool { return highest-due[i] > highest-due[j] })
+	ng.stats.Nacks++
+	ng.stats.Requests += uint32(len(due))
+	ng.mutex.Unlock()
+
+	ng.rs.sendNack(ng.ssrc, NackFci(due))
+}
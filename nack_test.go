@@ -0,0 +1,221 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedWriter captures written packets of a writer goroutine, for example a pacer.
+type lockedWriter struct {
+	captureWriter
+	mutex sync.Mutex
+}
+
+func (lw *lockedWriter) WriteDataTo(rp *DataPacket, addr *Address) (n int, err error) {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+	return lw.captureWriter.WriteDataTo(rp, addr)
+}
+
+func (lw *lockedWriter) sent() [][]byte {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+	return append([][]byte{}, lw.data...)
+}
+
+// nackPacket builds a RTPFB Generic NACK for the media SSRC.
+func nackPacket(sender, media uint32, fci []byte) *CtrlPacket {
+	buf := make([]byte, 12, 12+len(fci))
+	buf[0] = 0x80 | RtpfbNack
+	buf[1] = RtcpRtpfb
+	binary.BigEndian.PutUint16(buf[2:], uint16((12+len(fci))/4-1))
+	binary.BigEndian.PutUint32(buf[4:], sender)
+	binary.BigEndian.PutUint32(buf[8:], media)
+	rp, _ := NewCtrlPacketFromBuffer(append(buf, fci...))
+	return rp
+}
+
+func TestNack(t *testing.T) {
+	parseFlags()
+
+	seqs := []uint16{0xfffe, 0xffff, 0, 14, 15, 100}
+	fci := NackFci(seqs)
+	if len(fci) != 12 {
+		t.Errorf("NackFci length check failed. Expected: 12, got: %d\n", len(fci))
+	}
+	if got := ParseNack(fci); len(got) != len(seqs) {
+		t.Errorf("ParseNack count check failed. Expected: %d, got: %d\n", len(seqs), len(got))
+	} else {
+		for i := range seqs {
+			if got[i] != seqs[i] {
+				t.Errorf("ParseNack check failed at %d. Expected: %d, got: %d\n", i, seqs[i], got[i])
+			}
+		}
+	}
+	// PID 10 and all 16 BLP bits request 17 packets
+	if got := ParseNack([]byte{0, 10, 0xff, 0xff}); len(got) != 17 || got[16] != 26 {
+		t.Errorf("ParseNack bitmap check failed: %v\n", got)
+	}
+
+	rs, ct := closeSession(false)
+	nr, err := NewNackResponder(rs, 0, 8, nil)
+	if err != nil {
+		t.Errorf("NewNackResponder failed: %s\n", err)
+		return
+	}
+	if _, err = NewNackResponder(rs, 0, 0, nil); err == nil {
+		t.Errorf("NewNackResponder history check failed\n")
+	}
+	sent := make([]uint16, 10)
+	for i := range sent {
+		rp := rs.NewDataPacket(uint32(i * 160))
+		rp.SetPayload([]byte{byte(i)})
+		sent[i] = rp.Sequence()
+		rs.WriteData(rp)
+		rp.FreePacket()
+	}
+	ssrc := rs.SsrcStreamOutForIndex(0).Ssrc()
+	ct.captureWriter.data = nil
+
+	// The oldest two packets are no longer in the history, the duplicate is sent once
+	rs.OnRecvCtrl(nackPacket(0x0a0b0c0d, ssrc, NackFci([]uint16{sent[0], sent[1], sent[5], sent[5], sent[9]})))
+	if len(ct.captureWriter.data) != 2 {
+		t.Errorf("Retransmission count check failed. Expected: 2, got: %d\n", len(ct.captureWriter.data))
+		return
+	}
+	rp, _ := NewDataPacketFromBuffer(ct.captureWriter.data[0])
+	if rp.Sequence() != sent[5] || rp.Payload()[0] != 5 {
+		t.Errorf("Retransmitted packet check failed. Sequence: %d, payload: %d\n", rp.Sequence(), rp.Payload()[0])
+	}
+	if nr.Retransmitted() != 2 || nr.Missed() != 2 {
+		t.Errorf("Counter check failed. Retransmitted: %d, missed: %d\n", nr.Retransmitted(), nr.Missed())
+	}
+
+	// RTX retransmissions carry the original sequence number in front of the payload
+	nr.SetRtx(0x11121314, 97)
+	ct.captureWriter.data = nil
+	nr.handle(NackFci([]uint16{sent[7]}))
+	rp, _ = NewDataPacketFromBuffer(ct.captureWriter.data[0])
+	if rp.Ssrc() != 0x11121314 || rp.PayloadType() != 97 || binary.BigEndian.Uint16(rp.Payload()) != sent[7] || rp.Payload()[2] != 7 {
+		t.Errorf("RTX retransmission check failed\n")
+	}
+	if !rp.recoverRtx(ssrc, 0) || rp.Sequence() != sent[7] {
+		t.Errorf("RTX recovery check failed\n")
+	}
+
+	// The pacer spreads the retransmissions of one NACK
+	lw := new(lockedWriter)
+	rs = NewSession(lw, new(teeConsumer))
+	rs.AddRemote(&Address{IpAddr: net.IPv4(127, 0, 0, 1), DataPort: 6002, CtrlPort: 6003})
+	idx, _ := rs.NewSsrcStreamOut(&Address{IpAddr: net.IPv4(127, 0, 0, 1), DataPort: 6000, CtrlPort: 6001}, 0x01020304, 1)
+	rs.SsrcStreamOutForIndex(idx).SetPayloadType(0)
+	pacer := NewScheduler()
+	defer pacer.Stop()
+	nr, _ = NewNackResponder(rs, idx, 8, pacer)
+	nr.Spacing = 20 * time.Millisecond
+	for i := range sent[:3] {
+		rp := rs.NewDataPacket(uint32(i * 160))
+		sent[i] = rp.Sequence()
+		rs.WriteData(rp)
+		rp.FreePacket()
+	}
+	start := time.Now()
+	nr.handle(NackFci(sent[:3]))
+	for len(lw.sent()) < 6 && time.Since(start) < time.Second {
+		time.Sleep(time.Millisecond)
+	}
+	if d := time.Since(start); len(lw.sent()) != 6 || d < 40*time.Millisecond {
+		t.Errorf("Paced retransmission check failed. Sent: %d, after: %s\n", len(lw.sent()), d)
+	}
+}
+
+func TestNackGenerator(t *testing.T) {
+	parseFlags()
+
+	rs, ct := feedbackSession(true)
+	const media = 0x0a0b0c0d
+	receive := func(seq uint16) {
+		rp := rs.NewDataPacket(uint32(seq) * 160)
+		rp.SetSsrc(media)
+		rp.SetSequence(seq)
+		rs.OnRecvData(rp)
+	}
+	ng := NewNackGenerator(rs, media)
+	rs.nackGenerators = map[uint32]*NackGenerator{media: ng} // registered without the timer goroutine
+	for _, seq := range []uint16{1, 2, 5} {
+		receive(seq)
+	}
+	base := time.Now()
+	ng.check(base)
+	if len(ct.captureWriter.ctrl) != 0 {
+		t.Errorf("Reorder delay check failed. Sent: %d\n", len(ct.captureWriter.ctrl))
+	}
+	ng.check(base.Add(20 * time.Millisecond))
+	if len(ct.captureWriter.ctrl) != 1 {
+		t.Errorf("NACK count check failed. Expected: 1, got: %d\n", len(ct.captureWriter.ctrl))
+		return
+	}
+	rc, _ := NewCtrlPacketFromBuffer(ct.captureWriter.ctrl[0])
+	if rc.Type(0) != RtcpRtpfb || rc.Count(0) != RtpfbNack || rc.Ssrc(rtcpSsrcLength) != media {
+		t.Errorf("NACK header check failed\n")
+	}
+	if seqs := ParseNack(ct.captureWriter.ctrl[0][12:]); len(seqs) != 2 || seqs[0] != 3 || seqs[1] != 4 {
+		t.Errorf("NACK sequence check failed: %v\n", seqs)
+	}
+
+	// The packet 4 arrives, the retry of 3 waits for the retry interval
+	receive(4)
+	ng.check(base.Add(30 * time.Millisecond))
+	ng.check(base.Add(70 * time.Millisecond))
+	if len(ct.captureWriter.ctrl) != 2 {
+		t.Errorf("Retry count check failed. Expected: 2, got: %d\n", len(ct.captureWriter.ctrl))
+		return
+	}
+	if seqs := ParseNack(ct.captureWriter.ctrl[1][12:]); len(seqs) != 1 || seqs[0] != 3 {
+		t.Errorf("Retry sequence check failed: %v\n", seqs)
+	}
+	// The doubled retry interval, then the deadline
+	ng.check(base.Add(140 * time.Millisecond))
+	ng.check(base.Add(600 * time.Millisecond))
+	stats := ng.Stats()
+	if len(ct.captureWriter.ctrl) != 2 || stats.Nacks != 2 || stats.Requests != 3 || stats.Recovered != 1 || stats.Expired != 1 {
+		t.Errorf("NACK stats check failed: %+v, sent: %d\n", stats, len(ct.captureWriter.ctrl))
+	}
+
+	// A jump tracks MaxAge packets only
+	receive(5 + 1000)
+	if n := len(ng.missing); n != int(ng.MaxAge) {
+		t.Errorf("MaxAge check failed. Expected: %d missing, got: %d\n", ng.MaxAge, n)
+	}
+
+	ng = NewNackGenerator(rs, media)
+	ng.Start()
+	if rs.nackGenerators[media] != ng {
+		t.Errorf("Start registration check failed\n")
+	}
+	ng.Stop()
+	if _, ok := rs.nackGenerators[media]; ok {
+		t.Errorf("Stop registration check failed\n")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+)
+
+/*
+ * This source file contains the enrichment of the source addresses: an application function
+ * maps the address of a new source to its network origin, for example from a GeoIP and ASN
+ * database, and the session attaches the result to the input stream.
+ */
+
+// SourceOrigin is the network origin of a source address.
+type SourceOrigin struct {
+	Asn     uint32            `json:",omitempty"` // the autonomous system number, 0 if unknown
+	Network string            `json:",omitempty"` // e.g. the organization of the AS or the provider
+	Country string            `json:",omitempty"` // e.g. an ISO 3166 country code
+	Region  string            `json:",omitempty"` // e.g. a state, a cloud region or a data center
+	Labels  map[string]string `json:",omitempty"` // further attributes of the application
+}
+
+// SourceEnrichFunc returns the origin of a source address, false if it is unknown. The session
+// calls it in its receive path while it holds its stream table, the function must return
+// quickly, for example from an in-memory database, and must not call methods of the session.
+type SourceEnrichFunc func(ip net.IP) (SourceOrigin, bool)
+
+// maxOrigins limits the cached origins of a session, the session clears the cache if it is full.
+const maxOrigins = 1024
+
+// SetSourceEnrichment sets the function that returns the origin of the source addresses, nil
+// removes it. The session calls the function once per address when an input stream receives
+// its first packet or changes its address and attaches the result to the stream, see
+// SsrcStream.Origin, StreamInfo and StreamSnapshot. Set the function before the session starts.
+//
+//   fn - the enrichment function, the session caches its results per address
+//
+func (rs *Session) SetSourceEnrichment(fn SourceEnrichFunc) {
+	rs.originsMutex.Lock()
+	rs.enrich = fn
+	rs.origins = make(map[string]*SourceOrigin)
+	rs.originsMutex.Unlock()
+}
+
+// Origin returns the network origin of the input stream's address, false if the session has no
+// enrichment function or the function does not know the address.
+func (str *SsrcStream) Origin() (SourceOrigin, bool) {
+	if str == nil {
+		return SourceOrigin{}, false
+	}
+	str.contextMutex.Lock()
+	defer str.contextMutex.Unlock()
+	if str.origin == nil {
+		return SourceOrigin{}, false
+	}
+	return *str.origin, true
+}
+
+// *** Local functions and methods.
+
+// enrichSource attaches the origin of the stream's address to the stream if the address is new.
+func (rs *Session) enrichSource(str *SsrcStream) {
+	if str.IpAddr == nil {
+		return
+	}
+	str.contextMutex.Lock()
+	known := str.originIp.Equal(str.IpAddr)
+	str.contextMutex.Unlock()
+	if known {
+		return
+	}
+	rs.originsMutex.Lock()
+	if rs.enrich == nil {
+		rs.originsMutex.Unlock()
+		return
+	}
+	key := str.IpAddr.String()
+	origin, cached := rs.origins[key]
+	if !cached {
+		if o, ok := rs.enrich(str.IpAddr); ok {
+			origin = &o
+		}
+		if len(rs.origins) >= maxOrigins {
+			rs.origins = make(map[string]*SourceOrigin)
+		}
+		rs.origins[key] = origin
+	}
+	rs.originsMutex.Unlock()
+
+	str.contextMutex.Lock()
+	str.origin, str.originIp = origin, str.IpAddr
+	str.contextMutex.Unlock()
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+)
+
+func originData(rs *Session, ssrc uint32, seq uint16, from *Address) {
+	rp := rs.NewDataPacket(uint32(seq) * 160)
+	rp.SetSsrc(ssrc)
+	rp.SetSequence(seq)
+	rp.SetPayload(make([]byte, 160))
+	rp.fromAddr = *from
+	rs.OnRecvData(rp)
+}
+
+func TestSourceEnrichment(t *testing.T) {
+	parseFlags()
+
+	rs, _ := drainedSession(t)
+	lookups := 0
+	rs.SetSourceEnrichment(func(ip net.IP) (SourceOrigin, bool) {
+		lookups++
+		if ip4 := ip.To4(); ip4 != nil && ip4[0] == 10 {
+			return SourceOrigin{Asn: 64500, Network: "example", Region: "eu-west"}, true
+		}
+		return SourceOrigin{}, false
+	})
+	west := &Address{net.IPv4(10, 0, 0, 9), 6000, 6001}
+	for seq := uint16(0); seq < 3; seq++ {
+		originData(rs, 0x0a0b0c0d, seq, west)
+		originData(rs, 0x0a0b0c0e, seq, &Address{west.IpAddr, 6010, 6011})
+	}
+	if lookups != 1 {
+		t.Errorf("Enrichment must be called once per address, got: %d\n", lookups)
+	}
+	str, _, _ := rs.lookupSsrcMapIn(0x0a0b0c0d)
+	if origin, ok := str.Origin(); !ok || origin.Asn != 64500 || origin.Region != "eu-west" {
+		t.Errorf("Origin check failed: %+v\n", origin)
+	}
+	for _, info := range rs.InputStreams() {
+		if info.Origin == nil || info.Origin.Asn != 64500 {
+			t.Errorf("StreamInfo origin check failed for 0x%x\n", info.Ssrc)
+		}
+	}
+	if ss := rs.Snapshot().StreamsIn; len(ss) != 2 || ss[0].Origin == nil || ss[0].Origin.Network != "example" {
+		t.Errorf("Snapshot origin check failed\n")
+	}
+
+	// The source moves to an unknown network.
+	originData(rs, 0x0a0b0c0d, 3, &Address{net.IPv4(192, 0, 2, 1), 6000, 6001})
+	if _, ok := str.Origin(); ok || lookups != 2 {
+		t.Errorf("Address change check failed, %d lookups\n", lookups)
+	}
+	if _, ok := rs.SsrcStreamOutForIndex(0).Origin(); ok {
+		t.Errorf("Output streams have no origin\n")
+	}
+}
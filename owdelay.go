@@ -0,0 +1,207 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"sync"
+	"time"
+)
+
+// Sources of the send times of a one-way delay estimation.
+const (
+	DelayAbsSendTime = iota // the abs-send-time extension, the sender's wall clock
+	DelayToffset            // the RTP timestamp corrected by the toffset extension, the media clock
+)
+
+// DelayTrend is the one-way delay estimation of an input stream.
+//
+// Sender and receiver clocks are not synchronized, thus the estimation measures the delay
+// relative to the smallest delay of the window: Delay grows if queues build up on the path and
+// Slope tells if they are growing or draining.
+//
+type DelayTrend struct {
+	Source  int           // the source of the send times, DelayAbsSendTime or DelayToffset
+	Samples uint32        // the packets of the estimation
+	Delay   time.Duration // the smoothed delay above the minimum delay of the window
+	Max     time.Duration // the largest delay above the minimum of the window
+	Slope   float64       // the delay trend in milliseconds per second, positive if the delay grows
+}
+
+// ParseTransmissionOffset returns the signed 24 bit value of a transmission time offset
+// (toffset) extension element, RFC 5450, false if the data has not the length of 3 bytes. The
+// offset is the time from the RTP timestamp of the packet to its transmission in RTP clock
+// units.
+func ParseTransmissionOffset(data []byte) (int32, bool) {
+	if len(data) != 3 {
+		return 0, false
+	}
+	return int32(uint32(data[0])<<24|uint32(data[1])<<16|uint32(data[2])<<8) >> 8, true
+}
+
+// TransmissionOffset returns the data of a toffset extension element.
+func TransmissionOffset(offset int32) []byte {
+	return []byte{byte(offset >> 16), byte(offset >> 8), byte(offset)}
+}
+
+// TransmissionOffset returns the toffset extension of a RTP packet, false if the extension is
+// not registered or the packet does not contain a valid element.
+func (em *ExtensionMap) TransmissionOffset(rp *DataPacket) (int32, bool) {
+	return ParseTransmissionOffset(em.Extension(rp, ExtTransmissionOffset))
+}
+
+// SetTransmissionOffset sets the toffset extension of a RTP packet.
+func (em *ExtensionMap) SetTransmissionOffset(rp *DataPacket, offset int32) error {
+	return em.SetExtension(rp, ExtTransmissionOffset, TransmissionOffset(offset))
+}
+
+// SetDelayEstimation enables the one-way delay estimation of the input streams, see
+// SsrcStream.DelayTrend. The estimation uses the abs-send-time extension if the packets contain
+// it and the toffset extension or the plain RTP timestamp otherwise. Register the extensions in
+// the session's ExtensionMap.
+//
+//   window - the number of packets of the estimation window, 0 disables the estimation
+//
+func (rs *Session) SetDelayEstimation(window int) error {
+	if window < 0 || window == 1 {
+		return Error("Delay estimation window must be 0 or at least 2 packets.")
+	}
+	rs.delayWindow = window
+	return nil
+}
+
+// DelayTrend returns the one-way delay estimation of the input stream, false if the session
+// does not estimate the delay or the stream received no packet yet.
+func (si *SsrcStream) DelayTrend() (DelayTrend, bool) {
+	si.streamMutex.Lock()
+	de := si.delay
+	si.streamMutex.Unlock()
+	if de == nil {
+		return DelayTrend{}, false
+	}
+	return de.trend()
+}
+
+// *** Local functions and methods.
+
+type delaySample struct {
+	recv  int64 // receive time in ns, relative to the first sample
+	delay int64 // receive time minus send time in ns, relative to the first sample
+}
+
+// owdEstimator keeps the delay samples of an input stream's estimation window.
+type owdEstimator struct {
+	mutex    sync.Mutex
+	source   int
+	samples  []delaySample // ring of the window
+	next     int
+	count    uint32
+	first    int64  // receive time of the first sample
+	sendTime int64  // send time of the last sample in ns, relative to the first sample
+	lastRaw  uint32 // last abs-send-time or RTP send stamp
+	smoothed float64
+}
+
+func newOwdEstimator(window int) *owdEstimator {
+	return &owdEstimator{samples: make([]delaySample, 0, window)}
+}
+
+// recordDelay adds a received packet to the delay estimation of the stream. The caller holds
+// the stream's recvMutex.
+func (rs *Session) recordDelay(str *SsrcStream, rp *DataPacket, now int64) {
+	if str.delay == nil {
+		str.streamMutex.Lock()
+		str.delay = newOwdEstimator(rs.delayWindow)
+		str.streamMutex.Unlock()
+	}
+	if ast, ok := ParseAbsSendTime(rs.extensionMap.Extension(rp, ExtAbsSendTime)); ok {
+		str.delay.add(DelayAbsSendTime, ast, 1e9/(1<<18), now)
+		return
+	}
+	rate, _ := str.clockRate(rp)
+	if rate <= 0 {
+		return
+	}
+	stamp := rp.Timestamp()
+	if offset, ok := rs.extensionMap.TransmissionOffset(rp); ok {
+		stamp += uint32(offset)
+	}
+	str.delay.add(DelayToffset, stamp, 1e9/float64(rate), now)
+}
+
+// add records the send stamp of a packet, unit is the length of a stamp unit in ns. The 24 bit
+// abs-send-time stamps wrap every 64 seconds, the RTP stamps at 32 bit.
+func (de *owdEstimator) add(source int, stamp uint32, unit float64, recv int64) {
+	de.mutex.Lock()
+	defer de.mutex.Unlock()
+	if de.count == 0 || de.source != source {
+		de.source, de.count, de.next, de.samples = source, 0, 0, de.samples[:0]
+		de.first, de.lastRaw, de.sendTime, de.smoothed = recv, stamp, 0, 0
+	}
+	diff := int32(stamp - de.lastRaw)
+	if source == DelayAbsSendTime {
+		diff = int32((stamp-de.lastRaw)<<8) >> 8
+	}
+	de.sendTime += int64(float64(diff) * unit)
+	de.lastRaw = stamp
+
+	s := delaySample{recv: recv - de.first, delay: recv - de.first - de.sendTime}
+	if len(de.samples) < cap(de.samples) {
+		de.samples = append(de.samples, s)
+	} else {
+		de.samples[de.next] = s
+		de.next = (de.next + 1) % len(de.samples)
+	}
+	de.count++
+	base := de.samples[0].delay
+	for _, ws := range de.samples {
+		if ws.delay < base {
+			base = ws.delay
+		}
+	}
+	de.smoothed += (float64(s.delay-base) - de.smoothed) / 16 // like the jitter of RFC 3550
+}
+
+func (de *owdEstimator) trend() (tr DelayTrend, ok bool) {
+	de.mutex.Lock()
+	defer de.mutex.Unlock()
+	if de.count == 0 {
+		return tr, false
+	}
+	tr = DelayTrend{Source: de.source, Samples: de.count, Delay: time.Duration(de.smoothed)}
+	base := de.samples[0].delay
+	for _, s := range de.samples {
+		if s.delay < base {
+			base = s.delay
+		}
+	}
+	// least squares slope of the delay over the receive time
+	var sx, sy, sxx, sxy float64
+	n := float64(len(de.samples))
+	for _, s := range de.samples {
+		if d := time.Duration(s.delay - base); d > tr.Max {
+			tr.Max = d
+		}
+		x, y := float64(s.recv)/1e9, float64(s.delay)/1e6
+		sx, sy, sxx, sxy = sx+x, sy+y, sxx+x*x, sxy+x*y
+	}
+	if den := n*sxx - sx*sx; den > 0 {
+		tr.Slope = (n*sxy - sx*sy) / den
+	}
+	return tr, true
+}
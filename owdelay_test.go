@@ -0,0 +1,112 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTransmissionOffset(t *testing.T) {
+	parseFlags()
+
+	for _, offset := range []int32{0, 160, -5, 0x7fffff, -0x800000} {
+		if got, ok := ParseTransmissionOffset(TransmissionOffset(offset)); !ok || got != offset {
+			t.Errorf("toffset check failed. Expected: %d, got: %d\n", offset, got)
+		}
+	}
+	if _, ok := ParseTransmissionOffset([]byte{1, 2}); ok {
+		t.Errorf("ParseTransmissionOffset must reject 2 bytes\n")
+	}
+	em := NewExtensionMap()
+	em.Register(2, ExtTransmissionOffset)
+	rp := newDataPacket()
+	defer rp.FreePacket()
+	if err := em.SetTransmissionOffset(rp, -80); err != nil {
+		t.Errorf("SetTransmissionOffset failed: %v\n", err)
+	}
+	if offset, ok := em.TransmissionOffset(rp); !ok || offset != -80 {
+		t.Errorf("TransmissionOffset check failed: %d\n", offset)
+	}
+}
+
+func TestDelayTrend(t *testing.T) {
+	parseFlags()
+
+	// The queue grows 1 ms per 20 ms packet, abs-send-time units are 1/2^18 seconds. The send
+	// stamps start close to the 64 seconds wrap.
+	de := newOwdEstimator(20)
+	stamp := uint32(0xffffff - 3*5243)
+	var recv int64
+	for i := 0; i < 30; i++ {
+		de.add(DelayAbsSendTime, stamp&0xffffff, 1e9/(1<<18), recv+int64(i)*int64(time.Millisecond))
+		stamp += 5243 // 20 ms
+		recv += int64(20 * time.Millisecond)
+	}
+	tr, ok := de.trend()
+	if !ok || tr.Source != DelayAbsSendTime || tr.Samples != 30 {
+		t.Errorf("Trend check failed: %+v\n", tr)
+	}
+	if tr.Slope < 45 || tr.Slope > 55 || tr.Max < 18*time.Millisecond || tr.Max > 20*time.Millisecond || tr.Delay <= 0 {
+		t.Errorf("Growing delay check failed: %+v\n", tr)
+	}
+
+	// A constant delay has no trend.
+	de = newOwdEstimator(10)
+	for i := 0; i < 10; i++ {
+		de.add(DelayToffset, uint32(i*160), 1e9/8000, int64(i)*int64(20*time.Millisecond)+int64(time.Hour))
+	}
+	if tr, _ = de.trend(); tr.Slope != 0 || tr.Max != 0 || tr.Delay != 0 {
+		t.Errorf("Constant delay check failed: %+v\n", tr)
+	}
+}
+
+func TestDelayEstimation(t *testing.T) {
+	parseFlags()
+
+	rs, _ := closeSession(false)
+	if rs.SetDelayEstimation(1) == nil {
+		t.Errorf("SetDelayEstimation must reject a window of 1\n")
+	}
+	rs.SetDelayEstimation(8)
+	rs.ExtensionMap().Register(2, ExtTransmissionOffset)
+	from := &Address{net.IPv4(10, 0, 0, 9), 6000, 6001}
+	for seq := uint16(0); seq < 5; seq++ {
+		rp := rs.NewDataPacket(uint32(seq) * 160)
+		rp.SetSsrc(0x0a0b0c0d)
+		rp.SetSequence(seq)
+		rp.SetPayloadType(0)
+		rs.ExtensionMap().SetTransmissionOffset(rp, 40)
+		rp.SetPayload(make([]byte, 160))
+		rp.fromAddr = *from
+		rs.OnRecvData(rp)
+	}
+	str, _, _ := rs.lookupSsrcMapIn(0x0a0b0c0d)
+	if str == nil {
+		t.Errorf("Input stream missing\n")
+		return
+	}
+	if tr, ok := str.DelayTrend(); !ok || tr.Source != DelayToffset || tr.Samples != 5 {
+		t.Errorf("Delay estimation check failed: %+v\n", tr)
+	}
+	if _, ok := rs.SsrcStreamOutForIndex(0).DelayTrend(); ok {
+		t.Errorf("Output streams have no delay estimation\n")
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"time"
 )
 
 const (
@@ -101,6 +102,8 @@ type RawPacket struct {
 	isFree   bool
 	fromAddr Address
 	buffer   []byte
+	sockOpts *SocketOptions
+	txTime   int64 // wallclock transmit time in nanoseconds, 0 sends immediately
 }
 
 // Buffer returns the internal buffer in raw format.
@@ -120,12 +123,56 @@ func (rp *RawPacket) InUse() int {
 	return rp.inUse
 }
 
+// FromAddr returns the address of the sender of a received packet. The receiving transport sets
+// the data port for RTP packets and the control port for RTCP packets.
+func (rp *RawPacket) FromAddr() Address {
+	return rp.fromAddr
+}
+
+// SetFromAddr sets the address of the sender of a packet, for example before an application
+// injects a packet into a session, see Session.InjectData.
+func (rp *RawPacket) SetFromAddr(addr *Address) {
+	rp.fromAddr = *addr
+}
+
+// SetSocketOptions sets the socket options the UDP transport applies when it sends the packet,
+// see SocketOptions. Nil removes the options.
+func (rp *RawPacket) SetSocketOptions(opts *SocketOptions) {
+	rp.sockOpts = opts
+}
+
+// SocketOptions returns the packet's socket options, nil if the packet has none.
+func (rp *RawPacket) SocketOptions() *SocketOptions {
+	return rp.sockOpts
+}
+
+// SetTxTime sets the time the network interface shall transmit the packet. A UDP transport
+// with SO_TXTIME hands the packet to the kernel with the time, see TransportUDP.EnableTxTime,
+// other transports send the packet immediately. The zero time removes the transmit time.
+func (rp *RawPacket) SetTxTime(at time.Time) {
+	if at.IsZero() {
+		rp.txTime = 0
+		return
+	}
+	rp.txTime = at.UnixNano()
+}
+
+// TxTime returns the packet's transmit time, the zero time if the packet has none.
+func (rp *RawPacket) TxTime() time.Time {
+	if rp.txTime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, rp.txTime)
+}
+
 // *** RTP specific functions start here ***
 
 // RTP packet type to define RTP specific functions
 type DataPacket struct {
 	RawPacket
 	payloadLength int16
+	retransmitted bool // the session recovered the packet from a RTX packet
+	concealed     bool // a Concealer synthesized the packet
 }
 
 var freeListRtp = make(chan *DataPacket, freeListLengthRtp)
@@ -144,6 +191,23 @@ func newDataPacket() (rp *DataPacket) {
 	return
 }
 
+// NewDataPacketFromBuffer returns a RTP packet that contains a copy of buf.
+//
+// Applications use this function to handle RTP packets that were not received via a
+// transport, for example packets read from a capture file. The function returns an error
+// if buf is too short to hold a RTP header or too long to fit into a packet buffer.
+func NewDataPacketFromBuffer(buf []byte) (rp *DataPacket, err error) {
+	if len(buf) < rtpHeaderLength {
+		return nil, Error("Buffer too short for a RTP packet.")
+	}
+	if len(buf) > defaultBufferSize {
+		return nil, Error("Buffer too long for a RTP packet.")
+	}
+	rp = newDataPacket()
+	rp.inUse = copy(rp.buffer, buf)
+	return
+}
+
 // FreePacket returns the packet to the free RTP list.
 // A packet marked as free is ignored, thus calling FreePacket multiple times for the same
 // packet is possible.
@@ -156,6 +220,10 @@ func (rp *DataPacket) FreePacket() {
 	rp.padTo = 0
 	rp.fromAddr.DataPort = 0
 	rp.fromAddr.IpAddr = nil
+	rp.sockOpts = nil
+	rp.txTime = 0
+	rp.retransmitted = false
+	rp.concealed = false
 	rp.isFree = true
 
 	select {
@@ -166,6 +234,9 @@ func (rp *DataPacket) FreePacket() {
 
 // CsrcCount return the number of CSRC values in this packet
 func (rp *DataPacket) CsrcCount() uint8 {
+	if !rp.avail(1) {
+		return 0
+	}
 	return rp.buffer[0] & ccMask
 }
 
@@ -204,8 +275,12 @@ func (rp *DataPacket) SetCsrcList(csrc []uint32) {
 	rp.inUse = newInUse
 }
 
-// CsrcList returns the list of CSRC values as uint32 slice in host horder
+// CsrcList returns the list of CSRC values as uint32 slice in host horder. It returns nil if the
+// packet is too short for the list.
 func (rp *DataPacket) CsrcList() (list []uint32) {
+	if !rp.avail(rtpHeaderLength + int(rp.CsrcCount())*4) {
+		return nil
+	}
 	list = make([]uint32, rp.CsrcCount())
 	for i := 0; i < len(list); i++ {
 		list[i] = binary.BigEndian.Uint32(rp.buffer[rtpHeaderLength+i*4:])
@@ -244,7 +319,7 @@ func (rp *DataPacket) SetExtension(ext []byte) {
 	tmpRp := newDataPacket() // get a new packet first
 	newBuf := tmpRp.buffer   // and get its buffer
 
-	copy(newBuf, rp.buffer[0:rtpHeaderLength])              // copy fixed header
+	copy(newBuf, rp.buffer[0:offsetExt])                    // copy fixed header and CSRC list
 	copy(newBuf[offsetExt:], ext)                           // copy new extension
 	copy(newBuf[offsetNew:], rp.buffer[offsetOld:rp.inUse]) // copy over old content
 
@@ -261,16 +336,23 @@ func (rp *DataPacket) SetExtension(ext []byte) {
 
 // Extension returns the byte slice of the RTP packet extension part, if not extension available it returns nil.
 // This is not a copy of the extension part but the slice points into the real RTP packet buffer.
+// The method also returns nil if the extension exceeds the packet.
 func (rp *DataPacket) Extension() []byte {
 	if !rp.ExtensionBit() {
 		return nil
 	}
 	offset := int(rp.CsrcCount()*4 + rtpHeaderLength)
+	if !rp.avail(offset + rp.ExtensionLength()) {
+		return nil
+	}
 	return rp.buffer[offset : offset+rp.ExtensionLength()]
 }
 
 // Ssrc returns the SSRC as uint32 in host order.
 func (rp *DataPacket) Ssrc() uint32 {
+	if !rp.avail(rtpHeaderLength) {
+		return 0
+	}
 	return binary.BigEndian.Uint32(rp.buffer[ssrcOffsetRtp:])
 }
 
@@ -281,6 +363,9 @@ func (rp *DataPacket) SetSsrc(ssrc uint32) {
 
 // Timestamp returns the Timestamp as uint32 in host order.
 func (rp *DataPacket) Timestamp() uint32 {
+	if !rp.avail(rtpHeaderLength) {
+		return 0
+	}
 	return binary.BigEndian.Uint32(rp.buffer[timestampOffset:])
 }
 
@@ -302,6 +387,9 @@ func (rp *DataPacket) SetMarker(m bool) {
 // Marker returns the state of the Marker bit.
 // If the Marker bit is set the method return true, otherwise it returns false
 func (rp *DataPacket) Marker() bool {
+	if !rp.avail(markerPtOffset + 1) {
+		return false
+	}
 	return (rp.buffer[markerPtOffset] & markerBit) == markerBit
 }
 
@@ -329,6 +417,9 @@ func (rp *DataPacket) SetPadding(p bool, padTo int) {
 // Padding returns the state of the Padding bit.
 // If the Padding bit is set the method return true, otherwise it returns false
 func (rp *DataPacket) Padding() bool {
+	if !rp.avail(1) {
+		return false
+	}
 	return (rp.buffer[0] & paddingBit) == paddingBit
 }
 
@@ -340,6 +431,9 @@ func (rp *DataPacket) SetPayloadType(pt byte) {
 
 // PayloadType return the payload type value from RTP packet header.
 func (rp *DataPacket) PayloadType() byte {
+	if !rp.avail(markerPtOffset + 1) {
+		return 0
+	}
 	return rp.buffer[markerPtOffset] & ptMask
 }
 
@@ -350,11 +444,17 @@ func (rp *DataPacket) SetSequence(seq uint16) {
 
 // Sequence returns the sequence number as uint16 in host order.
 func (rp *DataPacket) Sequence() uint16 {
+	if !rp.avail(rtpHeaderLength) {
+		return 0
+	}
 	return binary.BigEndian.Uint16(rp.buffer[sequenceOffset:])
 }
 
 // ExtensionBit returns true if the Extension bit is set in the header, false otherwise.
 func (rp *DataPacket) ExtensionBit() bool {
+	if !rp.avail(1) {
+		return false
+	}
 	return (rp.buffer[0] & extensionBit) == extensionBit
 }
 
@@ -365,6 +465,9 @@ func (rp *DataPacket) ExtensionLength() (length int) {
 	}
 	offset := int16(rp.CsrcCount()*4 + rtpHeaderLength) // offset to extension header 32bit word
 	offset += 2
+	if !rp.avail(int(offset) + 2) {
+		return 0
+	}
 	length = int(binary.BigEndian.Uint16(rp.buffer[offset:])) + 1 // +1 for the main extension header word
 	length *= 4
 	return
@@ -373,13 +476,13 @@ func (rp *DataPacket) ExtensionLength() (length int) {
 // Payload returns the byte slice of the payload after removing length of possible padding.
 //
 // The slice is not a copy of the payload but the slice points into the real RTP packet buffer.
+// The method returns nil if the header or the padding exceeds the packet, see CheckedPayload.
 func (rp *DataPacket) Payload() []byte {
-	payOffset := int(rp.CsrcCount()*4+rtpHeaderLength) + rp.ExtensionLength()
-	pad := 0
-	if rp.Padding() {
-		pad = int(rp.buffer[rp.inUse-1])
+	payOffset, payEnd, err := rp.layout()
+	if err != nil {
+		return nil
 	}
-	return rp.buffer[payOffset : rp.inUse-pad]
+	return rp.buffer[payOffset:payEnd]
 }
 
 // SetPayload copies the contents of payload byte slice into the RTP packet, and replaces an existing payload.
@@ -427,6 +530,34 @@ func (rp *DataPacket) SetPayload(payload []byte) {
 	return
 }
 
+// Retransmitted returns true if the session recovered the packet from a RTX packet or the
+// packet answered a NACK of the session's NackGenerator.
+func (rp *DataPacket) Retransmitted() bool {
+	return rp.retransmitted
+}
+
+// Concealed returns true if a Concealer synthesized the packet for a lost packet. A concealed
+// packet without payload is a gap marker.
+func (rp *DataPacket) Concealed() bool {
+	return rp.concealed
+}
+
+// recoverRtx turns a RTX packet into the original packet, RFC 4588 chapter 4. It returns false
+// if the payload does not contain the original sequence number.
+func (rp *DataPacket) recoverRtx(ssrc uint32, pt byte) bool {
+	payOffset := int(rp.CsrcCount()*4+rtpHeaderLength) + rp.ExtensionLength()
+	if len(rp.Payload()) < 2 {
+		return false
+	}
+	osn := binary.BigEndian.Uint16(rp.buffer[payOffset:])
+	rp.inUse = payOffset + copy(rp.buffer[payOffset:], rp.buffer[payOffset+2:rp.inUse]) // keeps a padding
+	rp.SetSsrc(ssrc)
+	rp.SetPayloadType(pt)
+	rp.SetSequence(osn)
+	rp.retransmitted = true
+	return true
+}
+
 func (rp *DataPacket) IsValid() bool {
 	if (rp.buffer[0] & versionMask) != version2Bit {
 		return false
@@ -489,6 +620,7 @@ func newCtrlPacket() (rp *CtrlPacket, offset int) {
 	}
 	rp.buffer[0] = version2Bit // RTCP: V = 2, P, RC = 0
 	rp.inUse = rtcpHeaderLength
+	rp.isFree = false
 	offset = rtcpHeaderLength
 	return
 }
@@ -507,6 +639,23 @@ func (rp *CtrlPacket) addHeaderSsrc(offset int, ssrc uint32) int {
 	return rp.inUse
 }
 
+// NewCtrlPacketFromBuffer returns a RTCP packet that contains a copy of buf.
+//
+// Applications use this function to handle RTCP compounds that were not received via a
+// transport, for example packets read from a capture file. The function returns an error
+// if buf is too short to hold a RTCP header or too long to fit into a packet buffer.
+func NewCtrlPacketFromBuffer(buf []byte) (rp *CtrlPacket, err error) {
+	if len(buf) < rtcpHeaderLength+rtcpSsrcLength {
+		return nil, Error("Buffer too short for a RTCP packet.")
+	}
+	if len(buf) > defaultBufferSize {
+		return nil, Error("Buffer too long for a RTCP packet.")
+	}
+	rp, _ = newCtrlPacket()
+	rp.inUse = copy(rp.buffer, buf)
+	return
+}
+
 func (rp *CtrlPacket) FreePacket() {
 	if rp.isFree {
 		return
@@ -516,6 +665,8 @@ func (rp *CtrlPacket) FreePacket() {
 	rp.padTo = 0
 	rp.fromAddr.CtrlPort = 0
 	rp.fromAddr.IpAddr = nil
+	rp.sockOpts = nil
+	rp.txTime = 0
 	rp.isFree = true
 
 	select {
@@ -668,7 +819,7 @@ func (rr recvReport) setSsrc(ssrc uint32) {
 // packetsLost returns the receiver report packets lost data as 32bit unsigned in host order.
 func (rr recvReport) packetsLost() uint32 {
 	lost := binary.BigEndian.Uint32(rr[4:])
-	return lost >> 8
+	return lost & 0xffffff // lower 24 bits, the high byte holds the fraction lost
 }
 
 // setPacketsLost takes a 32 unsigned packet lost number in host order and sets lower 24 bits in network order in RR.
@@ -729,6 +880,50 @@ func (rr recvReport) setDlsr(dlsr uint32) {
 	binary.BigEndian.PutUint32(rr[20:], dlsr)
 }
 
+// ReportBlock holds the data of a received report block and the SSRC of the reported source.
+type ReportBlock struct {
+	Ssrc uint32
+	RecvReportData
+}
+
+// SenderInfo returns the sender info of the SR packet at offset.
+// Offset points to the first byte of the header word of a RTCP packet. The function returns
+// false if the packet is not a SR or too short.
+func (rp *CtrlPacket) SenderInfo(offset int) (info SenderInfoData, ok bool) {
+	infoOffset := offset + rtcpHeaderLength + rtcpSsrcLength
+	if rp.Type(offset) != RtcpSR || infoOffset+senderInfoLen > rp.inUse {
+		return
+	}
+	in := rp.toSenderInfo(infoOffset)
+	seconds, fraction := in.ntpTimeStamp()
+	info.NtpTime = fromNtp(seconds, fraction)
+	info.RtpTimestamp = in.rtpTimeStamp()
+	info.SenderPacketCnt = in.packetCount()
+	info.SenderOctectCnt = in.octetCount()
+	return info, true
+}
+
+// ReportBlocks returns the report blocks of the SR or RR packet at offset.
+// Offset points to the first byte of the header word of a RTCP packet. The function ignores
+// report blocks that exceed the packet.
+func (rp *CtrlPacket) ReportBlocks(offset int) (blocks []ReportBlock) {
+	rrOffset := offset + rtcpHeaderLength + rtcpSsrcLength
+	switch rp.Type(offset) {
+	case RtcpSR:
+		rrOffset += senderInfoLen
+	case RtcpRR:
+	default:
+		return nil
+	}
+	for i := 0; i < rp.Count(offset) && rrOffset+reportBlockLen <= rp.inUse; i++ {
+		rr := rp.toRecvReport(rrOffset)
+		blocks = append(blocks, ReportBlock{rr.ssrc(), RecvReportData{rr.packetsLostFrac(), rr.packetsLost(),
+			rr.highestSeq(), rr.jitter(), rr.lsr(), rr.dlsr()}})
+		rrOffset += reportBlockLen
+	}
+	return
+}
+
 /*
  * Functions to fill/access a SDES structure
  */
@@ -797,14 +992,22 @@ func (sc sdesChunk) chunkLen() (int, bool) {
 		}
 		return 8, true
 	}
-	// Loop over valid items and add their overall length to offset.
+	// Loop over valid items and add their overall length to offset. Check each read, a
+	// malformed chunk may end in the middle of an item or without SdesEnd.
 	for ; itemType != SdesEnd; itemType = sc[length] {
+		if length+1 >= len(sc) {
+			return 0, false
+		}
 		length += int(sc[length+1]) + 2 // lenght points to next item type field
-		if length > len(sc) {
+		if length >= len(sc) {
 			return 0, false
 		}
 	}
-	return (length + 4) &^ 0x3, true
+	length = (length + 4) &^ 0x3 // SdesEnd and padding to the next 32 bit boundary
+	if length > len(sc) {
+		return 0, false
+	}
+	return length, true
 }
 
 // newByePacket returns a BYE data structure which is positioned at the current inUse offet and advances inUse to point after BYE.
@@ -0,0 +1,200 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Parsing modes of a session, see SetParseMode.
+const (
+	ParseStrict  = iota // drop packets with a malformed field
+	ParseLenient        // repair or skip malformed fields, drop only packets that can't be repaired
+)
+
+// Fields of the parse diagnostics.
+const (
+	FieldHeader      = "header"       // the packet is shorter than the fixed header
+	FieldVersion     = "version"      // the version is not 2
+	FieldCsrcCount   = "csrc count"   // the CSRC list exceeds the packet
+	FieldExtension   = "extension"    // the header extension exceeds the packet
+	FieldPadding     = "padding"      // the padding count is 0 or exceeds the payload
+	FieldRtcpLength  = "rtcp length"  // the length of a RTCP packet exceeds the compound
+	FieldReportCount = "report count" // the report blocks exceed the SR or RR packet
+	FieldPtime       = "ptime"        // the payload is not the strict packet time, see SetAes67Profile
+)
+
+// ParseDiagnostic describes a malformed field of a received packet.
+type ParseDiagnostic struct {
+	Time     time.Time
+	Field    string // one of the Field constants
+	Detail   string
+	Repaired bool // the lenient mode repaired the field, false if the session dropped the packet
+}
+
+// maxDiagnostics is the number of diagnostics the session keeps per SSRC, maxDiagnosticSsrcs the
+// number of SSRCs with diagnostics.
+const (
+	maxDiagnostics     = 16
+	maxDiagnosticSsrcs = 256
+)
+
+type parseDiagnostics struct {
+	mutex sync.Mutex
+	ssrcs map[uint32]*diagnosticLog
+}
+
+type diagnosticLog struct {
+	count uint32 // all diagnostics of the SSRC
+	last  []ParseDiagnostic
+}
+
+// SetParseMode sets how the session handles malformed packets. ParseStrict, the default, drops
+// them. ParseLenient repairs them if possible: it clears a bad padding bit, drops the bytes
+// after the last complete RTCP packet of a compound, and reduces a report count to the report
+// blocks the packet holds. In both modes the session records a diagnostic for each malformed
+// field, see ParseDiagnostics. Set the mode before the session starts.
+//
+//   mode - ParseStrict or ParseLenient
+//
+func (rs *Session) SetParseMode(mode int) {
+	rs.parseMode = mode
+}
+
+// ParseDiagnostics returns the last diagnostics of the packets with the SSRC, oldest first,
+// and the number of all diagnostics of the SSRC. The session keeps 16 diagnostics per SSRC.
+// Diagnostics of packets too short to carry a SSRC use SSRC 0.
+func (rs *Session) ParseDiagnostics(ssrc uint32) (diags []ParseDiagnostic, count uint32) {
+	rs.diagnostics.mutex.Lock()
+	defer rs.diagnostics.mutex.Unlock()
+	if log, ok := rs.diagnostics.ssrcs[ssrc]; ok {
+		return append([]ParseDiagnostic{}, log.last...), log.count
+	}
+	return nil, 0
+}
+
+// *** Local functions and methods.
+
+func (pd *parseDiagnostics) record(ssrc uint32, field, detail string, repaired bool) {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+	if pd.ssrcs == nil {
+		pd.ssrcs = make(map[uint32]*diagnosticLog)
+	}
+	log, ok := pd.ssrcs[ssrc]
+	if !ok {
+		if len(pd.ssrcs) >= maxDiagnosticSsrcs {
+			return
+		}
+		log = new(diagnosticLog)
+		pd.ssrcs[ssrc] = log
+	}
+	log.count++
+	if len(log.last) == maxDiagnostics {
+		log.last = append(log.last[:0], log.last[1:]...)
+	}
+	log.last = append(log.last, ParseDiagnostic{Time: time.Now(), Field: field, Detail: detail, Repaired: repaired})
+}
+
+// checkData checks the structure of a received RTP packet. It returns false if the session must
+// drop the packet.
+func (rs *Session) checkData(rp *DataPacket) bool {
+	if rp.inUse < rtpHeaderLength {
+		rs.diagnostics.record(0, FieldHeader, fmt.Sprintf("%d bytes", rp.inUse), false)
+		return false
+	}
+	ssrc := rp.Ssrc()
+	hdr := rtpHeaderLength + int(rp.CsrcCount())*4
+	if hdr > rp.inUse {
+		rs.diagnostics.record(ssrc, FieldCsrcCount, fmt.Sprintf("%d CSRCs in %d bytes", rp.CsrcCount(), rp.inUse), false)
+		return false
+	}
+	if rp.ExtensionBit() {
+		if hdr+4 > rp.inUse || hdr+rp.ExtensionLength() > rp.inUse {
+			rs.diagnostics.record(ssrc, FieldExtension, fmt.Sprintf("extension at %d exceeds %d bytes", hdr, rp.inUse), false)
+			return false
+		}
+		hdr += rp.ExtensionLength()
+	}
+	if rp.Padding() {
+		if pad := int(rp.buffer[rp.inUse-1]); pad == 0 || hdr+pad > rp.inUse {
+			repair := rs.parseMode == ParseLenient
+			rs.diagnostics.record(ssrc, FieldPadding, fmt.Sprintf("padding %d, %d bytes after the header", pad, rp.inUse-hdr), repair)
+			if !repair {
+				return false
+			}
+			rp.buffer[0] &^= paddingBit // keep the bytes as payload
+		}
+	}
+	return rs.checkStrictPtime(rp)
+}
+
+// checkCtrl checks the structure of a received RTCP compound. It returns false if the session
+// must drop the compound.
+func (rs *Session) checkCtrl(rp *CtrlPacket) bool {
+	var ssrc uint32
+	if rp.inUse >= rtcpHeaderLength+rtcpSsrcLength {
+		ssrc = rp.Ssrc(0)
+	}
+	repair := rs.parseMode == ParseLenient
+	offset := 0
+	for offset < rp.inUse {
+		if offset+rtcpHeaderLength+rtcpSsrcLength > rp.inUse {
+			rs.diagnostics.record(ssrc, FieldRtcpLength, fmt.Sprintf("%d trailing bytes", rp.inUse-offset), repair && offset > 0)
+			break
+		}
+		if (rp.buffer[offset] & versionMask) != version2Bit {
+			rs.diagnostics.record(ssrc, FieldVersion, fmt.Sprintf("version %d at %d", rp.buffer[offset]>>6, offset), false)
+			return false
+		}
+		pktLen := int(rp.Length(offset)+1) * 4
+		if offset+pktLen > rp.inUse {
+			rs.diagnostics.record(ssrc, FieldRtcpLength, fmt.Sprintf("%d bytes at %d exceed %d bytes", pktLen, offset, rp.inUse), repair && offset > 0)
+			break
+		}
+		var blocks int
+		switch rp.Type(offset) {
+		case RtcpSR:
+			blocks = (pktLen - rtcpHeaderLength - rtcpSsrcLength - senderInfoLen) / reportBlockLen
+		case RtcpRR:
+			blocks = (pktLen - rtcpHeaderLength - rtcpSsrcLength) / reportBlockLen
+		default:
+			blocks = rp.Count(offset)
+		}
+		if rp.Count(offset) > blocks {
+			rs.diagnostics.record(ssrc, FieldReportCount, fmt.Sprintf("%d reports, room for %d", rp.Count(offset), blocks), repair && blocks >= 0)
+			if !repair || blocks < 0 {
+				return false
+			}
+			rp.buffer[offset] &^= countMask
+			rp.SetCount(offset, blocks)
+		}
+		offset += pktLen
+	}
+	if offset == rp.inUse {
+		return true
+	}
+	if !repair || offset == 0 {
+		return false
+	}
+	rp.inUse = offset // skip the malformed rest of the compound
+	return true
+}
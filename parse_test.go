@@ -0,0 +1,87 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+)
+
+// badPadding returns a RTP packet with the padding bit set and a padding count of 0.
+func badPadding(ssrc uint32) *DataPacket {
+	rp := newDataPacket()
+	rp.SetSsrc(ssrc)
+	rp.SetPayload([]byte{1, 2, 3, 0})
+	rp.buffer[0] |= paddingBit
+	rp.fromAddr = Address{IpAddr: net.IPv4(127, 0, 0, 1), DataPort: 6002, CtrlPort: 6003}
+	return rp
+}
+
+// badReportCount returns a RR that claims two report blocks but holds none, followed by junk.
+func badReportCount(ssrc uint32) *CtrlPacket {
+	rc, offset := newCtrlPacket()
+	rc.SetType(0, RtcpRR)
+	rc.SetCount(0, 2)
+	rc.addHeaderSsrc(offset, ssrc)
+	rc.SetLength(0, 1)
+	rc.inUse = rtcpHeaderLength + rtcpSsrcLength + 2
+	rc.fromAddr = Address{IpAddr: net.IPv4(127, 0, 0, 1), DataPort: 6002, CtrlPort: 6003}
+	return rc
+}
+
+func TestParseModes(t *testing.T) {
+	parseFlags()
+
+	rs := NewSession(new(captureWriter), new(teeConsumer))
+	if rs.OnRecvData(badPadding(0x0a0a0a0a)) {
+		t.Errorf("Strict mode must drop a packet with a bad padding\n")
+	}
+	rs.SetParseMode(ParseLenient)
+	if !rs.OnRecvData(badPadding(0x0a0a0a0a)) {
+		t.Errorf("Lenient mode must repair a bad padding\n")
+	}
+	diags, count := rs.ParseDiagnostics(0x0a0a0a0a)
+	if count != 2 || diags[0].Field != FieldPadding || diags[0].Repaired || !diags[1].Repaired {
+		t.Errorf("Padding diagnostics check failed: %+v\n", diags)
+	}
+
+	rp := newDataPacket()
+	rp.SetSsrc(0x0b0b0b0b)
+	rp.buffer[0] |= 0x0f // 15 CSRCs in a 12 bytes packet
+	if rs.OnRecvData(rp) {
+		t.Errorf("Lenient mode must drop a packet with a truncated CSRC list\n")
+	}
+	if diags, _ = rs.ParseDiagnostics(0x0b0b0b0b); len(diags) != 1 || diags[0].Field != FieldCsrcCount {
+		t.Errorf("CSRC diagnostics check failed: %+v\n", diags)
+	}
+
+	rs, _ = closeSession(false)
+	if rs.OnRecvCtrl(badReportCount(0x0c0c0c0c)) {
+		t.Errorf("Strict mode must drop a RR with a bad report count\n")
+	}
+	rs.SetParseMode(ParseLenient)
+	rc := badReportCount(0x0c0c0c0c)
+	if !rs.checkCtrl(rc) || rc.Count(0) != 0 || rc.inUse != rtcpHeaderLength+rtcpSsrcLength {
+		t.Errorf("Lenient RTCP repair check failed: count %d, length %d\n", rc.Count(0), rc.inUse)
+	}
+	diags, _ = rs.ParseDiagnostics(0x0c0c0c0c)
+	if len(diags) != 3 || diags[1].Field != FieldReportCount || diags[2].Field != FieldRtcpLength || !diags[2].Repaired {
+		t.Errorf("RTCP diagnostics check failed: %+v\n", diags)
+	}
+}
@@ -18,6 +18,10 @@
 
 package rtp
 
+import (
+	"time"
+)
+
 // For full reference of registered RTP parameters and payload types refer to:
 // http://www.iana.org/assignments/rtp-parameters
 
@@ -84,62 +88,73 @@ const (
 // For example if a dynamic format uses the payload number 98 then the application
 // may perform:
 //
-//     PayloadFormatMap[98] = &net.rtp.PayloadFormat{98, net.rtp.Audio, 41000, 2, "CD"}
+//     PayloadFormatMap[98] = &net.rtp.PayloadFormat{TypeNumber: 98, MediaType: net.rtp.Audio, ClockRate: 41000, Channels: 2, Name: "CD"}
+//
+// Create the formats with keyed literals as in the example, the positional form breaks when
+// PayloadFormat gets new fields, as it did with FrameDuration and FrameSize.
+//
+// Frame based formats, and sample based formats with a fixed bit rate, also define the duration
+// and the size of a frame. Sample based formats use 10 ms blocks as frames. Formats with a zero
+// FrameDuration have frames of variable size, see WriteFrames and SplitFrames. Formats with a
+// fixed frame duration but several frame sizes, for example G.723.1 with 24 byte frames at 6.3
+// kbit/s and 20 byte frames at 5.3 kbit/s, have a zero FrameSize.
 //
 type PayloadFormat struct {
 	TypeNumber,
 	MediaType,
 	ClockRate,
 	Channels int
-	Name string
+	Name          string
+	FrameDuration time.Duration // duration of a frame, 0 if not fixed
+	FrameSize     int           // bytes of a frame, 0 if not fixed
 }
 type payloadMap map[int]*PayloadFormat
 
 var PayloadFormatMap = make(payloadMap, 128)
 
 func init() {
-	PayloadFormatMap[0] = &PayloadFormat{0, Audio, 8000, 1, "PCMU"}
+	PayloadFormatMap[0] = &PayloadFormat{TypeNumber: 0, MediaType: Audio, ClockRate: 8000, Channels: 1, Name: "PCMU", FrameDuration: 10 * time.Millisecond, FrameSize: 80}
 	// 1         Reserved
 	// 2         Reserved
-	PayloadFormatMap[3] = &PayloadFormat{3, Audio, 8000, 1, "GSM"}
-	PayloadFormatMap[4] = &PayloadFormat{4, Audio, 8000, 1, "G723"}
-	PayloadFormatMap[5] = &PayloadFormat{5, Audio, 8000, 1, "DVI4"}
-	PayloadFormatMap[6] = &PayloadFormat{6, Audio, 16000, 1, "DVI4"}
-	PayloadFormatMap[7] = &PayloadFormat{7, Audio, 8000, 1, "LPC"}
-	PayloadFormatMap[8] = &PayloadFormat{8, Audio, 8000, 1, "PCMA"}
-	PayloadFormatMap[9] = &PayloadFormat{9, Audio, 8000, 1, "G722"}
-	PayloadFormatMap[10] = &PayloadFormat{10, Audio, 44100, 2, "L16"}
-	PayloadFormatMap[11] = &PayloadFormat{11, Audio, 44100, 1, "L16"}
-	PayloadFormatMap[12] = &PayloadFormat{12, Audio, 8000, 1, "QCELP"}
-	PayloadFormatMap[13] = &PayloadFormat{13, Audio, 8000, 1, "CN"}
-	PayloadFormatMap[14] = &PayloadFormat{14, Audio, 90000, 0, "MPA"}
-	PayloadFormatMap[15] = &PayloadFormat{15, Audio, 8000, 1, "G728"}
-	PayloadFormatMap[16] = &PayloadFormat{16, Audio, 11025, 1, "DVI4"}
-	PayloadFormatMap[17] = &PayloadFormat{17, Audio, 22050, 1, "DVI4"}
-	PayloadFormatMap[18] = &PayloadFormat{18, Audio, 8000, 1, "G729"}
+	PayloadFormatMap[3] = &PayloadFormat{TypeNumber: 3, MediaType: Audio, ClockRate: 8000, Channels: 1, Name: "GSM", FrameDuration: 20 * time.Millisecond, FrameSize: 33}
+	PayloadFormatMap[4] = &PayloadFormat{TypeNumber: 4, MediaType: Audio, ClockRate: 8000, Channels: 1, Name: "G723", FrameDuration: 30 * time.Millisecond}
+	PayloadFormatMap[5] = &PayloadFormat{TypeNumber: 5, MediaType: Audio, ClockRate: 8000, Channels: 1, Name: "DVI4"}
+	PayloadFormatMap[6] = &PayloadFormat{TypeNumber: 6, MediaType: Audio, ClockRate: 16000, Channels: 1, Name: "DVI4"}
+	PayloadFormatMap[7] = &PayloadFormat{TypeNumber: 7, MediaType: Audio, ClockRate: 8000, Channels: 1, Name: "LPC", FrameDuration: 20 * time.Millisecond, FrameSize: 14}
+	PayloadFormatMap[8] = &PayloadFormat{TypeNumber: 8, MediaType: Audio, ClockRate: 8000, Channels: 1, Name: "PCMA", FrameDuration: 10 * time.Millisecond, FrameSize: 80}
+	PayloadFormatMap[9] = &PayloadFormat{TypeNumber: 9, MediaType: Audio, ClockRate: 8000, Channels: 1, Name: "G722", FrameDuration: 10 * time.Millisecond, FrameSize: 80}
+	PayloadFormatMap[10] = &PayloadFormat{TypeNumber: 10, MediaType: Audio, ClockRate: 44100, Channels: 2, Name: "L16", FrameDuration: 10 * time.Millisecond, FrameSize: 1764}
+	PayloadFormatMap[11] = &PayloadFormat{TypeNumber: 11, MediaType: Audio, ClockRate: 44100, Channels: 1, Name: "L16", FrameDuration: 10 * time.Millisecond, FrameSize: 882}
+	PayloadFormatMap[12] = &PayloadFormat{TypeNumber: 12, MediaType: Audio, ClockRate: 8000, Channels: 1, Name: "QCELP"}
+	PayloadFormatMap[13] = &PayloadFormat{TypeNumber: 13, MediaType: Audio, ClockRate: 8000, Channels: 1, Name: "CN"}
+	PayloadFormatMap[14] = &PayloadFormat{TypeNumber: 14, MediaType: Audio, ClockRate: 90000, Channels: 0, Name: "MPA"}
+	PayloadFormatMap[15] = &PayloadFormat{TypeNumber: 15, MediaType: Audio, ClockRate: 8000, Channels: 1, Name: "G728", FrameDuration: 2500 * time.Microsecond, FrameSize: 5}
+	PayloadFormatMap[16] = &PayloadFormat{TypeNumber: 16, MediaType: Audio, ClockRate: 11025, Channels: 1, Name: "DVI4"}
+	PayloadFormatMap[17] = &PayloadFormat{TypeNumber: 17, MediaType: Audio, ClockRate: 22050, Channels: 1, Name: "DVI4"}
+	PayloadFormatMap[18] = &PayloadFormat{TypeNumber: 18, MediaType: Audio, ClockRate: 8000, Channels: 1, Name: "G729", FrameDuration: 10 * time.Millisecond, FrameSize: 10}
 	// 19        Reserved        A
 	// 20        Unassigned      A
 	// 21        Unassigned      A
 	// 22        Unassigned      A
 	// 23        Unassigned      A
 	// 24        Unassigned      V
-	PayloadFormatMap[25] = &PayloadFormat{25, Video, 90000, 0, "CelB"}
-	PayloadFormatMap[26] = &PayloadFormat{26, Video, 90000, 0, "JPEG"}
+	PayloadFormatMap[25] = &PayloadFormat{TypeNumber: 25, MediaType: Video, ClockRate: 90000, Channels: 0, Name: "CelB"}
+	PayloadFormatMap[26] = &PayloadFormat{TypeNumber: 26, MediaType: Video, ClockRate: 90000, Channels: 0, Name: "JPEG"}
 	// 27        Unassigned      V
-	PayloadFormatMap[28] = &PayloadFormat{28, Video, 90000, 0, "nv"}
+	PayloadFormatMap[28] = &PayloadFormat{TypeNumber: 28, MediaType: Video, ClockRate: 90000, Channels: 0, Name: "nv"}
 	// 29        Unassigned      V
 	// 30        Unassigned      V
-	PayloadFormatMap[31] = &PayloadFormat{31, Video, 90000, 0, "H261"}
-	PayloadFormatMap[32] = &PayloadFormat{32, Video, 90000, 0, "MPV"}
-	PayloadFormatMap[33] = &PayloadFormat{33, Audio | Video, 90000, 0, "MP2T"}
-	PayloadFormatMap[34] = &PayloadFormat{34, Video, 90000, 0, "H263"}
+	PayloadFormatMap[31] = &PayloadFormat{TypeNumber: 31, MediaType: Video, ClockRate: 90000, Channels: 0, Name: "H261"}
+	PayloadFormatMap[32] = &PayloadFormat{TypeNumber: 32, MediaType: Video, ClockRate: 90000, Channels: 0, Name: "MPV"}
+	PayloadFormatMap[33] = &PayloadFormat{TypeNumber: 33, MediaType: Audio | Video, ClockRate: 90000, Channels: 0, Name: "MP2T"}
+	PayloadFormatMap[34] = &PayloadFormat{TypeNumber: 34, MediaType: Video, ClockRate: 90000, Channels: 0, Name: "H263"}
 	// 35-71     Unassigned      ?
 	// 72-76     Reserved for RTCP conflict avoidance
 	// 77-95     Unassigned      ?
 	// 96-127    dynamic         ?
-	PayloadFormatMap[96] = &PayloadFormat{96, Video, 90000, 0, "H264"}
-	PayloadFormatMap[97] = &PayloadFormat{97, Audio, 90000, 0, "DYN1"}
-	PayloadFormatMap[98] = &PayloadFormat{98, Audio, 90000, 0, "DYN2"}
-	PayloadFormatMap[99] = &PayloadFormat{99, Audio, 90000, 0, "DYN3"}
-	PayloadFormatMap[100] = &PayloadFormat{100, Audio, 90000, 0, "DYN4"}
+	PayloadFormatMap[96] = &PayloadFormat{TypeNumber: 96, MediaType: Video, ClockRate: 90000, Channels: 0, Name: "H264"}
+	PayloadFormatMap[97] = &PayloadFormat{TypeNumber: 97, MediaType: Audio, ClockRate: 90000, Channels: 0, Name: "DYN1"}
+	PayloadFormatMap[98] = &PayloadFormat{TypeNumber: 98, MediaType: Audio, ClockRate: 90000, Channels: 0, Name: "DYN2"}
+	PayloadFormatMap[99] = &PayloadFormat{TypeNumber: 99, MediaType: Audio, ClockRate: 90000, Channels: 0, Name: "DYN3"}
+	PayloadFormatMap[100] = &PayloadFormat{TypeNumber: 100, MediaType: Audio, ClockRate: 90000, Channels: 0, Name: "DYN4"}
 }
@@ -0,0 +1,185 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+ * This source file contains the UDP port pool: it binds the port pairs of a range at startup
+ * and leases bound transports to sessions, thus call setup doesn't wait for bind calls and
+ * doesn't race with other processes for the ports.
+ */
+
+// UdpPortPool leases UDP transports with pre-bound port pairs.
+//
+// NewUdpPortPool binds the RTP data port and the RTCP control port of each pair of the range
+// and keeps the bound transports. Lease returns one of them, Release closes the transport of
+// an ended session and binds its port pair again. Released pairs go to the end of the queue,
+// thus the pool reuses a pair as late as possible. The sockets of a free pair receive the late
+// packets of the old call, Lease discards them before it returns the transport. If a port pair cannot be bound again, for example because another process took
+// it, the pool retries on later leases.
+//
+type UdpPortPool struct {
+	addr    *net.IPAddr
+	mutex   sync.Mutex
+	free    []*TransportUDP
+	leased  map[int]bool // data ports of the leased transports
+	unbound []int        // data ports that failed to bind again
+}
+
+// NewUdpPortPool creates the pool and binds the port pairs in the range. The function skips
+// port pairs that are in use and returns an error if it could not bind any pair.
+//
+//   addr             - the local IP address of the transports
+//   minPort, maxPort - the range of the RTP data ports, the RTCP control ports are the following odd ports
+//
+func NewUdpPortPool(addr *net.IPAddr, minPort, maxPort int) (*UdpPortPool, error) {
+	if minPort <= 0 || maxPort > 0xfffe || maxPort < minPort {
+		return nil, Error("Invalid port range.")
+	}
+	pp := &UdpPortPool{addr: addr, leased: make(map[int]bool)}
+	for port := minPort + minPort&1; port <= maxPort; port += 2 {
+		if tp := pp.bind(port); tp != nil {
+			pp.free = append(pp.free, tp)
+		}
+	}
+	if len(pp.free) == 0 {
+		return nil, Error("No free port pair in range.")
+	}
+	return pp, nil
+}
+
+// Lease returns a transport with bound ports. The caller creates the session with it and calls
+// Release when the session ended. ListenOnTransports, usually via StartSession, starts the
+// receivers as usual.
+func (pp *UdpPortPool) Lease() (*TransportUDP, error) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	if len(pp.free) == 0 {
+		pp.rebind()
+	}
+	if len(pp.free) == 0 {
+		return nil, Error("UdpPortPool: no free port pair.")
+	}
+	tp := pp.free[0]
+	pp.free[0] = nil
+	pp.free = pp.free[1:]
+	port, _ := tp.LocalPorts()
+	pp.leased[port] = true
+	drainSocket(tp.dataConn)
+	drainSocket(tp.ctrlConn)
+	return tp, nil
+}
+
+// Release closes the leased transport, see CloseRecv, and returns its port pair to the pool.
+// The session shall not use the transport anymore.
+func (pp *UdpPortPool) Release(tp *TransportUDP) error {
+	port, _ := tp.LocalPorts()
+
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	if !pp.leased[port] {
+		return Error("UdpPortPool: transport not leased from this pool.")
+	}
+	delete(pp.leased, port)
+	tp.CloseRecv()
+	if ntp := pp.bind(port); ntp != nil {
+		pp.free = append(pp.free, ntp)
+	} else if pp.addr != nil {
+		pp.unbound = append(pp.unbound, port)
+	}
+	return nil
+}
+
+// Free returns the number of bound port pairs that the pool can lease.
+func (pp *UdpPortPool) Free() int {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	return len(pp.free)
+}
+
+// Leased returns the number of leased port pairs.
+func (pp *UdpPortPool) Leased() int {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	return len(pp.leased)
+}
+
+// Close closes the sockets of the free port pairs. The leased transports stay open until they
+// are released; Release closes them but doesn't bind their ports again.
+func (pp *UdpPortPool) Close() {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	for _, tp := range pp.free {
+		tp.CloseRecv()
+	}
+	pp.free = nil
+	pp.unbound = nil
+	pp.addr = nil
+}
+
+// *** Local functions and methods.
+
+// bind returns a new transport with the bound port pair, nil if the pool is closed or the
+// ports are in use.
+func (pp *UdpPortPool) bind(port int) *TransportUDP {
+	if pp.addr == nil {
+		return nil
+	}
+	tp, _ := NewTransportUDP(pp.addr, port)
+	if tp.bind() != nil {
+		return nil
+	}
+	return tp
+}
+
+// drainWait is the time drainSocket waits for a further queued packet.
+const drainWait = time.Millisecond
+
+// drainSocket discards the packets that wait in the socket's receive queue.
+func drainSocket(conn *net.UDPConn) {
+	buf := make([]byte, defaultBufferSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(drainWait))
+		if _, _, err := conn.ReadFromUDP(buf); err != nil {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+}
+
+// rebind retries the port pairs that failed to bind again. The caller holds the mutex.
+func (pp *UdpPortPool) rebind() {
+	unbound := pp.unbound
+	pp.unbound = nil
+	for _, port := range unbound {
+		if tp := pp.bind(port); tp != nil {
+			pp.free = append(pp.free, tp)
+		} else {
+			pp.unbound = append(pp.unbound, port)
+		}
+	}
+}
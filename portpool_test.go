@@ -0,0 +1,116 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUdpPortPool(t *testing.T) {
+	parseFlags()
+
+	local, _ := net.ResolveIPAddr("ip", "127.0.0.1")
+	busy, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Port: 55403}) // the control port of a pair
+	if err != nil {
+		t.Errorf("Listen failed: %s\n", err)
+		return
+	}
+	pp, err := NewUdpPortPool(local, 55400, 55404)
+	if err != nil || pp.Free() != 2 {
+		t.Errorf("Pool bind check failed\n")
+		return
+	}
+	defer pp.Close()
+
+	first, _ := pp.Lease()
+	second, _ := pp.Lease()
+	if first == nil || second == nil || pp.Leased() != 2 {
+		t.Errorf("Lease check failed\n")
+		return
+	}
+	defer pp.Release(second)
+	if port, _ := first.LocalPorts(); port != 55400 {
+		t.Errorf("Lease order check failed. Got: %d\n", port)
+	}
+	if conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Port: 55404}); err == nil {
+		conn.Close()
+		t.Errorf("Leased ports are not bound\n")
+	}
+	if _, err := pp.Lease(); err == nil {
+		t.Errorf("Exhausted pool check failed\n")
+	}
+	foreign, _ := NewTransportUDP(local, 55410)
+	if pp.Release(foreign) == nil {
+		t.Errorf("Foreign transport check failed\n")
+	}
+
+	// a released pair is bound again, a pair that becomes free is bound on a later lease
+	if err := pp.Release(first); err != nil || pp.Free() != 1 || pp.Leased() != 1 {
+		t.Errorf("Release check failed\n")
+	}
+	if pp.Release(first) == nil {
+		t.Errorf("Double release check failed\n")
+	}
+	// a late packet of the old call waits in the free socket, the lease discards it
+	late, _ := net.DialUDP("udp", nil, &net.UDPAddr{IP: local.IP, Port: 55400})
+	late.Write([]byte{0x80, 0, 0, 1})
+	time.Sleep(10 * time.Millisecond)
+	again, _ := pp.Lease()
+	if port, _ := again.LocalPorts(); port != 55400 || again == first {
+		t.Errorf("Reuse check failed. Got: %d\n", port)
+	}
+	late.Write([]byte{0x80, 0, 0, 2})
+	buf := make([]byte, 16)
+	again.dataConn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := again.dataConn.ReadFromUDP(buf); err != nil || n != 4 || buf[3] != 2 {
+		t.Errorf("Late packet check failed, the lease received: %v\n", buf[:n])
+	}
+	again.dataConn.SetReadDeadline(time.Time{})
+	late.Close()
+	busy.Close()
+	pp.unbound = append(pp.unbound, 55402)
+	rebound, err := pp.Lease()
+	if err != nil {
+		t.Errorf("Rebind check failed: %s\n", err)
+		return
+	}
+	defer pp.Release(rebound)
+	if port, _ := rebound.LocalPorts(); port != 55402 {
+		t.Errorf("Rebind port check failed. Got: %d\n", port)
+	}
+
+	// the session manager leases and returns the transports of its sessions
+	pp.Release(again)
+	sm, _ := NewSessionManager(local, 55420, 55424)
+	defer sm.Close()
+	sm.SetPortPool(pp)
+	if _, err := sm.NewSession("call-a"); err != nil {
+		t.Errorf("Managed lease failed: %s\n", err)
+		return
+	}
+	if callId, _ := sm.SessionForPort(55400); callId != "call-a" || pp.Free() != 0 {
+		t.Errorf("Managed port check failed. Got: %s\n", callId)
+	}
+	sm.RemoveSession("call-a")
+	if pp.Free() != 1 {
+		t.Errorf("Managed release check failed\n")
+	}
+}
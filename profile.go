@@ -0,0 +1,112 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stages of the packet processing a Profiler measures.
+const (
+	ProfileReceive = iota // session receive path of RTP and RTCP packets: checks, statistics and delivery
+	ProfileDeliver        // delivery of received RTP packets to the application, part of ProfileReceive
+	ProfileCrypto         // SRTP and SRTCP protection and unprotection
+	ProfileSend           // session send path of RTP and RTCP packets including the transport writes
+	profileStages
+)
+
+// Profiler measures the packet rate of a session and the time its packets spend in the
+// processing stages. Operators use it to attribute the CPU of a media host to sessions without
+// an external profiler.
+//
+// The profiler is optional: a session without profiler, and a transport without profiler,
+// skip the measurements. The profiler uses atomic counters only. Set it before the session
+// starts, see Session.SetProfiler and TransportSRTP.SetProfiler.
+//
+type Profiler struct {
+	stages  [profileStages]profileCounter // first field, 64 bit aligned in an allocated Profiler
+	packets bitrateMeter                  // counts packets instead of bytes
+}
+
+type profileCounter struct {
+	count uint64
+	nanos uint64
+}
+
+// ProfileStage contains the measurements of one stage.
+type ProfileStage struct {
+	Count   uint64        // number of measured packets
+	Total   time.Duration // time spent in the stage
+	Average time.Duration // time per packet
+}
+
+// ProfileStats contains the measurements of a Profiler, Stages is indexed by the Profile
+// stage constants.
+type ProfileStats struct {
+	PacketsPerSecond float64 // received and sent packets in the last second
+	Stages           [profileStages]ProfileStage
+}
+
+// NewProfiler creates a profiler.
+func NewProfiler() *Profiler {
+	return new(Profiler)
+}
+
+// Stats returns the current measurements.
+func (pf *Profiler) Stats() (stats ProfileStats) {
+	stats.PacketsPerSecond = pf.packets.rate(time.Second, time.Now().UnixNano()) / 8
+	for i := range pf.stages {
+		pc := &pf.stages[i]
+		st := &stats.Stages[i]
+		st.Count = atomic.LoadUint64(&pc.count)
+		st.Total = time.Duration(atomic.LoadUint64(&pc.nanos))
+		if st.Count > 0 {
+			st.Average = st.Total / time.Duration(st.Count)
+		}
+	}
+	return
+}
+
+// *** Local functions and methods.
+
+// begin returns the start time of a measurement, the zero time if pf is nil.
+func (pf *Profiler) begin() time.Time {
+	if pf == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// measure adds the time since start to the stage.
+func (pf *Profiler) measure(stage int, start time.Time) {
+	if pf == nil {
+		return
+	}
+	pc := &pf.stages[stage]
+	atomic.AddUint64(&pc.count, 1)
+	atomic.AddUint64(&pc.nanos, uint64(time.Since(start)))
+}
+
+// packet counts a received or sent packet.
+func (pf *Profiler) packet() {
+	if pf != nil {
+		pf.packets.add(1, time.Now().UnixNano())
+	}
+}
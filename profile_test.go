@@ -0,0 +1,66 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"testing"
+)
+
+func TestProfiler(t *testing.T) {
+	parseFlags()
+
+	rs, _ := closeSession(false)
+	if _, ok := rs.ProfileStats(); ok {
+		t.Errorf("Profiling must be off by default\n")
+	}
+	pf := NewProfiler()
+	rs.SetProfiler(pf)
+	for i := 0; i < 3; i++ {
+		rp := rs.NewDataPacket(uint32(i * 160))
+		rs.WriteData(rp)
+		rp.FreePacket()
+	}
+	rp := rs.NewDataPacket(0)
+	rp.SetSsrc(0x0a0b0c0d)
+	rs.rtcpServiceActive = false // no RTCP service reads the control channel
+	rs.OnRecvData(rp)
+
+	srtp, _ := NewTransportSRTP(nil, new(captureWriter), make([]byte, 30), nil)
+	srtp.SetProfiler(pf)
+	rp = rs.NewDataPacket(0)
+	srtp.WriteDataTo(rp, nil)
+	rp.FreePacket()
+
+	stats, ok := rs.ProfileStats()
+	if !ok {
+		t.Errorf("ProfileStats check failed\n")
+		return
+	}
+	for stage, count := range []uint64{ProfileReceive: 1, ProfileDeliver: 1, ProfileCrypto: 1, ProfileSend: 3} {
+		if stats.Stages[stage].Count != count {
+			t.Errorf("Stage %d count check failed. Expected: %d, got: %d\n", stage, count, stats.Stages[stage].Count)
+		}
+	}
+	if stats.PacketsPerSecond != 4 {
+		t.Errorf("Packet rate check failed. Expected: 4, got: %f\n", stats.PacketsPerSecond)
+	}
+	if st := stats.Stages[ProfileSend]; st.Total <= 0 || st.Average != st.Total/3 {
+		t.Errorf("Stage time check failed: %+v\n", st)
+	}
+}
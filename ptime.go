@@ -0,0 +1,156 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the packetization time (ptime) handling: aggregation of codec frames
+ * into packets and the splitting of received packets into frames.
+ */
+
+import (
+	"time"
+)
+
+// maxFramesPayload is the payload size limit WriteFrames passes to the formatter, with the RTP,
+// UDP and IP headers below the path MTU of most networks and tunnels.
+const maxFramesPayload = 1200
+
+// SetPtime sets the packetization times of the output stream as negotiated in SDP, see
+// RFC 4566 a=ptime and a=maxptime. WriteFrames puts as many frames into a packet as fit into
+// ptime, never more than fit into maxPtime.
+//
+//   ptime    - the preferred duration of the media in a packet, 0 uses maxPtime
+//   maxPtime - the maximum duration of the media in a packet, 0 for no limit
+//
+func (str *SsrcStream) SetPtime(ptime, maxPtime time.Duration) error {
+	if ptime < 0 || maxPtime < 0 || (maxPtime > 0 && ptime > maxPtime) {
+		return Error("Invalid packetization time.")
+	}
+	str.streamMutex.Lock()
+	str.ptime, str.maxPtime = ptime, maxPtime
+	str.streamMutex.Unlock()
+	return nil
+}
+
+// Ptime returns the packetization times of the output stream.
+func (str *SsrcStream) Ptime() (ptime, maxPtime time.Duration) {
+	str.streamMutex.Lock()
+	defer str.streamMutex.Unlock()
+	return str.ptime, str.maxPtime
+}
+
+// FrameSamples returns the number of timestamp units of a frame, 0 if the format has no fixed
+// frame duration.
+func (pf *PayloadFormat) FrameSamples() uint32 {
+	return uint32(int64(pf.ClockRate) * int64(pf.FrameDuration) / int64(time.Second))
+}
+
+// WriteFrames packetizes codec frames and sends them on the output stream.
+//
+// The formatter of the stream's payload format, see PayloadFormatter, builds the payloads. The
+// built-in formatter of a format with a fixed frame duration puts as many frames into a packet
+// as the stream's packetization times allow, see SetPtime. Without packetization times every
+// frame goes into its own packet. A strict packet time, see SetAes67Profile, sends every
+// frame in its own packet and rejects frames of another size. The method returns the
+// timestamp of the frame that follows the last sent frame.
+//
+//   streamIndex - the index of the output stream as returned by NewSsrcStreamOut
+//   stamp       - the RTP timestamp of the first frame
+//   frames      - the codec frames in playout order
+//
+func (rs *Session) WriteFrames(streamIndex uint32, stamp uint32, frames [][]byte) (next uint32, err error) {
+	str := rs.SsrcStreamOutForIndex(streamIndex)
+	if str == nil {
+		return stamp, Error("No output stream at this index.")
+	}
+	pf := PayloadFormatMap[int(str.PayloadType())]
+	var formatter PayloadFormatter
+	if pf != nil {
+		formatter = pf.Formatter()
+	}
+	if formatter == nil {
+		return stamp, Error("Payload format has no fixed frame duration.")
+	}
+	ptime, maxPtime := str.Ptime()
+	if strict, ok, err := rs.strictFrames(str.PayloadType(), frames); err != nil {
+		return stamp, err
+	} else if ok {
+		ptime, maxPtime = strict, strict
+	}
+	payloads, err := formatter.Packetize(frames, ptime, maxPtime, maxFramesPayload)
+	if err != nil {
+		return stamp, err
+	}
+	for _, fp := range payloads {
+		rp := rs.NewDataPacketForStream(streamIndex, stamp)
+		rp.SetPayload(fp.Payload)
+		rp.SetMarker(fp.Marker)
+		_, err = rs.WriteData(rp)
+		rp.FreePacket()
+		if err != nil {
+			return stamp, err
+		}
+		stamp += fp.Samples
+	}
+	return stamp, nil
+}
+
+// SplitFrames splits the payload of a received packet into the codec frames with the formatter
+// of the payload format, see PayloadFormatter. It returns the frames and their timestamps, the
+// frames of formats without a fixed frame duration have the timestamp of the packet. The
+// built-in formatter of a format with a fixed frame size splits the payload by the frame size,
+// a trailing short frame, for example a G.729 Annex B comfort noise frame, is the last frame.
+// The function returns false if the payload format has no formatter or the formatter fails.
+//
+func SplitFrames(rp *DataPacket) (frames [][]byte, stamps []uint32, ok bool) {
+	pf := PayloadFormatMap[int(rp.PayloadType())]
+	if pf == nil {
+		return nil, nil, false
+	}
+	formatter := pf.Formatter()
+	if formatter == nil {
+		return nil, nil, false
+	}
+	frames, err := formatter.Depacketize(rp.Payload())
+	if err != nil {
+		return nil, nil, false
+	}
+	samples := uint32(int64(formatter.ClockRate()) * int64(formatter.FrameDuration()) / int64(time.Second))
+	stamp := rp.Timestamp()
+	for range frames {
+		stamps = append(stamps, stamp)
+		stamp += samples
+	}
+	return frames, stamps, true
+}
+
+// framesPerPacket returns the number of frames that fit into ptime and maxPtime, at least one.
+func framesPerPacket(frame, ptime, maxPtime time.Duration) int {
+	if ptime == 0 {
+		ptime = maxPtime
+	}
+	n := int(ptime / frame)
+	if maxPtime > 0 && n > int(maxPtime/frame) {
+		n = int(maxPtime / frame)
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPtime(t *testing.T) {
+	parseFlags()
+
+	rs, ct := closeSession(false)
+	str := rs.SsrcStreamOutForIndex(0)
+	if err := str.SetPtime(40*time.Millisecond, 20*time.Millisecond); err == nil {
+		t.Errorf("SetPtime check failed, ptime exceeds maxptime\n")
+	}
+	str.SetPtime(30*time.Millisecond, 20*time.Millisecond)
+	if err := str.SetPtime(30*time.Millisecond, 0); err != nil {
+		t.Errorf("SetPtime failed: %s\n", err)
+	}
+
+	// PCMU uses 10 ms frames of 80 bytes, 30 ms packets hold 3 frames
+	frames := make([][]byte, 7)
+	for i := range frames {
+		frames[i] = make([]byte, 80)
+		frames[i][0] = byte(i)
+	}
+	next, err := rs.WriteFrames(0, 1000, frames)
+	if err != nil {
+		t.Errorf("WriteFrames failed: %s\n", err)
+		return
+	}
+	if next != 1000+7*80 || len(ct.captureWriter.data) != 3 {
+		t.Errorf("WriteFrames check failed. Next stamp: %d, packets: %d\n", next, len(ct.captureWriter.data))
+		return
+	}
+	for i, length := range []int{240, 240, 80} {
+		rp, _ := NewDataPacketFromBuffer(ct.captureWriter.data[i])
+		if len(rp.Payload()) != length {
+			t.Errorf("Packet %d length check failed. Expected: %d, got: %d\n", i, length, len(rp.Payload()))
+		}
+	}
+
+	rp, _ := NewDataPacketFromBuffer(ct.captureWriter.data[1])
+	split, stamps, ok := SplitFrames(rp)
+	if !ok || len(split) != 3 || split[0][0] != 3 || split[2][0] != 5 || stamps[1]-stamps[0] != 80 || stamps[0] != rp.Timestamp() {
+		t.Errorf("SplitFrames check failed\n")
+	}
+
+	// Maxptime limits the aggregation of G.729 frames, a trailing SID frame splits off
+	str.SetPayloadType(18)
+	str.SetPtime(0, 20*time.Millisecond)
+	ct.captureWriter.data = nil
+	rs.WriteFrames(0, 0, [][]byte{make([]byte, 10), make([]byte, 10), make([]byte, 2)})
+	if len(ct.captureWriter.data) != 2 {
+		t.Errorf("Maxptime check failed. Packets: %d\n", len(ct.captureWriter.data))
+		return
+	}
+	rp, _ = NewDataPacketFromBuffer(ct.captureWriter.data[1])
+	if split, _, _ = SplitFrames(rp); len(split) != 1 || len(split[0]) != 2 {
+		t.Errorf("SID frame check failed\n")
+	}
+
+	str.SetPayloadType(96) // H264 has no fixed frames
+	if _, err = rs.WriteFrames(0, 0, frames); err == nil {
+		t.Errorf("WriteFrames frame duration check failed\n")
+	}
+}
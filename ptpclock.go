@@ -0,0 +1,143 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+package rtp
+
+/*
+ * This source file contains the reference clock of a PTP (IEEE 1588) disciplined clock.
+ */
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// PtpClock is a ReferenceClock that reads a PTP disciplined clock, for example the PTP
+// hardware clock of a network card that ptp4l synchronizes to the house grandmaster, see
+// OpenPtpDevice, or a clock the application reads itself, see NewPtpClock. Set it as the
+// reference clock of a session to derive the RTP timestamps and the NTP fields of the sender
+// reports from the house clock, see SetReferenceClock and SetAes67Profile.
+//
+// The time of the clock is the PTP timescale (TAI), it is ahead of UTC by the leap seconds.
+// If a reading fails the clock continues from the last good reading with the system's
+// monotonic clock, Failures reports the failures.
+//
+type PtpClock struct {
+	read   func() (time.Time, error)
+	closer io.Closer
+
+	mutex    sync.Mutex
+	last     time.Time // last good reading of the PTP clock
+	lastMono time.Time // system time of the last good reading, with its monotonic reading
+	err      error
+	failures uint32
+}
+
+// NewPtpClock creates a PTP clock that reads the time with a callback.
+//
+//   read - returns the current time of the PTP disciplined clock
+//
+func NewPtpClock(read func() (time.Time, error)) (*PtpClock, error) {
+	if read == nil {
+		return nil, Error("NewPtpClock: no read function.")
+	}
+	pc := &PtpClock{read: read}
+	if _, err := pc.sample(); err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// OpenPtpDevice opens a PTP hardware clock device, for example "/dev/ptp0". The function is
+// available on Linux only, other platforms use NewPtpClock. Close the clock to release the
+// device.
+//
+//   path - the path of the PTP clock device
+//
+func OpenPtpDevice(path string) (*PtpClock, error) {
+	read, closer, err := openPtpDevice(path)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := NewPtpClock(read)
+	if err != nil {
+		closer.Close()
+		return nil, err
+	}
+	pc.closer = closer
+	return pc, nil
+}
+
+// Now returns the current time of the PTP clock.
+func (pc *PtpClock) Now() time.Time {
+	tm, err := pc.sample()
+	if err == nil {
+		return tm
+	}
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	if pc.last.IsZero() {
+		return time.Now()
+	}
+	return pc.last.Add(time.Since(pc.lastMono))
+}
+
+// Failures returns the number of failed readings and the error of the last reading, nil if
+// it succeeded.
+func (pc *PtpClock) Failures() (uint32, error) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	return pc.failures, pc.err
+}
+
+// Close releases the device of the clock.
+func (pc *PtpClock) Close() error {
+	if pc.closer == nil {
+		return nil
+	}
+	return pc.closer.Close()
+}
+
+// PtpRefClock returns the ts-refclk signaling of a PTP clock, RFC 7273 chapter 4.8.
+//
+//   grandmaster - the clock identity of the PTP grandmaster
+//   domain      - the PTP domain number
+//
+func PtpRefClock(grandmaster [8]byte, domain int) TsRefClock {
+	gm := fmt.Sprintf("%02X-%02X-%02X-%02X-%02X-%02X-%02X-%02X", grandmaster[0], grandmaster[1], grandmaster[2],
+		grandmaster[3], grandmaster[4], grandmaster[5], grandmaster[6], grandmaster[7])
+	return TsRefClock{Source: "ptp", Value: fmt.Sprintf("IEEE1588-2008:%s:%d", gm, domain)}
+}
+
+// *** Local functions and methods.
+
+// sample reads the PTP clock and records the reading or the failure.
+func (pc *PtpClock) sample() (time.Time, error) {
+	tm, err := pc.read()
+	mono := time.Now()
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	if err != nil {
+		pc.err = err
+		pc.failures++
+		return tm, err
+	}
+	pc.last, pc.lastMono, pc.err = tm, mono, nil
+	return tm, nil
+}
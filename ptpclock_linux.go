@@ -0,0 +1,45 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+package rtp
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// openPtpDevice opens a PTP hardware clock and returns the function that reads it. The
+// dynamic POSIX clock ID of the device is derived from its file descriptor, see FD_TO_CLOCKID
+// in the kernel's posix-timers.
+func openPtpDevice(path string) (func() (time.Time, error), io.Closer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	clockId := (^int32(f.Fd()) << 3) | 3
+	read := func() (time.Time, error) {
+		var ts syscall.Timespec
+		if _, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, uintptr(clockId), uintptr(unsafe.Pointer(&ts)), 0); errno != 0 {
+			return time.Time{}, errno
+		}
+		return time.Unix(int64(ts.Sec), int64(ts.Nsec)), nil
+	}
+	return read, f, nil
+}
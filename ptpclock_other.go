@@ -0,0 +1,31 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+//go:build !linux
+// +build !linux
+
+package rtp
+
+import (
+	"io"
+	"time"
+)
+
+// openPtpDevice is not supported on this platform.
+func openPtpDevice(path string) (func() (time.Time, error), io.Closer, error) {
+	return nil, nil, Error("PTP clock devices are not supported on this platform.")
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+package rtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPtpClock(t *testing.T) {
+	parseFlags()
+
+	if _, err := NewPtpClock(nil); err == nil {
+		t.Errorf("NewPtpClock accepted a nil function\n")
+	}
+	if _, err := NewPtpClock(func() (time.Time, error) { return time.Time{}, Error("no clock") }); err == nil {
+		t.Errorf("NewPtpClock accepted a failing clock\n")
+	}
+
+	tai := time.Unix(5000, 0)
+	var fail bool
+	pc, err := NewPtpClock(func() (time.Time, error) {
+		if fail {
+			return time.Time{}, Error("device gone")
+		}
+		return tai, nil
+	})
+	if err != nil {
+		t.Errorf("NewPtpClock failed: %s\n", err)
+		return
+	}
+	if !pc.Now().Equal(tai) {
+		t.Errorf("PTP clock reading check failed: %v\n", pc.Now())
+	}
+
+	// A failed reading continues from the last good reading
+	fail = true
+	now := pc.Now()
+	if now.Before(tai) || now.Sub(tai) > time.Second {
+		t.Errorf("PTP clock extrapolation check failed: %v\n", now)
+	}
+	if count, err := pc.Failures(); count != 1 || err == nil {
+		t.Errorf("PTP clock failure check failed: %d, %v\n", count, err)
+	}
+	fail = false
+	pc.Now()
+	if count, err := pc.Failures(); count != 1 || err != nil {
+		t.Errorf("PTP clock recovery check failed: %d, %v\n", count, err)
+	}
+
+	rs := NewSession(new(captureWriter), new(teeConsumer))
+	rs.SetReferenceClock(PtpRefClock([8]byte{0x39, 0xa7, 0x94, 0xff, 0xfe, 0x07, 0xcb, 0xd0}, 0), pc, 0)
+	if stamp, _ := rs.MediaClockStamp(48000); stamp != uint32(5000*48000) {
+		t.Errorf("PTP media clock check failed: %d\n", stamp)
+	}
+	if ref := rs.refClock.ref.String(); ref != "ptp=IEEE1588-2008:39-A7-94-FF-FE-07-CB-D0:0" {
+		t.Errorf("PTP reference clock signaling check failed: %s\n", ref)
+	}
+	if _, err = OpenPtpDevice("/nonexistent/ptp0"); err == nil {
+		t.Errorf("OpenPtpDevice opened a missing device\n")
+	}
+}
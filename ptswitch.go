@@ -0,0 +1,94 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the handling of payload type switches of input streams, for example
+ * after a codec renegotiation.
+ */
+
+// PayloadTypeChange describes a switch of the payload type of an input stream, see the
+// PayloadTypeChanged event.
+//
+// The input stream keeps its sequence number, loss and duplicate state. If the clock rates
+// differ the stream converts its jitter to the new clock rate and restarts the transit time
+// computation, thus the new timestamp units neither look like a restart of the sender nor
+// distort the jitter.
+type PayloadTypeChange struct {
+	Ssrc         uint32
+	Index        uint32
+	Old, New     byte
+	OldClockRate int // 0 if the clock rate of the payload type is unknown
+	NewClockRate int
+}
+
+// *** Local functions and methods.
+
+// switchPayloadType checks the payload type of a packet against the previous packets of the
+// input stream and adjusts the timestamp arithmetic on a switch. It returns nil if the payload
+// type did not change. The caller holds recvMutex.
+func (si *SsrcStream) switchPayloadType(rp *DataPacket) *PayloadTypeChange {
+	pt := rp.PayloadType()
+	old := si.payloadType
+	if old == pt {
+		return nil
+	}
+	si.payloadType = pt
+	if old == 0xff {
+		return nil // the first packet
+	}
+	change := &PayloadTypeChange{Ssrc: si.ssrc, Old: old, New: pt, NewClockRate: si.payloadClockRate(pt)}
+	change.OldClockRate = si.statistics.clockRate
+	if change.OldClockRate == 0 {
+		change.OldClockRate = si.payloadClockRate(old)
+	}
+	if change.OldClockRate != change.NewClockRate {
+		if change.OldClockRate > 0 && change.NewClockRate > 0 {
+			si.statistics.jitter = uint32(uint64(si.statistics.jitter) * uint64(change.NewClockRate) / uint64(change.OldClockRate))
+		} else {
+			si.statistics.jitter = 0
+		}
+		si.statistics.lastPacketTransitTime = 0 // the next packet starts the transit times in the new units
+	}
+	return change
+}
+
+// payloadClockRate returns the clock rate of a payload type, the inferred one if the stream
+// inferred it, see SetClockRateInference.
+func (si *SsrcStream) payloadClockRate(pt byte) int {
+	if pf := PayloadFormatMap[int(pt)]; pf != nil && pf.ClockRate > 0 {
+		return pf.ClockRate
+	}
+	if ci := &si.statistics.clock; ci.rate > 0 && ci.pt == pt {
+		return ci.rate
+	}
+	return 0
+}
+
+// sendPayloadTypeChanged sends a PayloadTypeChanged event to the application.
+func (rs *Session) sendPayloadTypeChanged(str *SsrcStream, strIdx uint32, change *PayloadTypeChange) {
+	change.Index = strIdx
+	ctrlEv := newCrtlEvent(PayloadTypeChanged, str.ssrc, strIdx)
+	ctrlEv.PtChange = change
+	ctrlEv.Context = str.Context()
+	select {
+	case rs.ctrlEventChan <- []*CtrlEvent{ctrlEv}:
+	default:
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPayloadTypeSwitch(t *testing.T) {
+	parseFlags()
+
+	PayloadFormatMap[124] = &PayloadFormat{TypeNumber: 124, MediaType: Audio, ClockRate: 48000, Channels: 2, Name: "opus"}
+	defer delete(PayloadFormatMap, 124)
+
+	rs, _ := drainedSession(t)
+	events := rs.CreateCtrlEventChan()
+
+	from := &Address{IpAddr: net.IPv4(127, 0, 0, 1), DataPort: 6002, CtrlPort: 6003}
+	for seq := uint16(1); seq <= 10; seq++ {
+		quirkData(rs, 0x0a0b0c0d, seq, from)
+	}
+	str, _, _ := rs.lookupSsrcMapIn(0x0a0b0c0d)
+	before := str.Statistics()
+	if str.PayloadType() != 0 || before.ClockRate != 8000 {
+		t.Errorf("Initial payload type check failed: %d\n", str.PayloadType())
+		return
+	}
+
+	// The renegotiated codec continues the sequence numbers, its timestamps have a new offset and units
+	for seq := uint16(11); seq <= 20; seq++ {
+		rp := rs.NewDataPacket(5000000 + uint32(seq)*960)
+		rp.SetSsrc(0x0a0b0c0d)
+		rp.SetSequence(seq)
+		rp.SetPayloadType(124)
+		rp.fromAddr = *from
+		if !rs.OnRecvData(rp) {
+			t.Errorf("Packet %d after the switch dropped\n", seq)
+		}
+		if seq == 11 {
+			// The first packet after the switch does not update the jitter, it only converts it to 48 kHz
+			if jitter := str.Statistics().Jitter; jitter+6 < before.Jitter*6 || jitter > before.Jitter*6+6 {
+				t.Errorf("Jitter conversion check failed. Before: %d, after: %d\n", before.Jitter, jitter)
+			}
+		}
+	}
+	after := str.Statistics()
+	if after.PacketCount != 20 || after.PacketsLost != 0 || after.HighestSeqNo != 20 || after.ClockRate != 48000 || str.PayloadType() != 124 {
+		t.Errorf("Stream continuity check failed: %+v\n", after)
+	}
+
+	var changes []*PayloadTypeChange
+	for len(events) > 0 {
+		for _, ev := range <-events {
+			switch ev.EventType {
+			case StreamReset:
+				t.Errorf("Payload type switch reset the stream\n")
+			case PayloadTypeChanged:
+				changes = append(changes, ev.PtChange)
+			}
+		}
+	}
+	if len(changes) != 1 {
+		t.Errorf("PayloadTypeChanged event count check failed: %d\n", len(changes))
+		return
+	}
+	if c := changes[0]; c.Ssrc != 0x0a0b0c0d || c.Old != 0 || c.New != 124 || c.OldClockRate != 8000 || c.NewClockRate != 48000 {
+		t.Errorf("PayloadTypeChanged event check failed: %+v\n", c)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the traffic classes of the output streams. The classes order the
+ * packets in the Scheduler, select the DiffServ code point of the packets and split the
+ * bandwidth budget.
+ */
+
+// The traffic classes of the output streams in their priority order, ClassAudio is the highest
+// priority, see SetStreamClass.
+const (
+	ClassAudio = iota
+	ClassVideo
+	ClassFec
+	ClassRtx // the retransmissions of a NackResponder
+	trafficClasses
+)
+
+// SetStreamClass sets the traffic class of an output stream, for example ClassFec for a stream
+// that carries FEC packets. Without a class an output stream of an audio payload type is in
+// ClassAudio, all others in ClassVideo.
+//
+// The class selects the priority of the stream's packets in a Scheduler, its TOS byte, see
+// SetClassDscp, and its share of the bandwidth budget, see SetBandwidthBudget.
+//
+//   streamIndex - the index of the output stream
+//   class       - ClassAudio, ClassVideo, ClassFec or ClassRtx
+//
+func (rs *Session) SetStreamClass(streamIndex uint32, class int) error {
+	if class < 0 || class >= trafficClasses {
+		return Error("SetStreamClass: unknown class.")
+	}
+	rs.qosMutex.Lock()
+	defer rs.qosMutex.Unlock()
+	if rs.streamClasses == nil {
+		rs.streamClasses = make(map[uint32]int)
+	}
+	rs.streamClasses[streamIndex] = class
+	return nil
+}
+
+// SetClassDscp sets the TOS byte of the packets of a traffic class, for example
+// iana.DiffServEFPHB for audio and iana.DiffServAF41 for video. A UDP transport sends the
+// packets with the TOS byte, packets with own socket options keep them, see
+// RawPacket.SetSocketOptions. Without a TOS byte the packets use the transport's options.
+//
+//   class - ClassAudio, ClassVideo, ClassFec or ClassRtx
+//   tos   - the TOS byte containing the DiffServ code point, see package iana, a negative
+//           value removes the TOS byte of the class
+//
+func (rs *Session) SetClassDscp(class, tos int) error {
+	if class < 0 || class >= trafficClasses {
+		return Error("SetClassDscp: unknown class.")
+	}
+	if tos > 0xff {
+		return Error("SetClassDscp: the TOS byte is out of range.")
+	}
+	var opts *SocketOptions
+	if tos >= 0 {
+		opts = &SocketOptions{Set: SockOptTos, Tos: tos}
+	}
+	rs.qosMutex.Lock()
+	rs.classOpts[class] = opts
+	rs.qosMutex.Unlock()
+	return nil
+}
+
+// *** Local functions and methods.
+
+// streamClass returns the traffic class of a packet of the output stream, strIdx is negative
+// for a packet without an output stream.
+func (rs *Session) streamClass(strIdx int64, rp *DataPacket) int {
+	if strIdx >= 0 {
+		rs.qosMutex.Lock()
+		class, ok := rs.streamClasses[uint32(strIdx)]
+		rs.qosMutex.Unlock()
+		if ok {
+			return class
+		}
+	}
+	if pf := PayloadFormatMap[int(rp.PayloadType())]; pf != nil && pf.MediaType == Audio {
+		return ClassAudio
+	}
+	return ClassVideo
+}
+
+// packetClass returns the traffic class of a packet that the session sends later.
+func (rs *Session) packetClass(rp *DataPacket) int {
+	if _, strIdx, ok := rs.lookupSsrcMapOut(rp.Ssrc()); ok {
+		return rs.streamClass(int64(strIdx), rp)
+	}
+	return rs.streamClass(-1, rp)
+}
+
+// markClass sets the socket options of the class on a packet without own socket options. It
+// returns true if it set them, the caller removes them after sending.
+func (rs *Session) markClass(class int, rp *DataPacket) bool {
+	if rp.sockOpts != nil {
+		return false
+	}
+	rs.qosMutex.Lock()
+	rp.sockOpts = rs.classOpts[class]
+	rs.qosMutex.Unlock()
+	return rp.sockOpts != nil
+}
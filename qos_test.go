@@ -0,0 +1,137 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/room732/gortp/iana"
+)
+
+// tosWriter records the TOS byte of the sent RTP packets, -1 for packets without one.
+type tosWriter struct {
+	captureWriter
+	tos []int
+}
+
+func (tw *tosWriter) WriteDataTo(rp *DataPacket, addr *Address) (n int, err error) {
+	tos := -1
+	if opts := rp.SocketOptions(); opts != nil && opts.Set&SockOptTos != 0 {
+		tos = opts.Tos
+	}
+	tw.tos = append(tw.tos, tos)
+	return tw.captureWriter.WriteDataTo(rp, addr)
+}
+
+// classPacket returns a RTP packet of the payload type, the packets of rawPacket keep the
+// payload type of a reused buffer.
+func classPacket(ssrc uint32, seq uint16, pt byte, payload []byte) []byte {
+	buf := rawPacket(ssrc, seq, payload)
+	buf[1] = buf[1]&0x80 | pt
+	return buf
+}
+
+func TestTrafficClasses(t *testing.T) {
+	parseFlags()
+
+	rs, _ := drainedSession(t)
+	tw := new(tosWriter)
+	rs.transportWrite = tw
+	audio, video := rs.SsrcStreamOutForIndex(0), rs.SsrcStreamOutForIndex(1)
+
+	if err := rs.SetStreamClass(1, trafficClasses); err == nil {
+		t.Errorf("SetStreamClass accepted an unknown class\n")
+	}
+	if err := rs.SetClassDscp(ClassAudio, 0x100); err == nil {
+		t.Errorf("SetClassDscp accepted an invalid TOS byte\n")
+	}
+	rs.SetStreamClass(1, ClassVideo)
+	rp := classPacket(video.Ssrc(), 0, 97, make([]byte, 10))
+	pkt, _ := NewDataPacketFromBuffer(rp)
+	if c := rs.packetClass(pkt); c != ClassVideo {
+		t.Errorf("stream class check failed. Expected: %d, got: %d\n", ClassVideo, c)
+	}
+	pkt.FreePacket()
+
+	rs.SetClassDscp(ClassAudio, iana.DiffServEFPHB)
+	rs.SetClassDscp(ClassVideo, iana.DiffServAF41)
+	rs.WriteRaw(classPacket(audio.Ssrc(), 0, 0, make([]byte, 10)))
+	rs.WriteRaw(rp)
+	rs.SetClassDscp(ClassVideo, -1)
+	rs.WriteRaw(classPacket(video.Ssrc(), 1, 0, make([]byte, 10)))
+
+	// a packet with own socket options keeps them
+	own, _ := NewDataPacketFromBuffer(classPacket(audio.Ssrc(), 1, 0, make([]byte, 10)))
+	own.SetSocketOptions(&SocketOptions{Set: SockOptTos, Tos: iana.DiffServCS1})
+	rs.WriteData(own)
+	if own.SocketOptions() == nil {
+		t.Errorf("packet socket options were removed\n")
+	}
+	own.FreePacket()
+
+	expected := []int{iana.DiffServEFPHB, iana.DiffServAF41, -1, iana.DiffServCS1}
+	if len(tw.tos) != len(expected) {
+		t.Errorf("TOS count check failed. Expected: %d, got: %d\n", len(expected), len(tw.tos))
+		return
+	}
+	for i := range expected {
+		if tw.tos[i] != expected[i] {
+			t.Errorf("TOS check failed. Expected: %v, got: %v\n", expected, tw.tos)
+			break
+		}
+	}
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	parseFlags()
+
+	sc := NewScheduler()
+	defer sc.Stop()
+
+	// a blocking item delays a video burst and an audio packet, the audio packet runs first
+	// when they are all due, the video packets keep their order
+	now := time.Now()
+	results := make(chan string, 5)
+	sc.Schedule(now.Add(5*time.Millisecond), func() { time.Sleep(30 * time.Millisecond) })
+	for i, name := range []string{"v0", "v1", "v2"} {
+		name := name
+		sc.ScheduleClass(now.Add(time.Duration(6+i)*time.Millisecond), ClassVideo, func() { results <- name })
+	}
+	sc.ScheduleClass(now.Add(10*time.Millisecond), ClassRtx, func() { results <- "rtx" })
+	sc.ScheduleClass(now.Add(12*time.Millisecond), ClassAudio, func() { results <- "a0" })
+
+	var order []string
+	for len(order) < 5 {
+		select {
+		case name := <-results:
+			order = append(order, name)
+		case <-time.After(time.Second):
+			t.Errorf("Scheduler timeout, got only %d items\n", len(order))
+			return
+		}
+	}
+	expected := []string{"a0", "v0", "v1", "v2", "rtx"}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Errorf("Scheduler priority check failed. Expected: %v, got: %v\n", expected, order)
+			break
+		}
+	}
+}
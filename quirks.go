@@ -0,0 +1,107 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the interoperability quirks: tolerated deviations of other RTP
+ * implementations.
+ */
+
+import (
+	"sync/atomic"
+)
+
+// Interoperability quirks, see SetQuirks.
+const (
+	QuirkNonCompoundRtcp = 1 << iota // accept RTCP packets that don't start with a SR or RR, e.g. FFmpeg's lone BYE or SDES
+	QuirkRtcpBeforeRtp               // a source latched from its RTCP corrects the guessed data port with its first RTP packet, GStreamer
+	QuirkZeroSsrc                    // SSRC 0 in the first RTP packets: the first non-zero SSRC from the same address takes over the stream
+	QuirksAll            = QuirkNonCompoundRtcp | QuirkRtcpBeforeRtp | QuirkZeroSsrc
+)
+
+// QuirkCounts holds how often the session applied each quirk.
+type QuirkCounts struct {
+	NonCompoundRtcp uint32 // accepted RTCP packets that don't start with a SR or RR
+	RtcpBeforeRtp   uint32 // latched remotes whose data port the first RTP packet corrected
+	ZeroSsrc        uint32 // SSRC 0 streams taken over by the real SSRC
+}
+
+// SetQuirks enables the interoperability quirks, a combination of the Quirk constants. 0, the
+// default, disables all quirks and the session follows RFC 3550 strictly. Set the quirks before
+// the session starts.
+//
+//   quirks - the quirks to tolerate, e.g. QuirksAll
+//
+func (rs *Session) SetQuirks(quirks int) {
+	rs.quirks = quirks
+}
+
+// QuirkCounts returns how often the session applied each quirk.
+func (rs *Session) QuirkCounts() QuirkCounts {
+	return QuirkCounts{
+		NonCompoundRtcp: atomic.LoadUint32(&rs.quirkCounts.NonCompoundRtcp),
+		RtcpBeforeRtp:   atomic.LoadUint32(&rs.quirkCounts.RtcpBeforeRtp),
+		ZeroSsrc:        atomic.LoadUint32(&rs.quirkCounts.ZeroSsrc),
+	}
+}
+
+// *** Local functions and methods.
+
+// acceptNonCompound returns true if the quirk accepts a RTCP compound that starts with the packet
+// type.
+func (rs *Session) acceptNonCompound(pktType int) bool {
+	if rs.quirks&QuirkNonCompoundRtcp == 0 {
+		return false
+	}
+	switch pktType {
+	case RtcpSdes, RtcpBye, RtcpApp, RtcpXr:
+		atomic.AddUint32(&rs.quirkCounts.NonCompoundRtcp, 1)
+		return true
+	}
+	return false
+}
+
+// adoptZeroSsrc hands an input stream with SSRC 0 from the address of the packet over to the
+// packet's SSRC. The caller holds streamsMapMutex.
+func (rs *Session) adoptZeroSsrc(ssrc uint32, from *Address) (*SsrcStream, uint32, bool) {
+	str, idx, exists := rs.lookupSsrcMapIn(0)
+	if !exists || str.DataPort != from.DataPort || !str.IpAddr.Equal(from.IpAddr) {
+		return nil, 0, false
+	}
+	str.ssrc = ssrc
+	atomic.AddUint32(&rs.quirkCounts.ZeroSsrc, 1)
+	return str, idx, true
+}
+
+// relatchData corrects the data port of a remote the session latched from a RTCP packet of the
+// source, see verifySource. The remote gets a new Address, the writers may still use the old one.
+func (rs *Session) relatchData(ssrc uint32, from *Address) {
+	rs.remotesMutex.Lock()
+	defer rs.remotesMutex.Unlock()
+	if !rs.rtcpLatched || rs.rtcpLatchSsrc != ssrc {
+		return
+	}
+	rs.rtcpLatched = false
+	remote, ok := rs.remotes[rs.rtcpLatchIndex]
+	if !ok || !remote.IpAddr.Equal(from.IpAddr) || remote.DataPort == from.DataPort {
+		return
+	}
+	rs.remotes[rs.rtcpLatchIndex] = &Address{IpAddr: remote.IpAddr, DataPort: from.DataPort, CtrlPort: remote.CtrlPort}
+	atomic.AddUint32(&rs.quirkCounts.RtcpBeforeRtp, 1)
+}
@@ -0,0 +1,98 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+)
+
+// quirkCtrl builds a single RTCP packet of the type with an empty body.
+func quirkCtrl(pktType int, ssrc uint32, from *Address) *CtrlPacket {
+	rp, _ := newCtrlPacket()
+	rp.SetType(0, pktType)
+	rp.SetSsrc(0, ssrc)
+	if pktType == RtcpBye {
+		rp.SetCount(0, 1)
+	}
+	rp.inUse = rtcpHeaderLength + rtcpSsrcLength
+	rp.SetLength(0, 1)
+	rp.fromAddr = *from
+	return rp
+}
+
+func quirkData(rs *Session, ssrc uint32, seq uint16, from *Address) bool {
+	rp := rs.NewDataPacket(uint32(seq) * 160)
+	rp.SetSsrc(ssrc)
+	rp.SetSequence(seq)
+	rp.fromAddr = *from
+	return rs.OnRecvData(rp)
+}
+
+func TestQuirks(t *testing.T) {
+	parseFlags()
+
+	rs, _ := drainedSession(t)
+	ip := net.IPv4(10, 0, 0, 9)
+	ctrlFrom := &Address{IpAddr: ip, CtrlPort: 7101}
+
+	// Strict mode rejects a lone BYE and keeps the SSRC 0 stream
+	if rs.OnRecvCtrl(quirkCtrl(RtcpBye, 0x01020309, ctrlFrom)) {
+		t.Errorf("Strict non-compound check failed\n")
+	}
+	zeroFrom := &Address{IpAddr: ip, DataPort: 7010}
+	quirkData(rs, 0, 1, zeroFrom)
+	quirkData(rs, 0x0f0f0f0f, 2, zeroFrom)
+	if n := len(rs.InputStreams()); n != 2 {
+		t.Errorf("Strict zero SSRC check failed. Streams: %d\n", n)
+	}
+
+	rs, _ = drainedSession(t)
+	rs.SetQuirks(QuirksAll)
+	rs.SetSourceVerifier(func(ssrc uint32, from *Address, data bool) int { return SourceLatch })
+	if !rs.OnRecvCtrl(quirkCtrl(RtcpSdes, 0x01020309, ctrlFrom)) {
+		t.Errorf("Non-compound quirk check failed\n")
+	}
+	rs.OnRecvCtrl(quirkCtrl(RtcpRR, 0x01020309, ctrlFrom)) // RTCP before RTP latches the source
+	if remotes := rs.remoteList(); len(remotes) != 1 || remotes[0].DataPort != 7100 {
+		t.Errorf("RTCP latch check failed\n")
+		return
+	}
+	quirkData(rs, 0x01020309, 1, &Address{IpAddr: ip, DataPort: 7000})
+	if remotes := rs.remoteList(); remotes[0].DataPort != 7000 || remotes[0].CtrlPort != 7101 {
+		t.Errorf("RTCP before RTP quirk check failed: %v\n", remotes[0])
+	}
+
+	for seq := uint16(1); seq <= 3; seq++ {
+		quirkData(rs, 0, seq, zeroFrom)
+	}
+	quirkData(rs, 0x0f0f0f0f, 4, zeroFrom)
+	streams := rs.InputStreams()
+	if len(streams) != 2 {
+		t.Errorf("Zero SSRC quirk check failed. Streams: %d\n", len(streams))
+	}
+	for _, info := range streams {
+		if info.Ssrc == 0 || (info.Ssrc == 0x0f0f0f0f && info.Statistics.PacketCount != 4) {
+			t.Errorf("Zero SSRC stream check failed: %x, %d packets\n", info.Ssrc, info.Statistics.PacketCount)
+		}
+	}
+	if qc := rs.QuirkCounts(); qc != (QuirkCounts{NonCompoundRtcp: 1, RtcpBeforeRtp: 1, ZeroSsrc: 1}) {
+		t.Errorf("Quirk counts check failed: %+v\n", qc)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+// WriteRaw sends a RTP packet that another stack built, e.g. in a bridge, to all remote
+// destinations of the session. The session sends the bytes verbatim: it neither encrypts the
+// payload nor modifies the header.
+//
+// If the packet's SSRC belongs to an active output stream the session updates the sender
+// counters, thus its SR reports cover the raw packets, and keeps the packet for retransmissions.
+// A paused output stream drops the packet like WriteData. Packets of other SSRCs are sent
+// without any counting, see also SetRawCounting.
+//
+//   buf - the complete RTP packet, the caller keeps the buffer
+//
+func (rs *Session) WriteRaw(buf []byte) (n int, err error) {
+	rs.profiler.packet()
+	defer rs.profiler.measure(ProfileSend, rs.profiler.begin())
+
+	if err := rs.sendData(); err != nil {
+		return 0, err
+	}
+	rp, err := NewDataPacketFromBuffer(buf)
+	if err != nil {
+		return 0, err
+	}
+	defer rp.FreePacket()
+	if _, err := rp.Header(); err != nil {
+		return 0, err
+	}
+	strOut, strIdx, own := rs.lookupSsrcMapOut(rp.Ssrc())
+	if own && strOut.streamStatus != active && !rs.rawUncounted {
+		return 0, nil
+	}
+	class := rs.streamClass(-1, rp)
+	if own {
+		class = rs.streamClass(int64(strIdx), rp)
+	}
+	if !(own && strOut.sendPaused()) && !rs.budgetAdmit(class, rp) {
+		return 0, errBudget
+	}
+	if own && !rs.rawUncounted && !rs.countSent(strOut, rp) {
+		return 0, nil
+	}
+	rs.markClass(class, rp)
+	return rs.writeDataToRemotes(rp)
+}
+
+// SetRawCounting selects if WriteRaw updates the counters of the output streams. Bridges that
+// relay packets of an output stream's SSRC without the session's own RTP data switch it off,
+// the session then sends all raw packets without any state changes.
+//
+//   on - true updates the counters, the default; false sends the packets only
+//
+func (rs *Session) SetRawCounting(on bool) {
+	rs.rawUncounted = !on
+}
@@ -0,0 +1,67 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func rawPacket(ssrc uint32, seq uint16, payload []byte) []byte {
+	rp := newDataPacket()
+	defer rp.FreePacket()
+	rp.SetSsrc(ssrc)
+	rp.SetSequence(seq)
+	rp.SetPayload(payload)
+	return append([]byte(nil), rp.Buffer()[:rp.InUse()]...)
+}
+
+func TestWriteRaw(t *testing.T) {
+	parseFlags()
+
+	rs, ct := drainedSession(t)
+	str := rs.SsrcStreamOutForIndex(0)
+
+	own := rawPacket(str.Ssrc(), 100, []byte{1, 2, 3, 4})
+	if _, err := rs.WriteRaw(own); err != nil {
+		t.Errorf("WriteRaw failed: %v\n", err)
+		return
+	}
+	if len(ct.captureWriter.data) != 1 || !bytes.Equal(ct.captureWriter.data[0], own) {
+		t.Errorf("Raw packet must be sent verbatim\n")
+	}
+	if str.SenderPacketCnt != 1 || str.SenderOctectCnt != 4 || !str.sender {
+		t.Errorf("Counter check failed: %d packets, %d octets\n", str.SenderPacketCnt, str.SenderOctectCnt)
+	}
+
+	rs.WriteRaw(rawPacket(0x0a0b0c0d, 7, []byte{1, 2}))
+	rs.SetRawCounting(false)
+	rs.WriteRaw(rawPacket(str.Ssrc(), 101, []byte{5, 6}))
+	if len(ct.captureWriter.data) != 3 || str.SenderPacketCnt != 1 || str.SenderOctectCnt != 4 {
+		t.Errorf("Uncounted check failed: %d sent, %d packets\n", len(ct.captureWriter.data), str.SenderPacketCnt)
+	}
+
+	if _, err := rs.WriteRaw(own[:10]); err == nil {
+		t.Errorf("WriteRaw must reject a truncated packet\n")
+	}
+	rs.role = RoleRecvOnly
+	if _, err := rs.WriteRaw(own); err == nil || len(ct.captureWriter.data) != 3 {
+		t.Errorf("WriteRaw must respect the session role\n")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the thread placement of the transports' read loops.
+ */
+
+import (
+	"runtime"
+	"sync"
+)
+
+// ReadThread holds the scheduling options of a transport's read loops. Each read loop locks
+// its goroutine to an OS thread and applies the options to that thread, latency critical
+// deployments use them to keep the media path on the CPUs of one NUMA node. Linux only.
+type ReadThread struct {
+	Cpus     []int // the CPUs the read threads may run on, empty keeps the process' affinity
+	Nice     int   // the nice value of the read threads, -20 to 19, 0 keeps the default
+	Realtime int   // the SCHED_FIFO priority, 1 to 99, 0 keeps the normal scheduler and Nice applies
+}
+
+// maxReadThreadCpu is the number of CPUs a ReadThread may address, the size of cpu_set_t.
+const maxReadThreadCpu = 1024
+
+// readThreadState holds a transport's ReadThread and the first error of applying it.
+type readThreadState struct {
+	mutex sync.Mutex
+	opts  *ReadThread
+	err   error
+}
+
+// SetReadThread sets the scheduling options of the transport's read loops, nil removes them.
+// Call SetReadThread before ListenOnTransports, read loops that already run keep their
+// thread. Raising the priority or a realtime scheduler requires CAP_SYS_NICE.
+//
+// A read loop that fails to apply the options keeps reading on its thread, ReadThreadError
+// returns the error.
+//
+//   opts - the scheduling options, SetReadThread copies them
+//
+func (tc *TransportCommon) SetReadThread(opts *ReadThread) error {
+	if opts == nil {
+		tc.readThread.mutex.Lock()
+		tc.readThread.opts = nil
+		tc.readThread.mutex.Unlock()
+		return nil
+	}
+	for _, cpu := range opts.Cpus {
+		if cpu < 0 || cpu >= maxReadThreadCpu {
+			return Error("SetReadThread: CPU out of range.")
+		}
+	}
+	if opts.Nice < -20 || opts.Nice > 19 {
+		return Error("SetReadThread: nice value out of range.")
+	}
+	if opts.Realtime < 0 || opts.Realtime > 99 {
+		return Error("SetReadThread: realtime priority out of range.")
+	}
+	cp := *opts
+	cp.Cpus = append([]int(nil), opts.Cpus...)
+	tc.readThread.mutex.Lock()
+	tc.readThread.opts = &cp
+	tc.readThread.err = nil
+	tc.readThread.mutex.Unlock()
+	return nil
+}
+
+// ReadThreadError returns the first error of a read loop that applied the options of
+// SetReadThread, nil if all read loops run as configured.
+func (tc *TransportCommon) ReadThreadError() error {
+	tc.readThread.mutex.Lock()
+	defer tc.readThread.mutex.Unlock()
+	return tc.readThread.err
+}
+
+// pinReadThread locks the calling read loop to its OS thread and applies the options of
+// SetReadThread. The thread ends with the read loop, the runtime does not reuse it.
+func (tc *TransportCommon) pinReadThread() {
+	tc.readThread.mutex.Lock()
+	opts := tc.readThread.opts
+	tc.readThread.mutex.Unlock()
+	if opts == nil {
+		return
+	}
+	runtime.LockOSThread()
+	if err := applyReadThread(opts); err != nil {
+		tc.readThread.mutex.Lock()
+		if tc.readThread.err == nil {
+			tc.readThread.err = err
+		}
+		tc.readThread.mutex.Unlock()
+	}
+}
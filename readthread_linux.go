@@ -0,0 +1,56 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// schedFifo is the SCHED_FIFO policy of sched_setscheduler(2).
+const schedFifo = 1
+
+// applyReadThread applies the options to the calling thread, the thread must be locked.
+func applyReadThread(opts *ReadThread) error {
+	if len(opts.Cpus) > 0 {
+		var mask [maxReadThreadCpu / 64]uint64
+		for _, cpu := range opts.Cpus {
+			mask[cpu/64] |= 1 << uint(cpu%64)
+		}
+		_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(mask),
+			uintptr(unsafe.Pointer(&mask[0])))
+		if errno != 0 {
+			return errno
+		}
+	}
+	if opts.Realtime > 0 {
+		param := struct{ priority int32 }{int32(opts.Realtime)}
+		_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETSCHEDULER, 0, schedFifo,
+			uintptr(unsafe.Pointer(&param)))
+		if errno != 0 {
+			return errno
+		}
+	} else if opts.Nice != 0 {
+		// on Linux the nice value is a thread attribute, the thread ID selects the thread
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, syscall.Gettid(), opts.Nice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestReadThreadOptions(t *testing.T) {
+	parseFlags()
+
+	tp, _ := NewTransportUDP(&net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}, 54080)
+	bad := []ReadThread{
+		{Cpus: []int{-1}},
+		{Cpus: []int{maxReadThreadCpu}},
+		{Nice: 20},
+		{Nice: -21},
+		{Realtime: 100},
+		{Realtime: -1},
+	}
+	for i := range bad {
+		if err := tp.SetReadThread(&bad[i]); err == nil {
+			t.Errorf("SetReadThread accepted %+v\n", bad[i])
+		}
+	}
+	if tp.readThread.opts != nil {
+		t.Errorf("rejected options were set: %+v\n", tp.readThread.opts)
+	}
+	opts := &ReadThread{Cpus: []int{0, 1}, Nice: 5}
+	if err := tp.SetReadThread(opts); err != nil {
+		t.Errorf("SetReadThread failed: %s\n", err)
+		return
+	}
+	opts.Cpus[0] = 7
+	if tp.readThread.opts.Cpus[0] != 0 || tp.readThread.opts.Nice != 5 {
+		t.Errorf("SetReadThread did not copy the options: %+v\n", tp.readThread.opts)
+	}
+	tp.SetReadThread(nil)
+	if tp.readThread.opts != nil || tp.ReadThreadError() != nil {
+		t.Errorf("SetReadThread(nil) check failed: %+v\n", tp.readThread.opts)
+	}
+}
@@ -459,7 +459,344 @@ func rtpReceive(t *testing.T) {
 	}
 }
 
+func rtpInject(t *testing.T) {
+	initSessions()
+
+	strIdx, _ := rsSender.NewSsrcStreamOut(&Address{senderAddr.IP, senderPort, senderPort + 1}, 0x04030201, 100)
+	rsSender.SsrcStreamOutForIndex(strIdx).SetPayloadType(0)
+
+	// A packet from a custom source, not received via a transport
+	rpSender := rsSender.NewDataPacket(160)
+	rp, _ := NewDataPacketFromBuffer(rpSender.Buffer()[0:rpSender.InUse()])
+	rpSender.FreePacket()
+	rp.SetFromAddr(&Address{senderAddr.IP, senderPort, senderPort + 1})
+	if !rsRecv.InjectData(rp) {
+		t.Errorf("InjectData failed\n")
+		return
+	}
+	receivePacket(t, 0)
+	if strIn := rsRecv.SsrcStreamIn(); strIn == nil || strIn.Ssrc() != 0x04030201 {
+		t.Errorf("Injected packet did not create the input stream\n")
+	}
+
+	short := newDataPacket()
+	short.inUse = 4
+	if rsRecv.InjectData(short) {
+		t.Errorf("InjectData short packet check failed\n")
+	}
+	// RTCP compound with a length field that exceeds the compound
+	rc, offset := newCtrlPacket()
+	rc.SetType(0, RtcpRR)
+	rc.addHeaderSsrc(offset, 0x04030201)
+	rc.SetLength(0, 5)
+	if rsRecv.InjectCtrl(rc) {
+		t.Errorf("InjectCtrl malformed compound check failed\n")
+	}
+}
+
+func rtpPayloadFilter(t *testing.T) {
+	initSessions()
+
+	strIdx, _ := rsSender.NewSsrcStreamOut(&Address{senderAddr.IP, senderPort, senderPort + 1}, 0x04030201, 100)
+	rsSender.SsrcStreamOutForIndex(strIdx).SetPayloadType(8)
+	rsRecv.SetPayloadTypeFilter([]byte{0})
+
+	// Rejected payload type must not create an input stream
+	if rsRecv.OnRecvData(newSenderPacket(160)) {
+		t.Errorf("Session payload type filter check failed\n")
+	}
+	if rsRecv.SsrcStreamIn() != nil || rsRecv.PayloadTypeDrops() != 1 {
+		t.Errorf("Session payload type drop check failed. Drops: %d\n", rsRecv.PayloadTypeDrops())
+	}
+	rsSender.SsrcStreamOutForIndex(strIdx).SetPayloadType(0)
+	rsRecv.OnRecvData(newSenderPacket(320))
+	receivePacket(t, 0)
+
+	// The stream's filter overrides the session's filter
+	strIn := rsRecv.SsrcStreamIn()
+	strIn.SetPayloadTypeFilter([]byte{8})
+	rsRecv.OnRecvData(newSenderPacket(480))
+	if stats := strIn.Statistics(); stats.PayloadTypeDrops != 1 || stats.PacketCount != 1 {
+		t.Errorf("Stream payload type drop check failed. Drops: %d, packets: %d\n", stats.PayloadTypeDrops, stats.PacketCount)
+	}
+	rsSender.SsrcStreamOutForIndex(strIdx).SetPayloadType(8)
+	rsRecv.OnRecvData(newSenderPacket(640))
+	receivePacket(t, 1)
+}
+
+func rtpDuplicates(t *testing.T) {
+	initSessions()
+
+	strIdx, _ := rsSender.NewSsrcStreamOut(&Address{senderAddr.IP, senderPort, senderPort + 1}, 0x04030201, 100)
+	rsSender.SsrcStreamOutForIndex(strIdx).SetPayloadType(0)
+	for i, seq := range []uint16{10, 11, 10, 13, 12, 11} {
+		rp := newSenderPacket(uint32(i * 160))
+		rp.SetSequence(seq)
+		rsRecv.OnRecvData(rp)
+	}
+	// a rejected packet must not mark its sequence number, the valid packet 14 follows
+	rp := newSenderPacket(0x80000000)
+	rp.SetSequence(14)
+	rsRecv.OnRecvData(rp)
+	rp = newSenderPacket(6 * 160)
+	rp.SetSequence(14)
+	rsRecv.OnRecvData(rp)
+
+	// the packets 10, 11, 13, 12, 14 reach the application
+	for i := 0; i < 5; i++ {
+		receivePacket(t, i)
+	}
+	if len(dataReceiver) != 0 {
+		t.Errorf("Duplicate delivery check failed. Unexpected packets: %d\n", len(dataReceiver))
+	}
+	stats := rsRecv.SsrcStreamIn().Statistics()
+	if stats.Duplicates != 2 || stats.PacketCount != 5 || stats.PacketsLost != 0 {
+		t.Errorf("Duplicate statistics check failed. Duplicates: %d, packets: %d, lost: %d\n",
+			stats.Duplicates, stats.PacketCount, stats.PacketsLost)
+	}
+}
+
+func rtpRetransmission(t *testing.T) {
+	initSessions()
+	events := rsRecv.CreateCtrlEventChan()
+	rsRecv.SetRtxPayloadType(96, 0)
+	rsRecv.SetRtxGroup(0x04030201, 0x0a0b0c0d)
+
+	strIdx, _ := rsSender.NewSsrcStreamOut(&Address{senderAddr.IP, senderPort, senderPort + 1}, 0x04030201, 100)
+	rsSender.SsrcStreamOutForIndex(strIdx).SetPayloadType(0)
+	pay := []byte{1, 2, 3, 4}
+	rtx := func(osn uint16, ssrc uint32) *DataPacket {
+		rp := newSenderPacket(uint32(osn) * 160)
+		rp.SetSsrc(ssrc)
+		rp.SetPayloadType(96)
+		rp.SetSequence(500 + osn)
+		rp.SetPayload(append([]byte{byte(osn >> 8), byte(osn)}, pay...))
+		return rp
+	}
+	for _, seq := range []uint16{10, 11, 13} {
+		rp := newSenderPacket(uint32(seq) * 160)
+		rp.SetSequence(seq)
+		rsRecv.OnRecvData(rp)
+		receivePacket(t, int(seq))
+	}
+	// the RTX stream repairs packet 12, the retransmission of 11 is a duplicate
+	rsRecv.OnRecvData(rtx(12, 0x0a0b0c0d))
+	rsRecv.OnRecvData(rtx(11, 0x0a0b0c0d))
+	rsRecv.OnRecvData(rtx(14, 0x0e0e0e0e)) // RTX SSRC without primary stream
+	select {
+	case rp := <-dataReceiver:
+		if !rp.Retransmitted() || rp.Sequence() != 12 || rp.Ssrc() != 0x04030201 || rp.PayloadType() != 0 ||
+			string(rp.Payload()) != string(pay) {
+			t.Errorf("RTX recovery check failed. Sequence: %d, SSRC: %x, payload: %v\n", rp.Sequence(), rp.Ssrc(), rp.Payload())
+		}
+		rp.FreePacket()
+	default:
+		t.Errorf("RTX recovery check failed. No packet\n")
+	}
+	if len(dataReceiver) != 0 || len(rsRecv.streamsIn) != 1 {
+		t.Errorf("RTX delivery check failed. Packets: %d, input streams: %d\n", len(dataReceiver), len(rsRecv.streamsIn))
+	}
+	stats := rsRecv.SsrcStreamIn().Statistics()
+	if stats.PacketCount != 4 || stats.Retransmissions != 1 || stats.Duplicates != 1 || stats.PacketsLost != 0 {
+		t.Errorf("RTX statistics check failed. Got: %+v\n", stats)
+	}
+	dropped := false
+	for len(events) > 0 {
+		for _, ev := range <-events {
+			dropped = dropped || (ev.EventType == RtxDroppedData && ev.Ssrc == 0x0e0e0e0e)
+		}
+	}
+	if !dropped {
+		t.Errorf("RtxDroppedData event check failed\n")
+	}
+}
+
+func rtpRestart(t *testing.T) {
+	initSessions()
+	events := rsRecv.CreateCtrlEventChan()
+
+	strIdx, _ := rsSender.NewSsrcStreamOut(&Address{senderAddr.IP, senderPort, senderPort + 1}, 0x04030201, 100)
+	rsSender.SsrcStreamOutForIndex(strIdx).SetPayloadType(0)
+	for i := 0; i < 10; i++ {
+		rsRecv.OnRecvData(newSenderPacket(uint32(i * 160)))
+		receivePacket(t, i)
+	}
+	<-events // new stream event
+	// The sender restarts with a new timestamp offset, the sequence numbers just continue. The
+	// first packet is dropped, the second confirms the restart.
+	for i := 0; i < 2; i++ {
+		rsRecv.OnRecvData(newSenderPacket(0x80000000 + uint32(i*160)))
+	}
+	receivePacket(t, 10)
+	<-events // the dropped packet
+	select {
+	case ev := <-events:
+		if ev[0].EventType != StreamReset {
+			t.Errorf("StreamReset event check failed. Got event type: %d\n", ev[0].EventType)
+		}
+	default:
+		t.Errorf("StreamReset event check failed. No event\n")
+	}
+	stats := rsRecv.SsrcStreamIn().Statistics()
+	if stats.PacketCount != 1 || stats.PacketsLost != 0 || stats.Jitter != 0 {
+		t.Errorf("Restart statistics check failed. Packets: %d, lost: %d, jitter: %d\n",
+			stats.PacketCount, stats.PacketsLost, stats.Jitter)
+	}
+	// The same after a restart with new sequence numbers
+	for i := 0; i < 2; i++ {
+		rp := newSenderPacket(0x80000000 + uint32((i+2)*160))
+		rp.SetSequence(uint16(20000 + i))
+		rsRecv.OnRecvData(rp)
+	}
+	receivePacket(t, 11)
+	<-events
+	if ev := <-events; ev[0].EventType != StreamReset {
+		t.Errorf("Second StreamReset event check failed. Got event type: %d\n", ev[0].EventType)
+	}
+	if stats = rsRecv.SsrcStreamIn().Statistics(); stats.PacketCount != 1 || stats.HighestSeqNo != 20001 {
+		t.Errorf("Second restart statistics check failed. Packets: %d, highest: %d\n", stats.PacketCount, stats.HighestSeqNo)
+	}
+	// an offset change of some hours is a restart, some seconds are not
+	str := rsRecv.SsrcStreamIn()
+	now := time.Now().UnixNano()
+	for _, c := range []struct {
+		shift uint32
+		jump  bool
+	}{{0x04000000, true}, {0xfc000000, true}, {8000 * 5, false}} {
+		rp := newSenderPacket(0x80000000 + 3*160 + c.shift)
+		if str.stampJump(rp, now) != c.jump {
+			t.Errorf("Timestamp jump check failed for shift %x. Expected: %v\n", c.shift, c.jump)
+		}
+		rp.FreePacket()
+	}
+}
+
+func rtpOrdering(t *testing.T) {
+	initSessions()
+	dataReceiver = make(DataReceiveChan, 60) // the forwarding must not drop packets
+	rsRecv.dataReceiveChan = dataReceiver
+
+	strIdx, _ := rsSender.NewSsrcStreamOut(&Address{senderAddr.IP, senderPort, senderPort + 1}, 0x04030201, 100)
+	rsSender.SsrcStreamOutForIndex(strIdx).SetPayloadType(0)
+	var packets [2][]*DataPacket
+	for i := 0; i < 60; i++ {
+		packets[i%2] = append(packets[i%2], newSenderPacket(uint32(i*160)))
+	}
+	// Two lower layers deliver packets of the same SSRC concurrently, each in sequence
+	for _, pkts := range packets {
+		go func(pkts []*DataPacket) {
+			for _, rp := range pkts {
+				rsRecv.OnRecvData(rp)
+			}
+		}(pkts)
+	}
+	var last [2]uint16
+	for i := 0; i < 60; i++ {
+		select {
+		case rp := <-dataReceiver:
+			n := rp.Sequence() % 2
+			if last[n] != 0 && rp.Sequence() != last[n]+2 {
+				t.Errorf("Ordering check failed. Expected: %d, got: %d\n", last[n]+2, rp.Sequence())
+			}
+			last[n] = rp.Sequence()
+			rp.FreePacket()
+		case <-time.After(time.Second):
+			t.Errorf("Ordering check timeout after %d packets\n", i)
+			return
+		}
+	}
+	if stats := rsRecv.SsrcStreamIn().Statistics(); stats.PacketCount != 60 {
+		t.Errorf("Ordering statistics check failed. Expected: 60, got: %d\n", stats.PacketCount)
+	}
+}
+
+func rtpStreamInfo(t *testing.T) {
+	initSessions()
+
+	for i, ssrc := range []uint32{0x04030201, 0x04030202} {
+		strIdx, _ := rsSender.NewSsrcStreamOut(&Address{senderAddr.IP, senderPort, senderPort + 1}, ssrc, 100)
+		rsSender.SsrcStreamOutForIndex(strIdx).SetPayloadType(0)
+		rp := rsSender.NewDataPacketForStream(strIdx, 160)
+		rp.fromAddr = Address{senderAddr.IP, senderPort + 2*i, 0}
+		rsRecv.OnRecvData(rp)
+		receivePacket(t, i)
+		<-rsRecv.rtcpCtrlChan // the RTCP service is not running, consume the increment sender request
+	}
+	infos := rsRecv.InputStreams()
+	if len(infos) != 2 {
+		t.Errorf("InputStreams check failed. Expected: 2 streams, got: %d\n", len(infos))
+		return
+	}
+	for _, info := range infos {
+		if info.Statistics.PacketCount != 1 || info.LastActivity == 0 || info.StreamType != InputStream {
+			t.Errorf("StreamInfo check failed. Got: %+v\n", info)
+		}
+	}
+	if out := rsRecv.OutputStreams(); len(out) != 1 || out[0].SdesItems[SdesCname] != "AAAAAA" {
+		t.Errorf("OutputStreams check failed. Got: %+v\n", out)
+	}
+	if !rsRecv.RemoveInputStream(0x04030201) || rsRecv.RemoveInputStream(0x04030201) {
+		t.Errorf("RemoveInputStream check failed\n")
+	}
+	// the RTCP service is not running, do its part of the removal
+	if cmd := <-rsRecv.rtcpCtrlChan; cmd != rtcpRemoveStreams {
+		t.Errorf("RemoveInputStream command check failed. Got: %x\n", cmd)
+	}
+	rsRecv.removeQueuedStreams()
+	if infos = rsRecv.InputStreams(); len(infos) != 1 || infos[0].Ssrc != 0x04030202 {
+		t.Errorf("InputStreams check after remove failed. Got: %+v\n", infos)
+	}
+}
+
+func rtpSourceVerifier(t *testing.T) {
+	initSessions()
+
+	var calls int
+	rsRecv.SetSourceVerifier(func(ssrc uint32, from *Address, data bool) int {
+		calls++
+		if ssrc == 0x04030201 {
+			return SourceReject
+		}
+		return SourceLatch
+	})
+	for _, ssrc := range []uint32{0x04030201, 0x04030202} {
+		strIdx, _ := rsSender.NewSsrcStreamOut(&Address{senderAddr.IP, senderPort, senderPort + 1}, ssrc, 100)
+		rsSender.SsrcStreamOutForIndex(strIdx).SetPayloadType(0)
+		for i := 0; i < 2; i++ {
+			rp := rsSender.NewDataPacketForStream(strIdx, uint32(i*160))
+			rp.fromAddr = Address{senderAddr.IP, 6000, 0}
+			rsRecv.OnRecvData(rp)
+		}
+	}
+	// two calls for the rejected source, one for the latched source
+	if calls != 3 {
+		t.Errorf("Source verifier calls check failed. Expected: 3, got: %d\n", calls)
+	}
+	infos := rsRecv.InputStreams()
+	if len(infos) != 1 || infos[0].Ssrc != 0x04030202 || infos[0].Statistics.PacketCount != 2 {
+		t.Errorf("Source verifier stream check failed. Got: %+v\n", infos)
+	}
+	receivePacket(t, 0)
+	receivePacket(t, 1)
+	if len(rsRecv.remotes) != 1 {
+		t.Errorf("Latch check failed. Expected: 1 remote, got: %d\n", len(rsRecv.remotes))
+	}
+	for _, remote := range rsRecv.remotes {
+		if remote.DataPort != 6000 || remote.CtrlPort != 6001 || !remote.IpAddr.Equal(senderAddr.IP) {
+			t.Errorf("Latch address check failed. Got: %+v\n", remote)
+		}
+	}
+}
+
 func TestReceive(t *testing.T) {
 	parseFlags()
 	rtpReceive(t)
+	rtpInject(t)
+	rtpPayloadFilter(t)
+	rtpDuplicates(t)
+	rtpRetransmission(t)
+	rtpRestart(t)
+	rtpOrdering(t)
+	rtpStreamInfo(t)
+	rtpSourceVerifier(t)
 }
@@ -0,0 +1,245 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/room732/gortp"
+)
+
+// Frame is one RTP payload to play.
+type Frame struct {
+	Offset      time.Duration // send time relative to the start of the playback
+	Stamp       uint32        // RTP timestamp relative to the first frame
+	Payload     []byte
+	PayloadType byte // valid only if HasHeader is true
+	Marker      bool // valid only if HasHeader is true
+	HasHeader   bool // true if the frame carries an own payload type and marker
+}
+
+// Sender is the part of the rtp.Session that the Player uses to send packets.
+type Sender interface {
+	NewDataPacketForStream(streamIndex uint32, stamp uint32) *rtp.DataPacket
+	WriteData(rp *rtp.DataPacket) (n int, err error)
+}
+
+// Player transmits a list of frames as RTP on an output stream.
+//
+// The Player paces the packets against the start time of the playback with rtp.WaitUntil and
+// uses the monotonic clock, thus sleep inaccuracies do not accumulate and wallclock changes do
+// not affect the pacing. If the Player falls behind the schedule by more than MaxLag, for example after the
+// system was suspended, it moves the schedule instead of sending a burst of late packets.
+//
+type Player struct {
+	Loop   bool          // restart at the end of the frame list until stopped
+	MaxLag time.Duration // maximum lag before the Player re-schedules, zero means 200 ms
+
+	sender      Sender
+	streamIndex uint32
+	frames      []Frame
+	frameStamp  uint32 // timestamp increment after the last frame for the next loop pass
+
+	stopOnce sync.Once
+	stop     chan bool
+}
+
+// NewPlayer creates a new player.
+//
+//   sender      - usually the rtp.Session that owns the output stream
+//   streamIndex - the index of the output stream as returned by NewSsrcStreamOut
+//   frames      - the frames to play, see LoadRecording and LoadRawFrames
+//   frameStamp  - the duration of the last frame in timestamp units, the Player adds it
+//                 when it starts the next loop pass
+//
+func NewPlayer(sender Sender, streamIndex uint32, frames []Frame, frameStamp uint32) *Player {
+	return &Player{sender: sender, streamIndex: streamIndex, frames: frames, frameStamp: frameStamp,
+		stop: make(chan bool)}
+}
+
+// Play sends the frames and returns after the last frame, or after Stop was called if the
+// Player loops. It returns the number of sent packets.
+func (p *Player) Play() (sent int, err error) {
+	if len(p.frames) == 0 {
+		return 0, Error("No frames to play.")
+	}
+	maxLag := p.MaxLag
+	if maxLag == 0 {
+		maxLag = 200 * time.Millisecond
+	}
+	var stampBase uint32
+	var passOffset time.Duration
+	last := p.frames[len(p.frames)-1]
+	passLen := p.passLength()
+	start := time.Now()
+
+	for {
+		for _, fr := range p.frames {
+			due := start.Add(passOffset + fr.Offset)
+			if d := time.Until(due); d > 0 {
+				if !rtp.WaitUntil(due, p.stop) {
+					return sent, nil
+				}
+			} else if -d > maxLag {
+				start = start.Add(-d) // too late, move the schedule
+			}
+			select {
+			case <-p.stop:
+				return sent, nil
+			default:
+			}
+			rp := p.sender.NewDataPacketForStream(p.streamIndex, stampBase+fr.Stamp)
+			if fr.HasHeader {
+				rp.SetPayloadType(fr.PayloadType)
+				rp.SetMarker(fr.Marker)
+			}
+			rp.SetPayload(fr.Payload)
+			_, err = p.sender.WriteData(rp)
+			rp.FreePacket()
+			if err != nil {
+				return sent, err
+			}
+			sent++
+		}
+		if !p.Loop {
+			return sent, nil
+		}
+		stampBase += last.Stamp + p.frameStamp
+		passOffset += passLen
+	}
+}
+
+// Stop stops a running playback.
+func (p *Player) Stop() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// passLength returns the duration of one pass, that is the offset of the last frame plus the
+// duration of the last frame derived from the frames' offsets and timestamps.
+func (p *Player) passLength() time.Duration {
+	last := p.frames[len(p.frames)-1]
+	if last.Stamp == 0 || last.Offset == 0 {
+		return last.Offset + 20*time.Millisecond
+	}
+	return last.Offset + time.Duration(float64(last.Offset)*float64(p.frameStamp)/float64(last.Stamp))
+}
+
+// LoadRecording reads the frames of the recording segments.
+//
+// The Player paces recorded frames according to their RTP timestamps, not according to the
+// recorded arrival times, thus the playback does not reproduce the network jitter.
+//
+//   indexFiles - the index files of the segments in playback order, see Segments
+//
+// The function returns the frames and the timestamp increment of the last frame.
+//
+func LoadRecording(indexFiles ...string) (frames []Frame, frameStamp uint32, err error) {
+	var firstStamp, prevStamp uint32
+	var base time.Duration
+	for _, name := range indexFiles {
+		var entries []IndexEntry
+		var hdr IndexHeader
+		if hdr, entries, err = readIndexFile(name); err != nil {
+			return nil, 0, err
+		}
+		data, err := os.ReadFile(filepath.Join(filepath.Dir(name), hdr.Payload))
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, e := range entries {
+			if e.Offset+int64(e.Length) > int64(len(data)) {
+				return nil, 0, Error("Index entry exceeds payload file " + hdr.Payload + ".")
+			}
+			format := rtp.PayloadFormatMap[int(e.PayloadType)]
+			if format == nil || format.ClockRate == 0 {
+				return nil, 0, Error("Unknown payload type in recording " + name + ".")
+			}
+			if len(frames) == 0 {
+				firstStamp, prevStamp = e.Timestamp, e.Timestamp
+			}
+			if delta := e.Timestamp - prevStamp; int32(delta) > 0 {
+				frameStamp = delta
+				base += time.Duration(delta) * time.Second / time.Duration(format.ClockRate)
+				prevStamp = e.Timestamp
+			}
+			frames = append(frames, Frame{base, e.Timestamp - firstStamp, data[e.Offset : e.Offset+int64(e.Length)],
+				e.PayloadType, e.Marker, true})
+		}
+	}
+	return frames, frameStamp, nil
+}
+
+// LoadRawFrames splits a raw payload stream into frames of equal size and duration.
+//
+//   r             - the raw payload, for example a file with G.711 samples
+//   frameSize     - payload bytes per frame
+//   frameDuration - the duration of one frame, for example 20 ms
+//   clockRate     - the RTP clock rate of the payload format
+//
+// The function returns the frames and the timestamp increment per frame.
+//
+func LoadRawFrames(r io.Reader, frameSize int, frameDuration time.Duration, clockRate int) (frames []Frame, frameStamp uint32, err error) {
+	if frameSize <= 0 || frameDuration <= 0 {
+		return nil, 0, Error("Frame size and duration must be greater zero.")
+	}
+	frameStamp = uint32(time.Duration(clockRate) * frameDuration / time.Second)
+	br := bufio.NewReader(r)
+	for i := 0; ; i++ {
+		buf := make([]byte, frameSize)
+		n, err := io.ReadFull(br, buf)
+		if n > 0 {
+			frames = append(frames, Frame{Offset: time.Duration(i) * frameDuration, Stamp: uint32(i) * frameStamp, Payload: buf[:n]})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return frames, frameStamp, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// readIndexFile reads the header and the entries of an index file.
+func readIndexFile(name string) (hdr IndexHeader, entries []IndexEntry, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	if err = dec.Decode(&hdr); err != nil {
+		return
+	}
+	for {
+		var e IndexEntry
+		if err = dec.Decode(&e); err == io.EOF {
+			return hdr, entries, nil
+		} else if err != nil {
+			return
+		}
+		entries = append(entries, e)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/room732/gortp"
+)
+
+func testPacket(ssrc uint32, seq uint16, stamp uint32, payload []byte) *rtp.DataPacket {
+	buf := make([]byte, 12+len(payload))
+	buf[0] = 0x80
+	binary.BigEndian.PutUint16(buf[2:], seq)
+	binary.BigEndian.PutUint32(buf[4:], stamp)
+	binary.BigEndian.PutUint32(buf[8:], ssrc)
+	copy(buf[12:], payload)
+	rp, _ := rtp.NewDataPacketFromBuffer(buf)
+	return rp
+}
+
+func readIndex(t *testing.T, name string) (hdr IndexHeader, entries []IndexEntry) {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Errorf("Open index failed: %s\n", err)
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for first := true; sc.Scan(); first = false {
+		if first {
+			json.Unmarshal(sc.Bytes(), &hdr)
+			continue
+		}
+		var e IndexEntry
+		json.Unmarshal(sc.Bytes(), &e)
+		entries = append(entries, e)
+	}
+	return
+}
+
+func TestRecorder(t *testing.T) {
+	dir, err := os.MkdirTemp("", "gortp-record")
+	if err != nil {
+		t.Errorf("MkdirTemp failed: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	rec, err := NewRecorder(nil, dir, Policy{MaxDuration: time.Second, MaxSegments: 2})
+	if err != nil {
+		t.Errorf("NewRecorder failed: %s\n", err)
+		return
+	}
+	start := time.Unix(1400000000, 0)
+	// 3 seconds of 20 ms packets, 160 bytes each: three segments, the oldest one is removed
+	for i := 0; i < 150; i++ {
+		payload := make([]byte, 160)
+		payload[0] = byte(i)
+		rp := testPacket(0x1234, uint16(i), uint32(i*160), payload)
+		if err = rec.Record(rp, start.Add(time.Duration(i)*20*time.Millisecond)); err != nil {
+			t.Errorf("Record failed: %s\n", err)
+		}
+		rp.FreePacket()
+	}
+	rec.Close()
+
+	segments, _ := Segments(dir, 0x1234)
+	if len(segments) != 2 {
+		t.Errorf("Segment retention check failed. Expected: 2 segments, got: %d\n", len(segments))
+		return
+	}
+	hdr, entries := readIndex(t, segments[1])
+	if hdr.Ssrc != 0x1234 || hdr.Segment != 2 {
+		t.Errorf("Index header check failed. Got: %+v\n", hdr)
+	}
+	if len(entries) != 50 || entries[0].Seq != 100 || entries[0].Timestamp != 16000 || entries[1].Offset != 160 {
+		t.Errorf("Index entries check failed, got %d entries\n", len(entries))
+		return
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, hdr.Payload))
+	if len(data) != 50*160 || data[160] != 101 {
+		t.Errorf("Payload file check failed, length: %d\n", len(data))
+	}
+}
+
+// fakeSender records the packets a Player sends, together with the send times.
+type fakeSender struct {
+	seq     uint16
+	stamps  []uint32
+	payload [][]byte
+	times   []time.Time
+}
+
+func (fs *fakeSender) NewDataPacketForStream(streamIndex uint32, stamp uint32) *rtp.DataPacket {
+	fs.seq++
+	return testPacket(0x5678, fs.seq, stamp, nil)
+}
+
+func (fs *fakeSender) WriteData(rp *rtp.DataPacket) (n int, err error) {
+	fs.stamps = append(fs.stamps, rp.Timestamp())
+	fs.payload = append(fs.payload, append([]byte{}, rp.Payload()...))
+	fs.times = append(fs.times, time.Now())
+	return rp.InUse(), nil
+}
+
+func TestPlayer(t *testing.T) {
+	dir, err := os.MkdirTemp("", "gortp-play")
+	if err != nil {
+		t.Errorf("MkdirTemp failed: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	rec, _ := NewRecorder(nil, dir, Policy{})
+	start := time.Unix(1400000000, 0)
+	for i := 0; i < 10; i++ {
+		// record with some arrival jitter, playback must pace by timestamps
+		rp := testPacket(0x1234, uint16(i), uint32(1000+i*160), []byte{byte(i), 1, 2, 3})
+		rec.Record(rp, start.Add(time.Duration(i)*20*time.Millisecond+time.Duration(i%3)*7*time.Millisecond))
+		rp.FreePacket()
+	}
+	rec.Close()
+
+	segments, _ := Segments(dir, 0x1234)
+	frames, frameStamp, err := LoadRecording(segments...)
+	if err != nil || len(frames) != 10 || frameStamp != 160 {
+		t.Errorf("LoadRecording failed: %v, frames: %d, frame stamp: %d\n", err, len(frames), frameStamp)
+		return
+	}
+	if frames[9].Offset != 180*time.Millisecond || frames[9].Stamp != 1440 {
+		t.Errorf("Frame offset check failed. Got: %s, stamp: %d\n", frames[9].Offset, frames[9].Stamp)
+	}
+
+	fs := new(fakeSender)
+	pl := NewPlayer(fs, 0, frames, frameStamp)
+	sent, err := pl.Play()
+	if err != nil || sent != 10 {
+		t.Errorf("Play failed: %v, sent: %d\n", err, sent)
+		return
+	}
+	if d := fs.times[9].Sub(fs.times[0]); d < 170*time.Millisecond || d > 260*time.Millisecond {
+		t.Errorf("Pacing check failed. Expected about 180ms, got: %s\n", d)
+	}
+	if fs.stamps[9] != 1440 || fs.payload[3][0] != 3 {
+		t.Errorf("Played packet check failed. Stamp: %d\n", fs.stamps[9])
+	}
+
+	// Raw frames, looping: the second pass continues the timestamps
+	raw, frameStamp, _ := LoadRawFrames(bytes.NewReader(make([]byte, 480)), 160, 20*time.Millisecond, 8000)
+	fs = new(fakeSender)
+	pl = NewPlayer(fs, 0, raw, frameStamp)
+	pl.Loop = true
+	go func() {
+		time.Sleep(90 * time.Millisecond)
+		pl.Stop()
+	}()
+	sent, _ = pl.Play()
+	if sent < 4 || fs.stamps[3] != 480 {
+		t.Errorf("Loop check failed. Sent: %d, stamps: %v\n", sent, fs.stamps)
+	}
+}
+
+// fixedMapper maps the RTP timestamps of SSRC 0x1234 with a fixed mapping.
+type fixedMapper struct {
+	cm rtp.ClockMapping
+}
+
+func (fm *fixedMapper) ClockMapping(ssrc uint32) (rtp.ClockMapping, bool) {
+	return fm.cm, ssrc == 0x1234
+}
+
+func TestRecorderMediaTime(t *testing.T) {
+	dir, err := os.MkdirTemp("", "gortp-record")
+	if err != nil {
+		t.Errorf("MkdirTemp failed: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	rec, _ := NewRecorder(nil, dir, Policy{})
+	sender := time.Unix(1500000000, 0)
+	rec.SetClockMapper(&fixedMapper{rtp.ClockMapping{RtpTimestamp: 8000, Utc: sender, ClockRate: 8000, Rate: 8000}})
+	arrival := time.Unix(1400000000, 0)
+	for _, ssrc := range []uint32{0x1234, 0x4321} {
+		rp := testPacket(ssrc, 1, 16000, make([]byte, 160))
+		rec.Record(rp, arrival)
+		rp.FreePacket()
+	}
+	rec.Close()
+
+	segments, _ := Segments(dir, 0x1234)
+	_, entries := readIndex(t, segments[0])
+	if len(entries) != 1 || entries[0].MediaTime != sender.Add(time.Second).UnixNano() || entries[0].Wallclock != arrival.UnixNano() {
+		t.Errorf("Media time check failed: %+v\n", entries)
+	}
+	segments, _ = Segments(dir, 0x4321)
+	if _, entries = readIndex(t, segments[0]); len(entries) != 1 || entries[0].MediaTime != 0 {
+		t.Errorf("Unmapped stream must have no media time: %+v\n", entries)
+	}
+}
@@ -0,0 +1,352 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+// Package record implements recording of received RTP streams into per stream media files
+// and playback of recorded streams.
+//
+// A recording segment consists of two files: the raw payload file that contains the
+// concatenated payloads of the RTP packets, and an index file in JSON lines format. The
+// first line of the index is an IndexHeader, each following line is an IndexEntry that
+// describes one packet: its sequence number, RTP timestamp, arrival wallclock time, and
+// the position of its payload in the payload file.
+//
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/room732/gortp"
+)
+
+// Returned in case of an error.
+type Error string
+
+func (s Error) Error() string {
+	return string(s)
+}
+
+// File name extensions of the payload and index files of a segment.
+const (
+	PayloadExt = ".raw"
+	IndexExt   = ".idx.json"
+)
+
+// IndexHeader is the first line of an index file.
+type IndexHeader struct {
+	Ssrc    uint32 `json:"ssrc"`
+	Source  string `json:"source"`  // address of the stream's sender
+	Start   int64  `json:"start"`   // wallclock time of the first packet of the segment, nanoseconds
+	Segment int    `json:"segment"` // segment number, zero for the first segment of a stream
+	Payload string `json:"payload"` // name of the payload file, relative to the index file
+}
+
+// IndexEntry describes one recorded RTP packet.
+type IndexEntry struct {
+	Seq         uint16 `json:"seq"`
+	Timestamp   uint32 `json:"timestamp"`
+	Wallclock   int64  `json:"wallclock"` // arrival time, nanoseconds
+	PayloadType byte   `json:"pt"`
+	Marker      bool   `json:"marker,omitempty"`
+	Offset      int64  `json:"offset"`          // offset of the payload in the payload file
+	Length      int    `json:"length"`          // length of the payload
+	MediaTime   int64  `json:"media,omitempty"` // sender's wallclock time of the RTP timestamp, nanoseconds, see SetClockMapper
+}
+
+// ClockMapper returns the RTP to UTC mapping of a received stream, rtp.Session implements it.
+type ClockMapper interface {
+	ClockMapping(ssrc uint32) (rtp.ClockMapping, bool)
+}
+
+// Policy controls the rotation and retention of the recording segments.
+//
+// A zero value in a field disables the corresponding rule.
+type Policy struct {
+	MaxDuration time.Duration // start a new segment if the segment is older than this
+	MaxSize     int64         // start a new segment if the payload file exceeds this size
+	MaxSegments int           // keep at most this number of segments per stream, remove the oldest
+}
+
+// Recorder implements the rtp.TransportRecv interface and records the payloads of all received
+// RTP packets, one set of segment files per SSRC.
+//
+// Applications insert the Recorder between the network transport and the Session:
+//
+//   tp, _ := rtp.NewTransportUDP(local, localPort)
+//   rec, _ := record.NewRecorder(tp, "/var/spool/calls", record.Policy{MaxDuration: time.Hour})
+//   rs := rtp.NewSession(tp, rec)
+//
+// The Recorder forwards all packets unchanged to the upper layer and does not record RTCP
+// packets. After the session is closed the application calls Close to flush and close the
+// recording files.
+//
+type Recorder struct {
+	Dir    string
+	Policy Policy
+
+	callUpper     rtp.TransportRecv
+	transportRecv rtp.TransportRecv
+
+	mutex   sync.Mutex
+	streams map[uint32]*recStream
+	mapper  ClockMapper
+	closed  bool
+	err     error
+}
+
+// recStream is the open segment of one recorded stream.
+type recStream struct {
+	ssrc     uint32
+	base     string // file name prefix of all segments of this stream
+	segment  int
+	start    time.Time
+	size     int64
+	payload  *os.File
+	index    *os.File
+	payloadW *bufio.Writer
+	indexW   *bufio.Writer
+	enc      *json.Encoder
+	segments []string // file name prefixes of the existing segments, oldest first
+}
+
+// NewRecorder creates a new recorder that stores the segment files in directory dir.
+//
+//   tpr    - the transport that receives the packets, the function registers the recorder
+//            as its upper layer
+//   dir    - the recording directory, the function creates it if necessary
+//   policy - the rotation and retention policy
+//
+func NewRecorder(tpr rtp.TransportRecv, dir string, policy Policy) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	rec := new(Recorder)
+	rec.Dir = dir
+	rec.Policy = policy
+	rec.transportRecv = tpr
+	rec.streams = make(map[uint32]*recStream)
+	if tpr != nil {
+		tpr.SetCallUpper(rec)
+	}
+	return rec, nil
+}
+
+// SetClockMapper sets the source of the RTP to UTC mappings of the recorded streams, usually
+// the session that receives the streams. The recorder then stores the sender's wallclock time
+// of each packet's RTP timestamp in the MediaTime of the index entries, the recordings of
+// several senders align on this time in post-production. Nil removes the mapper.
+func (rec *Recorder) SetClockMapper(mapper ClockMapper) {
+	rec.mutex.Lock()
+	rec.mapper = mapper
+	rec.mutex.Unlock()
+}
+
+// Record records the payload of an RTP packet that arrived at time tm.
+//
+// OnRecvData calls Record for each received packet. Applications that receive packets by other
+// means, for example via the Session's data channel, may call Record directly.
+//
+func (rec *Recorder) Record(rp *rtp.DataPacket, tm time.Time) error {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+
+	if rec.closed {
+		return Error("Recorder is closed.")
+	}
+	ssrc := rp.Ssrc()
+	str := rec.streams[ssrc]
+	if str == nil {
+		str = &recStream{ssrc: ssrc, base: fmt.Sprintf("%08x-%s", ssrc, tm.UTC().Format("20060102T150405.000"))}
+		if err := rec.openSegment(str, rp, tm); err != nil {
+			return rec.fail(err)
+		}
+		rec.streams[ssrc] = str
+	} else if rec.rotate(str, tm) {
+		str.close()
+		str.segment++
+		if err := rec.openSegment(str, rp, tm); err != nil {
+			delete(rec.streams, ssrc)
+			return rec.fail(err)
+		}
+	}
+	payload := rp.Payload()
+	entry := IndexEntry{rp.Sequence(), rp.Timestamp(), tm.UnixNano(), rp.PayloadType(), rp.Marker(), str.size, len(payload), 0}
+	if rec.mapper != nil {
+		if cm, ok := rec.mapper.ClockMapping(ssrc); ok {
+			entry.MediaTime = cm.Time(rp.Timestamp()).UnixNano()
+		}
+	}
+	if _, err := str.payloadW.Write(payload); err != nil {
+		return rec.fail(err)
+	}
+	str.size += int64(len(payload))
+	if err := str.enc.Encode(&entry); err != nil {
+		return rec.fail(err)
+	}
+	return nil
+}
+
+// Err returns the first error that occured while recording packets received via OnRecvData.
+func (rec *Recorder) Err() error {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	return rec.err
+}
+
+// Close flushes and closes all open segment files. The Recorder ignores packets it receives
+// after Close.
+func (rec *Recorder) Close() (err error) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+
+	rec.closed = true
+	for ssrc, str := range rec.streams {
+		if e := str.close(); e != nil && err == nil {
+			err = e
+		}
+		delete(rec.streams, ssrc)
+	}
+	return
+}
+
+// *** The following methods implement the rtp.TransportRecv interface.
+
+// SetCallUpper implements the rtp.TransportRecv SetCallUpper method.
+func (rec *Recorder) SetCallUpper(upper rtp.TransportRecv) {
+	rec.callUpper = upper
+}
+
+// ListenOnTransports implements the rtp.TransportRecv ListenOnTransports method.
+func (rec *Recorder) ListenOnTransports() error {
+	return rec.transportRecv.ListenOnTransports()
+}
+
+// OnRecvData implements the rtp.TransportRecv OnRecvData method.
+//
+// The method records the packet and forwards it to the upper layer.
+func (rec *Recorder) OnRecvData(rp *rtp.DataPacket) bool {
+	if rp.InUse() >= 12 {
+		rec.Record(rp, time.Now())
+	}
+	if rec.callUpper != nil {
+		return rec.callUpper.OnRecvData(rp)
+	}
+	rp.FreePacket()
+	return true
+}
+
+// OnRecvCtrl implements the rtp.TransportRecv OnRecvCtrl method.
+func (rec *Recorder) OnRecvCtrl(rp *rtp.CtrlPacket) bool {
+	if rec.callUpper != nil {
+		return rec.callUpper.OnRecvCtrl(rp)
+	}
+	rp.FreePacket()
+	return true
+}
+
+// CloseRecv implements the rtp.TransportRecv CloseRecv method.
+func (rec *Recorder) CloseRecv() {
+	rec.transportRecv.CloseRecv()
+}
+
+// SetEndChannel implements the rtp.TransportRecv SetEndChannel method.
+func (rec *Recorder) SetEndChannel(ch rtp.TransportEnd) {
+	rec.transportRecv.SetEndChannel(ch)
+}
+
+// *** Local functions and methods.
+
+// fail records the first error, the caller holds the mutex.
+func (rec *Recorder) fail(err error) error {
+	if rec.err == nil {
+		rec.err = err
+	}
+	return err
+}
+
+// rotate returns true if the policy requires a new segment before recording a packet at tm.
+func (rec *Recorder) rotate(str *recStream, tm time.Time) bool {
+	if rec.Policy.MaxDuration > 0 && tm.Sub(str.start) >= rec.Policy.MaxDuration {
+		return true
+	}
+	return rec.Policy.MaxSize > 0 && str.size >= rec.Policy.MaxSize
+}
+
+// openSegment creates the files of the next segment and applies the retention rule.
+func (rec *Recorder) openSegment(str *recStream, rp *rtp.DataPacket, tm time.Time) (err error) {
+	prefix := fmt.Sprintf("%s-%04d", str.base, str.segment)
+	if str.payload, err = os.Create(filepath.Join(rec.Dir, prefix+PayloadExt)); err != nil {
+		return
+	}
+	if str.index, err = os.Create(filepath.Join(rec.Dir, prefix+IndexExt)); err != nil {
+		str.payload.Close()
+		return
+	}
+	str.payloadW = bufio.NewWriter(str.payload)
+	str.indexW = bufio.NewWriter(str.index)
+	str.enc = json.NewEncoder(str.indexW)
+	str.start = tm
+	str.size = 0
+
+	hdr := IndexHeader{str.ssrc, "", tm.UnixNano(), str.segment, prefix + PayloadExt}
+	if from := rp.FromAddr(); from.IpAddr != nil {
+		hdr.Source = fmt.Sprintf("%s:%d", from.IpAddr, from.DataPort)
+	}
+	if err = str.enc.Encode(&hdr); err != nil {
+		return
+	}
+	str.segments = append(str.segments, prefix)
+	if max := rec.Policy.MaxSegments; max > 0 && len(str.segments) > max {
+		for _, old := range str.segments[:len(str.segments)-max] {
+			os.Remove(filepath.Join(rec.Dir, old+PayloadExt))
+			os.Remove(filepath.Join(rec.Dir, old+IndexExt))
+		}
+		str.segments = str.segments[len(str.segments)-max:]
+	}
+	return nil
+}
+
+func (str *recStream) close() (err error) {
+	if str.payload == nil {
+		return nil
+	}
+	for _, e := range []error{str.payloadW.Flush(), str.indexW.Flush(), str.payload.Close(), str.index.Close()} {
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	str.payload, str.index = nil, nil
+	return
+}
+
+// Segments returns the names of the index files in directory dir that belong to the stream with
+// the given SSRC, sorted by recording start and segment number.
+func Segments(dir string, ssrc uint32) ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf("%08x-*", ssrc)+IndexExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,239 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+package rtp
+
+/*
+ * This source file contains the reference clock signaling and the clock synchronized playout,
+ * RFC 7273.
+ */
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReferenceClock is the clock the media clocks of a session derive from, for example a clock
+// that a PTP (IEEE 1588) or NTP client disciplines. Now returns the time of the reference
+// clock, the media clock counts from its epoch.
+type ReferenceClock interface {
+	Now() time.Time
+}
+
+// TsRefClock is the value of the SDP "ts-refclk" attribute, RFC 7273 chapter 4.8.
+//
+// Source is the type of the clock: "ntp", "ptp", "gps", "gal", "glonass", "local" or "private".
+// Value holds the rest of the attribute after the "=", for example the NTP server or the PTP
+// version, grandmaster identity and domain "IEEE1588-2008:39-A7-94-FF-FE-07-CB-D0:0". It is
+// empty for the sources without parameters.
+type TsRefClock struct {
+	Source string
+	Value  string
+}
+
+// String returns the attribute value as the SDP carries it.
+func (ref TsRefClock) String() string {
+	if ref.Value == "" {
+		return ref.Source
+	}
+	return ref.Source + "=" + ref.Value
+}
+
+// ParseTsRefClock parses a "ts-refclk" attribute. The function accepts the attribute with or
+// without the leading "a=ts-refclk:".
+//
+//   attr - the attribute or its value
+//
+func ParseTsRefClock(attr string) (TsRefClock, error) {
+	attr = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(attr), "a="), "ts-refclk:")
+	source, value := attr, ""
+	if i := strings.IndexByte(attr, '='); i >= 0 {
+		source, value = attr[:i], attr[i+1:]
+	}
+	switch source {
+	case "ntp", "ptp", "gps", "gal", "glonass", "private":
+	case "local":
+		if value != "" {
+			return TsRefClock{}, Error("ParseTsRefClock: local clock with a parameter.")
+		}
+	default:
+		return TsRefClock{}, Error("ParseTsRefClock: unknown clock source \"" + source + "\".")
+	}
+	if (source == "ntp" || source == "ptp") && value == "" {
+		return TsRefClock{}, Error("ParseTsRefClock: " + source + " clock without a parameter.")
+	}
+	return TsRefClock{Source: source, Value: value}, nil
+}
+
+// ParseMediaClock parses a "mediaclk" attribute, RFC 7273 chapter 5, and returns the offset
+// of the direct media clock. The RTP timestamps of a direct media clock count the samples since
+// the epoch of the reference clock plus the offset. The function accepts the attribute with or
+// without the leading "a=mediaclk:" and supports only direct media clocks with the nominal rate.
+//
+//   attr - the attribute or its value
+//
+func ParseMediaClock(attr string) (uint32, error) {
+	attr = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(attr), "a="), "mediaclk:")
+	fields := strings.Fields(attr)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "direct") {
+		return 0, Error("ParseMediaClock: not a direct media clock.")
+	}
+	var offset uint32
+	if v := strings.TrimPrefix(fields[0], "direct"); v != "" {
+		if v[0] != '=' {
+			return 0, Error("ParseMediaClock: malformed direct media clock.")
+		}
+		n, err := strconv.ParseUint(v[1:], 10, 32)
+		if err != nil {
+			return 0, Error("ParseMediaClock: malformed offset.")
+		}
+		offset = uint32(n)
+	}
+	for _, f := range fields[1:] {
+		if strings.HasPrefix(f, "rate=") {
+			return 0, Error("ParseMediaClock: media clock rates other than the nominal rate are not supported.")
+		}
+	}
+	return offset, nil
+}
+
+// refClock is the reference clock of a session, see SetReferenceClock.
+type refClock struct {
+	ref    TsRefClock
+	clock  ReferenceClock
+	offset uint32
+}
+
+// SetReferenceClock sets the reference clock of the session's direct media clock, RFC 7273.
+//
+// SdpMedia adds the "ts-refclk" and "mediaclk" attributes, the sender reports map the
+// RTP timestamps to the time of the reference clock instead of the system clock, and
+// MediaClockStamp returns the RTP timestamps for the application's data packets. The receivers
+// of all senders that share the reference clock, for example the members of an AES67
+// multicast group with the same PTP grandmaster, align their playout with a PlayoutClock. Set
+// the reference clock before StartSession, a nil clock removes it.
+//
+//   ref    - the reference clock signaling
+//   clock  - the reference clock
+//   offset - the RTP timestamp at the epoch of the reference clock
+//
+func (rs *Session) SetReferenceClock(ref TsRefClock, clock ReferenceClock, offset uint32) {
+	if clock == nil {
+		rs.refClock = nil
+		return
+	}
+	rs.refClock = &refClock{ref: ref, clock: clock, offset: offset}
+}
+
+// MediaClockStamp returns the RTP timestamp of the session's direct media clock at the current
+// time of the reference clock. It returns false if the session has no reference clock.
+//
+//   clockRate - the clock rate of the payload format
+//
+func (rs *Session) MediaClockStamp(clockRate int) (uint32, bool) {
+	rc := rs.refClock
+	if rc == nil {
+		return 0, false
+	}
+	return mediaClockStamp(rc.clock.Now(), clockRate, rc.offset), true
+}
+
+// PlayoutClock computes the playout times of the packets of a direct media clock. All
+// receivers that use the same reference clock, media clock offset and delay play a packet at
+// the same absolute time.
+type PlayoutClock struct {
+	clock     ReferenceClock
+	clockRate int
+	offset    uint32
+	delay     time.Duration
+}
+
+// NewPlayoutClock creates a playout clock.
+//
+//   clock     - the reference clock, synchronized to the sender's reference clock
+//   clockRate - the clock rate of the payload format
+//   offset    - the media clock offset, see ParseMediaClock
+//   delay     - the fixed link offset between the media time and the playout, it covers the
+//               network and buffering delay of the slowest receiver
+//
+func NewPlayoutClock(clock ReferenceClock, clockRate int, offset uint32, delay time.Duration) (*PlayoutClock, error) {
+	if clock == nil {
+		return nil, Error("NewPlayoutClock: no reference clock.")
+	}
+	if clockRate <= 0 {
+		return nil, Error("NewPlayoutClock: invalid clock rate.")
+	}
+	return &PlayoutClock{clock: clock, clockRate: clockRate, offset: offset, delay: delay}, nil
+}
+
+// PlayoutTime returns the reference clock time to play the sample with the RTP timestamp: the
+// media time of the timestamp plus the delay. The function resolves the wrap around of
+// the timestamp to the media time nearest to the current time.
+//
+//   stamp - the RTP timestamp
+//
+func (pc *PlayoutClock) PlayoutTime(stamp uint32) time.Time {
+	now := pc.clock.Now()
+	diff := int64(int32(stamp - mediaClockStamp(now, pc.clockRate, pc.offset)))
+	return now.Add(time.Duration(diff*1e9/int64(pc.clockRate)) + pc.delay)
+}
+
+// Until returns the time until the playout of the sample with the RTP timestamp, negative if
+// the sample is late.
+//
+//   stamp - the RTP timestamp
+//
+func (pc *PlayoutClock) Until(stamp uint32) time.Duration {
+	return pc.PlayoutTime(stamp).Sub(pc.clock.Now())
+}
+
+// *** Local functions and methods.
+
+// mediaClockStamp returns the RTP timestamp of a direct media clock at a time.
+func mediaClockStamp(t time.Time, clockRate int, offset uint32) uint32 {
+	ns := t.UnixNano()
+	sec, frac := uint64(ns/1e9), uint64(ns%1e9)
+	return offset + uint32(sec*uint64(clockRate)+frac*uint64(clockRate)/1e9)
+}
+
+// fillRefClockInfo replaces the NTP and RTP timestamps of a sender info with the time of the
+// reference clock and the media clock stamp at that time.
+func (rs *Session) fillRefClockInfo(so *SsrcStream, info senderInfo) {
+	rc := rs.refClock
+	if rc == nil {
+		return
+	}
+	pf := PayloadFormatMap[int(so.payloadType)]
+	if pf == nil {
+		return
+	}
+	tm := rc.clock.Now()
+	sec, frac := toNtpStamp(tm.UnixNano())
+	info.setNtpTimeStamp(sec, frac)
+	info.setRtpTimeStamp(mediaClockStamp(tm, pf.ClockRate, rc.offset))
+}
+
+// sdpRefClock returns the "ts-refclk" and "mediaclk" attributes of the session's reference
+// clock.
+func (rs *Session) sdpRefClock() string {
+	rc := rs.refClock
+	if rc == nil {
+		return ""
+	}
+	return "a=ts-refclk:" + rc.ref.String() + "\r\na=mediaclk:direct=" + strconv.FormatUint(uint64(rc.offset), 10) + "\r\n"
+}
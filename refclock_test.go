@@ -0,0 +1,135 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+package rtp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// fixedClock is a reference clock that stands still at a time.
+type fixedClock struct {
+	now time.Time
+}
+
+func (fc *fixedClock) Now() time.Time {
+	return fc.now
+}
+
+func TestParseRefClock(t *testing.T) {
+	parseFlags()
+
+	ref, err := ParseTsRefClock("a=ts-refclk:ptp=IEEE1588-2008:39-A7-94-FF-FE-07-CB-D0:0")
+	if err != nil || ref.Source != "ptp" || ref.Value != "IEEE1588-2008:39-A7-94-FF-FE-07-CB-D0:0" {
+		t.Errorf("ParseTsRefClock ptp check failed: %v, %v\n", ref, err)
+	}
+	if ref.String() != "ptp=IEEE1588-2008:39-A7-94-FF-FE-07-CB-D0:0" {
+		t.Errorf("TsRefClock string check failed: %s\n", ref.String())
+	}
+	if ref, err = ParseTsRefClock("local"); err != nil || ref.String() != "local" {
+		t.Errorf("ParseTsRefClock local check failed: %v, %v\n", ref, err)
+	}
+	for _, attr := range []string{"ts-refclk:ntp", "atomic=1", "local=x"} {
+		if _, err = ParseTsRefClock(attr); err == nil {
+			t.Errorf("ParseTsRefClock accepted %s\n", attr)
+		}
+	}
+
+	offset, err := ParseMediaClock("a=mediaclk:direct=963214424")
+	if err != nil || offset != 963214424 {
+		t.Errorf("ParseMediaClock check failed: %d, %v\n", offset, err)
+	}
+	if offset, err = ParseMediaClock("direct"); err != nil || offset != 0 {
+		t.Errorf("ParseMediaClock without offset check failed: %d, %v\n", offset, err)
+	}
+	for _, attr := range []string{"sender", "direct=12 rate=1000/1001", "direct=x", "directx"} {
+		if _, err = ParseMediaClock(attr); err == nil {
+			t.Errorf("ParseMediaClock accepted %s\n", attr)
+		}
+	}
+}
+
+func TestReferenceClock(t *testing.T) {
+	parseFlags()
+
+	clock := &fixedClock{now: time.Unix(1000, 500000000)}
+	rs := NewSession(new(captureWriter), new(teeConsumer))
+	rs.SetRtpProfile(RtpProfileAvp)
+	idx, _ := rs.NewSsrcStreamOut(&Address{net.IPv4(127, 0, 0, 1), 5004, 5005}, 0x01020304, 1)
+	rs.SsrcStreamOutForIndex(idx).SetPayloadType(0)
+	if _, ok := rs.MediaClockStamp(48000); ok {
+		t.Errorf("MediaClockStamp without reference clock succeeded\n")
+	}
+	ref := TsRefClock{Source: "ptp", Value: "IEEE1588-2008:39-A7-94-FF-FE-07-CB-D0:0"}
+	rs.SetReferenceClock(ref, clock, 100)
+	if stamp, ok := rs.MediaClockStamp(48000); !ok || stamp != 100+1000*48000+24000 {
+		t.Errorf("MediaClockStamp check failed: %d\n", stamp)
+	}
+
+	media, err := rs.SdpMedia(5004, []byte{0})
+	expected := "m=audio 5004 RTP/AVP 0\r\na=rtpmap:0 PCMU/8000\r\n" +
+		"a=ts-refclk:ptp=IEEE1588-2008:39-A7-94-FF-FE-07-CB-D0:0\r\na=mediaclk:direct=100\r\n"
+	if err != nil || media != expected {
+		t.Errorf("SDP media with reference clock check failed:\n%s\n", media)
+	}
+
+	rc, _ := newCtrlPacket()
+	info, _ := rc.newSenderInfo()
+	rs.fillRefClockInfo(rs.SsrcStreamOutForIndex(idx), info)
+	sec, frac := info.ntpTimeStamp()
+	if fromNtp(sec, frac)/1e6 != clock.now.UnixNano()/1e6 {
+		t.Errorf("sender info NTP time check failed: %d\n", fromNtp(sec, frac))
+	}
+	if stamp := info.rtpTimeStamp(); stamp != 100+1000*8000+4000 {
+		t.Errorf("sender info RTP time check failed: %d\n", stamp)
+	}
+	rc.FreePacket()
+
+	rs.SetReferenceClock(ref, nil, 0)
+	if media, _ = rs.SdpMedia(5004, []byte{0}); media != "m=audio 5004 RTP/AVP 0\r\na=rtpmap:0 PCMU/8000\r\n" {
+		t.Errorf("SDP media after removal of the reference clock check failed:\n%s\n", media)
+	}
+}
+
+func TestPlayoutClock(t *testing.T) {
+	parseFlags()
+
+	clock := &fixedClock{now: time.Unix(2000, 0)}
+	if _, err := NewPlayoutClock(nil, 48000, 0, 0); err == nil {
+		t.Errorf("NewPlayoutClock accepted a nil clock\n")
+	}
+	pc, err := NewPlayoutClock(clock, 48000, 7, 2*time.Millisecond)
+	if err != nil {
+		t.Errorf("NewPlayoutClock failed: %s\n", err)
+		return
+	}
+	now := mediaClockStamp(clock.now, 48000, 7)
+	if d := pc.Until(now); d != 2*time.Millisecond {
+		t.Errorf("playout delay check failed: %v\n", d)
+	}
+	if d := pc.Until(now + 480); d != 12*time.Millisecond {
+		t.Errorf("future sample check failed: %v\n", d)
+	}
+	if d := pc.Until(now - 4800); d != -98*time.Millisecond {
+		t.Errorf("late sample check failed: %v\n", d)
+	}
+	if tm := pc.PlayoutTime(now); !tm.Equal(clock.now.Add(2 * time.Millisecond)) {
+		t.Errorf("playout time check failed: %v\n", tm)
+	}
+}
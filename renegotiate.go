@@ -0,0 +1,154 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+package rtp
+
+/*
+ * This source file contains the SSRC handling of session renegotiations, for example a
+ * re-INVITE that moves the media to another address or switches the codec.
+ */
+
+// SSRC policies of a renegotiation, see SetSsrcPolicy.
+const (
+	SsrcContinue = iota // keep the SSRC and continue the sequence numbers and timestamps
+	SsrcRenew           // send a BYE and continue with a new SSRC, sequence number and timestamp base
+)
+
+// SetSsrcPolicy selects how Renegotiate treats the output streams.
+//
+// Far ends differ: some reset their decoders if the SSRC changes and drop audio until the
+// next key frame or the jitter buffer refills, others expect a new SSRC after a re-INVITE
+// that moved the media or switched the codec and discard packets that continue the old
+// sequence numbers. SsrcContinue, the default, keeps the streams continuous, SsrcRenew starts
+// them anew as RFC 3550 chapter 8.2 describes for a changed transport address.
+//
+//   policy - SsrcContinue or SsrcRenew
+//
+func (rs *Session) SetSsrcPolicy(policy int) error {
+	if policy != SsrcContinue && policy != SsrcRenew {
+		return Error("Unknown SSRC policy.")
+	}
+	rs.ssrcPolicy = policy
+	return nil
+}
+
+// SsrcPolicy returns the session's SSRC policy.
+func (rs *Session) SsrcPolicy() int {
+	return rs.ssrcPolicy
+}
+
+// Renegotiate applies the result of a renegotiation to the session.
+//
+// The method replaces the remote addresses and the payload type of the output streams and
+// handles the SSRCs of the output streams according to the SSRC policy, see SetSsrcPolicy.
+// With SsrcRenew each active output stream sends a BYE for its old SSRC and continues with a
+// new random SSRC, sequence number and initial timestamp, it resets its sender counters. The
+// application's timestamps continue in both cases, they keep their relation to the sender
+// reports. Call Renegotiate from the goroutine that sends the data packets.
+//
+//   remotes     - the new remote addresses, nil keeps the current remotes
+//   payloadType - the new payload type of the output streams, -1 keeps the payload types
+//
+func (rs *Session) Renegotiate(remotes []*Address, payloadType int) error {
+	if payloadType >= 0 {
+		if _, ok := PayloadFormatMap[payloadType]; !ok || payloadType > 127 {
+			return Error("Renegotiate: unknown payload type.")
+		}
+	}
+	var err error
+	if rs.ssrcPolicy == SsrcRenew && rs.rtcpServiceActive {
+		err = rs.sendRenewalByes()
+	}
+	if remotes != nil {
+		rs.replaceRemotes(remotes)
+	}
+	rs.streamsMapMutex.Lock()
+	for _, str := range rs.streamsOut {
+		if payloadType >= 0 {
+			str.SetPayloadType(byte(payloadType))
+		}
+		if rs.ssrcPolicy == SsrcRenew {
+			rs.renewStream(str)
+		}
+	}
+	rs.streamsMapMutex.Unlock()
+	return err
+}
+
+// *** Local functions and methods.
+
+// sendRenewalByes sends the BYE packets of the active output streams to the current remotes.
+func (rs *Session) sendRenewalByes() (err error) {
+	var renewing []*SsrcStream
+	rs.streamsMapMutex.Lock()
+	for _, str := range rs.streamsOut {
+		if str.streamStatus == active {
+			renewing = append(renewing, str)
+		}
+	}
+	rs.streamsMapMutex.Unlock()
+	for _, str := range renewing {
+		rc := rs.buildRtcpByePkt(str, "renegotiation")
+		if _, e := rs.WriteCtrl(rc); e != nil && err == nil {
+			err = e
+		}
+		rc.FreePacket()
+	}
+	return
+}
+
+// replaceRemotes replaces all remote addresses, the session stops following their host names.
+func (rs *Session) replaceRemotes(remotes []*Address) {
+	rs.remotesMutex.Lock()
+	defer rs.remotesMutex.Unlock()
+	rs.stopRemoteHosts()
+	for index := range rs.remotes {
+		delete(rs.remotes, index)
+	}
+	for _, remote := range remotes {
+		rs.remotes[rs.remoteIndex] = remote
+		rs.remoteIndex++
+	}
+}
+
+// renewStream gives the output stream a new SSRC that no other stream uses, a new sequence
+// number and a new initial timestamp. The caller holds streamsMapMutex.
+func (rs *Session) renewStream(str *SsrcStream) {
+	str.streamMutex.Lock()
+	defer str.streamMutex.Unlock()
+	old := str.ssrc
+	for str.newSsrc(); ; str.newSsrc() {
+		if _, _, exists := rs.lookupSsrcMapIn(str.ssrc); !exists && str.ssrc != old && rs.ssrcOutCount(str.ssrc) == 1 {
+			break
+		}
+	}
+	str.newSequence()
+	str.newInitialTimestamp()
+	str.SenderPacketCnt = 0
+	str.SenderOctectCnt = 0
+}
+
+// ssrcOutCount returns the number of output streams with the SSRC. The caller holds
+// streamsMapMutex.
+func (rs *Session) ssrcOutCount(ssrc uint32) (n int) {
+	for _, str := range rs.streamsOut {
+		if str.ssrc == ssrc {
+			n++
+		}
+	}
+	return
+}
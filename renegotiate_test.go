@@ -0,0 +1,94 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+package rtp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRenegotiateContinue(t *testing.T) {
+	parseFlags()
+
+	rs, ct := drainedSession(t)
+	str := rs.SsrcStreamOutForIndex(0)
+	rp := rs.NewDataPacketForStream(0, 160)
+	seq, stamp := rp.Sequence(), rp.Timestamp()
+	rp.FreePacket()
+
+	if err := rs.SetSsrcPolicy(7); err == nil {
+		t.Errorf("SetSsrcPolicy accepted an unknown policy\n")
+	}
+	if err := rs.Renegotiate(nil, 200); err == nil {
+		t.Errorf("Renegotiate accepted an unknown payload type\n")
+	}
+	remote := &Address{net.IPv4(127, 0, 0, 2), 7002, 7003}
+	if err := rs.Renegotiate([]*Address{remote}, 8); err != nil {
+		t.Errorf("Renegotiate failed: %s\n", err)
+	}
+	if remotes := rs.remoteList(); len(remotes) != 1 || !remotes[0].IpAddr.Equal(remote.IpAddr) {
+		t.Errorf("remote replacement check failed: %v\n", remotes)
+	}
+	rp = rs.NewDataPacketForStream(0, 320)
+	if rp.Ssrc() != 0x01020304 || rp.Sequence() != seq+1 || rp.Timestamp() != stamp+160 || rp.PayloadType() != 8 {
+		t.Errorf("continuity check failed: %x, %d, %d, %d\n", rp.Ssrc(), rp.Sequence()-seq, rp.Timestamp()-stamp, rp.PayloadType())
+	}
+	rp.FreePacket()
+	if len(ct.captureWriter.ctrl) != 0 || str.Ssrc() != 0x01020304 {
+		t.Errorf("SsrcContinue sent %d RTCP packets\n", len(ct.captureWriter.ctrl))
+	}
+}
+
+func TestRenegotiateRenew(t *testing.T) {
+	parseFlags()
+
+	rs, ct := drainedSession(t)
+	rs.SetSsrcPolicy(SsrcRenew)
+	str := rs.SsrcStreamOutForIndex(0)
+	str.SenderPacketCnt = 10
+	if err := rs.Renegotiate(nil, -1); err != nil {
+		t.Errorf("Renegotiate failed: %s\n", err)
+	}
+	if len(ct.captureWriter.ctrl) != 2 {
+		t.Errorf("BYE count check failed: %d\n", len(ct.captureWriter.ctrl))
+		return
+	}
+	var bye bool
+	rc, _ := newCtrlPacket()
+	for _, data := range ct.captureWriter.ctrl {
+		rc.inUse = copy(rc.buffer, data)
+		for offset := 0; offset < rc.inUse; offset += (int(rc.Length(offset)) + 1) * 4 {
+			if rc.Type(offset) == RtcpBye && rc.Ssrc(offset) == 0x01020304 {
+				bye = true
+			}
+		}
+	}
+	rc.FreePacket()
+	if !bye {
+		t.Errorf("BYE for the old SSRC missing\n")
+	}
+	if str.Ssrc() == 0x01020304 || str.Ssrc() == rs.SsrcStreamOutForIndex(1).Ssrc() || str.SenderPacketCnt != 0 {
+		t.Errorf("SSRC renewal check failed: %x\n", str.Ssrc())
+	}
+	if _, _, exists := rs.lookupSsrcMapOut(0x01020304); exists {
+		t.Errorf("old SSRC still in use\n")
+	}
+	if str.PayloadType() != 0 || rs.SsrcPolicy() != SsrcRenew {
+		t.Errorf("payload type or policy changed\n")
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * This source file contains the separate statistics of the retransmissions: the loss and
+ * bitrate statistics of a stream show the primary packets, the repair statistics show the
+ * overhead of the retransmissions.
+ */
+
+// RepairStats holds the retransmission counters of a stream: the retransmissions an input
+// stream received, RTX packets and packets that answered a NACK of the session, or the
+// retransmissions the NackResponder of an output stream sent.
+//
+// The retransmissions don't count in the bitrate of the stream, see Bitrate. The packet and
+// octet counts of an input stream, see StreamStatistics, include the received retransmissions
+// as RFC 3550 requires it for the receiver reports.
+type RepairStats struct {
+	Packets uint32
+	Octets  uint32 // payload octets
+	Bitrate BitrateStats
+}
+
+// RepairStats returns the retransmission counters of the stream.
+func (str *SsrcStream) RepairStats() RepairStats {
+	return RepairStats{Packets: atomic.LoadUint32(&str.repairPackets), Octets: atomic.LoadUint32(&str.repairOctets),
+		Bitrate: str.repairBitrate.stats(time.Now().UnixNano())}
+}
+
+// *** Local functions and methods.
+
+// addRepair counts a received or sent retransmission.
+func (str *SsrcStream) addRepair(rp *DataPacket, now int64) {
+	atomic.AddUint32(&str.repairPackets, 1)
+	atomic.AddUint32(&str.repairOctets, uint32(len(rp.Payload())))
+	str.repairBitrate.add(rp.inUse, now)
+}
+
+// requested returns true if the generator sent a NACK for the missing packet, thus the packet
+// is a retransmission.
+func (ng *NackGenerator) requested(seq uint16) bool {
+	ng.mutex.Lock()
+	defer ng.mutex.Unlock()
+	m, ok := ng.missing[seq]
+	return ok && m.retries > 0
+}
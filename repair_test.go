@@ -0,0 +1,78 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRepairStats(t *testing.T) {
+	parseFlags()
+
+	rs, _ := drainedSession(t)
+	from := &Address{IpAddr: net.IPv4(127, 0, 0, 1), DataPort: 6002, CtrlPort: 6003}
+	const ssrc = 0x0a0b0c0d
+	ng := NewNackGenerator(rs, ssrc)
+	rs.nackGenerators = map[uint32]*NackGenerator{ssrc: ng}
+
+	// packet 2 is lost, the generator requests it and the retransmission arrives
+	srCheckData(rs, ssrc, 1, 1, 100, from)
+	srCheckData(rs, ssrc, 3, 1, 100, from)
+	ng.check(time.Now().Add(50 * time.Millisecond))
+	if ng.Stats().Requests != 1 {
+		t.Errorf("NACK check failed\n")
+		return
+	}
+	srCheckData(rs, ssrc, 2, 1, 100, from)
+	str, _, _ := rs.lookupSsrcMapIn(ssrc)
+	stats := str.Statistics()
+	if stats.PacketCount != 3 || stats.Retransmissions != 1 || stats.PacketsLost != 0 || stats.OriginalLost != 1 {
+		t.Errorf("Receive statistics check failed. Got: %+v\n", stats)
+	}
+	repair := str.RepairStats()
+	primary := str.Bitrate(time.Second)
+	if repair.Packets != 1 || repair.Octets != 100 || repair.Bitrate.Rate1s != float64((rtpHeaderLength+100)*8) ||
+		primary != float64(2*(rtpHeaderLength+100)*8) {
+		t.Errorf("Receive repair check failed. Got: %+v, primary: %f\n", repair, primary)
+	}
+
+	// the NACK responder counts its retransmissions in the output stream
+	if _, err := NewNackResponder(rs, 0, 8, nil); err != nil {
+		t.Errorf("NewNackResponder failed: %s\n", err)
+		return
+	}
+	out := rs.SsrcStreamOutForIndex(0)
+	rp := rs.NewDataPacket(160)
+	rp.SetPayload(make([]byte, 50))
+	seq := rp.Sequence()
+	rs.WriteData(rp)
+	rp.FreePacket()
+	sent := out.Bitrate(time.Second)
+	rs.OnRecvCtrl(nackPacket(ssrc, out.Ssrc(), NackFci([]uint16{seq, seq})))
+	if repair = out.RepairStats(); repair.Packets != 1 || repair.Octets != 50 || out.Bitrate(time.Second) != sent {
+		t.Errorf("Send repair check failed. Got: %+v\n", repair)
+	}
+	for _, info := range rs.OutputStreams() {
+		if info.Index == 0 && info.Repair.Packets != 1 {
+			t.Errorf("Stream info repair check failed\n")
+		}
+	}
+}
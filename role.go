@@ -0,0 +1,90 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+// Session roles, see SetRole.
+const (
+	RoleSendRecv = iota // the session sends and receives RTP, the default
+	RoleSendOnly        // the session sends RTP and keeps no input streams, e.g. an announcer
+	RoleRecvOnly        // the session receives RTP and sends RTCP only, e.g. a monitoring probe
+	RolePassive         // the session receives RTP and RTCP and sends nothing, e.g. a monitoring tap
+)
+
+// SetRole sets the role of the session. Set the role after NewSession and before the session
+// creates streams.
+//
+// A receive-only session keeps one output stream, the SSRC of its receiver reports, and never
+// sends RTP: WriteData returns an error and the session refuses send side features such as
+// NackResponder and LossController. A send-only session keeps no input streams: it drops
+// received RTP packets and processes the reports of its receivers without creating input streams
+// for them, thus the session's memory doesn't grow with the number of receivers. Without input
+// streams the session neither sends receiver report blocks nor reports sequence gaps.
+//
+// A passive session is invisible on the network: it has no output streams, thus it sends no
+// receiver reports and no BYE, and WriteData and WriteCtrl return an error. It keeps the input
+// streams, statistics and control events of everything it receives, e.g. on a SPAN port. The
+// transports listen as usual, the application makes sure they don't send anything on their own,
+// for example STUN keepalives.
+//
+//   role - one of the Role constants
+//
+func (rs *Session) SetRole(role int) error {
+	if role < RoleSendRecv || role > RolePassive {
+		return Error("Unknown session role.")
+	}
+	rs.streamsMapMutex.Lock()
+	defer rs.streamsMapMutex.Unlock()
+	if rs.rtcpServiceActive || len(rs.streamsIn) > 0 || len(rs.streamsOut) > 0 {
+		return Error("Set the session role before creating streams.")
+	}
+	rs.role = role
+	switch role {
+	case RoleSendOnly:
+		rs.streamsIn = make(streamInMap)
+	case RoleRecvOnly:
+		rs.streamsOut = make(streamOutMap, 1)
+		rs.MaxNumberOutStreams = 1
+	case RolePassive:
+		rs.streamsOut = make(streamOutMap)
+		rs.MaxNumberOutStreams = 0
+	}
+	return nil
+}
+
+// Role returns the role of the session.
+func (rs *Session) Role() int {
+	return rs.role
+}
+
+// Errors of send attempts of receive-only and passive sessions.
+const (
+	errRecvOnly = Error("The session is receive-only.")
+	errPassive  = Error("The session is passive.")
+)
+
+// sendData returns the error of a RTP send attempt, nil if the role allows sending.
+func (rs *Session) sendData() error {
+	switch rs.role {
+	case RoleRecvOnly:
+		return errRecvOnly
+	case RolePassive:
+		return errPassive
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSessionRoles(t *testing.T) {
+	parseFlags()
+
+	local := net.IPv4(127, 0, 0, 1)
+	from := &Address{IpAddr: local, DataPort: 6002, CtrlPort: 6003}
+
+	// A receive-only probe sends no RTP
+	cw := new(captureWriter)
+	rs := NewSession(cw, new(teeConsumer))
+	if rs.SetRole(RoleRecvOnly) != nil || rs.Role() != RoleRecvOnly {
+		t.Errorf("SetRole failed\n")
+	}
+	rs.AddRemote(from)
+	idx, err := rs.NewSsrcStreamOut(&Address{IpAddr: local, DataPort: 6000, CtrlPort: 6001}, 0x01020304, 1)
+	if err != "" {
+		t.Errorf("Receive-only session must keep its reporting stream: %s\n", err)
+		return
+	}
+	if rs.SetRole(RoleSendRecv) == nil {
+		t.Errorf("SetRole must fail after the stream creation\n")
+	}
+	rs.SsrcStreamOutForIndex(idx).SetPayloadType(0)
+	if _, err := rs.WriteData(rs.NewDataPacket(160)); err == nil || len(cw.data) != 0 {
+		t.Errorf("Receive-only session must not send RTP\n")
+	}
+	if _, err := NewNackResponder(rs, idx, 10, nil); err == nil {
+		t.Errorf("Receive-only session must refuse a NACK responder\n")
+	}
+
+	// A send-only announcer keeps no input streams but reads the reports of its receivers
+	rs = NewSession(new(captureWriter), new(teeConsumer))
+	rs.SetRole(RoleSendOnly)
+	idx, _ = rs.NewSsrcStreamOut(&Address{IpAddr: local, DataPort: 6000, CtrlPort: 6001}, 0x01020304, 1)
+	rs.SsrcStreamOutForIndex(idx).SetPayloadType(0)
+	rs.rtcpServiceActive = true
+	if quirkData(rs, 0x0a0b0c0d, 1, from) {
+		t.Errorf("Send-only session must drop RTP\n")
+	}
+	rc, offset := newCtrlPacket()
+	rc.SetType(0, RtcpRR)
+	rc.SetCount(0, 1)
+	rc.addHeaderSsrc(offset, 0x0a0b0c0d)
+	rr, _ := rc.newRecvReport()
+	rr.setSsrc(0x01020304)
+	rr.setJitter(77)
+	rc.SetLength(0, uint16(rc.inUse/4-1))
+	rc.fromAddr = *from
+	rs.OnRecvCtrl(rc)
+	if len(rs.streamsIn) != 0 {
+		t.Errorf("Send-only session must not create input streams, got: %d\n", len(rs.streamsIn))
+	}
+	if jitter := rs.SsrcStreamOutForIndex(idx).RecvReportData.Jitter; jitter != 77 {
+		t.Errorf("Send-only session must read the receiver reports, jitter: %d\n", jitter)
+	}
+}
+
+func TestPassiveSession(t *testing.T) {
+	parseFlags()
+
+	ct := new(closeTransport)
+	rs := NewSession(ct, ct)
+	rs.SetRole(RolePassive)
+	if _, err := rs.NewSsrcStreamOut(&Address{IpAddr: net.IPv4(127, 0, 0, 1), DataPort: 6000, CtrlPort: 6001}, 0, 0); err == "" {
+		t.Errorf("Passive session must refuse output streams\n")
+	}
+	rs.rtcpServiceActive = true
+	drainCtrl(t, rs)
+	from := &Address{IpAddr: net.IPv4(10, 0, 0, 1), DataPort: 5004, CtrlPort: 5005}
+	for seq := uint16(1); seq <= 3; seq++ {
+		rp := newDataPacket()
+		rp.SetSsrc(0x0a0b0c0d)
+		rp.SetSequence(seq)
+		rp.SetTimestamp(uint32(seq) * 160)
+		rp.fromAddr = *from
+		rs.OnRecvData(rp)
+	}
+	rs.OnRecvCtrl(quirkCtrl(RtcpRR, 0x0e0e0e0e, from))
+	if len(rs.streamsIn) != 2 {
+		t.Errorf("Passive session must keep the input streams, got: %d\n", len(rs.streamsIn))
+	}
+	if str, _, ok := rs.lookupSsrcMapIn(0x0a0b0c0d); !ok || str.Statistics().PacketCount == 0 {
+		t.Errorf("Passive session statistics check failed\n")
+	}
+	rc, _ := newCtrlPacket()
+	if _, err := rs.WriteCtrl(rc); err == nil {
+		t.Errorf("Passive session must not send RTCP\n")
+	}
+	rs.CloseSessionBye("", 50*time.Millisecond)
+	if len(ct.captureWriter.data) != 0 || len(ct.captureWriter.ctrl) != 0 {
+		t.Errorf("Passive session sent packets\n")
+	}
+}
+
+func TestPassiveSessionStart(t *testing.T) {
+	parseFlags()
+
+	ct := new(closeTransport)
+	rs := NewSession(ct, ct)
+	rs.SetRole(RolePassive)
+	if err := rs.StartSession(); err != nil {
+		t.Errorf("StartSession failed: %s\n", err)
+		return
+	}
+	defer rs.CloseSessionBye("", 50*time.Millisecond)
+	if rs.RtcpSessionBandwidth <= 0 {
+		t.Errorf("Passive session has no RTCP bandwidth: %f\n", rs.RtcpSessionBandwidth)
+	}
+	from := &Address{IpAddr: net.IPv4(10, 0, 0, 1), DataPort: 5004, CtrlPort: 5005}
+	rp := newDataPacket()
+	rp.SetSsrc(0x0a0b0c0d)
+	rp.SetPayloadType(0)
+	rp.fromAddr = *from
+	rs.OnRecvData(rp)
+	if _, _, ok := rs.lookupSsrcMapIn(0x0a0b0c0d); !ok {
+		t.Errorf("Passive session did not create the input stream\n")
+	}
+	// the RTCP service must not time out the input stream on its next ticks
+	time.Sleep(600 * time.Millisecond)
+	rs.streamsMapMutex.Lock()
+	streams := len(rs.streamsIn)
+	rs.streamsMapMutex.Unlock()
+	if streams != 1 {
+		t.Errorf("Passive session lost its input stream, got: %d\n", streams)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"encoding/binary"
+)
+
+// RtcpPacket is a parsed RTCP packet of a compound packet. The concrete types are
+// *SenderReport, *ReceiverReport, *SourceDescription, *Bye, *Feedback and *OpaqueRtcp.
+// The parsed packets own their data and stay valid after the CtrlPacket was freed.
+type RtcpPacket interface {
+	PacketType() int
+}
+
+// SenderReport is a parsed SR packet, RFC 3550 chapter 6.4.1.
+type SenderReport struct {
+	Ssrc uint32 // SSRC of the sender
+	SenderInfoData
+	Reports []ReportBlock
+}
+
+// ReceiverReport is a parsed RR packet, RFC 3550 chapter 6.4.2.
+type ReceiverReport struct {
+	Ssrc    uint32 // SSRC of the packet sender
+	Reports []ReportBlock
+}
+
+// SdesItem is an item of a SDES chunk, e.g. the CNAME of a source.
+type SdesItem struct {
+	Type int // the item type, e.g. SdesCname
+	Text string
+}
+
+// SdesSource is a SDES chunk, the items of one source.
+type SdesSource struct {
+	Ssrc  uint32
+	Items []SdesItem
+}
+
+// SourceDescription is a parsed SDES packet, RFC 3550 chapter 6.5.
+type SourceDescription struct {
+	Chunks []SdesSource
+}
+
+// Bye is a parsed BYE packet, RFC 3550 chapter 6.6.
+type Bye struct {
+	Sources []uint32 // the SSRC/CSRC identifiers of the leaving sources
+	Reason  string   // empty if the packet has no reason
+}
+
+// Feedback is a parsed RTPFB or PSFB packet, RFC 4585 chapter 6.1. Other than the FeedbackMessage
+// of a handler it owns its FCI.
+type Feedback struct {
+	FeedbackMessage
+}
+
+// OpaqueRtcp is a RTCP packet the stack does not parse, e.g. an APP or XR packet.
+type OpaqueRtcp struct {
+	Type  int    // the packet type
+	Count int    // the count or subtype field of the header
+	Body  []byte // the packet after the header word
+}
+
+// PacketType returns RtcpSR.
+func (p *SenderReport) PacketType() int { return RtcpSR }
+
+// PacketType returns RtcpRR.
+func (p *ReceiverReport) PacketType() int { return RtcpRR }
+
+// PacketType returns RtcpSdes.
+func (p *SourceDescription) PacketType() int { return RtcpSdes }
+
+// PacketType returns RtcpBye.
+func (p *Bye) PacketType() int { return RtcpBye }
+
+// PacketType returns RtcpRtpfb or RtcpPsfb.
+func (p *Feedback) PacketType() int { return p.Type }
+
+// PacketType returns the type of the header.
+func (p *OpaqueRtcp) PacketType() int { return p.Type }
+
+// Item returns the text of the first item of the type, e.g. the CNAME of the source.
+func (s *SdesSource) Item(itemType int) (string, bool) {
+	for _, item := range s.Items {
+		if item.Type == itemType {
+			return item.Text, true
+		}
+	}
+	return "", false
+}
+
+// Nacks returns the lost sequence numbers if the feedback is a Generic NACK, nil otherwise.
+func (p *Feedback) Nacks() []uint16 {
+	if p.Type != RtcpRtpfb || p.Format != RtpfbNack {
+		return nil
+	}
+	return ParseNack(p.Fci)
+}
+
+// Packets parses the packets of the compound RTCP packet.
+// The method returns the packets parsed before the first malformed one together with an error.
+//
+func (rp *CtrlPacket) Packets() (pkts []RtcpPacket, err error) {
+	for offset := 0; offset < rp.inUse; {
+		if offset+rtcpHeaderLength > rp.inUse {
+			return pkts, Error("RTCP packet header truncated")
+		}
+		pktLen := int((rp.Length(offset) + 1) * 4)
+		var pkt RtcpPacket
+		if pkt, err = rp.PacketAt(offset, pktLen); err != nil {
+			return pkts, err
+		}
+		pkts = append(pkts, pkt)
+		offset += pktLen
+	}
+	return
+}
+
+// PacketAt parses one packet of the compound RTCP packet.
+//
+//   offset - points to the first byte of the header word of the packet
+//   pktLen - the length of the packet in bytes including the header word
+//
+func (rp *CtrlPacket) PacketAt(offset, pktLen int) (RtcpPacket, error) {
+	if pktLen < rtcpHeaderLength || offset+pktLen > rp.inUse {
+		return nil, Error("RTCP packet exceeds the compound packet")
+	}
+	end := offset + pktLen
+	switch pktType := rp.Type(offset); pktType {
+	case RtcpSR:
+		info, ok := rp.SenderInfo(offset)
+		if !ok || offset+rtcpHeaderLength+rtcpSsrcLength+senderInfoLen > end {
+			return nil, Error("RTCP SR too short")
+		}
+		return &SenderReport{Ssrc: rp.Ssrc(offset), SenderInfoData: info, Reports: rp.reportBlocksIn(offset, end)}, nil
+	case RtcpRR:
+		if offset+rtcpHeaderLength+rtcpSsrcLength > end {
+			return nil, Error("RTCP RR too short")
+		}
+		return &ReceiverReport{Ssrc: rp.Ssrc(offset), Reports: rp.reportBlocksIn(offset, end)}, nil
+	case RtcpSdes:
+		return rp.sourceDescription(offset, end)
+	case RtcpBye:
+		return rp.bye(offset, end)
+	case RtcpRtpfb, RtcpPsfb:
+		fbOffset := offset + rtcpHeaderLength + rtcpSsrcLength + rtcpSsrcLength
+		if fbOffset > end {
+			return nil, Error("RTCP feedback packet too short")
+		}
+		fci := make([]byte, end-fbOffset)
+		copy(fci, rp.buffer[fbOffset:end])
+		return &Feedback{FeedbackMessage{Type: pktType, Format: rp.Count(offset), Sender: rp.Ssrc(offset),
+			Media: rp.Ssrc(offset + rtcpSsrcLength), Fci: fci}}, nil
+	default:
+		body := make([]byte, pktLen-rtcpHeaderLength)
+		copy(body, rp.buffer[offset+rtcpHeaderLength:end])
+		return &OpaqueRtcp{Type: pktType, Count: rp.Count(offset), Body: body}, nil
+	}
+}
+
+// reportBlocksIn returns the report blocks of the SR or RR packet at offset that end before end.
+func (rp *CtrlPacket) reportBlocksIn(offset, end int) []ReportBlock {
+	blocks := rp.ReportBlocks(offset)
+	first := offset + rtcpHeaderLength + rtcpSsrcLength
+	if rp.Type(offset) == RtcpSR {
+		first += senderInfoLen
+	}
+	if n := (end - first) / reportBlockLen; n < len(blocks) {
+		blocks = blocks[:n]
+	}
+	return blocks
+}
+
+// sourceDescription parses the chunks of the SDES packet at offset; a malformed chunk is an
+// error.
+func (rp *CtrlPacket) sourceDescription(offset, end int) (*SourceDescription, error) {
+	sd := new(SourceDescription)
+	chunkOffset := offset + rtcpHeaderLength
+	for i := 0; i < rp.Count(offset) && chunkOffset < end; i++ {
+		chunk := rp.toSdesChunk(chunkOffset, end-chunkOffset)
+		chunkLen, ok := chunk.chunkLen()
+		if !ok {
+			return nil, Error("RTCP SDES chunk malformed")
+		}
+		src := SdesSource{Ssrc: chunk.ssrc()}
+		for itemOffset := 4; itemOffset+2 <= chunkLen; {
+			itemType := chunk.getItemType(itemOffset)
+			if itemType == SdesEnd {
+				break
+			}
+			txtLen := chunk.getItemLen(itemOffset)
+			src.Items = append(src.Items, SdesItem{Type: itemType, Text: chunk.getItemText(itemOffset, txtLen)})
+			itemOffset += 2 + txtLen
+		}
+		sd.Chunks = append(sd.Chunks, src)
+		chunkOffset += chunkLen
+	}
+	return sd, nil
+}
+
+// bye parses the sources and the reason of the BYE packet at offset.
+func (rp *CtrlPacket) bye(offset, end int) (*Bye, error) {
+	data := rp.toByeData(offset+rtcpHeaderLength, end-offset-rtcpHeaderLength)
+	cnt := rp.Count(offset)
+	if cnt*4 > len(data) {
+		return nil, Error("RTCP BYE source list truncated")
+	}
+	b := &Bye{Sources: make([]uint32, cnt), Reason: data.getReason(cnt)}
+	for i := range b.Sources {
+		b.Sources[i] = binary.BigEndian.Uint32(data[i*4:])
+	}
+	return b, nil
+}
+
+// attachPacket sets the parsed packet at offset in the packet type events of the packet.
+func attachPacket(rp *CtrlPacket, events []*CtrlEvent, offset, pktLen int) {
+	var pkt RtcpPacket
+	for _, ev := range events {
+		if ev.EventType < RtcpSR || ev.EventType > RtcpXr {
+			continue
+		}
+		if pkt == nil {
+			var err error
+			if pkt, err = rp.PacketAt(offset, pktLen); err != nil {
+				return
+			}
+		}
+		ev.Packet = pkt
+	}
+}
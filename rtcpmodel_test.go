@@ -0,0 +1,172 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// modelCompound returns a SR with one report block, a SDES with a CNAME and a BYE with a reason.
+func modelCompound(sender, reported uint32) []byte {
+	buf := make([]byte, 52+16+12)
+	buf[0], buf[1] = 0x81, RtcpSR
+	binary.BigEndian.PutUint16(buf[2:], 12)
+	binary.BigEndian.PutUint32(buf[4:], sender)
+	binary.BigEndian.PutUint32(buf[16:], 8000) // RTP timestamp
+	binary.BigEndian.PutUint32(buf[20:], 50)   // packet count
+	binary.BigEndian.PutUint32(buf[24:], 8000) // octet count
+	binary.BigEndian.PutUint32(buf[28:], reported)
+	binary.BigEndian.PutUint32(buf[36:], 1234) // highest sequence
+	binary.BigEndian.PutUint32(buf[40:], 17)   // jitter
+
+	sdes := buf[52:]
+	sdes[0], sdes[1] = 0x81, RtcpSdes
+	binary.BigEndian.PutUint16(sdes[2:], 3)
+	binary.BigEndian.PutUint32(sdes[4:], sender)
+	copy(sdes[8:], []byte{SdesCname, 3, 'a', '@', 'b', SdesEnd})
+
+	bye := buf[68:]
+	bye[0], bye[1] = 0x81, RtcpBye
+	binary.BigEndian.PutUint16(bye[2:], 2)
+	binary.BigEndian.PutUint32(bye[4:], sender)
+	copy(bye[8:], []byte{3, 'b', 'y', 'e'})
+	return buf
+}
+
+func TestRtcpPackets(t *testing.T) {
+	parseFlags()
+
+	rp, _ := NewCtrlPacketFromBuffer(modelCompound(0x0a0a0a0a, 0x01020304))
+	pkts, err := rp.Packets()
+	if err != nil || len(pkts) != 3 {
+		t.Errorf("Packets check failed: %d packets, %v\n", len(pkts), err)
+		return
+	}
+	sr, ok := pkts[0].(*SenderReport)
+	if !ok || sr.Ssrc != 0x0a0a0a0a || sr.RtpTimestamp != 8000 || sr.SenderPacketCnt != 50 || len(sr.Reports) != 1 {
+		t.Errorf("SR check failed: %+v\n", pkts[0])
+	} else if rb := sr.Reports[0]; rb.Ssrc != 0x01020304 || rb.HighestSeqNo != 1234 || rb.Jitter != 17 {
+		t.Errorf("Report block check failed: %+v\n", rb)
+	}
+	sd, ok := pkts[1].(*SourceDescription)
+	if !ok || len(sd.Chunks) != 1 || sd.Chunks[0].Ssrc != 0x0a0a0a0a {
+		t.Errorf("SDES check failed: %+v\n", pkts[1])
+	} else if cname, _ := sd.Chunks[0].Item(SdesCname); cname != "a@b" {
+		t.Errorf("SDES CNAME check failed: %q\n", cname)
+	}
+	bye, ok := pkts[2].(*Bye)
+	if !ok || len(bye.Sources) != 1 || bye.Sources[0] != 0x0a0a0a0a || bye.Reason != "bye" {
+		t.Errorf("BYE check failed: %+v\n", pkts[2])
+	}
+	rp.FreePacket()
+	if bye.Reason != "bye" || sd.Chunks[0].Items[0].Text != "a@b" {
+		t.Errorf("Parsed packets must not share the packet buffer\n")
+	}
+
+	nack := nackPacket(0x0a0b0c0d, 0x01020304, NackFci([]uint16{10, 12}))
+	pkts, err = nack.Packets()
+	if fb, ok := pkts[0].(*Feedback); err != nil || !ok || fb.Media != 0x01020304 || len(fb.Nacks()) != 2 || fb.Nacks()[1] != 12 {
+		t.Errorf("Feedback check failed: %+v, %v\n", pkts[0], err)
+	}
+
+	short, _ := NewCtrlPacketFromBuffer(modelCompound(0x0a0a0a0a, 0x01020304)[:40])
+	if pkts, err = short.Packets(); err == nil || len(pkts) != 0 {
+		t.Errorf("Truncated compound must fail: %d packets\n", len(pkts))
+	}
+}
+
+func TestRtcpPacketsMalformed(t *testing.T) {
+	parseFlags()
+
+	rr := []byte{0x80, RtcpRR, 0, 1, 0, 0, 0, 1}
+	cases := []struct {
+		name string
+		buf  []byte
+		good int  // the packets parsed before the malformed one
+		fail bool // Packets returns an error
+	}{
+		{"SDES items end at the packet end", []byte{0x81, RtcpSdes, 0, 2, 0, 0, 0, 1, 1, 2, 'a', 'b'}, 0, true},
+		{"SDES item exceeds the packet", []byte{0x81, RtcpSdes, 0, 2, 0, 0, 0, 1, 1, 9, 'a', 'b'}, 0, true},
+		{"SDES item type at the packet end", []byte{0x81, RtcpSdes, 0, 2, 0, 0, 0, 1, 1, 1, 'a', 2}, 0, true},
+		{"SDES second chunk truncated", append(append([]byte{}, rr...), 0x82, RtcpSdes, 0, 3, 0, 0, 0, 1, 1, 1, 'a', 0, 0, 0, 0, 1), 1, true},
+		{"SDES chunk too short", []byte{0x81, RtcpSdes, 0, 1, 0, 0, 0, 1}, 0, true},
+		{"BYE source list truncated", append(append([]byte{}, rr...), 0x83, RtcpBye, 0, 2, 0, 0, 0, 1, 0, 0, 0, 2), 1, true},
+		{"BYE reason exceeds the packet", []byte{0x81, RtcpBye, 0, 2, 0, 0, 0, 1, 9, 'b', 'y', 'e'}, 1, false},
+		{"SR without sender info", []byte{0x80, RtcpSR, 0, 3, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}, 0, true},
+		{"SR packet length exceeds the compound", modelCompound(1, 2)[:52+8], 1, true},
+		{"header truncated", append(append([]byte{}, rr...), 0x81, RtcpSdes), 1, true},
+	}
+	for _, c := range cases {
+		rp, _ := NewCtrlPacketFromBuffer(c.buf)
+		pkts, err := rp.Packets()
+		if len(pkts) != c.good || (err != nil) != c.fail {
+			t.Errorf("%s: %d packets, %v\n", c.name, len(pkts), err)
+		}
+		rp.FreePacket()
+	}
+
+	// random input must not panic, the packet buffers hold stale data beyond inUse
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		buf := make([]byte, 8+rnd.Intn(60))
+		rnd.Read(buf)
+		buf[0] = 0x80 | buf[0]&0x3f
+		buf[1] = byte(RtcpSR + rnd.Intn(7))
+		binary.BigEndian.PutUint16(buf[2:], uint16(rnd.Intn(len(buf)/4+2)))
+		rp, _ := NewCtrlPacketFromBuffer(buf)
+		rp.Packets()
+		rp.FreePacket()
+	}
+}
+
+func TestCtrlEventPacket(t *testing.T) {
+	parseFlags()
+
+	rs, _ := drainedSession(t)
+	events := rs.CreateCtrlEventChan()
+	rp, _ := NewCtrlPacketFromBuffer(modelCompound(0x0a0a0a0a, 0x01020304))
+	rp.fromAddr = Address{net.IPv4(10, 0, 0, 9), 6000, 6001}
+	if !rs.OnRecvCtrl(rp) {
+		t.Errorf("OnRecvCtrl failed\n")
+		return
+	}
+	var sr, rr, bye bool
+	for _, ev := range <-events {
+		switch ev.EventType {
+		case RtcpSR:
+			p, ok := ev.Packet.(*SenderReport)
+			sr = ok && p.Ssrc == 0x0a0a0a0a
+		case RtcpRR:
+			_, rr = ev.Packet.(*SenderReport) // report block of the SR
+		case RtcpBye:
+			p, ok := ev.Packet.(*Bye)
+			bye = ok && p.Reason == ev.Reason
+		case NewStreamCtrl:
+			if ev.Packet != nil {
+				t.Errorf("Stream events must not carry a packet\n")
+			}
+		}
+	}
+	if !sr || !rr || !bye {
+		t.Errorf("Event packet check failed: SR %v, RR %v, BYE %v\n", sr, rr, bye)
+	}
+}
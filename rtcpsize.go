@@ -0,0 +1,110 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"sync/atomic"
+)
+
+/*
+ * This source file contains the size control of the RTCP compounds: the RTCP service splits
+ * the reports of many senders across several compounds instead of creating IP fragments.
+ */
+
+const (
+	defaultRtcpMaxSize = 1200 // bytes of a compound, below the path MTU of most networks and tunnels
+	minRtcpMaxSize     = 128  // SR, one report block and a short SDES
+	maxReportBlocks    = 31   // the report count field has 5 bits
+)
+
+// SetRtcpMaxSize sets the maximum size of the RTCP compounds the session sends.
+//
+// The RTCP service adds report blocks, sender reports of further output streams and queued
+// feedback as long as the compound stays within the size and sends the rest in additional
+// compounds. Each additional compound starts with an SR or RR and carries the SDES of its
+// output stream, as RFC 3550 chapter 6.1 requires. The size counts the RTCP packets only,
+// leave room for the SRTCP trailer if the session uses SRTP. The default is 1200 bytes.
+//
+//   size - the maximum compound size in bytes, 0 restores the default
+//
+func (rs *Session) SetRtcpMaxSize(size int) error {
+	if size != 0 && (size < minRtcpMaxSize || size > defaultBufferSize) {
+		return Error("Invalid RTCP compound size.")
+	}
+	atomic.StoreUint32(&rs.rtcpMaxSize, uint32(size))
+	return nil
+}
+
+// RtcpMaxSize returns the maximum size of the RTCP compounds the session sends.
+func (rs *Session) RtcpMaxSize() int {
+	if size := atomic.LoadUint32(&rs.rtcpMaxSize); size != 0 {
+		return int(size)
+	}
+	return defaultRtcpMaxSize
+}
+
+// *** Local functions and methods.
+
+// rtcpFits returns true if n more bytes and the SDES of the output stream fit into the compound.
+func (rs *Session) rtcpFits(rc *CtrlPacket, strOut *SsrcStream, n int) bool {
+	sdes := 0
+	if strOut.sdesChunkLen > 0 {
+		sdes = strOut.sdesChunkLen + rtcpHeaderLength
+	}
+	return rc.InUse()+n+sdes <= rs.RtcpMaxSize()
+}
+
+// buildRtcpOverflow creates the compounds for the receiver reports that did not fit into the
+// first compound of the output stream. Each compound holds an RR of the output stream and its
+// SDES.
+func (rs *Session) buildRtcpOverflow(strOut *SsrcStream, inStreamCnt int) (rcs []*CtrlPacket) {
+	for inStreamCnt > 0 {
+		rc, offset := strOut.newCtrlPacket(RtcpRR)
+		offset = rc.addHeaderSsrc(offset, strOut.Ssrc())
+		pktLen := offset/4 - 1
+		rrCnt := rs.addRecvReports(rc, strOut, &inStreamCnt)
+		if rrCnt == 0 {
+			rc.FreePacket()
+			break
+		}
+		rc.SetLength(0, uint16(pktLen+rrCnt*reportBlockLen/4))
+		rc.SetCount(0, rrCnt)
+		rs.addSdes(strOut, rc)
+		rcs = append(rcs, rc)
+	}
+	return
+}
+
+// addRecvReports adds the receiver reports of the input streams that received data after the
+// last report as long as they fit into the compound. It returns the number of added reports and
+// decrements inStreamCnt by it.
+func (rs *Session) addRecvReports(rc *CtrlPacket, strOut *SsrcStream, inStreamCnt *int) (rrCnt int) {
+	for _, strIn := range rs.streamsIn {
+		if *inStreamCnt <= 0 || rrCnt == maxReportBlocks || !rs.rtcpFits(rc, strOut, reportBlockLen) {
+			break
+		}
+		if strIn.dataAfterLastReport {
+			strIn.dataAfterLastReport = false
+			strIn.makeRecvReport(rc)
+			rrCnt++
+			*inStreamCnt--
+		}
+	}
+	return
+}
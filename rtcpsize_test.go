@@ -0,0 +1,105 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"testing"
+)
+
+// rtcpSizeCheck checks that the compounds stay within the size and returns the number of
+// report blocks.
+func rtcpSizeCheck(t *testing.T, rcs []*CtrlPacket, ssrc uint32, size int) (blocks int) {
+	for i, rc := range rcs {
+		if rc.InUse() > size {
+			t.Errorf("Compound %d size check failed. Limit: %d, got: %d\n", i, size, rc.InUse())
+		}
+		typ := rc.Type(0)
+		if (typ != RtcpSR && typ != RtcpRR) || rc.Ssrc(0) != ssrc {
+			t.Errorf("Compound %d starts with type %d, SSRC %x\n", i, typ, rc.Ssrc(0))
+		}
+		offset := (int(rc.Length(0)) + 1) * 4
+		if offset >= rc.InUse() || rc.Type(offset) != RtcpSdes {
+			t.Errorf("Compound %d SDES check failed\n", i)
+		}
+		blocks += rc.Count(0)
+	}
+	return
+}
+
+func TestRtcpMaxSize(t *testing.T) {
+	parseFlags()
+
+	rs, _ := closeSession(false)
+	out := rs.SsrcStreamOutForIndex(0)
+	out.SetSdesItem(SdesCname, "size@example.com")
+	out.sender = true
+	if rs.RtcpMaxSize() != defaultRtcpMaxSize {
+		t.Errorf("Default size check failed: %d\n", rs.RtcpMaxSize())
+	}
+	if rs.SetRtcpMaxSize(64) == nil || rs.SetRtcpMaxSize(defaultBufferSize+1) == nil {
+		t.Errorf("Size range check failed\n")
+	}
+
+	for _, size := range []int{0, 300} {
+		if err := rs.SetRtcpMaxSize(size); err != nil {
+			t.Errorf("SetRtcpMaxSize failed: %s\n", err)
+			return
+		}
+		rs.streamsIn = make(streamInMap)
+		for i := uint32(0); i < 70; i++ {
+			str := newSsrcStreamIn(&Address{}, 0x1000+i)
+			str.dataAfterLastReport = true
+			rs.streamsIn[i] = str
+		}
+		rc := rs.buildRtcpPkt(out, 70)
+		rcs := append([]*CtrlPacket{rc}, rs.buildRtcpOverflow(out, 70-rc.Count(0))...)
+		if blocks := rtcpSizeCheck(t, rcs, out.Ssrc(), rs.RtcpMaxSize()); blocks != 70 {
+			t.Errorf("Report block count check failed with size %d. Expected: 70, got: %d in %d compounds\n", size, blocks, len(rcs))
+		}
+		if size == 0 && (len(rcs) != 3 || rc.Count(0) != maxReportBlocks || rc.Type(0) != RtcpSR || rcs[1].Type(0) != RtcpRR) {
+			t.Errorf("Default split check failed. Compounds: %d, first count: %d\n", len(rcs), rc.Count(0))
+		}
+		for _, str := range rs.streamsIn {
+			if str.dataAfterLastReport {
+				t.Errorf("Unreported input stream check failed with size %d\n", size)
+				break
+			}
+		}
+		for _, rc := range rcs {
+			rc.FreePacket()
+		}
+	}
+
+	// A second sender that does not fit starts its own compound
+	second := rs.SsrcStreamOutForIndex(1)
+	second.SetSdesItem(SdesCname, "second@example.com")
+	second.sender = true
+	rs.SetRtcpMaxSize(minRtcpMaxSize)
+	rc := rs.buildRtcpPkt(out, 0)
+	if !rs.addSenderReport(second, rc) {
+		t.Errorf("Sender report check failed, SR fits\n")
+	}
+	if rs.addSenderReport(second, rc) {
+		t.Errorf("Sender report size check failed\n")
+	}
+	if rc.InUse() > minRtcpMaxSize {
+		t.Errorf("Sender report compound size: %d\n", rc.InUse())
+	}
+	rc.FreePacket()
+}
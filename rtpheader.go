@@ -0,0 +1,99 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+// RtpHeader holds the fields of a RTP packet header, RFC 3550 chapter 5.1.
+type RtpHeader struct {
+	Version     int
+	Padding     bool
+	Extension   bool // the extension bit, see DataPacket.Extension for the data
+	Marker      bool
+	PayloadType byte
+	Sequence    uint16
+	Timestamp   uint32
+	Ssrc        uint32
+	Csrc        []uint32
+}
+
+// Version returns the RTP version of the packet header, 2 for RFC 3550 packets.
+func (rp *DataPacket) Version() int {
+	if !rp.avail(1) {
+		return 0
+	}
+	return int(rp.buffer[0]&versionMask) >> 6
+}
+
+// Header returns the header fields of the packet.
+//
+// Other than the single field accessors, which return zero values for fields beyond the end of
+// a truncated packet, the method checks the whole packet structure: the version, the CSRC list,
+// the extension and the padding must fit into the packet.
+//
+func (rp *DataPacket) Header() (hdr RtpHeader, err error) {
+	if _, _, err = rp.layout(); err != nil {
+		return
+	}
+	if rp.Version() != 2 {
+		return hdr, Error("Not a RTP version 2 packet.")
+	}
+	hdr = RtpHeader{Version: rp.Version(), Padding: rp.Padding(), Extension: rp.ExtensionBit(), Marker: rp.Marker(),
+		PayloadType: rp.PayloadType(), Sequence: rp.Sequence(), Timestamp: rp.Timestamp(), Ssrc: rp.Ssrc(), Csrc: rp.CsrcList()}
+	return
+}
+
+// CheckedPayload returns the payload like Payload but reports why a malformed packet has no payload.
+func (rp *DataPacket) CheckedPayload() ([]byte, error) {
+	payOffset, payEnd, err := rp.layout()
+	if err != nil {
+		return nil, err
+	}
+	return rp.buffer[payOffset:payEnd], nil
+}
+
+// avail returns true if the packet holds at least n valid bytes.
+func (rp *DataPacket) avail(n int) bool {
+	return n <= rp.inUse && n <= len(rp.buffer)
+}
+
+// layout returns the offsets of the payload start and end in the buffer, or an error if the
+// header or the padding exceeds the packet.
+func (rp *DataPacket) layout() (payOffset, payEnd int, err error) {
+	if !rp.avail(rtpHeaderLength) {
+		return 0, 0, Error("Packet too short for a RTP header.")
+	}
+	payOffset = rtpHeaderLength + int(rp.CsrcCount())*4
+	if !rp.avail(payOffset) {
+		return 0, 0, Error("CSRC list exceeds the RTP packet.")
+	}
+	if rp.ExtensionBit() {
+		if !rp.avail(payOffset+4) || !rp.avail(payOffset+rp.ExtensionLength()) {
+			return 0, 0, Error("Header extension exceeds the RTP packet.")
+		}
+		payOffset += rp.ExtensionLength()
+	}
+	payEnd = rp.inUse
+	if rp.Padding() {
+		pad := int(rp.buffer[rp.inUse-1])
+		if pad == 0 || payOffset+pad > rp.inUse {
+			return 0, 0, Error("Padding exceeds the RTP packet.")
+		}
+		payEnd -= pad
+	}
+	return
+}
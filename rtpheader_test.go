@@ -0,0 +1,103 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func headerPacket() []byte {
+	rp := newDataPacket()
+	defer rp.FreePacket()
+	rp.SetPayloadType(8)
+	rp.SetSequence(4711)
+	rp.SetTimestamp(160)
+	rp.SetSsrc(0x01020304)
+	rp.SetMarker(true)
+	rp.SetCsrcList([]uint32{0x0a0a0a0a, 0x0b0b0b0b})
+	rp.SetExtension([]byte{0xbe, 0xde, 0, 1, 0x10, 0xff, 0, 0})
+	rp.SetPadding(true, 0)
+	rp.SetPayload([]byte{1, 2, 3, 4, 5})
+	return append([]byte(nil), rp.Buffer()[:rp.InUse()]...)
+}
+
+func TestRtpHeader(t *testing.T) {
+	parseFlags()
+
+	buf := headerPacket()
+	rp, _ := NewDataPacketFromBuffer(buf)
+	hdr, err := rp.Header()
+	if err != nil {
+		t.Errorf("Header failed: %v\n", err)
+		return
+	}
+	if hdr.Version != 2 || !hdr.Padding || !hdr.Extension || !hdr.Marker || hdr.PayloadType != 8 || hdr.Sequence != 4711 ||
+		hdr.Timestamp != 160 || hdr.Ssrc != 0x01020304 || len(hdr.Csrc) != 2 || hdr.Csrc[1] != 0x0b0b0b0b {
+		t.Errorf("Header field check failed: %+v\n", hdr)
+	}
+	if pay, err := rp.CheckedPayload(); err != nil || !bytes.Equal(pay, []byte{1, 2, 3, 4, 5}) {
+		t.Errorf("CheckedPayload check failed: %v, %v\n", pay, err)
+	}
+	rp.FreePacket()
+
+	// Every truncation of the header must fail the checks, no truncation must let an accessor panic.
+	hdrLen := rtpHeaderLength + 2*4 + 8
+	for n := 0; n < len(buf); n++ {
+		rp := new(DataPacket)
+		rp.buffer = buf[:n]
+		rp.inUse = n
+		if _, err := rp.Header(); n < hdrLen && err == nil {
+			t.Errorf("Header must fail for %d bytes\n", n)
+		}
+		if pay, err := rp.CheckedPayload(); n < hdrLen && (err == nil || pay != nil) {
+			t.Errorf("CheckedPayload must fail for %d bytes\n", n)
+		}
+		rp.Version()
+		rp.Padding()
+		rp.ExtensionBit()
+		rp.Marker()
+		rp.PayloadType()
+		rp.Sequence()
+		rp.Timestamp()
+		rp.Ssrc()
+		rp.CsrcList()
+		rp.Extension()
+		rp.Payload()
+	}
+	short := &DataPacket{RawPacket: RawPacket{buffer: buf[:10], inUse: 10}}
+	if short.Ssrc() != 0 || short.Sequence() != 0 || short.CsrcList() != nil {
+		t.Errorf("Truncated fixed header must return zero values\n")
+	}
+
+	bad := append([]byte(nil), buf...)
+	bad[0] = 0x40 | bad[0]&^versionMask
+	rp, _ = NewDataPacketFromBuffer(bad)
+	if _, err := rp.Header(); err == nil {
+		t.Errorf("Header must reject version 1\n")
+	}
+	rp.FreePacket()
+	bad[0] = buf[0]
+	bad[len(bad)-1] = byte(len(bad))
+	rp, _ = NewDataPacketFromBuffer(bad)
+	if _, err := rp.CheckedPayload(); err == nil || rp.Payload() != nil {
+		t.Errorf("Oversized padding must fail\n")
+	}
+	rp.FreePacket()
+}
@@ -0,0 +1,248 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+package rtp
+
+/*
+ * This source file contains the sampling of received packets for audits.
+ */
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SamplerConfig selects the received packets a Sampler copies.
+type SamplerConfig struct {
+	Every int     // sample one of Every packets, 0 for a time based sampler
+	Rate  float64 // samples per second of a time based sampler, used if Every is 0
+	Full  bool    // copy the complete RTP packets, false copies the RTP headers only
+	Queue int     // samples waiting for the callback, default 256, more are dropped
+}
+
+// PacketSample is the copy of a sampled packet.
+type PacketSample struct {
+	Time   time.Time
+	From   Address
+	Ctrl   bool   // a RTCP packet
+	Data   []byte // the copied bytes: the packet or its RTP header
+	Length int    // the length of the packet
+}
+
+// SampleFunc receives the samples of a Sampler.
+type SampleFunc func(s PacketSample)
+
+// Sampler copies some of a session's received packets to a callback, for example to audit a
+// long running production session. The sampler takes one of Every packets or the packets
+// that arrive at most Rate times per second. It copies the RTP headers or the complete RTP
+// packets, RTCP packets always completely, and hands the copies to the callback on its own
+// goroutine. If the callback falls behind the sampler drops samples instead of blocking the
+// receive path, see Stats.
+//
+// A session without sampler skips the sampling, see Session.SetSampler.
+//
+type Sampler struct {
+	every    uint32
+	interval int64 // nanoseconds between the samples of a time based sampler
+	full     bool
+	fn       SampleFunc
+
+	count   uint32 // accessed atomically
+	next    int64  // time of the next sample in nanoseconds, accessed atomically
+	sampled uint64 // accessed atomically
+	dropped uint64 // accessed atomically
+
+	samples   chan PacketSample
+	closeOnce sync.Once
+	done      chan bool
+}
+
+// NewSampler creates a sampler and starts its goroutine.
+//
+//   cfg - the selection of the packets
+//   fn  - receives the samples
+//
+func NewSampler(cfg SamplerConfig, fn SampleFunc) (*Sampler, error) {
+	if fn == nil {
+		return nil, Error("NewSampler: no sample function.")
+	}
+	if cfg.Every < 0 || (cfg.Every == 0 && cfg.Rate <= 0) {
+		return nil, Error("NewSampler: set Every or a positive Rate.")
+	}
+	if cfg.Queue <= 0 {
+		cfg.Queue = 256
+	}
+	sp := &Sampler{every: uint32(cfg.Every), full: cfg.Full, fn: fn, samples: make(chan PacketSample, cfg.Queue), done: make(chan bool)}
+	if cfg.Every == 0 {
+		sp.interval = int64(float64(time.Second) / cfg.Rate)
+	}
+	go sp.run()
+	return sp, nil
+}
+
+// Stats returns the number of samples the sampler took and the number of samples it dropped
+// because the callback fell behind.
+func (sp *Sampler) Stats() (sampled, dropped uint64) {
+	return atomic.LoadUint64(&sp.sampled), atomic.LoadUint64(&sp.dropped)
+}
+
+// Close stops the sampler after the callback received the queued samples. Remove the sampler
+// from the session before, see Session.SetSampler.
+func (sp *Sampler) Close() {
+	sp.closeOnce.Do(func() {
+		close(sp.samples)
+	})
+	<-sp.done
+}
+
+// SetSampler sets the sampler of the session's received packets, nil removes it. Set the
+// sampler before the session starts.
+//
+//   sp - the sampler, may be shared by sessions
+//
+func (rs *Session) SetSampler(sp *Sampler) {
+	rs.sampler = sp
+}
+
+// SampleFile writes samples to a file in the rtpdump format of the rtptools, which Wireshark
+// and rtpplay read. The file header uses the address of the first sample.
+type SampleFile struct {
+	mutex sync.Mutex
+	w     io.Writer
+	start time.Time
+	err   error
+}
+
+// NewSampleFile creates a sample file that writes to w. Use its Sample method as the
+// SampleFunc of a Sampler.
+func NewSampleFile(w io.Writer) *SampleFile {
+	return &SampleFile{w: w}
+}
+
+// Sample writes a sample to the file. After a write error the file ignores the samples, see
+// Err.
+func (sf *SampleFile) Sample(s PacketSample) {
+	sf.mutex.Lock()
+	defer sf.mutex.Unlock()
+	if sf.err != nil {
+		return
+	}
+	if sf.start.IsZero() {
+		sf.start = s.Time
+		if sf.err = sf.writeHeader(s); sf.err != nil {
+			return
+		}
+	}
+	var hdr [8]byte
+	binary.BigEndian.PutUint16(hdr[0:], uint16(len(hdr)+len(s.Data)))
+	if !s.Ctrl {
+		binary.BigEndian.PutUint16(hdr[2:], uint16(s.Length)) // 0 marks RTCP packets
+	}
+	binary.BigEndian.PutUint32(hdr[4:], uint32(s.Time.Sub(sf.start)/time.Millisecond))
+	if _, sf.err = sf.w.Write(hdr[:]); sf.err == nil {
+		_, sf.err = sf.w.Write(s.Data)
+	}
+}
+
+// Err returns the first write error of the file.
+func (sf *SampleFile) Err() error {
+	sf.mutex.Lock()
+	defer sf.mutex.Unlock()
+	return sf.err
+}
+
+// *** Local functions and methods.
+
+// offer samples the packet if it is selected. A nil sampler does nothing.
+func (sp *Sampler) offer(rp *RawPacket, ctrl bool) {
+	if sp == nil {
+		return
+	}
+	now := time.Now()
+	if sp.every > 0 {
+		if atomic.AddUint32(&sp.count, 1)%sp.every != 0 {
+			return
+		}
+	} else {
+		next := atomic.LoadInt64(&sp.next)
+		if now.UnixNano() < next || !atomic.CompareAndSwapInt64(&sp.next, next, now.UnixNano()+sp.interval) {
+			return
+		}
+	}
+	n := rp.inUse
+	if !ctrl && !sp.full {
+		n = rtpHeaderSize(rp)
+	}
+	s := PacketSample{Time: now, From: rp.fromAddr, Ctrl: ctrl, Data: append([]byte{}, rp.buffer[:n]...), Length: rp.inUse}
+	select {
+	case sp.samples <- s:
+		atomic.AddUint64(&sp.sampled, 1)
+	default:
+		atomic.AddUint64(&sp.dropped, 1)
+	}
+}
+
+func (sp *Sampler) run() {
+	defer close(sp.done)
+	for s := range sp.samples {
+		sp.fn(s)
+	}
+}
+
+// rtpHeaderSize returns the size of the RTP header with the CSRCs and the header extension,
+// at most the size of the packet.
+func rtpHeaderSize(rp *RawPacket) int {
+	if rp.inUse < rtpHeaderLength {
+		return rp.inUse
+	}
+	n := rtpHeaderLength + int(rp.buffer[0]&0x0f)*4
+	if rp.buffer[0]&extensionBit != 0 && n+4 <= rp.inUse {
+		n += 4 + int(binary.BigEndian.Uint16(rp.buffer[n+2:]))*4
+	}
+	if n > rp.inUse {
+		n = rp.inUse
+	}
+	return n
+}
+
+// writeHeader writes the rtpdump file header: the text line and the binary header with the
+// start time and the source address.
+func (sf *SampleFile) writeHeader(s PacketSample) error {
+	port := s.From.DataPort
+	if s.Ctrl {
+		port = s.From.CtrlPort
+	}
+	ip := s.From.IpAddr.To4()
+	if ip == nil {
+		ip = make([]byte, 4)
+	}
+	line := "#!rtpplay1.0 " + s.From.IpAddr.String() + "/" + strconv.Itoa(port) + "\n"
+	if _, err := io.WriteString(sf.w, line); err != nil {
+		return err
+	}
+	var hdr [16]byte
+	binary.BigEndian.PutUint32(hdr[0:], uint32(s.Time.Unix()))
+	binary.BigEndian.PutUint32(hdr[4:], uint32(s.Time.Nanosecond()/1000))
+	copy(hdr[8:12], ip)
+	binary.BigEndian.PutUint16(hdr[12:], uint16(port))
+	_, err := sf.w.Write(hdr[:])
+	return err
+}
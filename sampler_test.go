@@ -0,0 +1,148 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+package rtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func samplePacket(ext bool) *DataPacket {
+	rp := newDataPacket()
+	rp.SetSsrc(0x01020304)
+	rp.SetCsrcList([]uint32{7})
+	if ext {
+		rp.SetExtension([]byte{0xbe, 0xde, 0, 1, 0x10, 0xaa, 0, 0})
+	}
+	rp.SetPayload(make([]byte, 100))
+	rp.fromAddr = Address{net.IPv4(192, 0, 2, 1), 5004, 5005}
+	return rp
+}
+
+func TestSamplerEvery(t *testing.T) {
+	parseFlags()
+
+	if _, err := NewSampler(SamplerConfig{Every: 3}, nil); err == nil {
+		t.Errorf("NewSampler accepted a nil function\n")
+	}
+	if _, err := NewSampler(SamplerConfig{}, func(PacketSample) {}); err == nil {
+		t.Errorf("NewSampler accepted a config without selection\n")
+	}
+
+	var samples []PacketSample
+	sp, _ := NewSampler(SamplerConfig{Every: 3}, func(s PacketSample) { samples = append(samples, s) })
+	rp := samplePacket(true)
+	for i := 0; i < 9; i++ {
+		sp.offer(&rp.RawPacket, false)
+	}
+	sp.Close()
+	if len(samples) != 3 {
+		t.Errorf("1-in-3 sample count check failed: %d\n", len(samples))
+		return
+	}
+	s := samples[0]
+	if len(s.Data) != 12+4+8 || s.Length != rp.inUse || s.Ctrl || s.From.DataPort != 5004 {
+		t.Errorf("header sample check failed: %d bytes of %d\n", len(s.Data), s.Length)
+	}
+	if !bytes.Equal(s.Data, rp.buffer[:len(s.Data)]) {
+		t.Errorf("header sample content check failed\n")
+	}
+	if sampled, dropped := sp.Stats(); sampled != 3 || dropped != 0 {
+		t.Errorf("sampler stats check failed: %d, %d\n", sampled, dropped)
+	}
+	rp.FreePacket()
+}
+
+func TestSamplerRate(t *testing.T) {
+	parseFlags()
+
+	block, started := make(chan bool), make(chan bool, 4)
+	sp, _ := NewSampler(SamplerConfig{Rate: 1, Full: true, Queue: 1}, func(s PacketSample) {
+		started <- true
+		<-block
+	})
+	rp := samplePacket(false)
+	for i := 0; i < 100; i++ {
+		sp.offer(&rp.RawPacket, false)
+	}
+	<-started
+	if sampled, dropped := sp.Stats(); sampled != 1 || dropped != 0 {
+		t.Errorf("rate sampler check failed: %d, %d\n", sampled, dropped)
+	}
+
+	// A blocked callback drops the samples instead of blocking the receive path
+	atomic.StoreInt64(&sp.next, 0)
+	sp.offer(&rp.RawPacket, false)
+	atomic.StoreInt64(&sp.next, 0)
+	sp.offer(&rp.RawPacket, false)
+	if sampled, dropped := sp.Stats(); sampled != 2 || dropped != 1 {
+		t.Errorf("drop check failed: %d, %d\n", sampled, dropped)
+	}
+	close(block)
+	sp.Close()
+	rp.FreePacket()
+}
+
+func TestSampleFile(t *testing.T) {
+	parseFlags()
+
+	var buf bytes.Buffer
+	sf := NewSampleFile(&buf)
+	sp, _ := NewSampler(SamplerConfig{Every: 1}, sf.Sample)
+	rs := NewSession(new(captureWriter), new(teeConsumer))
+	rs.SetSampler(sp)
+
+	rc, _ := newCtrlPacket()
+	rc.inUse = 8
+	rc.fromAddr = Address{net.IPv4(192, 0, 2, 1), 5004, 5005}
+	rs.OnRecvCtrl(rc)
+	rp := samplePacket(false)
+	sp.offer(&rp.RawPacket, false)
+	rp.FreePacket()
+	rs.SetSampler(nil)
+	sp.Close()
+	if sf.Err() != nil {
+		t.Errorf("sample file write failed: %s\n", sf.Err())
+	}
+
+	line := "#!rtpplay1.0 192.0.2.1/5005\n"
+	data := buf.Bytes()
+	if !bytes.HasPrefix(data, []byte(line)) || len(data) != len(line)+16+8+8+8+16 {
+		t.Errorf("rtpdump file check failed: %d bytes\n%q\n", len(data), data)
+		return
+	}
+	data = data[len(line):]
+	if ip := net.IP(data[8:12]); !ip.Equal(net.IPv4(192, 0, 2, 1)) || binary.BigEndian.Uint16(data[12:]) != 5005 {
+		t.Errorf("rtpdump source check failed\n")
+	}
+	data = data[16:]
+	if binary.BigEndian.Uint16(data) != 16 || binary.BigEndian.Uint16(data[2:]) != 0 {
+		t.Errorf("rtpdump RTCP record check failed: % x\n", data[:8])
+	}
+	data = data[16:]
+	if binary.BigEndian.Uint16(data) != 8+16 || binary.BigEndian.Uint16(data[2:]) != 12+4+100 {
+		t.Errorf("rtpdump RTP record check failed: % x\n", data[:8])
+	}
+	if binary.BigEndian.Uint32(data[4:]) > uint32(time.Second/time.Millisecond) {
+		t.Errorf("rtpdump offset check failed\n")
+	}
+}
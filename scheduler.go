@@ -0,0 +1,292 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"container/heap"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// SpinThreshold is the remaining wait time below which WaitUntil and the Scheduler stop
+// sleeping on a timer and busy-wait (yielding the processor) until the deadline.
+//
+// Go's timers may fire a (few) millisecond(s) late if the process is loaded. Spinning for the
+// last part of the wait gives sub-millisecond accuracy at the cost of some CPU time. A value of
+// zero disables spinning.
+var SpinThreshold = 500 * time.Microsecond
+
+// WaitUntil blocks until the deadline or until the stop channel is closed or receives a value.
+//
+// The function returns false if it was stopped before the deadline. It uses the monotonic clock
+// reading of the deadline, thus changes of the wallclock do not affect the wait. The stop
+// channel may be nil.
+//
+func WaitUntil(deadline time.Time, stop <-chan bool) bool {
+	if d := time.Until(deadline) - SpinThreshold; d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return false
+		}
+	}
+	for time.Now().Before(deadline) {
+		select {
+		case <-stop:
+			return false
+		default:
+		}
+		runtime.Gosched()
+	}
+	return true
+}
+
+// Scheduler runs functions and sends RTP packets at scheduled times.
+//
+// One Scheduler can serve many streams. It keeps the scheduled items in a heap, sleeps on a
+// single timer until shortly before the next item is due and busy-waits for the remaining time,
+// see SpinThreshold. If several items are due the items of the higher priority traffic class
+// run first, see SetStreamClass, thus a video burst does not delay the audio packets. Items of
+// the same class run in the order of their due times, items that are due at the same time in
+// the order they were scheduled.
+// The Scheduler counts the queued RTP packets of each output stream, see QueueDepth, and
+// signals congested queues, see SetQueueThresholds.
+//
+type Scheduler struct {
+	mutex   sync.Mutex
+	items   schedHeap
+	counter uint64
+	dropped uint64
+	wake    chan bool
+	stop    chan bool
+	done    chan bool
+
+	depths    map[queueKey]int  // queued RTP packets per output stream
+	congested map[queueKey]bool // streams above the high threshold
+	high, low int               // see SetQueueThresholds
+}
+
+type schedItem struct {
+	at       time.Time
+	seq      uint64 // keeps the order of items with the same due time
+	fn       func()
+	deadline time.Time // if not zero the item is dropped if it cannot run before the deadline
+	drop     func()    // called instead of fn if the item is dropped, may be nil
+	rs       *Session  // the session of a RTP packet, nil for other items
+	ssrc     uint32    // the SSRC of a RTP packet
+	class    int       // the traffic class, orders the due items
+}
+
+type schedHeap []*schedItem
+
+func (h schedHeap) Len() int { return len(h) }
+func (h schedHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h schedHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *schedHeap) Push(x interface{}) { *h = append(*h, x.(*schedItem)) }
+func (h *schedHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return it
+}
+
+// maxUrgentScan limits the due items that urgent visits, an overloaded Scheduler thus keeps
+// the cost of an item bounded.
+const maxUrgentScan = 256
+
+// urgent returns the index of the due item that runs next, the earliest item of the highest
+// priority class.
+func (h schedHeap) urgent(now time.Time) int {
+	if len(h) == 0 || h[0].class == ClassAudio {
+		return 0 // the first item has the highest priority
+	}
+	best, visited := 0, 0
+	h.scanDue(0, now, &best, &visited)
+	return best
+}
+
+// scanDue visits the due items of the subheap at i. Children are never due before their
+// parent, thus the scan stops at the first item that is not due.
+func (h schedHeap) scanDue(i int, now time.Time, best, visited *int) {
+	if i >= len(h) || *visited >= maxUrgentScan || h[i].at.After(now) {
+		return
+	}
+	*visited++
+	if h[i].class < h[*best].class || (h[i].class == h[*best].class && h.Less(i, *best)) {
+		*best = i
+	}
+	h.scanDue(2*i+1, now, best, visited)
+	h.scanDue(2*i+2, now, best, visited)
+}
+
+// NewScheduler creates a Scheduler and starts its goroutine.
+func NewScheduler() *Scheduler {
+	sc := &Scheduler{wake: make(chan bool, 1), stop: make(chan bool), done: make(chan bool)}
+	go sc.run()
+	return sc
+}
+
+// Schedule runs fn at time at. The function runs on the Scheduler's goroutine, thus it
+// shall not block. If at is in the past the Scheduler runs fn as soon as possible.
+func (sc *Scheduler) Schedule(at time.Time, fn func()) {
+	sc.push(&schedItem{at: at, fn: fn})
+}
+
+// ScheduleClass runs fn at time at like Schedule. If fn is due together with other items the
+// class orders them, see Scheduler. Schedule uses ClassAudio, the highest priority.
+func (sc *Scheduler) ScheduleClass(at time.Time, class int, fn func()) {
+	sc.push(&schedItem{at: at, fn: fn, class: class})
+}
+
+// ScheduleDeadline runs fn at time at like Schedule, but only if the Scheduler can run it
+// before the deadline. Otherwise the Scheduler drops the item, counts it, and calls drop
+// instead of fn. Drop may be nil.
+func (sc *Scheduler) ScheduleDeadline(at, deadline time.Time, fn, drop func()) {
+	sc.push(&schedItem{at: at, fn: fn, deadline: deadline, drop: drop})
+}
+
+func (sc *Scheduler) push(it *schedItem) {
+	sc.mutex.Lock()
+	it.seq = sc.counter
+	heap.Push(&sc.items, it)
+	sc.counter++
+	first := sc.items[0].seq == sc.counter-1
+	ev := sc.queued(it)
+	sc.mutex.Unlock()
+	ev.send()
+
+	if first {
+		select {
+		case sc.wake <- true:
+		default:
+		}
+	}
+}
+
+// ScheduleData sends the RTP packet at time at via the session's WriteData and frees the
+// packet after sending. If the bandwidth budget of the session refuses the packet the
+// Scheduler holds it and tries again when the budget refilled, see SetBandwidthBudget.
+func (sc *Scheduler) ScheduleData(rs *Session, rp *DataPacket, at time.Time) {
+	sc.push(sc.dataItem(rs, rp, at, time.Time{}))
+}
+
+// ScheduleDataDeadline sends the RTP packet at time at like ScheduleData. If the packet
+// cannot be sent before the deadline, for example because the sending goroutine was descheduled
+// or the Scheduler is overloaded, the Scheduler drops it and counts it, see Dropped. Sending a
+// stale audio frame is usually worse than dropping it.
+func (sc *Scheduler) ScheduleDataDeadline(rs *Session, rp *DataPacket, at, deadline time.Time) {
+	sc.push(sc.dataItem(rs, rp, at, deadline))
+}
+
+// dataItem returns the item that sends a RTP packet. An item that the bandwidth budget refuses
+// goes back into the queue, its deadline still applies.
+func (sc *Scheduler) dataItem(rs *Session, rp *DataPacket, at, deadline time.Time) *schedItem {
+	it := &schedItem{at: at, deadline: deadline, drop: rp.FreePacket, rs: rs, ssrc: rp.Ssrc(), class: rs.packetClass(rp)}
+	it.fn = func() {
+		if _, err := rs.WriteData(rp); err == errBudget {
+			it.at = time.Now().Add(rs.budgetRetry(it.class, rp))
+			sc.push(it)
+			return
+		}
+		rp.FreePacket()
+	}
+	return it
+}
+
+// Dropped returns the number of items the Scheduler dropped because they missed their deadline.
+func (sc *Scheduler) Dropped() uint64 {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return sc.dropped
+}
+
+// Pending returns the number of scheduled items that did not yet run.
+func (sc *Scheduler) Pending() int {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return len(sc.items)
+}
+
+// Stop stops the Scheduler and drops all pending items. Stop waits until a running
+// item returned.
+func (sc *Scheduler) Stop() {
+	select {
+	case <-sc.stop:
+		return
+	default:
+	}
+	close(sc.stop)
+	<-sc.done
+}
+
+func (sc *Scheduler) run() {
+	defer close(sc.done)
+	for {
+		sc.mutex.Lock()
+		var next *schedItem
+		if len(sc.items) > 0 {
+			next = sc.items[0]
+		}
+		sc.mutex.Unlock()
+
+		if next == nil {
+			select {
+			case <-sc.wake:
+				continue
+			case <-sc.stop:
+				return
+			}
+		}
+		if d := time.Until(next.at) - SpinThreshold; d > 0 {
+			timer := time.NewTimer(d)
+			select {
+			case <-timer.C:
+			case <-sc.wake: // an earlier item may have been scheduled
+				timer.Stop()
+				continue
+			case <-sc.stop:
+				timer.Stop()
+				return
+			}
+		}
+		if !WaitUntil(next.at, sc.stop) {
+			return
+		}
+		sc.mutex.Lock()
+		if len(sc.items) == 0 || sc.items[0] != next {
+			// an earlier item arrived while spinning, re-evaluate
+			sc.mutex.Unlock()
+			continue
+		}
+		next = heap.Remove(&sc.items, sc.items.urgent(time.Now())).(*schedItem)
+		ev := sc.dequeued(next)
+		sc.mutex.Unlock()
+		ev.send()
+		sc.runItem(next)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	parseFlags()
+
+	sc := NewScheduler()
+	defer sc.Stop()
+
+	start := time.Now()
+	results := make(chan int, 10)
+	late := make(chan time.Duration, 10)
+
+	// schedule out of order, two items with the same time must keep their order
+	for _, n := range []int{4, 2, 3, 0, 1} {
+		n := n
+		at := start.Add(time.Duration(n/2*10+5) * time.Millisecond)
+		sc.Schedule(at, func() {
+			results <- n
+			late <- time.Since(at)
+		})
+	}
+	var order []int
+	for i := 0; i < 5; i++ {
+		select {
+		case n := <-results:
+			order = append(order, n)
+			if d := <-late; d > 5*time.Millisecond {
+				t.Errorf("Scheduler accuracy check failed. Item %d was late by %s\n", n, d)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Scheduler timeout, got only %d items\n", len(order))
+			return
+		}
+	}
+	expected := []int{0, 1, 2, 3, 4}
+	for i := range expected {
+		// items 0/1 and 2/3 share their due times and were scheduled in this order
+		if order[i] != expected[i] {
+			t.Errorf("Scheduler order check failed. Expected: %v, got: %v\n", expected, order)
+			break
+		}
+	}
+	if sc.Pending() != 0 {
+		t.Errorf("Scheduler pending check failed. Expected: 0, got: %d\n", sc.Pending())
+	}
+	// a blocking item delays the next items, the one with the short deadline is dropped
+	now := time.Now()
+	ran := make(chan string, 3)
+	sc.Schedule(now.Add(5*time.Millisecond), func() { time.Sleep(30 * time.Millisecond) })
+	sc.ScheduleDeadline(now.Add(6*time.Millisecond), now.Add(15*time.Millisecond),
+		func() { ran <- "late" }, func() { ran <- "dropped" })
+	sc.ScheduleDeadline(now.Add(7*time.Millisecond), now.Add(time.Second), func() { ran <- "ok" }, nil)
+	for _, expect := range []string{"dropped", "ok"} {
+		select {
+		case got := <-ran:
+			if got != expect {
+				t.Errorf("Scheduler deadline check failed. Expected: %s, got: %s\n", expect, got)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Scheduler deadline timeout\n")
+			return
+		}
+	}
+	if sc.Dropped() != 1 {
+		t.Errorf("Scheduler dropped count check failed. Expected: 1, got: %d\n", sc.Dropped())
+	}
+	stop := make(chan bool)
+	close(stop)
+	if WaitUntil(time.Now().Add(time.Second), stop) {
+		t.Errorf("WaitUntil stop check failed\n")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the SDP media description of a session, RFC 4566 chapter 5.14.
+ */
+
+import (
+	"strconv"
+	"strings"
+)
+
+// SdpMedia returns the SDP media description of the session for an offer or answer: the "m="
+// line with the session's RTP profile, the rtpmap attributes of the payload types, the rtcp-fb
+// attributes of a feedback profile and its rtcp-rsize attribute if the session sends reduced
+// size RTCP, see SetRtcpReducedSize, the extmap attributes of the registered header
+// extensions, the ptime attribute of a strict packet time, and the ts-refclk and mediaclk
+// attributes of a reference clock. The lines end with CRLF. The keys of the secure profiles
+// are not part of the description, the key management, for example MIKEY, adds them.
+//
+//   port - the RTP data port
+//   pts  - the payload types in order of preference, all of the same media type
+//
+func (rs *Session) SdpMedia(port int, pts []byte) (string, error) {
+	if len(pts) == 0 {
+		return "", Error("SdpMedia: no payload types.")
+	}
+	media := 0
+	var fmts, attrs strings.Builder
+	for _, pt := range pts {
+		pf := PayloadFormatMap[int(pt)]
+		if pf == nil {
+			return "", Error("SdpMedia: unknown payload type " + strconv.Itoa(int(pt)) + ".")
+		}
+		if media == 0 {
+			media = pf.MediaType
+		} else if pf.MediaType != media {
+			return "", Error("SdpMedia: payload types of different media types.")
+		}
+		fmts.WriteString(" " + strconv.Itoa(int(pt)))
+		attrs.WriteString("a=rtpmap:" + strconv.Itoa(int(pt)) + " " + pf.Name + "/" + strconv.Itoa(pf.ClockRate))
+		if pf.Channels > 1 {
+			attrs.WriteString("/" + strconv.Itoa(pf.Channels))
+		}
+		attrs.WriteString("\r\n")
+	}
+	var mediaName string
+	switch media {
+	case Audio:
+		mediaName = "audio"
+	case Video:
+		mediaName = "video"
+	default:
+		return "", Error("SdpMedia: payload types without an audio or video media type.")
+	}
+
+	profile := rs.RtpProfile()
+	if hasFeedback(profile) {
+		attrs.WriteString("a=rtcp-fb:* nack\r\n")
+		attrs.WriteString("a=rtcp-fb:* nack pli\r\n")
+		if rs.RtcpReducedSize() {
+			attrs.WriteString("a=rtcp-rsize\r\n")
+		}
+	}
+	for _, ext := range rs.ExtensionMap().registered() {
+		attrs.WriteString("a=extmap:" + strconv.Itoa(int(ext.id)) + " " + ext.uri + "\r\n")
+	}
+	attrs.WriteString(rs.sdpPtime(pts))
+	attrs.WriteString(rs.sdpRefClock())
+	return "m=" + mediaName + " " + strconv.Itoa(port) + " " + RtpProfileName(profile) + fmts.String() + "\r\n" + attrs.String(), nil
+}
+
+type extensionEntry struct {
+	id  byte
+	uri string
+}
+
+// registered returns the registered header extensions ordered by their IDs.
+func (em *ExtensionMap) registered() (exts []extensionEntry) {
+	em.mutex.RLock()
+	defer em.mutex.RUnlock()
+	for id := 1; id < 256; id++ {
+		if uri, ok := em.uris[byte(id)]; ok {
+			exts = append(exts, extensionEntry{byte(id), uri})
+		}
+	}
+	return
+}
@@ -0,0 +1,67 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSdpMedia(t *testing.T) {
+	parseFlags()
+
+	PayloadFormatMap[111] = &PayloadFormat{TypeNumber: 111, MediaType: Audio, ClockRate: 48000, Channels: 2, Name: "opus"}
+	defer delete(PayloadFormatMap, 111)
+
+	rs := NewSession(new(captureWriter), new(teeConsumer))
+	rs.SetRtpProfile(RtpProfileSavpf)
+	rs.ExtensionMap().Register(3, ExtSdesMid)
+	rs.ExtensionMap().Register(1, ExtAudioLevel)
+	media, err := rs.SdpMedia(5220, []byte{111, 0})
+	expected := "m=audio 5220 RTP/SAVPF 111 0\r\n" +
+		"a=rtpmap:111 opus/48000/2\r\n" +
+		"a=rtpmap:0 PCMU/8000\r\n" +
+		"a=rtcp-fb:* nack\r\n" +
+		"a=rtcp-fb:* nack pli\r\n" +
+		"a=extmap:1 " + ExtAudioLevel + "\r\n" +
+		"a=extmap:3 " + ExtSdesMid + "\r\n"
+	if err != nil || media != expected {
+		t.Errorf("SDP media check failed:\n%s\n", media)
+	}
+
+	rs.SetRtcpReducedSize(true)
+	if media, _ = rs.SdpMedia(5220, []byte{0}); !strings.Contains(media, "a=rtcp-fb:* nack pli\r\na=rtcp-rsize\r\n") {
+		t.Errorf("SDP media rtcp-rsize check failed:\n%s\n", media)
+	}
+
+	rs = NewSession(new(captureWriter), new(teeConsumer))
+	if media, _ = rs.SdpMedia(5230, []byte{8}); media != "m=audio 5230 RTP/AVP 8\r\na=rtpmap:8 PCMA/8000\r\n" {
+		t.Errorf("SDP media of the default profile check failed:\n%s\n", media)
+	}
+	rs.SetRtpProfile(RtpProfileAvp)
+	if media, _ = rs.SdpMedia(5230, []byte{8}); media != "m=audio 5230 RTP/AVP 8\r\na=rtpmap:8 PCMA/8000\r\n" {
+		t.Errorf("SDP media without feedback check failed:\n%s\n", media)
+	}
+	if _, err = rs.SdpMedia(5230, []byte{0, 96}); err == nil {
+		t.Errorf("SdpMedia accepted audio and video payload types\n")
+	}
+	if _, err = rs.SdpMedia(5230, []byte{55}); err == nil {
+		t.Errorf("SdpMedia accepted an unknown payload type\n")
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+package rtp
+
+/*
+ * This source file contains the introspection and the flush control of the Scheduler's send
+ * queue.
+ */
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// queueKey identifies the output stream of a queued RTP packet.
+type queueKey struct {
+	rs   *Session
+	ssrc uint32
+}
+
+// queueEvent is a threshold event of a stream's queue, code 0 if there is none.
+type queueEvent struct {
+	code int
+	key  queueKey
+}
+
+// QueueDepth returns the number of the output stream's RTP packets that wait in the scheduler,
+// see ScheduleData and ScheduleDataDeadline.
+//
+//   rs          - the session of the stream
+//   streamIndex - the index of the output stream as returned by NewSsrcStreamOut
+//
+func (sc *Scheduler) QueueDepth(rs *Session, streamIndex uint32) int {
+	str := rs.SsrcStreamOutForIndex(streamIndex)
+	if str == nil {
+		return 0
+	}
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return sc.depths[queueKey{rs, str.Ssrc()}]
+}
+
+// SetQueueThresholds sets the thresholds of the queue depth events. If the queue of an
+// output stream grows to high packets the session of the stream sends a SendQueueHigh event,
+// if it then shrinks to low packets a SendQueueLow event. A video sender that sees
+// SendQueueHigh drops its stale frames, see ClearStream, and lowers its rate. A high
+// threshold of 0 switches the events off.
+//
+//   high - the depth that signals congestion
+//   low  - the depth that signals the end of the congestion, less than high
+//
+func (sc *Scheduler) SetQueueThresholds(high, low int) error {
+	if high < 0 || low < 0 || (high > 0 && low >= high) {
+		return Error("SetQueueThresholds: the low threshold must be less than the high threshold.")
+	}
+	sc.mutex.Lock()
+	sc.high, sc.low = high, low
+	if high == 0 {
+		sc.congested = nil
+	}
+	sc.mutex.Unlock()
+	return nil
+}
+
+// Flush runs all scheduled items now, in the order of their due times, on the calling
+// goroutine. Items with a passed deadline are dropped. The method returns the number of items
+// it ran or dropped.
+func (sc *Scheduler) Flush() int {
+	return sc.runNow(sc.take(func(it *schedItem) bool { return true }))
+}
+
+// FlushStream sends the queued RTP packets of an output stream now, in the order of their due
+// times, on the calling goroutine. It returns the number of packets it sent or dropped.
+//
+//   rs          - the session of the stream
+//   streamIndex - the index of the output stream as returned by NewSsrcStreamOut
+//
+func (sc *Scheduler) FlushStream(rs *Session, streamIndex uint32) int {
+	return sc.runNow(sc.takeStream(rs, streamIndex))
+}
+
+// Clear drops all scheduled items, the Scheduler calls their drop functions and frees the
+// queued RTP packets. Dropped does not count them. The method returns the number of dropped
+// items.
+func (sc *Scheduler) Clear() int {
+	return dropNow(sc.take(func(it *schedItem) bool { return true }))
+}
+
+// ClearStream drops the queued RTP packets of an output stream and frees them, for example the
+// stale frames of a congested video sender. It returns the number of dropped packets.
+//
+//   rs          - the session of the stream
+//   streamIndex - the index of the output stream as returned by NewSsrcStreamOut
+//
+func (sc *Scheduler) ClearStream(rs *Session, streamIndex uint32) int {
+	return dropNow(sc.takeStream(rs, streamIndex))
+}
+
+// *** Local functions and methods.
+
+// queued counts a queued RTP packet and returns the event of its stream. The caller holds
+// mutex.
+func (sc *Scheduler) queued(it *schedItem) (ev queueEvent) {
+	if it.rs == nil {
+		return
+	}
+	key := queueKey{it.rs, it.ssrc}
+	if sc.depths == nil {
+		sc.depths = make(map[queueKey]int)
+	}
+	sc.depths[key]++
+	if sc.high > 0 && sc.depths[key] >= sc.high && !sc.congested[key] {
+		if sc.congested == nil {
+			sc.congested = make(map[queueKey]bool)
+		}
+		sc.congested[key] = true
+		ev = queueEvent{SendQueueHigh, key}
+	}
+	return
+}
+
+// dequeued counts a RTP packet that left the queue and returns the event of its stream. The
+// caller holds mutex.
+func (sc *Scheduler) dequeued(it *schedItem) (ev queueEvent) {
+	if it.rs == nil {
+		return
+	}
+	key := queueKey{it.rs, it.ssrc}
+	depth := sc.depths[key] - 1
+	if depth <= 0 {
+		delete(sc.depths, key)
+	} else {
+		sc.depths[key] = depth
+	}
+	if sc.congested[key] && depth <= sc.low {
+		delete(sc.congested, key)
+		ev = queueEvent{SendQueueLow, key}
+	}
+	return
+}
+
+// take removes the items that match from the queue and returns them in the order of their due
+// times.
+func (sc *Scheduler) take(match func(it *schedItem) bool) (taken []*schedItem) {
+	var events []queueEvent
+	sc.mutex.Lock()
+	kept := sc.items[:0]
+	for _, it := range sc.items {
+		if !match(it) {
+			kept = append(kept, it)
+			continue
+		}
+		taken = append(taken, it)
+		if ev := sc.dequeued(it); ev.code != 0 {
+			events = append(events, ev)
+		}
+	}
+	for i := len(kept); i < len(sc.items); i++ {
+		sc.items[i] = nil
+	}
+	sc.items = kept
+	heap.Init(&sc.items)
+	sc.mutex.Unlock()
+
+	for _, ev := range events {
+		ev.send()
+	}
+	sort.Slice(taken, func(i, j int) bool { return schedHeap(taken).Less(i, j) })
+	select {
+	case sc.wake <- true: // the first item may have changed
+	default:
+	}
+	return
+}
+
+// takeStream removes the queued RTP packets of an output stream.
+func (sc *Scheduler) takeStream(rs *Session, streamIndex uint32) []*schedItem {
+	str := rs.SsrcStreamOutForIndex(streamIndex)
+	if str == nil {
+		return nil
+	}
+	ssrc := str.Ssrc()
+	return sc.take(func(it *schedItem) bool { return it.rs == rs && it.ssrc == ssrc })
+}
+
+// runNow runs the items on the calling goroutine.
+func (sc *Scheduler) runNow(items []*schedItem) int {
+	for _, it := range items {
+		sc.runItem(it)
+	}
+	return len(items)
+}
+
+// runItem runs an item that left the queue, or drops it if its deadline passed.
+func (sc *Scheduler) runItem(it *schedItem) {
+	if !it.deadline.IsZero() && time.Now().After(it.deadline) {
+		sc.mutex.Lock()
+		sc.dropped++
+		sc.mutex.Unlock()
+		if it.drop != nil {
+			it.drop()
+		}
+		return
+	}
+	it.fn()
+}
+
+// dropNow calls the drop functions of the items.
+func dropNow(items []*schedItem) int {
+	for _, it := range items {
+		if it.drop != nil {
+			it.drop()
+		}
+	}
+	return len(items)
+}
+
+// send sends the event to the session of the stream.
+func (ev queueEvent) send() {
+	if ev.code == 0 {
+		return
+	}
+	rs := ev.key.rs
+	rs.streamsMapMutex.Lock()
+	str, idx, ok := rs.lookupSsrcMapOut(ev.key.ssrc)
+	rs.streamsMapMutex.Unlock()
+	if ok {
+		rs.sendStreamCtrlEvent(ev.code, str, ev.key.ssrc, idx)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+package rtp
+
+import (
+	"testing"
+	"time"
+)
+
+// queueEvents returns the SendQueue events waiting in the channel.
+func queueEvents(ch CtrlEventChan) (events []*CtrlEvent) {
+	for {
+		select {
+		case evs := <-ch:
+			for _, ev := range evs {
+				if ev.EventType == SendQueueHigh || ev.EventType == SendQueueLow {
+					events = append(events, ev)
+				}
+			}
+		default:
+			return
+		}
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	parseFlags()
+
+	rs, ct := drainedSession(t)
+	events := rs.CreateCtrlEventChan()
+	sc := NewScheduler()
+	defer sc.Stop()
+	if err := sc.SetQueueThresholds(2, 2); err == nil {
+		t.Errorf("SetQueueThresholds accepted low = high\n")
+	}
+	sc.SetQueueThresholds(3, 1)
+
+	later := time.Now().Add(time.Hour)
+	for i := 0; i < 4; i++ {
+		sc.ScheduleData(rs, rs.NewDataPacketForStream(0, uint32(i*160)), later.Add(time.Duration(i)*time.Millisecond))
+	}
+	for i := 0; i < 2; i++ {
+		sc.ScheduleData(rs, rs.NewDataPacketForStream(1, uint32(i*160)), later)
+	}
+	ran := make(chan bool, 1)
+	sc.Schedule(later, func() { ran <- true })
+	if d0, d1 := sc.QueueDepth(rs, 0), sc.QueueDepth(rs, 1); d0 != 4 || d1 != 2 || sc.Pending() != 7 {
+		t.Errorf("queue depth check failed: %d, %d, %d\n", d0, d1, sc.Pending())
+	}
+	evs := queueEvents(events)
+	if len(evs) != 1 || evs[0].EventType != SendQueueHigh || evs[0].Index != 0 || evs[0].Ssrc != 0x01020304 {
+		t.Errorf("SendQueueHigh check failed: %v\n", evs)
+	}
+
+	if n := sc.ClearStream(rs, 0); n != 4 || sc.QueueDepth(rs, 0) != 0 {
+		t.Errorf("ClearStream check failed: %d, %d\n", n, sc.QueueDepth(rs, 0))
+	}
+	evs = queueEvents(events)
+	if len(evs) != 1 || evs[0].EventType != SendQueueLow {
+		t.Errorf("SendQueueLow check failed: %v\n", evs)
+	}
+
+	if n := sc.FlushStream(rs, 1); n != 2 || len(ct.captureWriter.data) != 2 || sc.QueueDepth(rs, 1) != 0 {
+		t.Errorf("FlushStream check failed: %d, %d packets sent\n", n, len(ct.captureWriter.data))
+	}
+	if sc.Pending() != 1 {
+		t.Errorf("pending check failed: %d\n", sc.Pending())
+	}
+	if n := sc.Flush(); n != 1 || len(ran) != 1 {
+		t.Errorf("Flush check failed: %d\n", n)
+	}
+	sc.ScheduleData(rs, rs.NewDataPacketForStream(0, 0), later)
+	if n := sc.Clear(); n != 1 || sc.Pending() != 0 || sc.QueueDepth(rs, 0) != 0 {
+		t.Errorf("Clear check failed: %d\n", n)
+	}
+}
@@ -23,17 +23,20 @@ package rtp
  */
 
 import (
+	"crypto/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Session contols and manages the resources and actions of a RTP session.
 //
 type Session struct {
-	RtcpTransmission        // Data structure to control and manage RTCP reports.
-	MaxNumberOutStreams int // Applications may set this to increase the number of supported output streams
-	MaxNumberInStreams  int // Applications may set this to increase the number of supported input streams
+	RtcpTransmission         // Data structure to control and manage RTCP reports.
+	MaxNumberOutStreams int  // Applications may set this to increase the number of supported output streams
+	MaxNumberInStreams  int  // Applications may set this to increase the number of supported input streams
+	RelaxedOrdering     bool // Applications may set this to drop the in-order delivery of packets per SSRC, see OnRecvData
 
 	dataReceiveChan DataReceiveChan
 	ctrlEventChan   CtrlEventChan
@@ -43,6 +46,70 @@ type Session struct {
 	streamsIn       streamInMap
 	remotes         remoteMap
 	conflicts       conflictMap
+	removedStreams  []uint32     // SSRCs of input streams RemoveInputStream handed to the RTCP service
+	remotesMutex    sync.RWMutex // synchronize changes of remotes with the writers
+
+	sdesPrivacy sdesPrivacy
+
+	rtxPayloadTypes map[byte]byte             // RTX payload type to the payload type of the original packets
+	rtxSsrcs        map[uint32]uint32         // RTX SSRC to the SSRC of the primary stream
+	nackGenerators  map[uint32]*NackGenerator // input SSRC to its running NACK generator
+
+	role        int // see SetRole
+	parseMode   int // see SetParseMode
+	diagnostics parseDiagnostics
+
+	leaving    uint32 // 1 while the session reconsiders its BYE, accessed atomically
+	byeMembers uint32 // BYE packets received while leaving plus one, accessed atomically
+
+	rtcpMaxSize    uint32 // see SetRtcpMaxSize, 0 selects the default, accessed atomically
+	inferClockRate bool   // see SetClockRateInference
+
+	ssrcPolicy   int          // see SetSsrcPolicy
+	refClock     *refClock    // nil without a reference clock, see SetReferenceClock
+	strictPtime  *strictPtime // nil without a strict packet time, see SetAes67Profile
+	rawUncounted bool         // see SetRawCounting
+	delayWindow  int          // see SetDelayEstimation, 0 if off
+
+	profiler  *Profiler        // nil if profiling is off
+	sampler   *Sampler         // nil without packet sampling
+	speakers  *SpeakerDetector // nil if speaker detection is off
+	conceal   *Concealer       // nil if the session doesn't conceal losses
+	cryptor   PayloadCryptor   // nil without end-to-end encryption of the payloads
+	srChecker *SrChecker       // nil if the session doesn't check the sender reports
+
+	inputContext InputContextFunc // nil if new input streams have no context
+
+	originsMutex sync.Mutex
+	enrich       SourceEnrichFunc         // nil without enrichment of the source addresses
+	origins      map[string]*SourceOrigin // cached results of enrich, nil for unknown addresses
+
+	admissionMutex  sync.Mutex
+	admission       SenderAdmission           // nil accepts all senders, see SetSenderAdmission
+	ignored         map[uint32]*IgnoredSender // the counters of the ignored senders
+	ignoredOverflow uint64                    // ignored packets of the senders beyond maxIgnoredSenders
+
+	budgetMutex sync.Mutex
+	budget      *bandwidthBudget // nil without a bandwidth budget, see SetBandwidthBudget
+
+	qosMutex      sync.Mutex
+	streamClasses map[uint32]int                 // the classes of the output streams, see SetStreamClass
+	classOpts     [trafficClasses]*SocketOptions // the TOS bytes of the classes, see SetClassDscp
+
+	fbMutex sync.Mutex
+	fb      feedbackState // profile and early feedback timing, guarded by fbMutex
+
+	gapHandler GapHandler // nil if the application uses the control events only
+
+	quirks         int         // interoperability quirks, see SetQuirks
+	quirkCounts    QuirkCounts // accessed atomically
+	rtcpLatched    bool        // the remote rtcpLatchIndex was latched from a RTCP packet of rtcpLatchSsrc, guarded by remotesMutex
+	rtcpLatchSsrc  uint32
+	rtcpLatchIndex uint32
+	ctrlRelatch    bool // follow the new control addresses of known sources, see SetCtrlRelatch, guarded by remotesMutex
+
+	hostsMutex  sync.Mutex
+	remoteHosts map[uint32]*remoteHost // remotes added with AddRemoteHost, guarded by hostsMutex
 
 	activeSenders,
 	streamOutIndex,
@@ -50,6 +117,12 @@ type Session struct {
 	remoteIndex,
 	conflictIndex uint32
 
+	payloadFilter    map[byte]bool // accepted payload types of input streams, nil accepts all
+	payloadTypeDrops uint32
+	sourceVerifier   SourceVerifier // verifies new sources, nil accepts all
+	extensionMap     *ExtensionMap
+	feedback         *FeedbackRouter
+
 	weSent            bool // is true if an output stream sent some RTP data
 	rtcpServiceActive bool // true if an input stream received RTP packets after last RR
 	rtcpCtrlChan      rtcpCtrlChan
@@ -75,10 +148,16 @@ type Address struct {
 // over the slice and select the events that it may process.
 //
 type CtrlEvent struct {
-	EventType int    // Either a Stream event or a Rtcp* packet type event, e.g. RtcpSR, RtcpRR, RtcpSdes, RtcpBye
-	Ssrc      uint32 // the input stream's SSRC
-	Index     uint32 // and its index
-	Reason    string // Resaon string if it was available, empty otherwise
+	EventType   int                // Either a Stream event or a Rtcp* packet type event, e.g. RtcpSR, RtcpRR, RtcpSdes, RtcpBye
+	Ssrc        uint32             // the input stream's SSRC
+	Index       uint32             // and its index
+	Reason      string             // Resaon string if it was available, empty otherwise
+	Gap         *SequenceGap       // the missing packets of a SequenceGapData event, nil otherwise
+	Discrepancy *SrDiscrepancy     // the mismatch of a SrInconsistentCtrl event, nil otherwise
+	PtChange    *PayloadTypeChange // the switch of a PayloadTypeChanged event, nil otherwise
+	AddrChange  *CtrlAddressChange // the addresses of a RemoteAddressChangedCtrl event, nil otherwise
+	Packet      RtcpPacket         // the parsed RTCP packet of a Rtcp* packet type event, nil otherwise
+	Context     StreamContext      // the application's context of the stream, see SsrcStream.SetContext
 }
 
 // Use a channel to signal if the transports are really closed.
@@ -119,6 +198,21 @@ const (
 	WrongStreamStatusCtrl            // Received RTCP packet for an inactive stream
 	StreamCollisionLoopData          // Detected a collision or loop processing an RTP packet
 	StreamCollisionLoopCtrl          // Detected a collision or loop processing an RTCP packet
+	WrongPayloadTypeData             // Dropped RTP packet because the payload type filter does not accept it
+	DuplicateData                    // Dropped RTP packet because the input stream already received it
+	StreamReset                      // The remote sender restarted (new sequence numbers or timestamp offset), the input stream reset its statistics
+	SourceRejectedData               // The source verifier rejected the new source of an RTP packet
+	SourceRejectedCtrl               // The source verifier rejected the new source of an RTCP packet
+	RtxDroppedData                   // Dropped RTX packet without a primary stream or original sequence number
+	ActiveSpeakerChanged             // The SpeakerDetector switched to a new dominant speaker
+	SequenceGapData                  // A RTP packet arrived after missing packets, see SequenceGap
+	DecryptFailedData                // Dropped RTP packet because the PayloadCryptor could not decrypt it
+	SrInconsistentCtrl               // The counts of a sender report don't match the received packets, see SrChecker
+	PayloadTypeChanged               // The remote sender switched the payload type of the input stream, see PayloadTypeChange
+	SendQueueHigh                    // The scheduler's queue of the output stream reached the high threshold, see Scheduler.SetQueueThresholds
+	SendQueueLow                     // The scheduler's queue of the output stream shrank to the low threshold
+	SenderIgnoredData                // The sender admission ignored the first RTP packet of a sender, see SetSenderAdmission
+	RemoteAddressChangedCtrl         // RTCP of a known input stream arrived from a new address, see SetCtrlRelatch
 )
 
 // The receiver transports return these vaules via the TransportEnd channel when they are
@@ -153,6 +247,9 @@ func NewSession(tpw TransportWrite, tpr TransportRecv) *Session {
 
 	rs.transportEnd = make(TransportEnd, 2)
 	rs.rtcpCtrlChan = make(rtcpCtrlChan, 1)
+	rs.extensionMap = NewExtensionMap()
+	rs.feedback = newFeedbackRouter()
+	rs.feedback.Register(RtcpRtpfb, RtpfbNack, func(msg *FeedbackMessage) { rs.handleNack(msg.Media, msg.Fci) })
 
 	tpr.SetCallUpper(rs)
 	tpr.SetEndChannel(rs.transportEnd)
@@ -160,6 +257,24 @@ func NewSession(tpw TransportWrite, tpr TransportRecv) *Session {
 	return rs
 }
 
+// NewSessionAutoPorts creates a new RTP session with a UDP transport on a free port pair.
+//
+// The function binds the ports immediately, the application doesn't need to guess free ports
+// and retry. The transport's LocalPorts method returns the selected ports, for example to
+// announce them in SDP.
+//
+//   addr    - the local IP address
+//   minPort - the lowest port number for the RTP data port, 0 lets the operating system select
+//   maxPort - the highest port number for the RTP data port, ignored if minPort is 0
+//
+func NewSessionAutoPorts(addr *net.IPAddr, minPort, maxPort int) (*Session, *TransportUDP, error) {
+	tp, err := NewTransportUDPAutoPorts(addr, minPort, maxPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewSession(tp, tp), tp, nil
+}
+
 // AddRemote adds the address and RTP port number of an additional remote peer.
 //
 // The port number must be even. The socket with the even port number sends and receives
@@ -171,6 +286,8 @@ func (rs *Session) AddRemote(remote *Address) (index uint32, err error) {
 	//	if (remote.DataPort & 0x1) == 0x1 {
 	//		return 0, Error("RTP data port number is not an even number.")
 	//	}
+	rs.remotesMutex.Lock()
+	defer rs.remotesMutex.Unlock()
 	rs.remotes[rs.remoteIndex] = remote
 	index = rs.remoteIndex
 	rs.remoteIndex++
@@ -180,7 +297,71 @@ func (rs *Session) AddRemote(remote *Address) (index uint32, err error) {
 // RemoveRemote removes the address at the specified index.
 //
 func (rs *Session) RemoveRemote(index uint32) {
+	rs.remotesMutex.Lock()
+	defer rs.remotesMutex.Unlock()
 	delete(rs.remotes, index)
+	rs.stopRemoteHost(index)
+}
+
+// AddRemoteHost adds a remote peer by host name and re-resolves the name periodically.
+//
+// Long lived sessions to DNS load balanced media relays shall follow DNS changes instead of
+// sending to the first resolved address forever. The session resolves the host name now and
+// then every ttl. If the name still resolves to the current address the session keeps it,
+// otherwise it replaces the remote's address, preferring the current address family. If a
+// resolution fails the session keeps the current address. The Go resolver does not report the
+// DNS record's TTL, thus the application sets the interval, usually the TTL of the record.
+//
+//   host - the host name of the remote peer
+//   port - the RTP data port, the RTCP control port is the next port
+//   ttl  - the interval to re-resolve the host name, must be positive
+//
+func (rs *Session) AddRemoteHost(host string, port int, ttl time.Duration) (index uint32, err error) {
+	if ttl <= 0 {
+		return 0, Error("AddRemoteHost: the interval must be positive.")
+	}
+	h := &remoteHost{host: host, ttl: ttl, stop: make(chan bool), lookup: lookupIP}
+	ip, err := resolveRemoteHost(h.lookup, host, nil)
+	if err != nil {
+		return 0, err
+	}
+	rs.remotesMutex.Lock()
+	index = rs.remoteIndex
+	rs.remotes[index] = &Address{ip, port, port + 1}
+	rs.remoteIndex++
+	rs.hostsMutex.Lock()
+	if rs.remoteHosts == nil {
+		rs.remoteHosts = make(map[uint32]*remoteHost)
+	}
+	rs.remoteHosts[index] = h
+	rs.hostsMutex.Unlock()
+	rs.remotesMutex.Unlock()
+
+	go rs.followRemoteHost(index, h)
+	return index, nil
+}
+
+// RemoteHost returns the host name of the remote at the index, empty if the application added
+// the remote by address.
+func (rs *Session) RemoteHost(index uint32) string {
+	rs.hostsMutex.Lock()
+	defer rs.hostsMutex.Unlock()
+	if h, ok := rs.remoteHosts[index]; ok {
+		return h.host
+	}
+	return ""
+}
+
+// remoteList returns the current remotes. The writers send without holding remotesMutex, thus
+// a blocking transport does not block changes of the remotes.
+func (rs *Session) remoteList() []*Address {
+	rs.remotesMutex.RLock()
+	defer rs.remotesMutex.RUnlock()
+	list := make([]*Address, 0, len(rs.remotes))
+	for _, remote := range rs.remotes {
+		list = append(list, remote)
+	}
+	return list
 }
 
 // NewOutputStream creates a new RTP output stream and returns its index.
@@ -201,6 +382,9 @@ func (rs *Session) RemoveRemote(index uint32) {
 //
 func (rs *Session) NewSsrcStreamOut(own *Address, ssrc uint32, sequenceNo uint16) (index uint32, err Error) {
 
+	if rs.role == RolePassive {
+		return 0, errPassive
+	}
 	if len(rs.streamsOut) > rs.MaxNumberOutStreams {
 		return 0, Error("Maximum number of output streams reached.")
 	}
@@ -228,6 +412,9 @@ func (rs *Session) NewSsrcStreamOut(own *Address, ssrc uint32, sequenceNo uint16
 // reports to it's remote peers.
 //
 func (rs *Session) StartSession() (err error) {
+	if err = rs.checkProfile(); err != nil {
+		return
+	}
 	err = rs.ListenOnTransports() // activate the transports
 	if err != nil {
 		return
@@ -238,17 +425,24 @@ func (rs *Session) StartSession() (err error) {
 			format := PayloadFormatMap[int(str.PayloadType())]
 			if format == nil {
 				rs.RtcpSessionBandwidth += 64000. / 20.0 // some standard: 5% of a 64000 bit connection
+				continue
 			}
 			// Assumption: fixed codec used, 8 byte per sample, one channel
 			rs.RtcpSessionBandwidth += float64(format.ClockRate) * 8.0 / 20.
 		}
+		if rs.RtcpSessionBandwidth == 0.0 { // no output streams, for example a passive session
+			rs.RtcpSessionBandwidth = 64000. / 20.0
+		}
 	}
 	rs.avrgPacketLength = float64(len(rs.streamsOut)*senderInfoLen + reportBlockLen + 20) // 28 for SDES
 
 	// initial call: members, senders, RTCP bandwidth,   packet length,     weSent, initial
 	ti, td := rtcpInterval(1, 0, rs.RtcpSessionBandwidth, rs.avrgPacketLength, false, true)
-	rs.tnext = ti + time.Now().UnixNano()
+	now := time.Now().UnixNano()
+	rs.tnext = ti + now
+	rs.scheduleFeedback(now, rs.tnext)
 
+	rs.rtcpServiceActive = true // before the service runs, packets that arrive now are processed
 	go rs.rtcpService(ti, td)
 	return
 }
@@ -256,16 +450,77 @@ func (rs *Session) StartSession() (err error) {
 // CloseSession closes the complete RTP session immediately.
 //
 // The methods stops the RTCP service, sends a BYE to all remaining active output streams, and
-// closes the receiver transports,
+// closes the receiver transports, see CloseSessionBye. The method uses a default BYE reason and
+// waits at most DefaultByeTimeout for the BYE packets.
 //
 func (rs *Session) CloseSession() {
-	if rs.rtcpServiceActive {
-		rs.rtcpCtrlChan <- rtcpStopService
-		for idx := range rs.streamsOut {
-			rs.SsrcStreamCloseForIndex(idx)
+	rs.CloseSessionBye(defaultByeReason, DefaultByeTimeout)
+}
+
+// DefaultByeTimeout is the time CloseSession waits until the transports sent the BYE packets.
+var DefaultByeTimeout = 500 * time.Millisecond
+
+const defaultByeReason = "Go RTP says good-bye"
+
+// CloseSessionBye closes the RTP session after it sent a BYE for each active output stream.
+//
+// The method stops the RTCP service, sends the BYE packets, and waits until the transports
+// wrote them, but not longer than the timeout. Then it closes the receiver transports, thus
+// the remote parties see a clean hangup instead of a media timeout. The method returns an
+// error if the BYE packets were not sent within the timeout or a transport failed to send them.
+// After a timeout the transports close as soon as the pending write returns.
+//
+// In sessions with more than 50 members the method first reconsiders the BYE as RFC 3550
+// chapter 6.3.7 specifies it: it delays the BYE by a RTCP interval that grows with the BYE
+// packets of other leaving members, thus the members of a large session that ends don't send
+// their BYE packets at once. The timeout does not include this delay, the delay is at most
+// 10 seconds.
+//
+//   reason  - the reason for leaving, may be empty
+//   timeout - the maximum time to wait for the BYE packets
+//
+func (rs *Session) CloseSessionBye(reason string, timeout time.Duration) (err error) {
+	if !rs.rtcpServiceActive {
+		return nil
+	}
+	rs.rtcpCtrlChan <- rtcpStopService
+	// the session stays active while it reconsiders the BYE, it counts the BYE packets of the
+	// other members
+	rs.reconsiderBye(reason)
+	rs.rtcpServiceActive = false
+
+	var closing []*SsrcStream
+	rs.streamsMapMutex.Lock()
+	for _, str := range rs.streamsOut {
+		if str.streamStatus == active {
+			closing = append(closing, str)
+		}
+	}
+	rs.streamsMapMutex.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		var byeErr error
+		for _, str := range closing {
+			if e := rs.closeStream(str, reason); e != nil && byeErr == nil {
+				byeErr = e
+			}
 		}
-		rs.CloseRecv() // de-activate the transports
+		done <- byeErr
+	}()
+	timer := time.NewTimer(timeout)
+	select {
+	case err = <-done:
+		timer.Stop()
+	case <-timer.C:
+		// the transports close once the blocked writer returned, not while it uses them
+		go func() {
+			<-done
+			rs.CloseRecv()
+		}()
+		return Error("Timeout while sending BYE packets.")
 	}
+	rs.CloseRecv() // de-activate the transports
 	return
 }
 
@@ -337,6 +592,15 @@ func (rs *Session) RemoveCtrlEventChan() {
 	rs.ctrlEventChan = nil
 }
 
+// ExtensionMap returns the session's header extension registry.
+//
+// The application registers the header extension IDs negotiated with the peer and then sets and
+// reads the extensions of the session's RTP packets by URI.
+//
+func (rs *Session) ExtensionMap() *ExtensionMap {
+	return rs.extensionMap
+}
+
 // SsrcStreamOut gets the standard output stream.
 //
 func (rs *Session) SsrcStreamOut() *SsrcStream {
@@ -365,6 +629,88 @@ func (rs *Session) SsrcStreamInForIndex(streamIndex uint32) *SsrcStream {
 	return rs.streamsIn[streamIndex]
 }
 
+// StreamInfo describes an input or output stream of a session, see InputStreams and OutputStreams.
+type StreamInfo struct {
+	Index        uint32 // the stream's index in the session
+	Ssrc         uint32
+	StreamType   int
+	Address                     // own address of an output stream, sender's address of an input stream
+	SdesItems    map[int]string // a copy of the stream's SDES items
+	Statistics   StreamStatistics
+	Bitrate      BitrateStats // the primary packets, without the retransmissions
+	Repair       RepairStats
+	LastActivity int64         // time in nanoseconds the stream sent (output) or received (input) the last RTP or RTCP packet
+	Context      StreamContext // the application's context of the stream
+	Origin       *SourceOrigin // the network origin of an input stream, nil if unknown, see SetSourceEnrichment
+}
+
+// InputStreams returns the current input streams (the member table) of the session.
+//
+// The information is a copy, the application may keep it. To get the stream itself use
+// SsrcStreamInForIndex with the returned index.
+//
+func (rs *Session) InputStreams() []StreamInfo {
+	rs.streamsMapMutex.Lock()
+	defer rs.streamsMapMutex.Unlock()
+
+	infos := make([]StreamInfo, 0, len(rs.streamsIn))
+	for idx, str := range rs.streamsIn {
+		infos = append(infos, str.info(idx))
+	}
+	return infos
+}
+
+// OutputStreams returns the current output streams of the session.
+//
+// See InputStreams above.
+//
+func (rs *Session) OutputStreams() []StreamInfo {
+	rs.streamsMapMutex.Lock()
+	defer rs.streamsMapMutex.Unlock()
+
+	infos := make([]StreamInfo, 0, len(rs.streamsOut))
+	for idx, str := range rs.streamsOut {
+		infos = append(infos, str.info(idx))
+	}
+	return infos
+}
+
+// RemoveInputStream removes the input stream with the SSRC from the session.
+//
+// Conference applications use this to purge a participant without closing the session. The
+// session does not send receiver reports for the stream anymore. If the session receives
+// packets from this SSRC again it creates a new input stream. The method returns false if the
+// session has no input stream with this SSRC.
+//
+// If the RTCP service is active the method hands the removal to the service, it removes the
+// stream shortly after the method returns.
+//
+//   ssrc - the SSRC of the input stream
+//
+func (rs *Session) RemoveInputStream(ssrc uint32) bool {
+	rs.streamsMapMutex.Lock()
+	if _, _, found := rs.lookupSsrcMapIn(ssrc); !found {
+		rs.streamsMapMutex.Unlock()
+		return false
+	}
+	for _, removed := range rs.removedStreams {
+		if removed == ssrc {
+			rs.streamsMapMutex.Unlock()
+			return false
+		}
+	}
+	if !rs.rtcpServiceActive {
+		rs.removeInputStream(ssrc)
+		rs.streamsMapMutex.Unlock()
+		return true
+	}
+	rs.removedStreams = append(rs.removedStreams, ssrc)
+	rs.streamsMapMutex.Unlock()
+
+	rs.rtcpCtrlChan <- rtcpRemoveStreams
+	return true
+}
+
 // SsrcStreamClose sends a RTCP BYE to the standard output stream (index 0).
 //
 // The method does not close the stream immediately but marks it as 'is closing'.
@@ -373,7 +719,7 @@ func (rs *Session) SsrcStreamInForIndex(streamIndex uint32) *SsrcStream {
 // are returned to the system. An application must not re-use a session.
 //
 func (rs *Session) SsrcStreamClose() {
-	rs.SsrcStreamOutForIndex(0)
+	rs.SsrcStreamCloseForIndex(0)
 }
 
 // SsrcStreamCloseForIndex sends a RTCP BYE to the stream at index index.
@@ -383,13 +729,260 @@ func (rs *Session) SsrcStreamClose() {
 //   streamindex - the index of the output stream as returned by NewSsrcStreamOut
 //
 func (rs *Session) SsrcStreamCloseForIndex(streamIndex uint32) {
-	if rs.rtcpServiceActive {
-		str := rs.streamsOut[streamIndex]
-		rc := rs.buildRtcpByePkt(str, "Go RTP says good-bye")
-		rs.WriteCtrl(rc)
+	if !rs.rtcpServiceActive {
+		return
+	}
+	rs.streamsMapMutex.Lock()
+	str, exists := rs.streamsOut[streamIndex]
+	rs.streamsMapMutex.Unlock()
+	if exists {
+		rs.closeStream(str, defaultByeReason)
+	}
+}
+
+// closeStream sends a BYE with the reason and marks the output stream as 'is closing'.
+func (rs *Session) closeStream(str *SsrcStream, reason string) error {
+	rc := rs.buildRtcpByePkt(str, reason)
+	_, err := rs.WriteCtrl(rc)
 
-		str.streamStatus = isClosing
+	str.streamStatus = isClosing
+	return err
+}
+
+// SetPayloadTypeFilter sets the payload types the session accepts for its input streams.
+//
+// The session counts and drops RTP packets with other payload types before they create
+// an input stream, update the receive statistics or reach the data receive channel. A
+// filter of an input stream overrides the session's filter, see SsrcStream.SetPayloadTypeFilter.
+// An empty list removes the filter, the session then accepts all payload types known in
+// PayloadFormatMap.
+//
+//   pts - the accepted payload type numbers
+//
+func (rs *Session) SetPayloadTypeFilter(pts []byte) {
+	rs.streamsMapMutex.Lock()
+	rs.payloadFilter = newPayloadFilter(pts)
+	rs.streamsMapMutex.Unlock()
+}
+
+// PayloadTypeDrops returns the number of RTP packets the payload type filters dropped.
+func (rs *Session) PayloadTypeDrops() uint32 {
+	rs.streamsMapMutex.Lock()
+	defer rs.streamsMapMutex.Unlock()
+	return rs.payloadTypeDrops
+}
+
+// SDES privacy levels, see SetSdesPrivacy.
+const (
+	SdesPrivacyFull       = iota // send all SDES items
+	SdesPrivacyCnameOnly         // send the CNAME only
+	SdesPrivacyAnonymized        // send CNAME and TOOL, hash NAME and EMAIL, suppress the other items
+)
+
+// SetSdesPrivacy sets the privacy level of the SDES items the session sends.
+//
+// The RTCP builder applies the level to the SDES chunks of all output streams, the streams
+// keep their SDES items. SdesPrivacyAnonymized replaces NAME and EMAIL by a keyed hash, the
+// peers can tell the users apart but not learn the texts. Sessions that use the same key send
+// the same hashes. The CNAME is always sent, applications that need an anonymous CNAME set a
+// random one, see RFC 7022. Set the level before the session starts.
+//
+//   level - SdesPrivacyFull, SdesPrivacyCnameOnly or SdesPrivacyAnonymized
+//   key   - the key of the hash, nil selects a random key. Used by SdesPrivacyAnonymized only.
+//
+func (rs *Session) SetSdesPrivacy(level int, key []byte) error {
+	if level < SdesPrivacyFull || level > SdesPrivacyAnonymized {
+		return Error("Unknown SDES privacy level.")
+	}
+	if level == SdesPrivacyAnonymized && key == nil {
+		key = make([]byte, 16)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
 	}
+	rs.sdesPrivacy = sdesPrivacy{level: level, key: append([]byte{}, key...)}
+	return nil
+}
+
+// SetRtxPayloadType maps a RTX payload type to the payload type of the original packets, as
+// signaled by SDP "a=fmtp:<rtxPt> apt=<pt>", see RFC 4588.
+//
+// The session recovers the original packets of RTX streams, see SetRtxGroup. The RTX payload
+// type doesn't need an entry in PayloadFormatMap.
+//
+//   rtxPt - the payload type of the RTX packets
+//   apt   - the payload type of the original packets
+//
+func (rs *Session) SetRtxPayloadType(rtxPt, apt byte) {
+	rs.streamsMapMutex.Lock()
+	defer rs.streamsMapMutex.Unlock()
+	if rs.rtxPayloadTypes == nil {
+		rs.rtxPayloadTypes = make(map[byte]byte)
+	}
+	rs.rtxPayloadTypes[rtxPt] = apt
+}
+
+// SetRtxGroup associates a RTX stream with its primary stream, as signaled by SDP
+// "a=ssrc-group:FID <primary> <rtx>".
+//
+// The session recovers the original packet from a RTX packet: it restores the SSRC, the
+// payload type and the original sequence number (OSN) and removes the OSN from the payload.
+// Then it handles the packet as a packet of the primary stream, the primary stream's statistics
+// count it and drop duplicates. DataPacket.Retransmitted reports recovered packets. RTX packets
+// with an unknown SSRC are dropped.
+//
+//   primary - the SSRC of the primary stream
+//   rtx     - the SSRC of the RTX stream
+//
+func (rs *Session) SetRtxGroup(primary, rtx uint32) {
+	rs.streamsMapMutex.Lock()
+	defer rs.streamsMapMutex.Unlock()
+	if rs.rtxSsrcs == nil {
+		rs.rtxSsrcs = make(map[uint32]uint32)
+	}
+	rs.rtxSsrcs[rtx] = primary
+}
+
+// Results of a SourceVerifier.
+const (
+	SourceAccept = iota // accept the source, the session creates an input stream for it
+	SourceReject        // reject the source, the session drops the packet
+	SourceLatch         // accept the source and send to its address, the address replaces all remote addresses
+)
+
+// SourceVerifier decides if the session accepts a new source, see SetSourceVerifier.
+//
+//   ssrc - the SSRC of the new source
+//   from - the address the packet came from, either the data port or the control port is set
+//   data - true if the packet is an RTP packet, false if it is an RTCP packet
+//
+type SourceVerifier func(ssrc uint32, from *Address, data bool) int
+
+// SetSourceVerifier sets a function that verifies new sources.
+//
+// Without a verifier the session creates an input stream for every SSRC that arrives on its
+// transports. If a verifier is set the session calls it if a RTP or RTCP packet arrives with
+// an SSRC that has no input stream yet. The verifier may accept the source, reject it, or latch
+// it, for example to send to the address a NATed peer really uses (symmetric RTP). If the
+// verifier rejects a source the session drops the packet and calls the verifier again for the
+// next packet of this source. The session does not hold a lock when it calls the verifier, the
+// verifier may call methods of the session. A nil verifier accepts all sources.
+//
+//   verify - the verifier function
+//
+func (rs *Session) SetSourceVerifier(verify SourceVerifier) {
+	rs.streamsMapMutex.Lock()
+	rs.sourceVerifier = verify
+	rs.streamsMapMutex.Unlock()
+}
+
+// SetProfiler enables the self-profiling of the session, nil disables it. The session measures
+// its receive, delivery and send paths, see Profiler. Set the profiler before the session
+// starts.
+//
+//   pf - the profiler, may be shared with the session's SRTP transport
+//
+func (rs *Session) SetProfiler(pf *Profiler) {
+	rs.profiler = pf
+}
+
+// SetConcealer sets the concealer of the session's in-order delivery path, nil removes it. The
+// session then delivers the concealed packets and gap markers of lost packets ahead of the next
+// packet, see Concealer. Set the concealer before the session starts, the session doesn't run
+// it if RelaxedOrdering is set.
+func (rs *Session) SetConcealer(cc *Concealer) {
+	rs.conceal = cc
+}
+
+// ProfileStats returns the measurements of the session's profiler, false if profiling is off.
+func (rs *Session) ProfileStats() (stats ProfileStats, ok bool) {
+	if rs.profiler == nil {
+		return stats, false
+	}
+	return rs.profiler.Stats(), true
+}
+
+// PauseStream pauses the output stream at index streamIndex, for example if a call is on hold.
+//
+// The session does not send data packets of a paused stream, WriteData drops them. The RTCP
+// service keeps running, after two RTCP intervals the stream sends receiver reports instead of
+// sender reports until the application resumes the stream.
+//
+//   streamindex - the index of the output stream as returned by NewSsrcStreamOut
+//
+func (rs *Session) PauseStream(streamIndex uint32) error {
+	str := rs.SsrcStreamOutForIndex(streamIndex)
+	if str == nil {
+		return Error("No output stream at this index.")
+	}
+	str.streamMutex.Lock()
+	str.pause()
+	str.streamMutex.Unlock()
+	return nil
+}
+
+// ResumeStream resumes a paused output stream.
+//
+// Usually an application's timestamps do not advance while the stream is paused. If
+// advanceStamp is true then the stream adds the paused time to the timestamps of the following
+// data packets. This keeps the timestamps in line with the wallclock and the receivers' playout
+// clocks stay in sync. If advanceStamp is false then the timestamps continue without a gap and
+// the stream adjusts the timestamps of its sender reports instead.
+//
+//   streamindex  - the index of the output stream as returned by NewSsrcStreamOut
+//   advanceStamp - advance the timestamps by the paused time
+//
+func (rs *Session) ResumeStream(streamIndex uint32, advanceStamp bool) error {
+	str := rs.SsrcStreamOutForIndex(streamIndex)
+	if str == nil {
+		return Error("No output stream at this index.")
+	}
+	str.streamMutex.Lock()
+	str.resume(advanceStamp)
+	str.streamMutex.Unlock()
+	return nil
+}
+
+// InjectData hands a RTP packet to the session as if the session's transport received it.
+//
+// Applications use this method for packets from non-standard sources, for example a custom
+// tunnel, a test harness, or the routing core of a SFU. The packet takes the normal path:
+// stream management, collision and loop detection, statistics, and the data receive channel.
+// Set the sender's address with SetFromAddr before injecting the packet, the session uses
+// it to detect collisions and loops. The session owns the packet after the call.
+//
+// The method returns false if the session dropped the packet.
+//
+func (rs *Session) InjectData(rp *DataPacket) bool {
+	if rp.inUse < rtpHeaderLength {
+		rp.FreePacket()
+		return false
+	}
+	return rs.OnRecvData(rp)
+}
+
+// InjectCtrl hands a RTCP compound packet to the session as if the session's transport
+// received it.
+//
+// See InjectData. The method checks the structure of the compound before it processes the
+// packets: each packet must have version 2 and the packet lengths must add up to the length
+// of the compound.
+//
+// The method returns false if the session dropped the packet.
+//
+func (rs *Session) InjectCtrl(rp *CtrlPacket) bool {
+	offset := 0
+	for offset+rtcpHeaderLength+rtcpSsrcLength <= rp.inUse {
+		if (rp.buffer[offset] & versionMask) != version2Bit {
+			break
+		}
+		offset += int(rp.Length(offset)+1) * 4
+	}
+	if offset == 0 || offset != rp.inUse {
+		rp.FreePacket()
+		return false
+	}
+	return rs.OnRecvCtrl(rp)
 }
 
 /*
@@ -423,9 +1016,31 @@ func (rs *Session) ListenOnTransports() (err error) {
 //
 // Delegating is not yet implemented. Applications receive data via the DataReceiveChan.
 //
+// Lower layers may call OnRecvData concurrently, for example if the application stacks several
+// transports (sockets) below the session or a transport uses several receivers. The session
+// processes the packets of one SSRC one at a time and packets of different SSRCs in parallel.
+// Unless RelaxedOrdering is set the session also forwards the packets of one SSRC to the
+// DataReceiveChan in the order it processed them, thus the application sees the packets of a
+// stream in the order the lower layers delivered them. Packets of different SSRCs have no
+// defined order. In simple RTP mode (no RTCP service) the session does not keep streams and
+// forwards the packets in the order of the calls.
+//
 func (rs *Session) OnRecvData(rp *DataPacket) bool {
 
-	if !rp.IsValid() {
+	rs.profiler.packet()
+	defer rs.profiler.measure(ProfileReceive, rs.profiler.begin())
+	rs.sampler.offer(&rp.RawPacket, false)
+
+	if rs.role == RoleSendOnly || !rs.checkData(rp) {
+		rp.FreePacket()
+		return false
+	}
+	if !rs.recoverRtx(rp) {
+		rs.sendDataCtrlEvent(RtxDroppedData, rp.Ssrc(), 0)
+		rp.FreePacket()
+		return false
+	}
+	if !rs.validData(rp) || !rs.admitSender(rp.Ssrc(), rp.fromAddr.IpAddr, true) {
 		rp.FreePacket()
 		return false
 	}
@@ -436,9 +1051,24 @@ func (rs *Session) OnRecvData(rp *DataPacket) bool {
 
 		now := time.Now().UnixNano()
 
+		if !rs.verifySource(ssrc, &rp.fromAddr, true) {
+			rs.sendDataCtrlEvent(SourceRejectedData, ssrc, 0)
+			rp.FreePacket()
+			return false
+		}
 		rs.streamsMapMutex.Lock()
-		str, _, existing := rs.lookupSsrcMap(ssrc)
+		str, strIdx, existing := rs.lookupSsrcMap(ssrc)
+		if !existing && ssrc != 0 && rs.quirks&QuirkZeroSsrc != 0 {
+			str, strIdx, existing = rs.adoptZeroSsrc(ssrc, &rp.fromAddr)
+		}
 
+		// The payload type filter drops packets before they create a stream or update its statistics
+		if !rs.acceptPayloadType(str, existing, rp.PayloadType()) {
+			rs.sendStreamCtrlEvent(WrongPayloadTypeData, str, ssrc, strIdx)
+			rp.FreePacket()
+			rs.streamsMapMutex.Unlock()
+			return false
+		}
 		// if not found in the input stream then create a new SSRC input stream
 		if !existing {
 			str = newSsrcStreamIn(&rp.fromAddr, ssrc)
@@ -448,15 +1078,17 @@ func (rs *Session) OnRecvData(rp *DataPacket) bool {
 				rs.streamsMapMutex.Unlock()
 				return false
 			}
+			strIdx = rs.streamInIndex
 			rs.streamsIn[rs.streamInIndex] = str
 			rs.streamInIndex++
 			str.streamStatus = active
 			str.statistics.initialDataTime = now // First packet arrival time.
-			rs.sendDataCtrlEvent(NewStreamData, ssrc, rs.streamInIndex-1)
+			rs.newInputContext(str)
+			rs.sendStreamCtrlEvent(NewStreamData, str, ssrc, rs.streamInIndex-1)
 		} else {
 			// Check if an existing stream is active
 			if str.streamStatus != active {
-				rs.sendDataCtrlEvent(WrongStreamStatusData, ssrc, rs.streamInIndex-1)
+				rs.sendStreamCtrlEvent(WrongStreamStatusData, str, ssrc, rs.streamInIndex-1)
 				rp.FreePacket()
 				rs.streamsMapMutex.Unlock()
 				return false
@@ -465,26 +1097,42 @@ func (rs *Session) OnRecvData(rp *DataPacket) bool {
 			// Test if RTCP packets had been received but this is the first data packet from this source.
 			if str.DataPort == 0 {
 				str.DataPort = rp.fromAddr.DataPort
+				if rs.quirks&QuirkRtcpBeforeRtp != 0 {
+					from := rp.fromAddr // the packet may be free when the deferred call runs
+					defer rs.relatchData(ssrc, &from)
+				}
 			}
 		}
+		nack := rs.nackGenerators[ssrc]
+		speakers := rs.speakers
 		rs.streamsMapMutex.Unlock()
 
-		// Before forwarding packet to next upper layer (application) for further processing:
-		// 1) check for collisions and loops. If the packet cannot be assigned to a source, it will be rejected.
-		// 2) check the source is a sufficiently well known source
-		// TODO: also check CSRC identifiers.
-		if !str.checkSsrcIncomingData(existing, rs, rp) || !str.recordReceptionData(rp, rs, now) {
-			// must be discarded due to collision or loop or invalid source
-			rs.sendDataCtrlEvent(StreamCollisionLoopData, ssrc, rs.streamInIndex-1)
-			rp.FreePacket()
-			return false
+		str.recvMutex.Lock()
+		if nack != nil && nack.requested(rp.Sequence()) {
+			rp.retransmitted = true // the answer to a NACK without RTX
+		}
+		valid := rs.recordData(str, strIdx, existing, rp, now)
+		if valid && nack != nil {
+			nack.received(rp.Sequence(), time.Unix(0, now))
+		}
+		if valid && speakers != nil {
+			speakers.received(rp, strIdx, time.Unix(0, now))
+		}
+		if valid && rs.cryptor != nil {
+			valid = rs.decryptPayload(str, strIdx, rp)
+		}
+		if valid && !rs.RelaxedOrdering {
+			rs.playoutData(rp)
+		}
+		str.recvMutex.Unlock()
+		if !valid || !rs.RelaxedOrdering {
+			return valid
 		}
 	}
-	select {
-	case rs.dataReceiveChan <- rp: // forwarded packet, that's all folks
-	default:
-		rp.FreePacket() // either channel full or not created - free packet
+	if rs.cryptor != nil && !rs.rtcpServiceActive && !rs.decryptPayload(nil, 0, rp) {
+		return false
 	}
+	rs.forwardData(rp)
 	return true
 }
 
@@ -498,11 +1146,23 @@ func (rs *Session) OnRecvData(rp *DataPacket) bool {
 //
 func (rs *Session) OnRecvCtrl(rp *CtrlPacket) bool {
 
+	rs.profiler.packet()
+	defer rs.profiler.measure(ProfileReceive, rs.profiler.begin())
+	rs.sampler.offer(&rp.RawPacket, true)
+
 	if !rs.rtcpServiceActive {
 		return true
 	}
+	if !rs.checkCtrl(rp) {
+		rp.FreePacket()
+		return false
+	}
 
-	if pktType := rp.Type(0); pktType != RtcpSR && pktType != RtcpRR && pktType != RtcpPsfb && pktType != RtcpRtpfb {
+	if rp.Type(0) == RtcpSR && rp.inUse >= rtcpHeaderLength+rtcpSsrcLength && !rs.admitSender(rp.Ssrc(0), rp.fromAddr.IpAddr, false) {
+		rp.FreePacket()
+		return false
+	}
+	if pktType := rp.Type(0); pktType != RtcpSR && pktType != RtcpRR && pktType != RtcpPsfb && pktType != RtcpRtpfb && !rs.acceptNonCompound(pktType) {
 		rp.FreePacket()
 		return false
 	}
@@ -513,6 +1173,7 @@ func (rs *Session) OnRecvCtrl(rp *CtrlPacket) bool {
 	offset := 0
 	for offset < rp.inUse {
 		pktLen := int((rp.Length(offset) + 1) * 4)
+		pktOffset, evStart := offset, len(ctrlEvArr)
 
 		switch rp.Type(offset) {
 		case RtcpSR:
@@ -523,7 +1184,7 @@ func (rs *Session) OnRecvCtrl(rp *CtrlPacket) bool {
 			// Always check sender's SSRC first in case of RR or SR
 			str, strIdx, existing := rs.rtcpSenderCheck(rp, offset)
 			if str == nil {
-				ctrlEvArr = append(ctrlEvArr, newCrtlEvent(int(strIdx), str.Ssrc(), 0))
+				ctrlEvArr = append(ctrlEvArr, newCrtlEvent(int(strIdx), rp.Ssrc(offset), 0))
 			} else {
 				if !existing {
 					ctrlEvArr = append(ctrlEvArr, newCrtlEvent(NewStreamCtrl, str.Ssrc(), rs.streamInIndex-1))
@@ -532,6 +1193,14 @@ func (rs *Session) OnRecvCtrl(rp *CtrlPacket) bool {
 				str.readSenderInfo(rp.toSenderInfo(rtcpHeaderLength + rtcpSsrcLength + offset))
 
 				ctrlEvArr = append(ctrlEvArr, newCrtlEvent(RtcpSR, str.Ssrc(), strIdx))
+				if rs.srChecker != nil {
+					for _, d := range rs.srChecker.check(str, strIdx, time.Now()) {
+						d := d
+						ctrlEv := newCrtlEvent(SrInconsistentCtrl, d.Ssrc, d.Index)
+						ctrlEv.Discrepancy = &d
+						ctrlEvArr = append(ctrlEvArr, ctrlEv)
+					}
+				}
 
 				// Offset to first RR block: offset to SR + fixed Header length for SR + length of sender info
 				rrOffset := offset + rtcpHeaderLength + rtcpSsrcLength + senderInfoLen
@@ -541,7 +1210,7 @@ func (rs *Session) OnRecvCtrl(rp *CtrlPacket) bool {
 					strOut, idx, exists := rs.lookupSsrcMapOut(rr.ssrc())
 					// Process Receive Reports that match own output streams (SSRC).
 					if exists {
-						strOut.readRecvReport(rr)
+						strOut.readRecvReport(rr, str.Ssrc())
 						ctrlEvArr = append(ctrlEvArr, newCrtlEvent(RtcpRR, rr.ssrc(), idx))
 					}
 					rrOffset += reportBlockLen
@@ -557,7 +1226,7 @@ func (rs *Session) OnRecvCtrl(rp *CtrlPacket) bool {
 			// Always check sender's SSRC first in case of RR or SR
 			str, strIdx, existing := rs.rtcpSenderCheck(rp, offset)
 			if str == nil {
-				ctrlEvArr = append(ctrlEvArr, newCrtlEvent(int(strIdx), str.Ssrc(), 0))
+				ctrlEvArr = append(ctrlEvArr, newCrtlEvent(int(strIdx), rp.Ssrc(offset), 0))
 			} else {
 				if !existing {
 					ctrlEvArr = append(ctrlEvArr, newCrtlEvent(NewStreamCtrl, str.Ssrc(), rs.streamInIndex-1))
@@ -571,7 +1240,7 @@ func (rs *Session) OnRecvCtrl(rp *CtrlPacket) bool {
 					strOut, idx, exists := rs.lookupSsrcMapOut(rr.ssrc())
 					// Process Receive Reports that match own output streams (SSRC)
 					if exists {
-						strOut.readRecvReport(rr)
+						strOut.readRecvReport(rr, str.Ssrc())
 						ctrlEvArr = append(ctrlEvArr, newCrtlEvent(RtcpRR, rr.ssrc(), idx))
 					}
 					rrOffset += reportBlockLen
@@ -611,6 +1280,9 @@ func (rs *Session) OnRecvCtrl(rp *CtrlPacket) bool {
 			// Currently the method suports only one SSRC per BYE packet. To enhance this we need
 			// to return an array of SSRC/CSRC values.
 			//
+			if atomic.LoadUint32(&rs.leaving) != 0 {
+				atomic.AddUint32(&rs.byeMembers, 1) // see reconsiderBye
+			}
 			byeCnt := rp.Count(offset)
 			byePkt := rp.toByeData(offset+4, pktLen-4)
 			if byePkt != nil {
@@ -639,28 +1311,38 @@ func (rs *Session) OnRecvCtrl(rp *CtrlPacket) bool {
 			if offset+pktLen > len(rp.Buffer()) {
 				return false
 			}
-			str, _, _ := rs.rtcpSenderCheck(rp, offset)
-			ctrlEv := newCrtlEvent(RtcpRtpfb, str.Ssrc(), 0)
+			rs.rtcpSenderCheck(rp, offset)
+			ctrlEv := newCrtlEvent(RtcpRtpfb, rp.Ssrc(offset), 0)
 			fbOffset := offset + rtcpHeaderLength + rtcpSsrcLength + rtcpSsrcLength
 			ctrlEv.Reason = string(rp.buffer[fbOffset:(offset + pktLen)])
 			ctrlEvArr = append(ctrlEvArr, ctrlEv)
+			rs.routeFeedback(rp, offset, pktLen)
 			offset += pktLen
 		case RtcpPsfb:
 			if offset+pktLen > len(rp.Buffer()) {
 				return false
 			}
-			str, _, _ := rs.rtcpSenderCheck(rp, offset)
-			ctrlEv := newCrtlEvent(RtcpPsfb, str.Ssrc(), 0)
+			rs.rtcpSenderCheck(rp, offset)
+			ctrlEv := newCrtlEvent(RtcpPsfb, rp.Ssrc(offset), 0)
 			fbOffset := offset + rtcpHeaderLength + rtcpSsrcLength + rtcpSsrcLength
-			ctrlEv.Reason = string(rp.buffer[fbOffset : fbOffset+8])
+			fbEnd := fbOffset + 8
+			if fbEnd > offset+pktLen {
+				fbEnd = offset + pktLen // e.g. a PLI without FCI
+			}
+			if fbOffset <= fbEnd {
+				ctrlEv.Reason = string(rp.buffer[fbOffset:fbEnd])
+			}
 			ctrlEvArr = append(ctrlEvArr, ctrlEv)
+			rs.routeFeedback(rp, offset, pktLen)
 			offset += pktLen
 		case RtcpXr:
 			// Advance to the next packet in the compound.
 			offset += pktLen
 
 		}
+		attachPacket(rp, ctrlEvArr[evStart:], pktOffset, pktLen)
 	}
+	rs.addEventContext(ctrlEvArr)
 	select {
 	case rs.ctrlEventChan <- ctrlEvArr: // send control event
 	default:
@@ -685,6 +1367,8 @@ func (rs *Session) OnRecvCtrl(rp *CtrlPacket) bool {
 // Only relevant if an application uses "simple RTP".
 //
 func (rs *Session) CloseRecv() {
+	rs.stopRemoteHosts()
+
 	if rs.transportRecv != nil {
 		rs.transportRecv.CloseRecv()
 		for allClosed := 0; allClosed != (DataTransportRecvStopped | CtrlTransportRecvStopped); {
@@ -718,24 +1402,69 @@ func (rs *Session) SetEndChannel(ch TransportEnd) {
 //
 func (rs *Session) WriteData(rp *DataPacket) (n int, err error) {
 
-	strOut, _, _ := rs.lookupSsrcMapOut(rp.Ssrc())
+	rs.profiler.packet()
+	defer rs.profiler.measure(ProfileSend, rs.profiler.begin())
+
+	if err := rs.sendData(); err != nil {
+		return 0, err
+	}
+	strOut, strIdx, _ := rs.lookupSsrcMapOut(rp.Ssrc())
 	if strOut.streamStatus != active {
 		return 0, nil
 	}
+	class := rs.streamClass(int64(strIdx), rp)
+	if !strOut.sendPaused() && !rs.budgetAdmit(class, rp) {
+		return 0, errBudget
+	}
+	if rs.cryptor != nil {
+		if err := rs.encryptPayload(strOut, strIdx, rp); err != nil {
+			return 0, err
+		}
+	}
+	if !rs.countSent(strOut, rp) {
+		return 0, nil
+	}
+	if rs.markClass(class, rp) {
+		defer rp.SetSocketOptions(nil)
+	}
+	return rs.writeDataToRemotes(rp)
+}
+
+// countSent updates the sender counters and statistics of the output stream for the packet and
+// records it for retransmissions. It returns false if the stream is paused.
+func (rs *Session) countSent(strOut *SsrcStream, rp *DataPacket) bool {
+	strOut.streamMutex.Lock()
+	if strOut.paused {
+		strOut.streamMutex.Unlock()
+		return false
+	}
 	strOut.SenderPacketCnt++
 	strOut.SenderOctectCnt += uint32(len(rp.Payload()))
 
-	strOut.streamMutex.Lock()
 	if !strOut.sender && rs.rtcpCtrlChan != nil {
 		rs.rtcpCtrlChan <- rtcpIncrementSender
 		strOut.sender = true
 	}
 	strOut.statistics.lastPacketTime = time.Now().UnixNano()
+	strOut.bitrate.add(rp.inUse, strOut.statistics.lastPacketTime)
+	nack := strOut.nack
 	strOut.streamMutex.Unlock()
 	rs.weSent = true
 
+	if nack != nil {
+		nack.record(rp)
+	}
+	return true
+}
+
+// writeDataToRemotes sends an RTP packet to all known remote destinations without updating the
+// statistics of the stream, retransmissions use it directly.
+func (rs *Session) writeDataToRemotes(rp *DataPacket) (n int, err error) {
+	if err := rs.sendData(); err != nil {
+		return 0, err
+	}
 	// Check here if SRTP is enabled for the SSRC of the packet - a stream attribute
-	for _, remote := range rs.remotes {
+	for _, remote := range rs.remoteList() {
 		_, err := rs.transportWrite.WriteDataTo(rp, remote)
 		if err != nil {
 			return 0, err
@@ -751,12 +1480,18 @@ func (rs *Session) WriteData(rp *DataPacket) (n int, err error) {
 //
 func (rs *Session) WriteCtrl(rp *CtrlPacket) (n int, err error) {
 
+	rs.profiler.packet()
+	defer rs.profiler.measure(ProfileSend, rs.profiler.begin())
+
+	if rs.role == RolePassive {
+		return 0, errPassive
+	}
 	// Check here if SRTCP is enabled for the SSRC of the packet - a stream attribute
 	strOut, _, _ := rs.lookupSsrcMapOut(rp.Ssrc(0))
 	if strOut.streamStatus != active {
 		return 0, nil
 	}
-	for _, remote := range rs.remotes {
+	for _, remote := range rs.remoteList() {
 		_, err := rs.transportWrite.WriteCtrlTo(rp, remote)
 		if err != nil {
 			return 0, err
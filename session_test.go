@@ -0,0 +1,362 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// closeTransport captures written packets, optionally blocks the writes, and signals the
+// end channel when the session closes it.
+type closeTransport struct {
+	captureWriter
+	teeConsumer
+	end   TransportEnd
+	block chan bool
+}
+
+func (ct *closeTransport) SetEndChannel(ch TransportEnd) { ct.end = ch }
+func (ct *closeTransport) CloseRecv() {
+	ct.end <- DataTransportRecvStopped
+	ct.end <- CtrlTransportRecvStopped
+}
+
+func (ct *closeTransport) WriteCtrlTo(rp *CtrlPacket, addr *Address) (n int, err error) {
+	if ct.block != nil {
+		<-ct.block
+	}
+	return ct.captureWriter.WriteCtrlTo(rp, addr)
+}
+
+func closeSession(block bool) (*Session, *closeTransport) {
+	ct := new(closeTransport)
+	if block {
+		ct.block = make(chan bool)
+	}
+	rs := NewSession(ct, ct)
+	local := net.IPv4(127, 0, 0, 1)
+	rs.AddRemote(&Address{local, 6002, 6003})
+	for _, ssrc := range []uint32{0x01020304, 0x05060708} {
+		idx, _ := rs.NewSsrcStreamOut(&Address{local, 6000, 6001}, ssrc, 1)
+		rs.SsrcStreamOutForIndex(idx).SetPayloadType(0)
+	}
+	rs.rtcpServiceActive = true // to simulate an active RTCP service
+	return rs, ct
+}
+
+// drainedSession returns a closeSession that discards its RTCP service commands, see drainCtrl.
+func drainedSession(t *testing.T) (*Session, *closeTransport) {
+	rs, ct := closeSession(false)
+	drainCtrl(t, rs)
+	return rs, ct
+}
+
+// drainCtrl discards the RTCP service commands of a session without a running RTCP service
+// until the test ends.
+func drainCtrl(t *testing.T, rs *Session) {
+	go func() {
+		for range rs.rtcpCtrlChan {
+		}
+	}()
+	t.Cleanup(func() { close(rs.rtcpCtrlChan) })
+}
+
+func TestCloseSession(t *testing.T) {
+	parseFlags()
+
+	rs, ct := closeSession(false)
+	if err := rs.CloseSessionBye("hangup", time.Second); err != nil {
+		t.Errorf("CloseSessionBye failed: %s\n", err)
+	}
+	if len(ct.captureWriter.ctrl) != 2 {
+		t.Errorf("BYE count check failed. Expected: 2, got: %d\n", len(ct.captureWriter.ctrl))
+		return
+	}
+	for _, pkt := range ct.captureWriter.ctrl {
+		rc, _ := NewCtrlPacketFromBuffer(pkt)
+		offset := int(rc.Length(0)+1) * 4      // skip RR
+		offset += int(rc.Length(offset)+1) * 4 // skip SDES
+		if rc.Type(offset) != RtcpBye || rc.toByeData(offset+4, len(pkt)-offset-4).getReason(1) != "hangup" {
+			t.Errorf("BYE packet check failed\n")
+		}
+	}
+	for _, str := range rs.streamsOut {
+		if str.streamStatus != isClosing {
+			t.Errorf("Stream status check failed. Expected: %d, got: %d\n", isClosing, str.streamStatus)
+		}
+	}
+
+	// A blocked transport must not block the close for longer than the timeout
+	rs, ct = closeSession(true)
+	start := time.Now()
+	if err := rs.CloseSessionBye("", 50*time.Millisecond); err == nil {
+		t.Errorf("CloseSessionBye timeout check failed\n")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("CloseSessionBye waited too long: %s\n", d)
+	}
+	select {
+	case <-ct.end:
+		t.Errorf("The transports must not close while a BYE write is pending\n")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(ct.block)
+	select {
+	case <-ct.end:
+	case <-time.After(time.Second):
+		t.Errorf("The transports did not close after the BYE write returned\n")
+	}
+}
+
+func TestPauseStream(t *testing.T) {
+	parseFlags()
+
+	rs, ct := closeSession(false)
+	str := rs.SsrcStreamOutForIndex(0)
+
+	rp := rs.NewDataPacket(160)
+	rs.WriteData(rp)
+	first := rp.Timestamp()
+	rp.FreePacket()
+
+	if err := rs.PauseStream(0); err != nil {
+		t.Errorf("PauseStream failed: %s\n", err)
+		return
+	}
+	rp = rs.NewDataPacket(320)
+	rs.WriteData(rp)
+	rp.FreePacket()
+	if len(ct.captureWriter.data) != 1 {
+		t.Errorf("Paused stream must not send data. Sent: %d\n", len(ct.captureWriter.data))
+	}
+	str.pauseStart -= int64(2 * time.Second) // simulate a 2 seconds hold
+	rs.ResumeStream(0, true)
+
+	rp = rs.NewDataPacket(480)
+	rs.WriteData(rp)
+	// PCMU, 8000 Hz: 2 seconds are 16000 samples
+	if d := rp.Timestamp() - first; d < 320+16000 || d > 320+16100 {
+		t.Errorf("Timestamp advance check failed. Expected about: %d, got: %d\n", 320+16000, d)
+	}
+	rp.FreePacket()
+	if len(ct.captureWriter.data) != 2 {
+		t.Errorf("Resumed stream must send data. Sent: %d\n", len(ct.captureWriter.data))
+	}
+
+	// without advance the timestamps continue, the sender reports shift instead
+	rs.PauseStream(1)
+	str = rs.SsrcStreamOutForIndex(1)
+	str.pauseStart -= int64(time.Second)
+	rs.ResumeStream(1, false)
+	if str.stampOffset != 0 || str.srStampShift < 8000 || str.srStampShift > 8100 {
+		t.Errorf("Sender report shift check failed. Offset: %d, shift: %d\n", str.stampOffset, str.srStampShift)
+	}
+	if err := rs.PauseStream(7); err == nil {
+		t.Errorf("PauseStream must fail for an unknown stream\n")
+	}
+
+	// a payload type without a format, for example a removed one, resumes without an advance
+	PayloadFormatMap[99] = nil
+	defer delete(PayloadFormatMap, 99)
+	str.SetPayloadType(99)
+	rs.PauseStream(1)
+	rs.ResumeStream(1, true)
+	if str.stampOffset != 0 {
+		t.Errorf("Resume without a payload format check failed. Offset: %d\n", str.stampOffset)
+	}
+}
+
+func TestRemoteHost(t *testing.T) {
+	parseFlags()
+
+	answers := make(chan []net.IP, 4)
+	lookupIP = func(host string) ([]net.IP, error) {
+		select {
+		case ips := <-answers:
+			return ips, nil
+		default:
+			return nil, Error("no answer")
+		}
+	}
+	defer func() { lookupIP = net.LookupIP }()
+
+	rs, _ := closeSession(false)
+	relay1, relay2 := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+	answers <- []net.IP{relay1}
+	idx, err := rs.AddRemoteHost("relay.example.com", 7000, 20*time.Millisecond)
+	if err != nil || rs.RemoteHost(idx) != "relay.example.com" {
+		t.Errorf("AddRemoteHost failed: %v\n", err)
+		return
+	}
+	remote := func() *Address {
+		rs.remotesMutex.RLock()
+		defer rs.remotesMutex.RUnlock()
+		return rs.remotes[idx]
+	}
+	if r := remote(); !r.IpAddr.Equal(relay1) || r.DataPort != 7000 || r.CtrlPort != 7001 {
+		t.Errorf("Resolved remote check failed. Got: %v\n", r)
+	}
+	// the current address is still in the answer: keep it, then follow the change
+	answers <- []net.IP{net.ParseIP("2001:db8::1"), relay2, relay1}
+	answers <- []net.IP{net.ParseIP("2001:db8::1"), relay2}
+	time.Sleep(100 * time.Millisecond)
+	if r := remote(); !r.IpAddr.Equal(relay2) {
+		t.Errorf("Re-resolution check failed. Expected: %s, got: %s\n", relay2, r.IpAddr)
+	}
+	// failed resolutions keep the address
+	time.Sleep(50 * time.Millisecond)
+	if r := remote(); !r.IpAddr.Equal(relay2) {
+		t.Errorf("Failed re-resolution check failed. Got: %s\n", r.IpAddr)
+	}
+	rs.RemoveRemote(idx)
+	if rs.RemoteHost(idx) != "" {
+		t.Errorf("RemoveRemote host check failed\n")
+	}
+	if _, err := rs.AddRemoteHost("relay.example.com", 7000, 0); err == nil {
+		t.Errorf("AddRemoteHost must fail for a zero interval\n")
+	}
+
+	// replacing the remotes stops following the host names, also while a writer holds the remotes
+	answers <- []net.IP{relay1}
+	idx, _ = rs.AddRemoteHost("relay.example.com", 7000, time.Hour)
+	rs.remotesMutex.RLock()
+	rs.stopRemoteHosts()
+	rs.remotesMutex.RUnlock()
+	if rs.RemoteHost(idx) != "" || len(rs.remoteHosts) != 0 {
+		t.Errorf("Stop remote hosts check failed\n")
+	}
+	answers <- []net.IP{relay1}
+	idx, _ = rs.AddRemoteHost("relay.example.com", 7000, time.Hour)
+	rs.SetSourceVerifier(func(ssrc uint32, from *Address, data bool) int { return SourceLatch })
+	rs.verifySource(0x0a0b0c0d, &Address{relay2, 7000, 0}, true)
+	if rs.RemoteHost(idx) != "" {
+		t.Errorf("Latched remote host check failed\n")
+	}
+}
+
+func TestSessionAutoPorts(t *testing.T) {
+	parseFlags()
+
+	local := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	rs, tp, err := NewSessionAutoPorts(local, 0, 0)
+	if err != nil || rs == nil {
+		t.Errorf("NewSessionAutoPorts failed: %v\n", err)
+		return
+	}
+	data, ctrl := tp.LocalPorts()
+	if data&1 != 0 || ctrl != data+1 || tp.ctrlConn.LocalAddr().(*net.UDPAddr).Port != ctrl {
+		t.Errorf("System ports check failed. Got: %d, %d\n", data, ctrl)
+	}
+	tp.CloseRecv()
+
+	// the ports in use are skipped
+	busy, err := net.ListenUDP("udp4", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		t.Errorf("ListenUDP failed: %s\n", err)
+		return
+	}
+	defer busy.Close()
+	port := busy.LocalAddr().(*net.UDPAddr).Port
+	first := port &^ 1
+	tp, err = NewTransportUDPAutoPorts(local, first, first+8)
+	if err != nil {
+		t.Logf("No free port pair near port %d: %s\n", port, err)
+		return
+	}
+	if data, ctrl = tp.LocalPorts(); data < first+2 || data&1 != 0 || ctrl != data+1 {
+		t.Errorf("Range ports check failed. Busy: %d, got: %d, %d\n", port, data, ctrl)
+	}
+	tp.CloseRecv()
+
+	if _, err = NewTransportUDPAutoPorts(local, 6000, 5000); err == nil {
+		t.Errorf("NewTransportUDPAutoPorts must fail for an invalid range\n")
+	}
+}
+
+func TestByeReconsideration(t *testing.T) {
+	parseFlags()
+
+	// Small sessions send the BYE at once
+	rs, _ := closeSession(false)
+	rs.RtcpSessionBandwidth = 1000
+	start := time.Now()
+	rs.reconsiderBye("")
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("Small session must not delay the BYE: %s\n", d)
+	}
+
+	// More BYE packets push the transmission time out: 1000 members of 100 bytes need 133 s,
+	// the randomization and the compensation reduce it to 54 s or more
+	now := time.Now()
+	atomic.StoreUint32(&rs.byeMembers, 1)
+	if wait := rs.byeWait(now.Add(-10*time.Second), now, 100); wait > 0 {
+		t.Errorf("Single member reconsideration check failed: %s\n", wait)
+	}
+	atomic.StoreUint32(&rs.byeMembers, 1000)
+	if wait := rs.byeWait(now.Add(-10*time.Second), now, 100); wait < 30*time.Second {
+		t.Errorf("Reconsideration check failed: %s\n", wait)
+	}
+
+	// A leaving member of a large session counts the BYE packets of the other members while it
+	// reconsiders its BYE
+	ct := new(closeTransport)
+	large := NewSession(ct, ct)
+	local := net.IPv4(127, 0, 0, 1)
+	large.AddRemote(&Address{local, 6002, 6003})
+	idx, _ := large.NewSsrcStreamOut(&Address{local, 6000, 6001}, 0x01020304, 1)
+	large.SsrcStreamOutForIndex(idx).SetPayloadType(0)
+	large.RtcpSessionBandwidth = 1e6
+	large.MaxNumberInStreams = 2 * byeReconsiderMembers
+	if err := large.StartSession(); err != nil {
+		t.Errorf("StartSession failed: %s\n", err)
+		return
+	}
+	for i := 0; i < byeReconsiderMembers; i++ {
+		originData(large, 0x100+uint32(i), 1, &Address{local, 6010 + 2*i, 6011 + 2*i})
+	}
+	done := make(chan error, 1)
+	start = time.Now()
+	go func() { done <- large.CloseSessionBye("", time.Second) }()
+	for atomic.LoadUint32(&large.leaving) == 0 && time.Since(start) < time.Second {
+		time.Sleep(time.Millisecond)
+	}
+	other := NewSession(new(captureWriter), new(teeConsumer))
+	for i := 0; i < 3; i++ {
+		oidx, _ := other.NewSsrcStreamOut(&Address{local, 6010 + 2*i, 6011 + 2*i}, 0x100+uint32(i), 1)
+		rc := other.buildRtcpByePkt(other.SsrcStreamOutForIndex(oidx), "bye")
+		rc.fromAddr = Address{local, 6010 + 2*i, 6011 + 2*i}
+		large.OnRecvCtrl(rc)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("CloseSessionBye failed: %s\n", err)
+	}
+	if n := atomic.LoadUint32(&large.byeMembers); n != 4 {
+		t.Errorf("BYE member count check failed: %d\n", n)
+	}
+	// the initial interval is at least 2.5 s * 0.5 / 1.21828
+	if d := time.Since(start); d < time.Second || d > byeMaxDelay {
+		t.Errorf("BYE reconsideration delay check failed: %s\n", d)
+	}
+	if len(ct.captureWriter.ctrl) == 0 {
+		t.Errorf("Large session did not send its BYE\n")
+	}
+}
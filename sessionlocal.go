@@ -23,7 +23,13 @@ package rtp
  */
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -52,6 +58,7 @@ const (
 	rtcpStopService     = 0x01000000
 	rtcpModifyInterval  = 0x02000000 // Modify RTCP timer interval, low 3 bytes contain new tick time in ms
 	rtcpIncrementSender = 0x03000000 // a stream became an active sender, count this globally
+	rtcpRemoveStreams   = 0x04000000 // remove the input streams queued by RemoveInputStream
 )
 
 // rtcpCtrlChan sends control data to the RTCP service.
@@ -85,14 +92,13 @@ func (rs *Session) rtcpService(ti, td int64) {
 	ssrcTimeout := 5 * td
 	dataTimeout := 2 * ti
 
-	rs.rtcpServiceActive = true
 	ticker := time.NewTicker(granularity)
 	var cmd uint32
 	for cmd != rtcpStopService {
 		select {
 		case <-ticker.C:
 			now := time.Now().UnixNano()
-			if now < rs.tnext {
+			if rs.tnext = rs.feedbackNext(rs.tnext); now < rs.tnext {
 				continue
 			}
 
@@ -138,8 +144,9 @@ func (rs *Session) rtcpService(ti, td int64) {
 				}
 			}
 
-			var rc *CtrlPacket
-			var streamForRR *SsrcStream
+			var rc, rcFull *CtrlPacket
+			var overflow []*CtrlPacket // compounds for the reports that don't fit into rc
+			var streamForRR, streamWithRR *SsrcStream
 			var outputSenders int
 
 			for idx, str := range rs.streamsOut {
@@ -169,8 +176,10 @@ func (rs *Session) rtcpService(ti, td int64) {
 					if str.sender {
 						if rc == nil {
 							rc = rs.buildRtcpPkt(str, inActiveSinceLastRR)
-						} else {
-							rs.addSenderReport(str, rc)
+							rcFull, streamWithRR = rc, str
+						} else if !rs.addSenderReport(str, rcFull) {
+							rcFull = rs.buildRtcpPkt(str, 0)
+							overflow = append(overflow, rcFull)
 						}
 					}
 
@@ -190,19 +199,28 @@ func (rs *Session) rtcpService(ti, td int64) {
 			// case the RTP stack in completey inactive.
 			if rc == nil && streamForRR != nil {
 				rc = rs.buildRtcpPkt(streamForRR, inActiveSinceLastRR)
+				streamWithRR = streamForRR
 			}
 			if rc != nil {
-				rs.WriteCtrl(rc)
+				overflow = append(overflow, rs.buildRtcpOverflow(streamWithRR, inActiveSinceLastRR-rc.Count(0))...)
+				for _, rcSend := range append([]*CtrlPacket{rc}, overflow...) {
+					rs.addQueuedFeedback(rcSend)
+					rs.WriteCtrl(rcSend)
+					size := float64(rcSend.InUse() + 20 + 8) // TODO: get real values for IP and transport from transport module
+					rs.avrgPacketLength = (1.0/16.0)*size + (15.0/16.0)*rs.avrgPacketLength
+				}
 				rs.tprev = now
-				size := float64(rc.InUse() + 20 + 8) // TODO: get real values for IP and transport from transport module
-				rs.avrgPacketLength = (1.0/16.0)*size + (15.0/16.0)*rs.avrgPacketLength
 
 				ti, td := rtcpInterval(outActive+inActive, int(rs.activeSenders), rs.RtcpSessionBandwidth,
 					rs.avrgPacketLength, rs.weSent, false)
 				rs.tnext = ti + now
+				rs.scheduleFeedback(now, rs.tnext)
 				dataTimeout = 2 * ti
 				ssrcTimeout = 5 * td
 				rc.FreePacket()
+				for _, rcSend := range overflow {
+					rcSend.FreePacket()
+				}
 			}
 			outActive = 0
 			inActive = 0
@@ -219,17 +237,96 @@ func (rs *Session) rtcpService(ti, td int64) {
 
 			case rtcpIncrementSender:
 				rs.activeSenders++
+
+			case rtcpRemoveStreams:
+				rs.removeQueuedStreams()
 			}
 		}
 	}
-	rs.rtcpServiceActive = false
+}
+
+// byeReconsiderMembers is the session size above which a leaving member reconsiders its BYE,
+// byeMaxDelay limits the delay of the BYE.
+const (
+	byeReconsiderMembers = 50
+	byeMaxDelay          = 10 * time.Second
+)
+
+// reconsiderBye delays the BYE of a leaving member of a large session, RFC 3550 chapter 6.3.7.
+//
+// The member restarts the interval computation as if it just joined the session: the members are
+// the BYE packets it receives from other leaving members plus one, the average RTCP size is the
+// size of its BYE. Every time the computed transmission time arrives the member reconsiders it
+// with the BYE packets it received in the meantime, more BYE packets push the transmission time
+// out.
+func (rs *Session) reconsiderBye(reason string) {
+	rs.streamsMapMutex.Lock()
+	members := len(rs.streamsOut) + len(rs.streamsIn)
+	outputs := len(rs.streamsOut)
+	rs.streamsMapMutex.Unlock()
+	if outputs == 0 || members <= byeReconsiderMembers || rs.RtcpSessionBandwidth <= 0 {
+		return
+	}
+	atomic.StoreUint32(&rs.byeMembers, 1)
+	atomic.StoreUint32(&rs.leaving, 1)
+	defer atomic.StoreUint32(&rs.leaving, 0)
+
+	size := float64(rtcpHeaderLength+rtcpSsrcLength+len(reason)+4) + 20 + 8 // BYE plus IP and UDP headers
+	tp := time.Now()
+	deadline := tp.Add(byeMaxDelay)
+	for wait := rs.byeWait(tp, tp, size); wait > 0 && time.Now().Before(deadline); wait = rs.byeWait(tp, time.Now(), size) {
+		if d := time.Until(deadline); wait > d {
+			wait = d
+		}
+		time.Sleep(wait)
+	}
+}
+
+// byeWait returns the time until the reconsidered transmission time of the BYE, zero or less if
+// the member sends its BYE now.
+//
+//   tp   - the time the member decided to leave
+//   now  - the current time
+//   size - the size of the BYE packet
+//
+func (rs *Session) byeWait(tp, now time.Time, size float64) time.Duration {
+	t, _ := rtcpInterval(int(atomic.LoadUint32(&rs.byeMembers)), 0, rs.RtcpSessionBandwidth, size, false, true)
+	return tp.Add(time.Duration(t)).Sub(now)
+}
+
+// removeQueuedStreams removes the input streams that RemoveInputStream queued. The RTCP service
+// calls it, thus the removal does not interfere with the RTCP report loop.
+func (rs *Session) removeQueuedStreams() {
+	rs.streamsMapMutex.Lock()
+	defer rs.streamsMapMutex.Unlock()
+	for _, ssrc := range rs.removedStreams {
+		rs.removeInputStream(ssrc)
+	}
+	rs.removedStreams = nil
+}
+
+// removeInputStream removes the input stream with the SSRC and updates the sender count. The
+// caller holds streamsMapMutex.
+func (rs *Session) removeInputStream(ssrc uint32) {
+	str, idx, found := rs.lookupSsrcMapIn(ssrc)
+	if !found {
+		return
+	}
+	str.streamMutex.Lock()
+	if str.sender && rs.activeSenders > 0 {
+		rs.activeSenders--
+	}
+	str.sender = false
+	str.streamMutex.Unlock()
+	delete(rs.streamsIn, idx)
 }
 
 // buildRtcpPkt creates an RTCP compound and fills it with a SR or RR packet.
 //
 // This method loops over the known input streams and fills in receiver reports.
-// the method adds a maximum of 31 receiver reports. The SR and/or RRs and the SDES
-// of the output stream always fit in the RTCP compund, thus no further checks required.
+// the method adds a maximum of 31 receiver reports and only as many as fit into the
+// maximum compound size together with the SDES of the output stream, see SetRtcpMaxSize.
+// The RTCP service sends the other receiver reports in overflow compounds.
 //
 // Other output streams just add their sender reports and SDES info.
 //
@@ -243,29 +340,15 @@ func (rs *Session) buildRtcpPkt(strOut *SsrcStream, inStreamCnt int) (rc *CtrlPa
 		var info senderInfo
 		info, offset = rc.newSenderInfo()
 		strOut.fillSenderInfo(info) // create a sender info block after fixed header and SSRC.
+		rs.fillRefClockInfo(strOut, info)
 	} else {
 		rc, offset = strOut.newCtrlPacket(RtcpRR)
 		offset = rc.addHeaderSsrc(offset, strOut.Ssrc())
 	}
 	pktLen = offset/4 - 1
-	// TODO Handle round-robin if we have more then 31 really active input streams (chap 6.4)
-	if inStreamCnt >= 31 {
-		inStreamCnt = 31
-	}
-	var rrCnt int
-	if inStreamCnt > 0 {
-		for _, strIn := range rs.streamsIn {
-			if strIn.dataAfterLastReport {
-				strIn.dataAfterLastReport = false
-				strIn.makeRecvReport(rc)
-				pktLen += reportBlockLen / 4 // increment SR/RR to include length of this recv report block
-				rrCnt++
-				if inStreamCnt--; inStreamCnt <= 0 {
-					break
-				}
-			}
-		}
-	}
+	rrCnt := rs.addRecvReports(rc, strOut, &inStreamCnt)
+	pktLen += rrCnt * reportBlockLen / 4 // increment SR/RR to include length of the recv report blocks
+
 	rc.SetLength(0, uint16(pktLen)) // length of first RTCP packet in compound: fixed header, 0 or 1 SR, n*RR
 	rc.SetCount(0, rrCnt)
 
@@ -296,7 +379,7 @@ func (rs *Session) addSdes(strOut *SsrcStream, rc *CtrlPacket) {
 		strOut.addCtrlHeader(rc, offsetSdes, RtcpSdes) // Add a RTCP SDES packet header after the SR/RR packet
 		// makeSdesChunk returns position where to append next chunk - for CSRCs that contribute to this, chap 6.5, RFC 3550
 		// CSRCs currently not supported, need additional data structures in output stream.
-		nextChunk := strOut.makeSdesChunk(rc)
+		nextChunk := strOut.makeSdesChunk(rc, &rs.sdesPrivacy)
 		rc.SetCount(offsetSdes, 1)                                   // currently one SDES chunk per SDES packet
 		rc.SetLength(offsetSdes, uint16((nextChunk-offsetSdes)/4-1)) // length of SDES packet in compound: fixed header plus SDES chunk len
 	}
@@ -306,17 +389,18 @@ func (rs *Session) addSdes(strOut *SsrcStream, rc *CtrlPacket) {
 //
 // The method just adds the sender report for the output stream. It does not loop over the
 // input streams to fill in the sreceiver reports. Only one output stream's sender report
-// contains receiver reports of our input streams.
+// contains receiver reports of our input streams. The method returns false if the sender
+// report and the SDES don't fit into the maximum compound size.
 //
-func (rs *Session) addSenderReport(strOut *SsrcStream, rc *CtrlPacket) {
+func (rs *Session) addSenderReport(strOut *SsrcStream, rc *CtrlPacket) bool {
 
 	if !strOut.sender {
-		return
+		return true
 	}
 
 	headerOffset := rc.InUse()
-	if headerOffset+strOut.sdesChunkLen+8 > len(rc.Buffer()) {
-		return
+	if !rs.rtcpFits(rc, strOut, rtcpHeaderLength+rtcpSsrcLength+senderInfoLen) {
+		return false
 	}
 	offset := strOut.addCtrlHeader(rc, headerOffset, RtcpSR)
 	rc.addHeaderSsrc(offset, strOut.Ssrc())
@@ -324,12 +408,14 @@ func (rs *Session) addSenderReport(strOut *SsrcStream, rc *CtrlPacket) {
 	var info senderInfo
 	info, offset = rc.newSenderInfo()
 	strOut.fillSenderInfo(info) // create a sender info block after fixed header and SSRC.
+	rs.fillRefClockInfo(strOut, info)
 
 	pktLen := (offset-headerOffset)/4 - 1
 	rc.SetLength(headerOffset, uint16(pktLen)) // length of RTCP packet in compound: fixed header, SR, 0*RR
 	rc.SetCount(headerOffset, 0)               // zero receiver reports in this SR
 
 	rs.addSdes(strOut, rc)
+	return true
 }
 
 // rtcpSenderCheck is a helper function for OnRecvCtrl and checks if a sender's SSRC.
@@ -337,10 +423,20 @@ func (rs *Session) addSenderReport(strOut *SsrcStream, rc *CtrlPacket) {
 func (rs *Session) rtcpSenderCheck(rp *CtrlPacket, offset int) (*SsrcStream, uint32, bool) {
 	ssrc := rp.Ssrc(offset) // get SSRC from control packet
 
+	if !rs.verifySource(ssrc, &rp.fromAddr, false) {
+		return nil, SourceRejectedCtrl, false
+	}
 	rs.streamsMapMutex.Lock()
 	str, strIdx, existing := rs.lookupSsrcMap(ssrc)
 
 	// if not found in the input stream then create a new SSRC input stream
+	if !existing && rs.role == RoleSendOnly {
+		// process the reports of the receiver without keeping a stream, see SetRole
+		rs.streamsMapMutex.Unlock()
+		str = newSsrcStreamIn(&rp.fromAddr, ssrc)
+		str.streamStatus = active
+		return str, 0, true
+	}
 	if !existing {
 		if len(rs.streamsIn) > rs.MaxNumberInStreams {
 			rs.streamsMapMutex.Unlock()
@@ -348,6 +444,7 @@ func (rs *Session) rtcpSenderCheck(rp *CtrlPacket, offset int) (*SsrcStream, uin
 		}
 		str = newSsrcStreamIn(&rp.fromAddr, ssrc)
 		str.streamStatus = active
+		rs.newInputContext(str)
 		rs.streamsIn[rs.streamInIndex] = str
 		rs.streamInIndex++
 	} else {
@@ -364,14 +461,84 @@ func (rs *Session) rtcpSenderCheck(rp *CtrlPacket, offset int) (*SsrcStream, uin
 	rs.streamsMapMutex.Unlock()
 
 	// Check if sender's SSRC collides or loops
-	if !str.checkSsrcIncomingCtrl(existing, rs, &rp.fromAddr) {
+	ok, moved := str.checkSsrcIncomingCtrl(existing, rs, &rp.fromAddr)
+	if !ok {
 		return nil, StreamCollisionLoopCtrl, false
 	}
+	if moved != nil {
+		rs.ctrlAddressChanged(str, strIdx, moved, &rp.fromAddr)
+	}
 	// record reception time
 	str.statistics.lastRtcpPacketTime = time.Now().UnixNano()
 	return str, strIdx, existing
 }
 
+// verifySource calls the source verifier if the session has no stream for the SSRC and returns
+// false if the verifier rejects the source. If the verifier latches the source verifySource sets
+// its address as the only remote address.
+//
+func (rs *Session) verifySource(ssrc uint32, from *Address, data bool) bool {
+	rs.streamsMapMutex.Lock()
+	verify := rs.sourceVerifier
+	_, _, existing := rs.lookupSsrcMap(ssrc)
+	rs.streamsMapMutex.Unlock()
+	if verify == nil || existing {
+		return true
+	}
+	switch verify(ssrc, from, data) {
+	case SourceReject:
+		return false
+	case SourceLatch:
+		addr := &Address{IpAddr: from.IpAddr, DataPort: from.DataPort, CtrlPort: from.CtrlPort}
+		if data {
+			addr.CtrlPort = addr.DataPort + 1
+		} else {
+			addr.DataPort = addr.CtrlPort - 1
+		}
+		rs.remotesMutex.Lock()
+		rs.remotes = make(remoteMap)
+		rs.remotes[rs.remoteIndex] = addr
+		rs.rtcpLatched, rs.rtcpLatchSsrc, rs.rtcpLatchIndex = !data, ssrc, rs.remoteIndex
+		rs.remoteIndex++
+		rs.remotesMutex.Unlock()
+		rs.stopRemoteHosts()
+	}
+	return true
+}
+
+// acceptPayloadType checks the payload type of a RTP packet against the filter of the input
+// stream or, if the stream has no filter, against the session's filter and counts dropped
+// packets. The caller holds streamsMapMutex.
+func (rs *Session) acceptPayloadType(str *SsrcStream, existing bool, pt byte) bool {
+	filter := rs.payloadFilter
+	if existing && str.streamType == InputStream {
+		str.streamMutex.Lock()
+		defer str.streamMutex.Unlock()
+		if str.payloadFilter != nil {
+			filter = str.payloadFilter
+		}
+		if filter != nil && !filter[pt] {
+			str.statistics.payloadTypeDrops++
+		}
+	}
+	if filter == nil || filter[pt] {
+		return true
+	}
+	rs.payloadTypeDrops++
+	return false
+}
+
+func newPayloadFilter(pts []byte) map[byte]bool {
+	if len(pts) == 0 {
+		return nil
+	}
+	filter := make(map[byte]bool, len(pts))
+	for _, pt := range pts {
+		filter[pt] = true
+	}
+	return filter
+}
+
 // sendDataCtrlEvent is a helper function to OnRecvData and sends one control event to the application
 // if the control event chanel is active.
 //
@@ -387,6 +554,131 @@ func (rs *Session) sendDataCtrlEvent(code int, ssrc, index uint32) {
 	}
 }
 
+// recordData is a helper function to OnRecvData and checks and records a RTP packet of an
+// input stream. It frees the packet and returns false if the packet must be discarded. The
+// caller holds the stream's recvMutex.
+//
+func (rs *Session) recordData(str *SsrcStream, strIdx uint32, existing bool, rp *DataPacket, now int64) bool {
+	ssrc := str.ssrc
+
+	// Before forwarding packet to next upper layer (application) for further processing:
+	// 1) check for collisions and loops. If the packet cannot be assigned to a source, it will be rejected.
+	// 2) check the source is a sufficiently well known source
+	// 3) drop duplicates, some middleboxes duplicate packets
+	// TODO: also check CSRC identifiers.
+	if !str.checkSsrcIncomingData(existing, rs, rp) {
+		// must be discarded due to collision or loop
+		rs.sendStreamCtrlEvent(StreamCollisionLoopData, str, ssrc, rs.streamInIndex-1)
+		rp.FreePacket()
+		return false
+	}
+	if str.duplicateData(rp.Sequence()) {
+		rs.sendStreamCtrlEvent(DuplicateData, str, ssrc, strIdx)
+		rp.FreePacket()
+		return false
+	}
+	prevMax := str.statistics.maxSeqNum
+	change := str.switchPayloadType(rp)
+	valid, reset := str.recordReceptionData(rp, rs, now)
+	if !valid {
+		// must be discarded due to invalid source
+		rs.sendStreamCtrlEvent(StreamCollisionLoopData, str, ssrc, rs.streamInIndex-1)
+		rp.FreePacket()
+		return false
+	}
+	if reset {
+		str.statistics.dupWindow = 0 // the sender restarted, forget its old sequence numbers
+		rs.sendStreamCtrlEvent(StreamReset, str, ssrc, strIdx)
+	}
+	if change != nil {
+		rs.sendPayloadTypeChanged(str, strIdx, change)
+	}
+	rs.checkGap(str, strIdx, prevMax, reset, rp, now)
+	str.recordSequence(rp.Sequence())
+	if rp.retransmitted {
+		str.statistics.retransmissions++
+		str.addRepair(rp, now)
+	} else {
+		str.bitrate.add(rp.inUse, now)
+		if rs.delayWindow > 0 {
+			rs.recordDelay(str, rp, now)
+		}
+	}
+	return true
+}
+
+// recoverRtx restores the original packet if the packet is a RTX packet, see SetRtxGroup. It
+// returns false if the packet is a RTX packet the session cannot recover.
+func (rs *Session) recoverRtx(rp *DataPacket) bool {
+	if rp.inUse < rtpHeaderLength {
+		return true // IsValid decides
+	}
+	rs.streamsMapMutex.Lock()
+	apt, isRtx := rs.rtxPayloadTypes[rp.PayloadType()]
+	primary, grouped := rs.rtxSsrcs[rp.Ssrc()]
+	rs.streamsMapMutex.Unlock()
+	if !isRtx {
+		return true
+	}
+	return grouped && rp.recoverRtx(primary, apt)
+}
+
+// handleNack passes the FCI of a Generic NACK to the NACK responder of the output stream.
+func (rs *Session) handleNack(ssrc uint32, fci []byte) {
+	rs.streamsMapMutex.Lock()
+	str, _, exists := rs.lookupSsrcMapOut(ssrc)
+	rs.streamsMapMutex.Unlock()
+	if !exists {
+		return
+	}
+	str.streamMutex.Lock()
+	nack := str.nack
+	str.streamMutex.Unlock()
+	if nack != nil {
+		nack.handle(fci)
+	}
+}
+
+// sendNack sends a Generic NACK for the media SSRC. The first output stream is the
+// packet sender, without an output stream the session can't send RTCP.
+func (rs *Session) sendNack(media uint32, fci []byte) {
+	rs.streamsMapMutex.Lock()
+	strOut, exists := rs.streamsOut[0]
+	rs.streamsMapMutex.Unlock()
+	if !exists {
+		return
+	}
+	rp, offset := strOut.newCtrlPacket(RtcpRtpfb)
+	rp.SetCount(0, RtpfbNack)
+	binary.BigEndian.PutUint32(rp.buffer[offset+rtcpSsrcLength:], media)
+	offset += rtcpSsrcLength + rtcpSsrcLength
+	rp.inUse = offset + copy(rp.buffer[offset:], fci)
+	rp.SetLength(0, uint16(rp.inUse/4-1))
+	rs.sendFeedback(rp)
+}
+
+// forwardData is a helper function to OnRecvData and forwards a RTP packet to the application.
+func (rs *Session) forwardData(rp *DataPacket) {
+	defer rs.profiler.measure(ProfileDeliver, rs.profiler.begin())
+	select {
+	case rs.dataReceiveChan <- rp: // forwarded packet, that's all folks
+	default:
+		rp.FreePacket() // either channel full or not created - free packet
+	}
+}
+
+// playoutData forwards a packet of the in-order delivery path, with the concealed packets of a
+// gap ahead of it if the session has a concealer.
+func (rs *Session) playoutData(rp *DataPacket) {
+	if rs.conceal == nil {
+		rs.forwardData(rp)
+		return
+	}
+	for _, out := range rs.conceal.Playout(rp) {
+		rs.forwardData(out)
+	}
+}
+
 // lookupSsrcMap returns a SsrcStream, either a SsrcStreamIn or SsrcStreamOut for a given SSRC, nil and false if none found.
 //
 func (rs *Session) lookupSsrcMap(ssrc uint32) (str *SsrcStream, idx uint32, exists bool) {
@@ -597,7 +889,7 @@ func rtcpInterval(members, senders int, rtcpBw, avrgSize float64, weSent, initia
 	 * average time between reports.
 	 */
 	t := avrgSize * float64(n) / rtcpBw
-	if t < rtcpMinTime {
+	if rtcpBw <= 0 || t < rtcpMinTime { // without a bandwidth use the minimum, not a division by zero
 		t = rtcpMinTime
 	}
 	td := int64(t * 1e9) // determinisitic interval, see chap 6.3.1, 6.3.5
@@ -638,3 +930,118 @@ func fromNtp(seconds, fraction uint32) (tm int64) {
 	tm = (int64(seconds)-ntpEpochOffset)*1e9 + n
 	return
 }
+
+// remoteHost holds the host name of a remote added with AddRemoteHost.
+type remoteHost struct {
+	host   string
+	ttl    time.Duration
+	stop   chan bool
+	lookup func(host string) ([]net.IP, error)
+}
+
+// lookupIP resolves host names, tests replace it.
+var lookupIP = net.LookupIP
+
+// resolveRemoteHost resolves a host name. It returns the current address if the name still
+// resolves to it, otherwise an address of the current address family if there is one.
+func resolveRemoteHost(lookup func(host string) ([]net.IP, error), host string, current net.IP) (net.IP, error) {
+	ips, err := lookup(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, Error("No address for host: " + host)
+	}
+	if current == nil {
+		return ips[0], nil
+	}
+	for _, ip := range ips {
+		if ip.Equal(current) {
+			return current, nil
+		}
+	}
+	for _, ip := range ips {
+		if (ip.To4() == nil) == (current.To4() == nil) {
+			return ip, nil
+		}
+	}
+	return ips[0], nil
+}
+
+// stopRemoteHost stops following the host name of the remote at the index.
+func (rs *Session) stopRemoteHost(index uint32) {
+	rs.hostsMutex.Lock()
+	defer rs.hostsMutex.Unlock()
+	if h, ok := rs.remoteHosts[index]; ok {
+		close(h.stop)
+		delete(rs.remoteHosts, index)
+	}
+}
+
+// stopRemoteHosts stops following the host names of all remotes, the session keeps their
+// current addresses. It doesn't take remotesMutex, thus it runs while writers hold it.
+func (rs *Session) stopRemoteHosts() {
+	rs.hostsMutex.Lock()
+	defer rs.hostsMutex.Unlock()
+	for index, h := range rs.remoteHosts {
+		close(h.stop)
+		delete(rs.remoteHosts, index)
+	}
+}
+
+// followRemoteHost re-resolves the host name of a remote every ttl and replaces the remote's
+// address if it changed. It stops if the remote is removed or the session closes.
+func (rs *Session) followRemoteHost(index uint32, h *remoteHost) {
+	timer := time.NewTimer(h.ttl)
+	defer timer.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-timer.C:
+		}
+		rs.remotesMutex.RLock()
+		cur := rs.remotes[index]
+		rs.remotesMutex.RUnlock()
+		if cur == nil {
+			return
+		}
+		if ip, err := resolveRemoteHost(h.lookup, h.host, cur.IpAddr); err == nil && !ip.Equal(cur.IpAddr) {
+			rs.remotesMutex.Lock()
+			if rs.remotes[index] == cur {
+				rs.remotes[index] = &Address{ip, cur.DataPort, cur.CtrlPort}
+			}
+			rs.remotesMutex.Unlock()
+		}
+		timer.Reset(h.ttl)
+	}
+}
+
+// sdesPrivacy holds the SDES privacy level of a session and the key of the hashed items.
+type sdesPrivacy struct {
+	level int
+	key   []byte
+}
+
+// sdesHashLength is the length of the hashed SDES texts, the hex encoded first 8 bytes of the
+// HMAC.
+const sdesHashLength = 16
+
+// text returns the text to send for the SDES item, false if the privacy level suppresses it.
+func (sp *sdesPrivacy) text(itemType int, text string) (string, bool) {
+	switch sp.level {
+	case SdesPrivacyCnameOnly:
+		return text, itemType == SdesCname
+	case SdesPrivacyAnonymized:
+		switch itemType {
+		case SdesCname, SdesTool:
+			return text, true
+		case SdesName, SdesEmail:
+			mac := hmac.New(sha256.New, sp.key)
+			mac.Write([]byte(text))
+			return hex.EncodeToString(mac.Sum(nil))[:sdesHashLength], true
+		}
+		return "", false
+	}
+	return text, true
+}
@@ -0,0 +1,338 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the snapshot and restore functions that support live migration
+ * of sessions, for example to hand off calls to another process during a rolling upgrade.
+ */
+
+// SnapshotVersion is the version of the snapshot format that this package writes.
+const SnapshotVersion = 1
+
+// SessionSnapshot holds the state of a session in a serializable form.
+//
+// All fields are exported and have no references to live objects (transports, channels), thus
+// applications may use encoding/json or encoding/gob to transfer a snapshot to another process.
+//
+type SessionSnapshot struct {
+	Version              int
+	RtcpSessionBandwidth float64
+	AvrgPacketLength     float64
+	WeSent               bool
+	Remotes              map[uint32]*Address
+	RemoteIndex          uint32
+	StreamsOut           map[uint32]*StreamSnapshot
+	StreamOutIndex       uint32
+	StreamsIn            map[uint32]*StreamSnapshot // the member table
+	StreamInIndex        uint32
+}
+
+// StreamSnapshot holds the state of an output or input stream.
+type StreamSnapshot struct {
+	StreamType    int
+	Status        int
+	Ssrc          uint32
+	Address              // own address of an output stream, sender's address of an input stream
+	SequenceNo    uint16 // next sequence number of an output stream, highest one of an input stream
+	PayloadType   byte
+	InitialTime   int64  // output streams: wallclock base of the RTP timestamp computation
+	InitialStamp  uint32 // output streams: the random timestamp offset
+	StampOffset   uint32 // output streams: timestamp advance of resumed streams
+	SrStampShift  uint32 // output streams: paused time not applied to the timestamps
+	Paused        bool   // output streams: the stream is paused, see PauseStream
+	PauseStart    int64  // output streams: wallclock time in nanoseconds the pause started
+	Sender        bool
+	SdesItems     map[int]string
+	CorrelationId string        `json:",omitempty"` // the CorrelationId of the stream's context
+	Origin        *SourceOrigin `json:",omitempty"` // input streams: the network origin, see SetSourceEnrichment
+	SenderInfoData
+	RecvReportData
+	Statistics *StreamStatsSnapshot `json:",omitempty"` // input streams only
+}
+
+// StreamStatsSnapshot holds the receive statistics of an input stream.
+type StreamStatsSnapshot struct {
+	LastPacketTime, LastRtcpPacketTime, InitialDataTime, LastRtcpSrTime int64
+
+	PacketCount, OctetCount, ExtendedMaxSeqNum, LastPacketTransitTime, InitialDataTimestamp uint32
+	CumulativePacketLost, Jitter                                                            uint32
+	MaxSeqNum, BaseSeqNum                                                                   uint16
+	FractionLost                                                                            uint8
+	Probation                                                                               int
+	ExpectedPrior, ReceivedPrior, BadSeqNum, SeqNumAccum                                    uint32
+	Hello                                                                                   bool
+}
+
+// Snapshot returns the current state of the session.
+//
+// The snapshot covers the remote addresses, the output streams with their SSRCs, sequence
+// numbers and timestamp offsets, the input streams (the member table) with their receive
+// statistics, and the RTCP parameters. An application that hands off a session usually stops
+// sending and closes the transports (CloseRecv) before it takes the snapshot. To migrate SRTP
+// state use the snapshot functions of TransportSRTP.
+//
+func (rs *Session) Snapshot() *SessionSnapshot {
+	rs.streamsMapMutex.Lock()
+	defer rs.streamsMapMutex.Unlock()
+
+	snap := &SessionSnapshot{Version: SnapshotVersion, RtcpSessionBandwidth: rs.RtcpSessionBandwidth,
+		AvrgPacketLength: rs.avrgPacketLength, WeSent: rs.weSent, RemoteIndex: rs.remoteIndex,
+		StreamOutIndex: rs.streamOutIndex, StreamInIndex: rs.streamInIndex}
+
+	rs.remotesMutex.RLock()
+	snap.Remotes = make(map[uint32]*Address, len(rs.remotes))
+	for idx, remote := range rs.remotes {
+		addr := *remote
+		snap.Remotes[idx] = &addr
+	}
+	rs.remotesMutex.RUnlock()
+	snap.StreamsOut = make(map[uint32]*StreamSnapshot, len(rs.streamsOut))
+	for idx, str := range rs.streamsOut {
+		snap.StreamsOut[idx] = str.snapshot()
+	}
+	snap.StreamsIn = make(map[uint32]*StreamSnapshot, len(rs.streamsIn))
+	for idx, str := range rs.streamsIn {
+		snap.StreamsIn[idx] = str.snapshot()
+	}
+	return snap
+}
+
+// Restore sets the state of the session from a snapshot.
+//
+// The application calls Restore on a new session after it created the transports and before
+// it starts the session. Restore replaces all remote addresses and streams of the session,
+// the stream indices stay the same as in the snapshot session.
+// Remotes added with AddRemoteHost keep the address of the snapshot, the session stops
+// re-resolving their host names.
+//
+func (rs *Session) Restore(snap *SessionSnapshot) error {
+	if snap == nil || snap.Version != SnapshotVersion {
+		return Error("Unsupported session snapshot version.")
+	}
+	rs.streamsMapMutex.Lock()
+	defer rs.streamsMapMutex.Unlock()
+
+	rs.RtcpSessionBandwidth = snap.RtcpSessionBandwidth
+	rs.avrgPacketLength = snap.AvrgPacketLength
+	rs.weSent = snap.WeSent
+
+	rs.remotesMutex.Lock()
+	rs.remotes = make(remoteMap, len(snap.Remotes))
+	for idx, remote := range snap.Remotes {
+		addr := *remote
+		rs.remotes[idx] = &addr
+	}
+	rs.remotesMutex.Unlock()
+	rs.stopRemoteHosts() // the snapshot holds the addresses, not the host names
+	rs.streamsOut = make(streamOutMap, len(snap.StreamsOut))
+	rs.activeSenders = 0
+	for idx, ss := range snap.StreamsOut {
+		rs.streamsOut[idx] = ss.restore()
+	}
+	rs.streamsIn = make(streamInMap, len(snap.StreamsIn))
+	for idx, ss := range snap.StreamsIn {
+		rs.streamsIn[idx] = ss.restore()
+	}
+	rs.remoteIndex = snap.RemoteIndex
+	rs.streamOutIndex = snap.StreamOutIndex
+	rs.streamInIndex = snap.StreamInIndex
+	return nil
+}
+
+func (str *SsrcStream) snapshot() *StreamSnapshot {
+	str.streamMutex.Lock()
+	defer str.streamMutex.Unlock()
+
+	ss := &StreamSnapshot{StreamType: str.streamType, Status: str.streamStatus, Ssrc: str.ssrc, Address: str.Address,
+		SequenceNo: str.sequenceNumber, PayloadType: str.payloadType, InitialTime: str.initialTime,
+		InitialStamp: str.initialStamp, StampOffset: str.stampOffset, SrStampShift: str.srStampShift, Paused: str.paused, PauseStart: str.pauseStart, Sender: str.sender, SenderInfoData: str.SenderInfoData,
+		RecvReportData: str.RecvReportData}
+	ss.CorrelationId = str.Context().CorrelationId
+	if origin, ok := str.Origin(); ok {
+		ss.Origin = &origin
+	}
+	ss.SdesItems = make(map[int]string, len(str.SdesItems))
+	for item, text := range str.SdesItems {
+		ss.SdesItems[item] = text
+	}
+	if str.streamType == InputStream {
+		st := &str.statistics
+		ss.Statistics = &StreamStatsSnapshot{st.lastPacketTime, st.lastRtcpPacketTime, st.initialDataTime, st.lastRtcpSrTime,
+			st.packetCount, st.octetCount, st.extendedMaxSeqNum, st.lastPacketTransitTime, st.initialDataTimestamp,
+			st.cumulativePacketLost, st.jitter, st.maxSeqNum, st.baseSeqNum, st.fractionLost, st.probation,
+			st.expectedPrior, st.receivedPrior, st.badSeqNum, st.seqNumAccum, st.flag}
+	}
+	return ss
+}
+
+func (ss *StreamSnapshot) restore() *SsrcStream {
+	str := new(SsrcStream)
+	str.streamType = ss.StreamType
+	str.streamStatus = ss.Status
+	str.ssrc = ss.Ssrc
+	str.Address = ss.Address
+	str.sequenceNumber = ss.SequenceNo
+	str.payloadType = ss.PayloadType
+	str.initialTime = ss.InitialTime
+	str.initialStamp = ss.InitialStamp
+	str.stampOffset = ss.StampOffset
+	str.srStampShift = ss.SrStampShift
+	str.paused = ss.Paused
+	str.pauseStart = ss.PauseStart
+	str.SenderInfoData = ss.SenderInfoData
+	str.RecvReportData = ss.RecvReportData
+	str.context.CorrelationId = ss.CorrelationId
+	if ss.Origin != nil {
+		origin := *ss.Origin
+		str.origin, str.originIp = &origin, str.IpAddr
+	}
+	str.SdesItems = make(SdesItemMap, len(ss.SdesItems))
+	for item, text := range ss.SdesItems {
+		str.SdesItems[item] = text
+	}
+	// The sender flag is not restored: the RTCP service of the new session counts the active
+	// senders again when the streams send or receive RTP packets.
+	if str.streamType == OutputStream {
+		str.SetSdesItem(SdesCname, str.SdesItems[SdesCname]) // re-computes the SDES chunk length
+	}
+	if st := ss.Statistics; st != nil {
+		str.statistics = ctrlStatistics{lastPacketTime: st.LastPacketTime, lastRtcpPacketTime: st.LastRtcpPacketTime,
+			initialDataTime: st.InitialDataTime, lastRtcpSrTime: st.LastRtcpSrTime, packetCount: st.PacketCount,
+			octetCount: st.OctetCount, extendedMaxSeqNum: st.ExtendedMaxSeqNum, lastPacketTransitTime: st.LastPacketTransitTime,
+			initialDataTimestamp: st.InitialDataTimestamp, cumulativePacketLost: st.CumulativePacketLost,
+			maxSeqNum: st.MaxSeqNum, fractionLost: st.FractionLost, jitter: st.Jitter, flag: st.Hello,
+			probation: st.Probation, baseSeqNum: st.BaseSeqNum, expectedPrior: st.ExpectedPrior,
+			receivedPrior: st.ReceivedPrior, badSeqNum: st.BadSeqNum, seqNumAccum: st.SeqNumAccum}
+	}
+	return str
+}
+
+// SrtpSnapshot holds the per SSRC state of the crypto contexts of a TransportSRTP.
+//
+// The snapshot does not contain the master keys. The application creates the SRTP transport in
+// the new process with the same keys and restores the rollover counters, SRTCP indices and
+// replay lists.
+//
+type SrtpSnapshot struct {
+	SendRtp, SendRtcp, RecvRtp, RecvRtcp map[uint32]SrtpStateSnapshot
+}
+
+// SrtpStateSnapshot holds the state of one SRTP or SRTCP stream.
+type SrtpStateSnapshot struct {
+	Started bool
+	Roc     uint32
+	LastSeq uint16
+	Index   uint64
+	Replay  uint64
+}
+
+// Snapshot returns the rollover counters, SRTCP indices and replay lists of all SSRCs, including
+// the SSRCs with their own crypto contexts.
+func (tp *TransportSRTP) Snapshot() *SrtpSnapshot {
+	snap := new(SrtpSnapshot)
+	if tp.send != nil {
+		snap.SendRtp, snap.SendRtcp = tp.send.snapshot()
+	}
+	if tp.recv != nil {
+		snap.RecvRtp, snap.RecvRtcp = tp.recv.snapshot()
+	}
+	tp.ctxMutex.RLock()
+	defer tp.ctxMutex.RUnlock()
+	snap.SendRtp, snap.SendRtcp = mergeSrtpStates(snap.SendRtp, snap.SendRtcp, tp.sendStreams)
+	snap.RecvRtp, snap.RecvRtcp = mergeSrtpStates(snap.RecvRtp, snap.RecvRtcp, tp.recvStreams)
+	return snap
+}
+
+// Restore sets the rollover counters, SRTCP indices and replay lists from a snapshot.
+//
+// The application installs the per SSRC keys (SetSendKey, SetRecvKey) before it restores the
+// snapshot.
+//
+func (tp *TransportSRTP) Restore(snap *SrtpSnapshot) {
+	if tp.send != nil {
+		tp.send.restore(snap.SendRtp, snap.SendRtcp)
+	}
+	if tp.recv != nil {
+		tp.recv.restore(snap.RecvRtp, snap.RecvRtcp)
+	}
+	tp.ctxMutex.RLock()
+	defer tp.ctxMutex.RUnlock()
+	for ssrc, ctx := range tp.sendStreams {
+		ctx.restore(selectSrtpState(snap.SendRtp, ssrc), selectSrtpState(snap.SendRtcp, ssrc))
+	}
+	for ssrc, ctx := range tp.recvStreams {
+		ctx.restore(selectSrtpState(snap.RecvRtp, ssrc), selectSrtpState(snap.RecvRtcp, ssrc))
+	}
+}
+
+// mergeSrtpStates adds the state of the SSRCs with own crypto contexts to the states of the
+// default context.
+func mergeSrtpStates(rtpStates, rtcpStates map[uint32]SrtpStateSnapshot, streams map[uint32]*srtpContext) (map[uint32]SrtpStateSnapshot, map[uint32]SrtpStateSnapshot) {
+	for ssrc, ctx := range streams {
+		rtpCtx, rtcpCtx := ctx.snapshot()
+		if rtpStates == nil {
+			rtpStates = make(map[uint32]SrtpStateSnapshot)
+			rtcpStates = make(map[uint32]SrtpStateSnapshot)
+		}
+		if st, ok := rtpCtx[ssrc]; ok {
+			rtpStates[ssrc] = st
+		}
+		if st, ok := rtcpCtx[ssrc]; ok {
+			rtcpStates[ssrc] = st
+		}
+	}
+	return rtpStates, rtcpStates
+}
+
+func selectSrtpState(states map[uint32]SrtpStateSnapshot, ssrc uint32) map[uint32]SrtpStateSnapshot {
+	if st, ok := states[ssrc]; ok {
+		return map[uint32]SrtpStateSnapshot{ssrc: st}
+	}
+	return nil
+}
+
+func (ctx *srtpContext) snapshot() (rtpStates, rtcpStates map[uint32]SrtpStateSnapshot) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	copyStates := func(states map[uint32]*srtpState) map[uint32]SrtpStateSnapshot {
+		snap := make(map[uint32]SrtpStateSnapshot, len(states))
+		for ssrc, st := range states {
+			snap[ssrc] = SrtpStateSnapshot{st.started, st.roc, st.lastSeq, st.index, st.replay}
+		}
+		return snap
+	}
+	return copyStates(ctx.rtpState), copyStates(ctx.rtcpState)
+}
+
+func (ctx *srtpContext) restore(rtpStates, rtcpStates map[uint32]SrtpStateSnapshot) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	copyStates := func(snap map[uint32]SrtpStateSnapshot) map[uint32]*srtpState {
+		states := make(map[uint32]*srtpState, len(snap))
+		for ssrc, st := range snap {
+			states[ssrc] = &srtpState{st.Started, st.Roc, st.LastSeq, st.Index, st.Replay}
+		}
+		return states
+	}
+	ctx.rtpState = copyStates(rtpStates)
+	ctx.rtcpState = copyStates(rtcpStates)
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	parseFlags()
+
+	local, _ := net.ResolveIPAddr("ip", "127.0.0.1")
+	tp, _ := NewTransportUDP(local, 54000)
+	rs := NewSession(tp, tp)
+	rs.AddRemote(&Address{local.IP, 54002, 54003})
+	strIdx, _ := rs.NewSsrcStreamOut(&Address{local.IP, 54000, 54001}, 0x01020304, 0x4711)
+	rs.SsrcStreamOutForIndex(strIdx).SetSdesItem(SdesCname, "migrate")
+	rs.SsrcStreamOutForIndex(strIdx).SetPayloadType(0)
+
+	rp := rs.NewDataPacketForStream(strIdx, 160)
+	rp.FreePacket()
+	// a second, paused stream must stay paused after the restore
+	pausedIdx, _ := rs.NewSsrcStreamOut(&Address{local.IP, 54000, 54001}, 0x01020305, 0x100)
+	rs.SsrcStreamOutForIndex(pausedIdx).SetPayloadType(0)
+	rs.PauseStream(pausedIdx)
+	pauseStart := rs.SsrcStreamOutForIndex(pausedIdx).pauseStart
+
+	data, err := json.Marshal(rs.Snapshot())
+	if err != nil {
+		t.Errorf("Snapshot marshal failed: %s\n", err)
+		return
+	}
+	snap := new(SessionSnapshot)
+	json.Unmarshal(data, snap)
+
+	tpNew, _ := NewTransportUDP(local, 54010)
+	rsNew := NewSession(tpNew, tpNew)
+	if err = rsNew.Restore(snap); err != nil {
+		t.Errorf("Restore failed: %s\n", err)
+		return
+	}
+	// the restored stream continues the sequence numbers and keeps the timestamp offset
+	str := rs.SsrcStreamOutForIndex(strIdx)
+	rpOld := rs.NewDataPacketForStream(strIdx, 320)
+	rpNew := rsNew.NewDataPacketForStream(strIdx, 320)
+	if rpNew.Ssrc() != 0x01020304 || rpNew.Sequence() != rpOld.Sequence() || rpNew.Timestamp() != rpOld.Timestamp() {
+		t.Errorf("Restored stream check failed. Expected: %x/%d/%d, got: %x/%d/%d\n", str.Ssrc(), rpOld.Sequence(),
+			rpOld.Timestamp(), rpNew.Ssrc(), rpNew.Sequence(), rpNew.Timestamp())
+	}
+	rpOld.FreePacket()
+	rpNew.FreePacket()
+	if cname := rsNew.SsrcStreamOutForIndex(strIdx).SdesItems[SdesCname]; cname != "migrate" {
+		t.Errorf("Restored SDES check failed. Got: %s\n", cname)
+	}
+	if str := rsNew.SsrcStreamOutForIndex(pausedIdx); str == nil || !str.paused || str.pauseStart != pauseStart {
+		t.Errorf("Restored pause check failed\n")
+	}
+	if remote := rsNew.remotes[0]; remote == nil || remote.DataPort != 54002 {
+		t.Errorf("Restored remote check failed\n")
+	}
+
+	// SRTP: the new transport continues with the rollover counter of the old one
+	srtpOld, _ := NewTransportSRTP(nil, nil, srtpMasterKeySalt(), nil)
+	rp = newDataPacket()
+	rp.SetSsrc(0x01020304)
+	for _, seq := range []uint16{0xffff, 0} {
+		rp.SetSequence(seq)
+		srtpOld.send.protectRtp(&rp.RawPacket)
+		rp.inUse = rtpHeaderLength
+	}
+	srtpNew, _ := NewTransportSRTP(nil, nil, srtpMasterKeySalt(), nil)
+	srtpNew.Restore(srtpOld.Snapshot())
+	if st := srtpNew.send.rtpState[0x01020304]; st == nil || st.roc != 1 || st.lastSeq != 0 {
+		t.Errorf("SRTP restore check failed. Got: %+v\n", st)
+	}
+	rp.FreePacket()
+}
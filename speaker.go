@@ -0,0 +1,229 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// AudioLevelFunc returns the audio level of a received packet in -dBov, 0 is the loudest level
+// and 127 the level of silence, false if the packet carries no level.
+type AudioLevelFunc func(rp *DataPacket) (level byte, ok bool)
+
+// ParseAudioLevel parses the client-to-mixer audio level extension, RFC 6464 chapter 3.
+//
+//   data - the extension element, see ExtensionMap.Extension and ExtAudioLevel
+//
+func ParseAudioLevel(data []byte) (level byte, voice, ok bool) {
+	if len(data) < 1 {
+		return 0, false, false
+	}
+	return data[0] & 0x7f, data[0]&0x80 != 0, true
+}
+
+// PcmLevel computes the audio level of 16 bit PCM samples in -dBov as RFC 6464 specifies it,
+// the root mean square of the samples relative to the overload point. An AudioLevelFunc may use
+// it if the senders don't send audio level extensions.
+func PcmLevel(pcm []int16) byte {
+	if len(pcm) == 0 {
+		return 127
+	}
+	var sum float64
+	for _, s := range pcm {
+		sum += float64(s) * float64(s)
+	}
+	rms := math.Sqrt(sum/float64(len(pcm))) / 32768
+	if rms == 0 {
+		return 127
+	}
+	dbov := -20 * math.Log10(rms)
+	if dbov < 0 {
+		return 0
+	}
+	if dbov > 127 {
+		return 127
+	}
+	return byte(dbov + 0.5)
+}
+
+// SpeakerDetector detects the dominant speaker of a session's input streams.
+//
+// The detector keeps a smoothed loudness of each input stream. It switches to a new dominant
+// speaker if the speaker is louder than the current one by Margin for SwitchDelay without
+// interruption, thus short noises and interjections don't switch. A speaker that stays silent for
+// the Window has no loudness, the detector keeps the dominant speaker if all streams are silent.
+// At each switch the session sends an ActiveSpeakerChanged control event with the SSRC and the
+// index of the new dominant input stream.
+//
+type SpeakerDetector struct {
+	Window      time.Duration // smoothing window of the loudness, default 400 ms
+	SwitchDelay time.Duration // time a new speaker must dominate before the switch, default 800 ms
+	Margin      float64       // loudness in dB a new speaker must exceed the current one, default 6
+	Silence     byte          // levels at or above it count as silence, default 100 (-100 dBov)
+
+	rs    *Session
+	level AudioLevelFunc
+
+	mutex          sync.Mutex
+	sources        map[uint32]*speakerSource
+	dominant       uint32
+	hasDominant    bool
+	candidate      uint32
+	candidateSince time.Time
+	switches       uint32
+}
+
+type speakerSource struct {
+	index    uint32
+	loudness float64 // smoothed 127 - level, 0 is silence
+	last     time.Time
+}
+
+// NewSpeakerDetector creates the speaker detector of the session and feeds it with the session's
+// received data packets.
+//
+//   rs    - the session
+//   level - returns the level of a packet, nil reads the ExtAudioLevel extension of the packet
+//           as registered in the session's ExtensionMap
+//
+func NewSpeakerDetector(rs *Session, level AudioLevelFunc) *SpeakerDetector {
+	sd := &SpeakerDetector{Window: 400 * time.Millisecond, SwitchDelay: 800 * time.Millisecond,
+		Margin: 6, Silence: 100, rs: rs, level: level, sources: make(map[uint32]*speakerSource)}
+	if sd.level == nil {
+		em := rs.ExtensionMap()
+		sd.level = func(rp *DataPacket) (byte, bool) {
+			level, _, ok := ParseAudioLevel(em.Extension(rp, ExtAudioLevel))
+			return level, ok
+		}
+	}
+	rs.streamsMapMutex.Lock()
+	rs.speakers = sd
+	rs.streamsMapMutex.Unlock()
+	return sd
+}
+
+// Dominant returns the SSRC of the dominant speaker, false if no one spoke yet.
+func (sd *SpeakerDetector) Dominant() (ssrc uint32, ok bool) {
+	sd.mutex.Lock()
+	defer sd.mutex.Unlock()
+	return sd.dominant, sd.hasDominant
+}
+
+// Loudness returns the current smoothed loudness of an input stream in dB above -127 dBov.
+func (sd *SpeakerDetector) Loudness(ssrc uint32) float64 {
+	sd.mutex.Lock()
+	defer sd.mutex.Unlock()
+	if src, ok := sd.sources[ssrc]; ok {
+		return sd.loudness(src, time.Now())
+	}
+	return 0
+}
+
+// Switches returns the number of dominant speaker changes.
+func (sd *SpeakerDetector) Switches() uint32 {
+	sd.mutex.Lock()
+	defer sd.mutex.Unlock()
+	return sd.switches
+}
+
+// Remove forgets an input stream, e.g. after its BYE. If it was the dominant speaker the detector
+// has no dominant speaker until the next switch.
+func (sd *SpeakerDetector) Remove(ssrc uint32) {
+	sd.mutex.Lock()
+	defer sd.mutex.Unlock()
+	delete(sd.sources, ssrc)
+	if sd.hasDominant && sd.dominant == ssrc {
+		sd.hasDominant = false
+	}
+}
+
+// *** Local functions and methods.
+
+// received updates the loudness of the packet's source and checks for a switch. OnRecvData calls
+// it for every valid data packet.
+func (sd *SpeakerDetector) received(rp *DataPacket, index uint32, now time.Time) {
+	level, ok := sd.level(rp)
+	if !ok {
+		return
+	}
+	ssrc := rp.Ssrc()
+	sd.mutex.Lock()
+	var loud float64
+	if level < sd.Silence {
+		loud = float64(127 - level)
+	}
+	weight := 1.0 // the first packet of a source sets its loudness
+	src, ok := sd.sources[ssrc]
+	if !ok {
+		src = &speakerSource{index: index}
+		sd.sources[ssrc] = src
+	} else if sd.Window > 0 {
+		weight = math.Min(1, float64(now.Sub(src.last))/float64(sd.Window))
+	}
+	src.loudness += (loud - src.loudness) * weight
+	src.last = now
+	changed, dominant, dominantIndex := sd.check(now)
+	sd.mutex.Unlock()
+
+	if changed {
+		sd.rs.sendStreamCtrlEvent(ActiveSpeakerChanged, sd.rs.lookupStream(dominant), dominant, dominantIndex)
+	}
+}
+
+// loudness returns the loudness of a source, a source without packets for the Window is silent.
+func (sd *SpeakerDetector) loudness(src *speakerSource, now time.Time) float64 {
+	if now.Sub(src.last) > sd.Window {
+		return 0
+	}
+	return src.loudness
+}
+
+// check switches the dominant speaker to the loudest source if it exceeds the current dominant
+// speaker by the margin for the switch delay.
+func (sd *SpeakerDetector) check(now time.Time) (changed bool, ssrc, index uint32) {
+	var loudest uint32
+	var max float64
+	for s, src := range sd.sources {
+		if l := sd.loudness(src, now); l > max {
+			loudest, max = s, l
+		}
+	}
+	if max == 0 || (sd.hasDominant && loudest == sd.dominant) {
+		sd.candidateSince = time.Time{}
+		return false, 0, 0
+	}
+	if sd.hasDominant {
+		if cur, ok := sd.sources[sd.dominant]; ok && max < sd.loudness(cur, now)+sd.Margin {
+			sd.candidateSince = time.Time{}
+			return false, 0, 0
+		}
+	}
+	if sd.candidateSince.IsZero() || sd.candidate != loudest {
+		sd.candidate, sd.candidateSince = loudest, now
+	}
+	if now.Sub(sd.candidateSince) < sd.SwitchDelay {
+		return false, 0, 0
+	}
+	sd.dominant, sd.hasDominant = loudest, true
+	sd.candidateSince = time.Time{}
+	sd.switches++
+	return true, loudest, sd.sources[loudest].index
+}
@@ -0,0 +1,86 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"testing"
+	"time"
+)
+
+func levelPacket(em *ExtensionMap, ssrc uint32, level byte) *DataPacket {
+	rp := newDataPacket()
+	rp.SetSsrc(ssrc)
+	em.SetExtension(rp, ExtAudioLevel, []byte{0x80 | level})
+	return rp
+}
+
+func TestSpeakerDetector(t *testing.T) {
+	parseFlags()
+
+	if PcmLevel([]int16{32767, -32767}) != 0 || PcmLevel(make([]int16, 10)) != 127 || PcmLevel([]int16{3277, -3277}) != 20 {
+		t.Errorf("PCM level check failed: %d\n", PcmLevel([]int16{3277, -3277}))
+	}
+	if level, voice, ok := ParseAudioLevel([]byte{0x9e}); !ok || !voice || level != 30 {
+		t.Errorf("Audio level parse check failed: %d\n", level)
+	}
+
+	rs := NewSession(new(captureWriter), new(teeConsumer))
+	events := rs.CreateCtrlEventChan()
+	em := rs.ExtensionMap()
+	em.Register(1, ExtAudioLevel)
+	sd := NewSpeakerDetector(rs, nil)
+
+	start := time.Unix(1000, 0)
+	// talk feeds 20 ms packets of both speakers for the duration
+	talk := func(from, duration time.Duration, levelA, levelB byte) {
+		for d := from; d < from+duration; d += 20 * time.Millisecond {
+			sd.received(levelPacket(em, 0xa, levelA), 1, start.Add(d))
+			sd.received(levelPacket(em, 0xb, levelB), 2, start.Add(d))
+		}
+	}
+	talk(0, 700*time.Millisecond, 30, 127)
+	if _, ok := sd.Dominant(); ok {
+		t.Errorf("The detector must wait for the switch delay\n")
+	}
+	talk(700*time.Millisecond, 300*time.Millisecond, 30, 127)
+	if ssrc, ok := sd.Dominant(); !ok || ssrc != 0xa {
+		t.Errorf("First speaker check failed: %x\n", ssrc)
+	}
+	select {
+	case ev := <-events:
+		if ev[0].EventType != ActiveSpeakerChanged || ev[0].Ssrc != 0xa || ev[0].Index != 1 {
+			t.Errorf("Speaker event check failed: %+v\n", ev[0])
+		}
+	default:
+		t.Errorf("Missing ActiveSpeakerChanged event\n")
+	}
+
+	// An interjection of B shorter than the switch delay, then B at a level within the margin
+	talk(time.Second, 300*time.Millisecond, 30, 5)
+	talk(1300*time.Millisecond, time.Second, 30, 27)
+	if ssrc, _ := sd.Dominant(); ssrc != 0xa || sd.Switches() != 1 {
+		t.Errorf("Hysteresis check failed, dominant: %x, switches: %d\n", ssrc, sd.Switches())
+	}
+
+	// A stops, B takes over after the delay
+	talk(2300*time.Millisecond, time.Second, 127, 27)
+	if ssrc, _ := sd.Dominant(); ssrc != 0xb || sd.Switches() != 2 {
+		t.Errorf("Speaker switch check failed, dominant: %x, switches: %d\n", ssrc, sd.Switches())
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// Key derivation test vectors of RFC 3711, appendix B.3
+var srtpMasterKey, _ = hex.DecodeString("E1F97A0D3E018BE0D64FA32C06DE4139")
+var srtpMasterSalt, _ = hex.DecodeString("0EC675AD498AFEEBB6960B3AABE6")
+
+func srtpMasterKeySalt() []byte {
+	return append(append([]byte{}, srtpMasterKey...), srtpMasterSalt...)
+}
+
+func srtpKeyDerivation(t *testing.T) {
+	master, _ := aes.NewCipher(srtpMasterKey)
+
+	vectors := []struct {
+		label  byte
+		length int
+		expect string
+	}{
+		{srtpLabelRtpEncryption, SrtpMasterKeyLength, "c61e7a93744f39ee10734afe3ff7a087"},
+		{srtpLabelRtpSalt, SrtpMasterSaltLength, "30cbbc08863d8c85d49db34a9ae1"},
+		{srtpLabelRtpAuth, srtpAuthKeyLength, "cebe321f6ff7716b6fd4ab49af256a156d38baa4"},
+	}
+	for _, v := range vectors {
+		key := hex.EncodeToString(srtpDeriveKey(master, srtpMasterSalt, v.label, v.length))
+		if key != v.expect {
+			t.Errorf("Key derivation for label %d failed. Expected: %s, got: %s\n", v.label, v.expect, key)
+		}
+	}
+}
+
+func srtpRoundTrip(t *testing.T) {
+	send, err := newSrtpContext(srtpMasterKeySalt())
+	if err != nil {
+		t.Errorf("newSrtpContext failed: %s\n", err)
+		return
+	}
+	recv, _ := newSrtpContext(srtpMasterKeySalt())
+
+	payload := []byte("0123456789abcdef0123456789abcdef")
+	for _, seq := range []uint16{0xfffe, 0xffff, 0, 1} {
+		rp := newDataPacket()
+		rp.SetSsrc(0x01020304)
+		rp.SetSequence(seq)
+		rp.SetPayload(payload)
+		plainLen := rp.inUse
+
+		send.protectRtp(&rp.RawPacket)
+		if rp.inUse != plainLen+srtpAuthTagLength {
+			t.Errorf("SRTP packet length check failed. Expected: %d, got: %d\n", plainLen+srtpAuthTagLength, rp.inUse)
+		}
+		if bytes.Equal(rp.Payload(), payload) {
+			t.Errorf("SRTP payload not encrypted, sequence: %d\n", seq)
+		}
+		protected := append([]byte{}, rp.buffer[0:rp.inUse]...)
+
+		if recv.unprotectRtp(&rp.RawPacket) != 0 {
+			t.Errorf("SRTP unprotect failed, sequence: %d\n", seq)
+		}
+		if !bytes.Equal(rp.Payload(), payload) {
+			t.Errorf("SRTP payload check failed, sequence: %d\n", seq)
+		}
+		// replayed packet must fail
+		rp.inUse = copy(rp.buffer, protected)
+		if recv.unprotectRtp(&rp.RawPacket) != SrtpReplay {
+			t.Errorf("SRTP replay check failed, sequence: %d\n", seq)
+		}
+		rp.FreePacket()
+	}
+	if recv.rtpState[0x01020304].roc != 1 {
+		t.Errorf("SRTP rollover counter check failed. Expected: 1, got: %d\n", recv.rtpState[0x01020304].roc)
+	}
+
+	// RTCP: protect a receiver report, modify a byte, expect authentication failure
+	rc, offset := newCtrlPacket()
+	rc.SetType(0, RtcpRR)
+	rc.addHeaderSsrc(offset, 0x05060708)
+	rc.SetLength(0, 1)
+	report := append([]byte{}, rc.buffer[0:rc.inUse]...)
+
+	send.protectRtcp(&rc.RawPacket)
+	protected := append([]byte{}, rc.buffer[0:rc.inUse]...)
+	if recv.unprotectRtcp(&rc.RawPacket) != 0 || !bytes.Equal(rc.buffer[0:rc.inUse], report) {
+		t.Errorf("SRTCP round trip failed\n")
+	}
+	rc.inUse = copy(rc.buffer, protected)
+	rc.buffer[2] ^= 0x01
+	if recv.unprotectRtcp(&rc.RawPacket) == 0 {
+		t.Errorf("SRTCP authentication check failed\n")
+	}
+	rc.FreePacket()
+}
+
+func srtpFailures(t *testing.T) {
+	key := srtpMasterKeySalt()
+	tp, _ := NewTransportSRTP(nil, nil, nil, key)
+	var reports []SrtpFailure
+	tp.SetFailureHandler(func(f SrtpFailure) { reports = append(reports, f) }, time.Hour)
+
+	send, _ := newSrtpContext(key)
+	wrongKey := append([]byte{}, key...)
+	wrongKey[0] ^= 0xff
+	wrong, _ := newSrtpContext(wrongKey)
+
+	packet := func(ctx *srtpContext, seq uint16) *DataPacket {
+		rp := newDataPacket()
+		rp.SetSsrc(0x01020304)
+		rp.SetSequence(seq)
+		rp.SetPayload([]byte("0123456789"))
+		ctx.protectRtp(&rp.RawPacket)
+		return rp
+	}
+	tp.OnRecvData(packet(send, 100)) // no upper layer, the packet is valid but dropped
+	for seq := uint16(101); seq < 104; seq++ {
+		tp.OnRecvData(packet(wrong, seq))
+	}
+	// the sender's rollover counter is one ahead
+	send.rtpState[0x01020304].roc = 1
+	tp.OnRecvData(packet(send, 104))
+
+	rtp, _ := tp.Failures()
+	if rtp.AuthFailure != 3 || rtp.RocMismatch != 1 {
+		t.Errorf("SRTP failure counts check failed. Got: %+v\n", rtp)
+	}
+	// the handler reports once per interval and SSRC
+	if len(reports) != 1 || reports[0].Reason != SrtpAuthFailure || reports[0].Ssrc != 0x01020304 || reports[0].Count != 1 {
+		t.Errorf("SRTP failure report check failed. Got: %+v\n", reports)
+	}
+	tp.SetFailureHandler(func(f SrtpFailure) { reports = append(reports, f) }, 0)
+	tp.OnRecvData(packet(wrong, 105))
+	if len(reports) != 2 || reports[1].Reason != SrtpAuthFailure {
+		t.Errorf("SRTP second failure report check failed. Got: %+v\n", reports)
+	}
+
+	// forged packets with random SSRCs must not grow the reports without limit
+	reports = nil
+	tp.SetFailureHandler(func(f SrtpFailure) { reports = append(reports, f) }, time.Hour)
+	for i := 0; i < 4*maxFailureReports; i++ {
+		rp := packet(wrong, uint16(200+i))
+		rp.SetSsrc(uint32(0x10000000 + i))
+		tp.OnRecvData(rp)
+	}
+	if len(tp.failureReports) != maxFailureReports || len(reports) != maxFailureReports+1 {
+		t.Errorf("SRTP failure report limit check failed. Tracked: %d, reports: %d\n", len(tp.failureReports), len(reports))
+	}
+	if last := reports[len(reports)-1]; last.Ssrc != 0x10000000+maxFailureReports {
+		t.Errorf("SRTP overflow report check failed. Got: %+v\n", last)
+	}
+}
+
+func srtpStreamKeys(t *testing.T) {
+	key := srtpMasterKeySalt()
+	otherKey := append([]byte{}, key...)
+	otherKey[0] ^= 0xff
+
+	// the sender uses the default key for one SSRC and another key for the second SSRC
+	capture := new(captureWriter)
+	sender, _ := NewTransportSRTP(nil, capture, key, nil)
+	sender.SetSendKey(0x05060708, otherKey)
+	receiver, _ := NewTransportSRTP(nil, nil, nil, key)
+	receiver.SetRecvKey(0x05060708, otherKey)
+	upper := new(teeConsumer)
+	receiver.SetCallUpper(upper)
+
+	for _, ssrc := range []uint32{0x01020304, 0x05060708} {
+		rp := newDataPacket()
+		rp.SetSsrc(ssrc)
+		rp.SetSequence(1)
+		rp.SetPayload([]byte("0123456789"))
+		sender.WriteDataTo(rp, nil)
+		rp.FreePacket()
+	}
+	for _, buf := range capture.data {
+		rp, _ := NewDataPacketFromBuffer(buf)
+		receiver.OnRecvData(rp)
+	}
+	if len(upper.data) != 2 || !bytes.Equal(upper.data[1].Payload(), []byte("0123456789")) {
+		t.Errorf("SRTP per SSRC key check failed, got %d packets\n", len(upper.data))
+	}
+	if snap := receiver.Snapshot(); snap.RecvRtp[0x05060708].LastSeq != 1 || snap.RecvRtp[0x01020304].LastSeq != 1 {
+		t.Errorf("SRTP per SSRC snapshot check failed. Got: %+v\n", snap.RecvRtp)
+	}
+	// after removing the context the receiver uses the default key and rejects the packet
+	receiver.RemoveRecvKey(0x05060708)
+	rp := newDataPacket()
+	rp.SetSsrc(0x05060708)
+	rp.SetSequence(2)
+	rp.SetPayload([]byte("0123456789"))
+	capture.data = nil
+	sender.WriteDataTo(rp, nil)
+	rp, _ = NewDataPacketFromBuffer(capture.data[0])
+	receiver.OnRecvData(rp)
+	if rtp, _ := receiver.Failures(); rtp.AuthFailure != 1 {
+		t.Errorf("SRTP removed key check failed. Got: %+v\n", rtp)
+	}
+
+	// without a default key the packets of other SSRCs neither pass unauthenticated nor go
+	// out unprotected
+	keyed, _ := NewTransportSRTP(nil, capture, nil, nil)
+	keyed.SetRecvKey(0x05060708, otherKey)
+	keyed.SetSendKey(0x05060708, otherKey)
+	upper = new(teeConsumer)
+	keyed.SetCallUpper(upper)
+	rp = newDataPacket()
+	rp.SetSsrc(0x01020304)
+	rp.SetSequence(3)
+	rp.SetPayload([]byte("0123456789"))
+	if _, err := keyed.WriteDataTo(rp, nil); err == nil {
+		t.Errorf("SRTP send without a key for the SSRC must fail\n")
+	}
+	rc, _ := newCtrlPacket()
+	rc.SetSsrc(0, 0x01020304)
+	rc.inUse = rtcpHeaderLength + rtcpSsrcLength
+	if _, err := keyed.WriteCtrlTo(rc, nil); err == nil {
+		t.Errorf("SRTCP send without a key for the SSRC must fail\n")
+	}
+	keyed.OnRecvData(rp)
+	keyed.OnRecvCtrl(rc)
+	if rtp, rtcp := keyed.Failures(); len(upper.data) != 0 || len(upper.ctrl) != 0 || rtp.NoKey != 1 || rtcp.NoKey != 1 {
+		t.Errorf("SRTP receive without a key for the SSRC check failed. Got: %+v, %+v\n", rtp, rtcp)
+	}
+}
+
+func TestSrtp(t *testing.T) {
+	parseFlags()
+	srtpKeyDerivation(t)
+	srtpRoundTrip(t)
+	srtpFailures(t)
+	srtpStreamKeys(t)
+	srtpForgedSsrcs(t)
+}
+
+// srtpForgedSsrcs checks that packets that fail the authentication don't add SSRC states.
+func srtpForgedSsrcs(t *testing.T) {
+	recv, _ := newSrtpContext(srtpMasterKeySalt())
+	for i := 0; i < 100; i++ {
+		rp := newDataPacket()
+		rp.SetSsrc(0x10000 + uint32(i))
+		rp.SetSequence(uint16(i))
+		rp.SetPayload(make([]byte, 20+srtpAuthTagLength))
+		if recv.unprotectRtp(&rp.RawPacket) != SrtpAuthFailure {
+			t.Errorf("forged SRTP packet was not rejected\n")
+		}
+		rp.FreePacket()
+
+		rc, offset := newCtrlPacket()
+		rc.SetType(0, RtcpRR)
+		rc.addHeaderSsrc(offset, 0x10000+uint32(i))
+		rc.SetLength(0, 1)
+		rc.inUse += srtcpIndexLength + srtpAuthTagLength
+		if recv.unprotectRtcp(&rc.RawPacket) != SrtpAuthFailure {
+			t.Errorf("forged SRTCP packet was not rejected\n")
+		}
+		rc.FreePacket()
+	}
+	if len(recv.rtpState) != 0 || len(recv.rtcpState) != 0 {
+		t.Errorf("forged packets added states: %d RTP, %d RTCP\n", len(recv.rtpState), len(recv.rtcpState))
+	}
+	send, _ := newSrtpContext(srtpMasterKeySalt())
+	rp := newDataPacket()
+	rp.SetSsrc(0x01020304)
+	rp.SetPayload(make([]byte, 20))
+	send.protectRtp(&rp.RawPacket)
+	if recv.unprotectRtp(&rp.RawPacket) != 0 || len(recv.rtpState) != 1 {
+		t.Errorf("authenticated packet check failed: %d states\n", len(recv.rtpState))
+	}
+	rp.FreePacket()
+}
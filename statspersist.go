@@ -0,0 +1,217 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the periodic persistence of the stream statistics.
+ */
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// StatsRecord holds the statistics of one stream at one time in a serializable form. The
+// records of a stream share the SSRC and the stream's CorrelationId, trending tools join the
+// records of a call across process restarts with them.
+type StatsRecord struct {
+	Time          int64  // the time of the record in nanoseconds
+	Label         string `json:",omitempty"` // the label of the persister, see SetLabel
+	Index         uint32 // the stream's index in the session
+	Ssrc          uint32
+	StreamType    int
+	Cname         string        `json:",omitempty"`
+	CorrelationId string        `json:",omitempty"` // the CorrelationId of the stream's context
+	Origin        *SourceOrigin `json:",omitempty"` // input streams: the network origin
+	Statistics    StreamStatistics
+	Bitrate       BitrateStats
+	Repair        RepairStats
+	LastActivity  int64
+}
+
+// StatsSink receives the records of all streams of one persistence run. It runs on the
+// persister's goroutine.
+type StatsSink func(records []StatsRecord) error
+
+// StatsPersister writes the statistics of a session's streams to a sink at a fixed interval.
+//
+// The counters of a session live in memory and end with the process. Long-term QoE trending
+// needs the history, a StatsPersister serializes it to a callback, an io.Writer, see
+// JsonLinesSink, or a file, see StatsFileSink. Call Flush before the process ends to write the
+// final counters.
+//
+type StatsPersister struct {
+	rs       *Session
+	interval time.Duration
+	sink     StatsSink
+
+	mutex  sync.Mutex
+	label  string
+	stop   chan bool
+	err    error
+	errors uint64
+}
+
+// NewStatsPersister creates a persister for the streams of a session. It returns an error if
+// the interval is not positive or the sink is nil.
+//
+//   rs       - the session of the streams
+//   interval - the time between two persistence runs, e.g. 1 minute
+//   sink     - the sink of the records
+//
+func NewStatsPersister(rs *Session, interval time.Duration, sink StatsSink) (*StatsPersister, error) {
+	if interval <= 0 {
+		return nil, Error("StatsPersister: interval must be positive.")
+	}
+	if sink == nil {
+		return nil, Error("StatsPersister: no sink.")
+	}
+	return &StatsPersister{rs: rs, interval: interval, sink: sink}, nil
+}
+
+// SetLabel sets the label of the records, e.g. the name of the session or the host.
+func (sp *StatsPersister) SetLabel(label string) {
+	sp.mutex.Lock()
+	sp.label = label
+	sp.mutex.Unlock()
+}
+
+// Start starts the persistence runs, the first one is an interval from now.
+func (sp *StatsPersister) Start() {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	if sp.stop != nil {
+		return
+	}
+	sp.stop = make(chan bool)
+	go sp.run(sp.stop)
+}
+
+// Stop stops the persistence runs. It does not write the current counters, see Flush.
+func (sp *StatsPersister) Stop() {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	if sp.stop != nil {
+		close(sp.stop)
+		sp.stop = nil
+	}
+}
+
+// Flush writes the records of all streams now and returns the sink's error.
+func (sp *StatsPersister) Flush() error {
+	return sp.persist(time.Now())
+}
+
+// Errors returns the number of failed persistence runs and the last error of the sink.
+func (sp *StatsPersister) Errors() (count uint64, last error) {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	return sp.errors, sp.err
+}
+
+func (sp *StatsPersister) run(stop chan bool) {
+	ticker := time.NewTicker(sp.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			sp.persist(now)
+		}
+	}
+}
+
+// persist writes the records of the input and output streams to the sink.
+func (sp *StatsPersister) persist(now time.Time) error {
+	sp.mutex.Lock()
+	label := sp.label
+	sp.mutex.Unlock()
+
+	infos := append(sp.rs.InputStreams(), sp.rs.OutputStreams()...)
+	records := make([]StatsRecord, len(infos))
+	for i := range infos {
+		info := &infos[i]
+		records[i] = StatsRecord{Time: now.UnixNano(), Label: label, Index: info.Index, Ssrc: info.Ssrc,
+			StreamType: info.StreamType, Cname: info.SdesItems[SdesCname], CorrelationId: info.Context.CorrelationId,
+			Origin: info.Origin, Statistics: info.Statistics, Bitrate: info.Bitrate, Repair: info.Repair,
+			LastActivity: info.LastActivity}
+	}
+	err := sp.sink(records)
+	if err != nil {
+		sp.mutex.Lock()
+		sp.err = err
+		sp.errors++
+		sp.mutex.Unlock()
+	}
+	return err
+}
+
+// JsonLinesSink returns a sink that writes each record as one line of JSON to the writer.
+func JsonLinesSink(w io.Writer) StatsSink {
+	var mutex sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(records []StatsRecord) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for i := range records {
+			if err := enc.Encode(&records[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// StatsFileSink opens or creates the file and returns a sink that appends the records as JSON
+// lines, see JsonLinesSink. A restarted process continues the file. The application closes the
+// file after the persister stopped.
+//
+func StatsFileSink(path string) (StatsSink, io.Closer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return JsonLinesSink(f), f, nil
+}
+
+// ReadStatsRecords reads the JSON lines of a sink, e.g. to continue a trend after a restart.
+// A truncated last line, the result of a crash, ends the records without an error.
+//
+func ReadStatsRecords(r io.Reader) (records []StatsRecord, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err != nil {
+			return records, err // the malformed line was not the last one
+		}
+		var rec StatsRecord
+		if err = json.Unmarshal(scanner.Bytes(), &rec); err == nil {
+			records = append(records, rec)
+		}
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,123 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsPersister(t *testing.T) {
+	parseFlags()
+
+	rs, _ := drainedSession(t)
+	if _, err := NewStatsPersister(rs, 0, JsonLinesSink(new(bytes.Buffer))); err == nil {
+		t.Errorf("NewStatsPersister accepted a zero interval\n")
+	}
+	if _, err := NewStatsPersister(rs, time.Second, nil); err == nil {
+		t.Errorf("NewStatsPersister accepted a nil sink\n")
+	}
+
+	var buf bytes.Buffer
+	sp, _ := NewStatsPersister(rs, time.Second, JsonLinesSink(&buf))
+	sp.SetLabel("node-1")
+	if err := sp.Flush(); err != nil {
+		t.Errorf("Flush failed: %s\n", err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 2 {
+		t.Errorf("JSON lines check failed: %d lines\n", lines)
+	}
+	records, err := ReadStatsRecords(&buf)
+	if err != nil || len(records) != 2 {
+		t.Errorf("ReadStatsRecords failed: %d records, %v\n", len(records), err)
+		return
+	}
+	ssrcs := map[uint32]bool{}
+	for _, rec := range records {
+		ssrcs[rec.Ssrc] = true
+		if rec.Label != "node-1" || rec.StreamType != OutputStream || rec.Time == 0 {
+			t.Errorf("record check failed: %+v\n", rec)
+		}
+	}
+	if !ssrcs[0x01020304] || !ssrcs[0x05060708] {
+		t.Errorf("record SSRCs check failed: %v\n", ssrcs)
+	}
+
+	// the periodic runs
+	runs := make(chan int, 8)
+	sp, _ = NewStatsPersister(rs, 10*time.Millisecond, func(records []StatsRecord) error {
+		runs <- len(records)
+		return Error("sink failed")
+	})
+	sp.Start()
+	select {
+	case n := <-runs:
+		if n != 2 {
+			t.Errorf("periodic run check failed: %d records\n", n)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no periodic run\n")
+	}
+	<-runs // the second run starts after the first one recorded its error
+	sp.Stop()
+	if count, last := sp.Errors(); count == 0 || last == nil {
+		t.Errorf("Errors check failed: %d, %v\n", count, last)
+	}
+}
+
+func TestStatsFileSink(t *testing.T) {
+	parseFlags()
+
+	dir, err := os.MkdirTemp("", "gortp-stats")
+	if err != nil {
+		t.Errorf("MkdirTemp failed: %s\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.jsonl")
+
+	// two process runs append to the same file
+	for run := 0; run < 2; run++ {
+		sink, closer, err := StatsFileSink(path)
+		if err != nil {
+			t.Errorf("StatsFileSink failed: %s\n", err)
+			return
+		}
+		sink([]StatsRecord{{Time: int64(run + 1), Ssrc: 0x11}})
+		closer.Close()
+	}
+	// a crash leaves a truncated last line
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"Time":3,"Ss`)
+	f.Close()
+
+	f, _ = os.Open(path)
+	records, err := ReadStatsRecords(f)
+	f.Close()
+	if err != nil || len(records) != 2 || records[0].Time != 1 || records[1].Time != 2 {
+		t.Errorf("file records check failed: %+v, %v\n", records, err)
+	}
+	if _, err := ReadStatsRecords(strings.NewReader("{x\n{\"Time\":1}\n")); err == nil {
+		t.Errorf("ReadStatsRecords accepted a malformed line\n")
+	}
+}
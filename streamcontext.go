@@ -0,0 +1,112 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the application's context of the streams: a correlation ID and
+ * arbitrary data, for example the call and the tenant, that the session copies into the
+ * events, the stream information and the snapshots of the stream.
+ */
+
+// StreamContext is the application's context of a stream.
+//
+// The session doesn't interpret the context. It copies the context into the control events
+// of the stream, into StreamInfo and, the correlation ID only, into the StreamSnapshot, thus
+// an application that logs or exports these doesn't need its own SSRC to call mapping.
+type StreamContext struct {
+	CorrelationId string      // e.g. a call ID, a log and metrics friendly string
+	Value         interface{} // arbitrary data of the application, e.g. the tenant
+}
+
+// InputContextFunc returns the context of a new input stream. The session calls it while it
+// holds its stream table, the function must not call methods of the session.
+type InputContextFunc func(ssrc uint32, from *Address) StreamContext
+
+// SetContext sets the application's context of the stream, see StreamContext.
+//
+// The NewStreamData and NewStreamCtrl events of an input stream carry the context only if the
+// session's InputContextFunc sets it, later events carry the context that SetContext set.
+//
+func (str *SsrcStream) SetContext(ctx StreamContext) {
+	str.contextMutex.Lock()
+	str.context = ctx
+	str.contextMutex.Unlock()
+}
+
+// Context returns the application's context of the stream.
+func (str *SsrcStream) Context() StreamContext {
+	if str == nil {
+		return StreamContext{}
+	}
+	str.contextMutex.Lock()
+	defer str.contextMutex.Unlock()
+	return str.context
+}
+
+// SetInputContext sets the function that returns the context of new input streams, nil
+// removes it. Set the function before the session starts.
+//
+//   fn - called once for each new input stream, before the session sends the new stream event
+//
+func (rs *Session) SetInputContext(fn InputContextFunc) {
+	rs.inputContext = fn
+}
+
+// *** Local functions and methods.
+
+// newInputContext sets the context of a new input stream. The caller holds streamsMapMutex.
+func (rs *Session) newInputContext(str *SsrcStream) {
+	if rs.inputContext != nil {
+		str.context = rs.inputContext(str.ssrc, &str.Address)
+	}
+	rs.enrichSource(str)
+}
+
+// sendStreamCtrlEvent sends an event of a known stream with the stream's context. The stream
+// may be nil, the event has no context then.
+func (rs *Session) sendStreamCtrlEvent(code int, str *SsrcStream, ssrc, index uint32) {
+	ctrlEv := newCrtlEvent(code, ssrc, index)
+	ctrlEv.Context = str.Context()
+	select {
+	case rs.ctrlEventChan <- []*CtrlEvent{ctrlEv}: // send control event
+	default:
+	}
+}
+
+// lookupStream returns the output or input stream of the SSRC, nil if the session has none.
+func (rs *Session) lookupStream(ssrc uint32) *SsrcStream {
+	rs.streamsMapMutex.Lock()
+	defer rs.streamsMapMutex.Unlock()
+	str, _, _ := rs.lookupSsrcMap(ssrc)
+	return str
+}
+
+// addEventContext sets the context of the events from the streams of their SSRC.
+func (rs *Session) addEventContext(ctrlEvArr []*CtrlEvent) {
+	if len(ctrlEvArr) == 0 {
+		return
+	}
+	rs.streamsMapMutex.Lock()
+	defer rs.streamsMapMutex.Unlock()
+	for _, ctrlEv := range ctrlEvArr {
+		if str, _, exists := rs.lookupSsrcMap(ctrlEv.Ssrc); exists {
+			ctrlEv.Context = str.Context()
+		}
+	}
+}
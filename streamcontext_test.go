@@ -0,0 +1,101 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+type tenant struct {
+	name string
+}
+
+// contextEvents reads the pending events and returns the contexts of the stream's events.
+func contextEvents(events CtrlEventChan, ssrc uint32) (found map[int]StreamContext) {
+	found = make(map[int]StreamContext)
+	for {
+		select {
+		case evs := <-events:
+			for _, ev := range evs {
+				if ev.Ssrc == ssrc {
+					found[ev.EventType] = ev.Context
+				}
+			}
+		default:
+			return
+		}
+	}
+}
+
+func TestStreamContext(t *testing.T) {
+	parseFlags()
+
+	rs, _ := drainedSession(t)
+	events := rs.CreateCtrlEventChan()
+	acme := &tenant{"acme"}
+	rs.SetInputContext(func(ssrc uint32, from *Address) StreamContext {
+		return StreamContext{CorrelationId: "call-1", Value: acme}
+	})
+	from := &Address{IpAddr: net.IPv4(127, 0, 0, 1), DataPort: 6002, CtrlPort: 6003}
+	const ssrc = 0x0a0b0c0d
+
+	// the context of the input context function is in the new stream event and the later ones
+	quirkData(rs, ssrc, 1, from)
+	quirkData(rs, ssrc, 1, from)
+	found := contextEvents(events, ssrc)
+	for _, code := range []int{NewStreamData, DuplicateData} {
+		if ctx, ok := found[code]; !ok || ctx.CorrelationId != "call-1" || ctx.Value != acme {
+			t.Errorf("Data event %d context check failed. Got: %v\n", code, ctx)
+		}
+	}
+	str, _, _ := rs.lookupSsrcMapIn(ssrc)
+	str.SetContext(StreamContext{CorrelationId: "call-2"})
+	srCheckReport(rs, ssrc, 1, 160, from)
+	if ctx, ok := contextEvents(events, ssrc)[RtcpSR]; !ok || ctx.CorrelationId != "call-2" || ctx.Value != nil {
+		t.Errorf("Control event context check failed. Got: %v\n", ctx)
+	}
+	if in := rs.InputStreams(); len(in) != 1 || in[0].Context.CorrelationId != "call-2" {
+		t.Errorf("Input stream info context check failed\n")
+	}
+
+	// output streams: the stream info and the snapshot keep the correlation ID
+	rs.SsrcStreamOutForIndex(0).SetContext(StreamContext{CorrelationId: "call-3", Value: acme})
+	for _, info := range rs.OutputStreams() {
+		if (info.Index == 0) != (info.Context.CorrelationId == "call-3" && info.Context.Value == acme) {
+			t.Errorf("Output stream %d info context check failed\n", info.Index)
+		}
+	}
+	data, err := json.Marshal(rs.Snapshot())
+	if err != nil {
+		t.Errorf("Snapshot marshal failed: %s\n", err)
+		return
+	}
+	snap := new(SessionSnapshot)
+	json.Unmarshal(data, snap)
+	rsNew, _ := closeSession(false)
+	if err = rsNew.Restore(snap); err != nil {
+		t.Errorf("Restore failed: %s\n", err)
+		return
+	}
+	if ctx := rsNew.SsrcStreamOutForIndex(0).Context(); ctx.CorrelationId != "call-3" || ctx.Value != nil {
+		t.Errorf("Restored context check failed. Got: %v\n", ctx)
+	}
+}
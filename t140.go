@@ -0,0 +1,243 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the real-time text support of RFC 4103: T.140 text in RTP, with
+ * RFC 2198 redundancy, and the loss-tolerant reassembly of the received text.
+ */
+
+import (
+	"strings"
+)
+
+const (
+	defaultT140Generations = 2         // redundant generations, RFC 4103 chapter 4
+	maxRedOffset           = 1<<14 - 1 // 14 bit timestamp offset of a RFC 2198 block
+	maxRedLength           = 1<<10 - 1 // 10 bit length of a RFC 2198 block
+	t140LossMarker         = "\uFFFD"  // inserted for text that redundancy did not recover
+)
+
+// t140Block is the text of one packet, the sender's redundancy history.
+type t140Block struct {
+	stamp uint32
+	text  []byte
+}
+
+// T140Sender sends real-time text on an output stream, RFC 4103.
+//
+// If the stream's payload format is "red" the sender packs the new text as primary block and
+// the text of the previous packets as redundant blocks, RFC 2198, the payload type of the
+// blocks is the "t140" format of PayloadFormatMap. With the "t140" format the packets carry
+// the new text only. The application calls Send every buffering interval, usually 300 ms,
+// with the text typed since, and keeps calling it with empty text while Pending reports
+// redundant text that was not repeated often enough.
+type T140Sender struct {
+	rs          *Session
+	streamIndex uint32
+	red         bool
+	t140Pt      byte
+	generations int
+	history     []t140Block // the newest block last
+}
+
+// NewT140Sender creates a real-time text sender for an output stream.
+//
+//   rs          - the session of the stream
+//   streamIndex - the index of the output stream as returned by NewSsrcStreamOut, its payload type is "red" or "t140"
+//   generations - the redundant generations with "red", 0 selects 2
+//
+func NewT140Sender(rs *Session, streamIndex uint32, generations int) (*T140Sender, error) {
+	str := rs.SsrcStreamOutForIndex(streamIndex)
+	if str == nil {
+		return nil, Error("No output stream at this index.")
+	}
+	t140Pt, ok := lookupPayloadName("t140")
+	if !ok {
+		return nil, Error("No t140 payload format.")
+	}
+	ts := &T140Sender{rs: rs, streamIndex: streamIndex, t140Pt: t140Pt, generations: generations}
+	pf := PayloadFormatMap[int(str.PayloadType())]
+	switch {
+	case pf != nil && strings.EqualFold(pf.Name, "red"):
+		ts.red = true
+		if ts.generations <= 0 {
+			ts.generations = defaultT140Generations
+		}
+	case pf != nil && strings.EqualFold(pf.Name, "t140"):
+		ts.generations = 0
+	default:
+		return nil, Error("Output stream has no red or t140 payload format.")
+	}
+	return ts, nil
+}
+
+// Send sends a packet with the new text and the redundant text of the previous packets. The
+// first packet after an idle period has the marker bit.
+//
+//   text  - the UTF-8 text typed since the previous call, may be empty
+//   stamp - the RTP timestamp of the packet, the t140 clock rate is 1000 Hz
+//
+func (ts *T140Sender) Send(text []byte, stamp uint32) error {
+	if len(text) > maxRedLength {
+		return Error("T.140 text block too long.")
+	}
+	idle := !ts.Pending()
+	if idle && len(text) == 0 {
+		return nil // nothing to send
+	}
+	var payload []byte
+	if ts.red {
+		for _, b := range ts.history {
+			offset := stamp - b.stamp
+			if offset > maxRedOffset {
+				return Error("T.140 redundant block too old.")
+			}
+			payload = append(payload, 0x80|ts.t140Pt, byte(offset>>6), byte(offset<<2)|byte(len(b.text)>>8), byte(len(b.text)))
+		}
+		payload = append(payload, ts.t140Pt)
+		for _, b := range ts.history {
+			payload = append(payload, b.text...)
+		}
+	}
+	payload = append(payload, text...)
+
+	rp := ts.rs.NewDataPacketForStream(ts.streamIndex, stamp)
+	rp.SetMarker(idle)
+	rp.SetPayload(payload)
+	_, err := ts.rs.WriteData(rp)
+	rp.FreePacket()
+	if err != nil {
+		return err
+	}
+	if ts.generations > 0 {
+		ts.history = append(ts.history, t140Block{stamp: stamp, text: append([]byte(nil), text...)})
+		if len(ts.history) > ts.generations {
+			ts.history = ts.history[1:]
+		}
+	}
+	return nil
+}
+
+// Pending returns true if the sender has text that was not yet sent in all redundant
+// generations.
+func (ts *T140Sender) Pending() bool {
+	for _, b := range ts.history {
+		if len(b.text) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// T140Receiver reassembles the real-time text of an input stream.
+//
+// The receiver takes the text of a lost packet from the redundant blocks of the following
+// packet. If the loss exceeds the redundancy the receiver inserts the replacement character
+// U+FFFD as RFC 4103 chapter 5.4 recommends. Packets of the "red" payload format contain
+// redundancy, other payload types are plain T.140 text.
+type T140Receiver struct {
+	lastSeq uint16
+	started bool
+}
+
+// NewT140Receiver creates a receiver of real-time text.
+func NewT140Receiver() *T140Receiver {
+	return new(T140Receiver)
+}
+
+// Receive returns the new text of a received packet of the input stream. Duplicate and late
+// packets return no text. Lost is true if the receiver inserted a loss marker.
+//
+//   rp - a RTP packet of the text stream in the order of arrival
+//
+func (tr *T140Receiver) Receive(rp *DataPacket) (text []byte, lost bool, err error) {
+	var blocks [][]byte // the redundant blocks, oldest first, then the primary block
+	pf := PayloadFormatMap[int(rp.PayloadType())]
+	if pf != nil && strings.EqualFold(pf.Name, "red") {
+		if blocks, err = parseRed(rp.Payload()); err != nil {
+			return nil, false, err
+		}
+	} else {
+		blocks = [][]byte{rp.Payload()}
+	}
+
+	seq := rp.Sequence()
+	missing := 0
+	if tr.started {
+		step := seq - tr.lastSeq
+		if step == 0 || step >= 0x8000 {
+			return nil, false, nil // duplicate or late
+		}
+		missing = int(step) - 1
+	}
+	tr.started, tr.lastSeq = true, seq
+
+	redundant := blocks[:len(blocks)-1]
+	if missing > len(redundant) {
+		text = append(text, t140LossMarker...)
+		lost = true
+		missing = len(redundant)
+	}
+	for _, b := range redundant[len(redundant)-missing:] {
+		text = append(text, b...)
+	}
+	return append(text, blocks[len(blocks)-1]...), lost, nil
+}
+
+// *** Local functions and methods.
+
+// parseRed splits a RFC 2198 payload into its blocks, the primary block last.
+func parseRed(payload []byte) (blocks [][]byte, err error) {
+	var lengths []int
+	offset := 0
+	for {
+		if offset >= len(payload) {
+			return nil, Error("Truncated RED header.")
+		}
+		if payload[offset]&0x80 == 0 {
+			offset++
+			break
+		}
+		if offset+4 > len(payload) {
+			return nil, Error("Truncated RED header.")
+		}
+		lengths = append(lengths, int(payload[offset+2]&0x03)<<8|int(payload[offset+3]))
+		offset += 4
+	}
+	for _, length := range lengths {
+		if offset+length > len(payload) {
+			return nil, Error("Truncated RED block.")
+		}
+		blocks = append(blocks, payload[offset:offset+length])
+		offset += length
+	}
+	return append(blocks, payload[offset:]), nil
+}
+
+// lookupPayloadName returns the lowest payload type of PayloadFormatMap with the encoding name.
+func lookupPayloadName(name string) (byte, bool) {
+	found := -1
+	for pt, pf := range PayloadFormatMap {
+		if strings.EqualFold(pf.Name, name) && (found < 0 || pt < found) {
+			found = pt
+		}
+	}
+	return byte(found), found >= 0
+}
@@ -0,0 +1,112 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"testing"
+)
+
+// t140Receive feeds the captured packets, except the lost ones, into a new receiver.
+func t140Receive(t *testing.T, data [][]byte, lost map[int]bool) (text string, losses int) {
+	tr := NewT140Receiver()
+	for i, buf := range data {
+		if lost[i] {
+			continue
+		}
+		rp, _ := NewDataPacketFromBuffer(buf)
+		part, loss, err := tr.Receive(rp)
+		if err != nil {
+			t.Errorf("Receive of packet %d failed: %s\n", i, err)
+		}
+		if loss {
+			losses++
+		}
+		text += string(part)
+	}
+	return
+}
+
+func TestT140(t *testing.T) {
+	parseFlags()
+
+	PayloadFormatMap[105] = &PayloadFormat{TypeNumber: 105, ClockRate: 1000, Name: "t140"}
+	PayloadFormatMap[106] = &PayloadFormat{TypeNumber: 106, ClockRate: 1000, Name: "red"}
+	defer delete(PayloadFormatMap, 105)
+	defer delete(PayloadFormatMap, 106)
+
+	rs, ct := closeSession(false)
+	if _, err := NewT140Sender(rs, 0, 0); err == nil {
+		t.Errorf("Payload format check failed, PCMU stream accepted\n")
+	}
+	rs.SsrcStreamOutForIndex(0).SetPayloadType(106)
+	ts, err := NewT140Sender(rs, 0, 0)
+	if err != nil {
+		t.Errorf("NewT140Sender failed: %s\n", err)
+		return
+	}
+	stamp := uint32(0)
+	for _, text := range []string{"he", "llo", "", "", "", " wor", "ld", "", ""} {
+		if err := ts.Send([]byte(text), stamp); err != nil {
+			t.Errorf("Send failed: %s\n", err)
+		}
+		stamp += 300
+	}
+	if ts.Pending() {
+		t.Errorf("Pending check failed after the redundant generations\n")
+	}
+	// The idle call without text sends nothing, 8 packets
+	if len(ct.captureWriter.data) != 8 {
+		t.Errorf("Packet count check failed: %d\n", len(ct.captureWriter.data))
+		return
+	}
+	for i, marker := range []bool{true, false, false, false, true, false, false, false} {
+		if rp, _ := NewDataPacketFromBuffer(ct.captureWriter.data[i]); rp.Marker() != marker || rp.PayloadType() != 106 {
+			t.Errorf("Packet %d marker or payload type check failed\n", i)
+		}
+	}
+
+	if text, losses := t140Receive(t, ct.captureWriter.data, nil); text != "hello world" || losses != 0 {
+		t.Errorf("Reassembly check failed: %q, losses: %d\n", text, losses)
+	}
+	if text, losses := t140Receive(t, ct.captureWriter.data, map[int]bool{1: true, 2: true, 5: true}); text != "hello world" || losses != 0 {
+		t.Errorf("Redundancy recovery check failed: %q, losses: %d\n", text, losses)
+	}
+	if text, losses := t140Receive(t, ct.captureWriter.data, map[int]bool{4: true, 5: true, 6: true}); text != "hello\uFFFDld" || losses != 1 {
+		t.Errorf("Loss marker check failed: %q, losses: %d\n", text, losses)
+	}
+
+	// Plain t140 has no redundancy
+	rs.SsrcStreamOutForIndex(0).SetPayloadType(105)
+	ts, _ = NewT140Sender(rs, 0, 0)
+	ct.captureWriter.data = nil
+	ts.Send([]byte("ab"), 0)
+	ts.Send([]byte("cd"), 300)
+	ts.Send([]byte("ef"), 600)
+	if ts.Pending() || len(ct.captureWriter.data) != 3 {
+		t.Errorf("Plain sender check failed: %d packets\n", len(ct.captureWriter.data))
+		return
+	}
+	if text, losses := t140Receive(t, ct.captureWriter.data, map[int]bool{1: true}); text != "ab\uFFFDef" || losses != 1 {
+		t.Errorf("Plain loss check failed: %q\n", text)
+	}
+
+	if _, err = parseRed([]byte{0x80 | 105, 0, 0}); err == nil {
+		t.Errorf("Truncated RED header check failed\n")
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"sync"
+)
+
+// Tee implements the TransportRecv interface and hands each received RTP and RTCP packet
+// to several upper layers, for example a Session, a recorder and an analyzer.
+//
+// Upper layers register with the Tee via SetCallUpper or AddUpper, thus modules that register
+// themselves at their receiving transport (NewSession, record.NewRecorder, NewForwarder) just
+// use the Tee as their transport. The upper layers own the packets they receive and may keep
+// or free them independently: every upper layer except the last one receives a copy of the
+// packet, the last one receives the original packet.
+//
+type Tee struct {
+	transportRecv TransportRecv
+
+	upperMutex sync.Mutex // synchronize activities on the upper layer list
+	uppers     []teeUpper
+	upperIndex uint32
+}
+
+type teeUpper struct {
+	index uint32
+	upper TransportRecv
+}
+
+// NewTee creates a new Tee.
+//
+//   tpr - the transport that receives the packets, the function registers the Tee as its
+//         upper layer
+//
+func NewTee(tpr TransportRecv) *Tee {
+	tee := new(Tee)
+	tee.transportRecv = tpr
+	tpr.SetCallUpper(tee)
+	return tee
+}
+
+// AddUpper adds an upper layer and returns its index. The Tee calls the upper layers in
+// the order they were added.
+//
+func (tee *Tee) AddUpper(upper TransportRecv) (index uint32) {
+	tee.upperMutex.Lock()
+	defer tee.upperMutex.Unlock()
+
+	index = tee.upperIndex
+	tee.uppers = append(tee.uppers, teeUpper{index, upper})
+	tee.upperIndex++
+	return
+}
+
+// RemoveUpper removes the upper layer at the specified index.
+//
+func (tee *Tee) RemoveUpper(index uint32) {
+	tee.upperMutex.Lock()
+	defer tee.upperMutex.Unlock()
+
+	for i, up := range tee.uppers {
+		if up.index == index {
+			tee.uppers = append(tee.uppers[:i:i], tee.uppers[i+1:]...)
+			return
+		}
+	}
+}
+
+// *** The following methods implement the rtp.TransportRecv interface.
+
+// SetCallUpper implements the rtp.TransportRecv SetCallUpper method.
+//
+// Other than the transports the Tee does not replace its upper layer but adds it, see AddUpper.
+func (tee *Tee) SetCallUpper(upper TransportRecv) {
+	tee.AddUpper(upper)
+}
+
+// ListenOnTransports implements the rtp.TransportRecv ListenOnTransports method.
+//
+// The Tee just forwards this to the receiving transport. Only one of the upper layers shall call it.
+func (tee *Tee) ListenOnTransports() error {
+	return tee.transportRecv.ListenOnTransports()
+}
+
+// OnRecvData implements the rtp.TransportRecv OnRecvData method.
+//
+// The method returns true if at least one upper layer accepted the packet.
+func (tee *Tee) OnRecvData(rp *DataPacket) (ok bool) {
+	uppers := tee.upperList()
+	if len(uppers) == 0 {
+		rp.FreePacket()
+		return false
+	}
+	for i, up := range uppers {
+		pkt := rp
+		if i < len(uppers)-1 {
+			pkt = newDataPacket()
+			pkt.inUse = copy(pkt.buffer, rp.buffer[0:rp.inUse])
+			pkt.fromAddr = rp.fromAddr
+		}
+		if up.upper.OnRecvData(pkt) {
+			ok = true
+		}
+	}
+	return
+}
+
+// OnRecvCtrl implements the rtp.TransportRecv OnRecvCtrl method.
+//
+// The method returns true if at least one upper layer accepted the packet.
+func (tee *Tee) OnRecvCtrl(rp *CtrlPacket) (ok bool) {
+	uppers := tee.upperList()
+	if len(uppers) == 0 {
+		rp.FreePacket()
+		return false
+	}
+	for i, up := range uppers {
+		pkt := rp
+		if i < len(uppers)-1 {
+			pkt, _ = newCtrlPacket()
+			pkt.inUse = copy(pkt.buffer, rp.buffer[0:rp.inUse])
+			pkt.fromAddr = rp.fromAddr
+		}
+		if up.upper.OnRecvCtrl(pkt) {
+			ok = true
+		}
+	}
+	return
+}
+
+// CloseRecv implements the rtp.TransportRecv CloseRecv method.
+//
+// The Tee just forwards this to the receiving transport.
+func (tee *Tee) CloseRecv() {
+	tee.transportRecv.CloseRecv()
+}
+
+// SetEndChannel implements the rtp.TransportRecv SetEndChannel method.
+//
+// The receiving transport signals directly to the channel. Only one of the upper layers shall set it.
+func (tee *Tee) SetEndChannel(ch TransportEnd) {
+	tee.transportRecv.SetEndChannel(ch)
+}
+
+// *** Local functions and methods.
+
+// upperList returns a copy of the upper layer list, the Tee does not hold the lock while it
+// calls the upper layers.
+func (tee *Tee) upperList() []teeUpper {
+	tee.upperMutex.Lock()
+	defer tee.upperMutex.Unlock()
+	return append([]teeUpper(nil), tee.uppers...)
+}
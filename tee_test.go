@@ -0,0 +1,77 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"testing"
+)
+
+// teeConsumer is a minimal upper layer that keeps the packets it receives.
+type teeConsumer struct {
+	data []*DataPacket
+	ctrl []*CtrlPacket
+}
+
+func (tc *teeConsumer) ListenOnTransports() error        { return nil }
+func (tc *teeConsumer) OnRecvData(rp *DataPacket) bool   { tc.data = append(tc.data, rp); return true }
+func (tc *teeConsumer) OnRecvCtrl(rp *CtrlPacket) bool   { tc.ctrl = append(tc.ctrl, rp); return true }
+func (tc *teeConsumer) SetCallUpper(upper TransportRecv) {}
+func (tc *teeConsumer) CloseRecv()                       {}
+func (tc *teeConsumer) SetEndChannel(ch TransportEnd)    {}
+
+func TestTee(t *testing.T) {
+	parseFlags()
+
+	lower := new(teeConsumer)
+	tee := NewTee(lower)
+	first, second, third := new(teeConsumer), new(teeConsumer), new(teeConsumer)
+	tee.SetCallUpper(first)
+	idx := tee.AddUpper(second)
+	tee.AddUpper(third)
+
+	rp := newDataPacket()
+	rp.SetSsrc(0x01020304)
+	rp.SetPayload([]byte{1, 2, 3})
+	rp.fromAddr.DataPort = 5220
+	if !tee.OnRecvData(rp) {
+		t.Errorf("Tee OnRecvData returned false\n")
+	}
+	if len(first.data) != 1 || len(second.data) != 1 || len(third.data) != 1 {
+		t.Errorf("Tee data fan-out check failed\n")
+		return
+	}
+	if third.data[0] != rp || first.data[0] == rp || second.data[0] == first.data[0] {
+		t.Errorf("Tee packet ownership check failed\n")
+	}
+	// a consumer that modifies or frees its packet must not affect the others
+	first.data[0].SetSsrc(0x05060708)
+	first.data[0].FreePacket()
+	if second.data[0].Ssrc() != 0x01020304 || second.data[0].Payload()[2] != 3 || second.data[0].fromAddr.DataPort != 5220 {
+		t.Errorf("Tee packet copy check failed\n")
+	}
+
+	tee.RemoveUpper(idx)
+	rc, _ := newCtrlPacket()
+	rc.SetType(0, RtcpRR)
+	rc.inUse = rtcpHeaderLength + rtcpSsrcLength
+	tee.OnRecvCtrl(rc)
+	if len(first.ctrl) != 1 || len(second.ctrl) != 0 || third.ctrl[0] != rc || first.ctrl[0].Type(0) != RtcpRR {
+		t.Errorf("Tee control fan-out check failed\n")
+	}
+}
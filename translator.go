@@ -0,0 +1,424 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"sync"
+)
+
+// Translator implements a RTP translator as specified in RFC 3550, chapter 7.2.
+//
+// A Translator connects two transports, for example a multicast domain and a set of unicast
+// subscribers. Each side has its own destinations. The Translator relays RTP and RTCP packets
+// that it receives on one side to the destinations of the other side. It keeps the SSRC space
+// unchanged, it may however re-write or drop payload types of the RTP packets it sends into a
+// side, or transform their payload, for example to transcode. If the Translator drops or
+// transforms packets it re-writes the packet and octet counts, and for a transformation with a
+// different clock rate the RTP timestamp, in the sender reports of the affected senders, thus
+// the receivers on the other side see consistent sender information. Receiver reports and all
+// other RTCP packets pass unchanged.
+//
+// Only a payload transformation touches the payload area of the packets. Without a
+// transformation the Translator relays the CSRC list, the header extension, the payload and the
+// padding byte by byte, as required for end-to-end encrypted payloads, for example SFrame.
+//
+type Translator struct {
+	SideA, SideB *TranslatorSide
+}
+
+// TranslatorSide is one side of a Translator. It implements the TransportRecv interface and
+// registers as upper layer of the side's receiving transport.
+//
+// If an application registers an upper layer (SetCallUpper) the side hands the received packets
+// to the upper layer after relaying them, otherwise it frees the packets.
+//
+type TranslatorSide struct {
+	// AcceptFrom, if not nil, checks the sender's address of each packet the side receives. The
+	// side drops packets if the function returns false. The receiving transport sets the data port
+	// for RTP packets and the control port for RTCP packets.
+	AcceptFrom func(from Address) bool
+
+	callUpper      TransportRecv
+	transportRecv  TransportRecv
+	transportWrite TransportWrite
+	peer           *TranslatorSide
+
+	sideMutex    sync.Mutex // synchronize activities on the destination, payload and counter maps
+	destinations remoteMap
+	destIndex    uint32
+	payloadMap   map[byte]int // payload type re-write for packets sent into this side, -1 drops
+	transforms   map[byte]*translatorTransform
+	dropped      map[uint32]*translatorDrops
+	stamps       map[uint32]*transformStamps // timestamp conversion per sender of transformed packets
+	repairs      map[uint32]*headerRepair    // header repair per sender, nil if off, see SetHeaderRepair
+}
+
+// translatorDrops counts the packets and payload octets of a sender that a side did not
+// relay because of the payload type settings, or the octets a transformation removed.
+type translatorDrops struct {
+	packets, octets uint32
+}
+
+// PayloadTransform transforms the payload of a relayed RTP packet, for example a transcoder
+// from Opus to PCMU. It returns the new payload, nil drops the packet. The function must not
+// keep the payload slice, the Translator reuses the packet.
+//
+//   ssrc    - the SSRC of the packet's sender
+//   payload - the payload of the received packet
+//
+type PayloadTransform func(ssrc uint32, payload []byte) []byte
+
+type translatorTransform struct {
+	outPt           byte
+	fn              PayloadTransform
+	inRate, outRate int64
+}
+
+// transformStamps converts the RTP timestamps of a sender to the clock rate of the transformed
+// payload. The conversion scales the distance to the first timestamp, thus it has no drift.
+type transformStamps struct {
+	inRate, outRate int64
+	first, last     uint32
+	ext             int64 // extended distance of last to first
+}
+
+// NewTranslator creates a new translator.
+//
+//   tprA, tpwA - the receiving and sending transports of side A
+//   tprB, tpwB - the receiving and sending transports of side B
+//
+// The function registers the sides as upper layers of the receiving transports, thus the
+// two sides need separate receiving transports.
+//
+func NewTranslator(tprA TransportRecv, tpwA TransportWrite, tprB TransportRecv, tpwB TransportWrite) *Translator {
+	tr := &Translator{newTranslatorSide(tprA, tpwA), newTranslatorSide(tprB, tpwB)}
+	tr.SideA.peer = tr.SideB
+	tr.SideB.peer = tr.SideA
+	return tr
+}
+
+func newTranslatorSide(tpr TransportRecv, tpw TransportWrite) *TranslatorSide {
+	ts := new(TranslatorSide)
+	ts.transportRecv = tpr
+	ts.transportWrite = tpw
+	ts.destinations = make(remoteMap, 2)
+	ts.payloadMap = make(map[byte]int)
+	ts.transforms = make(map[byte]*translatorTransform)
+	ts.dropped = make(map[uint32]*translatorDrops)
+	ts.stamps = make(map[uint32]*transformStamps)
+	tpr.SetCallUpper(ts)
+	return ts
+}
+
+// ListenOnTransports starts the receiving transports of both sides.
+func (tr *Translator) ListenOnTransports() (err error) {
+	if err = tr.SideA.ListenOnTransports(); err != nil {
+		return
+	}
+	if err = tr.SideB.ListenOnTransports(); err != nil {
+		tr.SideA.CloseRecv()
+	}
+	return
+}
+
+// CloseRecv closes the receiving transports of both sides.
+func (tr *Translator) CloseRecv() {
+	tr.SideA.CloseRecv()
+	tr.SideB.CloseRecv()
+}
+
+// AddDestination adds the address of an additional destination to this side.
+//
+//   dest - the address of the destination. The side sends RTP packets to the data
+//          port and RTCP packets to the control port.
+//
+func (ts *TranslatorSide) AddDestination(dest *Address) (index uint32) {
+	ts.sideMutex.Lock()
+	defer ts.sideMutex.Unlock()
+
+	ts.destinations[ts.destIndex] = dest
+	index = ts.destIndex
+	ts.destIndex++
+	return
+}
+
+// RemoveDestination removes the address at the specified index.
+//
+func (ts *TranslatorSide) RemoveDestination(index uint32) {
+	ts.sideMutex.Lock()
+	delete(ts.destinations, index)
+	ts.sideMutex.Unlock()
+}
+
+// SetPayloadTypeRewrite sets the payload type this side uses for relayed packets of payload
+// type pt. Setting newPt to the same value as pt removes the re-write.
+//
+func (ts *TranslatorSide) SetPayloadTypeRewrite(pt, newPt byte) {
+	ts.sideMutex.Lock()
+	if pt == newPt {
+		delete(ts.payloadMap, pt)
+	} else {
+		ts.payloadMap[pt] = int(newPt)
+	}
+	ts.sideMutex.Unlock()
+}
+
+// DropPayloadType stops relaying packets of payload type pt into this side, for example if
+// the receivers on this side cannot decode it. Use SetPayloadTypeRewrite(pt, pt) to relay the
+// payload type again.
+//
+func (ts *TranslatorSide) DropPayloadType(pt byte) {
+	ts.sideMutex.Lock()
+	ts.payloadMap[pt] = -1
+	ts.sideMutex.Unlock()
+}
+
+// SetPayloadTransform transforms the payload of the packets of payload type pt this side relays.
+// The side sends the packets with payload type outPt and converts their timestamps from the clock
+// rate of pt to the clock rate of outPt. A transformation takes precedence over the payload type
+// re-write and drop settings of pt. The method returns an error if PayloadFormatMap does not
+// contain pt or outPt.
+//
+//   pt    - the payload type of the received packets
+//   outPt - the payload type of the transformed packets
+//   fn    - the transformation, nil removes the transformation of pt
+//
+func (ts *TranslatorSide) SetPayloadTransform(pt, outPt byte, fn PayloadTransform) error {
+	ts.sideMutex.Lock()
+	defer ts.sideMutex.Unlock()
+	if fn == nil {
+		delete(ts.transforms, pt)
+		return nil
+	}
+	in, out := PayloadFormatMap[int(pt)], PayloadFormatMap[int(outPt)]
+	if in == nil || out == nil || in.ClockRate <= 0 || out.ClockRate <= 0 {
+		return Error("TranslatorSide: unknown payload format.")
+	}
+	ts.transforms[pt] = &translatorTransform{outPt, fn, int64(in.ClockRate), int64(out.ClockRate)}
+	return nil
+}
+
+// *** The following methods implement the rtp.TransportRecv interface.
+
+// SetCallUpper implements the rtp.TransportRecv SetCallUpper method.
+func (ts *TranslatorSide) SetCallUpper(upper TransportRecv) {
+	ts.callUpper = upper
+}
+
+// ListenOnTransports implements the rtp.TransportRecv ListenOnTransports method.
+//
+// The side just forwards this to its receiving transport.
+func (ts *TranslatorSide) ListenOnTransports() error {
+	return ts.transportRecv.ListenOnTransports()
+}
+
+// OnRecvData implements the rtp.TransportRecv OnRecvData method.
+//
+// The method relays the packet to the destinations of the other side.
+func (ts *TranslatorSide) OnRecvData(rp *DataPacket) bool {
+	if rp.inUse < rtpHeaderLength || (ts.AcceptFrom != nil && !ts.AcceptFrom(rp.fromAddr)) {
+		rp.FreePacket()
+		return false
+	}
+	ts.peer.relayData(rp)
+
+	if ts.callUpper != nil {
+		return ts.callUpper.OnRecvData(rp)
+	}
+	rp.FreePacket()
+	return true
+}
+
+// OnRecvCtrl implements the rtp.TransportRecv OnRecvCtrl method.
+//
+// The method relays the compound to the destinations of the other side.
+func (ts *TranslatorSide) OnRecvCtrl(rp *CtrlPacket) bool {
+	if ts.AcceptFrom != nil && !ts.AcceptFrom(rp.fromAddr) {
+		rp.FreePacket()
+		return false
+	}
+	ts.peer.relayCtrl(rp)
+
+	if ts.callUpper != nil {
+		return ts.callUpper.OnRecvCtrl(rp)
+	}
+	rp.FreePacket()
+	return true
+}
+
+// CloseRecv implements the rtp.TransportRecv CloseRecv method.
+//
+// The side just forwards this to its receiving transport.
+func (ts *TranslatorSide) CloseRecv() {
+	ts.transportRecv.CloseRecv()
+}
+
+// SetEndChannel implements the rtp.TransportRecv SetEndChannel method.
+//
+// The receiving transport signals directly to the channel.
+func (ts *TranslatorSide) SetEndChannel(ch TransportEnd) {
+	ts.transportRecv.SetEndChannel(ch)
+}
+
+// *** Local functions and methods.
+
+// relayData sends a RTP packet received on the other side to the destinations of this side.
+// The method restores the original payload type after sending.
+func (ts *TranslatorSide) relayData(rp *DataPacket) {
+	ts.sideMutex.Lock()
+	defer ts.sideMutex.Unlock()
+
+	if ts.repairs != nil {
+		seq, stamp, ok := ts.repairHeader(rp)
+		defer func() {
+			rp.SetSequence(seq)
+			rp.SetTimestamp(stamp)
+		}()
+		if !ok {
+			return
+		}
+	}
+	pt := rp.PayloadType()
+	if tf, ok := ts.transforms[pt]; ok {
+		ts.relayTransformed(rp, tf)
+		return
+	}
+	newPt, ok := ts.payloadMap[pt]
+	if ok && newPt < 0 {
+		drops := ts.drops(rp.Ssrc())
+		drops.packets++
+		drops.octets += uint32(len(rp.Payload()))
+		return
+	}
+	if ok {
+		rp.SetPayloadType(byte(newPt))
+	}
+	for _, dest := range ts.destinations {
+		ts.transportWrite.WriteDataTo(rp, dest)
+	}
+	if ok {
+		rp.SetPayloadType(pt)
+	}
+}
+
+// relayTransformed sends a copy of the packet with the transformed payload, payload type and
+// timestamp. The caller holds sideMutex.
+func (ts *TranslatorSide) relayTransformed(rp *DataPacket, tf *translatorTransform) {
+	ssrc := rp.Ssrc()
+	inLen := len(rp.Payload())
+	payload := tf.fn(ssrc, rp.Payload())
+	if payload == nil {
+		drops := ts.drops(ssrc)
+		drops.packets++
+		drops.octets += uint32(inLen)
+		return
+	}
+	if len(payload) != inLen {
+		ts.drops(ssrc).octets += uint32(inLen - len(payload)) // modulo 2^32, also for longer payloads
+	}
+	st := ts.stamps[ssrc]
+	if st == nil || st.inRate != tf.inRate || st.outRate != tf.outRate {
+		st = &transformStamps{inRate: tf.inRate, outRate: tf.outRate, first: rp.Timestamp(), last: rp.Timestamp()}
+		ts.stamps[ssrc] = st
+	}
+
+	out := newDataPacket()
+	payOffset := int(rp.CsrcCount()*4+rtpHeaderLength) + rp.ExtensionLength()
+	out.inUse = copy(out.buffer, rp.buffer[0:payOffset])
+	out.buffer[0] &^= paddingBit
+	out.SetPayload(payload)
+	out.SetPayloadType(tf.outPt)
+	out.SetTimestamp(st.advance(rp.Timestamp()))
+	out.sockOpts = rp.sockOpts
+	out.txTime = rp.txTime
+	for _, dest := range ts.destinations {
+		ts.transportWrite.WriteDataTo(out, dest)
+	}
+	out.FreePacket()
+}
+
+// drops returns the drop counters of the sender. The caller holds sideMutex.
+func (ts *TranslatorSide) drops(ssrc uint32) *translatorDrops {
+	drops := ts.dropped[ssrc]
+	if drops == nil {
+		drops = new(translatorDrops)
+		ts.dropped[ssrc] = drops
+	}
+	return drops
+}
+
+// advance converts the timestamp of the next packet and keeps it as the last timestamp.
+func (st *transformStamps) advance(stamp uint32) uint32 {
+	st.ext += int64(int32(stamp - st.last))
+	st.last = stamp
+	return st.convert(stamp)
+}
+
+// convert converts a timestamp close to the last timestamp, for example of a sender report.
+func (st *transformStamps) convert(stamp uint32) uint32 {
+	ext := st.ext + int64(int32(stamp-st.last))
+	return st.first + uint32(ext*st.outRate/st.inRate)
+}
+
+// relayCtrl sends a RTCP compound received on the other side to the destinations of this side.
+// If this side dropped packets of a sender, the method re-writes the counts in the sender's
+// report in a copy of the compound.
+func (ts *TranslatorSide) relayCtrl(rp *CtrlPacket) {
+	ts.sideMutex.Lock()
+	defer ts.sideMutex.Unlock()
+
+	out := rp
+	if len(ts.dropped) > 0 || len(ts.stamps) > 0 || len(ts.repairs) > 0 {
+		out, _ = newCtrlPacket()
+		out.inUse = copy(out.buffer, rp.buffer[0:rp.inUse])
+		defer out.FreePacket()
+		ts.rewriteSenderReports(out)
+	}
+	for _, dest := range ts.destinations {
+		ts.transportWrite.WriteCtrlTo(out, dest)
+	}
+}
+
+// rewriteSenderReports subtracts the dropped packets and octets from the counts in the sender
+// reports of the compound, shifts the RTP timestamps of repaired senders and converts the RTP
+// timestamps of transformed senders. The caller holds sideMutex.
+func (ts *TranslatorSide) rewriteSenderReports(rp *CtrlPacket) {
+	for offset := 0; offset+rtcpHeaderLength+rtcpSsrcLength <= rp.inUse; {
+		pktLen := int(rp.Length(offset)+1) * 4
+		if offset+pktLen > rp.inUse {
+			return
+		}
+		if rp.Type(offset) == RtcpSR && pktLen >= rtcpHeaderLength+rtcpSsrcLength+senderInfoLen {
+			if drops, ok := ts.dropped[rp.Ssrc(offset)]; ok {
+				info := rp.toSenderInfo(offset + rtcpHeaderLength + rtcpSsrcLength)
+				info.setPacketCount(info.packetCount() - drops.packets)
+				info.setOctetCount(info.octetCount() - drops.octets)
+			}
+			if hr, ok := ts.repairs[rp.Ssrc(offset)]; ok && hr.tsOffset != 0 {
+				info := rp.toSenderInfo(offset + rtcpHeaderLength + rtcpSsrcLength)
+				info.setRtpTimeStamp(info.rtpTimeStamp() + hr.tsOffset)
+			}
+			if st, ok := ts.stamps[rp.Ssrc(offset)]; ok {
+				info := rp.toSenderInfo(offset + rtcpHeaderLength + rtcpSsrcLength)
+				info.setRtpTimeStamp(st.convert(info.rtpTimeStamp()))
+			}
+		}
+		offset += pktLen
+	}
+}
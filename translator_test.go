@@ -0,0 +1,180 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+)
+
+// captureWriter is a TransportWrite that keeps copies of the packets written to it.
+type captureWriter struct {
+	data [][]byte
+	ctrl [][]byte
+}
+
+func (cw *captureWriter) WriteDataTo(rp *DataPacket, addr *Address) (n int, err error) {
+	cw.data = append(cw.data, append([]byte{}, rp.buffer[0:rp.inUse]...))
+	return rp.inUse, nil
+}
+
+func (cw *captureWriter) WriteCtrlTo(rp *CtrlPacket, addr *Address) (n int, err error) {
+	cw.ctrl = append(cw.ctrl, append([]byte{}, rp.buffer[0:rp.inUse]...))
+	return rp.inUse, nil
+}
+
+func (cw *captureWriter) SetToLower(lower TransportWrite) {}
+func (cw *captureWriter) CloseWrite()                     {}
+
+func TestTranslator(t *testing.T) {
+	parseFlags()
+
+	recvA, recvB := new(teeConsumer), new(teeConsumer)
+	writeA, writeB := new(captureWriter), new(captureWriter)
+	tr := NewTranslator(recvA, writeA, recvB, writeB)
+	tr.SideB.AddDestination(&Address{net.IPv4(10, 0, 0, 2), 5222, 5223})
+	tr.SideB.SetPayloadTypeRewrite(96, 100)
+	tr.SideB.DropPayloadType(13)
+	upper := new(teeConsumer)
+	tr.SideA.SetCallUpper(upper)
+
+	for i, pt := range []byte{96, 13, 96} {
+		rp := newDataPacket()
+		rp.SetSsrc(0x01020304)
+		rp.SetSequence(uint16(i))
+		rp.SetPayloadType(pt)
+		rp.SetPayload(make([]byte, 10))
+		tr.SideA.OnRecvData(rp)
+	}
+	if len(writeB.data) != 2 || len(writeA.data) != 0 {
+		t.Errorf("Translator relay check failed. Side B got: %d, side A got: %d\n", len(writeB.data), len(writeA.data))
+		return
+	}
+	rp, _ := NewDataPacketFromBuffer(writeB.data[1])
+	if rp.PayloadType() != 100 || rp.Ssrc() != 0x01020304 || rp.Sequence() != 2 {
+		t.Errorf("Translator payload re-write check failed. Payload type: %d\n", rp.PayloadType())
+	}
+	if upper.data[0].PayloadType() != 96 {
+		t.Errorf("Translator must restore the payload type for the upper layer\n")
+	}
+
+	// SR of the sender: 3 packets, 30 octets. Side B dropped one packet with 10 octets.
+	rc, offset := newCtrlPacket()
+	rc.SetType(0, RtcpSR)
+	rc.addHeaderSsrc(offset, 0x01020304)
+	info, _ := rc.newSenderInfo()
+	info.setPacketCount(3)
+	info.setOctetCount(30)
+	rc.SetLength(0, uint16(rc.inUse/4-1))
+	tr.SideA.OnRecvCtrl(rc)
+
+	rc, _ = NewCtrlPacketFromBuffer(writeB.ctrl[0])
+	if sr, ok := rc.SenderInfo(0); !ok || sr.SenderPacketCnt != 2 || sr.SenderOctectCnt != 20 {
+		t.Errorf("Translator sender report re-write check failed. Got: %+v\n", sr)
+	}
+	if sr, _ := upper.ctrl[0].SenderInfo(0); sr.SenderPacketCnt != 3 {
+		t.Errorf("Translator must not modify the received sender report\n")
+	}
+}
+
+func TestTranslatorPassThrough(t *testing.T) {
+	parseFlags()
+
+	recvA, recvB := new(teeConsumer), new(teeConsumer)
+	writeB := new(captureWriter)
+	tr := NewTranslator(recvA, new(captureWriter), recvB, writeB)
+	tr.SideB.AddDestination(&Address{IpAddr: net.IPv4(10, 0, 0, 2), DataPort: 5222, CtrlPort: 5223})
+	tr.SideB.AddDestination(&Address{IpAddr: net.IPv4(10, 0, 0, 3), DataPort: 5222, CtrlPort: 5223})
+	tr.SideB.SetPayloadTypeRewrite(96, 100)
+	upper := new(teeConsumer)
+	tr.SideA.SetCallUpper(upper)
+
+	orig := e2ePacket(0x01020304, 3)
+	tr.SideA.OnRecvData(e2eDataPacket(0x01020304, 3))
+
+	if len(writeB.data) != 2 || len(upper.data) != 1 {
+		t.Errorf("Translator relayed %d packets, expected 2.\n", len(writeB.data))
+		return
+	}
+	header := append([]byte{}, orig[0:rtpHeaderLength]...)
+	header[1] = 100
+	for _, data := range writeB.data {
+		checkPassThrough(t, "Translator", data, orig, header)
+	}
+	up := upper.data[0]
+	checkPassThrough(t, "Translator upper layer", up.buffer[0:up.inUse], orig, orig[0:rtpHeaderLength])
+}
+
+func TestTranslatorTransform(t *testing.T) {
+	parseFlags()
+
+	PayloadFormatMap[111] = &PayloadFormat{TypeNumber: 111, MediaType: Audio, ClockRate: 48000, Channels: 2, Name: "opus"}
+	defer delete(PayloadFormatMap, 111)
+
+	writeB := new(captureWriter)
+	tr := NewTranslator(new(teeConsumer), new(captureWriter), new(teeConsumer), writeB)
+	tr.SideB.AddDestination(&Address{IpAddr: net.IPv4(10, 0, 0, 2), DataPort: 5222, CtrlPort: 5223})
+	if err := tr.SideB.SetPayloadTransform(111, 112, func(ssrc uint32, payload []byte) []byte { return nil }); err == nil {
+		t.Errorf("Unknown payload format check failed\n")
+	}
+	// The "transcoder" turns 20 ms Opus frames of 40 bytes into 160 bytes PCMU, and drops empty frames
+	tr.SideB.SetPayloadTransform(111, 0, func(ssrc uint32, payload []byte) []byte {
+		if len(payload) == 0 {
+			return nil
+		}
+		return make([]byte, 160)
+	})
+
+	first := uint32(0xffffe000) // the timestamps wrap
+	for i := uint32(0); i < 4; i++ {
+		rp := newDataPacket()
+		rp.SetSsrc(0x01020304)
+		rp.SetSequence(uint16(i))
+		rp.SetPayloadType(111)
+		rp.SetTimestamp(first + i*960)
+		if i != 2 {
+			rp.SetPayload(make([]byte, 40))
+		}
+		tr.SideA.OnRecvData(rp)
+	}
+	if len(writeB.data) != 3 {
+		t.Errorf("Transform relay check failed. Got: %d packets\n", len(writeB.data))
+		return
+	}
+	rp, _ := NewDataPacketFromBuffer(writeB.data[2])
+	if rp.PayloadType() != 0 || len(rp.Payload()) != 160 || rp.Sequence() != 3 || rp.Timestamp() != first+3*160 {
+		t.Errorf("Transformed packet check failed. Payload type: %d, length: %d, stamp: %d\n", rp.PayloadType(), len(rp.Payload()), rp.Timestamp()-first)
+	}
+
+	// SR of the sender: 4 packets, 120 octets, side B sent 3 packets with 480 octets
+	rc, offset := newCtrlPacket()
+	rc.SetType(0, RtcpSR)
+	rc.addHeaderSsrc(offset, 0x01020304)
+	info, _ := rc.newSenderInfo()
+	info.setPacketCount(4)
+	info.setOctetCount(120)
+	info.setRtpTimeStamp(first + 4*960)
+	rc.SetLength(0, uint16(rc.inUse/4-1))
+	tr.SideA.OnRecvCtrl(rc)
+
+	rc, _ = NewCtrlPacketFromBuffer(writeB.ctrl[0])
+	if sr, ok := rc.SenderInfo(0); !ok || sr.SenderPacketCnt != 3 || sr.SenderOctectCnt != 480 || sr.RtpTimestamp != first+4*160 {
+		t.Errorf("Transform sender report check failed. Got: %+v\n", sr)
+	}
+}
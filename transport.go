@@ -18,6 +18,12 @@
 
 package rtp
 
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
 type TransportRecv interface {
 	ListenOnTransports() error
 	OnRecvData(rp *DataPacket) bool
@@ -40,4 +46,76 @@ type TransportCommon struct {
 	ctrlRecvStop,
 	dataWriteStop,
 	ctrlWriteStop bool
+
+	writeTimeout time.Duration
+	writeBlocked func(err error)
+	stats        TransportStats // accessed atomically
+	readThread   readThreadState
+}
+
+// TransportStats holds the transport level counters of a transport. Capacity problems show up
+// in these counters instead of as unexplained loss reported by the peers.
+type TransportStats struct {
+	ReadErrors    uint32 // reads from the sockets that failed
+	ShortReads    uint32 // dropped datagrams shorter than a RTP or RTCP header
+	Truncated     uint32 // dropped datagrams larger than the receive buffer
+	SendFailures  uint32 // writes that failed, including the blocked writes
+	BlockedWrites uint32 // writes that did not complete within the write timeout
+	KernelDrops   uint32 // datagrams the kernel dropped because the receive queue was full, Linux only
+}
+
+// SetWriteTimeout limits the time a transport waits until its socket accepts a packet.
+//
+// A full socket buffer or a TCP peer that stops reading blocks a write, without a timeout the
+// session's send path blocks as well. If a write does not complete within the timeout the
+// transport drops the packet, returns the timeout error, counts the write as blocked and calls
+// the handler. Set the timeout before the session starts.
+//
+//   timeout - the write timeout, 0 waits without limit
+//   handler - called with the error of a blocked write, may be nil
+//
+func (tc *TransportCommon) SetWriteTimeout(timeout time.Duration, handler func(err error)) {
+	tc.writeTimeout = timeout
+	tc.writeBlocked = handler
+}
+
+// BlockedWrites returns the number of writes that did not complete within the write timeout.
+func (tc *TransportCommon) BlockedWrites() uint32 {
+	return atomic.LoadUint32(&tc.stats.BlockedWrites)
+}
+
+// Stats returns a copy of the transport's counters.
+func (tc *TransportCommon) Stats() TransportStats {
+	return TransportStats{
+		ReadErrors:    atomic.LoadUint32(&tc.stats.ReadErrors),
+		ShortReads:    atomic.LoadUint32(&tc.stats.ShortReads),
+		Truncated:     atomic.LoadUint32(&tc.stats.Truncated),
+		SendFailures:  atomic.LoadUint32(&tc.stats.SendFailures),
+		BlockedWrites: atomic.LoadUint32(&tc.stats.BlockedWrites),
+		KernelDrops:   atomic.LoadUint32(&tc.stats.KernelDrops),
+	}
+}
+
+// setWriteDeadline sets the deadline of the next write on the connection if the transport has
+// a write timeout.
+func (tc *TransportCommon) setWriteDeadline(conn net.Conn) {
+	if tc.writeTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(tc.writeTimeout))
+	}
+}
+
+// writeDone counts failed writes. If the write timed out it counts the write as blocked and
+// calls the handler.
+func (tc *TransportCommon) writeDone(err error) {
+	if err == nil {
+		return
+	}
+	atomic.AddUint32(&tc.stats.SendFailures, 1)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		return
+	}
+	atomic.AddUint32(&tc.stats.BlockedWrites, 1)
+	if tc.writeBlocked != nil {
+		tc.writeBlocked(err)
+	}
 }
@@ -0,0 +1,292 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+)
+
+// CaptureFilter selects the captured UDP datagrams.
+type CaptureFilter struct {
+	MinPort, MaxPort int // UDP port range of the RTP and RTCP flows, source or destination, 0 and 0 select all ports
+}
+
+// TransportCapture is a receive-only transport that captures the RTP and RTCP packets of other
+// hosts from a network interface, e.g. a SPAN port or a network tap.
+//
+// The transport reads the IP datagrams of the interface, the kernel filters them with a BPF
+// program for UDP datagrams within the filter's port range. The transport takes the sender's
+// address from the IP and UDP headers and tells RTCP from RTP by the packet type (RFC 5761
+// chapter 4), thus it handles multiplexed flows as well. It captures IPv4 and IPv6 datagrams
+// without extension headers and skips IP fragments. Use it with a passive session, see
+// RolePassive: its write methods return an error.
+//
+// The capture uses AF_PACKET sockets, thus it runs on Linux only and needs the CAP_NET_RAW
+// capability.
+//
+type TransportCapture struct {
+	TransportCommon
+	callUpper TransportRecv
+	ifName    string
+	filter    CaptureFilter
+	source    captureSource
+	stop      uint32 // accessed atomically, CloseRecv and the receiver run concurrently
+}
+
+// captureSource reads the IP datagrams of an interface. read returns 0 if no datagram arrived
+// within some time, thus the receiver checks its stop flag.
+type captureSource interface {
+	read(buf []byte) (n int, err error)
+	close() error
+}
+
+// NewTransportCapture creates a capture transport for a network interface.
+//
+//   ifName - the name of the interface, e.g. "eth1"
+//   filter - the ports to capture
+//
+func NewTransportCapture(ifName string, filter CaptureFilter) (*TransportCapture, error) {
+	if filter.MinPort < 0 || filter.MaxPort > 65535 || filter.MinPort > filter.MaxPort {
+		return nil, Error("TransportCapture: invalid port range.")
+	}
+	if filter.MinPort == 0 && filter.MaxPort == 0 {
+		filter.MaxPort = 65535
+	}
+	tp := &TransportCapture{ifName: ifName, filter: filter}
+	tp.callUpper = tp
+	return tp, nil
+}
+
+// ListenOnTransports opens the capture on the interface and starts the receiver.
+func (tp *TransportCapture) ListenOnTransports() (err error) {
+	ifi, err := net.InterfaceByName(tp.ifName)
+	if err != nil {
+		return err
+	}
+	tp.source, err = openCapture(ifi, captureProgram(tp.filter))
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint32(&tp.stop, 0)
+	go tp.readCapture()
+	return nil
+}
+
+// *** The following methods implement the rtp.TransportRecv interface.
+
+// SetCallUpper implements the rtp.TransportRecv SetCallUpper method.
+func (tp *TransportCapture) SetCallUpper(upper TransportRecv) {
+	tp.callUpper = upper
+}
+
+// OnRecvData implements the rtp.TransportRecv OnRecvData method.
+//
+// TransportCapture is the lowest layer, it drops the packets without an upper layer.
+func (tp *TransportCapture) OnRecvData(rp *DataPacket) bool {
+	rp.FreePacket()
+	return false
+}
+
+// OnRecvCtrl implements the rtp.TransportRecv OnRecvCtrl method.
+//
+// TransportCapture is the lowest layer, it drops the packets without an upper layer.
+func (tp *TransportCapture) OnRecvCtrl(rp *CtrlPacket) bool {
+	rp.FreePacket()
+	return false
+}
+
+// CloseRecv implements the rtp.TransportRecv CloseRecv method. The receiver stops after its
+// current read and signals the end channel.
+func (tp *TransportCapture) CloseRecv() {
+	atomic.StoreUint32(&tp.stop, 1)
+}
+
+// SetEndChannel implements the rtp.TransportRecv SetEndChannel method.
+func (tp *TransportCapture) SetEndChannel(ch TransportEnd) {
+	tp.transportEnd = ch
+}
+
+// *** The following methods implement the rtp.TransportWrite interface.
+
+// SetToLower implements the rtp.TransportWrite SetToLower method. TransportCapture has no
+// lower layer.
+func (tp *TransportCapture) SetToLower(lower TransportWrite) {
+}
+
+// WriteDataTo implements the rtp.TransportWrite WriteDataTo method, capture transports can't
+// send.
+func (tp *TransportCapture) WriteDataTo(rp *DataPacket, addr *Address) (n int, err error) {
+	return 0, errCaptureWrite
+}
+
+// WriteCtrlTo implements the rtp.TransportWrite WriteCtrlTo method, capture transports can't
+// send.
+func (tp *TransportCapture) WriteCtrlTo(rp *CtrlPacket, addr *Address) (n int, err error) {
+	return 0, errCaptureWrite
+}
+
+// CloseWrite implements the rtp.TransportWrite CloseWrite method.
+func (tp *TransportCapture) CloseWrite() {
+}
+
+// *** Local functions and methods.
+
+const errCaptureWrite = Error("TransportCapture: a capture transport can't send.")
+
+func (tp *TransportCapture) readCapture() {
+	var buf [defaultBufferSize]byte
+
+	for atomic.LoadUint32(&tp.stop) == 0 {
+		n, err := tp.source.read(buf[0:])
+		if err != nil {
+			atomic.AddUint32(&tp.stats.ReadErrors, 1)
+			break
+		}
+		if n > 0 {
+			tp.dispatch(buf[0:n])
+		}
+	}
+	tp.source.close()
+	if tp.transportEnd != nil {
+		tp.transportEnd <- DataTransportRecvStopped | CtrlTransportRecvStopped
+	}
+}
+
+// dispatch hands the RTP or RTCP packet of a captured IP datagram to the upper layer.
+func (tp *TransportCapture) dispatch(datagram []byte) {
+	payload, src, srcPort, ok := parseCaptured(datagram, tp.filter)
+	if !ok {
+		atomic.AddUint32(&tp.stats.ShortReads, 1)
+		return
+	}
+	if len(payload) >= rtcpHeaderLength+rtcpSsrcLength && payload[1] >= 192 && payload[1] <= 223 {
+		rp, _ := newCtrlPacket()
+		rp.fromAddr = Address{IpAddr: src, CtrlPort: srcPort}
+		rp.inUse = copy(rp.buffer, payload)
+		tp.callUpper.OnRecvCtrl(rp)
+		return
+	}
+	if len(payload) < rtpHeaderLength {
+		atomic.AddUint32(&tp.stats.ShortReads, 1)
+		return
+	}
+	rp := newDataPacket()
+	rp.fromAddr = Address{IpAddr: src, DataPort: srcPort}
+	rp.inUse = copy(rp.buffer, payload)
+	tp.callUpper.OnRecvData(rp)
+}
+
+// parseCaptured returns the UDP payload and the source of an IP datagram, false if the datagram
+// is not an unfragmented UDP datagram of the filter's ports.
+func parseCaptured(datagram []byte, filter CaptureFilter) (payload []byte, src net.IP, srcPort int, ok bool) {
+	if len(datagram) < 1 {
+		return
+	}
+	var udp []byte
+	switch datagram[0] >> 4 {
+	case 4:
+		ihl := int(datagram[0]&0x0f) * 4
+		if ihl < 20 || len(datagram) < ihl+8 || datagram[9] != 17 || binary.BigEndian.Uint16(datagram[6:])&0x1fff != 0 {
+			return
+		}
+		if binary.BigEndian.Uint16(datagram[6:])&0x2000 != 0 {
+			return // the first fragment, the payload is not complete
+		}
+		src = net.IP(append([]byte{}, datagram[12:16]...))
+		udp = datagram[ihl:]
+	case 6:
+		if len(datagram) < 48 || datagram[6] != 17 {
+			return
+		}
+		src = net.IP(append([]byte{}, datagram[8:24]...))
+		udp = datagram[40:]
+	default:
+		return
+	}
+	srcPort = int(binary.BigEndian.Uint16(udp))
+	dstPort := int(binary.BigEndian.Uint16(udp[2:]))
+	if !filter.matches(srcPort) && !filter.matches(dstPort) {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(udp[4:]))
+	if length < 8 || length > len(udp) {
+		return
+	}
+	return udp[8:length], src, srcPort, true
+}
+
+func (filter CaptureFilter) matches(port int) bool {
+	return port >= filter.MinPort && port <= filter.MaxPort
+}
+
+// bpfInstruction is an instruction of a classic BPF program, see linux/filter.h.
+type bpfInstruction struct {
+	code   uint16
+	jt, jf uint8
+	k      uint32
+}
+
+// The classic BPF opcodes of the capture program.
+const (
+	bpfLdbAbs  = 0x30 // A = byte at k
+	bpfLdhAbs  = 0x28 // A = half word at k
+	bpfLdhInd  = 0x48 // A = half word at X + k
+	bpfLdxMsh  = 0xb1 // X = 4 * (byte at k & 0xf)
+	bpfLdxImm  = 0x01 // X = k
+	bpfRshK    = 0x74 // A >>= k
+	bpfJa      = 0x05 // jump by k
+	bpfJeqK    = 0x15 // jump jt if A == k, else jf
+	bpfJgeK    = 0x35 // jump jt if A >= k, else jf
+	bpfJgtK    = 0x25 // jump jt if A > k, else jf
+	bpfJsetK   = 0x45 // jump jt if A & k != 0, else jf
+	bpfRetK    = 0x06 // accept k bytes, 0 drops
+	bpfSnapLen = 0x40000
+)
+
+// captureProgram returns the BPF program that accepts unfragmented UDP datagrams over IPv4 or
+// IPv6 with a source or destination port in the filter's range. The program runs on the IP
+// datagram, parseCaptured checks the same conditions again.
+func captureProgram(filter CaptureFilter) []bpfInstruction {
+	min, max := uint32(filter.MinPort), uint32(filter.MaxPort)
+	return []bpfInstruction{
+		{bpfLdbAbs, 0, 0, 0},        // 0: IP version
+		{bpfRshK, 0, 0, 4},          // 1
+		{bpfJeqK, 7, 0, 6},          // 2: IPv6 at 10
+		{bpfJeqK, 0, 16, 4},         // 3: neither IPv4 nor IPv6, drop
+		{bpfLdbAbs, 0, 0, 9},        // 4: IPv4 protocol
+		{bpfJeqK, 0, 14, 17},        // 5: not UDP, drop
+		{bpfLdhAbs, 0, 0, 6},        // 6: flags and fragment offset
+		{bpfJsetK, 12, 0, 0x3fff},   // 7: fragment, drop
+		{bpfLdxMsh, 0, 0, 0},        // 8: X = IPv4 header length
+		{bpfJa, 0, 0, 3},            // 9: ports at 13
+		{bpfLdbAbs, 0, 0, 6},        // 10: IPv6 next header
+		{bpfJeqK, 0, 8, 17},         // 11: not UDP, drop
+		{bpfLdxImm, 0, 0, 40},       // 12: X = IPv6 header length
+		{bpfLdhInd, 0, 0, 0},        // 13: source port
+		{bpfJgeK, 0, 1, min},        // 14
+		{bpfJgtK, 0, 3, max},        // 15: in range, accept
+		{bpfLdhInd, 0, 0, 2},        // 16: destination port
+		{bpfJgeK, 0, 2, min},        // 17
+		{bpfJgtK, 1, 0, max},        // 18
+		{bpfRetK, 0, 0, bpfSnapLen}, // 19: accept
+		{bpfRetK, 0, 0, 0},          // 20: drop
+	}
+}
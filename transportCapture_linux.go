@@ -0,0 +1,80 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"syscall"
+)
+
+// captureTimeout is the receive timeout of the capture socket in microseconds, the receiver
+// checks its stop flag at least this often.
+const captureTimeout = 250000
+
+// packetSocket is a AF_PACKET socket of cooked mode, its datagrams start with the IP header.
+type packetSocket struct {
+	fd int
+}
+
+// openCapture opens a packet socket on the interface and attaches the BPF program. The socket
+// binds to the interface after it attached the filter, thus it doesn't queue unfiltered frames.
+func openCapture(ifi *net.Interface, program []bpfInstruction) (captureSource, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	filter := make([]syscall.SockFilter, len(program))
+	for i, ins := range program {
+		filter[i] = syscall.SockFilter{Code: ins.code, Jt: ins.jt, Jf: ins.jf, K: ins.k}
+	}
+	if err = syscall.AttachLsf(fd, filter); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	tv := syscall.NsecToTimeval(captureTimeout * 1000)
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	sa := &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ALL), Ifindex: ifi.Index}
+	if err = syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &packetSocket{fd: fd}, nil
+}
+
+func (ps *packetSocket) read(buf []byte) (int, error) {
+	n, _, err := syscall.Recvfrom(ps.fd, buf, 0)
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (ps *packetSocket) close() error {
+	return syscall.Close(ps.fd)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,245 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// runBpf interprets the classic BPF instructions of the capture program.
+func runBpf(program []bpfInstruction, pkt []byte) uint32 {
+	var a, x uint32
+	load := func(off uint32, size int) (uint32, bool) {
+		if int(off)+size > len(pkt) {
+			return 0, false
+		}
+		if size == 1 {
+			return uint32(pkt[off]), true
+		}
+		return uint32(binary.BigEndian.Uint16(pkt[off:])), true
+	}
+	for pc := 0; pc < len(program); pc++ {
+		ins := program[pc]
+		ok := true
+		jump := func(cond bool) {
+			if cond {
+				pc += int(ins.jt)
+			} else {
+				pc += int(ins.jf)
+			}
+		}
+		switch ins.code {
+		case bpfLdbAbs:
+			a, ok = load(ins.k, 1)
+		case bpfLdhAbs:
+			a, ok = load(ins.k, 2)
+		case bpfLdhInd:
+			a, ok = load(x+ins.k, 2)
+		case bpfLdxMsh:
+			x, ok = load(ins.k, 1)
+			x = (x & 0xf) * 4
+		case bpfLdxImm:
+			x = ins.k
+		case bpfRshK:
+			a >>= ins.k
+		case bpfJa:
+			pc += int(ins.k)
+		case bpfJeqK:
+			jump(a == ins.k)
+		case bpfJgeK:
+			jump(a >= ins.k)
+		case bpfJgtK:
+			jump(a > ins.k)
+		case bpfJsetK:
+			jump(a&ins.k != 0)
+		case bpfRetK:
+			return ins.k
+		default:
+			return 0
+		}
+		if !ok {
+			return 0
+		}
+	}
+	return 0
+}
+
+// udpDatagram builds an IPv4 or IPv6 datagram carrying a UDP datagram.
+func udpDatagram(src net.IP, sport, dport int, frag uint16, payload []byte) []byte {
+	udp := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(udp, uint16(sport))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dport))
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[8:], payload)
+
+	if ip4 := src.To4(); ip4 != nil {
+		hdr := make([]byte, 20)
+		hdr[0] = 0x45
+		binary.BigEndian.PutUint16(hdr[2:], uint16(20+len(udp)))
+		binary.BigEndian.PutUint16(hdr[6:], frag)
+		hdr[8] = 64
+		hdr[9] = 17
+		copy(hdr[12:], ip4)
+		copy(hdr[16:], net.IPv4(10, 0, 0, 9).To4())
+		return append(hdr, udp...)
+	}
+	hdr := make([]byte, 40)
+	hdr[0] = 0x60
+	binary.BigEndian.PutUint16(hdr[4:], uint16(len(udp)))
+	hdr[6] = 17
+	hdr[7] = 64
+	copy(hdr[8:], src.To16())
+	copy(hdr[24:], net.ParseIP("fd00::9"))
+	return append(hdr, udp...)
+}
+
+func TestCaptureProgram(t *testing.T) {
+	parseFlags()
+
+	filter := CaptureFilter{MinPort: 20000, MaxPort: 20099}
+	program := captureProgram(filter)
+	v4, v6 := net.IPv4(10, 0, 0, 1), net.ParseIP("fd00::1")
+	payload := make([]byte, 20)
+
+	tests := []struct {
+		name   string
+		pkt    []byte
+		accept bool
+	}{
+		{"IPv4 source port", udpDatagram(v4, 20010, 5000, 0, payload), true},
+		{"IPv4 destination port", udpDatagram(v4, 5000, 20099, 0, payload), true},
+		{"IPv4 out of range", udpDatagram(v4, 5000, 20100, 0, payload), false},
+		{"IPv4 below range", udpDatagram(v4, 19999, 5000, 0, payload), false},
+		{"IPv4 first fragment", udpDatagram(v4, 20010, 5000, 0x2000, payload), false},
+		{"IPv4 later fragment", udpDatagram(v4, 20010, 5000, 0x0010, payload), false},
+		{"IPv4 don't fragment", udpDatagram(v4, 20010, 5000, 0x4000, payload), true},
+		{"IPv6 source port", udpDatagram(v6, 20000, 5000, 0, payload), true},
+		{"IPv6 destination port", udpDatagram(v6, 5000, 20050, 0, payload), true},
+		{"IPv6 out of range", udpDatagram(v6, 5000, 30000, 0, payload), false},
+	}
+	tcp := udpDatagram(v4, 20010, 5000, 0, payload)
+	tcp[9] = 6
+	tests = append(tests, struct {
+		name   string
+		pkt    []byte
+		accept bool
+	}{"IPv4 TCP", tcp, false})
+
+	for _, tt := range tests {
+		accepted := runBpf(program, tt.pkt) != 0
+		if accepted != tt.accept {
+			t.Errorf("BPF program %s: accepted %v, expected %v.\n", tt.name, accepted, tt.accept)
+		}
+		_, _, _, parsed := parseCaptured(tt.pkt, filter)
+		if parsed != tt.accept {
+			t.Errorf("parseCaptured %s: accepted %v, expected %v.\n", tt.name, parsed, tt.accept)
+		}
+	}
+
+	all := captureProgram(CaptureFilter{MaxPort: 65535})
+	if runBpf(all, udpDatagram(v6, 1, 2, 0, payload)) == 0 {
+		t.Errorf("BPF program without port range dropped a datagram.\n")
+	}
+}
+
+// fakeCapture returns queued datagrams and times out if the queue is empty.
+type fakeCapture struct {
+	frames chan []byte
+	closed bool
+}
+
+func (fc *fakeCapture) read(buf []byte) (int, error) {
+	select {
+	case frame := <-fc.frames:
+		return copy(buf, frame), nil
+	case <-time.After(10 * time.Millisecond):
+		return 0, nil
+	}
+}
+
+func (fc *fakeCapture) close() error {
+	fc.closed = true
+	return nil
+}
+
+func TestTransportCapture(t *testing.T) {
+	parseFlags()
+
+	if _, err := NewTransportCapture("eth0", CaptureFilter{MinPort: 3000, MaxPort: 2000}); err == nil {
+		t.Errorf("NewTransportCapture accepted an invalid port range.\n")
+	}
+	tp, err := NewTransportCapture("eth0", CaptureFilter{})
+	if err != nil {
+		t.Errorf("NewTransportCapture failed: %s\n", err.Error())
+		return
+	}
+	upper := new(teeConsumer)
+	tp.SetCallUpper(upper)
+
+	rtp := newDataPacket()
+	rtp.SetSsrc(0x01020304)
+	rtp.SetPayload([]byte{1, 2, 3})
+	rtcp, _ := newCtrlPacket()
+	rtcp.buffer[0] = 0x80
+	rtcp.buffer[1] = RtcpRR
+	rtcp.SetLength(0, 1)
+	rtcp.SetSsrc(0, 0x05060708)
+	rtcp.inUse = 8
+
+	src4, src6 := net.IPv4(10, 0, 0, 1), net.ParseIP("fd00::1")
+	fc := &fakeCapture{frames: make(chan []byte, 4)}
+	fc.frames <- udpDatagram(src4, 5220, 6000, 0, rtp.Buffer()[0:rtp.InUse()])
+	fc.frames <- udpDatagram(src6, 5221, 6001, 0, rtcp.buffer[0:rtcp.inUse])
+	fc.frames <- udpDatagram(src4, 5220, 6000, 0, []byte{0x80, 0})
+
+	end := make(TransportEnd, 1)
+	tp.SetEndChannel(end)
+	tp.source = fc
+	go tp.readCapture()
+
+	for i := 0; i < 100 && len(fc.frames) > 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	tp.CloseRecv()
+	if stopped := <-end; stopped != DataTransportRecvStopped|CtrlTransportRecvStopped {
+		t.Errorf("End channel got %d, expected both receivers stopped.\n", stopped)
+	}
+	if !fc.closed {
+		t.Errorf("Capture source was not closed.\n")
+	}
+	if len(upper.data) != 1 || len(upper.ctrl) != 1 {
+		t.Errorf("Got %d RTP and %d RTCP packets, expected one each.\n", len(upper.data), len(upper.ctrl))
+		return
+	}
+	if rp := upper.data[0]; rp.Ssrc() != 0x01020304 || !rp.fromAddr.IpAddr.Equal(src4) || rp.fromAddr.DataPort != 5220 {
+		t.Errorf("Captured RTP packet has SSRC %x from %v:%d.\n", rp.Ssrc(), rp.fromAddr.IpAddr, rp.fromAddr.DataPort)
+	}
+	if rp := upper.ctrl[0]; rp.Ssrc(0) != 0x05060708 || !rp.fromAddr.IpAddr.Equal(src6) || rp.fromAddr.CtrlPort != 5221 {
+		t.Errorf("Captured RTCP packet has SSRC %x from %v:%d.\n", rp.Ssrc(0), rp.fromAddr.IpAddr, rp.fromAddr.CtrlPort)
+	}
+	if tp.Stats().ShortReads != 1 {
+		t.Errorf("ShortReads is %d, expected 1.\n", tp.Stats().ShortReads)
+	}
+	if _, err := tp.WriteDataTo(rtp, &Address{IpAddr: src4, DataPort: 5220}); err == nil {
+		t.Errorf("Capture transport sent a RTP packet.\n")
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the RTCP fault injection for chaos tests.
+ */
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RtcpImpairment holds the RTCP faults that TransportImpair injects in one direction.
+//
+// The probabilities range from 0, the fault never happens, to 1, it happens to each packet.
+// A network loses the whole compound packet, thus SrLoss drops the compound packets that
+// carry a SR and not just the SR.
+//
+type RtcpImpairment struct {
+	Loss     float64       // the probability to drop a compound RTCP packet
+	SrLoss   float64       // the probability to drop a compound packet with a SR
+	Corrupt  float64       // the probability to overwrite a report block with random values
+	ByeDelay time.Duration // the delay of compound packets with a BYE, 0 keeps them in order
+}
+
+// ImpairStats holds the number of faults TransportImpair injected in one direction.
+type ImpairStats struct {
+	Dropped         uint64 // compound packets dropped by Loss
+	DroppedSrs      uint64 // compound packets with a SR dropped by SrLoss
+	CorruptedBlocks uint64 // report blocks overwritten with random values
+	DelayedByes     uint64 // compound packets with a BYE delayed by ByeDelay
+}
+
+// TransportImpair implements the interfaces TransportRecv and TransportWrite and injects RTCP
+// faults for chaos tests: it drops compound RTCP packets and sender reports, corrupts report
+// blocks and delays BYE packets. Tests use it to check the member timeouts and the reception
+// statistics of a session under adverse RTCP conditions.
+//
+// TransportImpair is a stackable transport module like TransportSRTP. It forwards RTP packets
+// unchanged. Stack it above a SRTP transport, the SRTCP authentication rejects corrupted
+// packets.
+//
+type TransportImpair struct {
+	callUpper     TransportRecv
+	toLower       TransportWrite
+	transportRecv TransportRecv
+
+	mutex            sync.Mutex
+	rand             *rand.Rand
+	recv, send       *RtcpImpairment
+	recvStats        ImpairStats
+	sendStats        ImpairStats
+	recvStop, closed bool // delayed packets after the close are freed
+}
+
+// NewTransportImpair creates a new RTCP fault injection module. The module forwards all
+// packets unchanged until SetImpairment sets the faults.
+//
+//   tpr - the lower layer transport that receives the packets, the function registers the
+//         module as its upper layer. May be nil if the module only sends.
+//   tpw - the lower layer transport that sends the packets. May be nil if the module only
+//         receives.
+//
+func NewTransportImpair(tpr TransportRecv, tpw TransportWrite) *TransportImpair {
+	tp := &TransportImpair{transportRecv: tpr, toLower: tpw}
+	tp.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	if tpr != nil {
+		tpr.SetCallUpper(tp)
+	}
+	return tp
+}
+
+// SetImpairment sets the faults of received and sent RTCP packets, nil switches the faults of
+// a direction off. The function copies the impairments.
+//
+//   recv - the faults of the RTCP packets the module forwards to the upper layer
+//   send - the faults of the RTCP packets the module writes to the lower layer
+//
+func (tp *TransportImpair) SetImpairment(recv, send *RtcpImpairment) {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+	tp.recv, tp.send = nil, nil
+	if recv != nil {
+		cp := *recv
+		tp.recv = &cp
+	}
+	if send != nil {
+		cp := *send
+		tp.send = &cp
+	}
+}
+
+// SetSeed seeds the random source of the faults, tests use it to repeat a run.
+func (tp *TransportImpair) SetSeed(seed int64) {
+	tp.mutex.Lock()
+	tp.rand = rand.New(rand.NewSource(seed))
+	tp.mutex.Unlock()
+}
+
+// Stats returns the number of faults the module injected into received and sent packets.
+func (tp *TransportImpair) Stats() (recv, send ImpairStats) {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+	return tp.recvStats, tp.sendStats
+}
+
+// *** The following methods implement the rtp.TransportRecv interface.
+
+// SetCallUpper implements the rtp.TransportRecv SetCallUpper method.
+func (tp *TransportImpair) SetCallUpper(upper TransportRecv) {
+	tp.callUpper = upper
+}
+
+// ListenOnTransports implements the rtp.TransportRecv ListenOnTransports method.
+//
+// The module just forwards this to the lower layer receiving transport.
+func (tp *TransportImpair) ListenOnTransports() error {
+	if tp.transportRecv == nil {
+		return Error("TransportImpair: no receiving transport.")
+	}
+	tp.mutex.Lock()
+	tp.recvStop = false
+	tp.mutex.Unlock()
+	return tp.transportRecv.ListenOnTransports()
+}
+
+// OnRecvData implements the rtp.TransportRecv OnRecvData method.
+func (tp *TransportImpair) OnRecvData(rp *DataPacket) bool {
+	if tp.callUpper == nil {
+		rp.FreePacket()
+		return false
+	}
+	return tp.callUpper.OnRecvData(rp)
+}
+
+// OnRecvCtrl implements the rtp.TransportRecv OnRecvCtrl method.
+//
+// The method injects the receive faults in place and forwards the packet to the upper layer,
+// a delayed packet after the delay.
+func (tp *TransportImpair) OnRecvCtrl(rp *CtrlPacket) bool {
+	if tp.callUpper == nil {
+		rp.FreePacket()
+		return false
+	}
+	drop, delay := tp.impair(rp, false)
+	if drop {
+		rp.FreePacket()
+		return false
+	}
+	if delay > 0 {
+		time.AfterFunc(delay, func() {
+			tp.mutex.Lock()
+			stopped := tp.recvStop
+			tp.mutex.Unlock()
+			if stopped {
+				rp.FreePacket()
+				return
+			}
+			tp.callUpper.OnRecvCtrl(rp)
+		})
+		return true
+	}
+	return tp.callUpper.OnRecvCtrl(rp)
+}
+
+// CloseRecv implements the rtp.TransportRecv CloseRecv method.
+func (tp *TransportImpair) CloseRecv() {
+	tp.mutex.Lock()
+	tp.recvStop = true
+	tp.mutex.Unlock()
+	if tp.transportRecv != nil {
+		tp.transportRecv.CloseRecv()
+	}
+}
+
+// SetEndChannel implements the rtp.TransportRecv SetEndChannel method.
+//
+// The lower layer receiving transport signals directly to the channel.
+func (tp *TransportImpair) SetEndChannel(ch TransportEnd) {
+	if tp.transportRecv != nil {
+		tp.transportRecv.SetEndChannel(ch)
+	}
+}
+
+// *** The following methods implement the rtp.TransportWrite interface.
+
+// SetToLower implements the rtp.TransportWrite SetToLower method.
+func (tp *TransportImpair) SetToLower(lower TransportWrite) {
+	tp.toLower = lower
+}
+
+// WriteDataTo implements the rtp.TransportWrite WriteDataTo method.
+func (tp *TransportImpair) WriteDataTo(rp *DataPacket, addr *Address) (n int, err error) {
+	return tp.toLower.WriteDataTo(rp, addr)
+}
+
+// WriteCtrlTo implements the rtp.TransportWrite WriteCtrlTo method.
+//
+// The method injects the send faults into a copy of the packet because the Session sends the
+// same packet to several remote peers. A dropped or delayed packet counts as sent.
+func (tp *TransportImpair) WriteCtrlTo(rp *CtrlPacket, addr *Address) (n int, err error) {
+	tp.mutex.Lock()
+	on := tp.send != nil
+	tp.mutex.Unlock()
+	if !on {
+		return tp.toLower.WriteCtrlTo(rp, addr)
+	}
+	out, _ := newCtrlPacket()
+	out.inUse = copy(out.buffer, rp.buffer[0:rp.inUse])
+	out.sockOpts = rp.sockOpts
+	out.txTime = rp.txTime
+	drop, delay := tp.impair(out, true)
+	if drop {
+		out.FreePacket()
+		return rp.inUse, nil
+	}
+	if delay > 0 {
+		to := *addr
+		time.AfterFunc(delay, func() {
+			tp.mutex.Lock()
+			closed := tp.closed
+			tp.mutex.Unlock()
+			if !closed {
+				tp.toLower.WriteCtrlTo(out, &to)
+			}
+			out.FreePacket()
+		})
+		return rp.inUse, nil
+	}
+	n, err = tp.toLower.WriteCtrlTo(out, addr)
+	out.FreePacket()
+	return
+}
+
+// CloseWrite implements the rtp.TransportWrite CloseWrite method.
+func (tp *TransportImpair) CloseWrite() {
+	tp.mutex.Lock()
+	tp.closed = true
+	tp.mutex.Unlock()
+	if tp.toLower != nil {
+		tp.toLower.CloseWrite()
+	}
+}
+
+// *** Local functions and methods.
+
+// impair injects the faults of a direction into the compound RTCP packet. It returns true if
+// the packet is lost and the delay of a packet with a BYE.
+func (tp *TransportImpair) impair(rp *CtrlPacket, send bool) (drop bool, delay time.Duration) {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+	imp, stats := tp.recv, &tp.recvStats
+	if send {
+		imp, stats = tp.send, &tp.sendStats
+	}
+	if imp == nil {
+		return false, 0
+	}
+	if imp.Loss > 0 && tp.rand.Float64() < imp.Loss {
+		stats.Dropped++
+		return true, 0
+	}
+	for offset := 0; offset+rtcpHeaderLength <= rp.inUse; {
+		end := offset + int((rp.Length(offset)+1)*4)
+		if end > rp.inUse {
+			break
+		}
+		switch rp.Type(offset) {
+		case RtcpSR:
+			if imp.SrLoss > 0 && tp.rand.Float64() < imp.SrLoss {
+				stats.DroppedSrs++
+				return true, 0
+			}
+			tp.corruptBlocks(rp, offset+rtcpHeaderLength+rtcpSsrcLength+senderInfoLen, end, imp, stats)
+		case RtcpRR:
+			tp.corruptBlocks(rp, offset+rtcpHeaderLength+rtcpSsrcLength, end, imp, stats)
+		case RtcpBye:
+			delay = imp.ByeDelay
+		}
+		offset = end
+	}
+	if delay > 0 {
+		stats.DelayedByes++
+	}
+	return false, delay
+}
+
+// corruptBlocks overwrites the report blocks between first and end with random values. The
+// blocks keep their SSRC, the corrupted reports reach the report's stream.
+func (tp *TransportImpair) corruptBlocks(rp *CtrlPacket, first, end int, imp *RtcpImpairment, stats *ImpairStats) {
+	if imp.Corrupt <= 0 {
+		return
+	}
+	for block := first; block+reportBlockLen <= end; block += reportBlockLen {
+		if tp.rand.Float64() < imp.Corrupt {
+			tp.rand.Read(rp.buffer[block+rtcpSsrcLength : block+reportBlockLen])
+			stats.CorruptedBlocks++
+		}
+	}
+}
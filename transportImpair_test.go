@@ -0,0 +1,155 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// impairConsumer hands the received RTCP packets to a channel, delayed packets arrive on a
+// timer goroutine.
+type impairConsumer struct {
+	teeConsumer
+	ctrl chan *CtrlPacket
+}
+
+func (ic *impairConsumer) OnRecvCtrl(rp *CtrlPacket) bool { ic.ctrl <- rp; return true }
+
+// impairPacket returns a compound RTCP packet with a SR or RR of ssrc with one report block,
+// and a BYE if bye is true.
+func impairPacket(sr, bye bool, ssrc uint32) *CtrlPacket {
+	var buf []byte
+	if sr {
+		buf = make([]byte, 52)
+		buf[1] = RtcpSR
+	} else {
+		buf = make([]byte, 32)
+		buf[1] = RtcpRR
+	}
+	buf[0] = 0x81
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(buf)/4-1))
+	binary.BigEndian.PutUint32(buf[4:], ssrc)
+	block := buf[len(buf)-reportBlockLen:]
+	binary.BigEndian.PutUint32(block, 0x01020304)
+	block[4] = 0x10
+	if bye {
+		b := []byte{0x81, RtcpBye, 0, 1, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[4:], ssrc)
+		buf = append(buf, b...)
+	}
+	rp, _ := NewCtrlPacketFromBuffer(buf)
+	return rp
+}
+
+func TestTransportImpairRecv(t *testing.T) {
+	parseFlags()
+
+	lower := new(teeConsumer)
+	tp := NewTransportImpair(lower, nil)
+	upper := &impairConsumer{ctrl: make(chan *CtrlPacket, 4)}
+	tp.SetCallUpper(upper)
+	tp.SetSeed(1)
+
+	// without faults the packets pass unchanged
+	tp.OnRecvCtrl(impairPacket(true, false, 0x11))
+	if len(upper.ctrl) != 1 {
+		t.Errorf("unimpaired packet not forwarded\n")
+	}
+	(<-upper.ctrl).FreePacket()
+
+	tp.SetImpairment(&RtcpImpairment{Loss: 1}, nil)
+	if tp.OnRecvCtrl(impairPacket(false, false, 0x11)) || len(upper.ctrl) != 0 {
+		t.Errorf("Loss check failed\n")
+	}
+
+	tp.SetImpairment(&RtcpImpairment{SrLoss: 1}, nil)
+	tp.OnRecvCtrl(impairPacket(true, false, 0x11))
+	tp.OnRecvCtrl(impairPacket(false, false, 0x11))
+	if len(upper.ctrl) != 1 {
+		t.Errorf("SrLoss check failed: %d packets\n", len(upper.ctrl))
+	} else if rp := <-upper.ctrl; rp.Type(0) != RtcpRR {
+		t.Errorf("SrLoss dropped the RR\n")
+	}
+
+	tp.SetImpairment(&RtcpImpairment{Corrupt: 1}, nil)
+	orig := impairPacket(true, false, 0x11)
+	want := append([]byte(nil), orig.Buffer()[0:orig.InUse()]...)
+	tp.OnRecvCtrl(orig)
+	rp := <-upper.ctrl
+	got := rp.Buffer()[0:rp.InUse()]
+	block := len(want) - reportBlockLen
+	if !bytes.Equal(got[0:block+rtcpSsrcLength], want[0:block+rtcpSsrcLength]) {
+		t.Errorf("corruption changed the SR or the block's SSRC\n")
+	}
+	if bytes.Equal(got[block+rtcpSsrcLength:], want[block+rtcpSsrcLength:]) {
+		t.Errorf("report block not corrupted\n")
+	}
+	rp.FreePacket()
+
+	tp.SetImpairment(&RtcpImpairment{ByeDelay: 30 * time.Millisecond}, nil)
+	sent := time.Now()
+	tp.OnRecvCtrl(impairPacket(false, true, 0x11))
+	tp.OnRecvCtrl(impairPacket(false, false, 0x22))
+	if rp := <-upper.ctrl; rp.Ssrc(0) != 0x22 {
+		t.Errorf("packet without BYE was delayed\n")
+	}
+	select {
+	case rp := <-upper.ctrl:
+		if rp.Ssrc(0) != 0x11 || time.Since(sent) < 30*time.Millisecond {
+			t.Errorf("BYE delay check failed: %x after %s\n", rp.Ssrc(0), time.Since(sent))
+		}
+	case <-time.After(time.Second):
+		t.Errorf("delayed BYE not forwarded\n")
+	}
+
+	recv, send := tp.Stats()
+	if recv != (ImpairStats{Dropped: 1, DroppedSrs: 1, CorruptedBlocks: 1, DelayedByes: 1}) || send != (ImpairStats{}) {
+		t.Errorf("Stats check failed: %+v %+v\n", recv, send)
+	}
+}
+
+func TestTransportImpairSend(t *testing.T) {
+	parseFlags()
+
+	lower := new(captureWriter)
+	tp := NewTransportImpair(nil, lower)
+	tp.SetImpairment(nil, &RtcpImpairment{Corrupt: 1, SrLoss: 1})
+
+	rp := impairPacket(false, false, 0x11)
+	want := append([]byte(nil), rp.Buffer()[0:rp.InUse()]...)
+	if n, err := tp.WriteCtrlTo(rp, &Address{}); n != len(want) || err != nil {
+		t.Errorf("WriteCtrlTo failed: %d, %v\n", n, err)
+	}
+	if !bytes.Equal(rp.Buffer()[0:rp.InUse()], want) {
+		t.Errorf("send corruption changed the original packet\n")
+	}
+	if len(lower.ctrl) != 1 || bytes.Equal(lower.ctrl[0], want) {
+		t.Errorf("sent packet not corrupted\n")
+	}
+	// a dropped packet counts as sent
+	if n, err := tp.WriteCtrlTo(impairPacket(true, false, 0x11), &Address{}); n == 0 || err != nil || len(lower.ctrl) != 1 {
+		t.Errorf("SR loss check failed: %d, %v, %d packets\n", n, err, len(lower.ctrl))
+	}
+	if _, send := tp.Stats(); send.DroppedSrs != 1 || send.CorruptedBlocks != 1 {
+		t.Errorf("send Stats check failed: %+v\n", send)
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// TransportMux runs many sessions on one UDP socket, thus a deployment needs a single firewall
+// pinhole.
+//
+// Each session uses a MuxTransport of the mux. RTP and RTCP share the socket (RFC 5761), the mux
+// tells RTCP from RTP by the packet type. It hands a received packet to the transport of its
+// remote address tuple. The transports learn their tuples from the destinations they send to
+// and from AddRemote. A packet from an unknown tuple goes to the transport that has its SSRC,
+// see AddSsrc, or the MID in its sdes:mid header extension, see SetMid, and the mux latches the
+// tuple to this transport, thus the following RTCP packets of the remote party find the
+// session. The mux drops the other packets and counts them, see Unrouted.
+//
+// One goroutine reads the socket and calls the sessions, thus a session must not block its
+// receive path, for example with a full data receive channel.
+//
+type TransportMux struct {
+	conn       *net.UDPConn
+	midId      byte // ID of the sdes:mid header extension, 0 disables the MID demultiplexing
+	mutex      sync.RWMutex
+	byAddr     map[string]*MuxTransport
+	bySsrc     map[uint32]*MuxTransport
+	byMid      map[string]*MuxTransport
+	start      sync.Once
+	shortReads uint32 // accessed atomically
+	unrouted   uint32 // accessed atomically
+}
+
+// MuxTransport is the transport of one session of a TransportMux. It implements the
+// TransportRecv and TransportWrite interfaces. Use the remote's port as data and control port,
+// the session sends both to the same port.
+type MuxTransport struct {
+	TransportCommon
+	mux       *TransportMux
+	callUpper TransportRecv
+	active    uint32 // accessed atomically, 1 between ListenOnTransports and CloseRecv
+}
+
+// NewTransportMux creates the mux and binds its socket.
+//
+//   addr - the local IP address
+//   port - the UDP port of all sessions
+//
+func NewTransportMux(addr *net.IPAddr, port int) (*TransportMux, error) {
+	local := &net.UDPAddr{IP: addr.IP, Port: port}
+	conn, err := listenUDP(local)
+	if err != nil {
+		return nil, err
+	}
+	return &TransportMux{conn: conn, byAddr: make(map[string]*MuxTransport), bySsrc: make(map[uint32]*MuxTransport),
+		byMid: make(map[string]*MuxTransport)}, nil
+}
+
+// LocalPort returns the UDP port of the mux.
+func (m *TransportMux) LocalPort() int {
+	return m.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// SetMidExtension sets the header extension ID of the sdes:mid extension (RFC 8843), 0 disables
+// the MID demultiplexing. Set the ID before the first session starts.
+func (m *TransportMux) SetMidExtension(id byte) {
+	m.midId = id
+}
+
+// NewTransport returns a new transport of the mux for a session.
+func (m *TransportMux) NewTransport() *MuxTransport {
+	mt := &MuxTransport{mux: m}
+	mt.callUpper = mt
+	return mt
+}
+
+// ShortReads returns the number of dropped datagrams shorter than a RTP or RTCP header.
+func (m *TransportMux) ShortReads() uint32 {
+	return atomic.LoadUint32(&m.shortReads)
+}
+
+// Unrouted returns the number of received packets that the mux could not assign to a session.
+func (m *TransportMux) Unrouted() uint32 {
+	return atomic.LoadUint32(&m.unrouted)
+}
+
+// Close closes the socket. Close the sessions of the mux before.
+func (m *TransportMux) Close() {
+	m.conn.Close()
+}
+
+// AddRemote routes the packets of the remote's address tuple, IP address and data port, to this
+// transport.
+func (mt *MuxTransport) AddRemote(addr *Address) {
+	mt.mux.mutex.Lock()
+	mt.mux.byAddr[muxKey(addr.IpAddr, addr.DataPort)] = mt
+	mt.mux.mutex.Unlock()
+}
+
+// AddSsrc routes the packets of the SSRC from unknown address tuples to this transport.
+func (mt *MuxTransport) AddSsrc(ssrc uint32) {
+	mt.mux.mutex.Lock()
+	mt.mux.bySsrc[ssrc] = mt
+	mt.mux.mutex.Unlock()
+}
+
+// SetMid routes the RTP packets with the MID from unknown address tuples to this transport, see
+// SetMidExtension.
+func (mt *MuxTransport) SetMid(mid string) {
+	mt.mux.mutex.Lock()
+	mt.mux.byMid[mid] = mt
+	mt.mux.mutex.Unlock()
+}
+
+// ListenOnTransports implements the rtp.TransportRecv ListenOnTransports method. The first
+// transport starts the receiver of the mux.
+func (mt *MuxTransport) ListenOnTransports() error {
+	atomic.StoreUint32(&mt.active, 1)
+	mt.mux.start.Do(func() { go mt.mux.read() })
+	return nil
+}
+
+// *** The following methods implement the rtp.TransportRecv interface.
+
+// SetCallUpper implements the rtp.TransportRecv SetCallUpper method.
+func (mt *MuxTransport) SetCallUpper(upper TransportRecv) {
+	mt.callUpper = upper
+}
+
+// OnRecvData implements the rtp.TransportRecv OnRecvData method.
+//
+// MuxTransport is the lowest layer, it drops the packets without an upper layer.
+func (mt *MuxTransport) OnRecvData(rp *DataPacket) bool {
+	rp.FreePacket()
+	return false
+}
+
+// OnRecvCtrl implements the rtp.TransportRecv OnRecvCtrl method.
+//
+// MuxTransport is the lowest layer, it drops the packets without an upper layer.
+func (mt *MuxTransport) OnRecvCtrl(rp *CtrlPacket) bool {
+	rp.FreePacket()
+	return false
+}
+
+// CloseRecv implements the rtp.TransportRecv CloseRecv method. It removes the routes of the
+// transport, the socket of the mux stays open.
+func (mt *MuxTransport) CloseRecv() {
+	atomic.StoreUint32(&mt.active, 0)
+	mt.mux.remove(mt)
+	if mt.transportEnd != nil {
+		mt.transportEnd <- DataTransportRecvStopped | CtrlTransportRecvStopped
+	}
+}
+
+// SetEndChannel implements the rtp.TransportRecv SetEndChannel method.
+func (mt *MuxTransport) SetEndChannel(ch TransportEnd) {
+	mt.transportEnd = ch
+}
+
+// *** The following methods implement the rtp.TransportWrite interface.
+
+// SetToLower implements the rtp.TransportWrite SetToLower method. MuxTransport has no lower
+// layer.
+func (mt *MuxTransport) SetToLower(lower TransportWrite) {
+}
+
+// WriteDataTo implements the rtp.TransportWrite WriteDataTo method.
+func (mt *MuxTransport) WriteDataTo(rp *DataPacket, addr *Address) (n int, err error) {
+	return mt.writeTo(&rp.RawPacket, addr.IpAddr, addr.DataPort)
+}
+
+// WriteCtrlTo implements the rtp.TransportWrite WriteCtrlTo method. The transport sends to the
+// remote's data port if the control port is not set.
+func (mt *MuxTransport) WriteCtrlTo(rp *CtrlPacket, addr *Address) (n int, err error) {
+	port := addr.CtrlPort
+	if port == 0 {
+		port = addr.DataPort
+	}
+	return mt.writeTo(&rp.RawPacket, addr.IpAddr, port)
+}
+
+// CloseWrite implements the rtp.TransportWrite CloseWrite method.
+func (mt *MuxTransport) CloseWrite() {
+}
+
+// *** Local functions and methods.
+
+func muxKey(ip net.IP, port int) string {
+	return ip.String() + ":" + strconv.Itoa(port)
+}
+
+// learn routes the packets of a destination to the transport unless the tuple has a route.
+func (mt *MuxTransport) learn(key string) {
+	mt.mux.mutex.RLock()
+	_, ok := mt.mux.byAddr[key]
+	mt.mux.mutex.RUnlock()
+	if !ok {
+		mt.mux.mutex.Lock()
+		if _, ok = mt.mux.byAddr[key]; !ok {
+			mt.mux.byAddr[key] = mt
+		}
+		mt.mux.mutex.Unlock()
+	}
+}
+
+func (mt *MuxTransport) writeTo(rp *RawPacket, ip net.IP, port int) (n int, err error) {
+	if atomic.LoadUint32(&mt.active) == 1 {
+		mt.learn(muxKey(ip, port))
+	}
+	mt.setWriteDeadline(mt.mux.conn)
+	n, err = mt.mux.conn.WriteToUDP(rp.buffer[0:rp.inUse], &net.UDPAddr{IP: ip, Port: port})
+	mt.writeDone(err)
+	return
+}
+
+// remove deletes all routes of the transport.
+func (m *TransportMux) remove(mt *MuxTransport) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for key, t := range m.byAddr {
+		if t == mt {
+			delete(m.byAddr, key)
+		}
+	}
+	for ssrc, t := range m.bySsrc {
+		if t == mt {
+			delete(m.bySsrc, ssrc)
+		}
+	}
+	for mid, t := range m.byMid {
+		if t == mt {
+			delete(m.byMid, mid)
+		}
+	}
+}
+
+// route returns the active transport of a packet, nil if the mux has none. A route by SSRC or
+// MID latches the tuple.
+func (m *TransportMux) route(key string, ssrc uint32, mid []byte) *MuxTransport {
+	m.mutex.RLock()
+	mt, ok := m.byAddr[key]
+	if !ok {
+		if mt, ok = m.bySsrc[ssrc]; !ok && mid != nil {
+			mt, ok = m.byMid[string(mid)]
+		}
+	}
+	m.mutex.RUnlock()
+	if !ok || atomic.LoadUint32(&mt.active) == 0 {
+		return nil
+	}
+	mt.learn(key)
+	return mt
+}
+
+func (m *TransportMux) read() {
+	var buf [defaultBufferSize]byte
+
+	for {
+		n, addr, err := m.conn.ReadFromUDP(buf[0:])
+		if err != nil {
+			if readErrorKind(err) != readFatal {
+				continue
+			}
+			break // Close closed the socket
+		}
+		m.dispatch(buf[0:n], addr)
+	}
+}
+
+// dispatch hands a received RTP or RTCP packet to the transport of its session.
+func (m *TransportMux) dispatch(payload []byte, addr *net.UDPAddr) {
+	key := muxKey(addr.IP, addr.Port)
+	if len(payload) >= rtcpHeaderLength+rtcpSsrcLength && payload[1] >= 192 && payload[1] <= 223 {
+		rp, _ := newCtrlPacket()
+		rp.fromAddr = Address{IpAddr: addr.IP, DataPort: addr.Port, CtrlPort: addr.Port}
+		rp.inUse = copy(rp.buffer, payload)
+		if mt := m.route(key, rp.Ssrc(0), nil); mt != nil {
+			mt.callUpper.OnRecvCtrl(rp)
+			return
+		}
+		atomic.AddUint32(&m.unrouted, 1)
+		rp.FreePacket()
+		return
+	}
+	if len(payload) < rtpHeaderLength {
+		atomic.AddUint32(&m.shortReads, 1)
+		return
+	}
+	rp := newDataPacket()
+	rp.fromAddr = Address{IpAddr: addr.IP, DataPort: addr.Port, CtrlPort: addr.Port}
+	rp.inUse = copy(rp.buffer, payload)
+	var mid []byte
+	if m.midId != 0 {
+		mid = rp.ExtensionElement(m.midId)
+	}
+	if mt := m.route(key, rp.Ssrc(), mid); mt != nil {
+		mt.callUpper.OnRecvData(rp)
+		return
+	}
+	atomic.AddUint32(&m.unrouted, 1)
+	rp.FreePacket()
+}
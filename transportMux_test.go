@@ -0,0 +1,130 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// muxConsumer is an upper layer that hands the received data packets to a channel.
+type muxConsumer struct {
+	teeConsumer
+	data chan *DataPacket
+}
+
+func (mc *muxConsumer) OnRecvData(rp *DataPacket) bool { mc.data <- rp; return true }
+
+func muxPacket(ssrc uint32, em *ExtensionMap, mid string) []byte {
+	rp := newDataPacket()
+	rp.SetSsrc(ssrc)
+	rp.SetPayload([]byte{1, 2, 3})
+	if mid != "" {
+		em.SetExtension(rp, ExtSdesMid, []byte(mid))
+	}
+	return append([]byte(nil), rp.Buffer()[0:rp.InUse()]...)
+}
+
+func TestTransportMux(t *testing.T) {
+	parseFlags()
+
+	local, _ := net.ResolveIPAddr("ip", "127.0.0.1")
+	m, err := NewTransportMux(local, 55500)
+	if err != nil {
+		t.Errorf("NewTransportMux failed: %s\n", err)
+		return
+	}
+	defer m.Close()
+	em := NewExtensionMap()
+	em.Register(3, ExtSdesMid)
+	m.SetMidExtension(3)
+
+	mtA, mtB, mtC := m.NewTransport(), m.NewTransport(), m.NewTransport()
+	upA, upB, upC := new(teeConsumer), new(teeConsumer), new(teeConsumer)
+	for i, mt := range []*MuxTransport{mtA, mtB, mtC} {
+		mt.SetCallUpper([]TransportRecv{upA, upB, upC}[i])
+		mt.SetEndChannel(make(TransportEnd, 2))
+		mt.ListenOnTransports()
+	}
+	peerA := &net.UDPAddr{IP: local.IP, Port: 55510}
+	peerB := &net.UDPAddr{IP: local.IP, Port: 55512}
+	peerC := &net.UDPAddr{IP: local.IP, Port: 55514}
+	mtA.AddRemote(&Address{IpAddr: local.IP, DataPort: 55510, CtrlPort: 55510})
+	mtB.AddSsrc(0x0b0b0b0b)
+	mtC.SetMid("video")
+
+	// by tuple, by SSRC and by MID, the latter two latch the tuple for RTCP
+	m.dispatch(muxPacket(0x0a0a0a0a, em, ""), peerA)
+	m.dispatch(muxPacket(0x0b0b0b0b, em, ""), peerB)
+	m.dispatch(muxPacket(0x0c0c0c0c, em, "video"), peerC)
+	rc := quirkCtrl(RtcpRR, 0x0c0c0c0c, &Address{})
+	m.dispatch(rc.Buffer()[0:rc.InUse()], peerC)
+	if len(upA.data) != 1 || len(upB.data) != 1 || len(upC.data) != 1 || len(upC.ctrl) != 1 {
+		t.Errorf("Demultiplexing check failed. Got: %d/%d/%d/%d\n", len(upA.data), len(upB.data), len(upC.data),
+			len(upC.ctrl))
+		return
+	}
+	if from := upC.ctrl[0].fromAddr; from.CtrlPort != 55514 || from.DataPort != 55514 {
+		t.Errorf("Sender address check failed. Got: %d/%d\n", from.DataPort, from.CtrlPort)
+	}
+	m.dispatch(muxPacket(0x0d0d0d0d, em, "audio"), &net.UDPAddr{IP: local.IP, Port: 55516})
+	m.dispatch([]byte{0x80, 0, 0}, peerA)
+	if m.Unrouted() != 1 || m.ShortReads() != 1 || len(upA.data) != 1 {
+		t.Errorf("Unrouted check failed. Got: %d/%d\n", m.Unrouted(), m.ShortReads())
+	}
+	// a closed transport loses its routes
+	mtB.CloseRecv()
+	m.dispatch(muxPacket(0x0b0b0b0b, em, ""), peerB)
+	if len(upB.data) != 1 || m.Unrouted() != 2 {
+		t.Errorf("Closed transport check failed\n")
+	}
+
+	// the sessions send from the single port and learn the destinations
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Port: 55518})
+	if err != nil {
+		t.Errorf("Listen failed: %s\n", err)
+		return
+	}
+	defer peer.Close()
+	mtD := m.NewTransport()
+	upD := &muxConsumer{data: make(chan *DataPacket, 1)}
+	mtD.SetCallUpper(upD)
+	mtD.ListenOnTransports()
+	rp := newDataPacket()
+	rp.SetSsrc(0x01020304)
+	if _, err := mtD.WriteDataTo(rp, &Address{IpAddr: local.IP, DataPort: 55518}); err != nil {
+		t.Errorf("WriteDataTo failed: %s\n", err)
+	}
+	var buf [1500]byte
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, from, err := peer.ReadFromUDP(buf[0:]); err != nil || from.Port != 55500 {
+		t.Errorf("Send port check failed\n")
+		return
+	}
+	peer.WriteToUDP(muxPacket(0x0e0e0e0e, em, ""), &net.UDPAddr{IP: local.IP, Port: 55500})
+	select {
+	case rp = <-upD.data:
+		if rp.Ssrc() != 0x0e0e0e0e {
+			t.Errorf("Received packet check failed\n")
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Learned destination check failed, no packet\n")
+	}
+}
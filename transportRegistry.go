@@ -0,0 +1,164 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+ * This source file contains the registry that maps URI schemes to transport constructors.
+ */
+
+// TransportFactory creates the transport of a transport URI. Most transports implement both
+// interfaces and return the same transport twice.
+type TransportFactory func(uri *url.URL) (TransportRecv, TransportWrite, error)
+
+var (
+	transportsMutex sync.RWMutex
+	transports      = map[string]TransportFactory{
+		"udp":   newUdpFromUri,
+		"mcast": newMulticastFromUri,
+		"tcp":   newTcpFromUri,
+	}
+)
+
+// RegisterTransport registers the constructor of a transport URI scheme.
+//
+// The built-in schemes are "udp" (udp://host:port), "mcast" (mcast://group:port?iface=eth0,
+// add &source=host for a source-specific group) and "tcp" (tcp://host:port), the port is the
+// RTP data port. Packages that provide other
+// transports, for example "tls" or "quic", register their schemes in an init function, a
+// registration replaces an existing one. Scheme names are not case sensitive, nil removes
+// the registration.
+//
+//   scheme  - the URI scheme without "://"
+//   factory - creates the transport of a URI with this scheme
+//
+func RegisterTransport(scheme string, factory TransportFactory) {
+	transportsMutex.Lock()
+	defer transportsMutex.Unlock()
+	if factory == nil {
+		delete(transports, strings.ToLower(scheme))
+		return
+	}
+	transports[strings.ToLower(scheme)] = factory
+}
+
+// TransportSchemes returns the registered URI schemes in alphabetical order.
+func TransportSchemes() []string {
+	transportsMutex.RLock()
+	defer transportsMutex.RUnlock()
+	schemes := make([]string, 0, len(transports))
+	for scheme := range transports {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// NewTransportFromUri creates the transport of a URI with the constructor registered for its
+// scheme, see RegisterTransport. The transport does not listen yet.
+func NewTransportFromUri(uri string) (TransportRecv, TransportWrite, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	transportsMutex.RLock()
+	factory := transports[strings.ToLower(u.Scheme)]
+	transportsMutex.RUnlock()
+	if factory == nil {
+		return nil, nil, Error("Unknown transport scheme: " + u.Scheme)
+	}
+	return factory(u)
+}
+
+// *** Local functions and methods.
+
+// uriAddr returns the IP address and port of the URI's host part.
+func uriAddr(u *url.URL) (*net.IPAddr, int, error) {
+	if u.Port() == "" {
+		return nil, 0, Error("Transport URI has no port: " + u.String())
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		return nil, 0, err
+	}
+	ip, err := net.ResolveIPAddr("ip", u.Hostname())
+	if err != nil {
+		return nil, 0, err
+	}
+	return ip, port, nil
+}
+
+func newUdpFromUri(u *url.URL) (TransportRecv, TransportWrite, error) {
+	addr, port, err := uriAddr(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	tp, err := NewTransportUDP(addr, port)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tp, tp, nil
+}
+
+func newMulticastFromUri(u *url.URL) (TransportRecv, TransportWrite, error) {
+	group, port, err := uriAddr(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ifi *net.Interface
+	if name := u.Query().Get("iface"); name != "" {
+		if ifi, err = net.InterfaceByName(name); err != nil {
+			return nil, nil, err
+		}
+	}
+	var tp *TransportUDP
+	if source := u.Query().Get("source"); source != "" {
+		ip := net.ParseIP(source)
+		if ip == nil {
+			return nil, nil, Error("Invalid multicast source: " + source)
+		}
+		tp, err = NewTransportUDPSourceMulticast(group, &net.IPAddr{IP: ip}, port, ifi)
+	} else {
+		tp, err = NewTransportUDPMulticast(group, port, ifi)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return tp, tp, nil
+}
+
+func newTcpFromUri(u *url.URL) (TransportRecv, TransportWrite, error) {
+	addr, port, err := uriAddr(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	tp, err := NewTransportTCP(addr, port)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tp, tp, nil
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTransportRegistry(t *testing.T) {
+	parseFlags()
+
+	tpr, tpw, err := NewTransportFromUri("udp://127.0.0.1:54040")
+	if err != nil {
+		t.Errorf("UDP transport URI failed: %s\n", err)
+		return
+	}
+	if tp, ok := tpr.(*TransportUDP); !ok || tpw != TransportWrite(tp) || tp.localAddrRtp.Port != 54040 || tp.localAddrRtcp.Port != 54041 {
+		t.Errorf("UDP transport URI check failed\n")
+	}
+	if tpr, _, err = NewTransportFromUri("mcast://239.1.2.3:54042"); err != nil || !tpr.(*TransportUDP).multicast {
+		t.Errorf("Multicast transport URI check failed: %v\n", err)
+	}
+	if _, _, err = NewTransportFromUri("mcast://127.0.0.1:54042"); err == nil {
+		t.Errorf("Multicast address check failed\n")
+	}
+	if tpr, _, err = NewTransportFromUri("TCP://127.0.0.1:54044"); err != nil {
+		t.Errorf("TCP transport URI failed: %s\n", err)
+	} else if _, ok := tpr.(*TransportTCP); !ok {
+		t.Errorf("TCP transport URI check failed\n")
+	}
+	for _, uri := range []string{"udp://127.0.0.1", "quic://127.0.0.1:54046", "127.0.0.1:54046"} {
+		if _, _, err = NewTransportFromUri(uri); err == nil {
+			t.Errorf("Invalid transport URI check failed: %s\n", uri)
+		}
+	}
+
+	// An external package registers its scheme
+	var seen *url.URL
+	RegisterTransport("quic", func(u *url.URL) (TransportRecv, TransportWrite, error) {
+		seen = u
+		tp := new(closeTransport)
+		return tp, tp, nil
+	})
+	defer RegisterTransport("quic", nil)
+	if strings.Join(TransportSchemes(), ",") != "mcast,quic,tcp,udp" {
+		t.Errorf("Transport schemes check failed: %v\n", TransportSchemes())
+	}
+	cfg := &Config{Transport: "quic", Local: "127.0.0.1:54046"}
+	rs, err := BuildSession(cfg)
+	if err != nil {
+		t.Errorf("BuildSession with registered transport failed: %s\n", err)
+		return
+	}
+	if _, ok := rs.transportWrite.(*closeTransport); !ok || seen == nil || seen.Host != "127.0.0.1:54046" {
+		t.Errorf("Registered transport check failed\n")
+	}
+	cfg.Transport = "quic://127.0.0.1:54048?alpn=rtp"
+	if _, err = BuildSession(cfg); err != nil || seen.Query().Get("alpn") != "rtp" {
+		t.Errorf("Configured transport URI check failed\n")
+	}
+}
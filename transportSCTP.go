@@ -0,0 +1,183 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+/*
+ * This source file contains the transport for RTP and RTCP over an SCTP association.
+ */
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// SctpConn is a message oriented connection on a stream of an SCTP association.
+//
+// Each Write sends one message and each Read returns one message, as the streams of SCTP
+// associations and WebRTC data channels over DTLS do. Go has no SCTP in the standard library,
+// the application brings the association, for example a SCTP stream over DTLS/UDP of a WebRTC
+// stack or a native SCTP socket. If the connection has a SetWriteDeadline method the transport
+// enforces the write timeout, see SetWriteTimeout.
+type SctpConn interface {
+	io.ReadWriteCloser
+}
+
+// TransportSCTP sends and receives RTP and RTCP packets as messages of an SCTP association.
+//
+// SCTP keeps the message boundaries, thus the transport needs no framing like TCP. RTP and
+// RTCP share the stream, the transport tells them apart by the packet type as with RTP/RTCP
+// multiplexing, RFC 5761. The association defines the peer, the transport ignores the
+// addresses of the writes. Packages that provide SCTP or DTLS associations register them with
+// RegisterTransport, for example as "sctp" or "dtls" scheme, and return a TransportSCTP.
+type TransportSCTP struct {
+	TransportCommon
+	callUpper TransportRecv
+	toLower   TransportWrite
+	conn      SctpConn
+	remote    Address
+	stop      uint32 // 1 after CloseRecv, accessed atomically
+}
+
+// NewTransportSCTP creates a new RTP transport on an SCTP association.
+//
+//   conn   - the message oriented connection of the association's stream
+//   remote - the peer's address the session sees as the source of the packets, may be nil
+//
+func NewTransportSCTP(conn SctpConn, remote *Address) *TransportSCTP {
+	tp := &TransportSCTP{conn: conn}
+	tp.callUpper = tp
+	if remote != nil {
+		tp.remote = *remote
+	}
+	return tp
+}
+
+// ListenOnTransports starts to receive the messages of the association.
+//
+func (tp *TransportSCTP) ListenOnTransports() (err error) {
+	go tp.readPackets()
+	return nil
+}
+
+// *** The following methods implement the rtp.TransportRecv interface.
+
+// SetCallUpper implements the rtp.TransportRecv SetCallUpper method.
+func (tp *TransportSCTP) SetCallUpper(upper TransportRecv) {
+	tp.callUpper = upper
+}
+
+// OnRecvData implements the rtp.TransportRecv OnRecvData method.
+//
+// TransportSCTP is the lowest layer, it drops the packets without an upper layer.
+func (tp *TransportSCTP) OnRecvData(rp *DataPacket) bool {
+	rp.FreePacket()
+	return false
+}
+
+// OnRecvCtrl implements the rtp.TransportRecv OnRecvCtrl method.
+//
+// TransportSCTP is the lowest layer, it drops the packets without an upper layer.
+func (tp *TransportSCTP) OnRecvCtrl(rp *CtrlPacket) bool {
+	rp.FreePacket()
+	return false
+}
+
+// CloseRecv closes the connection, the receiver terminates and signals via the end channel.
+func (tp *TransportSCTP) CloseRecv() {
+	atomic.StoreUint32(&tp.stop, 1)
+	tp.conn.Close()
+}
+
+// SetEndChannel receives and set the channel to signal back after network socket was closed and receive loop terminated.
+func (tp *TransportSCTP) SetEndChannel(ch TransportEnd) {
+	tp.transportEnd = ch
+}
+
+// *** The following methods implement the rtp.TransportWrite interface.
+
+func (tp *TransportSCTP) SetToLower(lower TransportWrite) {
+	tp.toLower = lower
+}
+
+// WriteDataTo sends the packet as one message of the association, the method ignores the
+// address.
+func (tp *TransportSCTP) WriteDataTo(rp *DataPacket, addr *Address) (n int, err error) {
+	return tp.writeMessage(&rp.RawPacket)
+}
+
+// WriteCtrlTo sends the packet as one message of the association like WriteDataTo.
+func (tp *TransportSCTP) WriteCtrlTo(rp *CtrlPacket, addr *Address) (n int, err error) {
+	return tp.writeMessage(&rp.RawPacket)
+}
+
+func (tp *TransportSCTP) CloseWrite() {
+}
+
+// *** Local functions and methods.
+
+func (tp *TransportSCTP) writeMessage(rp *RawPacket) (n int, err error) {
+	if dl, ok := tp.conn.(interface{ SetWriteDeadline(t time.Time) error }); ok && tp.writeTimeout > 0 {
+		dl.SetWriteDeadline(time.Now().Add(tp.writeTimeout))
+	}
+	n, err = tp.conn.Write(rp.buffer[0:rp.inUse])
+	tp.writeDone(err)
+	return
+}
+
+func (tp *TransportSCTP) readPackets() {
+	var buf [defaultBufferSize]byte
+	for {
+		n, err := tp.conn.Read(buf[0:])
+		if atomic.LoadUint32(&tp.stop) != 0 {
+			break
+		}
+		if err == io.ErrShortBuffer {
+			atomic.AddUint32(&tp.stats.Truncated, 1)
+			continue
+		}
+		if err != nil {
+			atomic.AddUint32(&tp.stats.ReadErrors, 1)
+			break // the association closed
+		}
+		tp.dispatch(buf[0:n])
+	}
+	if tp.transportEnd != nil {
+		tp.transportEnd <- DataTransportRecvStopped | CtrlTransportRecvStopped
+	}
+}
+
+// dispatch hands a received message to the upper layer as RTP or RTCP packet.
+func (tp *TransportSCTP) dispatch(msg []byte) {
+	if len(msg) >= rtcpHeaderLength+rtcpSsrcLength && msg[1] >= 192 && msg[1] <= 223 {
+		rp, _ := newCtrlPacket()
+		rp.fromAddr = tp.remote
+		rp.inUse = copy(rp.buffer, msg)
+		tp.callUpper.OnRecvCtrl(rp)
+		return
+	}
+	if len(msg) < rtpHeaderLength {
+		atomic.AddUint32(&tp.stats.ShortReads, 1)
+		return
+	}
+	rp := newDataPacket()
+	rp.fromAddr = tp.remote
+	rp.inUse = copy(rp.buffer, msg)
+	tp.callUpper.OnRecvData(rp)
+}
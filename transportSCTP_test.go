@@ -0,0 +1,101 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sctpConsumer hands the received packets to channels.
+type sctpConsumer struct {
+	teeConsumer
+	data chan *DataPacket
+	ctrl chan *CtrlPacket
+}
+
+func (sc *sctpConsumer) OnRecvData(rp *DataPacket) bool { sc.data <- rp; return true }
+func (sc *sctpConsumer) OnRecvCtrl(rp *CtrlPacket) bool { sc.ctrl <- rp; return true }
+
+func TestTransportSCTP(t *testing.T) {
+	parseFlags()
+
+	// net.Pipe keeps the message boundaries if the reader's buffer is large enough, like SCTP
+	connA, connB := net.Pipe()
+	peer := &Address{IpAddr: net.IPv4(10, 0, 0, 2), DataPort: 5000, CtrlPort: 5000}
+	tpA, tpB := NewTransportSCTP(connA, nil), NewTransportSCTP(connB, peer)
+	up := &sctpConsumer{data: make(chan *DataPacket, 4), ctrl: make(chan *CtrlPacket, 4)}
+	tpB.SetCallUpper(up)
+	endB := make(TransportEnd, 2)
+	tpB.SetEndChannel(endB)
+	tpB.ListenOnTransports()
+	connA.Write([]byte{0x80, 0}) // too short for RTP and RTCP
+
+	rp := newDataPacket()
+	rp.SetSsrc(0x01020304)
+	rp.SetPayload([]byte{1, 2, 3, 4})
+	if n, err := tpA.WriteDataTo(rp, nil); err != nil || n != rp.InUse() {
+		t.Errorf("WriteDataTo failed: %d, %v\n", n, err)
+		return
+	}
+	rc, offset := newCtrlPacket()
+	rc.SetType(0, RtcpRR)
+	rc.addHeaderSsrc(offset, 0x01020304)
+	rc.SetLength(0, 1)
+	if _, err := tpA.WriteCtrlTo(rc, nil); err != nil {
+		t.Errorf("WriteCtrlTo failed: %s\n", err)
+		return
+	}
+	select {
+	case got := <-up.data:
+		if got.Ssrc() != 0x01020304 || len(got.Payload()) != 4 || !got.fromAddr.IpAddr.Equal(peer.IpAddr) || got.fromAddr.DataPort != 5000 {
+			t.Errorf("Received RTP packet check failed\n")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("RTP packet not received\n")
+		return
+	}
+	select {
+	case got := <-up.ctrl:
+		if got.Type(0) != RtcpRR || got.Ssrc(0) != 0x01020304 {
+			t.Errorf("Received RTCP packet check failed\n")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("RTCP packet not received\n")
+		return
+	}
+
+	tpB.CloseRecv()
+	select {
+	case ev := <-endB:
+		if ev != DataTransportRecvStopped|CtrlTransportRecvStopped {
+			t.Errorf("End channel check failed: %d\n", ev)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Receiver did not stop\n")
+	}
+	if tpB.Stats().ShortReads != 1 || atomic.LoadUint32(&tpB.stats.ReadErrors) != 0 {
+		t.Errorf("Transport stats check failed: %+v\n", tpB.Stats())
+	}
+	if _, err := tpA.WriteDataTo(rp, nil); err == nil || tpA.Stats().SendFailures != 1 {
+		t.Errorf("Write on closed association check failed\n")
+	}
+}
@@ -0,0 +1,812 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"hash"
+	"sync"
+	"time"
+)
+
+// SRTP parameters of the AES_CM_128_HMAC_SHA1_80 crypto suite, RFC 3711 and RFC 4568.
+const (
+	SrtpMasterKeyLength  = 16
+	SrtpMasterSaltLength = 14
+	srtpAuthKeyLength    = 20
+	srtpAuthTagLength    = 10
+	srtcpIndexLength     = 4
+	srtcpEncryptedBit    = 0x80000000
+	srtpReplayWindow     = 64
+)
+
+// Reasons why TransportSRTP rejects incoming packets, see SrtpFailure.
+const (
+	SrtpMalformed   = iota + 1 // the packet is too short or its header is invalid
+	SrtpReplay                 // the packet was already received or is older than the replay window
+	SrtpAuthFailure            // the authentication tag does not match, usually a key mismatch
+	SrtpRocMismatch            // the tag matches a neighbouring rollover counter, the sender's ROC differs
+	SrtpNoKey                  // the transport has SSRC keys but none for the packet's SSRC and no default key
+)
+
+// SRTP key derivation labels, RFC 3711 section 4.3.2
+const (
+	srtpLabelRtpEncryption  = 0x00
+	srtpLabelRtpAuth        = 0x01
+	srtpLabelRtpSalt        = 0x02
+	srtpLabelRtcpEncryption = 0x03
+	srtpLabelRtcpAuth       = 0x04
+	srtpLabelRtcpSalt       = 0x05
+)
+
+// TransportSRTP implements the interfaces TransportRecv and TransportWrite and protects RTP and
+// RTCP packets with SRTP and SRTCP.
+//
+// TransportSRTP is a stackable transport module that sits between the Session (or another upper
+// layer) and a network transport. It supports the AES_CM_128_HMAC_SHA1_80 crypto suite with a key
+// derivation rate of zero. The module uses one master key for outgoing packets and one master
+// key for incoming packets. The crypto contexts keep the rollover counters, SRTCP indices and the
+// replay lists per SSRC.
+//
+// Applications that bridge calls with different keys through one transport install crypto
+// contexts with their own master keys per SSRC and direction, see SetSendKey and SetRecvKey.
+//
+// TransportSRTP drops incoming packets that fail the authentication or replay checks. It counts
+// the dropped packets per reason, see Failures, and reports them to a failure handler, see
+// SetFailureHandler.
+//
+type TransportSRTP struct {
+	callUpper     TransportRecv
+	toLower       TransportWrite
+	transportRecv TransportRecv
+	send, recv    *srtpContext
+
+	ctxMutex                 sync.RWMutex
+	sendStreams, recvStreams map[uint32]*srtpContext // per SSRC contexts, override send and recv
+
+	failMutex       sync.Mutex
+	rtpFailures     SrtpFailureCounts
+	rtcpFailures    SrtpFailureCounts
+	failureHandler  func(f SrtpFailure)
+	failureInterval time.Duration
+	failureReports  map[uint32]*srtpFailureReport
+	failureOverflow srtpFailureReport // shared by the SSRCs that don't fit into failureReports
+
+	absSendTimeId byte
+	profiler      *Profiler
+}
+
+// SrtpFailureCounts holds the number of dropped packets per reason.
+type SrtpFailureCounts struct {
+	Malformed, Replay, AuthFailure, RocMismatch, NoKey uint64
+}
+
+// SrtpFailure describes packets that TransportSRTP rejected, see SetFailureHandler.
+type SrtpFailure struct {
+	Reason int    // SrtpMalformed, SrtpReplay, SrtpAuthFailure, SrtpRocMismatch or SrtpNoKey
+	Rtcp   bool   // true if the packet was an SRTCP packet
+	Ssrc   uint32 // the SSRC in the packet's header
+	From   Address
+	Count  uint64 // number of failures of this SSRC since the last report, including this one
+}
+
+type srtpFailureReport struct {
+	last  time.Time
+	count uint64
+}
+
+// maxFailureReports limits the number of SSRCs the failure reports track. The SSRCs of rejected
+// packets are not authenticated, forged packets may contain any number of different SSRCs.
+const maxFailureReports = 256
+
+// srtpContext holds the session keys derived from one master key and the per SSRC state.
+type srtpContext struct {
+	mutex     sync.Mutex // the hash functions and the state maps are not safe for concurrent use
+	rtpBlock  cipher.Block
+	rtcpBlock cipher.Block
+	rtpSalt   []byte
+	rtcpSalt  []byte
+	rtpAuth   hash.Hash
+	rtcpAuth  hash.Hash
+	rtpState  map[uint32]*srtpState
+	rtcpState map[uint32]*srtpState
+}
+
+// srtpState is the per SSRC state of a SRTP or SRTCP stream.
+type srtpState struct {
+	started bool
+	roc     uint32 // SRTP rollover counter
+	lastSeq uint16 // highest received or last sent sequence number
+	index   uint64 // highest received or last sent packet index
+	replay  uint64 // replay list bitmask, bit 0 represents index
+}
+
+// NewTransportSRTP creates a new SRTP transport module.
+//
+//   tpr     - the lower layer transport that receives the SRTP and SRTCP packets, the function
+//             registers the SRTP transport as its upper layer. May be nil if the module only sends.
+//   tpw     - the lower layer transport that sends the protected packets. May be nil if the
+//             module only receives.
+//   sendKey - master key followed by the master salt (30 bytes) to protect outgoing packets.
+//             If nil the module sends packets unprotected.
+//   recvKey - master key followed by the master salt (30 bytes) to check and decrypt incoming
+//             packets. If nil the module forwards received packets unchanged.
+//
+func NewTransportSRTP(tpr TransportRecv, tpw TransportWrite, sendKey, recvKey []byte) (tp *TransportSRTP, err error) {
+	tp = new(TransportSRTP)
+	if sendKey != nil {
+		if tp.send, err = newSrtpContext(sendKey); err != nil {
+			return nil, err
+		}
+	}
+	if recvKey != nil {
+		if tp.recv, err = newSrtpContext(recvKey); err != nil {
+			return nil, err
+		}
+	}
+	tp.transportRecv = tpr
+	tp.toLower = tpw
+	if tpr != nil {
+		tpr.SetCallUpper(tp)
+	}
+	return tp, nil
+}
+
+// SetSendKey installs a crypto context with its own master key for outgoing packets of an SSRC.
+//
+// The context replaces the transport's send key for this SSRC. Installing a new key for an
+// SSRC resets its rollover counter and SRTCP index. A transport without a send key but with
+// SSRC keys doesn't send the packets of other SSRCs unprotected, it returns an error.
+//
+//   ssrc - the SSRC of the outgoing RTP and RTCP packets
+//   key  - master key followed by the master salt (30 bytes)
+//
+func (tp *TransportSRTP) SetSendKey(ssrc uint32, key []byte) error {
+	ctx, err := newSrtpContext(key)
+	if err != nil {
+		return err
+	}
+	tp.ctxMutex.Lock()
+	if tp.sendStreams == nil {
+		tp.sendStreams = make(map[uint32]*srtpContext)
+	}
+	tp.sendStreams[ssrc] = ctx
+	tp.ctxMutex.Unlock()
+	return nil
+}
+
+// SetRecvKey installs a crypto context with its own master key for incoming packets of an SSRC.
+//
+// See SetSendKey above. A transport without a receive key but with SSRC keys drops the packets
+// of other SSRCs as SrtpNoKey failures instead of forwarding them unauthenticated.
+//
+//   ssrc - the SSRC of the incoming RTP and RTCP packets
+//   key  - master key followed by the master salt (30 bytes)
+//
+func (tp *TransportSRTP) SetRecvKey(ssrc uint32, key []byte) error {
+	ctx, err := newSrtpContext(key)
+	if err != nil {
+		return err
+	}
+	tp.ctxMutex.Lock()
+	if tp.recvStreams == nil {
+		tp.recvStreams = make(map[uint32]*srtpContext)
+	}
+	tp.recvStreams[ssrc] = ctx
+	tp.ctxMutex.Unlock()
+	return nil
+}
+
+// RemoveSendKey removes the crypto context of outgoing packets of an SSRC, the transport then
+// uses its send key again.
+func (tp *TransportSRTP) RemoveSendKey(ssrc uint32) {
+	tp.ctxMutex.Lock()
+	delete(tp.sendStreams, ssrc)
+	tp.ctxMutex.Unlock()
+}
+
+// RemoveRecvKey removes the crypto context of incoming packets of an SSRC, the transport then
+// uses its receive key again.
+func (tp *TransportSRTP) RemoveRecvKey(ssrc uint32) {
+	tp.ctxMutex.Lock()
+	delete(tp.recvStreams, ssrc)
+	tp.ctxMutex.Unlock()
+}
+
+// SetFailureHandler sets a function that TransportSRTP calls if it drops incoming packets.
+//
+// To avoid flooding the application the transport calls the handler at most once per interval
+// for each SSRC, the Count field of the report contains the failures since the last report. The
+// transport tracks up to 256 SSRCs. If more SSRCs fail within the interval, for example because
+// an attacker sends forged packets, these SSRCs share one report per interval. The handler runs
+// on the receiving goroutine of the lower transport and shall not block.
+//
+//   handler  - the function, nil removes the handler
+//   interval - the minimum time between two reports for the same SSRC
+//
+func (tp *TransportSRTP) SetFailureHandler(handler func(f SrtpFailure), interval time.Duration) {
+	tp.failMutex.Lock()
+	tp.failureHandler = handler
+	tp.failureInterval = interval
+	tp.failureReports = make(map[uint32]*srtpFailureReport)
+	tp.failureOverflow = srtpFailureReport{}
+	tp.failMutex.Unlock()
+}
+
+// expireFailureReports removes the reports whose interval elapsed, the next failure of such an
+// SSRC is reported immediately anyway. The caller holds failMutex.
+func (tp *TransportSRTP) expireFailureReports(now time.Time) {
+	for ssrc, report := range tp.failureReports {
+		if now.Sub(report.last) >= tp.failureInterval {
+			delete(tp.failureReports, ssrc)
+		}
+	}
+}
+
+// Failures returns the number of dropped SRTP and SRTCP packets per reason.
+func (tp *TransportSRTP) Failures() (rtp, rtcp SrtpFailureCounts) {
+	tp.failMutex.Lock()
+	defer tp.failMutex.Unlock()
+	return tp.rtpFailures, tp.rtcpFailures
+}
+
+// *** The following methods implement the rtp.TransportRecv interface.
+
+// SetCallUpper implements the rtp.TransportRecv SetCallUpper method.
+func (tp *TransportSRTP) SetCallUpper(upper TransportRecv) {
+	tp.callUpper = upper
+}
+
+// ListenOnTransports implements the rtp.TransportRecv ListenOnTransports method.
+//
+// The SRTP transport just forwards this to the lower layer receiving transport.
+func (tp *TransportSRTP) ListenOnTransports() error {
+	if tp.transportRecv == nil {
+		return Error("TransportSRTP: no receiving transport.")
+	}
+	return tp.transportRecv.ListenOnTransports()
+}
+
+// OnRecvData implements the rtp.TransportRecv OnRecvData method.
+//
+// The method checks and decrypts the SRTP packet in place and forwards it to the upper layer.
+func (tp *TransportSRTP) OnRecvData(rp *DataPacket) bool {
+	recv, missing := tp.context(tp.recvStreams, tp.recv, &rp.RawPacket, ssrcOffsetRtp)
+	if missing {
+		tp.failure(SrtpNoKey, false, &rp.RawPacket, ssrcOffsetRtp)
+		rp.FreePacket()
+		return false
+	}
+	if recv != nil {
+		start := tp.profiler.begin()
+		reason := recv.unprotectRtp(&rp.RawPacket)
+		tp.profiler.measure(ProfileCrypto, start)
+		if reason != 0 {
+			tp.failure(reason, false, &rp.RawPacket, ssrcOffsetRtp)
+			rp.FreePacket()
+			return false
+		}
+	}
+	if tp.callUpper == nil {
+		rp.FreePacket()
+		return false
+	}
+	return tp.callUpper.OnRecvData(rp)
+}
+
+// OnRecvCtrl implements the rtp.TransportRecv OnRecvCtrl method.
+//
+// The method checks and decrypts the SRTCP packet in place and forwards it to the upper layer.
+func (tp *TransportSRTP) OnRecvCtrl(rp *CtrlPacket) bool {
+	recv, missing := tp.context(tp.recvStreams, tp.recv, &rp.RawPacket, ssrcOffsetRtcp)
+	if missing {
+		tp.failure(SrtpNoKey, true, &rp.RawPacket, ssrcOffsetRtcp)
+		rp.FreePacket()
+		return false
+	}
+	if recv != nil {
+		start := tp.profiler.begin()
+		reason := recv.unprotectRtcp(&rp.RawPacket)
+		tp.profiler.measure(ProfileCrypto, start)
+		if reason != 0 {
+			tp.failure(reason, true, &rp.RawPacket, ssrcOffsetRtcp)
+			rp.FreePacket()
+			return false
+		}
+	}
+	if tp.callUpper == nil {
+		rp.FreePacket()
+		return false
+	}
+	return tp.callUpper.OnRecvCtrl(rp)
+}
+
+// CloseRecv implements the rtp.TransportRecv CloseRecv method.
+func (tp *TransportSRTP) CloseRecv() {
+	if tp.transportRecv != nil {
+		tp.transportRecv.CloseRecv()
+	}
+}
+
+// SetEndChannel implements the rtp.TransportRecv SetEndChannel method.
+//
+// The lower layer receiving transport signals directly to the channel.
+func (tp *TransportSRTP) SetEndChannel(ch TransportEnd) {
+	if tp.transportRecv != nil {
+		tp.transportRecv.SetEndChannel(ch)
+	}
+}
+
+// *** The following methods implement the rtp.TransportWrite interface.
+
+// SetProfiler measures the SRTP protection and unprotection in the profiler's ProfileCrypto
+// stage, nil disables the measurement. Set the profiler before the session starts.
+func (tp *TransportSRTP) SetProfiler(pf *Profiler) {
+	tp.profiler = pf
+}
+
+// SetAbsSendTime enables the abs-send-time header extension with the ID, 0 disables it.
+//
+// The transport writes the send time into each RTP packet immediately before it protects
+// the packet, the extension is part of the authenticated header.
+//
+func (tp *TransportSRTP) SetAbsSendTime(id byte) {
+	tp.absSendTimeId = id
+}
+
+// SetToLower implements the rtp.TransportWrite SetToLower method.
+func (tp *TransportSRTP) SetToLower(lower TransportWrite) {
+	tp.toLower = lower
+}
+
+// WriteDataTo implements the rtp.TransportWrite WriteDataTo method.
+//
+// The method protects a copy of the packet because the Session sends the same packet to
+// several remote peers. It also writes the abs-send-time element into the copy, thus the
+// packets of a Forwarder or Translator stay unchanged for the other destinations.
+func (tp *TransportSRTP) WriteDataTo(rp *DataPacket, addr *Address) (n int, err error) {
+	send, missing := tp.context(tp.sendStreams, tp.send, &rp.RawPacket, ssrcOffsetRtp)
+	if missing {
+		return 0, errSrtpNoKey
+	}
+	if send == nil && tp.absSendTimeId == 0 {
+		return tp.toLower.WriteDataTo(rp, addr)
+	}
+	out := newDataPacket()
+	out.inUse = copy(out.buffer, rp.buffer[0:rp.inUse])
+	out.sockOpts = rp.sockOpts
+	out.txTime = rp.txTime
+	if tp.absSendTimeId != 0 {
+		stampAbsSendTime(out, tp.absSendTimeId)
+	}
+	if send != nil {
+		start := tp.profiler.begin()
+		ok := send.protectRtp(&out.RawPacket)
+		tp.profiler.measure(ProfileCrypto, start)
+		if !ok {
+			out.FreePacket()
+			return 0, Error("TransportSRTP: cannot protect RTP packet.")
+		}
+	}
+	n, err = tp.toLower.WriteDataTo(out, addr)
+	out.FreePacket()
+	return
+}
+
+// WriteCtrlTo implements the rtp.TransportWrite WriteCtrlTo method.
+//
+// The method protects a copy of the packet, see WriteDataTo.
+func (tp *TransportSRTP) WriteCtrlTo(rp *CtrlPacket, addr *Address) (n int, err error) {
+	send, missing := tp.context(tp.sendStreams, tp.send, &rp.RawPacket, ssrcOffsetRtcp)
+	if missing {
+		return 0, errSrtpNoKey
+	}
+	if send == nil {
+		return tp.toLower.WriteCtrlTo(rp, addr)
+	}
+	out, _ := newCtrlPacket()
+	out.inUse = copy(out.buffer, rp.buffer[0:rp.inUse])
+	out.sockOpts = rp.sockOpts
+	out.txTime = rp.txTime
+	start := tp.profiler.begin()
+	ok := send.protectRtcp(&out.RawPacket)
+	tp.profiler.measure(ProfileCrypto, start)
+	if !ok {
+		out.FreePacket()
+		return 0, Error("TransportSRTP: cannot protect RTCP packet.")
+	}
+	n, err = tp.toLower.WriteCtrlTo(out, addr)
+	out.FreePacket()
+	return
+}
+
+// CloseWrite implements the rtp.TransportWrite CloseWrite method.
+func (tp *TransportSRTP) CloseWrite() {
+	if tp.toLower != nil {
+		tp.toLower.CloseWrite()
+	}
+}
+
+// *** Local functions and methods.
+
+// context returns the crypto context for the SSRC of a packet, either the SSRC's own context
+// or the default context. A transport without any keys has no context, its packets pass
+// unprotected. If the transport has SSRC contexts but neither one for the packet nor a default
+// context, missing is true and the packet must not pass.
+func (tp *TransportSRTP) context(streams map[uint32]*srtpContext, def *srtpContext, rp *RawPacket, ssrcOffset int) (ctx *srtpContext, missing bool) {
+	tp.ctxMutex.RLock()
+	defer tp.ctxMutex.RUnlock()
+	if len(streams) > 0 && rp.inUse >= ssrcOffset+4 {
+		if ctx, ok := streams[binary.BigEndian.Uint32(rp.buffer[ssrcOffset:])]; ok {
+			return ctx, false
+		}
+	}
+	return def, def == nil && len(streams) > 0
+}
+
+const errSrtpNoKey = Error("TransportSRTP: no key for the SSRC of the packet.")
+
+// failure counts a dropped packet and reports it to the failure handler.
+func (tp *TransportSRTP) failure(reason int, rtcp bool, rp *RawPacket, ssrcOffset int) {
+	var ssrc uint32
+	if rp.inUse >= ssrcOffset+4 {
+		ssrc = binary.BigEndian.Uint32(rp.buffer[ssrcOffset:])
+	}
+	tp.failMutex.Lock()
+	counts := &tp.rtpFailures
+	if rtcp {
+		counts = &tp.rtcpFailures
+	}
+	switch reason {
+	case SrtpMalformed:
+		counts.Malformed++
+	case SrtpReplay:
+		counts.Replay++
+	case SrtpAuthFailure:
+		counts.AuthFailure++
+	case SrtpRocMismatch:
+		counts.RocMismatch++
+	case SrtpNoKey:
+		counts.NoKey++
+	}
+	handler := tp.failureHandler
+	if handler == nil {
+		tp.failMutex.Unlock()
+		return
+	}
+	now := time.Now()
+	report, ok := tp.failureReports[ssrc]
+	if !ok {
+		if len(tp.failureReports) >= maxFailureReports {
+			tp.expireFailureReports(now)
+		}
+		if len(tp.failureReports) < maxFailureReports {
+			report = new(srtpFailureReport)
+			tp.failureReports[ssrc] = report
+		} else {
+			report = &tp.failureOverflow
+		}
+	}
+	report.count++
+	if !report.last.IsZero() && now.Sub(report.last) < tp.failureInterval {
+		tp.failMutex.Unlock()
+		return
+	}
+	f := SrtpFailure{Reason: reason, Rtcp: rtcp, Ssrc: ssrc, From: rp.fromAddr, Count: report.count}
+	report.last = now
+	report.count = 0
+	tp.failMutex.Unlock()
+	handler(f)
+}
+
+// newSrtpContext derives the session keys from a master key and master salt, RFC 3711 section 4.3.
+func newSrtpContext(masterKeySalt []byte) (*srtpContext, error) {
+	if len(masterKeySalt) != SrtpMasterKeyLength+SrtpMasterSaltLength {
+		return nil, Error("SRTP master key and salt must be 30 bytes.")
+	}
+	master, err := aes.NewCipher(masterKeySalt[:SrtpMasterKeyLength])
+	if err != nil {
+		return nil, err
+	}
+	salt := masterKeySalt[SrtpMasterKeyLength:]
+
+	ctx := new(srtpContext)
+	if ctx.rtpBlock, err = aes.NewCipher(srtpDeriveKey(master, salt, srtpLabelRtpEncryption, SrtpMasterKeyLength)); err != nil {
+		return nil, err
+	}
+	if ctx.rtcpBlock, err = aes.NewCipher(srtpDeriveKey(master, salt, srtpLabelRtcpEncryption, SrtpMasterKeyLength)); err != nil {
+		return nil, err
+	}
+	ctx.rtpSalt = srtpDeriveKey(master, salt, srtpLabelRtpSalt, SrtpMasterSaltLength)
+	ctx.rtcpSalt = srtpDeriveKey(master, salt, srtpLabelRtcpSalt, SrtpMasterSaltLength)
+	ctx.rtpAuth = hmac.New(sha1.New, srtpDeriveKey(master, salt, srtpLabelRtpAuth, srtpAuthKeyLength))
+	ctx.rtcpAuth = hmac.New(sha1.New, srtpDeriveKey(master, salt, srtpLabelRtcpAuth, srtpAuthKeyLength))
+	ctx.rtpState = make(map[uint32]*srtpState)
+	ctx.rtcpState = make(map[uint32]*srtpState)
+	return ctx, nil
+}
+
+// srtpDeriveKey computes a session key with the AES-CM PRF. The key derivation rate is zero,
+// thus the key id is just the label.
+func srtpDeriveKey(master cipher.Block, salt []byte, label byte, length int) []byte {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, salt)
+	iv[7] ^= label
+	key := make([]byte, length)
+	cipher.NewCTR(master, iv).XORKeyStream(key, key)
+	return key
+}
+
+// srtpIv computes the AES-CM IV: (salt * 2^16) XOR (SSRC * 2^64) XOR (index * 2^16).
+func srtpIv(salt []byte, ssrc uint32, index uint64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, salt)
+	iv[4] ^= byte(ssrc >> 24)
+	iv[5] ^= byte(ssrc >> 16)
+	iv[6] ^= byte(ssrc >> 8)
+	iv[7] ^= byte(ssrc)
+	for i := 0; i < 6; i++ {
+		iv[8+i] ^= byte(index >> uint(40-8*i))
+	}
+	return iv
+}
+
+func (ctx *srtpContext) state(states map[uint32]*srtpState, ssrc uint32) *srtpState {
+	st := states[ssrc]
+	if st == nil {
+		st = new(srtpState)
+		states[ssrc] = st
+	}
+	return st
+}
+
+// recvState returns the state of a received SSRC, a new state that is not yet stored if the
+// SSRC is unknown. The caller keeps a new state only after the packet authenticated, thus
+// forged packets with random SSRCs don't add states.
+func (ctx *srtpContext) recvState(states map[uint32]*srtpState, ssrc uint32) (st *srtpState, known bool) {
+	if st = states[ssrc]; st != nil {
+		return st, true
+	}
+	return new(srtpState), false
+}
+
+// authTag computes the truncated HMAC-SHA1 of data and roc. If roc is nil the function
+// does not include a rollover counter (SRTCP).
+func authTag(mac hash.Hash, data, roc []byte) []byte {
+	mac.Reset()
+	mac.Write(data)
+	if roc != nil {
+		mac.Write(roc)
+	}
+	return mac.Sum(nil)[:srtpAuthTagLength]
+}
+
+// rtpHeaderLen returns the length of the RTP header including CSRCs and extension, or -1 if
+// the packet is too short.
+func rtpHeaderLen(buf []byte) int {
+	if len(buf) < rtpHeaderLength {
+		return -1
+	}
+	length := rtpHeaderLength + int(buf[0]&ccMask)*4
+	if buf[0]&extensionBit != 0 {
+		if len(buf) < length+4 {
+			return -1
+		}
+		length += 4 + int(binary.BigEndian.Uint16(buf[length+2:]))*4
+	}
+	if length > len(buf) {
+		return -1
+	}
+	return length
+}
+
+// checkReplay returns true if the packet index was not yet received and is inside the replay window.
+func (st *srtpState) checkReplay(index uint64) bool {
+	if !st.started || index > st.index {
+		return true
+	}
+	delta := st.index - index
+	if delta >= srtpReplayWindow {
+		return false
+	}
+	return st.replay&(1<<delta) == 0
+}
+
+// updateReplay records the index of an authenticated packet in the replay list.
+func (st *srtpState) updateReplay(index uint64) {
+	if !st.started {
+		st.started = true
+		st.index = index
+		st.replay = 1
+		return
+	}
+	if index > st.index {
+		delta := index - st.index
+		if delta >= srtpReplayWindow {
+			st.replay = 1
+		} else {
+			st.replay = st.replay<<delta | 1
+		}
+		st.index = index
+		return
+	}
+	st.replay |= 1 << (st.index - index)
+}
+
+// protectRtp encrypts the payload and appends the authentication tag.
+func (ctx *srtpContext) protectRtp(rp *RawPacket) bool {
+	hdrLen := rtpHeaderLen(rp.buffer[0:rp.inUse])
+	if hdrLen < 0 || rp.inUse+srtpAuthTagLength > len(rp.buffer) {
+		return false
+	}
+	ssrc := binary.BigEndian.Uint32(rp.buffer[ssrcOffsetRtp:])
+	seq := binary.BigEndian.Uint16(rp.buffer[sequenceOffset:])
+
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	st := ctx.state(ctx.rtpState, ssrc)
+	if st.started && seq < st.lastSeq && st.lastSeq-seq > 0x8000 {
+		st.roc++ // sequence number wrapped
+	}
+	st.started = true
+	st.lastSeq = seq
+	index := uint64(st.roc)<<16 | uint64(seq)
+
+	payload := rp.buffer[hdrLen:rp.inUse]
+	cipher.NewCTR(ctx.rtpBlock, srtpIv(ctx.rtpSalt, ssrc, index)).XORKeyStream(payload, payload)
+
+	var roc [4]byte
+	binary.BigEndian.PutUint32(roc[:], st.roc)
+	rp.inUse += copy(rp.buffer[rp.inUse:], authTag(ctx.rtpAuth, rp.buffer[0:rp.inUse], roc[:]))
+	return true
+}
+
+// unprotectRtp checks the authentication tag and the replay list, decrypts the payload and
+// removes the authentication tag. It returns zero or the reason why it rejected the packet.
+func (ctx *srtpContext) unprotectRtp(rp *RawPacket) int {
+	if rp.inUse < rtpHeaderLength+srtpAuthTagLength {
+		return SrtpMalformed
+	}
+	authLen := rp.inUse - srtpAuthTagLength
+	hdrLen := rtpHeaderLen(rp.buffer[0:authLen])
+	if hdrLen < 0 {
+		return SrtpMalformed
+	}
+	ssrc := binary.BigEndian.Uint32(rp.buffer[ssrcOffsetRtp:])
+	seq := binary.BigEndian.Uint16(rp.buffer[sequenceOffset:])
+
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	st, known := ctx.recvState(ctx.rtpState, ssrc)
+
+	// Estimate the rollover counter, RFC 3711 appendix A
+	roc := st.roc
+	if st.started {
+		if st.lastSeq < 0x8000 {
+			if seq > st.lastSeq && seq-st.lastSeq > 0x8000 {
+				roc--
+			}
+		} else if st.lastSeq-0x8000 > seq {
+			roc++
+		}
+	}
+	index := uint64(roc)<<16 | uint64(seq)
+	if !st.checkReplay(index) {
+		return SrtpReplay
+	}
+	if !ctx.checkRtpTag(rp.buffer[0:authLen], rp.buffer[authLen:rp.inUse], roc) {
+		// Check if the sender uses another rollover counter to tell this from a key mismatch
+		if st.started && (ctx.checkRtpTag(rp.buffer[0:authLen], rp.buffer[authLen:rp.inUse], roc+1) ||
+			ctx.checkRtpTag(rp.buffer[0:authLen], rp.buffer[authLen:rp.inUse], roc-1)) {
+			return SrtpRocMismatch
+		}
+		return SrtpAuthFailure
+	}
+	if !known {
+		ctx.rtpState[ssrc] = st
+	}
+	if !st.started || roc > st.roc || (roc == st.roc && seq > st.lastSeq) {
+		st.roc = roc
+		st.lastSeq = seq
+	}
+	st.updateReplay(index)
+
+	payload := rp.buffer[hdrLen:authLen]
+	cipher.NewCTR(ctx.rtpBlock, srtpIv(ctx.rtpSalt, ssrc, index)).XORKeyStream(payload, payload)
+	rp.inUse = authLen
+	return 0
+}
+
+// checkRtpTag checks the authentication tag of a SRTP packet with the rollover counter roc.
+func (ctx *srtpContext) checkRtpTag(data, tag []byte, roc uint32) bool {
+	var rocBuf [4]byte
+	binary.BigEndian.PutUint32(rocBuf[:], roc)
+	return subtle.ConstantTimeCompare(authTag(ctx.rtpAuth, data, rocBuf[:]), tag) == 1
+}
+
+// protectRtcp encrypts the compound after the first sender SSRC and appends the E flag, the
+// SRTCP index and the authentication tag.
+func (ctx *srtpContext) protectRtcp(rp *RawPacket) bool {
+	offset := rtcpHeaderLength + rtcpSsrcLength
+	if rp.inUse < offset || rp.inUse+srtcpIndexLength+srtpAuthTagLength > len(rp.buffer) {
+		return false
+	}
+	ssrc := binary.BigEndian.Uint32(rp.buffer[ssrcOffsetRtcp:])
+
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	st := ctx.state(ctx.rtcpState, ssrc)
+	if st.started {
+		st.index = (st.index + 1) &^ srtcpEncryptedBit
+	}
+	st.started = true
+
+	body := rp.buffer[offset:rp.inUse]
+	cipher.NewCTR(ctx.rtcpBlock, srtpIv(ctx.rtcpSalt, ssrc, st.index)).XORKeyStream(body, body)
+
+	binary.BigEndian.PutUint32(rp.buffer[rp.inUse:], uint32(st.index)|srtcpEncryptedBit)
+	rp.inUse += srtcpIndexLength
+	rp.inUse += copy(rp.buffer[rp.inUse:], authTag(ctx.rtcpAuth, rp.buffer[0:rp.inUse], nil))
+	return true
+}
+
+// unprotectRtcp checks the authentication tag and the replay list, decrypts the compound and
+// removes the SRTCP index and authentication tag. It returns zero or the reason why it rejected
+// the packet.
+func (ctx *srtpContext) unprotectRtcp(rp *RawPacket) int {
+	offset := rtcpHeaderLength + rtcpSsrcLength
+	if rp.inUse < offset+srtcpIndexLength+srtpAuthTagLength {
+		return SrtpMalformed
+	}
+	authLen := rp.inUse - srtpAuthTagLength
+	indexWord := binary.BigEndian.Uint32(rp.buffer[authLen-srtcpIndexLength:])
+	index := uint64(indexWord &^ srtcpEncryptedBit)
+	ssrc := binary.BigEndian.Uint32(rp.buffer[ssrcOffsetRtcp:])
+
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	st, known := ctx.recvState(ctx.rtcpState, ssrc)
+	if !st.checkReplay(index) {
+		return SrtpReplay
+	}
+	tag := authTag(ctx.rtcpAuth, rp.buffer[0:authLen], nil)
+	if subtle.ConstantTimeCompare(tag, rp.buffer[authLen:rp.inUse]) != 1 {
+		return SrtpAuthFailure
+	}
+	if !known {
+		ctx.rtcpState[ssrc] = st
+	}
+	st.updateReplay(index)
+
+	body := rp.buffer[offset : authLen-srtcpIndexLength]
+	if indexWord&srtcpEncryptedBit != 0 {
+		cipher.NewCTR(ctx.rtcpBlock, srtpIv(ctx.rtcpSalt, ssrc, index)).XORKeyStream(body, body)
+	}
+	rp.inUse = authLen - srtcpIndexLength
+	return 0
+}
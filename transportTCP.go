@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,6 +16,30 @@ type TransportTCP struct {
 	dataConn, ctrlConn            net.Conn
 	localAddrRtp, localAddrRtcp   *net.TCPAddr
 	remoteAddrRtp, remoteAddrRtcp *net.TCPAddr
+
+	keepAlive     bool
+	keepIdle      time.Duration
+	keepInterval  time.Duration
+	keepCount     int
+	healthHandler func(h TcpHealth)
+	idleTimeout   time.Duration
+	lastRecv      int64 // time of the last received packet, accessed atomically
+}
+
+// States of the TCP connection reported to the health handler.
+const (
+	TcpConnected = iota // the transport accepted the connection
+	TcpIdle             // the peer sent no packet for the idle timeout
+	TcpActive           // the peer sends packets again after TcpIdle
+	TcpClosed           // the connection failed or closed, Err holds the reason
+)
+
+// TcpHealth reports a change of the TCP connection's state.
+type TcpHealth struct {
+	State    int          // TcpConnected, TcpIdle, TcpActive or TcpClosed
+	Remote   *net.TCPAddr // the peer's address
+	LastRecv time.Time    // time of the last packet received from the peer
+	Err      error        // the read error that closed the connection, nil if the transport closed it
 }
 
 // NewTransportTCP creates a new RTP transport for TCP.
@@ -32,6 +57,34 @@ func NewTransportTCP(addr *net.IPAddr, port int) (*TransportTCP, error) {
 	return tp, nil
 }
 
+// SetKeepAlive enables TCP keepalive on the accepted connection. A half-open connection
+// fails after idle + count * interval, the read fails and the health handler reports
+// TcpClosed. Set keepalive before ListenOnTransports. Platforms other than Linux use the
+// system's probe interval and count.
+//
+//   idle     - the idle time of the connection before the first keepalive probe
+//   interval - the time between keepalive probes
+//   count    - the number of unanswered probes that fail the connection
+//
+func (tp *TransportTCP) SetKeepAlive(idle, interval time.Duration, count int) {
+	tp.keepAlive = true
+	tp.keepIdle, tp.keepInterval, tp.keepCount = idle, interval, count
+}
+
+// SetHealthHandler sets the handler that monitors the connection. The transport reports the
+// accepted connection, a peer that sends no packets for the idle timeout, its recovery and
+// the end of the connection. Keepalive detects dead peers, the idle timeout detects peers
+// that keep the connection but stopped sending media. Set the handler before
+// ListenOnTransports.
+//
+//   handler - called on state changes of the connection
+//   idle    - the idle timeout, 0 disables the idle check
+//
+func (tp *TransportTCP) SetHealthHandler(handler func(h TcpHealth), idle time.Duration) {
+	tp.healthHandler = handler
+	tp.idleTimeout = idle
+}
+
 // ListenOnTransports listens for incoming RTP and RTCP packets addressed
 // to this transport.
 //
@@ -43,10 +96,22 @@ func (tp *TransportTCP) ListenOnTransports() (err error) {
 			return
 		}
 		log.Printf("Listen on: %s", ln.Addr())
-		tp.dataConn, err = ln.AcceptTCP()
-		log.Printf("Accept connection from: %s", tp.dataConn.RemoteAddr())
-		tp.remoteAddrRtp, _ = net.ResolveTCPAddr(tp.dataConn.RemoteAddr().Network(), tp.dataConn.RemoteAddr().String())
+		conn, err := ln.AcceptTCP()
 		ln.Close()
+		if err != nil {
+			tp.reportHealth(TcpClosed, err)
+			return
+		}
+		if tp.keepAlive {
+			if err = setKeepAlive(conn, tp.keepIdle, tp.keepInterval, tp.keepCount); err != nil {
+				fmt.Printf("TransportTCP: failed to set keepalive: %s\n", err)
+			}
+		}
+		log.Printf("Accept connection from: %s", conn.RemoteAddr())
+		tp.remoteAddrRtp, _ = net.ResolveTCPAddr(conn.RemoteAddr().Network(), conn.RemoteAddr().String())
+		tp.dataConn = conn
+		atomic.StoreInt64(&tp.lastRecv, time.Now().UnixNano())
+		tp.reportHealth(TcpConnected, nil)
 		go tp.readDataPacket()
 	}()
 	return
@@ -67,19 +132,13 @@ func (tp *TransportTCP) OnRecvCtrl(rp *CtrlPacket) bool {
 }
 
 func (tp *TransportTCP) CloseRecv() {
-	//
-	// The correct way to do it is to close the UDP connection after setting the
-	// stop flags to true. However, until issue 2116 is solved just set the flags
-	// and rely on the read timeout in the read packet functions
-	//
+	// Set the stop flags first, then close the connection. Closing unblocks the read,
+	// the receiver terminates and signal via the end channel.
 	tp.dataRecvStop = true
 	tp.ctrlRecvStop = true
-
-	//    err := tp.rtpConn.Close()
-	//    if err != nil {
-	//        fmt.Printf("Close failed: %s\n", err.String())
-	//    }
-	//    tp.rtcpConn.Close()
+	if tp.dataConn != nil {
+		tp.dataConn.Close()
+	}
 }
 
 // SetEndChannel receives and set the channel to signal back after network socket was closed and receive loop terminated.
@@ -87,22 +146,98 @@ func (tp *TransportTCP) SetEndChannel(ch TransportEnd) {
 	tp.transportEnd = ch
 }
 
+// *** The following methods implement the rtp.TransportWrite interface.
+
+func (tp *TransportTCP) SetToLower(lower TransportWrite) {
+	tp.toLower = lower
+}
+
+// WriteDataTo sends the packet on the accepted connection, framed with the RFC 4571 length
+// field. The connection defines the peer, the method ignores the address.
+//
+// If a write exceeds the write timeout the peer may have received a part of the packet, the
+// framing of the connection is lost and the application shall close the transport.
+func (tp *TransportTCP) WriteDataTo(rp *DataPacket, addr *Address) (n int, err error) {
+	return tp.writeFramed(&rp.RawPacket)
+}
+
+// WriteCtrlTo sends the packet on the accepted connection like WriteDataTo.
+func (tp *TransportTCP) WriteCtrlTo(rp *CtrlPacket, addr *Address) (n int, err error) {
+	return tp.writeFramed(&rp.RawPacket)
+}
+
+func (tp *TransportTCP) CloseWrite() {
+}
+
+func (tp *TransportTCP) writeFramed(rp *RawPacket) (n int, err error) {
+	conn := tp.dataConn
+	if conn == nil {
+		return 0, Error("TransportTCP: not connected.")
+	}
+	buf := make([]byte, 2+rp.inUse)
+	buf[0], buf[1] = byte(rp.inUse>>8), byte(rp.inUse)
+	copy(buf[2:], rp.buffer[0:rp.inUse])
+	tp.setWriteDeadline(conn)
+	n, err = conn.Write(buf)
+	tp.writeDone(err)
+	return
+}
+
+// reportHealth calls the health handler with the connection's state.
+func (tp *TransportTCP) reportHealth(state int, err error) {
+	if tp.healthHandler == nil {
+		return
+	}
+	tp.healthHandler(TcpHealth{State: state, Remote: tp.remoteAddrRtp, LastRecv: time.Unix(0, atomic.LoadInt64(&tp.lastRecv)), Err: err})
+}
+
+// monitor reports TcpIdle if the peer sends no packets for the idle timeout and TcpActive if
+// it sends again. It stops if the receiver terminates.
+func (tp *TransportTCP) monitor(stop chan bool) {
+	ticker := time.NewTicker(tp.idleTimeout / 4)
+	defer ticker.Stop()
+	idle := false
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			silent := now.UnixNano()-atomic.LoadInt64(&tp.lastRecv) > int64(tp.idleTimeout)
+			if silent != idle {
+				idle = silent
+				if idle {
+					tp.reportHealth(TcpIdle, nil)
+				} else {
+					tp.reportHealth(TcpActive, nil)
+				}
+			}
+		}
+	}
+}
+
 func (tp *TransportTCP) readDataPacket() {
 	var buf [defaultBufferSize]byte
 
+	tp.pinReadThread()
+
+	if tp.healthHandler != nil && tp.idleTimeout/4 > 0 {
+		stop := make(chan bool)
+		defer close(stop)
+		go tp.monitor(stop)
+	}
 	tp.dataRecvStop = false
+	var err error
 	for {
-		tp.dataConn.SetReadDeadline(time.Now().Add(20 * time.Millisecond)) // 20 ms, re-test and remove after Go issue 2116 is solved
-		n, err := tp.dataConn.Read(buf[0:])
+		var n int
+		n, err = tp.dataConn.Read(buf[0:])
 		if tp.dataRecvStop {
+			err = nil
 			break
 		}
-		if e, ok := err.(net.Error); ok && e.Timeout() {
-			continue
-		}
 		if err != nil {
 			break
 		}
+		atomic.StoreInt64(&tp.lastRecv, time.Now().UnixNano())
 		rp := newDataPacket()
 		rp.fromAddr.IpAddr = tp.remoteAddrRtp.IP
 		rp.fromAddr.DataPort = tp.remoteAddrRtp.Port
@@ -114,5 +249,6 @@ func (tp *TransportTCP) readDataPacket() {
 		}
 	}
 	tp.dataConn.Close()
+	tp.reportHealth(TcpClosed, err)
 	tp.transportEnd <- DataTransportRecvStopped
 }
@@ -0,0 +1,35 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+//go:build !linux
+// +build !linux
+
+package rtp
+
+import (
+	"net"
+	"time"
+)
+
+// setKeepAlive enables TCP keepalive with the idle time, the system selects interval and count.
+func setKeepAlive(conn *net.TCPConn, idle, interval time.Duration, count int) error {
+	if err := conn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return conn.SetKeepAlivePeriod(idle)
+}
@@ -0,0 +1,118 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWriteTimeout(t *testing.T) {
+	parseFlags()
+
+	local, peer := net.Pipe()
+	defer local.Close()
+	defer peer.Close()
+	tp, _ := NewTransportTCP(&net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}, 0)
+	tp.dataConn = local
+	var blocked []error
+	tp.SetWriteTimeout(20*time.Millisecond, func(err error) { blocked = append(blocked, err) })
+
+	rp, _ := NewDataPacketFromBuffer(append(make([]byte, rtpHeaderLength), payload...))
+	defer rp.FreePacket()
+	received := make(chan []byte)
+	go func() {
+		buf := make([]byte, 100)
+		n, _ := peer.Read(buf)
+		received <- buf[:n]
+	}()
+	if _, err := tp.WriteDataTo(rp, nil); err != nil {
+		t.Errorf("WriteDataTo failed: %s\n", err)
+	}
+	if frame := <-received; len(frame) != 2+rp.InUse() || frame[0] != 0 || int(frame[1]) != rp.InUse() {
+		t.Errorf("Framing check failed. Got: %x\n", frame)
+	}
+
+	// the peer stops reading: the write must not block
+	start := time.Now()
+	if _, err := tp.WriteDataTo(rp, nil); err == nil {
+		t.Errorf("Blocked WriteDataTo must fail\n")
+	}
+	if time.Since(start) > time.Second || tp.BlockedWrites() != 1 || len(blocked) != 1 {
+		t.Errorf("Blocked write check failed. Blocked: %d, handler calls: %d\n", tp.BlockedWrites(), len(blocked))
+	}
+}
+
+func TestTcpHealth(t *testing.T) {
+	parseFlags()
+
+	local := net.IPv4(127, 0, 0, 1)
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: local})
+	if err != nil {
+		t.Errorf("ListenTCP failed: %s\n", err)
+		return
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	tp, _ := NewTransportTCP(&net.IPAddr{IP: local}, port)
+	events := make(chan TcpHealth, 8)
+	tp.SetKeepAlive(time.Second, time.Second, 3)
+	tp.SetHealthHandler(func(h TcpHealth) { events <- h }, 40*time.Millisecond)
+	tp.SetCallUpper(new(teeConsumer))
+	tp.SetEndChannel(make(TransportEnd, 2))
+	tp.ListenOnTransports()
+
+	var peer net.Conn
+	for i := 0; i < 50 && peer == nil; i++ {
+		if peer, err = net.Dial("tcp4", ln.Addr().String()); err != nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if peer == nil {
+		t.Errorf("Dial failed: %s\n", err)
+		return
+	}
+	expect := func(state int) *TcpHealth {
+		select {
+		case h := <-events:
+			if h.State != state {
+				t.Errorf("Health state check failed. Expected: %d, got: %d\n", state, h.State)
+			}
+			return &h
+		case <-time.After(time.Second):
+			t.Errorf("Health state %d not reported\n", state)
+			return nil
+		}
+	}
+	if h := expect(TcpConnected); h != nil && h.Remote.Port != peer.LocalAddr().(*net.TCPAddr).Port {
+		t.Errorf("Health remote check failed. Got: %s\n", h.Remote)
+	}
+	frame := append([]byte{0, byte(rtpHeaderLength + len(payload))}, make([]byte, rtpHeaderLength)...)
+	frame = append(frame, payload...)
+	frame[2] = 0x80
+	expect(TcpIdle)
+	peer.Write(frame)
+	expect(TcpActive)
+	peer.Close()
+	if h := expect(TcpClosed); h != nil && h.Err == nil {
+		t.Errorf("Closed connection must report the read error\n")
+	}
+}
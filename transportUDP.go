@@ -21,6 +21,9 @@ package rtp
 import (
 	"fmt"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/room732/gortp/iana"
@@ -34,6 +37,70 @@ type TransportUDP struct {
 	toLower                     TransportWrite
 	dataConn, ctrlConn          *net.UDPConn
 	localAddrRtp, localAddrRtcp *net.UDPAddr
+	multicast                   bool
+	multicastIfi                *net.Interface
+	multicastSource             net.IP // nil for any-source multicast
+	multicastOwnIfi             bool   // IPv4: receive only the group's packets of multicastIfi, see NewMulticastLegs
+	absSendTimeId               byte
+
+	optMutex       sync.RWMutex // writers hold it shared, changes of the socket's options exclusive
+	dataIp         *ipv4.Conn
+	defaultOptions SocketOptions // the socket's options after ListenOnTransports
+	currentOptions SocketOptions // the options currently set on the socket
+	destOptions    map[string]*SocketOptions
+
+	dataDrops, ctrlDrops uint32 // the kernel's receive queue drop counters of the sockets
+
+	txTimeOn uint32 // 1 if the data socket uses SO_TXTIME, accessed atomically
+	txClock  int    // the clock of the transmit times, see EnableTxTime
+
+	refreshMutex sync.Mutex
+	refreshStop  chan bool // stops the multicast refresh, see SetMulticastRefresh
+	lastDataRecv int64     // time in nanoseconds of the last received RTP datagram, accessed atomically
+	rejoins      uint32    // re-joins of the multicast group, accessed atomically
+}
+
+// The socket options of SocketOptions.
+const (
+	SockOptTos = 1 << iota
+	SockOptTtl
+	SockOptDontFragment
+)
+
+// SocketOptions holds socket options that TransportUDP applies to single packets.
+//
+// Applications set the options per destination, see TransportUDP.SetDestinationOptions, or
+// per packet, see RawPacket.SetSocketOptions. The options of a packet override the options of
+// its destination, options that are not set keep the transport's defaults.
+//
+// On Linux the transport sends the TOS byte and the TTL as control messages with the packet,
+// other packets on the socket are not affected. IPv4 has no control message for the don't
+// fragment bit, thus the transport sets it on the socket. It keeps the setting until a packet
+// needs another one and serializes only the writes that change it. On other platforms the
+// transport handles all options this way.
+//
+type SocketOptions struct {
+	Set          int  // the options to apply, a combination of SockOptTos, SockOptTtl and SockOptDontFragment
+	Tos          int  // TOS byte containing the DiffServ code point, see package iana
+	Ttl          int  // IP time to live (hop limit)
+	DontFragment bool // set the don't fragment bit
+}
+
+// merge returns the options with the options that are set in other replaced.
+func (so SocketOptions) merge(other *SocketOptions) SocketOptions {
+	if other == nil {
+		return so
+	}
+	if other.Set&SockOptTos != 0 {
+		so.Tos = other.Tos
+	}
+	if other.Set&SockOptTtl != 0 {
+		so.Ttl = other.Ttl
+	}
+	if other.Set&SockOptDontFragment != 0 {
+		so.DontFragment = other.DontFragment
+	}
+	return so
 }
 
 // NewRtpTransportUDP creates a new RTP transport for UPD.
@@ -51,31 +118,146 @@ func NewTransportUDP(addr *net.IPAddr, port int) (*TransportUDP, error) {
 	return tp, nil
 }
 
+// NewTransportUDPMulticast creates a new RTP transport for UDP that joins a multicast group.
+//
+// The transport receives the RTP and RTCP packets sent to the group and sends packets from
+// the group's ports. To send packets to the group use the group's address as remote address.
+// The transport disables the multicast loopback, it does not receive its own packets.
+//
+// group - The multicast group's IP address
+//
+// port  - The port number of the RTP data port. This must be an even port number.
+//         The following odd port number is the control (RTCP) port.
+//
+// ifi   - The network interface to join the group on, nil selects the system's default
+//
+func NewTransportUDPMulticast(group *net.IPAddr, port int, ifi *net.Interface) (*TransportUDP, error) {
+	if !group.IP.IsMulticast() {
+		return nil, Error("Not a multicast address: " + group.String())
+	}
+	tp, _ := NewTransportUDP(group, port)
+	tp.multicast = true
+	tp.multicastIfi = ifi
+	return tp, nil
+}
+
+// NewTransportUDPSourceMulticast creates a new RTP transport for UDP that joins a
+// source-specific multicast group, RFC 4607. The transport receives only the packets of the
+// source, as the SSM deployments of AES67 and SMPTE ST 2110 require.
+//
+// group  - The multicast group's IP address, usually in 232.0.0.0/8
+//
+// source - The IP address of the sender
+//
+// port   - The port number of the RTP data port. This must be an even port number.
+//          The following odd port number is the control (RTCP) port.
+//
+// ifi    - The network interface to join the group on, nil selects the system's default
+//
+func NewTransportUDPSourceMulticast(group, source *net.IPAddr, port int, ifi *net.Interface) (*TransportUDP, error) {
+	if source == nil || source.IP.To4() == nil || group.IP.To4() == nil {
+		return nil, Error("Source-specific multicast needs IPv4 group and source addresses.")
+	}
+	tp, err := NewTransportUDPMulticast(group, port, ifi)
+	if err != nil {
+		return nil, err
+	}
+	tp.multicastSource = source.IP
+	return tp, nil
+}
+
+// NewTransportUDPAutoPorts creates a new RTP transport for UDP on a free port pair.
+//
+// The function binds the RTP data port and the following RTCP control port immediately and
+// skips ports that are in use, LocalPorts returns the selected ports.
+//
+// addr    - The UPD socket's local IP address
+//
+// minPort - The lowest port number for the RTP data port, 0 lets the operating system select
+//           the ports
+//
+// maxPort - The highest port number for the RTP data port, ignored if minPort is 0
+//
+func NewTransportUDPAutoPorts(addr *net.IPAddr, minPort, maxPort int) (*TransportUDP, error) {
+	if minPort < 0 || maxPort > 0xfffe || (minPort > 0 && maxPort < minPort) {
+		return nil, Error("Invalid port range.")
+	}
+	tp, _ := NewTransportUDP(addr, 0)
+	if minPort == 0 {
+		return tp, tp.bindSystemPorts(addr)
+	}
+	var err error = Error("No free port pair in range.")
+	for port := minPort + minPort&1; port <= maxPort; port += 2 {
+		tp.localAddrRtp = &net.UDPAddr{IP: addr.IP, Port: port}
+		tp.localAddrRtcp = &net.UDPAddr{IP: addr.IP, Port: port + 1}
+		if err = tp.bind(); err == nil {
+			return tp, nil
+		}
+	}
+	return nil, err
+}
+
+// LocalPorts returns the RTP data port and the RTCP control port of the transport.
+func (tp *TransportUDP) LocalPorts() (dataPort, ctrlPort int) {
+	return tp.localAddrRtp.Port, tp.localAddrRtcp.Port
+}
+
 // ListenOnTransports listens for incoming RTP and RTCP packets addressed
 // to this transport.
 //
 func (tp *TransportUDP) ListenOnTransports() (err error) {
-	tp.dataConn, err = net.ListenUDP(tp.localAddrRtp.Network(), tp.localAddrRtp)
-	if err != nil {
-		return
+	if tp.dataConn == nil {
+		if err = tp.bind(); err != nil {
+			return
+		}
 	}
 
+	enableQueueDrops(tp.dataConn)
+	enableQueueDrops(tp.ctrlConn)
+
 	p := ipv4.NewConn(tp.dataConn)
 	if err = p.SetTOS(iana.DiffServAF41); err != nil {
 		fmt.Printf("TransportUDP: failed to set TOS marking on dataConn\n")
 	}
+	tp.dataIp = p
+	tp.defaultOptions.Tos, _ = p.TOS()
+	tp.defaultOptions.Ttl, _ = p.TTL()
+	tp.currentOptions = tp.defaultOptions
 
-	tp.ctrlConn, err = net.ListenUDP(tp.localAddrRtcp.Network(), tp.localAddrRtcp)
-	if err != nil {
-		tp.dataConn.Close()
-		tp.dataConn = nil
-		return
-	}
 	go tp.readDataPacket()
 	go tp.readCtrlPacket()
 	return nil
 }
 
+// SetAbsSendTime enables the abs-send-time header extension with the ID, 0 disables it.
+//
+// The transport writes the send time into each RTP packet immediately before the socket
+// write. If a TransportSRTP protects the packets enable the extension on the SRTP transport
+// instead, the UDP transport cannot modify protected packets.
+//
+func (tp *TransportUDP) SetAbsSendTime(id byte) {
+	tp.absSendTimeId = id
+}
+
+// SetDestinationOptions sets the socket options of the packets sent to a destination, for
+// example to send the flows of several QoS classes via one transport. Nil removes the options.
+//
+// The transport matches the destination's IP address and data port.
+//
+func (tp *TransportUDP) SetDestinationOptions(addr *Address, opts *SocketOptions) {
+	tp.optMutex.Lock()
+	defer tp.optMutex.Unlock()
+	if opts == nil {
+		delete(tp.destOptions, destinationKey(addr))
+		return
+	}
+	if tp.destOptions == nil {
+		tp.destOptions = make(map[string]*SocketOptions)
+	}
+	o := *opts
+	tp.destOptions[destinationKey(addr)] = &o
+}
+
 // *** The following methods implement the rtp.TransportRecv interface.
 
 // SetCallUpper implements the rtp.TransportRecv SetCallUpper method.
@@ -103,19 +285,17 @@ func (tp *TransportUDP) OnRecvCtrl(rp *CtrlPacket) bool {
 
 // CloseRecv implements the rtp.TransportRecv CloseRecv method.
 func (tp *TransportUDP) CloseRecv() {
-	//
-	// The correct way to do it is to close the UDP connection after setting the
-	// stop flags to true. However, until issue 2116 is solved just set the flags
-	// and rely on the read timeout in the read packet functions
-	//
+	// Set the stop flags first, then close the connections. Closing unblocks the reads,
+	// the receivers terminate and signal via the end channel.
+	tp.stopMulticastRefresh()
 	tp.dataRecvStop = true
 	tp.ctrlRecvStop = true
-
-	//    err := tp.rtpConn.Close()
-	//    if err != nil {
-	//        fmt.Printf("Close failed: %s\n", err.String())
-	//    }
-	//    tp.rtcpConn.Close()
+	if tp.dataConn != nil {
+		tp.dataConn.Close()
+	}
+	if tp.ctrlConn != nil {
+		tp.ctrlConn.Close()
+	}
 }
 
 // setEndChannel receives and set the channel to signal back after network socket was closed and receive loop terminated.
@@ -134,7 +314,10 @@ func (tp *TransportUDP) SetToLower(lower TransportWrite) {
 
 // WriteRtpTo implements the rtp.TransportWrite WriteRtpTo method.
 func (tp *TransportUDP) WriteDataTo(rp *DataPacket, addr *Address) (n int, err error) {
-	return tp.dataConn.WriteToUDP(rp.buffer[0:rp.inUse], &net.UDPAddr{addr.IpAddr, addr.DataPort, ""})
+	if tp.absSendTimeId != 0 {
+		stampAbsSendTime(rp, tp.absSendTimeId)
+	}
+	return tp.writeTo(&rp.RawPacket, addr)
 }
 
 // WriteRtcpTo implements the rtp.TransportWrite WriteRtcpTo method.
@@ -142,7 +325,7 @@ func (tp *TransportUDP) WriteCtrlTo(rp *CtrlPacket, addr *Address) (n int, err e
 	//return tp.ctrlConn.WriteToUDP(rp.buffer[0:rp.inUse], &net.UDPAddr{addr.IpAddr, addr.CtrlPort, ""})
 	// TODO: big hack - send back RTCP packets (SR) in RTP data port, since hole punching is only
 	// done on the RTP data port...
-	return tp.dataConn.WriteToUDP(rp.buffer[0:rp.inUse], &net.UDPAddr{addr.IpAddr, addr.DataPort, ""})
+	return tp.writeTo(&rp.RawPacket, addr)
 }
 
 // CloseWrite implements the rtp.TransportWrite CloseWrite method.
@@ -154,27 +337,211 @@ func (tp *TransportUDP) CloseWrite() {
 
 // *** Local functions and methods.
 
+func destinationKey(addr *Address) string {
+	return addr.IpAddr.String() + ":" + strconv.Itoa(addr.DataPort)
+}
+
+// writeTo sends the packet via the data socket within the write timeout.
+func (tp *TransportUDP) writeTo(rp *RawPacket, addr *Address) (n int, err error) {
+	tp.setWriteDeadline(tp.dataConn)
+	n, err = tp.sendTo(rp, addr)
+	tp.writeDone(err)
+	return
+}
+
+// sendTo sends the packet via the data socket with the socket options of the packet and its
+// destination, see SocketOptions, and the packet's transmit time, see EnableTxTime. Writes
+// that don't need to change the options on the socket run in parallel.
+func (tp *TransportUDP) sendTo(rp *RawPacket, addr *Address) (n int, err error) {
+	buf := rp.buffer[0:rp.inUse]
+	dst := &net.UDPAddr{IP: addr.IpAddr, Port: addr.DataPort}
+	tp.optMutex.RLock()
+	txTime := tp.txTimeMessage(rp)
+	if tp.dataIp == nil {
+		tp.optMutex.RUnlock()
+		if txTime != nil {
+			n, _, err = tp.dataConn.WriteMsgUDP(buf, txTime, dst)
+			return
+		}
+		return tp.dataConn.WriteToUDP(buf, dst)
+	}
+	opts := tp.defaultOptions.merge(tp.destOptions[destinationKey(addr)]).merge(rp.sockOpts)
+	socket := opts // the options to set on the socket
+	var oob []byte
+	if controlMessageOptions {
+		oob = controlMessages(&opts, &tp.defaultOptions, addr.IpAddr.To4() == nil)
+		socket.Tos, socket.Ttl = tp.defaultOptions.Tos, tp.defaultOptions.Ttl
+	}
+	oob = append(oob, txTime...)
+	if socket == tp.currentOptions {
+		n, _, err = tp.dataConn.WriteMsgUDP(buf, oob, dst)
+		tp.optMutex.RUnlock()
+		return
+	}
+	tp.optMutex.RUnlock()
+
+	tp.optMutex.Lock()
+	defer tp.optMutex.Unlock()
+	tp.applyOptions(socket)
+	n, _, err = tp.dataConn.WriteMsgUDP(buf, oob, dst)
+	return
+}
+
+// applyOptions sets the options that differ from the current ones on the socket. The caller
+// holds optMutex exclusively.
+func (tp *TransportUDP) applyOptions(opts SocketOptions) {
+	cur := &tp.currentOptions
+	if opts.Tos != cur.Tos {
+		if err := tp.dataIp.SetTOS(opts.Tos); err != nil {
+			fmt.Printf("TransportUDP: failed to set TOS marking: %s\n", err)
+		}
+		cur.Tos = opts.Tos
+	}
+	if opts.Ttl != cur.Ttl {
+		if err := tp.dataIp.SetTTL(opts.Ttl); err != nil {
+			fmt.Printf("TransportUDP: failed to set TTL: %s\n", err)
+		}
+		cur.Ttl = opts.Ttl
+	}
+	if opts.DontFragment != cur.DontFragment {
+		if err := setDontFragment(tp.dataConn, opts.DontFragment); err != nil {
+			fmt.Printf("TransportUDP: failed to set don't fragment: %s\n", err)
+		}
+		cur.DontFragment = opts.DontFragment
+	}
+}
+
+// bind opens the data and the control socket on the transport's local addresses.
+func (tp *TransportUDP) bind() (err error) {
+	tp.dataConn, err = tp.listen(tp.localAddrRtp)
+	if err != nil {
+		return
+	}
+	tp.ctrlConn, err = tp.listen(tp.localAddrRtcp)
+	if err != nil {
+		tp.dataConn.Close()
+		tp.dataConn = nil
+	}
+	return
+}
+
+// maxPortAttempts limits the attempts to get an even data port with a free control port from
+// the operating system.
+const maxPortAttempts = 32
+
+// bindSystemPorts opens the data socket on a port the operating system selects and the
+// control socket on the next port. It retries if the system selected an odd port or the next
+// port is in use.
+func (tp *TransportUDP) bindSystemPorts(addr *net.IPAddr) (err error) {
+	for i := 0; i < maxPortAttempts; i++ {
+		tp.localAddrRtp = &net.UDPAddr{IP: addr.IP}
+		if tp.dataConn, err = tp.listen(tp.localAddrRtp); err != nil {
+			return
+		}
+		port := tp.dataConn.LocalAddr().(*net.UDPAddr).Port
+		if port&1 == 0 && port < 0xffff {
+			tp.localAddrRtp = &net.UDPAddr{IP: addr.IP, Port: port}
+			tp.localAddrRtcp = &net.UDPAddr{IP: addr.IP, Port: port + 1}
+			if tp.ctrlConn, err = tp.listen(tp.localAddrRtcp); err == nil {
+				return
+			}
+		}
+		tp.dataConn.Close()
+		tp.dataConn = nil
+	}
+	return Error("No free port pair from the system.")
+}
+
+func (tp *TransportUDP) listen(addr *net.UDPAddr) (*net.UDPConn, error) {
+	if !tp.multicast {
+		return listenUDP(addr)
+	}
+	var conn *net.UDPConn
+	var err error
+	if tp.multicastSource != nil {
+		conn, err = listenSourceMulticastUDP(addr, tp.multicastSource, tp.multicastIfi)
+	} else {
+		conn, err = listenMulticastUDP(addr, tp.multicastIfi)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tp.multicastOwnIfi && addr.IP.To4() != nil {
+		if err = setMulticastAll(conn, false); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	// don't receive own packets sent to the group
+	if err = ipv4.NewPacketConn(conn).SetMulticastLoopback(false); err != nil {
+		fmt.Printf("TransportUDP: failed to disable multicast loopback\n")
+	}
+	return conn, nil
+}
+
 // Here the local RTP and RTCP UDP network receivers. The ListenOnTransports() starts them
 // as go functions. The functions just receive data from the network, copy it into
 // the packet buffers and forward the packets to the next upper layer via callback
 // if callback is not nil
 
+// The kinds of read errors, see readErrorKind(). Only a fatal error ends a receiver.
+const (
+	readFatal = iota
+	readTruncated
+	readTransient
+)
+
+// readPacket reads a datagram from the socket and updates the transport's counters. It returns
+// n < 0 for datagrams that are truncated or shorter than minLength, the caller drops them.
+func (tp *TransportUDP) readPacket(conn *net.UDPConn, buf, oob []byte, drops *uint32, minLength int) (n int, addr *net.UDPAddr, err error) {
+	n, oobn, flags, addr, err := conn.ReadMsgUDP(buf, oob)
+	if err != nil {
+		switch readErrorKind(err) {
+		case readTruncated:
+			atomic.AddUint32(&tp.stats.Truncated, 1)
+			return -1, addr, nil
+		case readTransient:
+			atomic.AddUint32(&tp.stats.ReadErrors, 1)
+			return -1, addr, nil
+		}
+		return
+	}
+	if count, ok := queueDrops(oob[0:oobn]); ok {
+		atomic.StoreUint32(drops, count)
+		atomic.StoreUint32(&tp.stats.KernelDrops, atomic.LoadUint32(&tp.dataDrops)+atomic.LoadUint32(&tp.ctrlDrops))
+	}
+	switch {
+	case msgTruncated(flags):
+		atomic.AddUint32(&tp.stats.Truncated, 1)
+		n = -1
+	case n < minLength:
+		atomic.AddUint32(&tp.stats.ShortReads, 1)
+		n = -1
+	}
+	return
+}
+
 func (tp *TransportUDP) readDataPacket() {
 	var buf [defaultBufferSize]byte
+	oob := make([]byte, queueDropsSpace)
 
+	tp.pinReadThread()
 	tp.dataRecvStop = false
 	for {
-		tp.dataConn.SetReadDeadline(time.Now().Add(20 * time.Millisecond)) // 20 ms, re-test and remove after Go issue 2116 is solved
-		n, addr, err := tp.dataConn.ReadFromUDP(buf[0:])
+		n, addr, err := tp.readPacket(tp.dataConn, buf[0:], oob, &tp.dataDrops, rtpHeaderLength)
 		if tp.dataRecvStop {
 			break
 		}
-		if e, ok := err.(net.Error); ok && e.Timeout() {
-			continue
-		}
 		if err != nil {
+			atomic.AddUint32(&tp.stats.ReadErrors, 1)
 			break
 		}
+		if n < 0 {
+			continue
+		}
+		if tp.multicast {
+			atomic.StoreInt64(&tp.lastDataRecv, time.Now().UnixNano())
+		}
 		rp := newDataPacket()
 		rp.fromAddr.IpAddr = addr.IP
 		rp.fromAddr.DataPort = addr.Port
@@ -192,20 +559,22 @@ func (tp *TransportUDP) readDataPacket() {
 
 func (tp *TransportUDP) readCtrlPacket() {
 	var buf [defaultBufferSize]byte
+	oob := make([]byte, queueDropsSpace)
 
+	tp.pinReadThread()
 	tp.ctrlRecvStop = false
 	for {
-		tp.ctrlConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)) // 100 ms, re-test and remove after Go issue 2116 is solved
-		n, addr, err := tp.ctrlConn.ReadFromUDP(buf[0:])
+		n, addr, err := tp.readPacket(tp.ctrlConn, buf[0:], oob, &tp.ctrlDrops, rtcpHeaderLength)
 		if tp.ctrlRecvStop {
 			break
 		}
-		if e, ok := err.(net.Error); ok && e.Timeout() {
-			continue
-		}
 		if err != nil {
+			atomic.AddUint32(&tp.stats.ReadErrors, 1)
 			break
 		}
+		if n < 0 {
+			continue
+		}
 		rp, _ := newCtrlPacket()
 		rp.fromAddr.IpAddr = addr.IP
 		rp.fromAddr.CtrlPort = addr.Port
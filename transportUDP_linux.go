@@ -0,0 +1,201 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// controlMessageOptions is true if the platform sends the TOS byte and the TTL as per packet
+// control messages.
+const controlMessageOptions = true
+
+// controlMessages returns the control messages for the options that differ from the socket's
+// defaults, nil if there are none: IP_TOS and IP_TTL for an IPv4 destination, IPV6_TCLASS and
+// IPV6_HOPLIMIT for an IPv6 destination.
+func controlMessages(opts, defaults *SocketOptions, ipv6 bool) []byte {
+	level, tos, ttl := syscall.IPPROTO_IP, syscall.IP_TOS, syscall.IP_TTL
+	if ipv6 {
+		level, tos, ttl = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, syscall.IPV6_HOPLIMIT
+	}
+	var oob []byte
+	if opts.Tos != defaults.Tos {
+		oob = append(oob, ipControlMessage(level, tos, opts.Tos)...)
+	}
+	if opts.Ttl != defaults.Ttl {
+		oob = append(oob, ipControlMessage(level, ttl, opts.Ttl)...)
+	}
+	return oob
+}
+
+func ipControlMessage(level, msgType, value int) []byte {
+	b := make([]byte, syscall.CmsgSpace(4))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = int32(level)
+	h.Type = int32(msgType)
+	h.SetLen(syscall.CmsgLen(4))
+	*(*int32)(unsafe.Pointer(&b[syscall.CmsgLen(0)])) = int32(value)
+	return b
+}
+
+// ipv6DontFrag is the IPV6_DONTFRAG socket option, see ipv6(7), not in package syscall.
+const ipv6DontFrag = 62
+
+// setDontFragment sets or clears the don't fragment bit of the packets sent via the socket. An
+// IPv6 socket doesn't fragment the packets with IPV6_DONTFRAG, the IPv4 option then covers the
+// IPv4 mapped destinations of a dual stack socket.
+func setDontFragment(conn *net.UDPConn, on bool) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	discover, dontFrag := syscall.IP_PMTUDISC_DONT, 0
+	if on {
+		discover, dontFrag = syscall.IP_PMTUDISC_DO, 1
+	}
+	local, _ := conn.LocalAddr().(*net.UDPAddr)
+	ipv6 := local != nil && local.IP.To4() == nil
+	cerr := rc.Control(func(fd uintptr) {
+		if !ipv6 {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, discover)
+			return
+		}
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6DontFrag, dontFrag)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, discover)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// queueDropsSpace is the size of the control message buffer for the receive queue drop counter.
+var queueDropsSpace = syscall.CmsgSpace(4)
+
+// enableQueueDrops requests the kernel's receive queue drop counter (SO_RXQ_OVFL) with each
+// received datagram.
+func enableQueueDrops(conn *net.UDPConn) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	rc.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RXQ_OVFL, 1)
+	})
+}
+
+// queueDrops returns the socket's receive queue drop counter from the control messages.
+func queueDrops(oob []byte) (uint32, bool) {
+	if len(oob) == 0 {
+		return 0, false
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == syscall.SO_RXQ_OVFL && len(m.Data) >= 4 {
+			return *(*uint32)(unsafe.Pointer(&m.Data[0])), true
+		}
+	}
+	return 0, false
+}
+
+func msgTruncated(flags int) bool {
+	return flags&syscall.MSG_TRUNC != 0
+}
+
+// soTxTime is SO_TXTIME, the option and its control message SCM_TXTIME, not in package syscall.
+const soTxTime = 61
+
+// sofTxTimeDeadline is the deadline mode flag of SO_TXTIME.
+const sofTxTimeDeadline = 1
+
+// The clock IDs of the transmit times, see clock_gettime(2).
+var txClockIds = [...]int32{TxClockTai: 11, TxClockMonotonic: 1}
+
+// setTxTime enables SO_TXTIME on the socket.
+func setTxTime(conn *net.UDPConn, clock int, deadline bool) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	cfg := struct {
+		clockId int32
+		flags   uint32
+	}{clockId: txClockIds[clock]}
+	if deadline {
+		cfg.flags |= sofTxTimeDeadline
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, fd, syscall.SOL_SOCKET, soTxTime,
+			uintptr(unsafe.Pointer(&cfg)), unsafe.Sizeof(cfg), 0)
+		if errno != 0 {
+			err = errno
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// txTimeControl returns the SCM_TXTIME control message of a transmit time.
+func txTimeControl(at int64) []byte {
+	b := make([]byte, syscall.CmsgSpace(8))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = syscall.SOL_SOCKET
+	h.Type = soTxTime
+	h.SetLen(syscall.CmsgLen(8))
+	*(*uint64)(unsafe.Pointer(&b[syscall.CmsgLen(0)])) = uint64(at)
+	return b
+}
+
+// ipMulticastAll is the IP_MULTICAST_ALL socket option, see ip(7).
+const ipMulticastAll = 49
+
+// setMulticastAll sets IP_MULTICAST_ALL. A socket without it receives only the packets of the
+// groups it joined itself on the interfaces it joined them, not those of other sockets bound
+// to the same group and port.
+func setMulticastAll(conn *net.UDPConn, on bool) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	value := 0
+	if on {
+		value = 1
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, ipMulticastAll, value)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// clockNow returns the time of the transmit time clock in nanoseconds.
+func clockNow(clock int) int64 {
+	var ts syscall.Timespec
+	syscall.Syscall(syscall.SYS_CLOCK_GETTIME, uintptr(txClockIds[clock]), uintptr(unsafe.Pointer(&ts)), 0)
+	return ts.Nano()
+}
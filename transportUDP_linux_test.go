@@ -0,0 +1,387 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/room732/gortp/iana"
+	"golang.org/x/net/ipv4"
+)
+
+// receiveOptions reads a packet and returns the TOS byte and TTL it arrived with.
+func receiveOptions(t *testing.T, conn *net.UDPConn) (tos, ttl int) {
+	buf := make([]byte, 1500)
+	oob := make([]byte, 128)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, oobn, _, _, err := conn.ReadMsgUDP(buf, oob)
+	if err != nil {
+		t.Errorf("ReadMsgUDP failed: %s\n", err)
+		return -1, -1
+	}
+	msgs, _ := syscall.ParseSocketControlMessage(oob[:oobn])
+	tos, ttl = -1, -1
+	for _, m := range msgs {
+		if m.Header.Level != syscall.IPPROTO_IP || len(m.Data) == 0 {
+			continue
+		}
+		switch m.Header.Type {
+		case syscall.IP_TOS:
+			tos = int(m.Data[0])
+		case syscall.IP_TTL:
+			if len(m.Data) >= 4 {
+				ttl = int(m.Data[0]) | int(m.Data[1])<<8 | int(m.Data[2])<<16 | int(m.Data[3])<<24
+			}
+		}
+	}
+	return
+}
+
+func dontFragment(conn *net.UDPConn) bool {
+	rc, _ := conn.SyscallConn()
+	var discover int
+	rc.Control(func(fd uintptr) {
+		discover, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER)
+	})
+	return discover == syscall.IP_PMTUDISC_DO
+}
+
+func TestSocketOptions(t *testing.T) {
+	parseFlags()
+	loopback := net.IPv4(127, 0, 0, 1)
+	recv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Errorf("ListenUDP failed: %s\n", err)
+		return
+	}
+	defer recv.Close()
+	rc, _ := recv.SyscallConn()
+	rc.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVTOS, 1)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVTTL, 1)
+	})
+
+	tp, _ := NewTransportUDP(&net.IPAddr{IP: loopback}, 0)
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Errorf("ListenUDP failed: %s\n", err)
+		return
+	}
+	defer conn.Close()
+	tp.dataConn = conn
+	tp.dataIp = ipv4.NewConn(conn)
+	tp.dataIp.SetTOS(iana.DiffServAF41)
+	tp.dataIp.SetTTL(64)
+	tp.defaultOptions = SocketOptions{Tos: iana.DiffServAF41, Ttl: 64}
+	tp.currentOptions = tp.defaultOptions
+
+	dest := &Address{loopback, recv.LocalAddr().(*net.UDPAddr).Port, 0}
+	rp, _ := NewDataPacketFromBuffer(append(make([]byte, rtpHeaderLength), payload...))
+	tp.WriteDataTo(rp, dest)
+	if tos, ttl := receiveOptions(t, recv); tos != iana.DiffServAF41 || ttl != 64 {
+		t.Errorf("Default socket options check failed. Got TOS: %d, TTL: %d\n", tos, ttl)
+	}
+
+	tp.SetDestinationOptions(dest, &SocketOptions{Set: SockOptTos | SockOptTtl, Tos: iana.DiffServEFPHB, Ttl: 2})
+	tp.WriteDataTo(rp, dest)
+	if tos, ttl := receiveOptions(t, recv); tos != iana.DiffServEFPHB || ttl != 2 {
+		t.Errorf("Destination socket options check failed. Got TOS: %d, TTL: %d\n", tos, ttl)
+	}
+	// packet options override the destination's options, unset options keep them
+	rp.SetSocketOptions(&SocketOptions{Set: SockOptTos | SockOptDontFragment, Tos: iana.DiffServCS0, DontFragment: true})
+	tp.WriteDataTo(rp, dest)
+	if tos, ttl := receiveOptions(t, recv); tos != iana.DiffServCS0 || ttl != 2 {
+		t.Errorf("Packet socket options check failed. Got TOS: %d, TTL: %d\n", tos, ttl)
+	}
+	if !dontFragment(conn) {
+		t.Errorf("Don't fragment check failed, the bit is not set\n")
+	}
+	// TOS and TTL are per packet, they don't change the socket
+	if tos, _ := tp.dataIp.TOS(); tos != iana.DiffServAF41 {
+		t.Errorf("Socket TOS check failed. Got: %d\n", tos)
+	}
+	rp.SetSocketOptions(nil)
+	tp.SetDestinationOptions(dest, nil)
+	tp.WriteDataTo(rp, dest)
+	if tos, ttl := receiveOptions(t, recv); tos != iana.DiffServAF41 || ttl != 64 {
+		t.Errorf("Reset socket options check failed. Got TOS: %d, TTL: %d\n", tos, ttl)
+	}
+	if dontFragment(conn) {
+		t.Errorf("Don't fragment check failed, the bit is still set\n")
+	}
+	rp.FreePacket()
+}
+
+// receiveOptions6 reads a packet and returns the traffic class and hop limit it arrived with.
+func receiveOptions6(t *testing.T, conn *net.UDPConn) (tclass, hops int) {
+	buf := make([]byte, 1500)
+	oob := make([]byte, 128)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, oobn, _, _, err := conn.ReadMsgUDP(buf, oob)
+	if err != nil {
+		t.Errorf("ReadMsgUDP failed: %s\n", err)
+		return -1, -1
+	}
+	msgs, _ := syscall.ParseSocketControlMessage(oob[:oobn])
+	tclass, hops = -1, -1
+	for _, m := range msgs {
+		if m.Header.Level != syscall.IPPROTO_IPV6 || len(m.Data) < 4 {
+			continue
+		}
+		value := int(*(*int32)(unsafe.Pointer(&m.Data[0])))
+		switch m.Header.Type {
+		case syscall.IPV6_TCLASS:
+			tclass = value
+		case syscall.IPV6_HOPLIMIT:
+			hops = value
+		}
+	}
+	return
+}
+
+func TestSocketOptionsIpv6(t *testing.T) {
+	parseFlags()
+	loopback := net.IPv6loopback
+	recv, err := net.ListenUDP("udp6", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %s\n", err)
+	}
+	defer recv.Close()
+	rc, _ := recv.SyscallConn()
+	rc.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVTCLASS, 1)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVHOPLIMIT, 1)
+	})
+
+	tp, _ := NewTransportUDP(&net.IPAddr{IP: loopback}, 0)
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		t.Errorf("ListenUDP failed: %s\n", err)
+		return
+	}
+	defer conn.Close()
+	tp.dataConn = conn
+	tp.dataIp = ipv4.NewConn(conn)
+	tp.defaultOptions = SocketOptions{Tos: 0, Ttl: 64}
+	tp.currentOptions = tp.defaultOptions
+
+	dest := &Address{loopback, recv.LocalAddr().(*net.UDPAddr).Port, 0}
+	rp, _ := NewDataPacketFromBuffer(append(make([]byte, rtpHeaderLength), payload...))
+	tp.SetDestinationOptions(dest, &SocketOptions{Set: SockOptTos | SockOptTtl, Tos: iana.DiffServEFPHB, Ttl: 2})
+	tp.WriteDataTo(rp, dest)
+	if tclass, hops := receiveOptions6(t, recv); tclass != iana.DiffServEFPHB || hops != 2 {
+		t.Errorf("IPv6 destination socket options check failed. Got traffic class: %d, hop limit: %d\n", tclass, hops)
+	}
+
+	rp.SetSocketOptions(&SocketOptions{Set: SockOptDontFragment, DontFragment: true})
+	tp.WriteDataTo(rp, dest)
+	receiveOptions6(t, recv)
+	var dontFrag int
+	rc, _ = conn.SyscallConn()
+	rc.Control(func(fd uintptr) {
+		dontFrag, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6DontFrag)
+	})
+	if dontFrag != 1 {
+		t.Errorf("IPv6 don't fragment check failed, IPV6_DONTFRAG is not set\n")
+	}
+	rp.FreePacket()
+}
+
+// statsConsumer hands the received packets to the test, the transport's receiver blocks until
+// the test takes them.
+type statsConsumer struct {
+	teeConsumer
+	data chan *DataPacket
+}
+
+func (sc *statsConsumer) OnRecvData(rp *DataPacket) bool {
+	sc.data <- rp
+	return true
+}
+
+func TestTransportStats(t *testing.T) {
+	parseFlags()
+
+	local := &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	tp, err := NewTransportUDPAutoPorts(local, 0, 0)
+	if err != nil {
+		t.Errorf("NewTransportUDPAutoPorts failed: %s\n", err)
+		return
+	}
+	consumer := &statsConsumer{data: make(chan *DataPacket)}
+	tp.SetCallUpper(consumer)
+	tp.SetEndChannel(make(TransportEnd, 2))
+	tp.dataConn.SetReadBuffer(4096)
+	tp.ListenOnTransports()
+	defer tp.ctrlConn.Close() // closing fails the reads and stops the receivers
+	defer tp.dataConn.Close()
+
+	dataPort, _ := tp.LocalPorts()
+	peer, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: local.IP, Port: dataPort})
+	if err != nil {
+		t.Errorf("DialUDP failed: %s\n", err)
+		return
+	}
+	defer peer.Close()
+	packet := append(make([]byte, rtpHeaderLength), payload...)
+	packet[0] = 0x80
+
+	// a short datagram is dropped
+	peer.Write([]byte{0x80, 0})
+	peer.Write(packet)
+	rp := <-consumer.data
+	if tp.Stats().ShortReads != 1 || rp.InUse() != len(packet) {
+		t.Errorf("Short read check failed. Got: %+v\n", tp.Stats())
+	}
+	// a burst overflows the receive queue while the receiver blocks
+	peer.Write(packet) // the receiver blocks in the upper layer
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i < 200; i++ {
+		peer.Write(packet)
+	}
+	for drained := false; !drained; {
+		select {
+		case <-consumer.data:
+		case <-time.After(50 * time.Millisecond):
+			drained = true
+		}
+	}
+	// the kernel reports the drops with the next packet
+	peer.Write(packet)
+	select {
+	case <-consumer.data:
+	case <-time.After(time.Second):
+	}
+	if tp.Stats().KernelDrops == 0 {
+		t.Errorf("Kernel drops check failed. Got: %+v\n", tp.Stats())
+	}
+
+	// sending to port 0 fails
+	tp.WriteDataTo(rp, &Address{local.IP, 0, 0})
+	if tp.Stats().SendFailures != 1 {
+		t.Errorf("Send failure check failed. Got: %+v\n", tp.Stats())
+	}
+}
+
+func TestTxTimeSend(t *testing.T) {
+	parseFlags()
+
+	tp, _ := NewTransportUDP(&net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}, 54070)
+	recv := &muxConsumer{data: make(chan *DataPacket, 4)}
+	tp.SetCallUpper(recv)
+	if err := tp.ListenOnTransports(); err != nil {
+		t.Errorf("ListenOnTransports failed: %s\n", err)
+		return
+	}
+	defer tp.ctrlConn.Close() // closing fails the reads and stops the receivers
+	defer tp.dataConn.Close()
+	if err := tp.EnableTxTime(5, false); err == nil {
+		t.Errorf("EnableTxTime accepted an unknown clock\n")
+	}
+	if err := tp.EnableTxTime(TxClockMonotonic, false); err != nil {
+		t.Errorf("EnableTxTime failed: %s\n", err)
+		return
+	}
+	rp := newDataPacket()
+	rp.SetPayload([]byte{1, 2, 3, 4})
+	rp.SetTxTime(time.Now().Add(time.Millisecond))
+	if msg := tp.txTimeMessage(&rp.RawPacket); len(msg) != syscall.CmsgSpace(8) {
+		t.Errorf("SCM_TXTIME control message check failed: %d bytes\n", len(msg))
+	}
+	if _, err := tp.WriteDataTo(rp, &Address{net.IPv4(127, 0, 0, 1), 54070, 54071}); err != nil {
+		t.Errorf("write with transmit time failed: %s\n", err)
+	}
+	rp.FreePacket()
+	select {
+	case in := <-recv.data:
+		in.FreePacket()
+	case <-time.After(time.Second):
+		t.Errorf("packet with transmit time not received\n")
+	}
+}
+
+func TestReadThreadAffinity(t *testing.T) {
+	parseFlags()
+
+	// a locked goroutine that exits without unlocking ends its thread
+	done := make(chan uint64)
+	go func() {
+		runtime.LockOSThread()
+		var mask [maxReadThreadCpu / 64]uint64
+		if err := applyReadThread(&ReadThread{Cpus: []int{0}, Nice: 1}); err != nil {
+			t.Errorf("applyReadThread failed: %s\n", err)
+		}
+		syscall.RawSyscall(syscall.SYS_SCHED_GETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask[0])))
+		done <- mask[0]
+	}()
+	if mask := <-done; mask != 1 {
+		t.Errorf("affinity check failed: %x\n", mask)
+	}
+
+	tp, _ := NewTransportUDP(&net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}, 54082)
+	recv := &muxConsumer{data: make(chan *DataPacket, 4)}
+	tp.SetCallUpper(recv)
+	tp.SetReadThread(&ReadThread{Cpus: []int{0}})
+	if err := tp.ListenOnTransports(); err != nil {
+		t.Errorf("ListenOnTransports failed: %s\n", err)
+		return
+	}
+	defer tp.ctrlConn.Close() // closing fails the reads and stops the receivers
+	defer tp.dataConn.Close()
+	rp := newDataPacket()
+	rp.SetPayload([]byte{1, 2, 3, 4})
+	tp.WriteDataTo(rp, &Address{net.IPv4(127, 0, 0, 1), 54082, 54083})
+	rp.FreePacket()
+	select {
+	case in := <-recv.data:
+		in.FreePacket()
+	case <-time.After(time.Second):
+		t.Errorf("packet not received on the pinned read thread\n")
+	}
+	if err := tp.ReadThreadError(); err != nil {
+		t.Errorf("ReadThreadError: %s\n", err)
+	}
+}
+
+func TestMulticastAll(t *testing.T) {
+	parseFlags()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Errorf("ListenUDP failed: %s\n", err)
+		return
+	}
+	defer conn.Close()
+	if err = setMulticastAll(conn, false); err != nil {
+		t.Errorf("setMulticastAll failed: %s\n", err)
+	}
+	rc, _ := conn.SyscallConn()
+	value := -1
+	rc.Control(func(fd uintptr) {
+		value, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, ipMulticastAll)
+	})
+	if value != 0 {
+		t.Errorf("IP_MULTICAST_ALL check failed: %d\n", value)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+//go:build !linux
+// +build !linux
+
+package rtp
+
+import "net"
+
+// controlMessageOptions is false, the transport sets all options on the socket.
+const controlMessageOptions = false
+
+func controlMessages(opts, defaults *SocketOptions, ipv6 bool) []byte {
+	return nil
+}
+
+// setDontFragment is not supported on this platform.
+func setDontFragment(conn *net.UDPConn, on bool) error {
+	return Error("Don't fragment is not supported on this platform.")
+}
+
+// queueDropsSpace is 0, the platform does not report receive queue drops.
+const queueDropsSpace = 0
+
+func enableQueueDrops(conn *net.UDPConn) {
+}
+
+func queueDrops(oob []byte) (uint32, bool) {
+	return 0, false
+}
+
+// msgTruncated returns false, the platform's read flags are not checked.
+func msgTruncated(flags int) bool {
+	return false
+}
+
+// setTxTime is not supported on this platform.
+func setTxTime(conn *net.UDPConn, clock int, deadline bool) error {
+	return Error("SO_TXTIME is not supported on this platform.")
+}
+
+// setMulticastAll does nothing, the sockets of the platform keep their multicast filters.
+func setMulticastAll(conn *net.UDPConn, on bool) error {
+	return nil
+}
+
+func txTimeControl(at int64) []byte {
+	return nil
+}
+
+func clockNow(clock int) int64 {
+	return 0
+}
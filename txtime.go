@@ -0,0 +1,93 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+package rtp
+
+/*
+ * This source file contains the hardware pacing of TransportUDP with SO_TXTIME.
+ */
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// The clocks of the transmit times, see TransportUDP.EnableTxTime. The ETF qdisc and the
+// launch time of network cards use TAI, the fq qdisc uses the monotonic clock.
+const (
+	TxClockTai = iota
+	TxClockMonotonic
+)
+
+// EnableTxTime switches on SO_TXTIME, Linux only. The transport sends each packet with a
+// transmit time, see RawPacket.SetTxTime, as SCM_TXTIME control message and the kernel's ETF or
+// fq qdisc, or the network card's launch time, releases the packet at that time. This removes
+// the scheduling jitter of the sending goroutine, ST 2110 senders need it to fit the narrow
+// sender model. Packets without a transmit time go out immediately.
+//
+// The transport converts the wallclock transmit time of a packet to the clock with the
+// clock's current offset. Configure the qdisc before, for example
+// "tc qdisc replace dev eth0 parent root etf clockid CLOCK_TAI delta 200000 offload". Call
+// EnableTxTime after ListenOnTransports.
+//
+//   clock    - TxClockTai or TxClockMonotonic, the clock of the qdisc
+//   deadline - true selects the deadline mode: the kernel sends the packet as soon as
+//              possible but drops it after the transmit time
+//
+func (tp *TransportUDP) EnableTxTime(clock int, deadline bool) error {
+	if tp.dataConn == nil {
+		return Error("EnableTxTime: the transport does not listen.")
+	}
+	if clock != TxClockTai && clock != TxClockMonotonic {
+		return Error("EnableTxTime: unknown clock.")
+	}
+	if err := setTxTime(tp.dataConn, clock, deadline); err != nil {
+		return err
+	}
+	tp.optMutex.Lock()
+	tp.txClock = clock
+	tp.optMutex.Unlock()
+	atomic.StoreUint32(&tp.txTimeOn, 1)
+	return nil
+}
+
+// ScheduleDataTxTime sends the RTP packet ahead of its transmit time via the session's
+// WriteData and frees it after sending. The packet carries the transmit time, a transport
+// with SO_TXTIME lets the kernel or the network card release it on time, see
+// TransportUDP.EnableTxTime.
+//
+//   rs   - the session that sends the packet
+//   rp   - the RTP packet
+//   at   - the transmit time of the packet
+//   lead - the time the packet goes to the transport before its transmit time, it covers
+//          the scheduling jitter and must be less than the qdisc's horizon
+//
+func (sc *Scheduler) ScheduleDataTxTime(rs *Session, rp *DataPacket, at time.Time, lead time.Duration) {
+	rp.SetTxTime(at)
+	sc.ScheduleData(rs, rp, at.Add(-lead))
+}
+
+// *** Local functions and methods.
+
+// txTimeMessage returns the SCM_TXTIME control message of a packet, nil if the transport does
+// not use SO_TXTIME or the packet has no transmit time.
+func (tp *TransportUDP) txTimeMessage(rp *RawPacket) []byte {
+	if rp.txTime == 0 || atomic.LoadUint32(&tp.txTimeOn) == 0 {
+		return nil
+	}
+	return txTimeControl(rp.txTime - time.Now().UnixNano() + clockNow(tp.txClock))
+}
@@ -0,0 +1,59 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+package rtp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTxTimePacket(t *testing.T) {
+	parseFlags()
+
+	rp := newDataPacket()
+	if !rp.TxTime().IsZero() {
+		t.Errorf("new packet has a transmit time\n")
+	}
+	at := time.Unix(1234, 5678)
+	rp.SetTxTime(at)
+	if !rp.TxTime().Equal(at) {
+		t.Errorf("transmit time check failed: %v\n", rp.TxTime())
+	}
+	rp.FreePacket()
+	rp = newDataPacket()
+	if !rp.TxTime().IsZero() {
+		t.Errorf("reused packet kept its transmit time\n")
+	}
+	rp.FreePacket()
+}
+
+func TestEnableTxTime(t *testing.T) {
+	parseFlags()
+
+	tp, _ := NewTransportUDP(&net.IPAddr{IP: net.IPv4(127, 0, 0, 1)}, 54070)
+	if err := tp.EnableTxTime(TxClockMonotonic, false); err == nil {
+		t.Errorf("EnableTxTime before ListenOnTransports succeeded\n")
+	}
+	rp := newDataPacket()
+	rp.SetTxTime(time.Now())
+	if msg := tp.txTimeMessage(&rp.RawPacket); msg != nil {
+		t.Errorf("control message without SO_TXTIME\n")
+	}
+	rp.FreePacket()
+}
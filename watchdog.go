@@ -0,0 +1,125 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"sync"
+	"time"
+)
+
+// MediaWatchdog calls a function if a session does not receive media for some time.
+//
+// The RTCP service removes a member only after the RFC 3550 member timeout (5 RTCP report
+// intervals, at least 25 seconds). Applications that want to tear down calls with a dead media
+// path earlier use a MediaWatchdog. It checks the input streams of the session and calls the
+// timeout function once for every input stream that neither received RTP nor RTCP packets for
+// the timeout period. If the stream receives packets again the watchdog re-arms for it. If the
+// session has no input stream at all, i.e. the remote never sent anything since the watchdog
+// started, the watchdog calls the function once with a nil StreamInfo.
+//
+type MediaWatchdog struct {
+	rs        *Session
+	timeout   time.Duration
+	onTimeout func(info *StreamInfo)
+
+	mutex sync.Mutex
+	stop  chan bool
+}
+
+// NewMediaWatchdog creates a watchdog for the input streams of a session. It returns an error
+// if the timeout is not positive.
+//
+//   rs        - the session to watch
+//   timeout   - the time without RTP and RTCP packets after which the watchdog fires, e.g. 10 s
+//   onTimeout - the function to call, it runs on the watchdog's goroutine
+//
+func NewMediaWatchdog(rs *Session, timeout time.Duration, onTimeout func(info *StreamInfo)) (*MediaWatchdog, error) {
+	if timeout <= 0 {
+		return nil, Error("MediaWatchdog: timeout must be positive.")
+	}
+	return &MediaWatchdog{rs: rs, timeout: timeout, onTimeout: onTimeout}, nil
+}
+
+// Start starts the watchdog. The timeout period of the first check starts now.
+func (wd *MediaWatchdog) Start() {
+	wd.mutex.Lock()
+	defer wd.mutex.Unlock()
+	if wd.stop != nil {
+		return
+	}
+	wd.stop = make(chan bool)
+	go wd.watch(time.Now(), wd.stop)
+}
+
+// Stop stops the watchdog.
+func (wd *MediaWatchdog) Stop() {
+	wd.mutex.Lock()
+	defer wd.mutex.Unlock()
+	if wd.stop != nil {
+		close(wd.stop)
+		wd.stop = nil
+	}
+}
+
+// watch checks the input streams every quarter of the timeout. The map of fired streams belongs
+// to the goroutine, a restarted watchdog starts with a new one.
+func (wd *MediaWatchdog) watch(start time.Time, stop chan bool) {
+	fired := make(map[uint32]int64) // SSRCs of timed out streams and their last activity
+	tick := wd.timeout / 4
+	if tick <= 0 {
+		tick = wd.timeout
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	silentFired := false
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			infos := wd.rs.InputStreams()
+			if len(infos) == 0 {
+				if !silentFired && now.Sub(start) > wd.timeout {
+					silentFired = true
+					wd.onTimeout(nil)
+				}
+			}
+			present := make(map[uint32]bool, len(infos))
+			for i := range infos {
+				info := &infos[i]
+				present[info.Ssrc] = true
+				if last, ok := fired[info.Ssrc]; ok {
+					if info.LastActivity == last {
+						continue
+					}
+					delete(fired, info.Ssrc) // the stream received packets again
+				}
+				if now.Sub(time.Unix(0, info.LastActivity)) > wd.timeout {
+					fired[info.Ssrc] = info.LastActivity
+					wd.onTimeout(info)
+				}
+			}
+			for ssrc := range fired {
+				if !present[ssrc] {
+					delete(fired, ssrc) // the session removed the stream
+				}
+			}
+		}
+	}
+}
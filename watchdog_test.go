@@ -0,0 +1,78 @@
+// Copyright (C) 2011 Werner Dittmann
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Authors: Werner Dittmann <Werner.Dittmann@t-online.de>
+//
+
+package rtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMediaWatchdog(t *testing.T) {
+	parseFlags()
+	initSessions()
+
+	if _, err := NewMediaWatchdog(rsRecv, 0, nil); err == nil {
+		t.Errorf("Watchdog timeout check failed\n")
+	}
+	fired := make(chan *StreamInfo, 4)
+	wd, _ := NewMediaWatchdog(rsRecv, 40*time.Millisecond, func(info *StreamInfo) { fired <- info })
+	wd.Start()
+	defer wd.Stop()
+
+	// nothing received at all
+	select {
+	case info := <-fired:
+		if info != nil {
+			t.Errorf("Watchdog silent session check failed. Got: %+v\n", info)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Watchdog silent session timeout\n")
+		return
+	}
+	strIdx, _ := rsSender.NewSsrcStreamOut(&Address{senderAddr.IP, senderPort, senderPort + 1}, 0x04030201, 100)
+	rsSender.SsrcStreamOutForIndex(strIdx).SetPayloadType(0)
+	rsRecv.OnRecvData(newSenderPacket(160))
+	receivePacket(t, 0)
+
+	select {
+	case info := <-fired:
+		if info == nil || info.Ssrc != 0x04030201 {
+			t.Errorf("Watchdog stream check failed. Got: %+v\n", info)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Watchdog stream timeout\n")
+		return
+	}
+	// fires once only
+	time.Sleep(100 * time.Millisecond)
+	if len(fired) != 0 {
+		t.Errorf("Watchdog fired %d times more\n", len(fired))
+	}
+	// a restarted watchdog checks the stream again
+	wd.Stop()
+	wd.Start()
+	select {
+	case info := <-fired:
+		if info == nil || info.Ssrc != 0x04030201 {
+			t.Errorf("Watchdog restart check failed. Got: %+v\n", info)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Watchdog restart timeout\n")
+	}
+}